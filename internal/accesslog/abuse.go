@@ -0,0 +1,167 @@
+package accesslog
+
+import (
+	"cmp"
+	"maps"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/najahiiii/xray-agent/internal/config"
+	"github.com/najahiiii/xray-agent/internal/model"
+)
+
+// AbuseOptions are the patterns a Detector looks for.
+type AbuseOptions struct {
+	// TorrentPorts are destination ports BitTorrent peers and trackers use.
+	TorrentPorts config.PortList
+	// BlockedOutbounds are the outbound tags the routing sends forbidden
+	// traffic to, such as geosite or bittorrent protocol rules.
+	BlockedOutbounds []string
+	// MaxConnectionsPerMin is how many connections a user may open in one
+	// minute; 0 or less turns the churn check off.
+	MaxConnectionsPerMin int
+	// MinHits is how many torrent or blocked connections make a violation.
+	MinHits int
+}
+
+// Detector counts the connections of each user that match an abuse pattern
+// until they are flushed. It is safe for concurrent use.
+type Detector struct {
+	opts AbuseOptions
+
+	mu    sync.Mutex
+	from  time.Time
+	users map[string]*abuseUser
+}
+
+type abuseUser struct {
+	hits map[string]*abuseHits
+	// minute and inMinute count the connections of the current minute.
+	minute   time.Time
+	inMinute int
+}
+
+type abuseHits struct {
+	count   int
+	example string
+}
+
+func NewDetector(opts AbuseOptions, now time.Time) *Detector {
+	return &Detector{opts: opts, from: now, users: map[string]*abuseUser{}}
+}
+
+// Add checks e against the patterns. Entries without a user are skipped;
+// entries without a time count toward the current minute.
+func (d *Detector) Add(e Entry) {
+	if !e.Accepted || e.Email == "" {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	u := d.users[e.Email]
+	if u == nil {
+		u = &abuseUser{hits: map[string]*abuseHits{}}
+		d.users[e.Email] = u
+	}
+	dest := net.JoinHostPort(e.Host, strconv.Itoa(e.Port))
+	if d.opts.TorrentPorts.Contains(e.Port) {
+		u.hit(model.AbuseTorrentPort, 1, dest)
+	}
+	if e.Outbound != "" && slices.Contains(d.opts.BlockedOutbounds, e.Outbound) {
+		u.hit(model.AbuseBlockedOutbound, 1, dest)
+	}
+	if d.opts.MaxConnectionsPerMin > 0 {
+		t := e.Time
+		if t.IsZero() {
+			t = time.Now()
+		}
+		if minute := t.Truncate(time.Minute); !minute.Equal(u.minute) {
+			u.minute, u.inMinute = minute, 0
+		}
+		u.inMinute++
+		if u.inMinute > d.opts.MaxConnectionsPerMin {
+			u.peak(u.inMinute)
+		}
+	}
+}
+
+func (u *abuseUser) hit(kind string, n int, example string) {
+	h := u.hits[kind]
+	if h == nil {
+		h = &abuseHits{example: example}
+		u.hits[kind] = h
+	}
+	h.count += n
+}
+
+// peak records n connections in one minute when it is the most seen.
+func (u *abuseUser) peak(n int) {
+	h := u.hits[model.AbuseConnectionChurn]
+	if h == nil {
+		h = &abuseHits{}
+		u.hits[model.AbuseConnectionChurn] = h
+	}
+	h.count = max(h.count, n)
+}
+
+// Flush returns the violations found since the previous flush, or nil when
+// there were none, and starts over. Torrent and blocked connections are
+// violations from MinHits on; a user's connection churn counts as soon as
+// one minute went over the limit. Calling undo puts the flushed counts back.
+func (d *Detector) Flush(now time.Time) (push *model.AbusePush, undo func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	from, users := d.from, d.users
+	d.from, d.users = now, map[string]*abuseUser{}
+	// The minute in progress goes on counting.
+	for email, u := range users {
+		if u.inMinute > 0 {
+			d.users[email] = &abuseUser{hits: map[string]*abuseHits{}, minute: u.minute, inMinute: u.inMinute}
+		}
+	}
+	undo = func() { d.restore(from, users) }
+
+	var violations []model.AbuseViolation
+	for _, email := range slices.Sorted(maps.Keys(users)) {
+		for kind, h := range users[email].hits {
+			if kind != model.AbuseConnectionChurn && h.count < d.opts.MinHits {
+				continue
+			}
+			violations = append(violations, model.AbuseViolation{Email: email, Kind: kind, Count: h.count, Example: h.example})
+		}
+	}
+	if len(violations) == 0 {
+		return nil, undo
+	}
+	slices.SortFunc(violations, func(x, y model.AbuseViolation) int {
+		return cmp.Or(strings.Compare(x.Email, y.Email), strings.Compare(x.Kind, y.Kind))
+	})
+	return &model.AbusePush{ServerTime: now.UTC(), From: from.UTC(), To: now.UTC(), Violations: violations}, undo
+}
+
+// restore merges flushed counts back into the current ones.
+func (d *Detector) restore(from time.Time, users map[string]*abuseUser) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if from.Before(d.from) {
+		d.from = from
+	}
+	for email, old := range users {
+		u := d.users[email]
+		if u == nil {
+			u = &abuseUser{hits: map[string]*abuseHits{}}
+			d.users[email] = u
+		}
+		for kind, h := range old.hits {
+			if kind == model.AbuseConnectionChurn {
+				u.peak(h.count)
+			} else {
+				u.hit(kind, h.count, h.example)
+			}
+		}
+	}
+}
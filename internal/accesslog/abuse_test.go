@@ -0,0 +1,63 @@
+package accesslog
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/najahiiii/xray-agent/internal/config"
+	"github.com/najahiiii/xray-agent/internal/model"
+)
+
+func TestDetectorFindsViolations(t *testing.T) {
+	start := time.Date(2025, 11, 7, 15, 0, 0, 0, time.UTC)
+	d := NewDetector(AbuseOptions{
+		TorrentPorts:         config.PortList{"6881-6889", "51413"},
+		BlockedOutbounds:     []string{"blocked"},
+		MaxConnectionsPerMin: 5,
+		MinHits:              2,
+	}, start)
+
+	at := start.Add(10 * time.Second)
+	add := func(email, host string, port int, outbound string) {
+		d.Add(Entry{Time: at, Accepted: true, Email: email, Host: host, Port: port, Outbound: outbound})
+	}
+	add("a@example.com", "198.51.100.7", 6881, "direct")
+	add("a@example.com", "198.51.100.8", 51413, "direct")
+	add("b@example.com", "tracker.example.com", 6969, "blocked")
+	add("b@example.com", "ads.example.com", 443, "blocked")
+	add("c@example.com", "198.51.100.9", 6885, "direct") // below min_hits
+	for range 6 {
+		add("d@example.com", "example.com", 443, "direct")
+	}
+	d.Add(Entry{Source: "203.0.113.1", Reason: "invalid user"})
+
+	push, undo := d.Flush(start.Add(time.Minute))
+	want := []model.AbuseViolation{
+		{Email: "a@example.com", Kind: model.AbuseTorrentPort, Count: 2, Example: "198.51.100.7:6881"},
+		{Email: "b@example.com", Kind: model.AbuseBlockedOutbound, Count: 2, Example: "tracker.example.com:6969"},
+		{Email: "d@example.com", Kind: model.AbuseConnectionChurn, Count: 6},
+	}
+	if push == nil || !slices.Equal(push.Violations, want) {
+		t.Fatalf("violations = %+v, want %+v", push, want)
+	}
+
+	// Undone counts add up with new ones; the minute in progress goes on.
+	undo()
+	add("c@example.com", "198.51.100.9", 6886, "direct")
+	add("d@example.com", "example.com", 443, "direct")
+	push, _ = d.Flush(start.Add(2 * time.Minute))
+	want = []model.AbuseViolation{
+		{Email: "a@example.com", Kind: model.AbuseTorrentPort, Count: 2, Example: "198.51.100.7:6881"},
+		{Email: "b@example.com", Kind: model.AbuseBlockedOutbound, Count: 2, Example: "tracker.example.com:6969"},
+		{Email: "c@example.com", Kind: model.AbuseTorrentPort, Count: 2, Example: "198.51.100.9:6885"},
+		{Email: "d@example.com", Kind: model.AbuseConnectionChurn, Count: 7},
+	}
+	if push == nil || !slices.Equal(push.Violations, want) || !push.From.Equal(start) {
+		t.Fatalf("after undo = %+v, want %+v from %v", push, want, start)
+	}
+
+	if push, _ := d.Flush(start.Add(3 * time.Minute)); push != nil {
+		t.Fatalf("empty flush = %+v", push)
+	}
+}
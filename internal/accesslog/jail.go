@@ -0,0 +1,122 @@
+package accesslog
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// maxJailSources bounds the client addresses a Jail tracks. A scan from
+// many addresses fills it; addresses past it are not counted until older
+// ones fall out of the window.
+const maxJailSources = 10000
+
+// JailOptions decide when a Jail bans a client address.
+type JailOptions struct {
+	// MaxFailures rejected connections within FindTime make an offense.
+	MaxFailures int
+	FindTime    time.Duration
+	// Ignore are IPs and CIDRs that are never counted. Loopback addresses
+	// never are either.
+	Ignore []string
+}
+
+// Offense is a client address that reached JailOptions.MaxFailures.
+type Offense struct {
+	Addr     netip.Addr
+	Failures int
+	// Reason is why xray rejected the last connection, shortened like in
+	// summaries.
+	Reason string
+}
+
+// Jail counts the connections xray rejected per client address, fail2ban
+// style. It is safe for concurrent use.
+type Jail struct {
+	opts   JailOptions
+	ignore []netip.Prefix
+
+	mu      sync.Mutex
+	sources map[netip.Addr][]time.Time
+}
+
+// NewJail returns a Jail for opts. Ignore entries that do not parse are
+// skipped; the config has validated them.
+func NewJail(opts JailOptions) *Jail {
+	j := &Jail{opts: opts, sources: map[netip.Addr][]time.Time{}}
+	for _, entry := range opts.Ignore {
+		if prefix, err := netip.ParsePrefix(entry); err == nil {
+			j.ignore = append(j.ignore, prefix.Masked())
+		} else if addr, err := netip.ParseAddr(entry); err == nil {
+			j.ignore = append(j.ignore, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+		}
+	}
+	return j
+}
+
+// Add counts e when it is a rejection and returns the offense when its
+// source reached MaxFailures within FindTime. The source's count then
+// starts over, so an address that is not banned offends again only after
+// another MaxFailures. Entries without a time are taken to be from now.
+func (j *Jail) Add(e Entry) (Offense, bool) {
+	if e.Accepted {
+		return Offense{}, false
+	}
+	addr, err := netip.ParseAddr(e.Source)
+	if err != nil {
+		return Offense{}, false
+	}
+	addr = addr.Unmap()
+	if addr.IsLoopback() || j.ignored(addr) {
+		return Offense{}, false
+	}
+	t := e.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	failures, ok := j.sources[addr]
+	if !ok && len(j.sources) >= maxJailSources {
+		j.prune(t)
+		if len(j.sources) >= maxJailSources {
+			return Offense{}, false
+		}
+	}
+	failures = append(j.recent(failures, t), t)
+	if len(failures) < j.opts.MaxFailures {
+		j.sources[addr] = failures
+		return Offense{}, false
+	}
+	delete(j.sources, addr)
+	return Offense{Addr: addr, Failures: len(failures), Reason: reasonOf(e.Reason)}, true
+}
+
+func (j *Jail) ignored(addr netip.Addr) bool {
+	for _, prefix := range j.ignore {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// recent drops the failures older than FindTime before now.
+func (j *Jail) recent(failures []time.Time, now time.Time) []time.Time {
+	cutoff := now.Add(-j.opts.FindTime)
+	i := 0
+	for i < len(failures) && !failures[i].After(cutoff) {
+		i++
+	}
+	return failures[i:]
+}
+
+// prune forgets the sources without failures within FindTime.
+func (j *Jail) prune(now time.Time) {
+	for addr, failures := range j.sources {
+		if len(j.recent(failures, now)) == 0 {
+			delete(j.sources, addr)
+		}
+	}
+}
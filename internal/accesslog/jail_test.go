@@ -0,0 +1,44 @@
+package accesslog
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestJailBansRepeatedRejections(t *testing.T) {
+	j := NewJail(JailOptions{MaxFailures: 3, FindTime: time.Minute, Ignore: []string{"198.51.100.0/24", "2001:db8::1"}})
+	start := time.Date(2025, 11, 7, 15, 0, 0, 0, time.UTC)
+	reject := func(source string, at time.Duration) (Offense, bool) {
+		return j.Add(Entry{Time: start.Add(at), Source: source, Reason: "proxy/vless/encoding: invalid request user id > read tcp"})
+	}
+
+	// Failures spread wider than FindTime do not add up.
+	for i, at := range []time.Duration{0, 40 * time.Second, 90 * time.Second, 100 * time.Second} {
+		if o, ok := reject("203.0.113.5", at); ok {
+			t.Fatalf("failure %d banned %+v too early", i, o)
+		}
+	}
+	o, ok := reject("203.0.113.5", 110*time.Second)
+	want := Offense{Addr: netip.MustParseAddr("203.0.113.5"), Failures: 3, Reason: "proxy/vless/encoding: invalid request user id"}
+	if !ok || o != want {
+		t.Fatalf("offense = %+v, %v; want %+v", o, ok, want)
+	}
+	// The count starts over after an offense.
+	if _, ok := reject("203.0.113.5", 111*time.Second); ok {
+		t.Fatal("offense right after the previous one")
+	}
+
+	for _, source := range []string{"198.51.100.7", "2001:db8::1", "127.0.0.1", "::ffff:127.0.0.1", "not-an-ip"} {
+		for i := range 5 {
+			if o, ok := reject(source, time.Duration(i)*time.Second); ok {
+				t.Fatalf("ignored source %s banned: %+v", source, o)
+			}
+		}
+	}
+	for i := range 5 {
+		if _, ok := j.Add(Entry{Time: start, Accepted: true, Source: "203.0.113.9", Email: "a@example.com"}); ok {
+			t.Fatalf("accepted connection %d counted", i)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+// Package accesslog parses xray's access log and summarizes it per user for
+// the panel.
+package accesslog
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Entry is one access log line: a connection xray accepted, or one it
+// rejected before a user was known.
+type Entry struct {
+	Time time.Time
+	// Source is the client address without its port.
+	Source   string
+	Accepted bool
+	// Network, Host and Port are the destination of an accepted
+	// connection; Host is a domain or an IP address.
+	Network string
+	Host    string
+	Port    int
+	// Inbound and Outbound are the routing tags of an accepted connection;
+	// Outbound is empty when xray did not log one.
+	Inbound  string
+	Outbound string
+	Email    string
+	// Reason is why a connection was rejected.
+	Reason string
+}
+
+// timeLayout is the timestamp xray starts access log lines with; the
+// fraction is only there in newer versions.
+const timeLayout = "2006/01/02 15:04:05.999999"
+
+// Parse reads one access log line, such as
+//
+//	2025/11/07 15:01:00.123456 from 203.0.113.5:51234 accepted tcp:example.com:443 [vless-in >> direct] email: a@example.com
+//	2025/11/07 15:01:02 from tcp:198.51.100.9:40000 rejected  proxy/vless/encoding: invalid request user id
+//
+// Both the ">>" and "->" route separators and a "tcp:" prefix on the source
+// are accepted. Times are taken as local time, like xray writes them. ok is
+// false for lines that are not access log entries.
+func Parse(line string) (Entry, bool) {
+	stamp, rest, ok := strings.Cut(line, " from ")
+	if !ok {
+		return Entry{}, false
+	}
+	var e Entry
+	if t, err := time.ParseInLocation(timeLayout, strings.TrimSpace(stamp), time.Local); err == nil {
+		e.Time = t
+	}
+
+	source, rest, _ := strings.Cut(rest, " ")
+	e.Source = hostOf(source)
+	if e.Source == "" {
+		return Entry{}, false
+	}
+	verdict, rest, _ := strings.Cut(rest, " ")
+	switch verdict {
+	case "rejected":
+		e.Reason = strings.TrimSpace(rest)
+		return e, true
+	case "accepted":
+		e.Accepted = true
+	default:
+		return Entry{}, false
+	}
+
+	dest, rest, _ := strings.Cut(strings.TrimSpace(rest), " ")
+	network, hostport, ok := strings.Cut(dest, ":")
+	if !ok {
+		return Entry{}, false
+	}
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return Entry{}, false
+	}
+	e.Network, e.Host = network, host
+	e.Port, _ = strconv.Atoi(port)
+
+	rest = strings.TrimSpace(rest)
+	if strings.HasPrefix(rest, "[") {
+		route, after, _ := strings.Cut(rest[1:], "]")
+		rest = strings.TrimSpace(after)
+		in, out, ok := strings.Cut(route, " >> ")
+		if !ok {
+			in, out, _ = strings.Cut(route, " -> ")
+		}
+		e.Inbound, e.Outbound = strings.TrimSpace(in), strings.TrimSpace(out)
+	}
+	if email, ok := strings.CutPrefix(rest, "email:"); ok {
+		e.Email = strings.ToLower(strings.TrimSpace(email))
+	}
+	return e, true
+}
+
+// hostOf strips the network prefix and port off an access log address.
+func hostOf(addr string) string {
+	for _, prefix := range []string{"tcp:", "udp:"} {
+		addr = strings.TrimPrefix(addr, prefix)
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.Trim(addr, "[]")
+}
@@ -0,0 +1,61 @@
+package accesslog
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	for _, tc := range []struct {
+		line string
+		want Entry
+		ok   bool
+	}{
+		{
+			line: "2025/11/07 15:01:00.123456 from 203.0.113.5:51234 accepted tcp:example.com:443 [vless-in >> direct] email: A@Example.com",
+			want: Entry{
+				Time:   time.Date(2025, 11, 7, 15, 1, 0, 123456000, time.Local),
+				Source: "203.0.113.5", Accepted: true,
+				Network: "tcp", Host: "example.com", Port: 443,
+				Inbound: "vless-in", Outbound: "direct", Email: "a@example.com",
+			},
+			ok: true,
+		},
+		{
+			line: "2025/11/07 15:01:01 from tcp:[2001:db8::5]:40000 accepted udp:[2001:4860:4860::8888]:53 [vmess-ws -> block] email: b@example.com",
+			want: Entry{
+				Time:   time.Date(2025, 11, 7, 15, 1, 1, 0, time.Local),
+				Source: "2001:db8::5", Accepted: true,
+				Network: "udp", Host: "2001:4860:4860::8888", Port: 53,
+				Inbound: "vmess-ws", Outbound: "block", Email: "b@example.com",
+			},
+			ok: true,
+		},
+		{
+			line: "2025/11/07 15:01:02 from 198.51.100.9:40000 accepted tcp:10.0.0.1:80 [dokodemo]",
+			want: Entry{
+				Time:   time.Date(2025, 11, 7, 15, 1, 2, 0, time.Local),
+				Source: "198.51.100.9", Accepted: true,
+				Network: "tcp", Host: "10.0.0.1", Port: 80, Inbound: "dokodemo",
+			},
+			ok: true,
+		},
+		{
+			line: "2025/11/07 15:01:03 from tcp:198.51.100.9:40000 rejected  proxy/vless/encoding: invalid request user id > common/drain: drained connection",
+			want: Entry{
+				Time:   time.Date(2025, 11, 7, 15, 1, 3, 0, time.Local),
+				Source: "198.51.100.9",
+				Reason: "proxy/vless/encoding: invalid request user id > common/drain: drained connection",
+			},
+			ok: true,
+		},
+		{line: "2025/11/07 15:01:04 [Info] app/dispatcher: taking detour [direct] for [tcp:example.com:443]"},
+		{line: "2025/11/07 15:01:05 from 198.51.100.9:40000 accepted nonsense"},
+		{line: ""},
+	} {
+		got, ok := Parse(tc.line)
+		if ok != tc.ok || got != tc.want {
+			t.Errorf("Parse(%q) =\n  %+v, %v\nwant\n  %+v, %v", tc.line, got, ok, tc.want, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package accesslog
+
+import (
+	"cmp"
+	"maps"
+	"net/netip"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/najahiiii/xray-agent/internal/config"
+	"github.com/najahiiii/xray-agent/internal/model"
+)
+
+const (
+	// maxTracked bounds the distinct sources and destinations kept per user,
+	// and the distinct rejections, between two flushes. Entries past it are
+	// still counted as connections.
+	maxTracked = 1000
+	// maxRejections is how many distinct rejections a push lists.
+	maxRejections = 100
+)
+
+// Options are the privacy filters of a Summary.
+type Options struct {
+	// Destinations is full (hosts as logged), domain (the registrable
+	// domain, IPs masked to /24 or /48) or none.
+	Destinations string
+	// TopDestinations is how many destinations are listed per user.
+	TopDestinations int
+	// Exclude are shell patterns of hosts that are never listed.
+	Exclude []string
+	// Sources is full, masked (/24 or /48) or none, for rejections.
+	Sources string
+}
+
+// Summary aggregates access log entries per user until they are flushed.
+// It is safe for concurrent use.
+type Summary struct {
+	opts Options
+
+	mu         sync.Mutex
+	from       time.Time
+	users      map[string]*userSummary
+	rejections map[rejection]int
+}
+
+type userSummary struct {
+	connections  int
+	sources      map[string]bool
+	destinations map[string]int
+}
+
+type rejection struct {
+	source string
+	reason string
+}
+
+func NewSummary(opts Options, now time.Time) *Summary {
+	return &Summary{
+		opts:       opts,
+		from:       now,
+		users:      map[string]*userSummary{},
+		rejections: map[rejection]int{},
+	}
+}
+
+// Add counts e. Accepted connections without a user, from inbounds that have
+// none, are skipped.
+func (s *Summary) Add(e Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !e.Accepted {
+		key := rejection{source: s.source(e.Source), reason: reasonOf(e.Reason)}
+		if _, ok := s.rejections[key]; ok || len(s.rejections) < maxTracked {
+			s.rejections[key]++
+		}
+		return
+	}
+	if e.Email == "" {
+		return
+	}
+	u := s.users[e.Email]
+	if u == nil {
+		u = &userSummary{sources: map[string]bool{}, destinations: map[string]int{}}
+		s.users[e.Email] = u
+	}
+	u.connections++
+	if len(u.sources) < maxTracked {
+		u.sources[e.Source] = true
+	}
+	if host := s.destination(e.Host); host != "" {
+		if _, ok := u.destinations[host]; ok || len(u.destinations) < maxTracked {
+			u.destinations[host]++
+		}
+	}
+}
+
+// Flush returns what was added since the previous flush, or nil when
+// nothing was, and starts over. Calling undo puts the flushed entries back,
+// for when the panel did not take them.
+func (s *Summary) Flush(now time.Time) (push *model.AccessLogPush, undo func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	from, users, rejections := s.from, s.users, s.rejections
+	s.from, s.users, s.rejections = now, map[string]*userSummary{}, map[rejection]int{}
+	undo = func() { s.restore(from, users, rejections) }
+	if len(users) == 0 && len(rejections) == 0 {
+		return nil, undo
+	}
+
+	push = &model.AccessLogPush{ServerTime: now.UTC(), From: from.UTC(), To: now.UTC()}
+	for _, email := range slices.Sorted(maps.Keys(users)) {
+		u := users[email]
+		push.Users = append(push.Users, model.AccessLogUser{
+			Email:        email,
+			Connections:  u.connections,
+			Sources:      len(u.sources),
+			Destinations: topDestinations(u.destinations, s.opts.TopDestinations),
+		})
+	}
+	for key, count := range rejections {
+		push.Rejections = append(push.Rejections, model.AccessLogRejection{Source: key.source, Reason: key.reason, Count: count})
+	}
+	slices.SortFunc(push.Rejections, func(x, y model.AccessLogRejection) int {
+		return cmp.Or(cmp.Compare(y.Count, x.Count), strings.Compare(x.Source, y.Source), strings.Compare(x.Reason, y.Reason))
+	})
+	if len(push.Rejections) > maxRejections {
+		push.Rejections = push.Rejections[:maxRejections]
+	}
+	return push, undo
+}
+
+// restore merges flushed entries back into the current ones.
+func (s *Summary) restore(from time.Time, users map[string]*userSummary, rejections map[rejection]int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if from.Before(s.from) {
+		s.from = from
+	}
+	for email, old := range users {
+		u := s.users[email]
+		if u == nil {
+			s.users[email] = old
+			continue
+		}
+		u.connections += old.connections
+		for src := range old.sources {
+			if len(u.sources) < maxTracked {
+				u.sources[src] = true
+			}
+		}
+		for host, n := range old.destinations {
+			if _, ok := u.destinations[host]; ok || len(u.destinations) < maxTracked {
+				u.destinations[host] += n
+			}
+		}
+	}
+	for key, n := range rejections {
+		if _, ok := s.rejections[key]; ok || len(s.rejections) < maxTracked {
+			s.rejections[key] += n
+		}
+	}
+}
+
+// destination returns host as the Destinations option allows it to be
+// reported, or "" when it is not.
+func (s *Summary) destination(host string) string {
+	if host == "" || s.opts.Destinations == config.AccessLogNone {
+		return ""
+	}
+	for _, pattern := range s.opts.Exclude {
+		if ok, _ := path.Match(pattern, host); ok {
+			return ""
+		}
+	}
+	if s.opts.Destinations != config.AccessLogDomain {
+		return host
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return maskAddr(addr)
+	}
+	return registrableDomain(host)
+}
+
+// source returns a rejected client's address as the Sources option allows.
+func (s *Summary) source(addr string) string {
+	switch s.opts.Sources {
+	case config.AccessLogNone:
+		return ""
+	case config.AccessLogMasked:
+		if a, err := netip.ParseAddr(addr); err == nil {
+			return maskAddr(a)
+		}
+	}
+	return addr
+}
+
+// maskAddr returns the /24 or /48 network of addr.
+func maskAddr(addr netip.Addr) string {
+	addr = addr.Unmap()
+	bits := 48
+	if addr.Is4() {
+		bits = 24
+	}
+	prefix, _ := addr.Prefix(bits)
+	return prefix.String()
+}
+
+// countrySecondLevel are the second-level labels that country code domains
+// commonly register names under, as in co.uk and com.au.
+var countrySecondLevel = []string{"ac", "co", "com", "edu", "gov", "net", "or", "org"}
+
+// registrableDomain approximates the domain a name was registered under:
+// its last two labels, or three under a country code second-level domain.
+func registrableDomain(host string) string {
+	labels := strings.Split(strings.TrimSuffix(host, "."), ".")
+	n := 2
+	if len(labels) > 2 && len(labels[len(labels)-1]) == 2 && slices.Contains(countrySecondLevel, labels[len(labels)-2]) {
+		n = 3
+	}
+	if len(labels) <= n {
+		return host
+	}
+	return strings.Join(labels[len(labels)-n:], ".")
+}
+
+// reasonOf drops the error chain after the first " > ", which holds
+// addresses and other details that differ between otherwise equal
+// rejections.
+func reasonOf(reason string) string {
+	first, _, _ := strings.Cut(reason, " > ")
+	return strings.TrimSpace(first)
+}
+
+func topDestinations(counts map[string]int, top int) []model.AccessLogDestination {
+	if top <= 0 || len(counts) == 0 {
+		return nil
+	}
+	out := make([]model.AccessLogDestination, 0, len(counts))
+	for host, n := range counts {
+		out = append(out, model.AccessLogDestination{Host: host, Connections: n})
+	}
+	slices.SortFunc(out, func(x, y model.AccessLogDestination) int {
+		return cmp.Or(cmp.Compare(y.Connections, x.Connections), strings.Compare(x.Host, y.Host))
+	})
+	if len(out) > top {
+		out = out[:top]
+	}
+	return out
+}
@@ -0,0 +1,107 @@
+package accesslog
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/najahiiii/xray-agent/internal/config"
+	"github.com/najahiiii/xray-agent/internal/model"
+)
+
+func TestSummaryPrivacy(t *testing.T) {
+	entries := []Entry{
+		{Accepted: true, Email: "a@example.com", Source: "203.0.113.5", Host: "www.example.com"},
+		{Accepted: true, Email: "a@example.com", Source: "203.0.113.5", Host: "cdn.example.com"},
+		{Accepted: true, Email: "a@example.com", Source: "203.0.113.6", Host: "news.bbc.co.uk"},
+		{Accepted: true, Email: "a@example.com", Source: "203.0.113.6", Host: "198.51.100.77"},
+		{Accepted: true, Email: "a@example.com", Source: "203.0.113.6", Host: "bank.internal"},
+		{Accepted: true, Source: "203.0.113.9", Host: "skipped.example.com"},
+		{Source: "198.51.100.9", Reason: "invalid request user id > drained"},
+		{Source: "198.51.100.10", Reason: "invalid request user id > other"},
+	}
+	for _, tc := range []struct {
+		name         string
+		opts         Options
+		destinations []model.AccessLogDestination
+		rejections   []model.AccessLogRejection
+	}{
+		{
+			name: "domain and masked",
+			opts: Options{Destinations: config.AccessLogDomain, Sources: config.AccessLogMasked, TopDestinations: 20, Exclude: []string{"*.internal"}},
+			destinations: []model.AccessLogDestination{
+				{Host: "example.com", Connections: 2},
+				{Host: "198.51.100.0/24", Connections: 1},
+				{Host: "bbc.co.uk", Connections: 1},
+			},
+			rejections: []model.AccessLogRejection{{Source: "198.51.100.0/24", Reason: "invalid request user id", Count: 2}},
+		},
+		{
+			name: "full, top two",
+			opts: Options{Destinations: config.AccessLogFull, Sources: config.AccessLogFull, TopDestinations: 2},
+			destinations: []model.AccessLogDestination{
+				{Host: "198.51.100.77", Connections: 1},
+				{Host: "bank.internal", Connections: 1},
+			},
+			rejections: []model.AccessLogRejection{
+				{Source: "198.51.100.10", Reason: "invalid request user id", Count: 1},
+				{Source: "198.51.100.9", Reason: "invalid request user id", Count: 1},
+			},
+		},
+		{
+			name:       "none",
+			opts:       Options{Destinations: config.AccessLogNone, Sources: config.AccessLogNone, TopDestinations: 20},
+			rejections: []model.AccessLogRejection{{Reason: "invalid request user id", Count: 2}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			start := time.Now()
+			s := NewSummary(tc.opts, start)
+			for _, e := range entries {
+				s.Add(e)
+			}
+			push, _ := s.Flush(start.Add(time.Minute))
+			if push == nil || len(push.Users) != 1 {
+				t.Fatalf("push = %+v", push)
+			}
+			u := push.Users[0]
+			if u.Email != "a@example.com" || u.Connections != 5 || u.Sources != 2 {
+				t.Fatalf("user = %+v", u)
+			}
+			if !slices.Equal(u.Destinations, tc.destinations) {
+				t.Fatalf("destinations = %+v, want %+v", u.Destinations, tc.destinations)
+			}
+			if !slices.Equal(push.Rejections, tc.rejections) {
+				t.Fatalf("rejections = %+v, want %+v", push.Rejections, tc.rejections)
+			}
+		})
+	}
+}
+
+func TestSummaryFlushUndo(t *testing.T) {
+	start := time.Now()
+	s := NewSummary(Options{Destinations: config.AccessLogFull, TopDestinations: 5}, start)
+	if push, _ := s.Flush(start); push != nil {
+		t.Fatalf("empty summary flushed %+v", push)
+	}
+
+	s.Add(Entry{Accepted: true, Email: "a@example.com", Source: "203.0.113.5", Host: "example.com"})
+	push, undo := s.Flush(start.Add(time.Minute))
+	if push == nil || push.Users[0].Connections != 1 {
+		t.Fatalf("push = %+v", push)
+	}
+	s.Add(Entry{Accepted: true, Email: "a@example.com", Source: "203.0.113.6", Host: "example.com"})
+	undo()
+
+	push, _ = s.Flush(start.Add(2 * time.Minute))
+	if push == nil || !push.From.Equal(start.UTC()) {
+		t.Fatalf("push after undo = %+v, want it to start at %v", push, start)
+	}
+	want := model.AccessLogUser{Email: "a@example.com", Connections: 2, Sources: 2, Destinations: []model.AccessLogDestination{{Host: "example.com", Connections: 2}}}
+	if got := push.Users[0]; got.Email != want.Email || got.Connections != want.Connections || got.Sources != want.Sources || !slices.Equal(got.Destinations, want.Destinations) {
+		t.Fatalf("user after undo = %+v, want %+v", got, want)
+	}
+	if push, _ := s.Flush(start.Add(3 * time.Minute)); push != nil {
+		t.Fatalf("flushed twice: %+v", push)
+	}
+}
@@ -0,0 +1,371 @@
+// Package acme obtains certificates from an ACME CA such as Let's Encrypt,
+// proving control of each domain with HTTP-01 or TLS-ALPN-01 challenges.
+// HTTP-01 challenges are answered by a short-lived listener (port 80 is
+// usually free next to xray) or by files under a web server's root;
+// TLS-ALPN-01 ones by a short-lived TLS listener, for nodes where only 443
+// is reachable.
+//
+// It is built on golang.org/x/crypto/acme rather than a full client such as
+// lego, which would pull dozens of DNS provider SDKs into the agent. The
+// cost is that DNS-01, and with it wildcard certificates, is not supported.
+package acme
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+const (
+	DefaultDirectory = acme.LetsEncryptURL
+	DefaultHTTPAddr  = ":80"
+	DefaultTLSAddr   = ":443"
+)
+
+// Challenge types an Issuer can answer.
+const (
+	ChallengeHTTP01    = "http-01"
+	ChallengeTLSALPN01 = "tls-alpn-01"
+)
+
+const challengePrefix = "/.well-known/acme-challenge/"
+
+type Options struct {
+	// Directory is the CA's ACME directory URL.
+	Directory string
+	// Email is registered as the account contact; Let's Encrypt sends expiry
+	// notices there. Optional.
+	Email string
+	// AccountKeyFile holds the account's private key. It is created on first
+	// use and must be kept, since the CA rate-limits new accounts.
+	AccountKeyFile string
+	// HTTPAddr is where challenges are served while a certificate is being
+	// obtained, unless Webroot is set.
+	HTTPAddr string
+	// Webroot makes challenges files under <Webroot>/.well-known/acme-challenge
+	// for a web server that already owns port 80.
+	Webroot string
+	// Challenge is ChallengeHTTP01 (the default) or ChallengeTLSALPN01.
+	Challenge string
+	// TLSAddr is where TLS-ALPN-01 challenges are served while a certificate
+	// is being obtained.
+	TLSAddr string
+	Logger  *slog.Logger
+}
+
+// Issuer obtains certificates one at a time.
+type Issuer struct {
+	opts Options
+
+	mu     sync.Mutex
+	client *acme.Client
+
+	tokensMu sync.Mutex
+	tokens   map[string]string
+	// alpnCerts are the TLS-ALPN-01 challenge certificates by domain.
+	alpnCerts map[string]*tls.Certificate
+}
+
+func New(opts Options) *Issuer {
+	if opts.Directory == "" {
+		opts.Directory = DefaultDirectory
+	}
+	if opts.HTTPAddr == "" {
+		opts.HTTPAddr = DefaultHTTPAddr
+	}
+	if opts.Challenge == "" {
+		opts.Challenge = ChallengeHTTP01
+	}
+	if opts.TLSAddr == "" {
+		opts.TLSAddr = DefaultTLSAddr
+	}
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+	return &Issuer{opts: opts, tokens: map[string]string{}, alpnCerts: map[string]*tls.Certificate{}}
+}
+
+// Obtain gets a certificate covering domains and returns the PEM chain and a
+// new PEM private key.
+func (i *Issuer) Obtain(ctx context.Context, domains ...string) (certPEM, keyPEM []byte, err error) {
+	if len(domains) == 0 {
+		return nil, nil, errors.New("acme: no domains")
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	client, err := i.account(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(domains...))
+	if err != nil {
+		return nil, nil, fmt.Errorf("acme: new order: %w", err)
+	}
+
+	if order.Status != acme.StatusReady && order.Status != acme.StatusValid {
+		stop, err := i.serveChallenges(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = i.authorize(ctx, client, order.AuthzURLs)
+		stop()
+		if err != nil {
+			return nil, nil, err
+		}
+		if order, err = client.WaitOrder(ctx, order.URI); err != nil {
+			return nil, nil, fmt.Errorf("acme: wait order: %w", err)
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		DNSNames: domains,
+	}, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, nil, fmt.Errorf("acme: finalize order: %w", err)
+	}
+	for _, der := range chain {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	keyPEM, err = marshalKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return certPEM, keyPEM, nil
+}
+
+// ServeHTTP answers HTTP-01 challenges for the order in progress.
+func (i *Issuer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token, ok := strings.CutPrefix(r.URL.Path, challengePrefix)
+	i.tokensMu.Lock()
+	body, found := i.tokens[token]
+	i.tokensMu.Unlock()
+	if !ok || !found {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	_, _ = w.Write([]byte(body))
+}
+
+// GetCertificate answers TLS-ALPN-01 challenges for the order in progress;
+// it only serves connections that negotiate the acme-tls/1 protocol.
+func (i *Issuer) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if !slices.Contains(hello.SupportedProtos, acme.ALPNProto) {
+		return nil, errors.New("acme: not an acme-tls/1 connection")
+	}
+	i.tokensMu.Lock()
+	cert, ok := i.alpnCerts[strings.ToLower(hello.ServerName)]
+	i.tokensMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("acme: no challenge for %q", hello.ServerName)
+	}
+	return cert, nil
+}
+
+// account returns a client for the registered account, registering it and
+// creating its key on first use.
+func (i *Issuer) account(ctx context.Context) (*acme.Client, error) {
+	if i.client != nil {
+		return i.client, nil
+	}
+	key, err := loadOrCreateKey(i.opts.AccountKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("acme: account key: %w", err)
+	}
+	client := &acme.Client{Key: key, DirectoryURL: i.opts.Directory, UserAgent: "xray-agent"}
+	acct := &acme.Account{}
+	if i.opts.Email != "" {
+		acct.Contact = []string{"mailto:" + i.opts.Email}
+	}
+	if _, err := client.Register(ctx, acct, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return nil, fmt.Errorf("acme: register account: %w", err)
+	}
+	i.client = client
+	return client, nil
+}
+
+func (i *Issuer) authorize(ctx context.Context, client *acme.Client, urls []string) error {
+	for _, url := range urls {
+		authz, err := client.GetAuthorization(ctx, url)
+		if err != nil {
+			return fmt.Errorf("acme: get authorization: %w", err)
+		}
+		if authz.Status == acme.StatusValid {
+			continue
+		}
+		var chal *acme.Challenge
+		for _, c := range authz.Challenges {
+			if c.Type == i.opts.Challenge {
+				chal = c
+				break
+			}
+		}
+		if chal == nil {
+			return fmt.Errorf("acme: %s: CA offered no %s challenge", authz.Identifier.Value, i.opts.Challenge)
+		}
+		cleanup, err := i.publish(client, chal, authz.Identifier.Value)
+		if err != nil {
+			return err
+		}
+		if _, err := client.Accept(ctx, chal); err != nil {
+			cleanup()
+			return fmt.Errorf("acme: %s: accept challenge: %w", authz.Identifier.Value, err)
+		}
+		_, err = client.WaitAuthorization(ctx, authz.URI)
+		cleanup()
+		if err != nil {
+			return fmt.Errorf("acme: %s: %w", authz.Identifier.Value, err)
+		}
+		i.opts.Logger.Info("acme domain validated", "domain", authz.Identifier.Value)
+	}
+	return nil
+}
+
+// publish makes the challenge response available until cleanup is called.
+func (i *Issuer) publish(client *acme.Client, chal *acme.Challenge, domain string) (cleanup func(), err error) {
+	if chal.Type == ChallengeTLSALPN01 {
+		cert, err := client.TLSALPN01ChallengeCert(chal.Token, domain)
+		if err != nil {
+			return nil, err
+		}
+		domain = strings.ToLower(domain)
+		i.tokensMu.Lock()
+		i.alpnCerts[domain] = &cert
+		i.tokensMu.Unlock()
+		return func() {
+			i.tokensMu.Lock()
+			delete(i.alpnCerts, domain)
+			i.tokensMu.Unlock()
+		}, nil
+	}
+
+	token := chal.Token
+	body, err := client.HTTP01ChallengeResponse(token)
+	if err != nil {
+		return nil, err
+	}
+	if i.opts.Webroot != "" {
+		path := filepath.Join(i.opts.Webroot, filepath.FromSlash(challengePrefix), token)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+			return nil, err
+		}
+		return func() { _ = os.Remove(path) }, nil
+	}
+	i.tokensMu.Lock()
+	i.tokens[token] = body
+	i.tokensMu.Unlock()
+	return func() {
+		i.tokensMu.Lock()
+		delete(i.tokens, token)
+		i.tokensMu.Unlock()
+	}, nil
+}
+
+// serveChallenges starts the challenge listener unless a webroot is used.
+func (i *Issuer) serveChallenges(ctx context.Context) (stop func(), err error) {
+	if i.opts.Challenge == ChallengeTLSALPN01 {
+		ln, err := (&net.ListenConfig{}).Listen(ctx, "tcp", i.opts.TLSAddr)
+		if err != nil {
+			return nil, fmt.Errorf("acme: listen for tls-alpn-01 challenges: %w", err)
+		}
+		ln = tls.NewListener(ln, &tls.Config{
+			GetCertificate: i.GetCertificate,
+			NextProtos:     []string{acme.ALPNProto},
+			MinVersion:     tls.VersionTLS12,
+		})
+		go serveALPN(ln)
+		return func() { _ = ln.Close() }, nil
+	}
+	if i.opts.Webroot != "" {
+		return func() {}, nil
+	}
+	ln, err := (&net.ListenConfig{}).Listen(ctx, "tcp", i.opts.HTTPAddr)
+	if err != nil {
+		return nil, fmt.Errorf("acme: listen for http-01 challenges: %w", err)
+	}
+	srv := &http.Server{Handler: i, ReadHeaderTimeout: 10 * time.Second}
+	go func() { _ = srv.Serve(ln) }()
+	return func() { _ = srv.Close() }, nil
+}
+
+// serveALPN completes the handshake of each connection, which is all a
+// TLS-ALPN-01 validation needs, and closes it.
+func serveALPN(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+			_ = conn.(*tls.Conn).Handshake()
+		}()
+	}
+}
+
+func loadOrCreateKey(path string) (crypto.Signer, error) {
+	if data, err := os.ReadFile(path); err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("%s: no PEM key", path)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	data, err := marshalKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func marshalKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
@@ -0,0 +1,287 @@
+package acme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeCA is a minimal RFC 8555 server. It does not check request signatures;
+// it validates the challenge of chalType by calling validate with the
+// http-01 challenge path and issues certificates from a throwaway root.
+type fakeCA struct {
+	t        *testing.T
+	srv      *httptest.Server
+	chalType string
+	validate func(path string) string
+
+	mu        sync.Mutex
+	domain    string
+	validated bool
+	accounts  int
+	chain     []byte
+}
+
+func newFakeCA(t *testing.T, validate func(path string) string) *fakeCA {
+	ca := &fakeCA{t: t, chalType: ChallengeHTTP01, validate: validate}
+	ca.srv = httptest.NewServer(http.HandlerFunc(ca.serve))
+	t.Cleanup(ca.srv.Close)
+	return ca
+}
+
+func (ca *fakeCA) serve(w http.ResponseWriter, r *http.Request) {
+	url := ca.srv.URL
+	w.Header().Set("Replay-Nonce", "nonce")
+	var payload []byte
+	if r.Method == http.MethodPost {
+		var jws struct {
+			Payload string `json:"payload"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+			ca.t.Errorf("decode JWS: %v", err)
+		}
+		payload, _ = base64.RawURLEncoding.DecodeString(jws.Payload)
+	}
+
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	authzStatus := "pending"
+	if ca.validated {
+		authzStatus = "valid"
+	}
+	reply := func(code int, v any) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(v)
+	}
+	challenge := map[string]any{"type": ca.chalType, "url": url + "/chal", "token": "tok", "status": authzStatus}
+
+	switch r.URL.Path {
+	case "/dir":
+		reply(http.StatusOK, map[string]any{"newNonce": url + "/nonce", "newAccount": url + "/acct", "newOrder": url + "/order"})
+	case "/nonce":
+		w.WriteHeader(http.StatusOK)
+	case "/acct":
+		ca.accounts++
+		w.Header().Set("Location", url+"/acct/1")
+		reply(http.StatusCreated, map[string]any{"status": "valid"})
+	case "/order":
+		var req struct {
+			Identifiers []struct{ Value string } `json:"identifiers"`
+		}
+		json.Unmarshal(payload, &req)
+		ca.domain = req.Identifiers[0].Value
+		w.Header().Set("Location", url+"/order/1")
+		reply(http.StatusCreated, ca.order("pending"))
+	case "/order/1":
+		w.Header().Set("Location", url+"/order/1")
+		status := "pending"
+		if ca.validated {
+			status = "ready"
+		}
+		reply(http.StatusOK, ca.order(status))
+	case "/authz":
+		reply(http.StatusOK, map[string]any{
+			"status":     authzStatus,
+			"identifier": map[string]string{"type": "dns", "value": ca.domain},
+			"challenges": []any{challenge},
+		})
+	case "/chal":
+		body := ca.validate("/.well-known/acme-challenge/tok")
+		ca.validated = strings.HasPrefix(body, "tok.")
+		challenge["status"] = "processing"
+		reply(http.StatusOK, challenge)
+	case "/finalize":
+		var req struct {
+			CSR string `json:"csr"`
+		}
+		json.Unmarshal(payload, &req)
+		der, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+		ca.chain = ca.issue(der)
+		w.Header().Set("Location", url+"/order/1")
+		reply(http.StatusOK, ca.order("valid"))
+	case "/cert":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(ca.chain)
+	default:
+		ca.t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (ca *fakeCA) order(status string) map[string]any {
+	url := ca.srv.URL
+	return map[string]any{
+		"status":         status,
+		"identifiers":    []any{map[string]string{"type": "dns", "value": ca.domain}},
+		"authorizations": []string{url + "/authz"},
+		"finalize":       url + "/finalize",
+		"certificate":    url + "/cert",
+	}
+}
+
+func (ca *fakeCA) issue(csrDER []byte) []byte {
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		ca.t.Errorf("parse CSR: %v", err)
+		return nil
+	}
+	rootKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	root := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fake root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	rootDER, _ := x509.CreateCertificate(rand.Reader, root, root, &rootKey.PublicKey, rootKey)
+	leaf := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leaf, root, csr.PublicKey, rootKey)
+	if err != nil {
+		ca.t.Errorf("issue: %v", err)
+		return nil
+	}
+	return append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leafDER}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: rootDER})...)
+}
+
+func TestObtainAnswersHTTP01AndReusesAccount(t *testing.T) {
+	var issuer *Issuer
+	ca := newFakeCA(t, func(path string) string {
+		rec := httptest.NewRecorder()
+		issuer.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec.Body.String()
+	})
+	keyFile := filepath.Join(t.TempDir(), "acme_account.key")
+	issuer = New(Options{
+		Directory:      ca.srv.URL + "/dir",
+		Email:          "ops@example.com",
+		AccountKeyFile: keyFile,
+		HTTPAddr:       "127.0.0.1:0",
+		Logger:         slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+
+	certPEM, keyPEM, err := issuer.Obtain(context.Background(), "edge.example.com")
+	if err != nil {
+		t.Fatalf("Obtain: %v", err)
+	}
+	block, _ := pem.Decode(certPEM)
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil || leaf.VerifyHostname("edge.example.com") != nil {
+		t.Fatalf("leaf = %v, err = %v", leaf.DNSNames, err)
+	}
+	if !strings.Contains(string(keyPEM), "PRIVATE KEY") {
+		t.Fatalf("key = %q", keyPEM)
+	}
+	if info, err := os.Stat(keyFile); err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("account key: %v", err)
+	}
+
+	// The challenge is only served while the order is in progress.
+	rec := httptest.NewRecorder()
+	issuer.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/.well-known/acme-challenge/tok", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("challenge still served: %d", rec.Code)
+	}
+
+	if _, _, err := issuer.Obtain(context.Background(), "edge.example.com"); err != nil {
+		t.Fatalf("second Obtain: %v", err)
+	}
+	if ca.accounts != 1 {
+		t.Fatalf("registered %d accounts", ca.accounts)
+	}
+}
+
+func TestObtainWritesWebrootChallenge(t *testing.T) {
+	webroot := t.TempDir()
+	ca := newFakeCA(t, func(path string) string {
+		data, _ := os.ReadFile(filepath.Join(webroot, filepath.FromSlash(path)))
+		return string(data)
+	})
+	issuer := New(Options{
+		Directory:      ca.srv.URL + "/dir",
+		AccountKeyFile: filepath.Join(t.TempDir(), "acme_account.key"),
+		Webroot:        webroot,
+		Logger:         slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if _, _, err := issuer.Obtain(context.Background(), "edge.example.com"); err != nil {
+		t.Fatalf("Obtain: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(webroot, ".well-known", "acme-challenge", "tok")); !os.IsNotExist(err) {
+		t.Fatalf("challenge file left behind: %v", err)
+	}
+}
+
+func TestObtainAnswersTLSALPN01(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	ca := newFakeCA(t, func(string) string {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{
+			ServerName:         "edge.example.com",
+			NextProtos:         []string{"acme-tls/1"},
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			t.Errorf("dial challenge listener: %v", err)
+			return ""
+		}
+		defer conn.Close()
+		cert := conn.ConnectionState().PeerCertificates[0]
+		for _, ext := range cert.Extensions {
+			// id-pe-acmeIdentifier carries the key authorization digest.
+			if ext.Id.String() == "1.3.6.1.5.5.7.1.31" && ext.Critical && slices.Equal(cert.DNSNames, []string{"edge.example.com"}) {
+				return "tok.validated"
+			}
+		}
+		t.Errorf("challenge certificate without acmeIdentifier: %v", cert.DNSNames)
+		return ""
+	})
+	ca.chalType = ChallengeTLSALPN01
+	issuer := New(Options{
+		Directory:      ca.srv.URL + "/dir",
+		AccountKeyFile: filepath.Join(t.TempDir(), "acme_account.key"),
+		Challenge:      ChallengeTLSALPN01,
+		TLSAddr:        addr,
+		Logger:         slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if _, _, err := issuer.Obtain(context.Background(), "edge.example.com"); err != nil {
+		t.Fatalf("Obtain: %v", err)
+	}
+	// The listener is only up while the order is in progress.
+	if conn, err := net.Dial("tcp", addr); err == nil {
+		conn.Close()
+		t.Fatal("challenge listener still open")
+	}
+}
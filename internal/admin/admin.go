@@ -0,0 +1,347 @@
+// Package admin serves the agent's local admin API on a unix socket, and
+// optionally on a loopback TCP address, and provides the client the CLI uses
+// to query it. The socket is only accessible to its owner, which is what
+// authenticates its callers; the TCP listener requires a bearer token.
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/najahiiii/xray-agent/internal/model"
+	"github.com/najahiiii/xray-agent/internal/xray"
+)
+
+// StatusFunc reports the agent's current status.
+type StatusFunc func(ctx context.Context) (*model.AdminStatus, error)
+
+// API is what the admin API serves. Endpoints whose function is nil answer
+// 404.
+type API struct {
+	// Status serves GET /v1/status.
+	Status StatusFunc
+	// Clients serves GET /v1/clients: the applied clients, without their
+	// credentials.
+	Clients func(ctx context.Context) ([]model.AdminClient, error)
+	// Routes serves GET /v1/routes: the applied route rules.
+	Routes func(ctx context.Context) ([]model.RouteRule, error)
+	// RouteReport serves GET /v1/routes/inspect: the applied route rules
+	// next to the rules the running core holds.
+	RouteReport func(ctx context.Context) ([]xray.RuleReport, error)
+	// Sync serves POST /v1/sync: fetch and apply the state now.
+	Sync func(ctx context.Context) (*model.AdminSyncResult, error)
+	// Logs serves GET /v1/logs?lines=N: the latest n log records, oldest
+	// first; n <= 0 means all that are kept.
+	Logs func(n int) []model.LogEntry
+	// Usage serves GET /v1/usage: the per-user totals of the current and
+	// previous day and month.
+	Usage func(ctx context.Context) (*model.UsageRollups, error)
+}
+
+// DefaultLogLines is how many records GET /v1/logs returns without lines.
+const DefaultLogLines = 50
+
+// Handler serves api under /v1/.
+func Handler(api API) http.Handler {
+	mux := http.NewServeMux()
+	if api.Status != nil {
+		mux.HandleFunc("GET /v1/status", func(w http.ResponseWriter, r *http.Request) {
+			st, err := api.Status(r.Context())
+			if err != nil {
+				writeError(w, http.StatusServiceUnavailable, err)
+				return
+			}
+			writeJSON(w, st)
+		})
+	}
+	if api.Clients != nil {
+		mux.HandleFunc("GET /v1/clients", func(w http.ResponseWriter, r *http.Request) {
+			clients, err := api.Clients(r.Context())
+			if err != nil {
+				writeError(w, http.StatusServiceUnavailable, err)
+				return
+			}
+			writeJSON(w, clients)
+		})
+	}
+	if api.Routes != nil {
+		mux.HandleFunc("GET /v1/routes", func(w http.ResponseWriter, r *http.Request) {
+			routes, err := api.Routes(r.Context())
+			if err != nil {
+				writeError(w, http.StatusServiceUnavailable, err)
+				return
+			}
+			writeJSON(w, routes)
+		})
+	}
+	if api.RouteReport != nil {
+		mux.HandleFunc("GET /v1/routes/inspect", func(w http.ResponseWriter, r *http.Request) {
+			reports, err := api.RouteReport(r.Context())
+			if err != nil {
+				writeError(w, http.StatusServiceUnavailable, err)
+				return
+			}
+			writeJSON(w, reports)
+		})
+	}
+	if api.Sync != nil {
+		mux.HandleFunc("POST /v1/sync", func(w http.ResponseWriter, r *http.Request) {
+			res, err := api.Sync(r.Context())
+			if err != nil {
+				writeError(w, http.StatusBadGateway, err)
+				return
+			}
+			writeJSON(w, res)
+		})
+	}
+	if api.Logs != nil {
+		mux.HandleFunc("GET /v1/logs", func(w http.ResponseWriter, r *http.Request) {
+			n := DefaultLogLines
+			if v := r.URL.Query().Get("lines"); v != "" {
+				var err error
+				if n, err = strconv.Atoi(v); err != nil {
+					writeError(w, http.StatusBadRequest, fmt.Errorf("lines: %w", err))
+					return
+				}
+			}
+			writeJSON(w, api.Logs(n))
+		})
+	}
+	if api.Usage != nil {
+		mux.HandleFunc("GET /v1/usage", func(w http.ResponseWriter, r *http.Request) {
+			usage, err := api.Usage(r.Context())
+			if err != nil {
+				writeError(w, http.StatusServiceUnavailable, err)
+				return
+			}
+			writeJSON(w, usage)
+		})
+	}
+	return mux
+}
+
+// RequireToken wraps h so that every request must carry
+// "Authorization: Bearer <token>".
+func RequireToken(h http.Handler, token string) http.Handler {
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("missing or wrong admin token"))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// ValidateListen accepts only loopback addresses, so the token is never
+// the only thing keeping the API off the network.
+func ValidateListen(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("admin.listen %q: %w", addr, err)
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return nil
+	}
+	return fmt.Errorf("admin.listen %q must be a loopback address (127.0.0.1, [::1] or localhost)", addr)
+}
+
+// Start listens on the unix socket path and serves h until ctx is done. A
+// stale socket left by a previous run is replaced. It returns once the
+// listener is bound.
+func Start(ctx context.Context, path string, h http.Handler, log *slog.Logger) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	if err := removeStaleSocket(path); err != nil {
+		return err
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("listen %s: %w", path, err)
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		ln.Close()
+		return err
+	}
+	serve(ctx, ln, h, log)
+	log.Info("admin api listening", "socket", path)
+	return nil
+}
+
+// StartTCP listens on the loopback address addr and serves h behind
+// RequireToken until ctx is done. It returns once the listener is bound.
+func StartTCP(ctx context.Context, addr, token string, h http.Handler, log *slog.Logger) error {
+	if err := ValidateListen(addr); err != nil {
+		return err
+	}
+	if token == "" {
+		return errors.New("admin.listen requires admin.token")
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("listen %s: %w", addr, err)
+	}
+	serve(ctx, ln, RequireToken(h, token), log)
+	log.Info("admin api listening", "addr", ln.Addr().String())
+	return nil
+}
+
+func serve(ctx context.Context, ln net.Listener, h http.Handler, log *slog.Logger) {
+	srv := &http.Server{Handler: h, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Warn("admin api stopped", "err", err)
+		}
+	}()
+}
+
+// removeStaleSocket removes path unless another agent is still listening on
+// it.
+func removeStaleSocket(path string) error {
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another agent", path)
+	}
+	return os.Remove(path)
+}
+
+// Client talks to a running agent's admin API.
+type Client struct {
+	http *http.Client
+}
+
+const (
+	// requestTimeout bounds the queries; syncTimeout bounds POST /v1/sync,
+	// which waits for the whole state to be applied.
+	requestTimeout = 10 * time.Second
+	syncTimeout    = 2 * time.Minute
+)
+
+func NewClient(path string) *Client {
+	return &Client{http: &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", path)
+			},
+		},
+	}}
+}
+
+// Status fetches GET /v1/status.
+func (c *Client) Status(ctx context.Context) (*model.AdminStatus, error) {
+	var st model.AdminStatus
+	if err := c.do(ctx, http.MethodGet, "/v1/status", requestTimeout, &st); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+// Clients fetches GET /v1/clients.
+func (c *Client) Clients(ctx context.Context) ([]model.AdminClient, error) {
+	var clients []model.AdminClient
+	if err := c.do(ctx, http.MethodGet, "/v1/clients", requestTimeout, &clients); err != nil {
+		return nil, err
+	}
+	return clients, nil
+}
+
+// Routes fetches GET /v1/routes.
+func (c *Client) Routes(ctx context.Context) ([]model.RouteRule, error) {
+	var routes []model.RouteRule
+	if err := c.do(ctx, http.MethodGet, "/v1/routes", requestTimeout, &routes); err != nil {
+		return nil, err
+	}
+	return routes, nil
+}
+
+// RouteReport fetches GET /v1/routes/inspect.
+func (c *Client) RouteReport(ctx context.Context) ([]xray.RuleReport, error) {
+	var reports []xray.RuleReport
+	if err := c.do(ctx, http.MethodGet, "/v1/routes/inspect", requestTimeout, &reports); err != nil {
+		return nil, err
+	}
+	return reports, nil
+}
+
+// Sync asks the agent to sync the state now, via POST /v1/sync.
+func (c *Client) Sync(ctx context.Context) (*model.AdminSyncResult, error) {
+	var res model.AdminSyncResult
+	if err := c.do(ctx, http.MethodPost, "/v1/sync", syncTimeout, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Logs fetches the latest n log records with GET /v1/logs.
+func (c *Client) Logs(ctx context.Context, n int) ([]model.LogEntry, error) {
+	var entries []model.LogEntry
+	if err := c.do(ctx, http.MethodGet, "/v1/logs?lines="+strconv.Itoa(n), requestTimeout, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Usage fetches GET /v1/usage.
+func (c *Client) Usage(ctx context.Context) (*model.UsageRollups, error) {
+	var usage model.UsageRollups
+	if err := c.do(ctx, http.MethodGet, "/v1/usage", requestTimeout, &usage); err != nil {
+		return nil, err
+	}
+	return &usage, nil
+}
+
+func (c *Client) do(ctx context.Context, method, path string, timeout time.Duration, out any) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	// The host is ignored by the unix dialer.
+	req, err := http.NewRequestWithContext(ctx, method, "http://agent"+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("admin api: %w (is the agent running?)", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("admin api %s: %s: %s", path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
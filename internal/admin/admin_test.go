@@ -0,0 +1,169 @@
+package admin
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/najahiiii/xray-agent/internal/model"
+	"github.com/najahiiii/xray-agent/internal/xray"
+)
+
+func TestClientStatusOverSocket(t *testing.T) {
+	// Unix socket paths are limited to ~108 bytes, so keep it short.
+	dir, err := os.MkdirTemp("", "adm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "admin.sock")
+	// A stale socket file from a crashed agent is replaced.
+	if err := os.WriteFile(path, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	fail := false
+	status := func(context.Context) (*model.AdminStatus, error) {
+		if fail {
+			return nil, errors.New("stats query: unavailable")
+		}
+		return &model.AdminStatus{Users: 3, ActiveUsers: 1}, nil
+	}
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	if err := Start(ctx, path, Handler(API{Status: status}), log); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("socket mode: %v %v", info.Mode(), err)
+	}
+
+	client := NewClient(path)
+	st, err := client.Status(ctx)
+	if err != nil || st.Users != 3 || st.ActiveUsers != 1 {
+		t.Fatalf("Status = %+v, %v", st, err)
+	}
+	fail = true
+	if _, err := client.Status(ctx); err == nil || !strings.Contains(err.Error(), "unavailable") {
+		t.Fatalf("Status error = %v", err)
+	}
+
+	if err := Start(ctx, path, Handler(API{Status: status}), log); err == nil {
+		t.Fatal("second Start took over a socket in use")
+	}
+}
+
+func TestHandlerEndpoints(t *testing.T) {
+	synced := 0
+	api := API{
+		Clients: func(context.Context) ([]model.AdminClient, error) {
+			return []model.AdminClient{{Email: "a@example.com", Proto: "vless"}}, nil
+		},
+		Routes: func(context.Context) ([]model.RouteRule, error) {
+			return []model.RouteRule{{Tag: "cn", OutboundTag: "block"}}, nil
+		},
+		RouteReport: func(context.Context) ([]xray.RuleReport, error) {
+			return []xray.RuleReport{{Tag: "cn", Status: xray.RuleMissing}}, nil
+		},
+		Sync: func(context.Context) (*model.AdminSyncResult, error) {
+			synced++
+			return &model.AdminSyncResult{ConfigVersion: 42, Clients: 1}, nil
+		},
+		Logs: func(n int) []model.LogEntry {
+			return make([]model.LogEntry, n)
+		},
+		Usage: func(context.Context) (*model.UsageRollups, error) {
+			return &model.UsageRollups{Today: model.UsageTotals{Period: "2025-11-07", Uplink: 3, Users: []model.UsageTotal{{Email: "a@example.com", Uplink: 3}}}}, nil
+		},
+	}
+	dir, err := os.MkdirTemp("", "adm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "admin.sock")
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	if err := Start(ctx, path, Handler(api), slog.New(slog.NewTextHandler(io.Discard, nil))); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	client := NewClient(path)
+
+	clients, err := client.Clients(ctx)
+	if err != nil || len(clients) != 1 || clients[0].Email != "a@example.com" {
+		t.Fatalf("Clients = %+v, %v", clients, err)
+	}
+	routes, err := client.Routes(ctx)
+	if err != nil || len(routes) != 1 || routes[0].Tag != "cn" {
+		t.Fatalf("Routes = %+v, %v", routes, err)
+	}
+	reports, err := client.RouteReport(ctx)
+	if err != nil || len(reports) != 1 || reports[0].Status != xray.RuleMissing {
+		t.Fatalf("RouteReport = %+v, %v", reports, err)
+	}
+	res, err := client.Sync(ctx)
+	if err != nil || res.ConfigVersion != 42 || synced != 1 {
+		t.Fatalf("Sync = %+v, %v (synced %d)", res, err, synced)
+	}
+	logs, err := client.Logs(ctx, 3)
+	if err != nil || len(logs) != 3 {
+		t.Fatalf("Logs = %d, %v", len(logs), err)
+	}
+	usage, err := client.Usage(ctx)
+	if err != nil || usage.Today.Period != "2025-11-07" || len(usage.Today.Users) != 1 {
+		t.Fatalf("Usage = %+v, %v", usage, err)
+	}
+	if _, err := client.Status(ctx); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("Status without a StatusFunc = %v", err)
+	}
+	var out any
+	if err := client.do(ctx, http.MethodGet, "/v1/sync", requestTimeout, &out); err == nil || synced != 1 {
+		t.Fatalf("GET /v1/sync = %v (synced %d)", err, synced)
+	}
+}
+
+func TestStartTCPRequiresTokenAndLoopback(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	h := Handler(API{Logs: func(int) []model.LogEntry { return nil }})
+
+	if err := StartTCP(ctx, "0.0.0.0:0", "secret", h, log); err == nil {
+		t.Fatal("StartTCP accepted a non-loopback address")
+	}
+	if err := StartTCP(ctx, "127.0.0.1:0", "", h, log); err == nil {
+		t.Fatal("StartTCP accepted an empty token")
+	}
+
+	srv := httptest.NewServer(RequireToken(h, "secret"))
+	defer srv.Close()
+	for _, tc := range []struct {
+		auth string
+		want int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"Bearer secret", http.StatusOK},
+	} {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/v1/logs", nil)
+		if tc.auth != "" {
+			req.Header.Set("Authorization", tc.auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Fatalf("Authorization %q: %s, want %d", tc.auth, resp.Status, tc.want)
+		}
+	}
+}
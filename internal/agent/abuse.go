@@ -0,0 +1,141 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/najahiiii/xray-agent/internal/accesslog"
+	"github.com/najahiiii/xray-agent/internal/audit"
+	"github.com/najahiiii/xray-agent/internal/model"
+)
+
+// abuseRulePrefix starts the tags of the route rules that block abusers.
+const abuseRulePrefix = "agent-abuse:"
+
+// abuseBlock is a user whose traffic goes to abuse.block_outbound until
+// until. reported is set once the panel accepted the violation that caused
+// it; later violations of a reported block are not sent again.
+type abuseBlock struct {
+	until    time.Time
+	reported bool
+}
+
+// runAbuseLoop reports the violations detector found every
+// abuse.interval_sec and, with abuse.auto_block, blocks the offenders and
+// lifts their blocks once they expire.
+func (a *Agent) runAbuseLoop(ctx context.Context, detector *accesslog.Detector) {
+	sched := a.newSchedule(time.Duration(a.cfg.Abuse.IntervalSec) * time.Second)
+	for {
+		if !sched.wait(ctx) {
+			return
+		}
+		if err := a.track(subsystemAbuse, a.pushAbuseOnce(ctx, detector, time.Now())); err != nil {
+			a.log.Warn("abuse-sync", "err", err)
+		}
+	}
+}
+
+func (a *Agent) pushAbuseOnce(ctx context.Context, detector *accesslog.Detector, now time.Time) error {
+	push, undo := detector.Flush(now)
+	if a.cfg.Abuse.AutoBlock {
+		a.expireAbuseBlocks(ctx, now)
+		if push != nil {
+			a.blockAbusers(ctx, push, now)
+		}
+	}
+	if push == nil || len(push.Violations) == 0 {
+		return nil
+	}
+	if err := a.ctrl.PostAbuse(ctx, push); err != nil {
+		undo()
+		return fmt.Errorf("post abuse: %w", err)
+	}
+	a.log.Info("reported abuse", "violations", len(push.Violations))
+	if a.cfg.Abuse.AutoBlock {
+		a.syncMu.Lock()
+		for _, v := range push.Violations {
+			if b := a.abuseBlocks[v.Email]; b != nil {
+				b.reported = true
+			}
+		}
+		a.syncMu.Unlock()
+	}
+	return nil
+}
+
+// blockAbusers routes the traffic of every user in push that is not blocked
+// yet to abuse.block_outbound and sets BlockedUntil on the violations of
+// blocked users. Violations of blocks the panel already knows about are
+// dropped from push.
+func (a *Agent) blockAbusers(ctx context.Context, push *model.AbusePush, now time.Time) {
+	a.syncMu.Lock()
+	defer a.syncMu.Unlock()
+	push.Violations = slices.DeleteFunc(push.Violations, func(v model.AbuseViolation) bool {
+		b := a.abuseBlocks[v.Email]
+		return b != nil && b.reported
+	})
+
+	desired := maps.Clone(a.agentRules)
+	kinds := map[string][]string{}
+	for _, v := range push.Violations {
+		if a.abuseBlocks[v.Email] == nil {
+			r := a.abuseRule(v.Email)
+			desired[r.Tag] = r
+			kinds[v.Email] = append(kinds[v.Email], v.Kind)
+		}
+	}
+	if len(kinds) > 0 {
+		until := now.Add(time.Duration(a.cfg.Abuse.BlockSec) * time.Second)
+		failed, err := a.setAgentRules(audit.WithSource(ctx, audit.SourceAbuse, max(a.state.Version(), 0)), desired)
+		for _, email := range slices.Sorted(maps.Keys(kinds)) {
+			ferr := err
+			if ferr == nil {
+				ferr = failed[abuseRulePrefix+email]
+			}
+			if ferr != nil {
+				a.log.Warn("abusing user not blocked", "email", email, "err", ferr)
+				continue
+			}
+			a.abuseBlocks[email] = &abuseBlock{until: until}
+			a.log.Warn("blocked abusing user", "email", email, "kinds", kinds[email], "until", until.UTC(), "outbound", a.cfg.Abuse.BlockOutbound)
+		}
+	}
+	for i, v := range push.Violations {
+		if b := a.abuseBlocks[v.Email]; b != nil {
+			until := b.until.UTC()
+			push.Violations[i].BlockedUntil = &until
+		}
+	}
+}
+
+// expireAbuseBlocks lifts the blocks that ran out by now.
+func (a *Agent) expireAbuseBlocks(ctx context.Context, now time.Time) {
+	a.syncMu.Lock()
+	defer a.syncMu.Unlock()
+	desired := maps.Clone(a.agentRules)
+	for email, b := range a.abuseBlocks {
+		if !b.until.After(now) {
+			delete(desired, abuseRulePrefix+email)
+		}
+	}
+	if len(desired) == len(a.agentRules) {
+		return
+	}
+	if _, err := a.setAgentRules(audit.WithSource(ctx, audit.SourceAbuse, max(a.state.Version(), 0)), desired); err != nil {
+		a.log.Warn("abuse blocks not lifted; retrying", "err", err)
+		return
+	}
+	for email, b := range a.abuseBlocks {
+		if !b.until.After(now) {
+			delete(a.abuseBlocks, email)
+			a.log.Info("abuse block expired", "email", email)
+		}
+	}
+}
+
+func (a *Agent) abuseRule(email string) model.RouteRule {
+	return model.RouteRule{Tag: abuseRulePrefix + email, OutboundTag: a.cfg.Abuse.BlockOutbound, User: []string{email}}
+}
@@ -0,0 +1,110 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/najahiiii/xray-agent/internal/accesslog"
+	"github.com/najahiiii/xray-agent/internal/config"
+	"github.com/najahiiii/xray-agent/internal/control"
+	"github.com/najahiiii/xray-agent/internal/model"
+	"github.com/najahiiii/xray-agent/internal/xray"
+	"github.com/najahiiii/xray-agent/testsupport"
+)
+
+func TestAbuseAutoBlockLifecycle(t *testing.T) {
+	core := testsupport.NewCore(t)
+	core.AddProtocolInbound("vless", "v")
+	core.SeedRule(abuseRulePrefix+"old@example.com", "blocked")
+	cfg := newTestConfig(core.Addr)
+	cfg.Abuse.AutoBlock = true
+	cfg.Abuse.BlockOutbound = "blocked"
+	cfg.Abuse.BlockSec = 600
+
+	var pushes []model.AbusePush
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/agents/sg/drift" {
+			return
+		}
+		if r.URL.Path != "/api/agents/sg/abuse" {
+			t.Errorf("unexpected request %s", r.URL.Path)
+		}
+		var push model.AbusePush
+		if err := json.NewDecoder(r.Body).Decode(&push); err != nil {
+			t.Errorf("decode: %v", err)
+		}
+		pushes = append(pushes, push)
+	}))
+	defer srv.Close()
+	cfg.Control.BaseURL = config.URLList{srv.URL}
+
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	manager := xray.NewManager(cfg, log)
+	a := New(cfg, log, control.NewClient(cfg, log, "v-test", ""), manager, nil, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	clients := []model.Client{{Proto: "vless", ID: "1", Email: "a@example.com"}}
+	if _, _, err := manager.State(ctx, nil, clients, nil, nil); err != nil {
+		t.Fatalf("State: %v", err)
+	}
+	a.state.Update(1, clients, nil)
+
+	// Reconcile removes the block an earlier run left behind.
+	if err := a.reconcileOnce(ctx, manager); err != nil {
+		t.Fatalf("reconcileOnce: %v", err)
+	}
+	if tags := core.RuleTags(); len(tags) != 0 {
+		t.Fatalf("stale abuse rules left: %v", tags)
+	}
+
+	now := time.Now()
+	detector := accesslog.NewDetector(accesslog.AbuseOptions{TorrentPorts: config.PortList{"6881"}, MinHits: 1}, now)
+	torrent := accesslog.Entry{Time: now, Accepted: true, Email: "a@example.com", Host: "198.51.100.7", Port: 6881}
+	detector.Add(torrent)
+	if err := a.pushAbuseOnce(ctx, detector, now); err != nil {
+		t.Fatalf("pushAbuseOnce: %v", err)
+	}
+	tag := abuseRulePrefix + "a@example.com"
+	if tags := core.RuleTags(); !slices.Equal(tags, []string{tag}) {
+		t.Fatalf("rules = %v, want %s", tags, tag)
+	}
+	// Reconcile leaves the agent's own rule alone.
+	if err := a.reconcileOnce(ctx, manager); err != nil {
+		t.Fatalf("reconcileOnce: %v", err)
+	}
+	if tags := core.RuleTags(); !slices.Equal(tags, []string{tag}) {
+		t.Fatalf("rules after reconcile = %v, want %s", tags, tag)
+	}
+	if len(pushes) != 1 || len(pushes[0].Violations) != 1 || pushes[0].Violations[0].BlockedUntil == nil {
+		t.Fatalf("pushes = %+v, want one blocked violation", pushes)
+	}
+	if until := *pushes[0].Violations[0].BlockedUntil; until.Sub(now) < 599*time.Second || until.Sub(now) > 601*time.Second {
+		t.Fatalf("blocked_until = %v, want 10m from now", until)
+	}
+
+	// A blocked user's further violations are not reported again.
+	detector.Add(torrent)
+	if err := a.pushAbuseOnce(ctx, detector, now.Add(time.Minute)); err != nil {
+		t.Fatalf("pushAbuseOnce: %v", err)
+	}
+	if len(pushes) != 1 {
+		t.Fatalf("violation of a reported block sent again: %+v", pushes[1:])
+	}
+
+	if err := a.pushAbuseOnce(ctx, detector, now.Add(11*time.Minute)); err != nil {
+		t.Fatalf("pushAbuseOnce: %v", err)
+	}
+	if tags := core.RuleTags(); len(tags) != 0 {
+		t.Fatalf("expired block still in xray: %v", tags)
+	}
+	if len(a.abuseBlocks) != 0 {
+		t.Fatalf("expired block still tracked: %v", a.abuseBlocks)
+	}
+}
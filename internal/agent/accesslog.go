@@ -0,0 +1,154 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/najahiiii/xray-agent/internal/accesslog"
+	"github.com/najahiiii/xray-agent/internal/config"
+	"github.com/najahiiii/xray-agent/internal/logtail"
+	"github.com/najahiiii/xray-agent/internal/xrayconf"
+)
+
+// accessLogRetry is how long the tailer waits before opening an access log
+// it could not read again.
+const accessLogRetry = 30 * time.Second
+
+// runAccessLogLoop follows xray's access log when access_log.enabled,
+// abuse.enabled or ban.enabled is set. With access_log.enabled it pushes a
+// summary of it every access_log.interval_sec; a summary the panel does not
+// take is merged into the next one. Abuse detection runs in runAbuseLoop,
+// source bans in runBanLoop.
+func (a *Agent) runAccessLogLoop(ctx context.Context) {
+	if a.ctrl == nil || !a.cfg.AccessLog.Enabled && !a.cfg.Abuse.Enabled && !a.cfg.Ban.Enabled || a.cfg.Backend == config.BackendSingBox {
+		return
+	}
+	path, err := a.accessLogPath()
+	if err != nil {
+		a.log.Warn("access log summaries, abuse detection and source bans disabled", "err", a.track(subsystemAccessLog, err))
+		return
+	}
+	var summary *accesslog.Summary
+	if a.cfg.AccessLog.Enabled {
+		summary = accesslog.NewSummary(accesslog.Options{
+			Destinations:    a.cfg.AccessLog.Destinations,
+			TopDestinations: a.cfg.AccessLog.TopDestinations,
+			Exclude:         a.cfg.AccessLog.ExcludeDestinations,
+			Sources:         a.cfg.AccessLog.Sources,
+		}, time.Now())
+	}
+	var detector *accesslog.Detector
+	if a.cfg.Abuse.Enabled {
+		detector = accesslog.NewDetector(accesslog.AbuseOptions{
+			TorrentPorts:         a.cfg.Abuse.TorrentPorts,
+			BlockedOutbounds:     a.cfg.Abuse.BlockedOutbounds,
+			MaxConnectionsPerMin: a.cfg.Abuse.MaxConnectionsPerMin,
+			MinHits:              a.cfg.Abuse.MinHits,
+		}, time.Now())
+		go a.runAbuseLoop(ctx, detector)
+	}
+	var jail *accesslog.Jail
+	offenses := make(chan accesslog.Offense, banQueueSize)
+	if a.cfg.Ban.Enabled {
+		jail = accesslog.NewJail(accesslog.JailOptions{
+			MaxFailures: a.cfg.Ban.MaxFailures,
+			FindTime:    time.Duration(a.cfg.Ban.FindTimeSec) * time.Second,
+			Ignore:      a.cfg.Ban.Ignore,
+		})
+		go a.runBanLoop(ctx, offenses)
+	}
+	go a.tailAccessLog(ctx, path, func(e accesslog.Entry) {
+		if summary != nil {
+			summary.Add(e)
+		}
+		if detector != nil {
+			detector.Add(e)
+		}
+		if jail == nil {
+			return
+		}
+		if o, ok := jail.Add(e); ok {
+			select {
+			case offenses <- o:
+			default:
+				a.log.Debug("ban queue full; offense dropped", "addr", o.Addr)
+			}
+		}
+	})
+	if summary == nil {
+		return
+	}
+
+	intv := time.Duration(a.cfg.AccessLog.IntervalSec) * time.Second
+	if intv <= 0 {
+		intv = config.DefaultAccessLogIntervalSec * time.Second
+	}
+	sched := a.newSchedule(intv)
+	for {
+		if !sched.wait(ctx) {
+			return
+		}
+		if err := a.track(subsystemAccessLog, a.pushAccessLogOnce(ctx, summary)); err != nil {
+			a.log.Warn("access-log-sync", "err", err)
+		}
+	}
+}
+
+func (a *Agent) pushAccessLogOnce(ctx context.Context, summary *accesslog.Summary) error {
+	push, undo := summary.Flush(time.Now())
+	if push == nil {
+		return nil
+	}
+	if err := a.ctrl.PostAccessLog(ctx, push); err != nil {
+		undo()
+		return fmt.Errorf("post access log: %w", err)
+	}
+	a.log.Debug("posted access log summary", "users", len(push.Users), "rejections", len(push.Rejections))
+	return nil
+}
+
+// tailAccessLog hands the entries appended to path to add until ctx is
+// done. Lines already in the file when it is opened are skipped.
+func (a *Agent) tailAccessLog(ctx context.Context, path string, add func(accesslog.Entry)) {
+	lines := make(chan logtail.Line)
+	go func() {
+		for {
+			select {
+			case l := <-lines:
+				if e, ok := accesslog.Parse(l.Text); ok {
+					add(e)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	for {
+		err := logtail.File(ctx, "access", path, 0, true, func(string) bool { return true }, lines)
+		if ctx.Err() != nil {
+			return
+		}
+		a.log.Warn("access log not readable; retrying", "path", path, "err", err, "retry_in", accessLogRetry)
+		if !sleepContext(ctx, accessLogRetry) {
+			return
+		}
+	}
+}
+
+// accessLogPath returns access_log.path, or else the access log file of the
+// xray config.
+func (a *Agent) accessLogPath() (string, error) {
+	if p := a.cfg.AccessLog.Path; p != "" {
+		return p, nil
+	}
+	file, err := xrayconf.Load(a.xrayConfigPath())
+	if err != nil {
+		return "", fmt.Errorf("read xray access log path: %w", err)
+	}
+	access, _ := file.LogPaths()
+	if access == "" || access == "none" {
+		return "", fmt.Errorf("xray writes no access log file; set log.access in %s or access_log.path", a.xrayConfigPath())
+	}
+	return access, nil
+}
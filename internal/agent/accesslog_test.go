@@ -0,0 +1,89 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/najahiiii/xray-agent/internal/accesslog"
+	"github.com/najahiiii/xray-agent/internal/config"
+	"github.com/najahiiii/xray-agent/internal/control"
+	"github.com/najahiiii/xray-agent/internal/model"
+)
+
+func TestAccessLogSummaryIsPushedAndKeptOnFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	old := "2025/11/07 15:00:00 from 203.0.113.1:1000 accepted tcp:old.example.com:443 [vless-in >> direct] email: a@example.com\n"
+	if err := os.WriteFile(path, []byte(old), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	fail := true
+	var pushes []model.AccessLogPush
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/agents/sg/access-log" {
+			t.Errorf("unexpected request %s", r.URL.Path)
+		}
+		if fail {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		var push model.AccessLogPush
+		if err := json.NewDecoder(r.Body).Decode(&push); err != nil {
+			t.Errorf("decode: %v", err)
+		}
+		pushes = append(pushes, push)
+	}))
+	defer srv.Close()
+
+	cfg := newTestConfig("127.0.0.1:0")
+	cfg.Control.BaseURL = config.URLList{srv.URL}
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	a := New(cfg, log, control.NewClient(cfg, log, "v-test", ""), nil, nil, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	summary := accesslog.NewSummary(accesslog.Options{Destinations: config.AccessLogFull, TopDestinations: 5}, time.Now())
+	go a.tailAccessLog(ctx, path, summary.Add)
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// The tailer starts at the end of the file; keep appending until it
+	// has picked a line up.
+	line := "2025/11/07 15:01:00 from 203.0.113.5:51234 accepted tcp:example.com:443 [vless-in >> direct] email: a@example.com\n"
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := f.WriteString(line); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+		if err := a.pushAccessLogOnce(ctx, summary); err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("access log lines were never picked up")
+		}
+	}
+
+	fail = false
+	if err := a.pushAccessLogOnce(ctx, summary); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	if len(pushes) != 1 || len(pushes[0].Users) != 1 {
+		t.Fatalf("pushes = %+v", pushes)
+	}
+	u := pushes[0].Users[0]
+	if u.Email != "a@example.com" || u.Connections < 1 || len(u.Destinations) != 1 || u.Destinations[0].Host != "example.com" {
+		t.Fatalf("user = %+v, want only the appended lines", u)
+	}
+}
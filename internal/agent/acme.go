@@ -0,0 +1,121 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/najahiiii/xray-agent/internal/certs"
+)
+
+// CertIssuer obtains a certificate and key for domains, e.g. through ACME.
+type CertIssuer interface {
+	Obtain(ctx context.Context, domains ...string) (cert, key []byte, err error)
+}
+
+// noteACMEDomains records the state's ACME domains and wakes the ACME loop
+// when they changed. Called with syncMu held.
+func (a *Agent) noteACMEDomains(domains []string) {
+	if a.issuer == nil || slices.Equal(domains, a.acmeDomains) {
+		return
+	}
+	a.acmeDomains = slices.Clone(domains)
+	select {
+	case a.acmeWake <- struct{}{}:
+	default:
+	}
+}
+
+// runACMELoop checks the certificates of the ACME domains every
+// acme.check_interval_sec, and right away when the panel changes the list.
+func (a *Agent) runACMELoop(ctx context.Context) {
+	if a.issuer == nil {
+		return
+	}
+	intv := time.Duration(a.cfg.ACME.CheckIntervalSec) * time.Second
+	for {
+		if err := a.track(subsystemACME, a.renewCertificatesOnce(ctx)); err != nil {
+			a.log.Warn("acme", "err", err)
+		}
+		timer := time.NewTimer(intv)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-a.acmeWake:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// acmeTargets returns the config and state ACME domains, minus domains the
+// panel ships bundles for, since those are the panel's to renew.
+func (a *Agent) acmeTargets() []string {
+	a.syncMu.Lock()
+	defer a.syncMu.Unlock()
+
+	var domains []string
+	for _, d := range slices.Concat(a.cfg.ACME.Domains, a.acmeDomains) {
+		if _, fromPanel := a.appliedCertificates[d]; fromPanel || slices.Contains(domains, d) {
+			continue
+		}
+		domains = append(domains, d)
+	}
+	return domains
+}
+
+// renewCertificatesOnce obtains a certificate for every ACME domain whose
+// certificate is missing or expires within acme.renew_before_days, and
+// restarts xray when any file changed.
+func (a *Agent) renewCertificatesOnce(ctx context.Context) error {
+	renewBefore := time.Duration(a.cfg.ACME.RenewBeforeDays) * 24 * time.Hour
+	var (
+		changed bool
+		errs    []error
+	)
+	for _, domain := range a.acmeTargets() {
+		if err := certs.ValidDomain(domain); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if strings.HasPrefix(domain, "*.") {
+			errs = append(errs, fmt.Errorf("%s: wildcard certificates need DNS-01, which is not supported", domain))
+			continue
+		}
+		certPath, keyPath := a.certificatePaths(domain)
+		if notAfter, err := certs.Expiry(certPath); err == nil && time.Until(notAfter) > renewBefore {
+			continue
+		}
+
+		cert, key, err := a.issuer.Obtain(ctx, domain)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", domain, err))
+			continue
+		}
+		notAfter, err := certs.Check(domain, cert, key)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: issued certificate: %w", domain, err))
+			continue
+		}
+		wrote, err := certs.Install(certPath, keyPath, cert, key)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", domain, err))
+			continue
+		}
+		a.log.Info("issued certificate", "domain", domain, "cert", certPath, "expires", notAfter.Format(time.RFC3339))
+		changed = changed || wrote
+	}
+
+	if changed {
+		if err := a.restartCore(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("restart xray after certificate renewal: %w", err))
+		} else if err := coreRestartSyncer(a, ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,70 @@
+package agent
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/najahiiii/xray-agent/internal/certs"
+	"github.com/najahiiii/xray-agent/internal/config"
+)
+
+type fakeIssuer struct {
+	t      *testing.T
+	issued []string
+}
+
+func (f *fakeIssuer) Obtain(_ context.Context, domains ...string) ([]byte, []byte, error) {
+	f.issued = append(f.issued, domains...)
+	b := testBundle(f.t, domains[0])
+	return []byte(b.Cert), []byte(b.Key), nil
+}
+
+func TestRenewCertificatesOnceIssuesOnlyWhatIsDue(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &config.Config{}
+	cfg.Certificates.Dir = dir
+	cfg.ACME.Domains = []string{"a.example.com", "b.example.com"}
+	cfg.ACME.RenewBeforeDays = 30
+	issuer := &fakeIssuer{t: t}
+	sup := &fakeCoreSupervisor{}
+	a := &Agent{
+		cfg:                 cfg,
+		log:                 slog.New(slog.NewTextHandler(io.Discard, nil)),
+		issuer:              issuer,
+		acmeDomains:         []string{"b.example.com", "c.example.com", "panel.example.com"},
+		appliedCertificates: map[string]string{"panel.example.com": "hash"},
+	}
+	a.SetCoreSupervisor(sup)
+
+	syncs := 0
+	originalSyncer := coreRestartSyncer
+	coreRestartSyncer = func(*Agent, context.Context) error { syncs++; return nil }
+	t.Cleanup(func() { coreRestartSyncer = originalSyncer })
+
+	if err := a.renewCertificatesOnce(context.Background()); err != nil {
+		t.Fatalf("renewCertificatesOnce: %v", err)
+	}
+	if want := []string{"a.example.com", "b.example.com", "c.example.com"}; !slices.Equal(issuer.issued, want) {
+		t.Fatalf("issued %v, want %v", issuer.issued, want)
+	}
+	if sup.restarts != 1 || syncs != 1 {
+		t.Fatalf("restarts = %d, syncs = %d", sup.restarts, syncs)
+	}
+	if _, err := certs.Expiry(filepath.Join(dir, "c.example.com.crt")); err != nil {
+		t.Fatalf("certificate not installed: %v", err)
+	}
+
+	// The test certificates are valid for a day, inside the renewal window.
+	issuer.issued = nil
+	cfg.ACME.RenewBeforeDays = 0
+	if err := a.renewCertificatesOnce(context.Background()); err != nil {
+		t.Fatalf("second run: %v", err)
+	}
+	if len(issuer.issued) != 0 || sup.restarts != 1 {
+		t.Fatalf("second run issued %v, restarts = %d", issuer.issued, sup.restarts)
+	}
+}
@@ -2,18 +2,27 @@ package agent
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"path/filepath"
 	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/najahiiii/xray-agent/internal/acme"
+	"github.com/najahiiii/xray-agent/internal/assist"
+	"github.com/najahiiii/xray-agent/internal/audit"
 	"github.com/najahiiii/xray-agent/internal/config"
 	"github.com/najahiiii/xray-agent/internal/control"
+	"github.com/najahiiii/xray-agent/internal/geoip"
 	"github.com/najahiiii/xray-agent/internal/metrics"
 	"github.com/najahiiii/xray-agent/internal/model"
 	"github.com/najahiiii/xray-agent/internal/state"
-	"github.com/najahiiii/xray-agent/internal/stats"
-	"github.com/najahiiii/xray-agent/internal/xray"
+	"github.com/najahiiii/xray-agent/internal/usage"
 	"github.com/najahiiii/xray-agent/internal/xraycore"
 
 	"log/slog"
@@ -21,21 +30,140 @@ import (
 
 var xrayCoreChecker = xraycore.Check
 
+const statsCountersFile = "stats-counters.json"
+
 type Agent struct {
 	cfg     *config.Config
 	log     *slog.Logger
 	ctrl    *control.Client
-	xray    *xray.Manager
-	stats   *stats.Collector
+	xray    CoreManager
+	stats   StatsSource
 	metrics *metrics.Collector
 	state   *state.Store
-	// statsSnapshot keeps the last seen cumulative counters when StatsResetEachPush is disabled.
+	// statsSnapshot keeps the counter values already reported to the panel;
+	// statsCarry is usage read by a counter reset but not yet reported.
 	statsSnapshot map[string][2]int64
-	syncMu        sync.Mutex
+	statsCarry    map[string][2]int64
+	// statsTotals is the usage delivered per user, reported on checkpoint
+	// pushes; statsCheckpointAt is when the last checkpoint was accepted.
+	statsTotals       map[string][2]int64
+	statsCheckpointAt time.Time
+	// statsCoreUptime is xray's uptime when the counters in statsSnapshot
+	// were read; statsCoreReset is set once xray is seen to have restarted.
+	statsCoreUptime uint32
+	statsCoreReset  bool
+	// statsInFlight is the push awaiting the panel with
+	// stats_reset_each_push; statsReplay is set when it was restored from
+	// disk and goes out again before the counters are queried.
+	statsInFlight *state.InFlightStats
+	statsReplay   bool
+	// usageHistory is nil unless usage_history.enabled is set;
+	// usageRecorded is the pending usage already counted in it and in
+	// rollups, which rollupMu guards.
+	usageHistory  *usage.History
+	usageRecorded map[string][2]int64
+	rollupMu      sync.Mutex
+	rollups       state.UsageRollups
+	// bandwidth is the node traffic counted for bandwidth_cap.
+	bandwidth bandwidthCap
+	// geo resolves client addresses in pushes; nil unless geoip.enabled.
+	geo *geoip.Resolver
+	// counters persists statsSnapshot and statsSeq across restarts; nil when storage is disabled.
+	counters     *state.CounterStore
+	statsSeq     uint64
+	statsRestart *model.StatsRestartMarker
+	health       *healthTracker
+	throughput   throughputSampler
+	core         CoreSupervisor
+	// logs is nil unless the agent logs to a file.
+	logs LogRotator
+	// assist is nil unless assist.enabled is set.
+	assist *assist.Manager
+	// retention receives the panel's retention policy whenever it changes.
+	retention        []RetentionHandler
+	appliedRetention *model.RetentionPolicy
+	// appliedSniffing is the last sniffing map written to the xray config.
+	appliedSniffing map[string]model.Sniffing
+	// appliedDNS is the last DNS section written to the xray config.
+	appliedDNS *model.DNS
+	// appliedPeers are the wireguard peers in the xray config by inbound tag.
+	appliedPeers map[string][]model.Client
+	// appliedOutbounds are the outbounds of the state that are in xray.
+	appliedOutbounds map[string]model.Outbound
+	// appliedCertificates maps each domain to the hash of the bundle on disk.
+	appliedCertificates map[string]string
+	// issuer is nil unless acme.enabled is set. acmeDomains are the extra
+	// domains from the state; acmeWake is signalled when they change.
+	issuer      CertIssuer
+	acmeDomains []string
+	acmeWake    chan struct{}
+	// features are the state's feature flags as decided for this node.
+	features featureSet
+	// metricsBacklog holds the samples the panel did not accept.
+	metricsBacklog metricsBacklog
+	// audit is nil unless audit.enabled is set; its entries for the panel
+	// are flushed after every state sync.
+	audit *audit.Log
+	// alerts is the state of each metrics.alerts rule, used by the
+	// metrics loop only.
+	alerts map[config.AlertRule]*alertState
+	// events holds activity feed events until runEventLoop delivers them.
+	events eventQueue
+	// lastDrift is the drift report the panel last accepted; see
+	// reportDrift.
+	lastDrift *model.DriftReport
+	// agentRules are the route rules the agent added to xray on its own,
+	// by tag; abuseBlocks are the users abuse.auto_block routes to the
+	// block outbound, by email. Both are guarded by syncMu.
+	agentRules  map[string]model.RouteRule
+	abuseBlocks map[string]*abuseBlock
+	// bans are the source bans of ban.enabled.
+	bans banState
+	// syncFailing is set after a state sync failed, so sync_failed is sent
+	// once per outage. coreRestarts counts the restarts the agent made;
+	// statsCoreRestarts is its value when the core uptime was committed,
+	// which tells the agent's own restarts from crashes.
+	syncFailing       atomic.Bool
+	coreRestarts      atomic.Uint64
+	statsCoreRestarts uint64
+	// speedtestRunning is set while a SPEEDTEST command measures.
+	speedtestRunning atomic.Bool
+	syncMu           sync.Mutex
+}
+
+// RetentionHandler applies a retention policy to one kind of local artifact.
+// Nil fields in the policy mean the local config value applies again.
+type RetentionHandler func(policy model.RetentionPolicy)
+
+// LogRotator rotates the agent's log file on demand.
+type LogRotator interface {
+	Rotate() error
+}
+
+// CoreManager applies clients, route rules and outbounds to the core. It is
+// implemented by xray.Manager and singbox.Manager.
+type CoreManager interface {
+	State(ctx context.Context, currentClients map[string]model.Client, desiredClients []model.Client, currentRoutes map[string]model.RouteRule, desiredRoutes []model.RouteRule) (changed bool, failedRoutes map[string]error, err error)
+	Outbounds(ctx context.Context, current map[string]model.Outbound, desired []model.Outbound) (changed bool, failed map[string]error, err error)
+}
+
+// StatsSource reads traffic counters and runtime stats from the core. It is
+// implemented by stats.Collector and singbox.Collector.
+type StatsSource interface {
+	QueryUserBytes(ctx context.Context, emails []string) (map[string][2]int64, error)
+	ResetUserBytes(ctx context.Context, emails []string) (map[string][2]int64, error)
+	OnlineUsers(ctx context.Context) ([]model.OnlineUserInfo, error)
+	SysStats(ctx context.Context) (*model.XraySysStats, error)
 }
 
-func New(cfg *config.Config, log *slog.Logger, ctrl *control.Client, xr *xray.Manager, statsCollector *stats.Collector, metricsCollector *metrics.Collector) *Agent {
-	return &Agent{
+// CoreSupervisor restarts an xray process that the agent runs itself.
+type CoreSupervisor interface {
+	Restart(ctx context.Context) error
+}
+
+func New(cfg *config.Config, log *slog.Logger, ctrl *control.Client, xr CoreManager, statsCollector StatsSource, metricsCollector *metrics.Collector) *Agent {
+	startedAt := time.Now().UTC()
+	a := &Agent{
 		cfg:           cfg,
 		log:           log,
 		ctrl:          ctrl,
@@ -44,17 +172,145 @@ func New(cfg *config.Config, log *slog.Logger, ctrl *control.Client, xr *xray.Ma
 		metrics:       metricsCollector,
 		state:         state.New(),
 		statsSnapshot: map[string][2]int64{},
+		statsCarry:    map[string][2]int64{},
+		usageRecorded: map[string][2]int64{},
+		statsRestart:  &model.StatsRestartMarker{StartedAt: startedAt},
+		health:        newHealthTracker(startedAt),
+		acmeWake:      make(chan struct{}, 1),
+		agentRules:    map[string]model.RouteRule{},
+		abuseBlocks:   map[string]*abuseBlock{},
+		events:        eventQueue{wake: make(chan struct{}, 1)},
+	}
+	if cfg.Storage.Dir != "" {
+		a.counters = state.NewCounterStore(filepath.Join(cfg.Storage.Dir, statsCountersFile))
+	}
+	if cfg.BandwidthCap.Enabled && cfg.Storage.Dir != "" {
+		a.bandwidth.store = state.NewBandwidthStore(filepath.Join(cfg.Storage.Dir, bandwidthFile))
+	}
+	if cfg.UsageHistory.Enabled {
+		a.usageHistory = usage.NewHistory(cfg.UsageHistory.Dir, cfg.UsageHistory.RetentionDays)
+	}
+	if cfg.GeoIP.Enabled {
+		files := cfg.GeoIP.Files
+		if len(files) == 0 {
+			share := xraycore.AgentLayout(xraycore.Options{ShareDir: cfg.Xray.Install.ShareDir}).ShareDir
+			files = []string{filepath.Join(share, "geoip.dat")}
+		}
+		a.geo = geoip.New(files, log)
 	}
+	if cfg.Assist.Enabled {
+		a.assist = assist.New(assist.Options{
+			SSHBinary:   cfg.Assist.SSHBinary,
+			KeyFile:     cfg.Assist.KeyFile,
+			LocalAddr:   cfg.Assist.LocalAddr,
+			MaxDuration: time.Duration(cfg.Assist.MaxDurationSec) * time.Second,
+			Logger:      log,
+		})
+	}
+	if cfg.ACME.Enabled {
+		a.issuer = acme.New(acme.Options{
+			Directory:      cfg.ACME.Directory,
+			Email:          cfg.ACME.Email,
+			AccountKeyFile: cfg.ACME.AccountKeyFile,
+			HTTPAddr:       cfg.ACME.HTTPAddr,
+			Webroot:        cfg.ACME.Webroot,
+			Challenge:      cfg.ACME.Challenge,
+			TLSAddr:        cfg.ACME.TLSAddr,
+			Logger:         log,
+		})
+	}
+	if ctrl != nil {
+		ctrl.SetCapabilities(a.capabilities())
+	}
+	return a
+}
+
+// SetCoreSupervisor routes core restarts to s instead of systemctl. It must be
+// called before Start.
+func (a *Agent) SetCoreSupervisor(s CoreSupervisor) {
+	a.core = s
+}
+
+// SetLogRotator lets ROTATE_LOGS rotate the agent's log file. It must be
+// called before Start.
+func (a *Agent) SetLogRotator(r LogRotator) {
+	a.logs = r
+}
+
+// SetAudit makes the agent attribute the changes it applies to the state
+// version that caused them and deliver queued entries to the panel. The
+// core manager records them; see xray.Manager.SetAudit. It must be called
+// before Start.
+func (a *Agent) SetAudit(l *audit.Log) {
+	a.audit = l
+}
+
+// OnRetention registers h for retention policies from the panel. It must be
+// called before Start.
+func (a *Agent) OnRetention(h RetentionHandler) {
+	a.retention = append(a.retention, h)
 }
 
 func (a *Agent) Start(ctx context.Context) {
-	go a.runStateLoop(ctx)
-	go a.runOnlineLoop(ctx)
-	go a.runStatsLoop(ctx)
-	go a.runMetricsLoop(ctx)
-	go a.runHeartbeatLoop(ctx)
-	go a.runCommandLoop(ctx)
-	go a.runCoreUpdateLoop(ctx)
+	a.restoreStatsCounters()
+	if dir := a.cfg.Storage.Dir; dir != "" {
+		a.noteStorage(dir, state.ProbeWritable(dir))
+	}
+	if a.assist != nil {
+		go func() {
+			<-ctx.Done()
+			_ = a.assist.Close()
+		}()
+	}
+
+	go func() {
+		if delay := a.startupDelay(); delay > 0 {
+			a.log.Info("delaying first sync", "delay", delay.Round(time.Millisecond))
+			if !sleepContext(ctx, delay) {
+				return
+			}
+		}
+		go a.runStateLoop(ctx)
+		go a.runStateStream(ctx)
+		go a.runOnlineLoop(ctx)
+		go a.runStatsLoop(ctx)
+		go a.runMetricsLoop(ctx)
+		go a.runHeartbeatLoop(ctx)
+		go a.runReportLoop(ctx)
+		go a.runCommandLoop(ctx)
+		go a.runReconcileLoop(ctx)
+		go a.runCoreUpdateLoop(ctx)
+		go a.runACMELoop(ctx)
+		go a.runEventLoop(ctx)
+		go a.runAccessLogLoop(ctx)
+		go a.runBandwidthCapLoop(ctx)
+	}()
+}
+
+// RunOnce runs one state sync, stats, online, metrics and heartbeat cycle
+// synchronously and returns every failure. The background loops are not started.
+func (a *Agent) RunOnce(ctx context.Context) error {
+	var errs []error
+	if err := a.track(subsystemState, a.syncStateOnce(ctx)); err != nil {
+		errs = append(errs, fmt.Errorf("state sync: %w", err))
+	}
+	if a.stats != nil {
+		if err := a.track(subsystemStats, a.pushStatsOnce(ctx)); err != nil {
+			errs = append(errs, err)
+		}
+		if a.cfg.Backend != config.BackendSingBox {
+			if err := a.track(subsystemOnline, a.pushOnlineOnce(ctx)); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if err := a.track(subsystemMetrics, a.pushMetricsOnce(ctx)); err != nil {
+		errs = append(errs, err)
+	}
+	if err := a.ctrl.Heartbeat(ctx, a.nodeStatus()); err != nil {
+		errs = append(errs, fmt.Errorf("heartbeat: %w", err))
+	}
+	return errors.Join(errs...)
 }
 
 func (a *Agent) runStateLoop(ctx context.Context) {
@@ -62,18 +318,18 @@ func (a *Agent) runStateLoop(ctx context.Context) {
 	if intv <= 0 {
 		intv = 15 * time.Second
 	}
-	ticker := time.NewTicker(intv)
-	defer ticker.Stop()
+	sched := a.newSchedule(intv)
+	if a.ctrl != nil {
+		sched.wake = a.ctrl.StateUpdates()
+	}
 
 	for {
-		if err := a.syncStateOnce(ctx); err != nil {
+		if err := a.track(subsystemState, a.syncStateOnce(ctx)); err != nil {
 			a.log.Warn("state-sync", "err", err)
 		}
 
-		select {
-		case <-ctx.Done():
+		if !sched.wait(ctx) {
 			return
-		case <-ticker.C:
 		}
 	}
 }
@@ -87,14 +343,68 @@ func (a *Agent) syncStateAfterRuntimeReset(ctx context.Context) error {
 }
 
 func (a *Agent) syncState(ctx context.Context, assumeEmptyRuntime bool) error {
+	coreRestarted, err := a.applyState(ctx, assumeEmptyRuntime)
+	if ferr := a.audit.Flush(ctx, a.ctrl.PostAudit); ferr != nil {
+		a.log.Warn("audit entries not delivered; retrying after the next sync", "err", ferr)
+	}
+	if err != nil {
+		if a.syncFailing.CompareAndSwap(false, true) {
+			a.emit(model.EventSyncFailed, model.SeverityError, "state sync failed", map[string]string{"error": err.Error()})
+		}
+	} else {
+		a.syncFailing.Store(false)
+	}
+	if err != nil || !coreRestarted {
+		return err
+	}
+	// A config change restarted xray, which dropped every user and rule.
+	return a.syncStateAfterCoreRestart(ctx)
+}
+
+// applyState fetches and applies the state. It reports whether applying it
+// restarted xray, in which case the users and rules were not applied.
+func (a *Agent) applyState(ctx context.Context, assumeEmptyRuntime bool) (bool, error) {
 	a.syncMu.Lock()
 	defer a.syncMu.Unlock()
 
 	ds, err := a.ctrl.GetState(ctx)
 	if err != nil {
-		return err
+		return false, err
+	}
+	source := audit.SourceState
+	if assumeEmptyRuntime {
+		source = audit.SourceReapply
+	}
+	ctx = audit.WithSource(ctx, source, ds.ConfigVersion)
+
+	a.applyRetention(ds.Retention)
+	configChanged, err := a.applyXrayConfig(ctx, ds)
+	if err != nil {
+		a.log.Warn("xray config settings not applied", "err", err)
+	}
+	certsChanged, err := a.applyCertificates(ds.Certificates)
+	if err != nil {
+		a.log.Warn("certificates not applied", "err", err)
+	}
+	a.noteACMEDomains(ds.ACMEDomains)
+	a.noteFeatures(ds.Features)
+	if configChanged || certsChanged {
+		// xray reads its config and certificate files only at startup.
+		if err := a.restartCore(ctx); err != nil {
+			return false, fmt.Errorf("restart xray after config change: %w", err)
+		}
+		return true, nil
+	}
+
+	// Outbounds go first so that new route rules can send traffic to them.
+	if err := a.applyOutbounds(ctx, ds.Outbounds, assumeEmptyRuntime); err != nil {
+		return false, fmt.Errorf("outbounds: %w", err)
 	}
 
+	// Wireguard peers live in the xray config, not in the user API.
+	clients := slices.DeleteFunc(slices.Clone(model.WithInboundTags(ds.Clients, ds.InboundTags)), func(c model.Client) bool {
+		return c.Proto == model.ProtoWireGuard
+	})
 	normalizedRoutes, duplicateRouteTags := model.NormalizeRouteRules(ds.Routes)
 	if len(duplicateRouteTags) > 0 {
 		a.log.Warn(
@@ -104,9 +414,13 @@ func (a *Agent) syncState(ctx context.Context, assumeEmptyRuntime bool) error {
 		)
 	}
 
-	if !assumeEmptyRuntime && a.state.IsUnchanged(ds.ConfigVersion, ds.Clients, normalizedRoutes) {
+	routes := slices.DeleteFunc(slices.Clone(normalizedRoutes), func(r model.RouteRule) bool {
+		return len(r.Unsupported) > 0
+	})
+
+	if !assumeEmptyRuntime && a.state.IsUnchanged(ds.ConfigVersion, clients, routes) {
 		a.log.Debug("state unchanged")
-		return nil
+		return false, nil
 	}
 
 	current := a.state.ClientsSnapshot()
@@ -120,22 +434,100 @@ func (a *Agent) syncState(ctx context.Context, assumeEmptyRuntime bool) error {
 				"version",
 				ds.ConfigVersion,
 				"clients",
-				len(ds.Clients),
+				len(clients),
 				"routes",
-				len(normalizedRoutes),
+				len(routes),
 			)
 		}
 	}
 
-	changed, err := a.xray.State(ctx, current, ds.Clients, currentRoutes, normalizedRoutes)
+	// Users the bandwidth cap took off their inbounds stay off until it lifts.
+	maps.DeleteFunc(current, func(_ string, c model.Client) bool { return a.capWithholds(c) })
+	live := slices.DeleteFunc(slices.Clone(clients), a.capWithholds)
+	changed, failedRoutes, err := a.xray.State(ctx, current, live, currentRoutes, routes)
 	if err != nil {
-		return err
+		return false, err
 	}
+	// Failed rules are left out of the store so the next sync retries them.
+	routes = slices.DeleteFunc(routes, func(r model.RouteRule) bool {
+		_, failed := failedRoutes[r.Tag]
+		return failed
+	})
 	if changed {
-		a.log.Info("applied clients/routes", "version", ds.ConfigVersion, "clients", len(ds.Clients), "routes", len(normalizedRoutes))
+		a.log.Info("applied clients/routes", "version", ds.ConfigVersion, "clients", len(clients), "routes", len(routes))
+		severity := model.SeverityInfo
+		if len(failedRoutes) > 0 {
+			severity = model.SeverityWarn
+		}
+		a.emit(model.EventSyncApplied, severity, "applied state", map[string]string{
+			"config_version": strconv.FormatInt(ds.ConfigVersion, 10),
+			"clients":        strconv.Itoa(len(clients)),
+			"routes":         strconv.Itoa(len(routes)),
+			"failed_routes":  strconv.Itoa(len(failedRoutes)),
+		})
 	}
-	a.state.Update(ds.ConfigVersion, ds.Clients, normalizedRoutes)
-	return nil
+	a.state.Update(ds.ConfigVersion, clients, routes)
+	a.reportRoutes(normalizedRoutes, failedRoutes)
+	if assumeEmptyRuntime {
+		a.reapplyAgentRules(ctx)
+	}
+	return false, nil
+}
+
+// reportRoutes records the outcome of each route rule of the state for the
+// heartbeat and logs the rules that are not in xray.
+func (a *Agent) reportRoutes(routes []model.RouteRule, failed map[string]error) {
+	results := make([]model.RouteResult, 0, len(routes))
+	for _, r := range routes {
+		res := model.RouteResult{Tag: r.Tag, Status: model.RouteApplied}
+		if len(r.Unsupported) > 0 {
+			res.Status = model.RouteSkipped
+			res.Reason = "unsupported matcher: " + strings.Join(r.Unsupported, ", ")
+			a.log.Warn("route rule skipped", "tag", r.Tag, "unsupported", r.Unsupported)
+		} else if err := failed[r.Tag]; err != nil {
+			res.Status = model.RouteFailed
+			res.Reason = err.Error()
+			a.log.Warn("route rule not applied", "tag", r.Tag, "err", err)
+		}
+		results = append(results, res)
+	}
+	if a.health != nil {
+		a.health.setRoutes(results)
+	}
+}
+
+// applyRetention hands a changed retention policy to every handler. Dropping
+// the policy from the state hands over an empty one, which restores the
+// local config.
+func (a *Agent) applyRetention(policy *model.RetentionPolicy) {
+	if policy.Equal(a.appliedRetention) {
+		return
+	}
+	if err := policy.Validate(); err != nil {
+		a.log.Warn("ignoring retention policy", "err", err)
+		return
+	}
+	var p model.RetentionPolicy
+	if policy != nil {
+		p = *policy
+	}
+	for _, h := range a.retention {
+		h(p)
+	}
+	a.appliedRetention = &p
+
+	var attrs []any
+	for name, v := range map[string]*int{
+		"spool_max_age_sec":  p.SpoolMaxAgeSec,
+		"backup_count":       p.BackupCount,
+		"log_max_age_days":   p.LogMaxAgeDays,
+		"history_cache_size": p.HistoryCacheSize,
+	} {
+		if v != nil {
+			attrs = append(attrs, name, *v)
+		}
+	}
+	a.log.Info("applied retention policy", attrs...)
 }
 
 func (a *Agent) runStatsLoop(ctx context.Context) {
@@ -143,51 +535,106 @@ func (a *Agent) runStatsLoop(ctx context.Context) {
 	if intv <= 0 {
 		intv = 60 * time.Second
 	}
-	ticker := time.NewTicker(intv)
-	defer ticker.Stop()
+	sched := a.newSchedule(intv)
 
 	for {
-		emails := a.state.Emails()
-		if len(emails) > 0 {
-			slices.Sort(emails)
-			if statsMap, err := a.stats.QueryUserBytes(ctx, emails); err != nil {
-				a.log.Warn("stats query", "err", err)
-			} else {
-				if !a.cfg.Xray.StatsResetEachPush {
-					statsMap = a.normalizeStatsDeltas(statsMap)
-				} else if len(a.statsSnapshot) > 0 {
-					clear(a.statsSnapshot)
-				}
-
-				users := make([]model.UserUsage, 0, len(statsMap))
-				for _, email := range emails {
-					if usage, ok := statsMap[email]; ok {
-						lower := strings.ToLower(email)
-						users = append(users, model.UserUsage{Email: lower, Uplink: usage[0], Downlink: usage[1]})
-						a.log.Debug("usage sample", "email", lower, "uplink", usage[0], "downlink", usage[1])
-					}
-				}
-				if len(users) > 0 {
-					payload := &model.StatsPush{ServerTime: time.Now().UTC(), Users: users}
-					if err := a.ctrl.PostStats(ctx, payload); err != nil {
-						a.log.Warn("post stats", "err", err)
-					} else {
-						a.log.Debug("posted stats", "count", len(users))
-					}
-				}
+		// runReportLoop sends the heartbeat while combined_report is on.
+		if !a.combinedReport() {
+			if err := a.track(subsystemStats, a.pushStatsOnce(ctx)); err != nil {
+				a.log.Warn("stats-sync", "err", err)
 			}
 		}
 
-		select {
-		case <-ctx.Done():
+		if !sched.wait(ctx) {
 			return
-		case <-ticker.C:
 		}
 	}
 }
 
+func (a *Agent) pushStatsOnce(ctx context.Context) error {
+	payload, commit, err := a.collectStats(ctx)
+	if err != nil || commit == nil {
+		return err
+	}
+	defer a.saveStatsCounters()
+	if payload != nil {
+		if err := a.ctrl.PostStats(ctx, payload); err != nil {
+			// Nothing is committed, so the next push reports this usage again.
+			return fmt.Errorf("post stats sequence %d: %w", payload.Sequence, err)
+		}
+		a.log.Debug("posted stats", "count", len(payload.Users), "sequence", payload.Sequence, "checkpoint", payload.Checkpoint)
+	}
+	commit()
+	return nil
+}
+
+// collectStats reads the usage for the next stats push. payload is nil when
+// no user has usage to report. commit records the usage as delivered: call
+// it once the panel accepted payload, or right away when payload is nil, and
+// save the counters either way. A nil commit means there is nothing to do.
+func (a *Agent) collectStats(ctx context.Context) (payload *model.StatsPush, commit func(), err error) {
+	if a.statsReplay {
+		payload, commit = a.replayStats(ctx)
+		return payload, commit, nil
+	}
+	emails := a.state.Emails()
+	if len(emails) == 0 {
+		return nil, nil, nil
+	}
+	slices.Sort(emails)
+
+	uptime, uptimeOK := a.noteCoreUptime(ctx)
+	counters, err := a.stats.QueryUserBytes(ctx, emails)
+	if err != nil {
+		return nil, nil, fmt.Errorf("stats query: %w", err)
+	}
+	statsMap := a.pendingUsage(counters)
+	a.recordUsage(statsMap)
+	checkpoint := a.statsCheckpointDue()
+
+	users := make([]model.UserUsage, 0, len(statsMap))
+	for _, email := range emails {
+		usage, ok := statsMap[email]
+		if !ok || (usage == [2]int64{} && !checkpoint) {
+			continue
+		}
+		lower := strings.ToLower(email)
+		user := model.UserUsage{Email: lower, Uplink: usage[0], Downlink: usage[1]}
+		if checkpoint {
+			total := a.statsTotals[lower]
+			up, down := total[0]+usage[0], total[1]+usage[1]
+			user.TotalUplink, user.TotalDownlink = &up, &down
+		}
+		users = append(users, user)
+		a.log.Debug("usage sample", "email", lower, "uplink", usage[0], "downlink", usage[1])
+	}
+
+	if len(users) > 0 {
+		a.attachOnlineIPs(ctx, users)
+		payload = a.newStatsPush(users)
+		payload.Checkpoint = checkpoint
+		payload.CounterReset = a.statsCoreReset
+		if a.cfg.Xray.StatsResetEachPush {
+			// Counters are reset once the panel accepts this push; until
+			// then it is on disk, so a crash in between does not lose it.
+			a.statsInFlight = &state.InFlightStats{Push: payload, Counters: counters, CoreUptime: uptime}
+			a.saveStatsCounters()
+		}
+	}
+	commit = func() {
+		a.statsInFlight = nil
+		if payload != nil {
+			a.statsRestart = nil
+			a.addUsageTotals(emails, users, checkpoint)
+		}
+		a.commitUsage(ctx, emails, counters)
+		a.commitCoreUptime(uptime, uptimeOK)
+	}
+	return payload, commit, nil
+}
+
 func (a *Agent) runOnlineLoop(ctx context.Context) {
-	if a.stats == nil {
+	if a.stats == nil || a.cfg.Backend == config.BackendSingBox {
 		return
 	}
 
@@ -195,46 +642,50 @@ func (a *Agent) runOnlineLoop(ctx context.Context) {
 	if intv <= 0 {
 		intv = 10 * time.Second
 	}
-	ticker := time.NewTicker(intv)
-	defer ticker.Stop()
+	sched := a.newSchedule(intv)
 
 	for {
-		payload, err := a.collectOnlineSnapshot(ctx)
-		if err != nil {
-			a.log.Warn("online query", "err", err)
-		} else if payload != nil {
-			if err := a.ctrl.PostOnlineUsers(ctx, payload); err != nil {
-				a.log.Warn("post online users", "err", err)
-			} else {
-				a.log.Debug("posted online users", "count", len(payload.Users))
-			}
+		if err := a.track(subsystemOnline, a.pushOnlineOnce(ctx)); err != nil {
+			a.log.Warn("online-sync", "err", err)
 		}
 
-		select {
-		case <-ctx.Done():
+		if !sched.wait(ctx) {
 			return
-		case <-ticker.C:
 		}
 	}
 }
 
+func (a *Agent) pushOnlineOnce(ctx context.Context) error {
+	payload, err := a.collectOnlineSnapshot(ctx)
+	if err != nil {
+		return fmt.Errorf("online query: %w", err)
+	}
+	if payload == nil {
+		return nil
+	}
+	if err := a.ctrl.PostOnlineUsers(ctx, payload); err != nil {
+		return fmt.Errorf("post online users: %w", err)
+	}
+	a.log.Debug("posted online users", "count", len(payload.Users))
+	return nil
+}
+
 func (a *Agent) runHeartbeatLoop(ctx context.Context) {
 	intv := time.Duration(a.cfg.Intervals.HeartbeatSec) * time.Second
 	if intv <= 0 {
 		intv = 30 * time.Second
 	}
-	ticker := time.NewTicker(intv)
-	defer ticker.Stop()
+	sched := a.newSchedule(intv)
 
 	for {
-		if err := a.ctrl.Heartbeat(ctx); err != nil {
-			a.log.Debug("heartbeat", "err", err)
+		if !a.combinedReport() {
+			if err := a.ctrl.Heartbeat(ctx, a.nodeStatus()); err != nil {
+				a.log.Debug("heartbeat", "err", err)
+			}
 		}
 
-		select {
-		case <-ctx.Done():
+		if !sched.wait(ctx) {
 			return
-		case <-ticker.C:
 		}
 	}
 }
@@ -248,34 +699,62 @@ func (a *Agent) runMetricsLoop(ctx context.Context) {
 	if intv <= 0 {
 		intv = 30 * time.Second
 	}
-	ticker := time.NewTicker(intv)
-	defer ticker.Stop()
+	sched := a.newSchedule(intv)
 
 	for {
-		if sample := a.collectMetricsSample(ctx); sample != nil {
-			if err := a.ctrl.PostMetrics(ctx, sample); err != nil {
-				a.log.Warn("post metrics", "err", err)
-			} else {
-				a.log.Debug("posted metrics",
-					"cpu", sample.CPUPercent,
-					"mem", sample.MemoryPercent,
-					"up_mbps", sample.BandwidthUpMbps,
-					"down_mbps", sample.BandwidthDownMbps,
-					"sys_stats", sample.XraySysStats != nil,
-				)
+		if !a.combinedReport() {
+			if err := a.track(subsystemMetrics, a.pushMetricsOnce(ctx)); err != nil {
+				a.log.Warn("metrics-sync", "err", err)
 			}
 		}
 
-		select {
-		case <-ctx.Done():
+		if !sched.wait(ctx) {
 			return
-		case <-ticker.C:
 		}
 	}
 }
 
+func (a *Agent) pushMetricsOnce(ctx context.Context) error {
+	sample := a.collectMetricsSample(ctx)
+	if sample == nil {
+		return nil
+	}
+	a.checkAlerts(ctx, sample)
+	if err := a.ctrl.PostMetrics(ctx, sample); err != nil {
+		a.metricsBacklog.add(sample)
+		return fmt.Errorf("post metrics: %w", err)
+	}
+	a.log.Debug("posted metrics",
+		"cpu", sample.CPUPercent,
+		"mem", sample.MemoryPercent,
+		"up_mbps", sample.BandwidthUpMbps,
+		"down_mbps", sample.BandwidthDownMbps,
+		"sys_stats", sample.XraySysStats != nil,
+	)
+	return a.flushMetricsBacklog(ctx)
+}
+
+// flushMetricsBacklog posts the aggregates of an outage, oldest first, after
+// the panel accepted a live sample again. What is left is retried on the
+// next successful push.
+func (a *Agent) flushMetricsBacklog(ctx context.Context) error {
+	posted := 0
+	for !a.metricsBacklog.empty() {
+		if err := a.ctrl.PostMetrics(ctx, a.metricsBacklog.oldest()); err != nil {
+			return fmt.Errorf("post metrics backlog: %w", err)
+		}
+		a.metricsBacklog.drop()
+		posted++
+	}
+	if posted > 0 {
+		a.log.Info("posted metrics aggregated during outage", "samples", posted)
+	}
+	return nil
+}
+
 func (a *Agent) runCoreUpdateLoop(ctx context.Context) {
-	if a.ctrl == nil {
+	// sing-box is installed and updated outside the agent.
+	if a.ctrl == nil || a.cfg.Backend == config.BackendSingBox {
 		return
 	}
 
@@ -287,8 +766,9 @@ func (a *Agent) runCoreUpdateLoop(ctx context.Context) {
 		return
 	}
 
-	ticker := time.NewTicker(intv)
-	defer ticker.Stop()
+	sched := a.newSchedule(intv)
+	// The check asks GitHub, not the panel.
+	sched.hold = nil
 
 	var (
 		lastInstalled       string
@@ -323,17 +803,18 @@ func (a *Agent) runCoreUpdateLoop(ctx context.Context) {
 			}
 		}
 
-		select {
-		case <-ctx.Done():
+		if !sched.wait(ctx) {
 			return
-		case <-ticker.C:
 		}
 	}
 }
 
 func (a *Agent) checkCoreUpdateOnce(ctx context.Context) (*xraycore.CheckResult, error) {
 	return xrayCoreChecker(ctx, xraycore.Options{
-		Token: a.cfg.GitHub.Token,
+		Repo:     a.cfg.GitHub.Repo,
+		Token:    a.cfg.GitHub.Token,
+		CacheDir: a.cfg.Storage.Dir,
+		Proxy:    a.cfg.GitHub.DownloadProxy,
 	})
 }
 
@@ -341,6 +822,15 @@ func (a *Agent) collectMetricsSample(ctx context.Context) *model.ServerMetricPus
 	var sample *model.ServerMetricPush
 	if a.metrics != nil {
 		sample = a.metrics.Sample(ctx)
+		if conns := a.metrics.Connections(a.inboundPorts()); conns != nil {
+			if sample == nil {
+				sample = &model.ServerMetricPush{ServerTime: time.Now().UTC()}
+			}
+			sample.Connections = conns
+		}
+		if network := a.metrics.Network(ctx); network != nil && sample != nil {
+			sample.Network = network
+		}
 	}
 
 	if sysStats := a.collectXraySysStats(ctx); sysStats != nil {
@@ -381,6 +871,11 @@ func (a *Agent) collectOnlineSnapshot(ctx context.Context) (*model.OnlineUsersPu
 		if client, ok := byEmail[users[idx].Email]; ok && users[idx].Proto == "" {
 			users[idx].Proto = client.Proto
 		}
+		if a.geo != nil {
+			for i := range users[idx].IPs {
+				users[idx].IPs[i].GeoInfo = a.geo.LookupString(users[idx].IPs[i].Address)
+			}
+		}
 	}
 
 	slices.SortFunc(users, func(a, b model.OnlineUserInfo) int {
@@ -393,38 +888,313 @@ func (a *Agent) collectOnlineSnapshot(ctx context.Context) (*model.OnlineUsersPu
 	}, nil
 }
 
-func (a *Agent) normalizeStatsDeltas(current map[string][2]int64) map[string][2]int64 {
-	if len(current) == 0 {
-		clear(a.statsSnapshot)
-		return current
+// attachOnlineIPs adds the addresses each user is online from, as xray's
+// online tracking sees them, with their country and AS when geoip is
+// enabled. They are best effort: xray only tracks them with
+// statsUserOnline in its policy, and a failed query just leaves them out.
+func (a *Agent) attachOnlineIPs(ctx context.Context, users []model.UserUsage) {
+	if a.cfg.Backend == config.BackendSingBox {
+		return
+	}
+	online, err := a.stats.OnlineUsers(ctx)
+	if err != nil {
+		a.log.Debug("online ips for stats push", "err", err)
+		return
+	}
+	ips := make(map[string][]string, len(online))
+	for _, u := range online {
+		email := strings.ToLower(u.Email)
+		for _, ip := range u.IPs {
+			ips[email] = append(ips[email], ip.Address)
+		}
+	}
+	for i := range users {
+		users[i].IPs = ips[users[i].Email]
+		if a.geo == nil {
+			continue
+		}
+		for _, ip := range users[i].IPs {
+			if info := a.geo.LookupString(ip); !info.IsZero() {
+				if users[i].IPGeo == nil {
+					users[i].IPGeo = map[string]model.GeoInfo{}
+				}
+				users[i].IPGeo[ip] = info
+			}
+		}
 	}
+}
 
-	normalized := make(map[string][2]int64, len(current))
-	present := make(map[string]struct{}, len(current))
+// replayStats returns the push that was in flight when the previous agent
+// stopped. The panel may have accepted it already, so it keeps its sequence
+// and is marked replayed. Committing it takes its counters as reported and
+// resets them, which is right whether or not the previous agent got as far as
+// the reset: a counter that was reset is below its reported value, so all of
+// it counts as new usage.
+func (a *Agent) replayStats(ctx context.Context) (*model.StatsPush, func()) {
+	in := a.statsInFlight
+	push := *in.Push
+	push.Replayed = true
+	emails := slices.Sorted(maps.Keys(in.Counters))
+	a.log.Info("replaying the stats push that was unconfirmed when the agent stopped", "sequence", push.Sequence)
+	return &push, func() {
+		a.statsReplay, a.statsInFlight = false, nil
+		a.addUsageTotals(emails, push.Users, push.Checkpoint)
+		a.commitUsage(ctx, emails, in.Counters)
+		a.commitCoreUptime(in.CoreUptime, in.CoreUptime > 0)
+	}
+}
 
-	for email, usage := range current {
+// pendingUsage returns the usage not yet reported to the panel: the counters
+// minus what statsSnapshot says was already reported, plus usage carried over
+// from a reset. Without stats_reset_each_push a user seen for the first time
+// starts at zero, since its counter may include usage reported before the
+// agent restarted; with it, counters only hold unreported usage.
+//
+// A counter below its reported value means xray restarted and counted from
+// zero again, so the whole counter is new usage; both directions of a user
+// are treated that way when either went backwards. After a restart seen in
+// xray's uptime (statsCoreReset) every counter is new usage, which also
+// covers counters that already grew past their old values.
+func (a *Agent) pendingUsage(counters map[string][2]int64) map[string][2]int64 {
+	pending := make(map[string][2]int64, len(counters))
+	for email, usage := range counters {
 		key := strings.ToLower(email)
-		present[key] = struct{}{}
-
 		prev, found := a.statsSnapshot[key]
-		uplink := int64(0)
-		downlink := int64(0)
-		if found {
-			uplink = usageCounterDelta(prev[0], usage[0])
-			downlink = usageCounterDelta(prev[1], usage[1])
+		var delta [2]int64
+		switch {
+		case a.statsCoreReset || usage[0] < prev[0] || usage[1] < prev[1]:
+			delta = [2]int64{max(usage[0], 0), max(usage[1], 0)}
+		case found || a.cfg.Xray.StatsResetEachPush:
+			delta = [2]int64{usageCounterDelta(prev[0], usage[0]), usageCounterDelta(prev[1], usage[1])}
+		}
+		carry := a.statsCarry[key]
+		pending[email] = [2]int64{delta[0] + carry[0], delta[1] + carry[1]}
+	}
+	return pending
+}
+
+// commitUsage records that the usage from pendingUsage(counters) reached the
+// panel. With stats_reset_each_push the counters are reset only now, and what
+// xray counted between the query and the reset is carried into the next push.
+// If the reset fails, statsSnapshot keeps the reported values so they are not
+// reported twice.
+func (a *Agent) commitUsage(ctx context.Context, emails []string, counters map[string][2]int64) {
+	clear(a.statsSnapshot)
+	clear(a.statsCarry)
+	clear(a.usageRecorded)
+	for email, usage := range counters {
+		a.statsSnapshot[strings.ToLower(email)] = usage
+	}
+	if !a.cfg.Xray.StatsResetEachPush || len(emails) == 0 {
+		return
+	}
+
+	reset, err := a.stats.ResetUserBytes(ctx, emails)
+	if err != nil {
+		a.log.Warn("stats reset failed; counters stay cumulative until the next push", "err", err)
+		return
+	}
+	if a.statsCarry == nil {
+		a.statsCarry = map[string][2]int64{}
+	}
+	for email, usage := range reset {
+		key := strings.ToLower(email)
+		prev := a.statsSnapshot[key]
+		carry := [2]int64{usageCounterDelta(prev[0], usage[0]), usageCounterDelta(prev[1], usage[1])}
+		if carry != ([2]int64{}) {
+			a.statsCarry[key] = carry
 		}
+	}
+	clear(a.statsSnapshot)
+}
+
+// noteCoreUptime reads xray's uptime before the counters and sets
+// statsCoreReset when it is below the uptime recorded with the reported
+// counters, i.e. xray restarted since. The flag stays set until usage is
+// committed, so a failed push is retried with the same treatment.
+func (a *Agent) noteCoreUptime(ctx context.Context) (uint32, bool) {
+	sys, err := a.stats.SysStats(ctx)
+	if err != nil || sys == nil {
+		a.log.Debug("core uptime unknown; relying on counters going backwards", "err", err)
+		return 0, false
+	}
+	if a.statsCoreUptime > 0 && sys.Uptime < a.statsCoreUptime && !a.statsCoreReset {
+		a.log.Info("xray restarted since the last stats push; counting all counters as new usage",
+			"uptime_sec", sys.Uptime, "previous_uptime_sec", a.statsCoreUptime)
+		a.statsCoreReset = true
+		if a.coreRestarts.Load() == a.statsCoreRestarts {
+			a.emit(model.EventCoreCrashed, model.SeverityError, "xray restarted without the agent restarting it", map[string]string{
+				"uptime_sec":          strconv.FormatUint(uint64(sys.Uptime), 10),
+				"previous_uptime_sec": strconv.FormatUint(uint64(a.statsCoreUptime), 10),
+			})
+		}
+	}
+	return sys.Uptime, true
+}
 
-		normalized[email] = [2]int64{uplink, downlink}
-		a.statsSnapshot[key] = usage
+func (a *Agent) commitCoreUptime(uptime uint32, ok bool) {
+	a.statsCoreReset = false
+	a.statsCoreRestarts = a.coreRestarts.Load()
+	if ok {
+		a.statsCoreUptime = uptime
 	}
+}
 
-	for email := range a.statsSnapshot {
-		if _, ok := present[email]; !ok {
-			delete(a.statsSnapshot, email)
+// statsCheckpointDue reports whether the next push is a checkpoint: the
+// first one after the agent starts and then one every stats_checkpoint_sec.
+func (a *Agent) statsCheckpointDue() bool {
+	every := a.cfg.Xray.StatsCheckpointSec
+	if every == 0 {
+		every = config.DefaultStatsCheckpointSec
+	}
+	if every < 0 {
+		return false
+	}
+	return a.statsCheckpointAt.IsZero() || time.Since(a.statsCheckpointAt) >= time.Duration(every)*time.Second
+}
+
+// addUsageTotals adds the usage the panel accepted to the running totals.
+// A checkpoint also forgets the totals of users no longer in the state.
+func (a *Agent) addUsageTotals(emails []string, users []model.UserUsage, checkpoint bool) {
+	if a.statsTotals == nil {
+		a.statsTotals = map[string][2]int64{}
+	}
+	for _, u := range users {
+		total := a.statsTotals[u.Email]
+		a.statsTotals[u.Email] = [2]int64{total[0] + u.Uplink, total[1] + u.Downlink}
+	}
+	if !checkpoint {
+		return
+	}
+	a.statsCheckpointAt = time.Now()
+	keep := make(map[string]bool, len(emails))
+	for _, email := range emails {
+		keep[strings.ToLower(email)] = true
+	}
+	maps.DeleteFunc(a.statsTotals, func(email string, _ [2]int64) bool { return !keep[email] })
+}
+
+// newStatsPush stamps the next push sequence; gaps in the sequence seen by the
+// panel correspond to pushes that never arrived.
+func (a *Agent) newStatsPush(users []model.UserUsage) *model.StatsPush {
+	a.statsSeq++
+	return &model.StatsPush{
+		ServerTime: time.Now().UTC(),
+		Sequence:   a.statsSeq,
+		Restart:    a.statsRestart,
+		Users:      users,
+	}
+}
+
+// recordUsage counts what pending holds beyond what was counted already in
+// the rollups and the usage history, so usage the panel has not accepted
+// yet is counted once however many pushes it takes. A failed history write
+// is retried with the next read.
+func (a *Agent) recordUsage(pending map[string][2]int64) {
+	now := time.Now().UTC()
+	var samples []usage.Sample
+	for _, email := range slices.Sorted(maps.Keys(pending)) {
+		key := strings.ToLower(email)
+		u, done := pending[email], a.usageRecorded[key]
+		up, down := max(u[0]-done[0], 0), max(u[1]-done[1], 0)
+		if up == 0 && down == 0 {
+			continue
 		}
+		samples = append(samples, usage.Sample{Time: now, Email: key, Uplink: up, Downlink: down})
+	}
+	if a.usageHistory != nil {
+		if err := a.usageHistory.Append(samples); err != nil {
+			a.log.Warn("write usage history", "dir", a.usageHistory.Dir(), "err", err)
+			return
+		}
+	}
+	a.rollupMu.Lock()
+	for _, s := range samples {
+		a.rollups.Add(s.Time, s.Email, [2]int64{s.Uplink, s.Downlink})
 	}
+	a.rollupMu.Unlock()
+	for email, u := range pending {
+		a.usageRecorded[strings.ToLower(email)] = u
+	}
+}
+
+func (a *Agent) restoreStatsCounters() {
+	if a.counters == nil {
+		return
+	}
+
+	snap, err := a.counters.Load()
+	if err != nil {
+		a.log.Warn("load stats counters", "path", a.counters.Path(), "err", err)
+		return
+	}
+	if snap == nil {
+		return
+	}
+
+	a.statsSeq = snap.Sequence
+	maps.Copy(a.statsCarry, snap.Pending)
+	maps.Copy(a.usageRecorded, snap.Recorded)
+	if snap.Rollups != nil {
+		a.rollupMu.Lock()
+		a.rollups = *snap.Rollups
+		a.rollupMu.Unlock()
+	}
+	a.statsTotals = maps.Clone(snap.Totals)
+	a.statsCoreUptime = snap.CoreUptime
+	if in := snap.InFlight; in != nil && in.Push != nil {
+		if a.cfg.Xray.StatsResetEachPush {
+			a.statsInFlight, a.statsReplay = in, true
+			a.statsSeq = max(a.statsSeq, in.Push.Sequence)
+		} else {
+			a.log.Warn("dropping an unconfirmed stats push; stats_reset_each_push is now off", "sequence", in.Push.Sequence)
+		}
+	}
+	if a.statsRestart != nil {
+		a.statsRestart.PreviousSequence = snap.Sequence
+		if !snap.SavedAt.IsZero() {
+			savedAt := snap.SavedAt.UTC()
+			a.statsRestart.PreviousSavedAt = &savedAt
+		}
+	}
+
+	for email, usage := range snap.Counters {
+		a.statsSnapshot[email] = usage
+	}
+	if a.statsRestart != nil {
+		a.statsRestart.CountersRestored = len(snap.Counters) > 0
+	}
+	a.log.Info("restored stats counters", "sequence", snap.Sequence, "users", len(snap.Counters))
+}
 
-	return normalized
+func (a *Agent) saveStatsCounters() {
+	if a.counters == nil {
+		return
+	}
+	if a.health != nil && a.health.skipStorageWrite() {
+		a.log.Debug("skipping stats counter save; storage not writable", "path", a.counters.Path())
+		return
+	}
+
+	a.rollupMu.Lock()
+	rollups := a.rollups.Clone()
+	a.rollupMu.Unlock()
+	snap := &state.CounterSnapshot{
+		Sequence:   a.statsSeq,
+		SavedAt:    time.Now().UTC(),
+		Counters:   maps.Clone(a.statsSnapshot),
+		Pending:    maps.Clone(a.statsCarry),
+		Recorded:   maps.Clone(a.usageRecorded),
+		Rollups:    &rollups,
+		Totals:     maps.Clone(a.statsTotals),
+		CoreUptime: a.statsCoreUptime,
+		InFlight:   a.statsInFlight,
+	}
+	err := a.counters.Save(snap)
+	a.noteStorage(a.counters.Path(), err)
+	if err != nil && state.StorageCondition(err) == "" {
+		a.log.Warn("save stats counters", "path", a.counters.Path(), "err", err)
+	}
 }
 
 func usageCounterDelta(prev, curr int64) int64 {
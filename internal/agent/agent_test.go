@@ -3,13 +3,13 @@ package agent
 import (
 	"context"
 	"encoding/json"
-	"fmt"
 	"io"
 	"log/slog"
-	"net"
+	"maps"
 	"net/http"
 	"net/http/httptest"
-	"strings"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -19,53 +19,26 @@ import (
 	"github.com/najahiiii/xray-agent/internal/stats"
 	"github.com/najahiiii/xray-agent/internal/xray"
 	"github.com/najahiiii/xray-agent/internal/xraycore"
+	"github.com/najahiiii/xray-agent/testsupport"
 
-	handlerService "github.com/xtls/xray-core/app/proxyman/command"
-	statscommand "github.com/xtls/xray-core/app/stats/command"
-	"google.golang.org/grpc"
+	"github.com/xtls/xray-core/app/router"
+	"google.golang.org/protobuf/proto"
 )
 
-type recordingHandler struct {
-	handlerService.UnimplementedHandlerServiceServer
-	adds    []string
-	removes []string
-}
-
-func (r *recordingHandler) AlterInbound(ctx context.Context, req *handlerService.AlterInboundRequest) (*handlerService.AlterInboundResponse, error) {
-	msg, err := req.Operation.GetInstance()
-	if err != nil {
-		return nil, err
-	}
-	switch op := msg.(type) {
-	case *handlerService.AddUserOperation:
-		r.adds = append(r.adds, op.User.Email)
-	case *handlerService.RemoveUserOperation:
-		r.removes = append(r.removes, op.Email)
-	default:
-		return nil, fmt.Errorf("unexpected op %T", op)
-	}
-	return &handlerService.AlterInboundResponse{}, nil
-}
-
-func startHandler(t *testing.T) (*recordingHandler, string, func()) {
-	t.Helper()
-	lis, err := net.Listen("tcp", "127.0.0.1:0")
-	if err != nil {
-		t.Fatalf("listen: %v", err)
-	}
-	server := grpc.NewServer()
-	rec := &recordingHandler{}
-	handlerService.RegisterHandlerServiceServer(server, rec)
-	go server.Serve(lis)
-	return rec, lis.Addr().String(), func() {
-		server.Stop()
-		_ = lis.Close()
+// addedEmails returns the emails of AddUser operations recorded by the fake core.
+func addedEmails(core *testsupport.Core) []string {
+	var emails []string
+	for _, op := range core.HandlerOps() {
+		if op.Kind == testsupport.OpAdd {
+			emails = append(emails, op.Email)
+		}
 	}
+	return emails
 }
 
 func newTestConfig(api string) *config.Config {
 	cfg := &config.Config{}
-	cfg.Control.BaseURL = "http://example"
+	cfg.Control.BaseURL = config.URLList{"http://example"}
 	cfg.Control.Token = "t"
 	cfg.Control.ServerSlug = "sg"
 	cfg.Xray.APIServer = api
@@ -83,10 +56,8 @@ func newTestConfig(api string) *config.Config {
 }
 
 func TestAgentSyncStateOnce(t *testing.T) {
-	rec, addr, closeFn := startHandler(t)
-	defer closeFn()
-
-	cfg := newTestConfig(addr)
+	core := testsupport.NewCore(t)
+	cfg := newTestConfig(core.Addr)
 
 	stateResp := model.State{
 		ConfigVersion: 1,
@@ -99,7 +70,7 @@ func TestAgentSyncStateOnce(t *testing.T) {
 		_ = json.NewEncoder(w).Encode(stateResp)
 	}))
 	defer srv.Close()
-	cfg.Control.BaseURL = srv.URL
+	cfg.Control.BaseURL = config.URLList{srv.URL}
 
 	log := slog.New(slog.NewTextHandler(io.Discard, nil))
 	ctrl := control.NewClient(cfg, log, "v1.0.3", "v25.10.15")
@@ -114,8 +85,8 @@ func TestAgentSyncStateOnce(t *testing.T) {
 		t.Fatalf("syncStateOnce: %v", err)
 	}
 
-	if len(rec.adds) != 1 || rec.adds[0] != "user@example.com" {
-		t.Fatalf("expected add, got %+v", rec.adds)
+	if adds := addedEmails(core); len(adds) != 1 || adds[0] != "user@example.com" {
+		t.Fatalf("expected add, got %+v", adds)
 	}
 	if !a.state.IsUnchanged(1, stateResp.Clients, nil) {
 		t.Fatal("state store not updated")
@@ -123,10 +94,8 @@ func TestAgentSyncStateOnce(t *testing.T) {
 }
 
 func TestSyncStateAfterRuntimeResetReappliesCachedClients(t *testing.T) {
-	rec, addr, closeFn := startHandler(t)
-	defer closeFn()
-
-	cfg := newTestConfig(addr)
+	core := testsupport.NewCore(t)
+	cfg := newTestConfig(core.Addr)
 
 	stateResp := model.State{
 		ConfigVersion: 7,
@@ -139,7 +108,7 @@ func TestSyncStateAfterRuntimeResetReappliesCachedClients(t *testing.T) {
 		_ = json.NewEncoder(w).Encode(stateResp)
 	}))
 	defer srv.Close()
-	cfg.Control.BaseURL = srv.URL
+	cfg.Control.BaseURL = config.URLList{srv.URL}
 
 	log := slog.New(slog.NewTextHandler(io.Discard, nil))
 	ctrl := control.NewClient(cfg, log, "v1.0.3", "v25.10.15")
@@ -156,20 +125,18 @@ func TestSyncStateAfterRuntimeResetReappliesCachedClients(t *testing.T) {
 		t.Fatalf("syncStateAfterRuntimeReset: %v", err)
 	}
 
-	if len(rec.adds) != 1 || rec.adds[0] != "user@example.com" {
-		t.Fatalf("expected re-add after runtime reset, got %+v", rec.adds)
+	if adds := addedEmails(core); len(adds) != 1 || adds[0] != "user@example.com" {
+		t.Fatalf("expected re-add after runtime reset, got %+v", adds)
 	}
 }
 
 func TestCollectOnlineSnapshot(t *testing.T) {
-	addr, closeFn := statsTestServer(t, nil, map[string]map[string]int64{
-		"User@example.com": {
-			"203.0.113.10": time.Now().UTC().Unix(),
-		},
+	core := testsupport.NewCore(t)
+	core.SetOnlineIPs("User@example.com", map[string]int64{
+		"203.0.113.10": time.Now().UTC().Unix(),
 	})
-	defer closeFn()
 
-	cfg := newTestConfig(addr)
+	cfg := newTestConfig(core.Addr)
 	log := slog.New(slog.NewTextHandler(io.Discard, nil))
 	collector := stats.New(cfg, log)
 	a := New(cfg, log, nil, nil, collector, nil)
@@ -193,6 +160,49 @@ func TestCollectOnlineSnapshot(t *testing.T) {
 	}
 }
 
+func TestOnlineIPsGeoIP(t *testing.T) {
+	core := testsupport.NewCore(t)
+	core.SetOnlineIPs("user@example.com", map[string]int64{
+		"203.0.113.10": time.Now().UTC().Unix(),
+		"192.168.1.2":  time.Now().UTC().Unix(),
+	})
+	dat, err := proto.Marshal(&router.GeoIPList{Entry: []*router.GeoIP{{
+		CountryCode: "ID",
+		Cidr:        []*router.CIDR{{Ip: []byte{203, 0, 113, 0}, Prefix: 24}},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "geoip.dat")
+	if err := os.WriteFile(path, dat, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := newTestConfig(core.Addr)
+	cfg.GeoIP.Enabled = true
+	cfg.GeoIP.Files = []string{path}
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	a := New(cfg, log, nil, nil, stats.New(cfg, log), nil)
+
+	payload, err := a.collectOnlineSnapshot(context.Background())
+	if err != nil {
+		t.Fatalf("collectOnlineSnapshot: %v", err)
+	}
+	got := map[string]string{}
+	for _, ip := range payload.Users[0].IPs {
+		got[ip.Address] = ip.Country
+	}
+	if want := map[string]string{"203.0.113.10": "ID", "192.168.1.2": ""}; !maps.Equal(got, want) {
+		t.Fatalf("online ip countries = %v, want %v", got, want)
+	}
+
+	users := []model.UserUsage{{Email: "user@example.com"}}
+	a.attachOnlineIPs(context.Background(), users)
+	if want := map[string]model.GeoInfo{"203.0.113.10": {Country: "ID"}}; !maps.Equal(users[0].IPGeo, want) {
+		t.Fatalf("stats push ip_geo = %v, want %v", users[0].IPGeo, want)
+	}
+}
+
 func TestCheckCoreUpdateOnceUsesLatestRelease(t *testing.T) {
 	originalChecker := xrayCoreChecker
 	t.Cleanup(func() {
@@ -285,59 +295,116 @@ func TestRunCoreUpdateLoopChecksInBackground(t *testing.T) {
 	}
 }
 
-func statsTestServer(t *testing.T, values map[string][2]int64, onlineIPs map[string]map[string]int64) (string, func()) {
-	t.Helper()
-	lis, err := net.Listen("tcp", "127.0.0.1:0")
-	if err != nil {
-		t.Fatalf("listen: %v", err)
+func TestApplyRetentionNotifiesOnChange(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	a := New(newTestConfig("127.0.0.1:0"), log, nil, nil, nil, nil)
+
+	var got []model.RetentionPolicy
+	a.OnRetention(func(p model.RetentionPolicy) { got = append(got, p) })
+
+	days := 3
+	policy := &model.RetentionPolicy{LogMaxAgeDays: &days}
+	a.applyRetention(policy)
+	a.applyRetention(&model.RetentionPolicy{LogMaxAgeDays: &days})
+	if len(got) != 1 || model.IntOr(got[0].LogMaxAgeDays, 0) != 3 {
+		t.Fatalf("expected one notification with log_max_age_days=3, got %+v", got)
 	}
-	server := grpc.NewServer()
-	statscommand.RegisterStatsServiceServer(server, &fakeAgentStatsServer{
-		values:    values,
-		onlineIPs: onlineIPs,
-	})
-	go server.Serve(lis)
-	return lis.Addr().String(), func() {
-		server.Stop()
-		_ = lis.Close()
+
+	negative := -1
+	a.applyRetention(&model.RetentionPolicy{BackupCount: &negative})
+	if len(got) != 1 {
+		t.Fatalf("invalid policy should be ignored, got %+v", got)
 	}
-}
 
-type fakeAgentStatsServer struct {
-	statscommand.UnimplementedStatsServiceServer
-	values    map[string][2]int64
-	onlineIPs map[string]map[string]int64
+	a.applyRetention(nil)
+	if len(got) != 2 || got[1].LogMaxAgeDays != nil {
+		t.Fatalf("removing the policy should restore local defaults, got %+v", got)
+	}
 }
 
-func (f *fakeAgentStatsServer) QueryStats(ctx context.Context, req *statscommand.QueryStatsRequest) (*statscommand.QueryStatsResponse, error) {
-	resp := &statscommand.QueryStatsResponse{}
-	for email, usage := range f.values {
-		resp.Stat = append(resp.Stat,
-			&statscommand.Stat{Name: "user>>>" + email + ">>>traffic>>>uplink", Value: usage[0]},
-			&statscommand.Stat{Name: "user>>>" + email + ">>>traffic>>>downlink", Value: usage[1]},
-		)
+func TestSyncStateReportsEachRouteRule(t *testing.T) {
+	core := testsupport.NewCore(t)
+	cfg := newTestConfig(core.Addr)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, `{"config_version": 7, "routes": [
+			{"tag": "direct-private", "outbound_tag": "direct", "ip": ["10.0.0.0/8"]},
+			{"tag": "bad-ip", "outbound_tag": "direct", "ip": ["not-an-ip"]},
+			{"tag": "by-process", "outbound_tag": "blocked", "process": ["curl"], "attrs": null}
+		]}`)
+	}))
+	defer srv.Close()
+	cfg.Control.BaseURL = config.URLList{srv.URL}
+
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	a := New(cfg, log, control.NewClient(cfg, log, "v1.0.3", "v25.10.15"), xray.NewManager(cfg, log), nil, nil)
+	ctx := context.Background()
+
+	if err := a.syncStateOnce(ctx); err != nil {
+		t.Fatalf("syncStateOnce: %v", err)
+	}
+	if tags := core.RuleTags(); len(tags) != 1 || tags[0] != "direct-private" {
+		t.Fatalf("rules in xray = %v", tags)
+	}
+	st := a.healthStatus()
+	if st.ConfigVersion != 7 || st.Status != model.NodeStatusDegraded || len(st.Routes) != 3 {
+		t.Fatalf("status = %+v", st)
+	}
+	want := []string{model.RouteApplied, model.RouteFailed, model.RouteSkipped}
+	for i, res := range st.Routes {
+		if res.Status != want[i] {
+			t.Fatalf("routes[%d] = %+v, want %s", i, res, want[i])
+		}
+	}
+	if st.Routes[2].Reason != "unsupported matcher: process" || st.Routes[1].Reason == "" {
+		t.Fatalf("reasons = %+v", st.Routes)
 	}
-	return resp, nil
-}
 
-func (f *fakeAgentStatsServer) GetAllOnlineUsers(ctx context.Context, req *statscommand.GetAllOnlineUsersRequest) (*statscommand.GetAllOnlineUsersResponse, error) {
-	users := make([]string, 0, len(f.onlineIPs))
-	for email := range f.onlineIPs {
-		users = append(users, "user>>>"+email+">>>online")
+	// The failed rule is retried; the applied one is left alone.
+	core.ResetOps()
+	if err := a.syncStateOnce(ctx); err != nil {
+		t.Fatalf("second syncStateOnce: %v", err)
+	}
+	for _, op := range core.RouteOps() {
+		if op.Tag != "bad-ip" {
+			t.Fatalf("unexpected route op on retry: %+v", op)
+		}
 	}
-	return &statscommand.GetAllOnlineUsersResponse{Users: users}, nil
 }
 
-func (f *fakeAgentStatsServer) GetStatsOnlineIpList(ctx context.Context, req *statscommand.GetStatsRequest) (*statscommand.GetStatsOnlineIpListResponse, error) {
-	name := req.GetName()
-	const prefix = "user>>>"
-	const suffix = ">>>online"
-	if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
-		return &statscommand.GetStatsOnlineIpListResponse{Name: name}, nil
-	}
-	email := strings.TrimSuffix(strings.TrimPrefix(name, prefix), suffix)
-	return &statscommand.GetStatsOnlineIpListResponse{
-		Name: name,
-		Ips:  f.onlineIPs[email],
-	}, nil
+func TestSyncStateAppliesOutbounds(t *testing.T) {
+	core := testsupport.NewCore(t)
+	cfg := newTestConfig(core.Addr)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, `{"config_version": 3,
+			"outbounds": [
+				{"tag": "relay-sg", "protocol": "trojan", "server": {"address": "sg.example.com", "port": 443, "password": "p"}},
+				{"tag": "broken", "protocol": "vless", "server": {"address": "x.example.com", "port": 443}}
+			],
+			"routes": [{"tag": "via-sg", "outbound_tag": "relay-sg", "domain": ["geosite:netflix"]}]}`)
+	}))
+	defer srv.Close()
+	cfg.Control.BaseURL = config.URLList{srv.URL}
+
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	a := New(cfg, log, control.NewClient(cfg, log, "v1.0.3", "v25.10.15"), xray.NewManager(cfg, log), nil, nil)
+	ctx := context.Background()
+
+	if err := a.syncStateOnce(ctx); err != nil {
+		t.Fatalf("syncStateOnce: %v", err)
+	}
+	if tags := core.OutboundTags(); len(tags) != 1 || tags[0] != "relay-sg" {
+		t.Fatalf("outbounds in xray = %v", tags)
+	}
+
+	// An xray restart drops API-added outbounds; the forced reapply adds
+	// them again.
+	core.ResetRuntime()
+	if err := a.syncStateAfterRuntimeReset(ctx); err != nil {
+		t.Fatalf("syncStateAfterRuntimeReset: %v", err)
+	}
+	if tags := core.OutboundTags(); len(tags) != 1 || tags[0] != "relay-sg" {
+		t.Fatalf("outbounds after restart = %v", tags)
+	}
 }
@@ -0,0 +1,72 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/najahiiii/xray-agent/internal/model"
+)
+
+// isAgentRule reports whether tag belongs to a route rule the agent adds on
+// its own, outside the state: abuse blocks, source bans and the bandwidth
+// cap. Reconcile does not report them as extra.
+func isAgentRule(tag string) bool {
+	return strings.HasPrefix(tag, abuseRulePrefix) || strings.HasPrefix(tag, banRulePrefix) || tag == bandwidthRuleTag
+}
+
+// setAgentRules changes the agent's own rules in xray from a.agentRules to
+// desired, leaving users and the state's rules alone. Rules xray rejects
+// are returned by tag and left out of a.agentRules. Called with syncMu held.
+func (a *Agent) setAgentRules(ctx context.Context, desired map[string]model.RouteRule) (map[string]error, error) {
+	clients := a.state.ClientsSnapshot()
+	_, failed, err := a.xray.State(ctx, clients, slices.Collect(maps.Values(clients)), a.agentRules, slices.Collect(maps.Values(desired)))
+	if err != nil {
+		return nil, err
+	}
+	a.agentRules = maps.Clone(desired)
+	for tag := range failed {
+		delete(a.agentRules, tag)
+	}
+	return failed, nil
+}
+
+// reapplyAgentRules adds the agent's own rules again after xray lost its
+// runtime state. Called with syncMu held.
+func (a *Agent) reapplyAgentRules(ctx context.Context) {
+	if len(a.agentRules) == 0 {
+		return
+	}
+	desired := a.agentRules
+	a.agentRules = map[string]model.RouteRule{}
+	failed, err := a.setAgentRules(ctx, desired)
+	if err == nil && len(failed) > 0 {
+		err = fmt.Errorf("%d rules rejected", len(failed))
+	}
+	if err != nil {
+		a.agentRules = desired
+		a.log.Warn("agent rules not added again", "err", err)
+		return
+	}
+	if err := a.putCapRuleFirst(ctx); err != nil {
+		a.log.Warn("bandwidth cap rule not moved ahead", "err", err)
+	}
+}
+
+// removeStaleAgentRules removes agent rules that a previous run of the
+// agent left in xray; their expiry died with it. A bandwidth cap still in
+// force is added again by the next check. Called with syncMu held.
+func (a *Agent) removeStaleAgentRules(ctx context.Context, tags []string) {
+	stale := make(map[string]model.RouteRule, len(tags))
+	for _, tag := range tags {
+		stale[tag] = model.RouteRule{Tag: tag}
+	}
+	clients := a.state.ClientsSnapshot()
+	if _, _, err := a.xray.State(ctx, clients, slices.Collect(maps.Values(clients)), stale, nil); err != nil {
+		a.log.Warn("stale agent rules not removed", "err", err)
+		return
+	}
+	a.log.Info("removed agent rules left by an earlier run", "tags", tags)
+}
@@ -0,0 +1,152 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/najahiiii/xray-agent/internal/config"
+	"github.com/najahiiii/xray-agent/internal/model"
+)
+
+const alertWebhookTimeout = 10 * time.Second
+
+// alertWebhookClient posts alert events to metrics.alerts.webhook.
+var alertWebhookClient = &http.Client{Timeout: alertWebhookTimeout}
+
+// alertState tracks one rule: since is when the metric first went above the
+// threshold in the current run of samples, firing whether the alert was sent.
+type alertState struct {
+	since  time.Time
+	firing bool
+}
+
+// alertValue returns the value of metric in sample, or false when the sample
+// does not have it.
+func alertValue(sample *model.ServerMetricPush, metric string) (float64, bool) {
+	deref := func(v *float64) (float64, bool) {
+		if v == nil {
+			return 0, false
+		}
+		return *v, true
+	}
+	switch metric {
+	case "cpu_percent":
+		return deref(sample.CPUPercent)
+	case "memory_percent":
+		return deref(sample.MemoryPercent)
+	case "bandwidth_up_mbps":
+		return deref(sample.BandwidthUpMbps)
+	case "bandwidth_down_mbps":
+		return deref(sample.BandwidthDownMbps)
+	case "disk_percent":
+		if len(sample.Disks) == 0 {
+			return 0, false
+		}
+		fullest := sample.Disks[0].UsedPercent
+		for _, d := range sample.Disks[1:] {
+			fullest = max(fullest, d.UsedPercent)
+		}
+		return fullest, true
+	case "load1":
+		if sample.LoadAverage == nil {
+			return 0, false
+		}
+		return sample.LoadAverage.Load1, true
+	}
+	return 0, false
+}
+
+// checkAlerts evaluates metrics.alerts.rules against a metrics sample. A
+// rule fires once its metric has been above the threshold for for_sec and
+// resolves on the first sample at or below it. A sample without the metric
+// leaves the rule as it is.
+func (a *Agent) checkAlerts(ctx context.Context, sample *model.ServerMetricPush) {
+	rules := a.cfg.Metrics.Alerts.Rules
+	if len(rules) == 0 {
+		return
+	}
+	if a.alerts == nil {
+		a.alerts = map[config.AlertRule]*alertState{}
+	}
+	now := sample.ServerTime
+	for _, r := range rules {
+		value, ok := alertValue(sample, r.Metric)
+		if !ok {
+			continue
+		}
+		st := a.alerts[r]
+		if st == nil {
+			st = &alertState{}
+			a.alerts[r] = st
+		}
+		attrs := map[string]string{
+			"metric":  r.Metric,
+			"value":   strconv.FormatFloat(value, 'f', 1, 64),
+			"above":   strconv.FormatFloat(r.Above, 'f', -1, 64),
+			"for_sec": strconv.Itoa(r.ForSec),
+		}
+		if value <= r.Above {
+			if st.firing {
+				a.alert(ctx, model.EventAlertResolved, model.SeverityInfo, fmt.Sprintf("%s back to %s", r.Metric, attrs["value"]), attrs)
+			}
+			*st = alertState{}
+			continue
+		}
+		if st.since.IsZero() {
+			st.since = now
+		}
+		if !st.firing && now.Sub(st.since) >= time.Duration(r.ForSec)*time.Second {
+			st.firing = true
+			a.alert(ctx, model.EventAlert, model.SeverityWarn, fmt.Sprintf("%s is %s, above %s", r.Metric, attrs["value"], attrs["above"]), attrs)
+		}
+	}
+}
+
+// alert logs an alert event, queues it for the panel and posts it to the
+// webhook, if any.
+func (a *Agent) alert(ctx context.Context, typ, severity, message string, attrs map[string]string) {
+	if severity == model.SeverityInfo {
+		a.log.Info(message, "event", typ)
+	} else {
+		a.log.Warn(message, "event", typ)
+	}
+	a.emit(typ, severity, message, attrs)
+	hook := a.cfg.Metrics.Alerts.Webhook
+	if hook == "" {
+		return
+	}
+	body, err := json.Marshal(model.AgentEvent{
+		Time:     time.Now().UTC(),
+		Type:     typ,
+		Severity: severity,
+		Message:  message,
+		Attrs:    attrs,
+	})
+	if err != nil {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), alertWebhookTimeout)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook, bytes.NewReader(body))
+		if err != nil {
+			a.log.Warn("alert webhook failed", "err", err)
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := alertWebhookClient.Do(req)
+		if err != nil {
+			a.log.Warn("alert webhook failed", "err", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			a.log.Warn("alert webhook failed", "status", resp.StatusCode)
+		}
+	}()
+}
@@ -0,0 +1,76 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/najahiiii/xray-agent/internal/config"
+	"github.com/najahiiii/xray-agent/internal/model"
+)
+
+func TestCheckAlertsFiresAfterDurationAndResolves(t *testing.T) {
+	hooked := make(chan model.AgentEvent, 4)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e model.AgentEvent
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			t.Errorf("decode: %v", err)
+		}
+		hooked <- e
+	}))
+	defer srv.Close()
+
+	cfg := &config.Config{}
+	cfg.Events.Enabled = true
+	cfg.Metrics.Alerts.Webhook = srv.URL
+	cfg.Metrics.Alerts.Rules = []config.AlertRule{
+		{Metric: "cpu_percent", Above: 90, ForSec: 300},
+		{Metric: "disk_percent", Above: 95},
+	}
+	a := &Agent{cfg: cfg, log: slog.New(slog.NewTextHandler(io.Discard, nil))}
+
+	start := time.Date(2026, 3, 1, 3, 0, 0, 0, time.UTC)
+	sample := func(offset time.Duration, cpu float64) *model.ServerMetricPush {
+		return &model.ServerMetricPush{
+			ServerTime: start.Add(offset),
+			CPUPercent: &cpu,
+			Disks:      []model.DiskUsage{{Path: "/", UsedPercent: 40}, {Path: "/var/log", UsedPercent: 60}},
+		}
+	}
+	ctx := context.Background()
+	a.checkAlerts(ctx, sample(0, 95))
+	a.checkAlerts(ctx, sample(200*time.Second, 97))
+	if n := len(a.events.pending); n != 0 {
+		t.Fatalf("alert fired after 200s: %+v", a.events.pending)
+	}
+	a.checkAlerts(ctx, sample(300*time.Second, 96))
+	a.checkAlerts(ctx, sample(330*time.Second, 99))
+	a.checkAlerts(ctx, sample(360*time.Second, 50))
+
+	if n := len(a.events.pending); n != 2 {
+		t.Fatalf("expected alert and resolved events, got %+v", a.events.pending)
+	}
+	fired, resolved := a.events.pending[0], a.events.pending[1]
+	if fired.Type != model.EventAlert || fired.Attrs["metric"] != "cpu_percent" || fired.Attrs["value"] != "96.0" {
+		t.Fatalf("unexpected alert: %+v", fired)
+	}
+	if resolved.Type != model.EventAlertResolved || resolved.Attrs["value"] != "50.0" {
+		t.Fatalf("unexpected resolved event: %+v", resolved)
+	}
+
+	for range 2 {
+		select {
+		case e := <-hooked:
+			if e.Type != model.EventAlert && e.Type != model.EventAlertResolved {
+				t.Fatalf("unexpected webhook event: %+v", e)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("webhook not called")
+		}
+	}
+}
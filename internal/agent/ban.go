@@ -0,0 +1,174 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/netip"
+	"time"
+
+	"github.com/najahiiii/xray-agent/internal/accesslog"
+	"github.com/najahiiii/xray-agent/internal/audit"
+	"github.com/najahiiii/xray-agent/internal/config"
+	"github.com/najahiiii/xray-agent/internal/firewall"
+	"github.com/najahiiii/xray-agent/internal/model"
+)
+
+const (
+	// banRulePrefix starts the tags of the route rules of xray source bans.
+	banRulePrefix = "agent-ban:"
+	// banQueueSize is how many offenses wait for the ban loop. More are
+	// dropped while it is busy; their addresses offend again later.
+	banQueueSize = 64
+	// maxPendingBans bounds the bans and lifted bans held for the panel;
+	// the oldest are dropped past it.
+	maxPendingBans = 1000
+)
+
+// Banner bans client addresses for a while. firewall.NFTables implements
+// it for ban.method nftables, xrayBanner for xray.
+type Banner interface {
+	Ban(ctx context.Context, addr netip.Addr, d time.Duration) error
+	Unban(ctx context.Context, addr netip.Addr) error
+}
+
+// banState holds the source bans of ban.enabled. It is used by runBanLoop
+// only.
+type banState struct {
+	banner Banner
+	active map[netip.Addr]model.SourceBan
+	// banned and lifted wait for the next push.
+	banned []model.SourceBan
+	lifted []model.SourceBan
+}
+
+// runBanLoop bans the addresses in offenses for ban.ban_sec, lifts the bans
+// that ran out and reports both every ban.interval_sec.
+func (a *Agent) runBanLoop(ctx context.Context, offenses <-chan accesslog.Offense) {
+	banner, err := a.newBanner(ctx)
+	if err != nil {
+		a.log.Warn("source bans disabled", "err", a.track(subsystemBan, err))
+		return
+	}
+	a.bans = banState{banner: banner, active: map[netip.Addr]model.SourceBan{}}
+	ticker := time.NewTicker(time.Duration(a.cfg.Ban.IntervalSec) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case o := <-offenses:
+			a.banSource(ctx, o, time.Now())
+		case now := <-ticker.C:
+			a.liftBans(ctx, now)
+			if time.Now().Before(a.ctrl.ThrottledUntil()) {
+				continue
+			}
+			if err := a.track(subsystemBan, a.pushBansOnce(ctx)); err != nil {
+				a.log.Warn("bans-sync", "err", err)
+			}
+		}
+	}
+}
+
+func (a *Agent) newBanner(ctx context.Context) (Banner, error) {
+	if a.cfg.Ban.Method == config.BanXray {
+		return xrayBanner{a}, nil
+	}
+	n := firewall.NewNFTables(a.cfg.Ban.NFTBinary, a.cfg.Ban.NFTTable)
+	if err := n.Setup(ctx); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// banSource bans o.Addr unless it is banned already.
+func (a *Agent) banSource(ctx context.Context, o accesslog.Offense, now time.Time) {
+	if _, ok := a.bans.active[o.Addr]; ok {
+		return
+	}
+	d := time.Duration(a.cfg.Ban.BanSec) * time.Second
+	if err := a.bans.banner.Ban(ctx, o.Addr, d); err != nil {
+		a.log.Warn("source not banned", "addr", o.Addr, "err", err)
+		return
+	}
+	ban := model.SourceBan{
+		Address:  o.Addr.String(),
+		Failures: o.Failures,
+		Reason:   o.Reason,
+		Method:   a.cfg.Ban.Method,
+		BannedAt: now.UTC(),
+		Until:    now.Add(d).UTC(),
+	}
+	a.bans.active[o.Addr] = ban
+	a.bans.banned = appendBan(a.bans.banned, ban)
+	a.log.Warn("banned source", "addr", o.Addr, "failures", o.Failures, "reason", o.Reason, "until", ban.Until)
+}
+
+// liftBans lifts the bans that ran out by now. A ban that cannot be lifted
+// is tried again on the next call.
+func (a *Agent) liftBans(ctx context.Context, now time.Time) {
+	for addr, ban := range a.bans.active {
+		if ban.Until.After(now) {
+			continue
+		}
+		if err := a.bans.banner.Unban(ctx, addr); err != nil {
+			a.log.Warn("ban not lifted; retrying", "addr", addr, "err", err)
+			continue
+		}
+		delete(a.bans.active, addr)
+		a.bans.lifted = appendBan(a.bans.lifted, ban)
+		a.log.Info("ban lifted", "addr", addr)
+	}
+}
+
+// pushBansOnce reports the bans added and lifted since the last accepted
+// push; a failed push is sent again with the next one.
+func (a *Agent) pushBansOnce(ctx context.Context) error {
+	if len(a.bans.banned) == 0 && len(a.bans.lifted) == 0 {
+		return nil
+	}
+	push := &model.BanPush{ServerTime: time.Now().UTC(), Banned: a.bans.banned, Lifted: a.bans.lifted, Active: len(a.bans.active)}
+	if err := a.ctrl.PostBans(ctx, push); err != nil {
+		return fmt.Errorf("post bans: %w", err)
+	}
+	a.bans.banned, a.bans.lifted = nil, nil
+	return nil
+}
+
+func appendBan(list []model.SourceBan, ban model.SourceBan) []model.SourceBan {
+	list = append(list, ban)
+	if over := len(list) - maxPendingBans; over > 0 {
+		list = list[over:]
+	}
+	return list
+}
+
+// xrayBanner bans an address with a route rule that sends its connections
+// to ban.block_outbound. The inbound still rejects probes from it as
+// before; the rule stops the traffic of the connections that get through.
+type xrayBanner struct{ a *Agent }
+
+func (b xrayBanner) Ban(ctx context.Context, addr netip.Addr, _ time.Duration) error {
+	a := b.a
+	a.syncMu.Lock()
+	defer a.syncMu.Unlock()
+	r := model.RouteRule{Tag: banRulePrefix + addr.String(), OutboundTag: a.cfg.Ban.BlockOutbound, Source: []string{addr.String()}}
+	desired := maps.Clone(a.agentRules)
+	desired[r.Tag] = r
+	failed, err := a.setAgentRules(audit.WithSource(ctx, audit.SourceBan, max(a.state.Version(), 0)), desired)
+	if err == nil {
+		err = failed[r.Tag]
+	}
+	return err
+}
+
+func (b xrayBanner) Unban(ctx context.Context, addr netip.Addr) error {
+	a := b.a
+	a.syncMu.Lock()
+	defer a.syncMu.Unlock()
+	desired := maps.Clone(a.agentRules)
+	delete(desired, banRulePrefix+addr.String())
+	_, err := a.setAgentRules(audit.WithSource(ctx, audit.SourceBan, max(a.state.Version(), 0)), desired)
+	return err
+}
@@ -0,0 +1,97 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/najahiiii/xray-agent/internal/accesslog"
+	"github.com/najahiiii/xray-agent/internal/config"
+	"github.com/najahiiii/xray-agent/internal/control"
+	"github.com/najahiiii/xray-agent/internal/model"
+	"github.com/najahiiii/xray-agent/internal/xray"
+	"github.com/najahiiii/xray-agent/testsupport"
+)
+
+func TestSourceBanWithXrayRuleIsReportedAndLifted(t *testing.T) {
+	core := testsupport.NewCore(t)
+	core.AddProtocolInbound("vless", "v")
+	cfg := newTestConfig(core.Addr)
+	cfg.Ban.Method = config.BanXray
+	cfg.Ban.BlockOutbound = "blocked"
+	cfg.Ban.BanSec = 600
+
+	fail := true
+	var pushes []model.BanPush
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/agents/sg/bans" {
+			t.Errorf("unexpected request %s", r.URL.Path)
+		}
+		if fail {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		var push model.BanPush
+		if err := json.NewDecoder(r.Body).Decode(&push); err != nil {
+			t.Errorf("decode: %v", err)
+		}
+		pushes = append(pushes, push)
+	}))
+	defer srv.Close()
+	cfg.Control.BaseURL = config.URLList{srv.URL}
+
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	a := New(cfg, log, control.NewClient(cfg, log, "v-test", ""), xray.NewManager(cfg, log), nil, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	banner, err := a.newBanner(ctx)
+	if err != nil {
+		t.Fatalf("newBanner: %v", err)
+	}
+	a.bans = banState{banner: banner, active: map[netip.Addr]model.SourceBan{}}
+
+	now := time.Now()
+	offense := accesslog.Offense{Addr: netip.MustParseAddr("203.0.113.5"), Failures: 10, Reason: "invalid request user id"}
+	a.banSource(ctx, offense, now)
+	a.banSource(ctx, offense, now.Add(time.Second))
+	tag := banRulePrefix + "203.0.113.5"
+	if tags := core.RuleTags(); !slices.Equal(tags, []string{tag}) {
+		t.Fatalf("rules = %v, want %s", tags, tag)
+	}
+
+	if err := a.pushBansOnce(ctx); err == nil {
+		t.Fatal("push succeeded against a failing panel")
+	}
+	fail = false
+	if err := a.pushBansOnce(ctx); err != nil {
+		t.Fatalf("pushBansOnce: %v", err)
+	}
+	if len(pushes) != 1 || len(pushes[0].Banned) != 1 || pushes[0].Active != 1 {
+		t.Fatalf("pushes = %+v, want the one ban kept over the failed push", pushes)
+	}
+	if b := pushes[0].Banned[0]; b.Address != "203.0.113.5" || b.Method != config.BanXray || b.Failures != 10 || !b.Until.Equal(now.Add(10*time.Minute)) {
+		t.Fatalf("ban = %+v", b)
+	}
+
+	a.liftBans(ctx, now.Add(5*time.Minute))
+	if len(core.RuleTags()) != 1 {
+		t.Fatal("ban lifted early")
+	}
+	a.liftBans(ctx, now.Add(10*time.Minute))
+	if tags := core.RuleTags(); len(tags) != 0 {
+		t.Fatalf("rules after the ban ran out = %v", tags)
+	}
+	if err := a.pushBansOnce(ctx); err != nil {
+		t.Fatalf("pushBansOnce: %v", err)
+	}
+	if len(pushes) != 2 || len(pushes[1].Banned) != 0 || len(pushes[1].Lifted) != 1 || pushes[1].Active != 0 {
+		t.Fatalf("second push = %+v, want the lifted ban", pushes[1:])
+	}
+}
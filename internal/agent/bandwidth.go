@@ -0,0 +1,369 @@
+package agent
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/najahiiii/xray-agent/internal/audit"
+	"github.com/najahiiii/xray-agent/internal/config"
+	"github.com/najahiiii/xray-agent/internal/metrics"
+	"github.com/najahiiii/xray-agent/internal/model"
+	"github.com/najahiiii/xray-agent/internal/state"
+)
+
+const (
+	// bandwidthRuleTag tags the route rule that enforces bandwidth_cap.
+	bandwidthRuleTag = "agent-cap:bandwidth"
+	bandwidthFile    = "bandwidth.json"
+)
+
+// readNetBytes reads the interface counters; tests replace it.
+var readNetBytes = (*metrics.Collector).NetBytes
+
+// bandwidthCap is the node traffic counted for bandwidth_cap. snap is nil
+// until the first count; store is nil when storage is disabled. withheld is
+// set while action inbounds keeps the non-exempt users off their inbounds;
+// syncMu guards it.
+type bandwidthCap struct {
+	mu       sync.Mutex
+	store    *state.BandwidthStore
+	snap     *state.BandwidthSnapshot
+	withheld bool
+}
+
+// runBandwidthCapLoop counts the node's traffic every
+// bandwidth_cap.interval_sec and blocks it once it reaches the cap.
+func (a *Agent) runBandwidthCapLoop(ctx context.Context) {
+	if !a.cfg.BandwidthCap.Enabled {
+		return
+	}
+	if a.metrics == nil {
+		a.log.Warn("bandwidth cap disabled; no interface counters")
+		return
+	}
+	a.restoreBandwidth()
+	sched := a.newSchedule(time.Duration(a.cfg.BandwidthCap.IntervalSec) * time.Second)
+	for {
+		if err := a.track(subsystemBandwidth, a.checkBandwidthCap(ctx, time.Now())); err != nil {
+			a.log.Warn("bandwidth-cap", "err", err)
+		}
+		if !sched.wait(ctx) {
+			return
+		}
+	}
+}
+
+func (a *Agent) restoreBandwidth() {
+	b := &a.bandwidth
+	if b.store == nil {
+		return
+	}
+	snap, err := b.store.Load()
+	if err != nil {
+		a.log.Warn("load bandwidth count", "path", b.store.Path(), "err", err)
+		return
+	}
+	b.mu.Lock()
+	b.snap = snap
+	b.mu.Unlock()
+	if snap != nil {
+		a.log.Info("restored bandwidth count", "period_start", snap.PeriodStart, "sent", snap.Sent, "recv", snap.Recv, "capped", snap.CappedAt != nil)
+	}
+}
+
+// checkBandwidthCap adds the traffic since the last check to the period's
+// count, starting a new period on the reset day, and adds or removes the
+// blocking rule to match.
+func (a *Agent) checkBandwidthCap(ctx context.Context, now time.Time) error {
+	sent, recv, ok := readNetBytes(a.metrics, ctx)
+	if !ok {
+		return errors.New("interface counters unavailable")
+	}
+	cfg := a.cfg.BandwidthCap
+	limit := uint64(cfg.LimitGB * 1e9)
+	start := bandwidthPeriodStart(now, cfg.ResetDay)
+
+	b := &a.bandwidth
+	b.mu.Lock()
+	if b.snap == nil {
+		b.snap = &state.BandwidthSnapshot{PeriodStart: start}
+	}
+	snap := b.snap
+	var lifted *time.Time
+	if !snap.PeriodStart.Equal(start) {
+		lifted = snap.CappedAt
+		snap.PeriodStart, snap.Sent, snap.Recv, snap.CappedAt = start, 0, 0, nil
+	}
+	// The first read only sets the baseline; counters that went backwards
+	// were reset by a reboot and hold only the traffic since.
+	if !snap.ReadAt.IsZero() {
+		snap.Sent += counterGrowth(snap.LastSent, sent)
+		snap.Recv += counterGrowth(snap.LastRecv, recv)
+	}
+	snap.LastSent, snap.LastRecv, snap.ReadAt = sent, recv, now.UTC()
+	used := bandwidthUsed(snap, cfg.Direction)
+	capped := snap.CappedAt == nil && used >= limit
+	if capped {
+		at := now.UTC()
+		snap.CappedAt = &at
+	}
+	blocked := snap.CappedAt != nil
+	saved := *snap
+	b.mu.Unlock()
+
+	if b.store != nil {
+		if err := b.store.Save(&saved); err != nil {
+			a.log.Warn("save bandwidth count", "path", b.store.Path(), "err", err)
+		}
+	}
+	attrs := map[string]string{
+		"used_bytes":  strconv.FormatUint(used, 10),
+		"limit_bytes": strconv.FormatUint(limit, 10),
+		"direction":   cfg.Direction,
+		"action":      cfg.Action,
+	}
+	if lifted != nil {
+		a.alert(ctx, model.EventBandwidthLifted, model.SeverityInfo, "bandwidth cap lifted; a new billing period started", attrs)
+	}
+	if capped {
+		reset := start.AddDate(0, 1, 0)
+		attrs["reset_at"] = reset.Format(time.RFC3339)
+		a.alert(ctx, model.EventBandwidthCapped, model.SeverityWarn,
+			fmt.Sprintf("node traffic reached the %s GB cap; blocking %s until %s", strconv.FormatFloat(cfg.LimitGB, 'f', -1, 64), cfg.Action, reset.Format(time.DateOnly)), attrs)
+	}
+	return a.enforceBandwidthCap(ctx, blocked)
+}
+
+// enforceBandwidthCap adds the blocking rule while blocked and removes it
+// otherwise, and keeps its inbounds in step with the clients'. With action
+// inbounds the users on the capped inbounds are also taken off them, which
+// no route rule can get around; with blackhole the rule is moved ahead of
+// the other managed rules.
+func (a *Agent) enforceBandwidthCap(ctx context.Context, blocked bool) error {
+	a.syncMu.Lock()
+	defer a.syncMu.Unlock()
+	ctx = audit.WithSource(ctx, audit.SourceBandwidth, max(a.state.Version(), 0))
+	if err := a.withholdCappedUsers(ctx, blocked && a.cfg.BandwidthCap.Action == config.BandwidthActionInbounds); err != nil {
+		return err
+	}
+	current, exists := a.agentRules[bandwidthRuleTag]
+	desired := maps.Clone(a.agentRules)
+	if !blocked {
+		if !exists {
+			return nil
+		}
+		delete(desired, bandwidthRuleTag)
+	} else {
+		r, err := a.bandwidthRule()
+		if err != nil {
+			return err
+		}
+		if exists && reflect.DeepEqual(current, r) {
+			return nil
+		}
+		desired[bandwidthRuleTag] = r
+	}
+	failed, err := a.setAgentRules(ctx, desired)
+	if err == nil {
+		err = failed[bandwidthRuleTag]
+	}
+	if err != nil {
+		return fmt.Errorf("bandwidth cap rule: %w", err)
+	}
+	if blocked {
+		return a.putCapRuleFirst(ctx)
+	}
+	return nil
+}
+
+// cappedClient reports whether action inbounds takes c off its inbound,
+// that is whether the inbound is not exempt.
+func (a *Agent) cappedClient(c model.Client) bool {
+	tag := cmp.Or(c.InboundTag, a.inboundTags(nil)[c.Proto])
+	return !slices.Contains(a.cfg.BandwidthCap.ExemptInbounds, tag)
+}
+
+// capWithholds reports whether the bandwidth cap currently keeps c off
+// its inbound, so syncs and reconcile leave it out. Called with syncMu held.
+func (a *Agent) capWithholds(c model.Client) bool {
+	return a.bandwidth.withheld && a.cappedClient(c)
+}
+
+// withholdCappedUsers removes the users on capped inbounds from xray when
+// withhold is set, and adds them back once it is not. Called with syncMu
+// held.
+func (a *Agent) withholdCappedUsers(ctx context.Context, withhold bool) error {
+	b := &a.bandwidth
+	if b.withheld == withhold {
+		return nil
+	}
+	all := a.state.ClientsSnapshot()
+	remaining := maps.Clone(all)
+	maps.DeleteFunc(remaining, func(_ string, c model.Client) bool { return a.cappedClient(c) })
+	current, desired := remaining, all
+	if withhold {
+		current, desired = all, remaining
+		// Removing a user xray no longer has fails, so only the ones it
+		// still has are removed; reconcile does not add the rest back.
+		if lister, ok := a.xray.(RuntimeLister); ok {
+			if users, err := lister.ListUsers(ctx); err == nil {
+				type key struct{ tag, email string }
+				present := make(map[key]bool, len(users))
+				for _, u := range users {
+					present[key{u.InboundTag, u.Email}] = true
+				}
+				tags := a.inboundTags(nil)
+				current = maps.Clone(all)
+				maps.DeleteFunc(current, func(email string, c model.Client) bool {
+					return a.cappedClient(c) && !present[key{cmp.Or(c.InboundTag, tags[c.Proto]), email}]
+				})
+			}
+		}
+	}
+	if _, _, err := a.xray.State(ctx, current, slices.Collect(maps.Values(desired)), nil, nil); err != nil {
+		return fmt.Errorf("bandwidth cap users: %w", err)
+	}
+	b.withheld = withhold
+	if withhold {
+		a.log.Warn("bandwidth cap took users off their inbounds", "users", len(all)-len(remaining))
+	} else {
+		a.log.Info("bandwidth cap lifted; users added back", "users", len(all)-len(remaining))
+	}
+	return nil
+}
+
+// putCapRuleFirst adds the state's and the agent's other rules again behind
+// the blackhole cap rule. xray only appends rules at runtime and routes by
+// the first match, so a rule ahead of the cap, such as a catch-all to
+// direct, would carry the capped traffic past it. Rules of the static xray
+// config still come first. The others keep the order xray had them in.
+// Called with syncMu held.
+func (a *Agent) putCapRuleFirst(ctx context.Context) error {
+	capRule, ok := a.agentRules[bandwidthRuleTag]
+	if !ok || a.cfg.BandwidthCap.Action != config.BandwidthActionBlackhole {
+		return nil
+	}
+	managed := a.state.RoutesSnapshot()
+	maps.Copy(managed, a.agentRules)
+	others := slices.SortedFunc(maps.Values(managed), func(x, y model.RouteRule) int { return strings.Compare(x.Tag, y.Tag) })
+	others = slices.DeleteFunc(others, func(r model.RouteRule) bool { return r.Tag == bandwidthRuleTag })
+	if len(others) == 0 {
+		return nil
+	}
+	if lister, ok := a.xray.(RuntimeLister); ok {
+		if rules, err := lister.ListRules(ctx); err == nil {
+			// Rules xray does not have go last, in tag order.
+			pos := make(map[string]int, len(rules))
+			for i, r := range rules {
+				pos[r.RuleTag] = i + 1
+			}
+			slices.SortStableFunc(others, func(x, y model.RouteRule) int {
+				return cmp.Compare(cmp.Or(pos[x.Tag], len(rules)+1), cmp.Or(pos[y.Tag], len(rules)+1))
+			})
+		}
+	}
+
+	clients := a.state.ClientsSnapshot()
+	maps.DeleteFunc(clients, func(_ string, c model.Client) bool { return a.capWithholds(c) })
+	users := slices.Collect(maps.Values(clients))
+	capOnly := map[string]model.RouteRule{bandwidthRuleTag: capRule}
+	if _, _, err := a.xray.State(ctx, clients, users, managed, []model.RouteRule{capRule}); err != nil {
+		return fmt.Errorf("move rules behind the bandwidth cap: %w", err)
+	}
+	_, failed, err := a.xray.State(ctx, clients, users, capOnly, append([]model.RouteRule{capRule}, others...))
+	if err != nil {
+		return fmt.Errorf("move rules behind the bandwidth cap: %w", err)
+	}
+	// State rules that did not go back in are added again by reconcile.
+	for tag, err := range failed {
+		delete(a.agentRules, tag)
+		a.log.Warn("route rule not added back behind the bandwidth cap", "tag", tag, "err", err)
+	}
+	return nil
+}
+
+// bandwidthRule routes the capped traffic to bandwidth_cap.block_outbound.
+// With action inbounds it matches the inbounds the agent provisions users
+// on, less the exempt ones; with blackhole every TCP and UDP connection.
+func (a *Agent) bandwidthRule() (model.RouteRule, error) {
+	cfg := a.cfg.BandwidthCap
+	r := model.RouteRule{Tag: bandwidthRuleTag, OutboundTag: cfg.BlockOutbound}
+	if cfg.Action == config.BandwidthActionBlackhole {
+		r.Network = "tcp,udp"
+		return r, nil
+	}
+	tags := map[string]bool{}
+	in := a.cfg.Xray.InboundTags
+	for _, tag := range []string{in.VLESS, in.VMESS, in.TROJAN, in.WireGuard} {
+		tags[tag] = true
+	}
+	for _, c := range a.state.ClientsSnapshot() {
+		tags[c.InboundTag] = true
+	}
+	delete(tags, "")
+	for _, tag := range cfg.ExemptInbounds {
+		delete(tags, tag)
+	}
+	if len(tags) == 0 {
+		return r, errors.New("every inbound is exempt from the bandwidth cap")
+	}
+	r.InboundTag = slices.Sorted(maps.Keys(tags))
+	return r, nil
+}
+
+// bandwidthCapStatus reports the count for the heartbeat; nil before the
+// first count.
+func (a *Agent) bandwidthCapStatus() *model.BandwidthCapStatus {
+	b := &a.bandwidth
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.snap == nil || !a.cfg.BandwidthCap.Enabled {
+		return nil
+	}
+	return &model.BandwidthCapStatus{
+		PeriodStart: b.snap.PeriodStart,
+		ResetAt:     b.snap.PeriodStart.AddDate(0, 1, 0),
+		UsedBytes:   bandwidthUsed(b.snap, a.cfg.BandwidthCap.Direction),
+		LimitBytes:  uint64(a.cfg.BandwidthCap.LimitGB * 1e9),
+		SentBytes:   b.snap.Sent,
+		RecvBytes:   b.snap.Recv,
+		CappedAt:    b.snap.CappedAt,
+	}
+}
+
+// bandwidthPeriodStart returns the last reset day at or before now, at
+// midnight UTC.
+func bandwidthPeriodStart(now time.Time, resetDay int) time.Time {
+	now = now.UTC()
+	start := time.Date(now.Year(), now.Month(), resetDay, 0, 0, 0, 0, time.UTC)
+	if now.Before(start) {
+		start = start.AddDate(0, -1, 0)
+	}
+	return start
+}
+
+func bandwidthUsed(snap *state.BandwidthSnapshot, direction string) uint64 {
+	switch direction {
+	case config.BandwidthOut:
+		return snap.Sent
+	case config.BandwidthIn:
+		return snap.Recv
+	}
+	return snap.Sent + snap.Recv
+}
+
+func counterGrowth(prev, curr uint64) uint64 {
+	if curr < prev {
+		return curr
+	}
+	return curr - prev
+}
@@ -0,0 +1,187 @@
+package agent
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/najahiiii/xray-agent/internal/config"
+	"github.com/najahiiii/xray-agent/internal/control"
+	"github.com/najahiiii/xray-agent/internal/metrics"
+	"github.com/najahiiii/xray-agent/internal/model"
+	"github.com/najahiiii/xray-agent/internal/xray"
+	"github.com/najahiiii/xray-agent/testsupport"
+)
+
+func TestBandwidthCapBlocksUntilResetDay(t *testing.T) {
+	core := testsupport.NewCore(t)
+	core.AddProtocolInbound("vless", "v", "v-ws")
+	cfg := newTestConfig(core.Addr)
+	cfg.Storage.Dir = t.TempDir()
+	cfg.Events.Enabled = true
+	cfg.BandwidthCap.Enabled = true
+	cfg.BandwidthCap.LimitGB = 1e-6 // 1000 bytes
+	cfg.BandwidthCap.ResetDay = 5
+	cfg.BandwidthCap.Direction = config.BandwidthTotal
+	cfg.BandwidthCap.Action = config.BandwidthActionInbounds
+	cfg.BandwidthCap.ExemptInbounds = []string{"m", "t"}
+	cfg.BandwidthCap.BlockOutbound = "blocked"
+
+	var sent, recv uint64
+	orig := readNetBytes
+	t.Cleanup(func() { readNetBytes = orig })
+	readNetBytes = func(*metrics.Collector, context.Context) (uint64, uint64, bool) { return sent, recv, true }
+
+	srv := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer srv.Close()
+	cfg.Control.BaseURL = config.URLList{srv.URL}
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	manager := xray.NewManager(cfg, log)
+	newAgent := func() *Agent {
+		a := New(cfg, log, control.NewClient(cfg, log, "v-test", ""), manager, nil, nil)
+		a.state.Update(1, []model.Client{{Proto: "vless", ID: "1", Email: "a@example.com", InboundTag: "v-ws"}}, nil)
+		a.restoreBandwidth()
+		return a
+	}
+	a := newAgent()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, _, err := manager.State(ctx, nil, []model.Client{{Proto: "vless", ID: "1", Email: "a@example.com", InboundTag: "v-ws"}}, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	check := func(a *Agent, at time.Time, s, r uint64) {
+		t.Helper()
+		sent, recv = s, r
+		if err := a.checkBandwidthCap(ctx, at); err != nil {
+			t.Fatalf("checkBandwidthCap: %v", err)
+		}
+	}
+	events := func(a *Agent) []string {
+		var types []string
+		for _, e := range a.events.pending {
+			types = append(types, e.Type)
+		}
+		return types
+	}
+
+	// The first read is the baseline, whatever the interfaces counted before.
+	day := time.Date(2025, 11, 20, 12, 0, 0, 0, time.UTC)
+	check(a, day, 5000, 5000)
+	check(a, day.Add(time.Minute), 5400, 5500)
+	if len(core.RuleTags()) != 0 {
+		t.Fatalf("rules under the cap = %v", core.RuleTags())
+	}
+	check(a, day.Add(2*time.Minute), 5500, 5600)
+	if tags := core.RuleTags(); !slices.Equal(tags, []string{bandwidthRuleTag}) {
+		t.Fatalf("rules over the cap = %v", tags)
+	}
+	if r := a.agentRules[bandwidthRuleTag]; !slices.Equal(r.InboundTag, []string{"v", "v-ws"}) || r.OutboundTag != "blocked" {
+		t.Fatalf("cap rule = %+v", r)
+	}
+	// The users are taken off the capped inbounds, so no earlier route rule
+	// can carry their traffic, and reconcile leaves them off.
+	if users := core.Users("v-ws"); len(users) != 0 {
+		t.Fatalf("users on a capped inbound = %v", users)
+	}
+	if err := a.reconcileOnce(ctx, manager); err != nil || len(core.Users("v-ws")) != 0 {
+		t.Fatalf("reconcile while capped: %v, users %v", err, core.Users("v-ws"))
+	}
+	st := a.bandwidthCapStatus()
+	if st == nil || st.UsedBytes != 1100 || st.LimitBytes != 1000 || st.CappedAt == nil ||
+		!st.PeriodStart.Equal(time.Date(2025, 11, 5, 0, 0, 0, 0, time.UTC)) || !st.ResetAt.Equal(time.Date(2025, 12, 5, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("status = %+v", st)
+	}
+	if got := events(a); !slices.Equal(got, []string{model.EventBandwidthCapped}) {
+		t.Fatalf("events = %v", got)
+	}
+
+	// A restarted agent, after a reboot reset the counters, keeps the count
+	// and the cap without reporting it again.
+	core.ResetRuntime()
+	a = newAgent()
+	check(a, day.Add(time.Hour), 100, 100)
+	check(a, day.Add(2*time.Hour), 150, 100)
+	if st := a.bandwidthCapStatus(); st.SentBytes != 650 || st.RecvBytes != 700 {
+		t.Fatalf("status after restart = %+v", st)
+	}
+	if tags := core.RuleTags(); !slices.Equal(tags, []string{bandwidthRuleTag}) {
+		t.Fatalf("rules after restart = %v", tags)
+	}
+	if got := events(a); len(got) != 0 {
+		t.Fatalf("events after restart = %v", got)
+	}
+
+	// The reset day starts a new period and lifts the cap.
+	check(a, time.Date(2025, 12, 5, 0, 0, 30, 0, time.UTC), 200, 200)
+	if tags := core.RuleTags(); len(tags) != 0 {
+		t.Fatalf("rules after the reset day = %v", tags)
+	}
+	if users := core.Users("v-ws"); !slices.Equal(users, []string{"a@example.com"}) {
+		t.Fatalf("users after the reset day = %v", users)
+	}
+	if st := a.bandwidthCapStatus(); st.UsedBytes != 150 || st.CappedAt != nil {
+		t.Fatalf("status after the reset day = %+v", st)
+	}
+	if got := events(a); !slices.Equal(got, []string{model.EventBandwidthLifted}) {
+		t.Fatalf("events after the reset day = %v", got)
+	}
+}
+
+func TestBandwidthCapBlackholeGoesFirst(t *testing.T) {
+	core := testsupport.NewCore(t)
+	core.AddProtocolInbound("vless", "v")
+	cfg := newTestConfig(core.Addr)
+	cfg.BandwidthCap.Enabled = true
+	cfg.BandwidthCap.Action = config.BandwidthActionBlackhole
+	cfg.BandwidthCap.BlockOutbound = "blocked"
+
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	manager := xray.NewManager(cfg, log)
+	a := New(cfg, log, nil, manager, nil, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// A catch-all state rule would route everything before a rule added
+	// after it.
+	routes := []model.RouteRule{
+		{Tag: "warp", Domain: []string{"domain:example.com"}, OutboundTag: "warp"},
+		{Tag: "catch-all", Network: "tcp,udp", OutboundTag: "direct"},
+	}
+	if _, _, err := manager.State(ctx, nil, nil, nil, routes); err != nil {
+		t.Fatal(err)
+	}
+	a.state.Update(1, nil, routes)
+
+	if err := a.enforceBandwidthCap(ctx, true); err != nil {
+		t.Fatalf("enforceBandwidthCap: %v", err)
+	}
+	if tags := core.RuleTags(); !slices.Equal(tags, []string{bandwidthRuleTag, "warp", "catch-all"}) {
+		t.Fatalf("rules while capped = %v", tags)
+	}
+	if err := a.enforceBandwidthCap(ctx, false); err != nil {
+		t.Fatalf("enforceBandwidthCap: %v", err)
+	}
+	if tags := core.RuleTags(); !slices.Equal(tags, []string{"warp", "catch-all"}) {
+		t.Fatalf("rules after the cap = %v", tags)
+	}
+}
+
+func TestBandwidthPeriodStart(t *testing.T) {
+	for _, tc := range []struct {
+		now  time.Time
+		day  int
+		want time.Time
+	}{
+		{time.Date(2025, 11, 20, 0, 0, 0, 0, time.UTC), 1, time.Date(2025, 11, 1, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2025, 11, 4, 23, 59, 0, 0, time.UTC), 5, time.Date(2025, 10, 5, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2026, 1, 3, 0, 0, 0, 0, time.UTC), 28, time.Date(2025, 12, 28, 0, 0, 0, 0, time.UTC)},
+	} {
+		if got := bandwidthPeriodStart(tc.now, tc.day); !got.Equal(tc.want) {
+			t.Errorf("bandwidthPeriodStart(%v, %d) = %v, want %v", tc.now, tc.day, got, tc.want)
+		}
+	}
+}
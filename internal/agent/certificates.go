@@ -0,0 +1,69 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/najahiiii/xray-agent/internal/certs"
+	"github.com/najahiiii/xray-agent/internal/model"
+)
+
+// certificatePaths returns where the bundle for domain is written.
+func (a *Agent) certificatePaths(domain string) (cert, key string) {
+	if p, ok := a.cfg.Certificates.Paths[domain]; ok {
+		return p.Cert, p.Key
+	}
+	return certs.Paths(a.cfg.Certificates.Dir, domain)
+}
+
+// applyCertificates writes the panel's certificate bundles to disk and
+// reports whether any file changed and xray needs a restart. Bundles that fail
+// their hash or do not match their domain are skipped and reported together;
+// the files already on disk stay in place. Domains dropped from the state keep
+// their files, since the xray config may still refer to them.
+func (a *Agent) applyCertificates(bundles []model.CertificateBundle) (bool, error) {
+	var (
+		changed bool
+		errs    []error
+	)
+	applied := make(map[string]string, len(bundles))
+	for _, b := range bundles {
+		if a.appliedCertificates[b.Domain] == b.Hash && b.Hash != "" {
+			applied[b.Domain] = b.Hash
+			continue
+		}
+		wrote, err := a.installCertificate(b)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", b.Domain, err))
+			continue
+		}
+		applied[b.Domain] = b.Hash
+		changed = changed || wrote
+	}
+	a.appliedCertificates = applied
+	return changed, errors.Join(errs...)
+}
+
+func (a *Agent) installCertificate(b model.CertificateBundle) (bool, error) {
+	if err := certs.ValidDomain(b.Domain); err != nil {
+		return false, err
+	}
+	cert, key := []byte(b.Cert), []byte(b.Key)
+	if got := certs.Hash(cert, key); got != b.Hash {
+		return false, fmt.Errorf("hash mismatch: got %s, want %s", got, b.Hash)
+	}
+	notAfter, err := certs.Check(b.Domain, cert, key)
+	if err != nil {
+		return false, err
+	}
+	certPath, keyPath := a.certificatePaths(b.Domain)
+	wrote, err := certs.Install(certPath, keyPath, cert, key)
+	if err != nil {
+		return false, err
+	}
+	if wrote {
+		a.log.Info("installed certificate", "domain", b.Domain, "cert", certPath, "expires", notAfter.Format(time.RFC3339))
+	}
+	return wrote, nil
+}
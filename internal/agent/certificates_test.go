@@ -0,0 +1,86 @@
+package agent
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log/slog"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/najahiiii/xray-agent/internal/certs"
+	"github.com/najahiiii/xray-agent/internal/config"
+	"github.com/najahiiii/xray-agent/internal/model"
+)
+
+func testBundle(t *testing.T, domain string) model.CertificateBundle {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: domain},
+		DNSNames:     []string{domain},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	key := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return model.CertificateBundle{Domain: domain, Cert: string(cert), Key: string(key), Hash: certs.Hash(cert, key)}
+}
+
+func TestApplyCertificatesWritesOnlyValidChanges(t *testing.T) {
+	dir := t.TempDir()
+	custom := filepath.Join(dir, "custom")
+	cfg := &config.Config{}
+	cfg.Certificates.Dir = dir
+	cfg.Certificates.Paths = map[string]config.CertificatePath{
+		"b.example.com": {Cert: filepath.Join(custom, "fullchain.pem"), Key: filepath.Join(custom, "privkey.pem")},
+	}
+	a := &Agent{cfg: cfg, log: slog.New(slog.NewTextHandler(io.Discard, nil))}
+
+	good := testBundle(t, "a.example.com")
+	mapped := testBundle(t, "b.example.com")
+	tampered := testBundle(t, "c.example.com")
+	tampered.Hash = good.Hash
+
+	changed, err := a.applyCertificates([]model.CertificateBundle{good, mapped, tampered})
+	if !changed || err == nil {
+		t.Fatalf("first apply: changed=%v err=%v", changed, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a.example.com.crt")); err != nil {
+		t.Fatalf("default path not written: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(custom, "privkey.pem")); err != nil {
+		t.Fatalf("mapped path not written: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "c.example.com.crt")); !os.IsNotExist(err) {
+		t.Fatalf("tampered bundle written: %v", err)
+	}
+
+	changed, err = a.applyCertificates([]model.CertificateBundle{good, mapped})
+	if changed || err != nil {
+		t.Fatalf("repeat apply: changed=%v err=%v", changed, err)
+	}
+	renewed := testBundle(t, "a.example.com")
+	if changed, err = a.applyCertificates([]model.CertificateBundle{renewed, mapped}); !changed || err != nil {
+		t.Fatalf("renewal: changed=%v err=%v", changed, err)
+	}
+}
@@ -2,13 +2,22 @@ package agent
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"os"
 	"os/exec"
+	"slices"
 	"strings"
+	"syscall"
 	"time"
 
+	"github.com/najahiiii/xray-agent/internal/assist"
+	"github.com/najahiiii/xray-agent/internal/config"
+	"github.com/najahiiii/xray-agent/internal/initsys"
 	"github.com/najahiiii/xray-agent/internal/model"
+	"github.com/najahiiii/xray-agent/internal/privsep"
 	"github.com/najahiiii/xray-agent/internal/selfupdate"
+	"github.com/najahiiii/xray-agent/internal/speedtest"
 	"github.com/najahiiii/xray-agent/internal/xraycore"
 )
 
@@ -19,9 +28,11 @@ const (
 	agentRestartDelay       = "2s"
 )
 
-var systemctlRunner = runSystemctl
+var serviceRestarter = restartService
 var agentUpdater = selfupdate.InstallOrUpdate
 var coreUpdater = xraycore.InstallOrUpdate
+var geodataUpdater = xraycore.UpdateGeodata
+var speedtestRunner = speedtest.Run
 var agentRestartScheduler = scheduleAgentRestart
 var coreRestartSyncer = func(a *Agent, ctx context.Context) error {
 	return a.syncStateAfterCoreRestart(ctx)
@@ -33,18 +44,15 @@ func (a *Agent) runCommandLoop(ctx context.Context) {
 		intv = 15 * time.Second
 	}
 
-	ticker := time.NewTicker(intv)
-	defer ticker.Stop()
+	sched := a.newSchedule(intv)
 
 	for {
-		if err := a.executeNextCommand(ctx); err != nil {
+		if err := a.track(subsystemCommands, a.executeNextCommand(ctx)); err != nil {
 			a.log.Warn("command-sync", "err", err)
 		}
 
-		select {
-		case <-ctx.Done():
+		if !sched.wait(ctx) {
 			return
-		case <-ticker.C:
 		}
 	}
 }
@@ -61,6 +69,19 @@ func (a *Agent) executeNextCommand(ctx context.Context) error {
 	startedAt := time.Now().UTC()
 	a.log.Info("executing agent command", "command_id", command.ID, "type", command.Type)
 
+	if !a.commandAllowed(command.Type) {
+		a.log.Warn("refusing agent command not in commands.allow", "command_id", command.ID, "type", command.Type)
+		return a.postCommandAck(command.ID, &model.AgentCommandAck{
+			Status:       model.AgentCommandAckFailed,
+			ErrorMessage: fmt.Sprintf("command type %s is not allowed on this node (commands.allow)", command.Type),
+			Result: map[string]any{
+				"executed_at": startedAt.Format(time.RFC3339),
+				"type":        string(command.Type),
+				"mode":        "not_allowed",
+			},
+		})
+	}
+
 	if command.Type == model.AgentCommandTypeRestartAgent {
 		return a.restartAgentAndAck(command.ID, startedAt)
 	}
@@ -70,6 +91,15 @@ func (a *Agent) executeNextCommand(ctx context.Context) error {
 	if command.Type == model.AgentCommandTypeUpdateCore {
 		return a.updateCoreAndAck(command.ID, startedAt, command.Payload)
 	}
+	if command.Type == model.AgentCommandTypeUpdateGeodata {
+		return a.updateGeodataAndAck(command.ID, startedAt, command.Payload)
+	}
+	if command.Type == model.AgentCommandTypeOpenAssist || command.Type == model.AgentCommandTypeCloseAssist {
+		return a.assistAndAck(ctx, command, startedAt)
+	}
+	if command.Type == model.AgentCommandTypeSpeedtest {
+		return a.speedtestAndAck(ctx, command.ID, startedAt)
+	}
 
 	execErr := a.executeAgentCommand(ctx, command.Type)
 	ack := &model.AgentCommandAck{
@@ -105,6 +135,15 @@ func (a *Agent) executeNextCommand(ctx context.Context) error {
 	return nil
 }
 
+// scheduleRestart schedules a restart of the agent through service.init.
+func (a *Agent) scheduleRestart() error {
+	kind, err := initsys.Resolve(a.cfg.Service.Init)
+	if err != nil {
+		return err
+	}
+	return agentRestartScheduler(context.Background(), kind)
+}
+
 func (a *Agent) restartAgentAndAck(commandID string, startedAt time.Time) error {
 	ack := &model.AgentCommandAck{
 		Status: model.AgentCommandAckSucceeded,
@@ -114,7 +153,7 @@ func (a *Agent) restartAgentAndAck(commandID string, startedAt time.Time) error
 			"mode":        "restart_scheduled",
 		},
 	}
-	restartErr := agentRestartScheduler(context.Background())
+	restartErr := a.scheduleRestart()
 	if restartErr != nil {
 		ack.Status = model.AgentCommandAckFailed
 		ack.ErrorMessage = restartErr.Error()
@@ -184,7 +223,7 @@ func (a *Agent) updateAgentAndAck(
 		return a.postCommandAck(commandID, ack)
 	}
 
-	restartErr := agentRestartScheduler(context.Background())
+	restartErr := a.scheduleRestart()
 	if restartErr != nil {
 		ack.Status = model.AgentCommandAckFailed
 		ack.ErrorMessage = restartErr.Error()
@@ -221,9 +260,38 @@ func (a *Agent) updateCoreAndAck(
 	ack.Result["target_version"] = targetVersion
 
 	updateResult, updateErr := coreUpdater(context.Background(), xraycore.Options{
-		Version: targetVersion,
-		Token:   a.cfg.GitHub.Token,
-		Logger:  a.log,
+		Repo:                a.cfg.GitHub.Repo,
+		Arch:                a.cfg.Xray.Arch,
+		AssetName:           a.cfg.GitHub.AssetName,
+		DigestOptional:      a.cfg.GitHub.DgstOptional,
+		Version:             targetVersion,
+		Token:               a.cfg.GitHub.Token,
+		CacheDir:            a.cfg.Storage.Dir,
+		AssetCacheDir:       a.cfg.Storage.AssetCacheDir,
+		AssetCacheKeep:      a.cfg.Storage.AssetCacheKeep,
+		Mirrors:             a.cfg.GitHub.Mirrors,
+		MinisignKey:         a.cfg.GitHub.MinisignKey,
+		Proxy:               a.cfg.GitHub.DownloadProxy,
+		DownloadIdleTimeout: time.Duration(a.cfg.GitHub.DownloadTimeoutSec) * time.Second,
+		Init:                a.cfg.Service.Init,
+		BinDir:              a.cfg.Xray.Install.BinDir,
+		ConfigPath:          a.cfg.Xray.Install.ConfigPath,
+		ShareDir:            a.cfg.Xray.Install.ShareDir,
+		ServicePath:         a.cfg.Xray.Install.ServicePath,
+		VersionsDir:         a.cfg.Xray.Install.VersionsDir,
+		KeepVersions:        a.cfg.Xray.Install.KeepVersions,
+		Limits: xraycore.Limits{
+			NoFile:      a.cfg.Xray.Limits.NoFile,
+			NProc:       a.cfg.Xray.Limits.NProc,
+			Environment: a.cfg.Xray.Limits.Environment,
+			Directives:  a.cfg.Xray.Hardening.Directives(),
+		},
+		Hooks: xraycore.Hooks{
+			PreUpdate:  a.cfg.Xray.Hooks.PreUpdate,
+			PostUpdate: a.cfg.Xray.Hooks.PostUpdate,
+			OnFailure:  a.cfg.Xray.Hooks.OnFailure,
+		},
+		Logger: a.log,
 	})
 	if updateErr != nil {
 		ack.Status = model.AgentCommandAckFailed
@@ -245,7 +313,7 @@ func (a *Agent) updateCoreAndAck(
 		return a.postCommandAck(commandID, ack)
 	}
 
-	if restartErr := systemctlRunner(context.Background(), "restart", "xray"); restartErr != nil {
+	if restartErr := a.restartCore(context.Background()); restartErr != nil {
 		ack.Status = model.AgentCommandAckFailed
 		ack.ErrorMessage = restartErr.Error()
 		ack.Result["mode"] = "update_installed_restart_failed"
@@ -263,10 +331,171 @@ func (a *Agent) updateCoreAndAck(
 		a.log.Warn("core version heartbeat refresh failed", "command_id", commandID, "err", err)
 	}
 
+	ack.Result["mode"] = "update_installed_restart_completed"
+	a.emit(model.EventCoreUpdated, model.SeverityInfo, "xray-core updated", map[string]string{
+		"from_version": updateResult.FromVersion,
+		"to_version":   updateResult.ToVersion,
+	})
+	return a.postCommandAck(commandID, ack)
+}
+
+// updateGeodataAndAck replaces the geodata files and restarts xray so it
+// loads them. target_version in the payload picks the release to take them
+// from; the latest release is used otherwise.
+func (a *Agent) updateGeodataAndAck(
+	commandID string,
+	startedAt time.Time,
+	payload map[string]any,
+) error {
+	ack := &model.AgentCommandAck{
+		Status: model.AgentCommandAckSucceeded,
+		Result: map[string]any{
+			"executed_at": startedAt.Format(time.RFC3339),
+			"type":        string(model.AgentCommandTypeUpdateGeodata),
+			"mode":        "update_pending",
+		},
+	}
+
+	result, updateErr := geodataUpdater(context.Background(), xraycore.Options{
+		Repo:                a.cfg.GitHub.Repo,
+		Arch:                a.cfg.Xray.Arch,
+		AssetName:           a.cfg.GitHub.AssetName,
+		DigestOptional:      a.cfg.GitHub.DgstOptional,
+		Version:             normalizeTargetVersion(payload),
+		Token:               a.cfg.GitHub.Token,
+		CacheDir:            a.cfg.Storage.Dir,
+		AssetCacheDir:       a.cfg.Storage.AssetCacheDir,
+		AssetCacheKeep:      a.cfg.Storage.AssetCacheKeep,
+		Mirrors:             a.cfg.GitHub.Mirrors,
+		MinisignKey:         a.cfg.GitHub.MinisignKey,
+		Proxy:               a.cfg.GitHub.DownloadProxy,
+		DownloadIdleTimeout: time.Duration(a.cfg.GitHub.DownloadTimeoutSec) * time.Second,
+		ShareDir:            a.cfg.Xray.Install.ShareDir,
+		Logger:              a.log,
+	})
+	if updateErr != nil {
+		ack.Status = model.AgentCommandAckFailed
+		ack.ErrorMessage = updateErr.Error()
+		ack.Result["mode"] = "update_failed"
+		return a.postCommandAck(commandID, ack)
+	}
+	ack.Result["release"] = result.Version
+	ack.Result["files"] = result.Files
+
+	if restartErr := a.restartCore(context.Background()); restartErr != nil {
+		ack.Status = model.AgentCommandAckFailed
+		ack.ErrorMessage = restartErr.Error()
+		ack.Result["mode"] = "update_installed_restart_failed"
+		return a.postCommandAck(commandID, ack)
+	}
+	if syncErr := coreRestartSyncer(a, context.Background()); syncErr != nil {
+		ack.Status = model.AgentCommandAckFailed
+		ack.ErrorMessage = syncErr.Error()
+		ack.Result["mode"] = "update_installed_restart_sync_failed"
+		return a.postCommandAck(commandID, ack)
+	}
+
 	ack.Result["mode"] = "update_installed_restart_completed"
 	return a.postCommandAck(commandID, ack)
 }
 
+// commandAllowed reports whether commands.allow permits t. An empty list
+// allows every command type.
+func (a *Agent) commandAllowed(t model.AgentCommandType) bool {
+	allow := a.cfg.Commands.Allow
+	return len(allow) == 0 || slices.Contains(allow, string(t))
+}
+
+// assistAndAck opens or closes the emergency SSH tunnel. The ack always
+// carries the tunnel's public key when one exists, so the panel can authorize
+// it on the bastion even if the first attempt is rejected.
+func (a *Agent) assistAndAck(ctx context.Context, command *model.AgentCommand, startedAt time.Time) error {
+	ack := &model.AgentCommandAck{
+		Status: model.AgentCommandAckSucceeded,
+		Result: map[string]any{
+			"executed_at": startedAt.Format(time.RFC3339),
+			"type":        string(command.Type),
+		},
+	}
+	fail := func(mode string, err error) error {
+		ack.Status = model.AgentCommandAckFailed
+		ack.ErrorMessage = err.Error()
+		ack.Result["mode"] = mode
+		a.log.Warn("assist command failed", "command_id", command.ID, "type", command.Type, "err", err)
+		return a.postCommandAck(command.ID, ack)
+	}
+
+	if a.assist == nil {
+		return fail("disabled", errors.New("remote assist is disabled on this node (assist.enabled)"))
+	}
+
+	if command.Type == model.AgentCommandTypeCloseAssist {
+		if err := a.assist.Close(); err != nil {
+			ack.Result["mode"] = "not_open"
+		} else {
+			ack.Result["mode"] = "closed"
+		}
+		return a.postCommandAck(command.ID, ack)
+	}
+
+	req, err := assist.ParseRequest(command.Payload)
+	if err != nil {
+		return fail("invalid_payload", err)
+	}
+	session, err := a.assist.Open(ctx, req)
+	if session.PublicKey != "" {
+		ack.Result["public_key"] = session.PublicKey
+	}
+	if err != nil {
+		return fail("open_failed", err)
+	}
+	ack.Result["mode"] = "open"
+	ack.Result["bastion"] = session.Bastion
+	ack.Result["remote_port"] = session.RemotePort
+	ack.Result["expires_at"] = session.ExpiresAt.Format(time.RFC3339)
+	return a.postCommandAck(command.ID, ack)
+}
+
+// speedtestAndAck starts a speedtest in the background and acks right away;
+// the measurement takes up to twice speedtest.timeout_sec, too long to hold
+// up the command loop. The result is posted to the speedtest endpoint.
+func (a *Agent) speedtestAndAck(ctx context.Context, commandID string, startedAt time.Time) error {
+	ack := &model.AgentCommandAck{
+		Status: model.AgentCommandAckSucceeded,
+		Result: map[string]any{
+			"executed_at": startedAt.Format(time.RFC3339),
+			"type":        string(model.AgentCommandTypeSpeedtest),
+			"mode":        "started",
+		},
+	}
+	if !a.speedtestRunning.CompareAndSwap(false, true) {
+		ack.Status = model.AgentCommandAckFailed
+		ack.ErrorMessage = "a speedtest is already running"
+		ack.Result["mode"] = "already_running"
+		return a.postCommandAck(commandID, ack)
+	}
+
+	go func() {
+		defer a.speedtestRunning.Store(false)
+		res := speedtestRunner(ctx, speedtest.Options{
+			DownloadURL: a.cfg.Speedtest.DownloadURL,
+			UploadURL:   a.cfg.Speedtest.UploadURL,
+			UploadBytes: int64(a.cfg.Speedtest.UploadMB) << 20,
+			Timeout:     time.Duration(a.cfg.Speedtest.TimeoutSec) * time.Second,
+		})
+		res.CommandID = commandID
+		if res.Error != "" {
+			a.log.Warn("speedtest failed", "command_id", commandID, "err", res.Error)
+		}
+		if err := a.ctrl.PostSpeedtest(ctx, res); err != nil {
+			a.log.Warn("speedtest result not posted", "command_id", commandID, "err", err)
+			return
+		}
+		a.log.Info("speedtest completed", "command_id", commandID)
+	}()
+	return a.postCommandAck(commandID, ack)
+}
+
 func (a *Agent) postCommandAck(commandID string, ack *model.AgentCommandAck) error {
 	if err := a.ctrl.AckCommand(context.Background(), commandID, ack); err != nil {
 		return fmt.Errorf("ack command %s: %w", commandID, err)
@@ -277,13 +506,20 @@ func (a *Agent) postCommandAck(commandID string, ack *model.AgentCommandAck) err
 func (a *Agent) executeAgentCommand(ctx context.Context, commandType model.AgentCommandType) error {
 	switch commandType {
 	case model.AgentCommandTypeRestartCore:
-		if err := systemctlRunner(ctx, "restart", "xray"); err != nil {
+		if err := a.restartCore(ctx); err != nil {
 			return err
 		}
 		if err := a.syncStateAfterCoreRestart(ctx); err != nil {
 			return fmt.Errorf("restart core completed but immediate state sync failed: %w", err)
 		}
 		return nil
+	case model.AgentCommandTypeResync:
+		return a.syncState(ctx, false)
+	case model.AgentCommandTypeRotateLogs:
+		if a.logs == nil {
+			return errors.New("agent does not log to a file (logging.output)")
+		}
+		return a.logs.Rotate()
 	default:
 		return fmt.Errorf("unsupported command type: %s", commandType)
 	}
@@ -319,7 +555,33 @@ func resolveUpdatedCoreVersion(
 }
 
 func (a *Agent) refreshCoreVersionHeartbeat() error {
-	return a.ctrl.Heartbeat(context.Background())
+	return a.ctrl.Heartbeat(context.Background(), a.nodeStatus())
+}
+
+// restartCore restarts xray through the agent's own supervisor when it runs
+// xray as a child process, and through service.init otherwise.
+func (a *Agent) restartCore(ctx context.Context) error {
+	a.coreRestarts.Add(1)
+	if a.core != nil {
+		return a.core.Restart(ctx)
+	}
+	kind, err := initsys.Resolve(a.cfg.Service.Init)
+	if err != nil {
+		return err
+	}
+	if a.cfg.Backend == config.BackendSingBox {
+		return serviceRestarter(ctx, kind, a.cfg.SingBox.Service)
+	}
+	return serviceRestarter(ctx, kind, "xray")
+}
+
+// restartService restarts name with the init system. systemd goes through
+// runSystemctl, whose errors explain polkit denials for an unprivileged agent.
+func restartService(ctx context.Context, kind initsys.Kind, name string) error {
+	if kind == initsys.Systemd {
+		return runSystemctl(ctx, "restart", name)
+	}
+	return initsys.Restart(ctx, kind, name)
 }
 
 func (a *Agent) syncStateAfterCoreRestart(ctx context.Context) error {
@@ -365,6 +627,9 @@ func runSystemctl(ctx context.Context, args ...string) error {
 	}
 
 	message := strings.TrimSpace(string(output))
+	if hint := privsep.DeniedHint(message); hint != "" {
+		return fmt.Errorf("systemctl %s failed: %s (%s)", strings.Join(args, " "), message, hint)
+	}
 	if message != "" {
 		return fmt.Errorf("systemctl %s failed: %s", strings.Join(args, " "), message)
 	}
@@ -372,7 +637,23 @@ func runSystemctl(ctx context.Context, args ...string) error {
 	return fmt.Errorf("systemctl %s: %w", strings.Join(args, " "), err)
 }
 
-func scheduleAgentRestart(ctx context.Context) error {
+// scheduleAgentRestart restarts the agent's own service after
+// agentRestartDelay, from outside the agent so the restart survives it
+// exiting.
+func scheduleAgentRestart(ctx context.Context, kind initsys.Kind) error {
+	if kind != initsys.Systemd {
+		return detachAgentRestart(kind)
+	}
+	if os.Geteuid() != 0 {
+		// A transient unit would run as root, which the polkit rule does not
+		// allow, so an unprivileged agent queues its own restart instead.
+		delay, _ := time.ParseDuration(agentRestartDelay)
+		time.AfterFunc(delay, func() {
+			_ = runSystemctl(context.Background(), "--no-block", "restart", "xray-agent")
+		})
+		return nil
+	}
+
 	cmdCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
@@ -400,3 +681,19 @@ func scheduleAgentRestart(ctx context.Context) error {
 
 	return fmt.Errorf("schedule agent restart: %w", err)
 }
+
+// detachAgentRestart runs the OpenRC or sysvinit restart of xray-agent in
+// its own session, so stopping the agent does not take the restart with it.
+func detachAgentRestart(kind initsys.Kind) error {
+	argv, err := initsys.RestartCommand(kind, "xray-agent")
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command("/bin/sh", "-c", `sleep "$0" && exec "$@"`, strings.TrimSuffix(agentRestartDelay, "s"))
+	cmd.Args = append(cmd.Args, argv...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("schedule agent restart: %w", err)
+	}
+	return cmd.Process.Release()
+}
@@ -14,8 +14,10 @@ import (
 
 	"github.com/najahiiii/xray-agent/internal/config"
 	"github.com/najahiiii/xray-agent/internal/control"
+	"github.com/najahiiii/xray-agent/internal/initsys"
 	"github.com/najahiiii/xray-agent/internal/model"
 	"github.com/najahiiii/xray-agent/internal/selfupdate"
+	"github.com/najahiiii/xray-agent/internal/speedtest"
 	"github.com/najahiiii/xray-agent/internal/xraycore"
 )
 
@@ -43,7 +45,7 @@ func TestRestartAgentAndAckFailedWhenRestartTriggerFails(t *testing.T) {
 	defer server.Close()
 
 	cfg := &config.Config{}
-	cfg.Control.BaseURL = server.URL
+	cfg.Control.BaseURL = config.URLList{server.URL}
 	cfg.Control.Token = "token"
 	cfg.Control.ServerSlug = "sg"
 
@@ -55,7 +57,7 @@ func TestRestartAgentAndAckFailedWhenRestartTriggerFails(t *testing.T) {
 	}
 
 	originalScheduler := agentRestartScheduler
-	agentRestartScheduler = func(_ context.Context) error {
+	agentRestartScheduler = func(context.Context, initsys.Kind) error {
 		return errors.New("schedule failed")
 	}
 	t.Cleanup(func() {
@@ -93,7 +95,7 @@ func TestRestartAgentAndAckSucceededWhenRestartScheduled(t *testing.T) {
 	defer server.Close()
 
 	cfg := &config.Config{}
-	cfg.Control.BaseURL = server.URL
+	cfg.Control.BaseURL = config.URLList{server.URL}
 	cfg.Control.Token = "token"
 	cfg.Control.ServerSlug = "sg"
 
@@ -105,7 +107,7 @@ func TestRestartAgentAndAckSucceededWhenRestartScheduled(t *testing.T) {
 	}
 
 	originalScheduler := agentRestartScheduler
-	agentRestartScheduler = func(_ context.Context) error {
+	agentRestartScheduler = func(context.Context, initsys.Kind) error {
 		return nil
 	}
 	t.Cleanup(func() {
@@ -143,7 +145,7 @@ func TestUpdateAgentAndAckFailsWithoutTargetVersion(t *testing.T) {
 	defer server.Close()
 
 	cfg := &config.Config{}
-	cfg.Control.BaseURL = server.URL
+	cfg.Control.BaseURL = config.URLList{server.URL}
 	cfg.Control.Token = "token"
 	cfg.Control.ServerSlug = "sg"
 
@@ -154,10 +156,10 @@ func TestUpdateAgentAndAckFailsWithoutTargetVersion(t *testing.T) {
 		ctrl: control.NewClient(cfg, logger, "v1.0.5", "v25.10.15"),
 	}
 
-	originalRunner := systemctlRunner
+	originalRunner := serviceRestarter
 	originalUpdater := agentUpdater
-	systemctlRunner = func(_ context.Context, _ ...string) error {
-		t.Fatal("systemctlRunner should not be called")
+	serviceRestarter = func(context.Context, initsys.Kind, string) error {
+		t.Fatal("serviceRestarter should not be called")
 		return nil
 	}
 	agentUpdater = func(_ context.Context, _ string, _ selfupdate.Options) (*selfupdate.InstallResult, error) {
@@ -165,7 +167,7 @@ func TestUpdateAgentAndAckFailsWithoutTargetVersion(t *testing.T) {
 		return nil, nil
 	}
 	t.Cleanup(func() {
-		systemctlRunner = originalRunner
+		serviceRestarter = originalRunner
 		agentUpdater = originalUpdater
 	})
 
@@ -197,7 +199,7 @@ func TestUpdateAgentAndAckTriggersRestartAfterInstall(t *testing.T) {
 	defer server.Close()
 
 	cfg := &config.Config{}
-	cfg.Control.BaseURL = server.URL
+	cfg.Control.BaseURL = config.URLList{server.URL}
 	cfg.Control.Token = "token"
 	cfg.Control.ServerSlug = "sg"
 	cfg.GitHub.Token = "gh-token"
@@ -211,7 +213,7 @@ func TestUpdateAgentAndAckTriggersRestartAfterInstall(t *testing.T) {
 
 	originalScheduler := agentRestartScheduler
 	originalUpdater := agentUpdater
-	agentRestartScheduler = func(_ context.Context) error {
+	agentRestartScheduler = func(context.Context, initsys.Kind) error {
 		return nil
 	}
 	agentUpdater = func(_ context.Context, currentVersion string, opts selfupdate.Options) (*selfupdate.InstallResult, error) {
@@ -284,7 +286,7 @@ func TestUpdateCoreAndAckRestartsCoreAndRefreshesHeartbeat(t *testing.T) {
 	defer server.Close()
 
 	cfg := &config.Config{}
-	cfg.Control.BaseURL = server.URL
+	cfg.Control.BaseURL = config.URLList{server.URL}
 	cfg.Control.Token = "token"
 	cfg.Control.ServerSlug = "sg"
 	cfg.GitHub.Token = "gh-token"
@@ -296,12 +298,12 @@ func TestUpdateCoreAndAckRestartsCoreAndRefreshesHeartbeat(t *testing.T) {
 		ctrl: control.NewClient(cfg, logger, "v1.0.5", "v26.1.23"),
 	}
 
-	originalRunner := systemctlRunner
+	originalRunner := serviceRestarter
 	originalUpdater := coreUpdater
 	originalSyncer := coreRestartSyncer
-	systemctlRunner = func(_ context.Context, args ...string) error {
-		if len(args) != 2 || args[0] != "restart" || args[1] != "xray" {
-			t.Fatalf("unexpected systemctl args: %v", args)
+	serviceRestarter = func(_ context.Context, _ initsys.Kind, name string) error {
+		if name != "xray" {
+			t.Fatalf("unexpected service restart: %s", name)
 		}
 		return nil
 	}
@@ -322,7 +324,7 @@ func TestUpdateCoreAndAckRestartsCoreAndRefreshesHeartbeat(t *testing.T) {
 		return nil
 	}
 	t.Cleanup(func() {
-		systemctlRunner = originalRunner
+		serviceRestarter = originalRunner
 		coreUpdater = originalUpdater
 		coreRestartSyncer = originalSyncer
 	})
@@ -352,3 +354,241 @@ func TestUpdateCoreAndAckRestartsCoreAndRefreshesHeartbeat(t *testing.T) {
 		t.Fatalf("unexpected xray core version in heartbeat: %s", heartbeat.XrayCoreVersion)
 	}
 }
+
+type fakeCoreSupervisor struct{ restarts int }
+
+func (f *fakeCoreSupervisor) Restart(context.Context) error {
+	f.restarts++
+	return nil
+}
+
+func TestRestartCoreUsesSupervisor(t *testing.T) {
+	originalRunner := serviceRestarter
+	serviceRestarter = func(_ context.Context, _ initsys.Kind, name string) error {
+		t.Fatalf("init system should not be called with a supervisor, got %s", name)
+		return nil
+	}
+	t.Cleanup(func() { serviceRestarter = originalRunner })
+
+	sup := &fakeCoreSupervisor{}
+	a := &Agent{}
+	a.SetCoreSupervisor(sup)
+	if err := a.restartCore(context.Background()); err != nil {
+		t.Fatalf("restartCore: %v", err)
+	}
+	if sup.restarts != 1 {
+		t.Fatalf("expected 1 supervisor restart, got %d", sup.restarts)
+	}
+}
+
+func TestRestartCoreUsesConfiguredInit(t *testing.T) {
+	originalRunner := serviceRestarter
+	var got string
+	serviceRestarter = func(_ context.Context, kind initsys.Kind, name string) error {
+		got = string(kind) + " " + name
+		return nil
+	}
+	t.Cleanup(func() { serviceRestarter = originalRunner })
+
+	a := &Agent{cfg: &config.Config{}}
+	a.cfg.Service.Init = "openrc"
+	if err := a.restartCore(context.Background()); err != nil {
+		t.Fatalf("restartCore: %v", err)
+	}
+	if got != "openrc xray" {
+		t.Fatalf("restarted %q, want xray via openrc", got)
+	}
+}
+
+func TestAssistCommandFailsWhenDisabled(t *testing.T) {
+	var ack model.AgentCommandAck
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&ack); err != nil {
+			t.Fatalf("decode ack: %v", err)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	cfg := &config.Config{}
+	cfg.Control.BaseURL = config.URLList{server.URL}
+	cfg.Control.Token = "token"
+	cfg.Control.ServerSlug = "sg"
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	a := &Agent{
+		cfg:  cfg,
+		log:  logger,
+		ctrl: control.NewClient(cfg, logger, "v-test", "v25.10.15"),
+	}
+
+	command := &model.AgentCommand{ID: "cmd-1", Type: model.AgentCommandTypeOpenAssist}
+	if err := a.assistAndAck(context.Background(), command, time.Now()); err != nil {
+		t.Fatalf("assistAndAck returned error: %v", err)
+	}
+	if ack.Status != model.AgentCommandAckFailed || ack.Result["mode"] != "disabled" {
+		t.Fatalf("unexpected ack: %+v", ack)
+	}
+}
+
+// commandServer serves one command from commands/next and records its ack.
+func commandServer(t *testing.T, command model.AgentCommand, ack *model.AgentCommandAck) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/commands/next"):
+			json.NewEncoder(w).Encode(map[string]any{"command": command})
+		case strings.HasSuffix(r.URL.Path, "/ack"):
+			if err := json.NewDecoder(r.Body).Decode(ack); err != nil {
+				t.Fatalf("decode ack: %v", err)
+			}
+		default:
+			t.Fatalf("unexpected path: %s", r.URL.Path)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func newCommandAgent(serverURL string) *Agent {
+	cfg := &config.Config{}
+	cfg.Control.BaseURL = config.URLList{serverURL}
+	cfg.Control.Token = "token"
+	cfg.Control.ServerSlug = "sg"
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	return &Agent{cfg: cfg, log: logger, ctrl: control.NewClient(cfg, logger, "v-test", "v25.10.15")}
+}
+
+func TestExecuteNextCommandRefusesTypesOutsideAllowList(t *testing.T) {
+	var ack model.AgentCommandAck
+	server := commandServer(t, model.AgentCommand{ID: "cmd-1", Type: model.AgentCommandTypeRestartCore}, &ack)
+	a := newCommandAgent(server.URL)
+	a.cfg.Commands.Allow = []string{"ROTATE_LOGS"}
+
+	originalRunner := serviceRestarter
+	serviceRestarter = func(_ context.Context, _ initsys.Kind, name string) error {
+		t.Fatalf("command outside the allow-list restarted %s", name)
+		return nil
+	}
+	t.Cleanup(func() { serviceRestarter = originalRunner })
+
+	if err := a.executeNextCommand(context.Background()); err != nil {
+		t.Fatalf("executeNextCommand: %v", err)
+	}
+	if ack.Status != model.AgentCommandAckFailed || ack.Result["mode"] != "not_allowed" {
+		t.Fatalf("unexpected ack: %+v", ack)
+	}
+}
+
+type fakeLogRotator struct{ rotations int }
+
+func (f *fakeLogRotator) Rotate() error {
+	f.rotations++
+	return nil
+}
+
+func TestExecuteNextCommandRotatesLogs(t *testing.T) {
+	var ack model.AgentCommandAck
+	server := commandServer(t, model.AgentCommand{ID: "cmd-1", Type: model.AgentCommandTypeRotateLogs}, &ack)
+	a := newCommandAgent(server.URL)
+	a.cfg.Commands.Allow = []string{"ROTATE_LOGS"}
+
+	if err := a.executeNextCommand(context.Background()); err != nil {
+		t.Fatalf("executeNextCommand: %v", err)
+	}
+	if ack.Status != model.AgentCommandAckFailed {
+		t.Fatalf("expected FAILED without a log file, got %+v", ack)
+	}
+
+	rotator := &fakeLogRotator{}
+	a.SetLogRotator(rotator)
+	if err := a.executeNextCommand(context.Background()); err != nil {
+		t.Fatalf("executeNextCommand: %v", err)
+	}
+	if ack.Status != model.AgentCommandAckSucceeded || rotator.rotations != 1 {
+		t.Fatalf("ack = %+v, rotations = %d", ack, rotator.rotations)
+	}
+}
+
+func TestUpdateGeodataAndAckRestartsCore(t *testing.T) {
+	var ack model.AgentCommandAck
+	server := commandServer(t, model.AgentCommand{}, &ack)
+	a := newCommandAgent(server.URL)
+	sup := &fakeCoreSupervisor{}
+	a.SetCoreSupervisor(sup)
+
+	originalUpdater := geodataUpdater
+	originalSyncer := coreRestartSyncer
+	geodataUpdater = func(_ context.Context, opts xraycore.Options) (*xraycore.GeodataResult, error) {
+		if opts.Version != "" {
+			t.Fatalf("unexpected release: %s", opts.Version)
+		}
+		return &xraycore.GeodataResult{Version: "v26.2.6", Files: []string{"geoip.dat", "geosite.dat"}}, nil
+	}
+	coreRestartSyncer = func(*Agent, context.Context) error { return nil }
+	t.Cleanup(func() {
+		geodataUpdater = originalUpdater
+		coreRestartSyncer = originalSyncer
+	})
+
+	if err := a.updateGeodataAndAck("cmd-geo", time.Now(), nil); err != nil {
+		t.Fatalf("updateGeodataAndAck: %v", err)
+	}
+	if ack.Status != model.AgentCommandAckSucceeded || ack.Result["mode"] != "update_installed_restart_completed" {
+		t.Fatalf("unexpected ack: %+v", ack)
+	}
+	if ack.Result["release"] != "v26.2.6" || sup.restarts != 1 {
+		t.Fatalf("release = %v, restarts = %d", ack.Result["release"], sup.restarts)
+	}
+}
+
+func TestSpeedtestRunsInBackgroundAndPostsResult(t *testing.T) {
+	var ack model.AgentCommandAck
+	posted := make(chan model.SpeedtestResult, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/ack"):
+			json.NewDecoder(r.Body).Decode(&ack)
+		case strings.HasSuffix(r.URL.Path, "/speedtest"):
+			var res model.SpeedtestResult
+			json.NewDecoder(r.Body).Decode(&res)
+			posted <- res
+		default:
+			t.Errorf("unexpected path: %s", r.URL.Path)
+		}
+	}))
+	t.Cleanup(server.Close)
+	a := newCommandAgent(server.URL)
+
+	release := make(chan struct{})
+	originalRunner := speedtestRunner
+	speedtestRunner = func(context.Context, speedtest.Options) *model.SpeedtestResult {
+		<-release
+		mbps := 940.5
+		return &model.SpeedtestResult{DownloadMbps: &mbps}
+	}
+	t.Cleanup(func() { speedtestRunner = originalRunner })
+
+	if err := a.speedtestAndAck(context.Background(), "cmd-1", time.Now()); err != nil {
+		t.Fatalf("speedtestAndAck: %v", err)
+	}
+	if ack.Status != model.AgentCommandAckSucceeded || ack.Result["mode"] != "started" {
+		t.Fatalf("unexpected ack: %+v", ack)
+	}
+	if err := a.speedtestAndAck(context.Background(), "cmd-2", time.Now()); err != nil {
+		t.Fatalf("speedtestAndAck: %v", err)
+	}
+	if ack.Status != model.AgentCommandAckFailed || ack.Result["mode"] != "already_running" {
+		t.Fatalf("second speedtest ack = %+v; want already_running", ack)
+	}
+
+	close(release)
+	select {
+	case res := <-posted:
+		if res.CommandID != "cmd-1" || res.DownloadMbps == nil || *res.DownloadMbps != 940.5 {
+			t.Fatalf("posted result = %+v", res)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("speedtest result not posted")
+	}
+}
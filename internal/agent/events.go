@@ -0,0 +1,107 @@
+package agent
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/najahiiii/xray-agent/internal/model"
+)
+
+const (
+	// maxQueuedEvents bounds the events waiting for the panel; the oldest
+	// are dropped once it is full.
+	maxQueuedEvents = 100
+	// eventRetryInterval is how long undelivered events wait before the
+	// next attempt.
+	eventRetryInterval = 30 * time.Second
+)
+
+// eventQueue holds events until runEventLoop delivers them, so emitting
+// never waits for the panel.
+type eventQueue struct {
+	mu      sync.Mutex
+	pending []model.AgentEvent
+	dropped int
+	wake    chan struct{}
+}
+
+// emit queues an event for the panel's activity feed when events.enabled
+// is set.
+func (a *Agent) emit(typ, severity, message string, attrs map[string]string) {
+	if !a.cfg.Events.Enabled {
+		return
+	}
+	q := &a.events
+	q.mu.Lock()
+	if len(q.pending) == maxQueuedEvents {
+		q.pending = q.pending[1:]
+		q.dropped++
+	}
+	q.pending = append(q.pending, model.AgentEvent{
+		Time:     time.Now().UTC(),
+		Type:     typ,
+		Severity: severity,
+		Message:  message,
+		Attrs:    attrs,
+	})
+	q.mu.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// runEventLoop delivers queued events in order. Delivery stops at the first
+// failure and is retried after eventRetryInterval, or once the panel's
+// Retry-After has passed.
+func (a *Agent) runEventLoop(ctx context.Context) {
+	if a.ctrl == nil || !a.cfg.Events.Enabled {
+		return
+	}
+	q := &a.events
+	var retry <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.wake:
+		case <-retry:
+		}
+		retry = nil
+		if wait := time.Until(a.ctrl.ThrottledUntil()); wait > 0 {
+			// The panel asked for a pause; new events queue up meanwhile.
+			retry = time.After(wait)
+			continue
+		}
+		if err := a.flushEvents(ctx); err != nil {
+			a.log.Warn("events not delivered", "err", err, "retry_in", eventRetryInterval)
+			retry = time.After(eventRetryInterval)
+		}
+	}
+}
+
+func (a *Agent) flushEvents(ctx context.Context) error {
+	q := &a.events
+	q.mu.Lock()
+	batch, dropped := q.pending, q.dropped
+	q.pending, q.dropped = nil, 0
+	q.mu.Unlock()
+	if dropped > 0 {
+		a.log.Warn("event queue overflowed; oldest events dropped", "count", dropped)
+	}
+
+	for i := range batch {
+		if err := a.ctrl.PostEvent(ctx, &batch[i]); err != nil {
+			q.mu.Lock()
+			q.pending = append(batch[i:], q.pending...)
+			if over := len(q.pending) - maxQueuedEvents; over > 0 {
+				q.pending = q.pending[over:]
+				q.dropped += over
+			}
+			q.mu.Unlock()
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/najahiiii/xray-agent/internal/config"
+	"github.com/najahiiii/xray-agent/internal/control"
+	"github.com/najahiiii/xray-agent/internal/model"
+	"github.com/najahiiii/xray-agent/internal/stats"
+	"github.com/najahiiii/xray-agent/internal/xray"
+	"github.com/najahiiii/xray-agent/testsupport"
+)
+
+func TestSyncStateEmitsEvents(t *testing.T) {
+	core := testsupport.NewCore(t)
+	cfg := newTestConfig(core.Addr)
+	cfg.Events.Enabled = true
+
+	var (
+		mu      sync.Mutex
+		events  []model.AgentEvent
+		failing atomic.Bool
+	)
+	failing.Store(true)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/agents/sg/events":
+			var e model.AgentEvent
+			if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+				t.Errorf("decode event: %v", err)
+			}
+			mu.Lock()
+			events = append(events, e)
+			mu.Unlock()
+		case "/api/agents/sg/state":
+			if failing.Load() {
+				http.Error(w, "maintenance", http.StatusServiceUnavailable)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(model.State{
+				ConfigVersion: 3,
+				Clients:       []model.Client{{Proto: "vless", ID: "1", Email: "user@example.com"}},
+			})
+		}
+	}))
+	defer srv.Close()
+	cfg.Control.BaseURL = config.URLList{srv.URL}
+
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ctrl := control.NewClient(cfg, log, "v1.0.3", "v25.10.15")
+	a := New(cfg, log, ctrl, xray.NewManager(cfg, log), stats.New(cfg, log), nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Two failures in a row are one outage.
+	for range 2 {
+		if err := a.syncStateOnce(ctx); err == nil {
+			t.Fatal("expected sync error")
+		}
+	}
+	failing.Store(false)
+	if err := a.syncStateOnce(ctx); err != nil {
+		t.Fatalf("syncStateOnce: %v", err)
+	}
+	if err := a.flushEvents(ctx); err != nil {
+		t.Fatalf("flushEvents: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %+v", events)
+	}
+	if events[0].Type != model.EventSyncFailed || events[0].Severity != model.SeverityError {
+		t.Fatalf("unexpected first event: %+v", events[0])
+	}
+	if e := events[1]; e.Type != model.EventSyncApplied || e.Attrs["config_version"] != "3" || e.Attrs["clients"] != "1" {
+		t.Fatalf("unexpected second event: %+v", e)
+	}
+}
+
+func TestEmitWithoutEventsEnabledQueuesNothing(t *testing.T) {
+	a := &Agent{cfg: &config.Config{}}
+	a.emit(model.EventCoreUpdated, model.SeverityInfo, "xray-core updated", nil)
+	if len(a.events.pending) != 0 {
+		t.Fatalf("queued %d events", len(a.events.pending))
+	}
+}
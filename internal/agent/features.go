@@ -0,0 +1,92 @@
+package agent
+
+import (
+	"maps"
+	"runtime"
+	"slices"
+	"sync"
+
+	"github.com/najahiiii/xray-agent/internal/config"
+	"github.com/najahiiii/xray-agent/internal/model"
+	"github.com/najahiiii/xray-agent/internal/rollout"
+	"github.com/najahiiii/xray-agent/internal/singbox"
+	"github.com/najahiiii/xray-agent/internal/xray"
+)
+
+// featureSet holds the feature flags of the last state, decided for this
+// node.
+type featureSet struct {
+	mu      sync.RWMutex
+	enabled map[string]bool
+}
+
+// noteFeatures decides each flag of the state for this node, letting the
+// features config override the rollout, and logs the flags that flipped.
+func (a *Agent) noteFeatures(flags map[string]model.FeatureFlag) {
+	next := make(map[string]bool, len(flags))
+	for name, flag := range flags {
+		next[name] = rollout.Enabled(a.cfg.Control.ServerSlug, name, flag.Percent)
+	}
+	for name, on := range a.cfg.Features {
+		next[name] = on
+	}
+
+	a.features.mu.Lock()
+	prev := a.features.enabled
+	a.features.enabled = next
+	a.features.mu.Unlock()
+
+	names := slices.Concat(slices.Collect(maps.Keys(next)), slices.Collect(maps.Keys(prev)))
+	slices.Sort(names)
+	for _, name := range slices.Compact(names) {
+		if next[name] != prev[name] {
+			a.log.Info("feature flag changed", "feature", name, "enabled", next[name], "percent", flags[name].Percent)
+		}
+	}
+}
+
+// featureEnabled reports whether the named behavior is on for this node.
+// Unknown flags are off.
+func (a *Agent) featureEnabled(name string) bool {
+	a.features.mu.RLock()
+	defer a.features.mu.RUnlock()
+	return a.features.enabled[name]
+}
+
+func (a *Agent) featuresSnapshot() map[string]bool {
+	a.features.mu.RLock()
+	defer a.features.mu.RUnlock()
+	if len(a.features.enabled) == 0 {
+		return nil
+	}
+	return maps.Clone(a.features.enabled)
+}
+
+func (a *Agent) capabilities() model.Capabilities {
+	return Capabilities(a.cfg)
+}
+
+// Capabilities lists what an agent running with cfg applies from the state.
+// Sections that depend on local config, such as rendering and ACME, are only
+// listed when they are configured; the sing-box backend applies only the user
+// sections.
+func Capabilities(cfg *config.Config) model.Capabilities {
+	protocols := append(xray.Protocols(), model.ProtoWireGuard)
+	features := []string{"routes", "route_results", "route_user", "route_network", "route_source", "route_attrs", "outbounds", "inbound_tags", "client_inbound_tag", "client_flow", "client_level", "retention", "sniffing", "dns", "certificates", "features", "report"}
+	if cfg.Backend == config.BackendSingBox {
+		protocols = singbox.Protocols()
+		features = []string{"inbound_tags", "client_inbound_tag", "client_flow", "retention", "certificates", "features", "report"}
+	} else if cfg.Xray.Render.Template != "" {
+		features = append(features, "render")
+	}
+	if cfg.ACME.Enabled {
+		features = append(features, "acme_domains")
+	}
+	return model.Capabilities{
+		OS:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+		Backend:   cfg.Backend,
+		Protocols: protocols,
+		Features:  features,
+	}
+}
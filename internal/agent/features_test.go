@@ -0,0 +1,35 @@
+package agent
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/najahiiii/xray-agent/internal/config"
+	"github.com/najahiiii/xray-agent/internal/model"
+	"github.com/najahiiii/xray-agent/internal/rollout"
+)
+
+func TestNoteFeaturesDecidesPerNode(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Control.ServerSlug = "sg-1"
+	cfg.Features = map[string]bool{"forced": true}
+	a := &Agent{cfg: cfg, log: slog.New(slog.NewTextHandler(io.Discard, nil))}
+
+	bucket := rollout.Bucket("sg-1", "canary")
+	a.noteFeatures(map[string]model.FeatureFlag{
+		"everyone": {Percent: 100},
+		"canary":   {Percent: bucket + 0.01},
+		"forced":   {Percent: 0},
+	})
+	if !a.featureEnabled("everyone") || !a.featureEnabled("canary") || !a.featureEnabled("forced") {
+		t.Fatalf("features = %v", a.featuresSnapshot())
+	}
+
+	// Shrinking the rollout below the node's bucket drops it; unknown flags
+	// are off.
+	a.noteFeatures(map[string]model.FeatureFlag{"canary": {Percent: bucket}})
+	if a.featureEnabled("canary") || a.featureEnabled("everyone") || a.featureEnabled("missing") {
+		t.Fatalf("features = %v", a.featuresSnapshot())
+	}
+}
@@ -0,0 +1,246 @@
+package agent
+
+import (
+	"maps"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/najahiiii/xray-agent/internal/config"
+	"github.com/najahiiii/xray-agent/internal/model"
+	"github.com/najahiiii/xray-agent/internal/state"
+)
+
+// Subsystem names reported in the v1 heartbeat.
+const (
+	subsystemState     = "state"
+	subsystemStats     = "stats"
+	subsystemOnline    = "online"
+	subsystemMetrics   = "metrics"
+	subsystemCommands  = "commands"
+	subsystemACME      = "acme"
+	subsystemAccessLog = "access_log"
+	subsystemAbuse     = "abuse"
+	subsystemBan       = "ban"
+	subsystemBandwidth = "bandwidth_cap"
+)
+
+// storageRetryInterval is how long local writes are skipped after the
+// filesystem was found read-only or full.
+const storageRetryInterval = 5 * time.Minute
+
+// xrayProbe checks that xray-core's API accepts connections.
+var xrayProbe = func(addr string) error {
+	conn, err := net.DialTimeout("tcp", addr, 2*time.Second)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// healthTracker keeps the outcome of the latest run of each loop.
+type healthTracker struct {
+	mu         sync.Mutex
+	startedAt  time.Time
+	subsystems map[string]model.SubsystemStatus
+	// storage is non-nil while the storage dir is read-only or full.
+	storage        *model.StorageStatus
+	storageRetryAt time.Time
+	// routes is the outcome of each route rule of the last applied state.
+	routes []model.RouteResult
+}
+
+func newHealthTracker(startedAt time.Time) *healthTracker {
+	return &healthTracker{startedAt: startedAt, subsystems: map[string]model.SubsystemStatus{}}
+}
+
+func (h *healthTracker) record(name string, err error) {
+	now := time.Now().UTC()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	st := h.subsystems[name]
+	if err != nil {
+		st.Status = model.NodeStatusError
+		st.LastErrorAt = &now
+		st.LastError = err.Error()
+		st.ConsecutiveFailures++
+	} else {
+		st.Status = model.NodeStatusOK
+		st.LastSuccessAt = &now
+		st.ConsecutiveFailures = 0
+	}
+	h.subsystems[name] = st
+}
+
+// recordStorage updates the storage condition after a write to path. It
+// reports the previous and the new condition so callers can log transitions
+// once instead of on every write.
+func (h *healthTracker) recordStorage(path string, err error) (before, after string) {
+	now := time.Now().UTC()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.storage != nil {
+		before = h.storage.Condition
+	}
+	after = state.StorageCondition(err)
+	switch {
+	case after == "":
+		h.storage = nil
+		h.storageRetryAt = time.Time{}
+	case after != before:
+		h.storage = &model.StorageStatus{Condition: after, Path: path, Error: err.Error(), Since: now}
+		h.storageRetryAt = now.Add(storageRetryInterval)
+	default:
+		h.storage.Error = err.Error()
+		h.storageRetryAt = now.Add(storageRetryInterval)
+	}
+	return before, after
+}
+
+// skipStorageWrite reports whether local writes should be skipped because
+// the storage dir recently failed as read-only or full.
+func (h *healthTracker) skipStorageWrite() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.storage != nil && time.Now().Before(h.storageRetryAt)
+}
+
+func (h *healthTracker) storageStatus() *model.StorageStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.storage == nil {
+		return nil
+	}
+	st := *h.storage
+	return &st
+}
+
+func (h *healthTracker) setRoutes(results []model.RouteResult) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.routes = results
+}
+
+func (h *healthTracker) routesSnapshot() []model.RouteResult {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return slices.Clone(h.routes)
+}
+
+func (h *healthTracker) snapshot() map[string]model.SubsystemStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return maps.Clone(h.subsystems)
+}
+
+// xrayStatus probes the core's API: xray.api_server, or sing_box.api_server
+// with the sing-box backend. It returns nil when no API address is configured.
+func (a *Agent) xrayStatus() *model.XrayStatus {
+	addr := a.cfg.Xray.APIServer
+	if a.cfg.Backend == config.BackendSingBox {
+		addr = a.cfg.SingBox.APIServer
+	}
+	if addr == "" {
+		return nil
+	}
+	if err := xrayProbe(addr); err != nil {
+		return &model.XrayStatus{State: model.XrayUnreachable, Error: err.Error()}
+	}
+	return &model.XrayStatus{State: model.XrayRunning}
+}
+
+// noteStorage records the outcome of a local write and logs when the storage
+// dir becomes read-only or full, and when it recovers.
+func (a *Agent) noteStorage(path string, err error) {
+	if a.health == nil {
+		return
+	}
+	before, after := a.health.recordStorage(path, err)
+	switch {
+	case after != "" && after != before:
+		a.log.Warn("storage is not writable; skipping local writes and keeping state in memory",
+			"condition", after, "path", path, "retry_in", storageRetryInterval, "err", err)
+		typ := model.EventStorageFull
+		if after == state.StorageReadOnly {
+			typ = model.EventStorageReadOnly
+		}
+		a.emit(typ, model.SeverityWarn, "storage is not writable", map[string]string{"path": path, "error": err.Error()})
+	case after == "" && before != "":
+		a.log.Info("storage is writable again", "path", path)
+	}
+}
+
+// track records err against a subsystem and returns it unchanged.
+func (a *Agent) track(name string, err error) error {
+	if a.health != nil {
+		a.health.record(name, err)
+	}
+	return err
+}
+
+// nodeStatus builds the v1 heartbeat summary. A failing state sync means the
+// node no longer follows the panel and is reported as error; any other failing
+// subsystem, or an xray API that does not answer, only degrades the node. It
+// returns nil unless the v1 heartbeat format is configured.
+func (a *Agent) nodeStatus() *model.NodeStatus {
+	if a.health == nil || a.cfg.Control.HeartbeatFormat != config.HeartbeatFormatV1 {
+		return nil
+	}
+	return a.healthStatus()
+}
+
+// healthStatus summarizes agent health whatever the heartbeat format.
+func (a *Agent) healthStatus() *model.NodeStatus {
+	subsystems := a.health.snapshot()
+	storage := a.health.storageStatus()
+	routes := a.health.routesSnapshot()
+	xrayStatus := a.xrayStatus()
+	status := model.NodeStatusOK
+	if storage != nil || slices.ContainsFunc(routes, func(r model.RouteResult) bool { return r.Status == model.RouteFailed }) {
+		status = model.NodeStatusDegraded
+	}
+	if xrayStatus != nil && xrayStatus.State != model.XrayRunning {
+		status = model.NodeStatusDegraded
+	}
+	for name, st := range subsystems {
+		if st.Status != model.NodeStatusError {
+			continue
+		}
+		if name == subsystemState {
+			status = model.NodeStatusError
+			break
+		}
+		status = model.NodeStatusDegraded
+	}
+
+	var network *model.NetworkStatus
+	if a.metrics != nil {
+		network = a.metrics.LastNetwork()
+	}
+	return &model.NodeStatus{
+		Status:        status,
+		ConfigVersion: a.state.Version(),
+		Clients:       len(a.state.Emails()),
+		Xray:          xrayStatus,
+		Features:      a.featuresSnapshot(),
+		Routes:        routes,
+		StartedAt:     a.health.startedAt,
+		UptimeSec:     int64(time.Since(a.health.startedAt).Seconds()),
+		Subsystems:    subsystems,
+		Timers: map[string]int{
+			"state_sec":      a.cfg.Intervals.StateSec,
+			"online_sec":     a.cfg.Intervals.OnlineSec,
+			"stats_sec":      a.cfg.Intervals.StatsSec,
+			"heartbeat_sec":  a.cfg.Intervals.HeartbeatSec,
+			"metrics_sec":    a.cfg.Intervals.MetricsSec,
+			"core_check_sec": a.cfg.Intervals.CoreCheckSec,
+		},
+		Storage:      storage,
+		Network:      network,
+		BandwidthCap: a.bandwidthCapStatus(),
+		Usage:        a.usageRollups(time.Now(), false),
+	}
+}
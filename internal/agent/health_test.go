@@ -0,0 +1,107 @@
+package agent
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/najahiiii/xray-agent/internal/config"
+	"github.com/najahiiii/xray-agent/internal/model"
+	"github.com/najahiiii/xray-agent/internal/state"
+)
+
+func TestNodeStatusReflectsSubsystemFailures(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Control.HeartbeatFormat = config.HeartbeatFormatV1
+	cfg.Intervals.StatsSec = 60
+	a := &Agent{cfg: cfg, state: state.New(), health: newHealthTracker(time.Now().UTC())}
+
+	_ = a.track(subsystemState, nil)
+	_ = a.track(subsystemStats, nil)
+	if got := a.nodeStatus(); got.Status != model.NodeStatusOK || got.Timers["stats_sec"] != 60 {
+		t.Fatalf("expected ok status, got %+v", got)
+	}
+
+	_ = a.track(subsystemStats, errors.New("stats query: unavailable"))
+	_ = a.track(subsystemStats, errors.New("stats query: unavailable"))
+	got := a.nodeStatus()
+	if got.Status != model.NodeStatusDegraded {
+		t.Fatalf("expected degraded status, got %s", got.Status)
+	}
+	stats := got.Subsystems[subsystemStats]
+	if stats.ConsecutiveFailures != 2 || stats.LastError == "" || stats.LastSuccessAt == nil {
+		t.Fatalf("unexpected stats subsystem: %+v", stats)
+	}
+
+	_ = a.track(subsystemState, errors.New("state http 500"))
+	if got := a.nodeStatus(); got.Status != model.NodeStatusError {
+		t.Fatalf("expected error status, got %s", got.Status)
+	}
+
+	cfg.Control.HeartbeatFormat = config.HeartbeatFormatEmpty
+	if got := a.nodeStatus(); got != nil {
+		t.Fatalf("expected no status for legacy heartbeat, got %+v", got)
+	}
+}
+
+func TestNodeStatusReportsReadOnlyStorage(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Control.HeartbeatFormat = config.HeartbeatFormatV1
+	cfg.Storage.Dir = t.TempDir()
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	a := New(cfg, log, nil, nil, nil, nil)
+
+	path := filepath.Join(cfg.Storage.Dir, statsCountersFile)
+	a.noteStorage(path, &os.PathError{Op: "open", Path: path, Err: syscall.EROFS})
+	got := a.nodeStatus()
+	if got.Status != model.NodeStatusDegraded || got.Storage == nil || got.Storage.Condition != state.StorageReadOnly {
+		t.Fatalf("expected degraded status with read-only storage, got %+v", got)
+	}
+
+	// Writes are skipped while the condition is fresh, so the counters file
+	// is not touched even though the directory is actually writable.
+	a.saveStatsCounters()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("stats counters written while storage is read-only: %v", err)
+	}
+
+	a.noteStorage(path, nil)
+	if got := a.nodeStatus(); got.Status != model.NodeStatusOK || got.Storage != nil {
+		t.Fatalf("expected recovered storage, got %+v", got)
+	}
+	a.saveStatsCounters()
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("stats counters not written after recovery: %v", err)
+	}
+}
+
+func TestNodeStatusReportsClientsAndXray(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Control.HeartbeatFormat = config.HeartbeatFormatV1
+	cfg.Xray.APIServer = "127.0.0.1:10085"
+	a := &Agent{cfg: cfg, state: state.New(), health: newHealthTracker(time.Now().UTC())}
+	a.state.Update(7, []model.Client{{Email: "a@x", Proto: "vless"}, {Email: "b@x", Proto: "trojan"}}, nil)
+
+	probeErr := errors.New("connection refused")
+	orig := xrayProbe
+	xrayProbe = func(string) error { return probeErr }
+	t.Cleanup(func() { xrayProbe = orig })
+
+	got := a.nodeStatus()
+	if got.Clients != 2 || got.ConfigVersion != 7 {
+		t.Fatalf("clients = %d, config_version = %d", got.Clients, got.ConfigVersion)
+	}
+	if got.Status != model.NodeStatusDegraded || got.Xray == nil || got.Xray.State != model.XrayUnreachable || got.Xray.Error == "" {
+		t.Fatalf("expected degraded node with unreachable xray, got %+v", got)
+	}
+
+	probeErr = nil
+	if got := a.nodeStatus(); got.Status != model.NodeStatusOK || got.Xray.State != model.XrayRunning {
+		t.Fatalf("expected ok node with running xray, got %+v", got)
+	}
+}
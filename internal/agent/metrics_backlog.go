@@ -0,0 +1,102 @@
+package agent
+
+import (
+	"time"
+
+	"github.com/najahiiii/xray-agent/internal/model"
+)
+
+const (
+	// metricsBucket is the period one aggregated sample covers.
+	metricsBucket = 5 * time.Minute
+	// metricsBacklogBuckets keeps a day of outage; older buckets are dropped.
+	metricsBacklogBuckets = 288
+)
+
+// metricsBacklog folds the metric samples the panel did not accept into
+// per-bucket min/avg/max aggregates, so an outage is reported at a coarser
+// resolution instead of being lost.
+type metricsBacklog struct {
+	buckets []*metricsAggregate
+}
+
+type metricsAggregate struct {
+	start    time.Time
+	from, to time.Time
+	samples  int
+	last     *model.ServerMetricPush
+
+	cpu, mem, down, up series
+}
+
+// series accumulates one optional metric.
+type series struct {
+	n             int
+	min, max, sum float64
+}
+
+func (s *series) add(v *float64) {
+	if v == nil {
+		return
+	}
+	if s.n == 0 || *v < s.min {
+		s.min = *v
+	}
+	if s.n == 0 || *v > s.max {
+		s.max = *v
+	}
+	s.n++
+	s.sum += *v
+}
+
+func (s *series) summary() (*float64, *model.MinAvgMax) {
+	if s.n == 0 {
+		return nil, nil
+	}
+	avg := s.sum / float64(s.n)
+	return &avg, &model.MinAvgMax{Min: s.min, Avg: avg, Max: s.max}
+}
+
+func (b *metricsBacklog) add(sample *model.ServerMetricPush) {
+	start := sample.ServerTime.Truncate(metricsBucket)
+	var agg *metricsAggregate
+	if n := len(b.buckets); n > 0 && b.buckets[n-1].start.Equal(start) {
+		agg = b.buckets[n-1]
+	} else {
+		agg = &metricsAggregate{start: start, from: sample.ServerTime}
+		b.buckets = append(b.buckets, agg)
+		if len(b.buckets) > metricsBacklogBuckets {
+			b.buckets = b.buckets[1:]
+		}
+	}
+	agg.to = sample.ServerTime
+	agg.samples++
+	agg.last = sample
+	agg.cpu.add(sample.CPUPercent)
+	agg.mem.add(sample.MemoryPercent)
+	agg.down.add(sample.BandwidthDownMbps)
+	agg.up.add(sample.BandwidthUpMbps)
+}
+
+func (b *metricsBacklog) empty() bool {
+	return len(b.buckets) == 0
+}
+
+// oldest returns the oldest bucket as a sample to post.
+func (b *metricsBacklog) oldest() *model.ServerMetricPush {
+	agg := b.buckets[0]
+	sample := *agg.last
+	sample.ServerTime = agg.to
+	aggregate := &model.MetricAggregate{From: agg.from, To: agg.to, Samples: agg.samples}
+	sample.CPUPercent, aggregate.CPUPercent = agg.cpu.summary()
+	sample.MemoryPercent, aggregate.MemoryPercent = agg.mem.summary()
+	sample.BandwidthDownMbps, aggregate.BandwidthDownMbps = agg.down.summary()
+	sample.BandwidthUpMbps, aggregate.BandwidthUpMbps = agg.up.summary()
+	sample.Aggregate = aggregate
+	return &sample
+}
+
+// drop forgets the oldest bucket once the panel accepted it.
+func (b *metricsBacklog) drop() {
+	b.buckets = b.buckets[1:]
+}
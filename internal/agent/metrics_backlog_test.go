@@ -0,0 +1,76 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/najahiiii/xray-agent/internal/model"
+)
+
+func TestMetricsBacklogAggregatesPerBucket(t *testing.T) {
+	var b metricsBacklog
+	base := time.Date(2025, 11, 7, 15, 0, 0, 0, time.UTC)
+	for i, cpu := range []float64{10, 30, 20, 50} {
+		b.add(&model.ServerMetricPush{ServerTime: base.Add(time.Duration(i) * 2 * time.Minute), CPUPercent: &cpu})
+	}
+	if len(b.buckets) != 2 {
+		t.Fatalf("buckets = %d, want 2", len(b.buckets))
+	}
+
+	first := b.oldest()
+	agg := first.Aggregate
+	if agg == nil || agg.Samples != 3 || !agg.From.Equal(base) || !agg.To.Equal(base.Add(4*time.Minute)) {
+		t.Fatalf("aggregate = %+v", agg)
+	}
+	if *agg.CPUPercent != (model.MinAvgMax{Min: 10, Avg: 20, Max: 30}) || *first.CPUPercent != 20 {
+		t.Fatalf("cpu = %+v, top-level %v; want min 10 avg 20 max 30", agg.CPUPercent, *first.CPUPercent)
+	}
+	if agg.MemoryPercent != nil || first.MemoryPercent != nil {
+		t.Fatal("memory reported without samples")
+	}
+	b.drop()
+	if got := b.oldest().Aggregate.Samples; got != 1 {
+		t.Fatalf("second bucket samples = %d, want 1", got)
+	}
+
+	for i := range metricsBacklogBuckets + 10 {
+		b.add(&model.ServerMetricPush{ServerTime: base.Add(time.Duration(i) * metricsBucket)})
+	}
+	if len(b.buckets) != metricsBacklogBuckets {
+		t.Fatalf("backlog grew to %d buckets, want at most %d", len(b.buckets), metricsBacklogBuckets)
+	}
+}
+
+func TestPushMetricsFlushesBacklogAfterOutage(t *testing.T) {
+	var posted []model.ServerMetricPush
+	failing := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing {
+			http.Error(w, "down", http.StatusBadGateway)
+			return
+		}
+		var p model.ServerMetricPush
+		json.NewDecoder(r.Body).Decode(&p)
+		posted = append(posted, p)
+	}))
+	t.Cleanup(server.Close)
+	a := newCommandAgent(server.URL)
+
+	cpu := 40.0
+	a.metricsBacklog.add(&model.ServerMetricPush{ServerTime: time.Now().UTC(), CPUPercent: &cpu})
+	if err := a.flushMetricsBacklog(context.Background()); err == nil || a.metricsBacklog.empty() {
+		t.Fatalf("flush during outage = %v; want error and backlog kept", err)
+	}
+
+	failing = false
+	if err := a.flushMetricsBacklog(context.Background()); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if len(posted) != 1 || posted[0].Aggregate == nil || posted[0].Aggregate.Samples != 1 || !a.metricsBacklog.empty() {
+		t.Fatalf("posted = %+v; want one aggregate and an empty backlog", posted)
+	}
+}
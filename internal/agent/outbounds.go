@@ -0,0 +1,53 @@
+package agent
+
+import (
+	"context"
+
+	"github.com/najahiiii/xray-agent/internal/model"
+)
+
+// applyOutbounds brings the outbounds added through the API in line with the
+// state. Invalid outbounds and ones xray rejects are logged and left out of
+// appliedOutbounds, so the next sync retries them. After xray restarted,
+// assumeEmptyRuntime adds every outbound again.
+func (a *Agent) applyOutbounds(ctx context.Context, outbounds []model.Outbound, assumeEmptyRuntime bool) error {
+	if assumeEmptyRuntime {
+		a.appliedOutbounds = nil
+	}
+
+	// Like routes, a repeated tag keeps its last definition.
+	last := make(map[string]int, len(outbounds))
+	for i, o := range outbounds {
+		last[o.Tag] = i
+	}
+	desired := make([]model.Outbound, 0, len(last))
+	for i, o := range outbounds {
+		if last[o.Tag] != i {
+			a.log.Warn("state contains duplicate outbound tag; keeping last occurrence", "tag", o.Tag)
+			continue
+		}
+		if err := o.Validate(); err != nil {
+			a.log.Warn("outbound skipped", "tag", o.Tag, "err", err)
+			continue
+		}
+		desired = append(desired, o)
+	}
+
+	changed, failed, err := a.xray.Outbounds(ctx, a.appliedOutbounds, desired)
+	if err != nil {
+		return err
+	}
+	applied := make(map[string]model.Outbound, len(desired))
+	for _, o := range desired {
+		if err := failed[o.Tag]; err != nil {
+			a.log.Warn("outbound not applied", "tag", o.Tag, "err", err)
+			continue
+		}
+		applied[o.Tag] = o
+	}
+	a.appliedOutbounds = applied
+	if changed {
+		a.log.Info("applied outbounds", "outbounds", len(applied))
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package agent
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/najahiiii/xray-agent/internal/audit"
+	"github.com/najahiiii/xray-agent/internal/model"
+	"github.com/najahiiii/xray-agent/internal/xray"
+)
+
+// RuntimeLister lists the users and routing rules the running core holds.
+// xray.Manager implements it; core managers that do not are never
+// reconciled.
+type RuntimeLister interface {
+	ListUsers(ctx context.Context) ([]xray.CoreUser, error)
+	ListRules(ctx context.Context) ([]xray.CoreRule, error)
+}
+
+// maxLoggedEmails caps the emails named in a reconcile log line.
+const maxLoggedEmails = 10
+
+// runReconcileLoop checks every intervals.reconcile_sec that xray still
+// holds the users of the applied state. The state loop skips an unchanged
+// state without asking xray, so users lost behind the agent's back (a
+// restart it did not make, a manual API call) would otherwise stay missing
+// until the panel changes something.
+func (a *Agent) runReconcileLoop(ctx context.Context) {
+	lister, ok := a.xray.(RuntimeLister)
+	if !ok || a.cfg.Intervals.ReconcileSec <= 0 {
+		return
+	}
+	sched := a.newSchedule(time.Duration(a.cfg.Intervals.ReconcileSec) * time.Second)
+	for {
+		if !sched.wait(ctx) {
+			return
+		}
+		err := a.reconcileOnce(ctx, lister)
+		if errors.Is(err, xray.ErrListUsersUnsupported) {
+			a.log.Info("xray cannot list inbound users; reconciliation disabled", "err", err)
+			return
+		}
+		if err != nil {
+			a.log.Warn("reconcile", "err", err)
+		}
+	}
+}
+
+// reconcileOnce compares the core with the applied state, adds missing
+// users and route rules back, and reports the drift to the panel whenever
+// it differs from the last report. Users and rules only the core has are
+// left alone, since they may come from the static config.
+func (a *Agent) reconcileOnce(ctx context.Context, lister RuntimeLister) error {
+	a.syncMu.Lock()
+	defer a.syncMu.Unlock()
+
+	version := a.state.Version()
+	if version < 0 {
+		return nil
+	}
+	users, err := lister.ListUsers(ctx)
+	if err != nil {
+		return err
+	}
+	rules, err := lister.ListRules(ctx)
+	if errors.Is(err, xray.ErrListRulesUnsupported) {
+		rules = nil
+	} else if err != nil {
+		return err
+	}
+
+	report := &model.DriftReport{ServerTime: time.Now().UTC(), ConfigVersion: version, Users: []model.DriftItem{}, Routes: []model.DriftItem{}}
+	applied := a.state.ClientsSnapshot()
+	maps.DeleteFunc(applied, func(_ string, c model.Client) bool { return a.capWithholds(c) })
+	current := maps.Clone(applied)
+	type key struct{ tag, email string }
+	wanted := make(map[key]bool, len(applied))
+	tags := a.inboundTags(nil)
+	for email, c := range applied {
+		wanted[key{cmp.Or(c.InboundTag, tags[c.Proto]), email}] = true
+	}
+	present := make(map[key]bool, len(users))
+	for _, u := range users {
+		k := key{u.InboundTag, u.Email}
+		present[k] = true
+		if !wanted[k] {
+			report.Users = append(report.Users, model.DriftItem{Subject: u.Email, Inbound: u.InboundTag, Status: model.DriftExtra})
+		}
+	}
+	var missing []string
+	for k := range wanted {
+		if !present[k] {
+			delete(current, k.email)
+			missing = append(missing, k.email)
+			report.Users = append(report.Users, model.DriftItem{Subject: k.email, Inbound: k.tag, Status: model.DriftMissing, Repaired: true})
+		}
+	}
+
+	appliedRoutes := a.state.RoutesSnapshot()
+	currentRoutes := maps.Clone(appliedRoutes)
+	var stale []string
+	if rules != nil {
+		managed := slices.SortedFunc(maps.Values(appliedRoutes), func(x, y model.RouteRule) int { return strings.Compare(x.Tag, y.Tag) })
+		for _, r := range xray.CompareRules(managed, rules) {
+			item := model.DriftItem{Subject: r.Tag}
+			if r.Core != nil {
+				item.Outbound = r.Core.OutboundTag
+			}
+			switch r.Status {
+			case xray.RuleMissing:
+				delete(currentRoutes, r.Tag)
+				item.Status, item.Repaired = model.DriftMissing, true
+			case xray.RuleOutboundMismatch:
+				item.Status = model.DriftOutboundMismatch
+			case xray.RuleUnmanaged:
+				if isAgentRule(r.Tag) {
+					if _, ok := a.agentRules[r.Tag]; !ok {
+						stale = append(stale, r.Tag)
+					}
+					continue
+				}
+				if r.Tag == "" {
+					// Untagged rules from the static config cannot be told apart.
+					continue
+				}
+				item.Status = model.DriftExtra
+			default:
+				continue
+			}
+			report.Routes = append(report.Routes, item)
+		}
+	}
+	if len(stale) > 0 {
+		slices.Sort(stale)
+		a.removeStaleAgentRules(audit.WithSource(ctx, audit.SourceReconcile, version), stale)
+	}
+	sortDrift(report.Users)
+	sortDrift(report.Routes)
+
+	if len(missing) > 0 || len(currentRoutes) < len(appliedRoutes) {
+		slices.Sort(missing)
+		a.log.Warn("xray lost parts of the applied state; adding them again",
+			"version", version, "missing_users", len(missing), "emails", missing[:min(len(missing), maxLoggedEmails)],
+			"missing_routes", len(appliedRoutes)-len(currentRoutes))
+		rctx := audit.WithSource(ctx, audit.SourceReconcile, version)
+		_, failed, err := a.xray.State(rctx, current, slices.Collect(maps.Values(applied)), currentRoutes, slices.Collect(maps.Values(appliedRoutes)))
+		if err != nil {
+			// Nothing was repaired for sure; report the drift as found.
+			for i := range report.Users {
+				report.Users[i].Repaired = false
+			}
+			for i := range report.Routes {
+				report.Routes[i].Repaired = false
+			}
+			a.reportDrift(ctx, report)
+			return err
+		}
+		for i, item := range report.Routes {
+			if _, ok := failed[item.Subject]; ok {
+				report.Routes[i].Repaired = false
+			}
+		}
+	} else {
+		a.log.Debug("xray matches the applied state", "users", len(applied), "routes", len(appliedRoutes))
+	}
+	a.reportDrift(ctx, report)
+	return nil
+}
+
+// reportDrift sends report unless the panel already has the same findings.
+// The first report after startup is always sent, so drift the panel holds
+// from before is cleared.
+func (a *Agent) reportDrift(ctx context.Context, report *model.DriftReport) {
+	if a.lastDrift != nil && reflect.DeepEqual(a.lastDrift.Users, report.Users) && reflect.DeepEqual(a.lastDrift.Routes, report.Routes) {
+		return
+	}
+	if err := a.ctrl.PostDrift(ctx, report); err != nil {
+		a.log.Warn("drift report not delivered; retrying after the next reconcile", "err", err)
+		return
+	}
+	a.lastDrift = report
+}
+
+func sortDrift(items []model.DriftItem) {
+	slices.SortFunc(items, func(x, y model.DriftItem) int {
+		return cmp.Or(strings.Compare(x.Inbound, y.Inbound), strings.Compare(x.Subject, y.Subject), strings.Compare(x.Status, y.Status))
+	})
+}
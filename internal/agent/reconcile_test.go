@@ -0,0 +1,102 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/najahiiii/xray-agent/internal/config"
+	"github.com/najahiiii/xray-agent/internal/control"
+	"github.com/najahiiii/xray-agent/internal/model"
+	"github.com/najahiiii/xray-agent/internal/xray"
+	"github.com/najahiiii/xray-agent/testsupport"
+)
+
+func TestReconcileRepairsAndReportsDrift(t *testing.T) {
+	core := testsupport.NewCore(t)
+	core.AddProtocolInbound("vless", "v")
+	core.AddProtocolInbound("trojan", "t")
+	cfg := newTestConfig(core.Addr)
+
+	var reports []model.DriftReport
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/agents/sg/drift" {
+			t.Errorf("unexpected request %s", r.URL.Path)
+		}
+		var report model.DriftReport
+		if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+			t.Errorf("decode: %v", err)
+		}
+		reports = append(reports, report)
+	}))
+	defer srv.Close()
+	cfg.Control.BaseURL = config.URLList{srv.URL}
+
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	manager := xray.NewManager(cfg, log)
+	a := New(cfg, log, control.NewClient(cfg, log, "v1.0.3", "v25.10.15"), manager, nil, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	clients := []model.Client{
+		{Proto: "vless", ID: "1", Email: "a@example.com"},
+		{Proto: "vless", ID: "2", Email: "b@example.com"},
+		{Proto: "trojan", Password: "p", Email: "c@example.com"},
+	}
+	routes := []model.RouteRule{{Tag: "block-ads", OutboundTag: "blocked", Domain: []string{"domain:ads.example.com"}}}
+	manual := model.Client{Proto: "vless", ID: "9", Email: "manual@example.com"}
+	if _, _, err := manager.State(ctx, nil, append(slices.Clone(clients), manual), nil, routes); err != nil {
+		t.Fatalf("State: %v", err)
+	}
+	a.state.Update(3, clients, routes)
+	core.SeedRule("hand-made", "direct")
+
+	if err := a.reconcileOnce(ctx, manager); err != nil {
+		t.Fatalf("reconcileOnce: %v", err)
+	}
+	if len(reports) != 1 {
+		t.Fatalf("first reconcile sent %d reports, want 1", len(reports))
+	}
+	want := []model.DriftItem{{Subject: "manual@example.com", Inbound: "v", Status: model.DriftExtra}}
+	if !slices.Equal(reports[0].Users, want) || !slices.Equal(reports[0].Routes, []model.DriftItem{{Subject: "hand-made", Status: model.DriftExtra, Outbound: "direct"}}) {
+		t.Fatalf("first report = %+v", reports[0])
+	}
+
+	// Unchanged drift is not sent again.
+	if err := a.reconcileOnce(ctx, manager); err != nil {
+		t.Fatalf("reconcileOnce: %v", err)
+	}
+	if len(reports) != 1 {
+		t.Fatalf("unchanged drift sent again: %+v", reports)
+	}
+
+	core.ResetOps()
+	core.DropUser("v", "b@example.com")
+	core.DropUser("t", "c@example.com")
+	if err := a.reconcileOnce(ctx, manager); err != nil {
+		t.Fatalf("reconcileOnce: %v", err)
+	}
+	if adds := addedEmails(core); !slices.Equal(slices.Sorted(slices.Values(adds)), []string{"b@example.com", "c@example.com"}) {
+		t.Fatalf("re-added %v, want the two dropped users", adds)
+	}
+	if got := core.Users("v"); !slices.Equal(got, []string{"a@example.com", "b@example.com", "manual@example.com"}) {
+		t.Fatalf("vless users = %v", got)
+	}
+	if len(reports) != 2 {
+		t.Fatalf("sent %d reports, want 2", len(reports))
+	}
+	want = []model.DriftItem{
+		{Subject: "c@example.com", Inbound: "t", Status: model.DriftMissing, Repaired: true},
+		{Subject: "b@example.com", Inbound: "v", Status: model.DriftMissing, Repaired: true},
+		{Subject: "manual@example.com", Inbound: "v", Status: model.DriftExtra},
+	}
+	if !slices.Equal(reports[1].Users, want) || reports[1].ConfigVersion != 3 {
+		t.Fatalf("second report = %+v", reports[1])
+	}
+}
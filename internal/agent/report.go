@@ -0,0 +1,80 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/najahiiii/xray-agent/internal/model"
+)
+
+// featureCombinedReport is the feature flag a panel sets once it serves
+// POST /report. While it is on, the heartbeat, stats and metrics loops stand
+// down and runReportLoop sends all three in one request.
+const featureCombinedReport = "combined_report"
+
+// combinedReport reports whether the heartbeat, stats and metrics go out as
+// one report.
+func (a *Agent) combinedReport() bool {
+	return a.featureEnabled(featureCombinedReport)
+}
+
+func (a *Agent) runReportLoop(ctx context.Context) {
+	intv := time.Duration(a.cfg.Intervals.ReportSec) * time.Second
+	if intv <= 0 {
+		intv = 30 * time.Second
+	}
+	sched := a.newSchedule(intv)
+
+	for {
+		if !sched.wait(ctx) {
+			return
+		}
+		if !a.combinedReport() {
+			continue
+		}
+		if err := a.pushReportOnce(ctx); err != nil {
+			a.log.Warn("report-sync", "err", err)
+		}
+	}
+}
+
+// pushReportOnce collects what the heartbeat, stats and metrics loops would
+// send and posts it as one report. Usage is committed and the metrics sample
+// dropped only once the panel accepted the report, as with the separate
+// pushes.
+func (a *Agent) pushReportOnce(ctx context.Context) error {
+	var stats *model.StatsPush
+	var commit func()
+	var statsErr error
+	if a.stats != nil {
+		stats, commit, statsErr = a.collectStats(ctx)
+		if commit != nil {
+			defer a.saveStatsCounters()
+		}
+	}
+	var sample *model.ServerMetricPush
+	if a.metrics != nil || a.stats != nil {
+		if sample = a.collectMetricsSample(ctx); sample != nil {
+			a.checkAlerts(ctx, sample)
+		}
+	}
+
+	err := a.ctrl.PostReport(ctx, a.nodeStatus(), stats, sample)
+	if err != nil {
+		if sample != nil {
+			a.metricsBacklog.add(sample)
+		}
+		err = fmt.Errorf("post report: %w", err)
+		a.track(subsystemStats, errors.Join(statsErr, err))
+		a.track(subsystemMetrics, err)
+		return err
+	}
+	if commit != nil {
+		commit()
+	}
+	a.log.Debug("posted report", "stats", stats != nil, "metrics", sample != nil)
+	a.track(subsystemStats, statsErr)
+	return errors.Join(statsErr, a.track(subsystemMetrics, a.flushMetricsBacklog(ctx)))
+}
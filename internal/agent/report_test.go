@@ -0,0 +1,88 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/najahiiii/xray-agent/internal/config"
+	"github.com/najahiiii/xray-agent/internal/control"
+	"github.com/najahiiii/xray-agent/internal/model"
+	"github.com/najahiiii/xray-agent/internal/stats"
+	"github.com/najahiiii/xray-agent/testsupport"
+)
+
+func TestCombinedReportReplacesSeparatePushes(t *testing.T) {
+	core := testsupport.NewCore(t)
+	core.SetUserTraffic("user@example.com", 100, 200)
+	cfg := newTestConfig(core.Addr)
+	cfg.Xray.StatsResetEachPush = true
+	cfg.Features = map[string]bool{featureCombinedReport: true}
+
+	var (
+		fail    = true
+		paths   []string
+		reports []model.ReportPush
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		if fail {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		if r.URL.Path != "/api/agents/sg/report" {
+			return
+		}
+		var report model.ReportPush
+		if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+			t.Errorf("decode report: %v", err)
+		}
+		reports = append(reports, report)
+	}))
+	defer srv.Close()
+	cfg.Control.BaseURL = config.URLList{srv.URL}
+
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	a := New(cfg, log, control.NewClient(cfg, log, "v-test", "v25.10.15"), nil, stats.New(cfg, log), nil)
+	a.noteFeatures(nil)
+	if !a.combinedReport() {
+		t.Fatal("combined_report forced on in the config is off")
+	}
+	a.state.Update(1, []model.Client{{Proto: "vless", ID: "1", Email: "user@example.com"}}, nil)
+	ctx := context.Background()
+
+	if err := a.pushReportOnce(ctx); err == nil {
+		t.Fatal("expected report failure")
+	}
+	if got := core.Counter("user>>>user@example.com>>>traffic>>>uplink"); got != 100 {
+		t.Fatalf("counter reset before the panel accepted the report: %d", got)
+	}
+
+	fail = false
+	if err := a.pushReportOnce(ctx); err != nil {
+		t.Fatalf("report: %v", err)
+	}
+	// The sample of the failed report is sent as metrics backlog.
+	want := []string{"/api/agents/sg/report", "/api/agents/sg/report", "/api/agents/sg/metrics"}
+	if !slices.Equal(paths, want) {
+		t.Fatalf("requests = %v, want %v", paths, want)
+	}
+	if len(reports) != 1 {
+		t.Fatalf("reports = %+v", reports)
+	}
+	got := reports[0]
+	if !got.Heartbeat.OK || got.Heartbeat.AgentVersion != "v-test" {
+		t.Fatalf("heartbeat = %+v", got.Heartbeat)
+	}
+	if got.Stats == nil || len(got.Stats.Users) != 1 || got.Stats.Users[0].Uplink != 100 || got.Stats.Users[0].Downlink != 200 {
+		t.Fatalf("stats = %+v", got.Stats)
+	}
+	if got := core.Counter("user>>>user@example.com>>>traffic>>>uplink"); got != 0 {
+		t.Fatalf("counter not reset after the panel accepted the report: %d", got)
+	}
+}
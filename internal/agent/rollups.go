@@ -0,0 +1,46 @@
+package agent
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/najahiiii/xray-agent/internal/model"
+	"github.com/najahiiii/xray-agent/internal/state"
+)
+
+// usageRollups reports the daily and monthly totals as of now, with the
+// per-user totals when withUsers is set.
+func (a *Agent) usageRollups(now time.Time, withUsers bool) *model.UsageRollups {
+	a.rollupMu.Lock()
+	defer a.rollupMu.Unlock()
+	a.rollups.Roll(now)
+	totals := func(p state.UsagePeriod) model.UsageTotals {
+		t := model.UsageTotals{Period: p.Period}
+		for email, u := range p.Users {
+			t.Uplink += u[0]
+			t.Downlink += u[1]
+			if withUsers {
+				t.Users = append(t.Users, model.UsageTotal{Email: email, Uplink: u[0], Downlink: u[1]})
+			}
+		}
+		slices.SortFunc(t.Users, func(x, y model.UsageTotal) int {
+			return cmp.Or(cmp.Compare(y.Uplink+y.Downlink, x.Uplink+x.Downlink), strings.Compare(x.Email, y.Email))
+		})
+		return t
+	}
+	return &model.UsageRollups{
+		Today:     totals(a.rollups.Day),
+		Yesterday: totals(a.rollups.PrevDay),
+		Month:     totals(a.rollups.Month),
+		LastMonth: totals(a.rollups.PrevMonth),
+	}
+}
+
+// AdminUsage serves the per-user daily and monthly totals for the local
+// admin API.
+func (a *Agent) AdminUsage(context.Context) (*model.UsageRollups, error) {
+	return a.usageRollups(time.Now(), true), nil
+}
@@ -0,0 +1,43 @@
+package agent
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestUsageRollupsCountOnceAndSurviveRestart(t *testing.T) {
+	cfg := newTestConfig("127.0.0.1:10085")
+	cfg.Storage.Dir = t.TempDir()
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	a := New(cfg, log, nil, nil, nil, nil)
+	// Usage the panel did not take yet is read again with the next push.
+	a.recordUsage(map[string][2]int64{"A@example.com": {100, 200}})
+	a.recordUsage(map[string][2]int64{"A@example.com": {150, 200}, "b@example.com": {1, 1}})
+	a.commitUsage(context.Background(), nil, nil)
+	a.recordUsage(map[string][2]int64{"A@example.com": {5, 5}})
+	a.saveStatsCounters()
+
+	b := New(cfg, log, nil, nil, nil, nil)
+	b.restoreStatsCounters()
+	usage, err := b.AdminUsage(context.Background())
+	if err != nil {
+		t.Fatalf("AdminUsage: %v", err)
+	}
+	today := usage.Today
+	if today.Period != time.Now().UTC().Format(time.DateOnly) || today.Uplink != 156 || today.Downlink != 206 || len(today.Users) != 2 {
+		t.Fatalf("today = %+v", today)
+	}
+	if u := today.Users[0]; u.Email != "a@example.com" || u.Uplink != 155 || u.Downlink != 205 {
+		t.Fatalf("busiest user = %+v", u)
+	}
+	if usage.Month.Uplink != 156 || usage.Yesterday.Uplink != 0 {
+		t.Fatalf("usage = %+v", usage)
+	}
+	if st := b.healthStatus(); st.Usage == nil || st.Usage.Today.Uplink != 156 || st.Usage.Today.Users != nil {
+		t.Fatalf("heartbeat usage = %+v", st.Usage)
+	}
+}
@@ -0,0 +1,97 @@
+package agent
+
+import (
+	"context"
+	"math/rand/v2"
+	"time"
+)
+
+// jitterFraction returns a random value in [0, 1); overridden in tests.
+var jitterFraction = rand.Float64
+
+// schedule paces one background loop. Slots are anchored to the loop's first
+// run rather than to the end of the previous run, so slow work does not push
+// later runs back; each run then lands at a random offset within ±spread of
+// its slot so that a fleet of agents started together does not hit the panel
+// in lockstep.
+type schedule struct {
+	interval time.Duration
+	spread   time.Duration
+	slot     time.Time
+	// hold returns a time no run may start before, such as the end of the
+	// panel's Retry-After. Nil means no hold.
+	hold func() time.Time
+	// wake, when set, ends a wait early, e.g. when the panel pushes a state.
+	wake <-chan struct{}
+}
+
+// newSchedule returns a schedule for interval with the configured spread,
+// held back while the panel throttles the agent.
+func (a *Agent) newSchedule(interval time.Duration) *schedule {
+	s := &schedule{interval: interval, slot: time.Now()}
+	if pct := a.cfg.Intervals.JitterPercent; pct > 0 {
+		s.spread = interval * time.Duration(min(pct, 50)) / 100
+	}
+	if a.ctrl != nil {
+		s.hold = a.ctrl.ThrottledUntil
+	}
+	return s
+}
+
+// wait blocks until the next run is due and reports false once ctx is done.
+// Slots missed while the previous run was still busy are skipped.
+func (s *schedule) wait(ctx context.Context) bool {
+	now := time.Now()
+	s.slot = s.slot.Add(s.interval)
+	for !s.slot.After(now) {
+		s.slot = s.slot.Add(s.interval)
+	}
+	at := s.slot
+	if s.spread > 0 {
+		at = at.Add(time.Duration((2*jitterFraction() - 1) * float64(s.spread)))
+	}
+	if s.hold != nil {
+		if until := s.hold(); until.After(at) {
+			// Spread the retries after the hold too, or every loop of every
+			// throttled agent returns at the same instant.
+			at = until.Add(time.Duration(jitterFraction() * float64(s.spread)))
+		}
+	}
+	if s.wake == nil {
+		return sleepContext(ctx, time.Until(at))
+	}
+	timer := time.NewTimer(time.Until(at))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+	case <-s.wake:
+	}
+	return true
+}
+
+// startupDelay picks a random delay in [0, startup_jitter_sec) for the first
+// run of every loop.
+func (a *Agent) startupDelay() time.Duration {
+	max := time.Duration(a.cfg.Intervals.StartupJitterSec) * time.Second
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(jitterFraction() * float64(max))
+}
+
+// sleepContext waits for d and reports false if ctx is done first.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
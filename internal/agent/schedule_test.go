@@ -0,0 +1,97 @@
+package agent
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestScheduleSpreadsRunsAroundSlot(t *testing.T) {
+	original := jitterFraction
+	t.Cleanup(func() { jitterFraction = original })
+
+	cfg := newTestConfig("127.0.0.1:0")
+	cfg.Intervals.JitterPercent = 50
+	a := &Agent{cfg: cfg}
+
+	for _, tc := range []struct {
+		fraction float64
+		want     time.Duration
+	}{
+		{fraction: 0, want: 50 * time.Millisecond},
+		{fraction: 0.5, want: 100 * time.Millisecond},
+		{fraction: 0.999, want: 150 * time.Millisecond},
+	} {
+		jitterFraction = func() float64 { return tc.fraction }
+		s := a.newSchedule(100 * time.Millisecond)
+		start := time.Now()
+		if !s.wait(context.Background()) {
+			t.Fatal("wait returned false without cancellation")
+		}
+		got := time.Since(start)
+		if got < tc.want-20*time.Millisecond || got > tc.want+40*time.Millisecond {
+			t.Fatalf("fraction %v: waited %v, want about %v", tc.fraction, got, tc.want)
+		}
+	}
+}
+
+func TestScheduleSkipsMissedSlots(t *testing.T) {
+	a := &Agent{cfg: newTestConfig("127.0.0.1:0")}
+	s := a.newSchedule(100 * time.Millisecond)
+	time.Sleep(230 * time.Millisecond)
+
+	start := time.Now()
+	if !s.wait(context.Background()) {
+		t.Fatal("wait returned false without cancellation")
+	}
+	// The slots at 100ms and 200ms were missed; the next one is at 300ms,
+	// not a full interval after the overrun.
+	if got := time.Since(start); got < 40*time.Millisecond || got > 95*time.Millisecond {
+		t.Fatalf("waited %v after overrunning, want about 70ms", got)
+	}
+}
+
+func TestStartupDelay(t *testing.T) {
+	original := jitterFraction
+	t.Cleanup(func() { jitterFraction = original })
+	jitterFraction = func() float64 { return 0.5 }
+
+	cfg := newTestConfig("127.0.0.1:0")
+	a := &Agent{cfg: cfg}
+	if got := a.startupDelay(); got != 0 {
+		t.Fatalf("startup delay without jitter = %v, want 0", got)
+	}
+	cfg.Intervals.StartupJitterSec = 30
+	if got := a.startupDelay(); got != 15*time.Second {
+		t.Fatalf("startup delay = %v, want 15s", got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if sleepContext(ctx, time.Hour) {
+		t.Fatal("sleepContext should stop on cancellation")
+	}
+}
+
+func TestScheduleWaitsOutThrottle(t *testing.T) {
+	a := &Agent{cfg: newTestConfig("127.0.0.1:0")}
+	s := a.newSchedule(50 * time.Millisecond)
+	until := time.Now().Add(200 * time.Millisecond)
+	s.hold = func() time.Time { return until }
+
+	start := time.Now()
+	if !s.wait(context.Background()) {
+		t.Fatal("wait returned false without cancellation")
+	}
+	if got := time.Since(start); got < 190*time.Millisecond || got > 260*time.Millisecond {
+		t.Fatalf("waited %v, want about 200ms while throttled", got)
+	}
+	// Once the hold has passed the loop returns to its slots.
+	start = time.Now()
+	if !s.wait(context.Background()) {
+		t.Fatal("wait returned false without cancellation")
+	}
+	if got := time.Since(start); got > 60*time.Millisecond {
+		t.Fatalf("waited %v after the hold, want at most one interval", got)
+	}
+}
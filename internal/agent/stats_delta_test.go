@@ -1,32 +1,64 @@
 package agent
 
-import "testing"
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
 
-func TestNormalizeStatsDeltas(t *testing.T) {
+	"github.com/najahiiii/xray-agent/internal/config"
+	"github.com/najahiiii/xray-agent/internal/control"
+	"github.com/najahiiii/xray-agent/internal/model"
+	"github.com/najahiiii/xray-agent/internal/stats"
+	"github.com/najahiiii/xray-agent/testsupport"
+
+	statscommand "github.com/xtls/xray-core/app/stats/command"
+)
+
+func TestPendingUsageAgainstReportedCounters(t *testing.T) {
 	a := &Agent{
+		cfg:           &config.Config{},
 		statsSnapshot: map[string][2]int64{},
 	}
+	report := func(counters map[string][2]int64) map[string][2]int64 {
+		pending := a.pendingUsage(counters)
+		a.commitUsage(context.Background(), nil, counters)
+		return pending
+	}
 
-	first := a.normalizeStatsDeltas(map[string][2]int64{
+	first := report(map[string][2]int64{
 		"User@Example.com": {100, 200},
 	})
 	if got := first["User@Example.com"]; got != [2]int64{0, 0} {
 		t.Fatalf("first sample should be warmup delta 0, got %+v", got)
 	}
 
-	second := a.normalizeStatsDeltas(map[string][2]int64{
+	second := report(map[string][2]int64{
 		"user@example.com": {150, 260},
 	})
 	if got := second["user@example.com"]; got != [2]int64{50, 60} {
 		t.Fatalf("second sample should be incremental delta, got %+v", got)
 	}
 
-	afterReset := a.normalizeStatsDeltas(map[string][2]int64{
+	afterReset := report(map[string][2]int64{
 		"user@example.com": {20, 5},
 	})
 	if got := afterReset["user@example.com"]; got != [2]int64{20, 5} {
 		t.Fatalf("counter reset should use current absolute value, got %+v", got)
 	}
+
+	// Usage that was not committed is reported again.
+	if got := a.pendingUsage(map[string][2]int64{"user@example.com": {30, 9}})["user@example.com"]; got != [2]int64{10, 4} {
+		t.Fatalf("uncommitted delta = %+v", got)
+	}
+	if got := a.pendingUsage(map[string][2]int64{"user@example.com": {45, 9}})["user@example.com"]; got != [2]int64{25, 4} {
+		t.Fatalf("delta after failed push = %+v", got)
+	}
 }
 
 func TestUsageCounterDelta(t *testing.T) {
@@ -51,3 +83,309 @@ func TestUsageCounterDelta(t *testing.T) {
 		})
 	}
 }
+
+func TestStatsCountersSurviveRestart(t *testing.T) {
+	cfg := newTestConfig("127.0.0.1:10085")
+	cfg.Storage.Dir = t.TempDir()
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	first := New(cfg, log, nil, nil, nil, nil)
+	first.restoreStatsCounters()
+	first.commitUsage(context.Background(), nil, map[string][2]int64{"user@example.com": {100, 200}})
+	if push := first.newStatsPush(nil); push.Sequence != 1 || push.Restart == nil {
+		t.Fatalf("unexpected first push: %+v", push)
+	}
+	first.saveStatsCounters()
+
+	second := New(cfg, log, nil, nil, nil, nil)
+	second.restoreStatsCounters()
+
+	deltas := second.pendingUsage(map[string][2]int64{"user@example.com": {150, 260}})
+	if got := deltas["user@example.com"]; got != [2]int64{50, 60} {
+		t.Fatalf("expected delta against persisted counters, got %+v", got)
+	}
+
+	push := second.newStatsPush(nil)
+	if push.Sequence != 2 {
+		t.Fatalf("expected sequence to continue from persisted value, got %d", push.Sequence)
+	}
+	if push.Restart == nil || push.Restart.PreviousSequence != 1 || !push.Restart.CountersRestored || push.Restart.PreviousSavedAt == nil {
+		t.Fatalf("unexpected restart marker: %+v", push.Restart)
+	}
+}
+
+func TestPushStatsResetsCountersOnlyAfterPanelAccepts(t *testing.T) {
+	core := testsupport.NewCore(t)
+	core.SetUserTraffic("user@example.com", 100, 200)
+	cfg := newTestConfig(core.Addr)
+	cfg.Xray.StatsResetEachPush = true
+
+	var (
+		fail   = true
+		pushes []model.UserUsage
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		var push model.StatsPush
+		if err := json.NewDecoder(r.Body).Decode(&push); err != nil {
+			t.Fatalf("decode push: %v", err)
+		}
+		pushes = append(pushes, push.Users...)
+		// Traffic counted after the agent's query but before its reset.
+		core.AddUserTraffic("user@example.com", 7, 3)
+	}))
+	defer srv.Close()
+	cfg.Control.BaseURL = config.URLList{srv.URL}
+
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	a := New(cfg, log, control.NewClient(cfg, log, "v-test", "v25.10.15"), nil, stats.New(cfg, log), nil)
+	a.state.Update(1, []model.Client{{Proto: "vless", ID: "1", Email: "user@example.com"}}, nil)
+	ctx := context.Background()
+
+	if err := a.pushStatsOnce(ctx); err == nil {
+		t.Fatal("expected push failure")
+	}
+	if got := core.Counter("user>>>user@example.com>>>traffic>>>uplink"); got != 100 {
+		t.Fatalf("counter reset before the panel accepted the push: %d", got)
+	}
+
+	fail = false
+	core.AddUserTraffic("user@example.com", 10, 20)
+	if err := a.pushStatsOnce(ctx); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	if err := a.pushStatsOnce(ctx); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	if len(pushes) != 2 || pushes[0].Uplink != 110 || pushes[0].Downlink != 220 || pushes[1].Uplink != 7 || pushes[1].Downlink != 3 {
+		t.Fatalf("pushes = %+v", pushes)
+	}
+}
+
+func TestPushStatsOmitsIdleUsersBetweenCheckpoints(t *testing.T) {
+	core := testsupport.NewCore(t)
+	core.SetUserTraffic("a@example.com", 100, 200)
+	core.SetUserTraffic("b@example.com", 0, 0)
+	cfg := newTestConfig(core.Addr)
+	cfg.Xray.StatsResetEachPush = true
+	cfg.Xray.StatsCheckpointSec = 3600
+
+	var pushes []model.StatsPush
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var push model.StatsPush
+		if err := json.NewDecoder(r.Body).Decode(&push); err != nil {
+			t.Fatalf("decode push: %v", err)
+		}
+		pushes = append(pushes, push)
+	}))
+	defer srv.Close()
+	cfg.Control.BaseURL = config.URLList{srv.URL}
+
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	a := New(cfg, log, control.NewClient(cfg, log, "v-test", "v25.10.15"), nil, stats.New(cfg, log), nil)
+	a.state.Update(1, []model.Client{
+		{Proto: "vless", ID: "1", Email: "a@example.com"},
+		{Proto: "vless", ID: "2", Email: "b@example.com"},
+	}, nil)
+	ctx := context.Background()
+
+	for _, up := range []int64{0, 5} {
+		core.AddUserTraffic("a@example.com", up, 0)
+		if err := a.pushStatsOnce(ctx); err != nil {
+			t.Fatalf("push: %v", err)
+		}
+	}
+	a.statsCheckpointAt = a.statsCheckpointAt.Add(-2 * time.Hour)
+	if err := a.pushStatsOnce(ctx); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+
+	if len(pushes) != 3 {
+		t.Fatalf("got %d pushes, want 3", len(pushes))
+	}
+	first, second, third := pushes[0], pushes[1], pushes[2]
+	if !first.Checkpoint || len(first.Users) != 2 || first.Users[0].TotalUplink == nil || *first.Users[0].TotalUplink != 100 {
+		t.Fatalf("first push = %+v; want a checkpoint with both users", first)
+	}
+	if second.Checkpoint || len(second.Users) != 1 || second.Users[0].Email != "a@example.com" || second.Users[0].Uplink != 5 || second.Users[0].TotalUplink != nil {
+		t.Fatalf("second push = %+v; want only a@example.com's delta", second)
+	}
+	if !third.Checkpoint || len(third.Users) != 2 || *third.Users[0].TotalUplink != 105 || *third.Users[1].TotalDownlink != 0 {
+		t.Fatalf("third push = %+v; want a checkpoint with totals 105 and 0", third)
+	}
+}
+
+func TestPushStatsCountsAllUsageAfterCoreRestart(t *testing.T) {
+	core := testsupport.NewCore(t)
+	core.SetUserTraffic("a@example.com", 100, 200)
+	core.SetUserTraffic("b@example.com", 50, 50)
+	core.SetSysStats(&statscommand.SysStatsResponse{Uptime: 600})
+	cfg := newTestConfig(core.Addr)
+
+	var pushes []model.StatsPush
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var push model.StatsPush
+		if err := json.NewDecoder(r.Body).Decode(&push); err != nil {
+			t.Fatalf("decode push: %v", err)
+		}
+		pushes = append(pushes, push)
+	}))
+	defer srv.Close()
+	cfg.Control.BaseURL = config.URLList{srv.URL}
+
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	a := New(cfg, log, control.NewClient(cfg, log, "v-test", "v25.10.15"), nil, stats.New(cfg, log), nil)
+	a.state.Update(1, []model.Client{
+		{Proto: "vless", ID: "1", Email: "a@example.com"},
+		{Proto: "vless", ID: "2", Email: "b@example.com"},
+	}, nil)
+	ctx := context.Background()
+	if err := a.pushStatsOnce(ctx); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+
+	// xray restarted: a@ has already counted past its old uplink, b@ only
+	// went backwards in one direction.
+	core.SetUserTraffic("a@example.com", 150, 20)
+	core.SetUserTraffic("b@example.com", 70, 10)
+	core.SetSysStats(&statscommand.SysStatsResponse{Uptime: 30})
+	if err := a.pushStatsOnce(ctx); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+
+	last := pushes[len(pushes)-1]
+	if !last.CounterReset {
+		t.Fatalf("push after restart = %+v; want counter_reset", last)
+	}
+	got := map[string][2]int64{}
+	for _, u := range last.Users {
+		got[u.Email] = [2]int64{u.Uplink, u.Downlink}
+	}
+	if got["a@example.com"] != [2]int64{150, 20} || got["b@example.com"] != [2]int64{70, 10} {
+		t.Fatalf("usage after restart = %v; want the full counters", got)
+	}
+
+	core.AddUserTraffic("a@example.com", 5, 5)
+	core.SetSysStats(&statscommand.SysStatsResponse{Uptime: 90})
+	if err := a.pushStatsOnce(ctx); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	if last := pushes[len(pushes)-1]; last.CounterReset || len(last.Users) != 1 || last.Users[0].Uplink != 5 {
+		t.Fatalf("push after recovery = %+v; want a plain 5-byte delta", last)
+	}
+}
+
+func TestPushStatsReplaysUnconfirmedPushAfterCrash(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		reset bool // the crashed agent got as far as resetting the counters
+	}{
+		{name: "before reset"},
+		{name: "after reset", reset: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			core := testsupport.NewCore(t)
+			core.SetUserTraffic("user@example.com", 100, 200)
+			cfg := newTestConfig(core.Addr)
+			cfg.Xray.StatsResetEachPush = true
+			cfg.Storage.Dir = t.TempDir()
+
+			var pushes []model.StatsPush
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var push model.StatsPush
+				if err := json.NewDecoder(r.Body).Decode(&push); err != nil {
+					t.Fatalf("decode push: %v", err)
+				}
+				pushes = append(pushes, push)
+			}))
+			defer srv.Close()
+			cfg.Control.BaseURL = config.URLList{srv.URL}
+
+			log := slog.New(slog.NewTextHandler(io.Discard, nil))
+			clients := []model.Client{{Proto: "vless", ID: "1", Email: "user@example.com"}}
+			ctx := context.Background()
+
+			// The first agent's push reaches the panel, then it dies without
+			// saving: either before the reset or right after it.
+			crashed := New(cfg, log, control.NewClient(cfg, log, "v-test", "v25.10.15"), nil, stats.New(cfg, log), nil)
+			crashed.state.Update(1, clients, nil)
+			payload, commit, err := crashed.collectStats(ctx)
+			if err != nil || payload == nil {
+				t.Fatalf("collectStats = %+v, %v", payload, err)
+			}
+			if err := crashed.ctrl.PostStats(ctx, payload); err != nil {
+				t.Fatalf("post: %v", err)
+			}
+			if tc.reset {
+				commit()
+			}
+			core.AddUserTraffic("user@example.com", 5, 6)
+
+			a := New(cfg, log, control.NewClient(cfg, log, "v-test", "v25.10.15"), nil, stats.New(cfg, log), nil)
+			a.state.Update(1, clients, nil)
+			a.restoreStatsCounters()
+			if err := a.pushStatsOnce(ctx); err != nil {
+				t.Fatalf("replay: %v", err)
+			}
+			core.AddUserTraffic("user@example.com", 1, 1)
+			if err := a.pushStatsOnce(ctx); err != nil {
+				t.Fatalf("push: %v", err)
+			}
+
+			if len(pushes) != 3 {
+				t.Fatalf("pushes = %+v", pushes)
+			}
+			replay := pushes[1]
+			if !replay.Replayed || replay.Sequence != pushes[0].Sequence || replay.Users[0].Uplink != 100 || replay.Users[0].Downlink != 200 {
+				t.Fatalf("replayed push = %+v, want a copy of %+v", replay, pushes[0])
+			}
+			next := pushes[2]
+			if next.Replayed || next.Sequence != replay.Sequence+1 {
+				t.Fatalf("push after replay = %+v", next)
+			}
+			if got := next.Users[0]; got.Uplink != 6 || got.Downlink != 7 {
+				t.Fatalf("usage after replay = %d/%d, want 6/7", got.Uplink, got.Downlink)
+			}
+		})
+	}
+}
+
+func TestPushStatsListsOnlineIPs(t *testing.T) {
+	core := testsupport.NewCore(t)
+	core.SetUserTraffic("a@example.com", 100, 200)
+	core.SetUserTraffic("b@example.com", 10, 20)
+	core.SetOnlineIPs("a@example.com", map[string]int64{"203.0.113.5": 1762484400, "2001:db8::7": 1762484401})
+	cfg := newTestConfig(core.Addr)
+	cfg.Xray.StatsResetEachPush = true
+
+	var push model.StatsPush
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&push); err != nil {
+			t.Fatalf("decode push: %v", err)
+		}
+	}))
+	defer srv.Close()
+	cfg.Control.BaseURL = config.URLList{srv.URL}
+
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	a := New(cfg, log, control.NewClient(cfg, log, "v-test", "v25.10.15"), nil, stats.New(cfg, log), nil)
+	a.state.Update(1, []model.Client{
+		{Proto: "vless", ID: "1", Email: "a@example.com"},
+		{Proto: "vless", ID: "2", Email: "b@example.com"},
+	}, nil)
+	if err := a.pushStatsOnce(context.Background()); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	if len(push.Users) != 2 {
+		t.Fatalf("users = %+v", push.Users)
+	}
+	if got := push.Users[0].IPs; !slices.Equal(got, []string{"2001:db8::7", "203.0.113.5"}) {
+		t.Fatalf("a@example.com ips = %v", got)
+	}
+	if got := push.Users[1].IPs; got != nil {
+		t.Fatalf("offline b@example.com ips = %v", got)
+	}
+}
@@ -0,0 +1,160 @@
+package agent
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/najahiiii/xray-agent/internal/model"
+	"github.com/najahiiii/xray-agent/internal/xray"
+)
+
+// minThroughputSample is the shortest window a new throughput sample is taken
+// over; status requests arriving faster get the previous sample.
+const minThroughputSample = time.Second
+
+// throughputSampler turns cumulative user counters into rates by comparing
+// each sample with the previous one.
+type throughputSampler struct {
+	mu     sync.Mutex
+	at     time.Time
+	last   map[string][2]int64
+	window time.Duration
+	rates  []model.UserThroughput
+}
+
+// AdminStatus reports health, user counts and per-user throughput for the
+// local admin API. Throughput is empty on the first call.
+func (a *Agent) AdminStatus(ctx context.Context) (*model.AdminStatus, error) {
+	if a.health == nil {
+		return nil, fmt.Errorf("agent not started")
+	}
+	st := &model.AdminStatus{NodeStatus: a.healthStatus()}
+	emails := a.state.Emails()
+	st.Users = len(emails)
+	if a.stats == nil || len(emails) == 0 {
+		return st, nil
+	}
+
+	rates, window, err := a.sampleThroughput(ctx, emails)
+	if err != nil {
+		return nil, err
+	}
+	st.SampleSec = window.Seconds()
+	st.Throughput = rates
+	for _, r := range rates {
+		if r.UplinkBytesSec > 0 || r.DownlinkBytesSec > 0 {
+			st.ActiveUsers++
+		}
+	}
+	return st, nil
+}
+
+// sampleThroughput queries the counters without resetting them. A counter
+// that went down, because it was reset after a push, counts from zero.
+func (a *Agent) sampleThroughput(ctx context.Context, emails []string) ([]model.UserThroughput, time.Duration, error) {
+	s := &a.throughput
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if !s.at.IsZero() && now.Sub(s.at) < minThroughputSample {
+		return s.rates, s.window, nil
+	}
+	counters, err := a.stats.QueryUserBytes(ctx, emails)
+	if err != nil {
+		return nil, 0, fmt.Errorf("stats query: %w", err)
+	}
+
+	var rates []model.UserThroughput
+	window := now.Sub(s.at)
+	if !s.at.IsZero() {
+		for email, usage := range counters {
+			prev, ok := s.last[email]
+			if !ok {
+				continue
+			}
+			rates = append(rates, model.UserThroughput{
+				Email:            strings.ToLower(email),
+				UplinkBytesSec:   int64(float64(usageCounterDelta(prev[0], usage[0])) / window.Seconds()),
+				DownlinkBytesSec: int64(float64(usageCounterDelta(prev[1], usage[1])) / window.Seconds()),
+			})
+		}
+		slices.SortFunc(rates, func(x, y model.UserThroughput) int {
+			return cmp.Or(
+				cmp.Compare(y.UplinkBytesSec+y.DownlinkBytesSec, x.UplinkBytesSec+x.DownlinkBytesSec),
+				strings.Compare(x.Email, y.Email),
+			)
+		})
+	} else {
+		window = 0
+	}
+	s.at, s.last, s.rates, s.window = now, counters, rates, window
+	return rates, window, nil
+}
+
+// AdminClients lists the applied clients by email, without credentials.
+// Clients without an inbound of their own show the one of their proto.
+func (a *Agent) AdminClients(context.Context) ([]model.AdminClient, error) {
+	snapshot := a.state.ClientsSnapshot()
+	tags := a.inboundTags(nil)
+	clients := make([]model.AdminClient, 0, len(snapshot))
+	for email, c := range snapshot {
+		clients = append(clients, model.AdminClient{
+			Email:      email,
+			Proto:      c.Proto,
+			InboundTag: cmp.Or(c.InboundTag, tags[c.Proto]),
+			Flow:       c.Flow,
+			Level:      c.Level,
+		})
+	}
+	slices.SortFunc(clients, func(x, y model.AdminClient) int { return strings.Compare(x.Email, y.Email) })
+	return clients, nil
+}
+
+// AdminRoutes lists the applied route rules by tag.
+func (a *Agent) AdminRoutes(context.Context) ([]model.RouteRule, error) {
+	snapshot := a.state.RoutesSnapshot()
+	routes := make([]model.RouteRule, 0, len(snapshot))
+	for _, r := range snapshot {
+		routes = append(routes, r)
+	}
+	slices.SortFunc(routes, func(x, y model.RouteRule) int { return strings.Compare(x.Tag, y.Tag) })
+	return routes, nil
+}
+
+// AdminRouteReport compares the applied route rules with the rules the
+// running core holds, like the routes command does for the panel state.
+// Every rule is unverified when the core cannot list its rules.
+func (a *Agent) AdminRouteReport(ctx context.Context) ([]xray.RuleReport, error) {
+	managed, err := a.AdminRoutes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var core []xray.CoreRule
+	if lister, ok := a.xray.(RuntimeLister); ok {
+		core, err = lister.ListRules(ctx)
+		if err != nil && !errors.Is(err, xray.ErrListRulesUnsupported) {
+			return nil, err
+		}
+	}
+	return xray.CompareRules(managed, core), nil
+}
+
+// SyncNow fetches and applies the state outside the state loop's schedule,
+// for POST /v1/sync.
+func (a *Agent) SyncNow(ctx context.Context) (*model.AdminSyncResult, error) {
+	if err := a.track(subsystemState, a.syncStateOnce(ctx)); err != nil {
+		return nil, err
+	}
+	return &model.AdminSyncResult{
+		ConfigVersion: a.state.Version(),
+		Clients:       len(a.state.Emails()),
+		Routes:        len(a.state.RoutesSnapshot()),
+	}, nil
+}
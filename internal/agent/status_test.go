@@ -0,0 +1,85 @@
+package agent
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"maps"
+	"testing"
+	"time"
+
+	"github.com/najahiiii/xray-agent/internal/model"
+	"github.com/najahiiii/xray-agent/internal/stats"
+	"github.com/najahiiii/xray-agent/internal/xray"
+	"github.com/najahiiii/xray-agent/testsupport"
+)
+
+func TestAdminStatusReportsThroughput(t *testing.T) {
+	core := testsupport.NewCore(t)
+	core.SetUserTraffic("busy@example.com", 1000, 1000)
+	core.SetUserTraffic("idle@example.com", 50, 50)
+	cfg := newTestConfig(core.Addr)
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	a := New(cfg, log, nil, nil, stats.New(cfg, log), nil)
+	a.state.Update(1, []model.Client{
+		{Proto: "vless", ID: "1", Email: "busy@example.com"},
+		{Proto: "vless", ID: "2", Email: "idle@example.com"},
+	}, nil)
+	ctx := context.Background()
+
+	st, err := a.AdminStatus(ctx)
+	if err != nil || st.Users != 2 || st.SampleSec != 0 || len(st.Throughput) != 0 {
+		t.Fatalf("first sample = %+v, %v", st, err)
+	}
+
+	// Pretend the first sample was taken two seconds ago.
+	a.throughput.at = a.throughput.at.Add(-2 * time.Second)
+	core.AddUserTraffic("busy@example.com", 4000, 8000)
+	st, err = a.AdminStatus(ctx)
+	if err != nil {
+		t.Fatalf("AdminStatus: %v", err)
+	}
+	if st.ActiveUsers != 1 || len(st.Throughput) != 2 || st.Throughput[0].Email != "busy@example.com" {
+		t.Fatalf("status = %+v", st)
+	}
+	if busy := st.Throughput[0]; busy.UplinkBytesSec < 1900 || busy.UplinkBytesSec > 2000 || busy.DownlinkBytesSec < 3800 {
+		t.Fatalf("busy = %+v over %.2fs", busy, st.SampleSec)
+	}
+
+	// Requests within a second reuse the sample.
+	again, err := a.AdminStatus(ctx)
+	if err != nil || again.SampleSec != st.SampleSec {
+		t.Fatalf("repeat = %+v, %v", again, err)
+	}
+}
+
+func TestAdminRouteReportComparesWithCore(t *testing.T) {
+	core := testsupport.NewCore(t)
+	cfg := newTestConfig(core.Addr)
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	manager := xray.NewManager(cfg, log)
+	a := New(cfg, log, nil, manager, nil, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	applied := []model.RouteRule{{Tag: "block-ads", OutboundTag: "blocked", Domain: []string{"domain:ads.example.com"}}}
+	if _, _, err := manager.State(ctx, nil, nil, nil, applied); err != nil {
+		t.Fatalf("State: %v", err)
+	}
+	lost := model.RouteRule{Tag: "cn", OutboundTag: "direct", Domain: []string{"geosite:cn"}}
+	a.state.Update(1, nil, append(applied, lost))
+	core.SeedRule("hand-made", "direct")
+
+	reports, err := a.AdminRouteReport(ctx)
+	if err != nil {
+		t.Fatalf("AdminRouteReport: %v", err)
+	}
+	got := map[string]string{}
+	for _, r := range reports {
+		got[r.Tag] = r.Status
+	}
+	want := map[string]string{"block-ads": xray.RuleInSync, "cn": xray.RuleMissing, "hand-made": xray.RuleUnmanaged}
+	if !maps.Equal(got, want) {
+		t.Fatalf("statuses = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,55 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/najahiiii/xray-agent/internal/config"
+	"github.com/najahiiii/xray-agent/internal/control"
+)
+
+// Reconnect delays of the state stream; overridden in tests. The delay
+// doubles after each failure and starts over once a stream stayed up for
+// streamRetryMax.
+var (
+	streamRetryMin = 5 * time.Second
+	streamRetryMax = 5 * time.Minute
+)
+
+// runStateStream keeps the panel's state stream open with
+// control.state_stream, so the state loop fetches a changed state as soon as
+// the panel announces it. Polling continues underneath, so a stream that is
+// down only costs latency.
+func (a *Agent) runStateStream(ctx context.Context) {
+	if a.ctrl == nil || !a.cfg.Control.StateStream || a.cfg.Control.Transport == config.TransportMQTT {
+		return
+	}
+	delay := streamRetryMin
+	for {
+		started := time.Now()
+		err := a.ctrl.StreamState(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if errors.Is(err, control.ErrStreamUnsupported) {
+			a.log.Info("panel has no state stream; polling only", "interval_sec", a.cfg.Intervals.StateSec)
+			return
+		}
+		if time.Since(started) >= streamRetryMax {
+			delay = streamRetryMin
+		}
+		if errors.Is(err, control.ErrStreamRejected) {
+			// A token the panel rejects will not be accepted on the next
+			// try either; wait for a rotation or a maintenance token.
+			delay = streamRetryMax
+			a.log.Warn("panel rejected the state stream; polling until it is retried", "err", err, "delay", delay)
+		} else {
+			a.log.Debug("state stream ended; reconnecting", "err", err, "delay", delay)
+		}
+		if !sleepContext(ctx, max(delay, time.Until(a.ctrl.ThrottledUntil()))) {
+			return
+		}
+		delay = min(delay*2, streamRetryMax)
+	}
+}
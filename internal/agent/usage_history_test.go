@@ -0,0 +1,88 @@
+package agent
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/najahiiii/xray-agent/internal/config"
+	"github.com/najahiiii/xray-agent/internal/control"
+	"github.com/najahiiii/xray-agent/internal/model"
+	"github.com/najahiiii/xray-agent/internal/stats"
+	"github.com/najahiiii/xray-agent/internal/usage"
+	"github.com/najahiiii/xray-agent/testsupport"
+)
+
+func TestUsageHistoryRecordsUndeliveredUsageOnce(t *testing.T) {
+	core := testsupport.NewCore(t)
+	core.SetUserTraffic("User@example.com", 100, 200)
+	cfg := newTestConfig(core.Addr)
+	cfg.Xray.StatsResetEachPush = true
+	cfg.Storage.Dir = t.TempDir()
+	cfg.UsageHistory.Enabled = true
+	cfg.UsageHistory.Dir = t.TempDir()
+	cfg.UsageHistory.RetentionDays = 30
+
+	fail := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer srv.Close()
+	cfg.Control.BaseURL = config.URLList{srv.URL}
+
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	newAgent := func() *Agent {
+		a := New(cfg, log, control.NewClient(cfg, log, "v-test", "v25.10.15"), nil, stats.New(cfg, log), nil)
+		a.state.Update(1, []model.Client{{Proto: "vless", ID: "1", Email: "User@example.com"}}, nil)
+		a.restoreStatsCounters()
+		return a
+	}
+	a := newAgent()
+	ctx := context.Background()
+
+	if err := a.pushStatsOnce(ctx); err == nil {
+		t.Fatal("expected push failure")
+	}
+	if err := a.pushStatsOnce(ctx); err == nil {
+		t.Fatal("expected push failure")
+	}
+	// The restarted agent replays the unconfirmed push without writing it
+	// again; what xray counted since is carried into the next push.
+	core.AddUserTraffic("User@example.com", 5, 6)
+	a = newAgent()
+	fail = false
+	if err := a.pushStatsOnce(ctx); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	core.AddUserTraffic("User@example.com", 1, 2)
+	if err := a.pushStatsOnce(ctx); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+
+	var got [][2]int64
+	h := usage.NewHistory(cfg.UsageHistory.Dir, 0)
+	if err := h.Read(time.Now().Add(-time.Hour), time.Now().Add(time.Hour), func(s usage.Sample) error {
+		if s.Email != "user@example.com" {
+			t.Errorf("email = %q", s.Email)
+		}
+		got = append(got, [2]int64{s.Uplink, s.Downlink})
+		return nil
+	}); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	want := [][2]int64{{100, 200}, {6, 8}}
+	if len(got) != len(want) {
+		t.Fatalf("samples = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("samples = %v, want %v", got, want)
+		}
+	}
+}
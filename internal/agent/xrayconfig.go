@@ -0,0 +1,238 @@
+package agent
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"maps"
+	"path/filepath"
+	"reflect"
+	"slices"
+
+	"github.com/najahiiii/xray-agent/internal/config"
+	"github.com/najahiiii/xray-agent/internal/model"
+	"github.com/najahiiii/xray-agent/internal/xrayconf"
+)
+
+// xrayConfigPath is the config file xray runs with: xray.install.config_path
+// when set, service.xray_config otherwise.
+func (a *Agent) xrayConfigPath() string {
+	if p := a.cfg.Xray.Install.ConfigPath; p != "" {
+		return p
+	}
+	return a.cfg.Service.XrayConfig
+}
+
+func (a *Agent) xrayBinary() string {
+	if dir := a.cfg.Xray.Install.BinDir; dir != "" {
+		return filepath.Join(dir, "xray")
+	}
+	return a.cfg.Service.XrayBinary
+}
+
+// renderData is what xray.render.template is executed with.
+type renderData struct {
+	// Vars are the state's render values.
+	Vars map[string]any
+	Meta map[string]any
+	// InboundTags are the effective inbound tags by proto, which the
+	// template's inbounds must use for users to be added to them.
+	InboundTags map[string]string
+}
+
+// applyXrayConfig writes the panel's sniffing and DNS settings and wireguard
+// peers into the xray config, since the API cannot change existing inbounds
+// or the resolver. With xray.render.template set the config is rendered from
+// scratch first. The file is tested and written once. It reports whether the
+// file changed and xray needs a restart. An empty sniffing map and a nil DNS
+// leave their parts of the config alone.
+func (a *Agent) applyXrayConfig(ctx context.Context, ds *model.State) (bool, error) {
+	if a.cfg.Backend == config.BackendSingBox {
+		return false, nil
+	}
+	peers := a.wireGuardPeers(ds)
+	if a.cfg.Xray.Render.Template != "" {
+		return a.renderXrayConfig(ctx, ds, peers)
+	}
+
+	sniffingDue := len(ds.Sniffing) > 0 && !maps.EqualFunc(ds.Sniffing, a.appliedSniffing, sniffingEqual)
+	dnsDue := ds.DNS != nil && !reflect.DeepEqual(ds.DNS, a.appliedDNS)
+	peersDue := len(peers) > 0 && !reflect.DeepEqual(peers, a.appliedPeers)
+	if !sniffingDue && !dnsDue && !peersDue {
+		return false, nil
+	}
+	if !peersDue {
+		peers = nil
+	}
+
+	file, err := xrayconf.Load(a.xrayConfigPath())
+	if err != nil {
+		return false, err
+	}
+	changedParts, err := setStateSections(file, ds, sniffingDue, dnsDue, peers)
+	if err != nil {
+		return false, err
+	}
+	if len(changedParts) > 0 {
+		if err := file.Apply(ctx, a.xrayBinary()); err != nil {
+			return false, err
+		}
+		a.log.Info("updated xray config", "parts", changedParts)
+	}
+	if sniffingDue {
+		a.appliedSniffing = maps.Clone(ds.Sniffing)
+	}
+	if dnsDue {
+		d := *ds.DNS
+		a.appliedDNS = &d
+	}
+	if peersDue {
+		a.notePeers(peers)
+	}
+	return len(changedParts) > 0, nil
+}
+
+// renderXrayConfig renders xray.render.template, applies sniffing, DNS and
+// wireguard peers on top and replaces the config when the result differs from
+// the file.
+func (a *Agent) renderXrayConfig(ctx context.Context, ds *model.State, peers map[string][]model.Client) (bool, error) {
+	data := renderData{
+		Vars:        ds.Render,
+		Meta:        ds.Meta,
+		InboundTags: a.inboundTags(ds.InboundTags),
+	}
+	file, err := xrayconf.Render(a.xrayConfigPath(), a.cfg.Xray.Render.Template, data)
+	if err != nil {
+		return false, fmt.Errorf("render xray config: %w", err)
+	}
+	if _, err := setStateSections(file, ds, len(ds.Sniffing) > 0, ds.DNS != nil, peers); err != nil {
+		return false, err
+	}
+	a.notePeers(peers)
+	changed, err := file.Changed()
+	if err != nil || !changed {
+		return false, err
+	}
+	if err := file.Apply(ctx, a.xrayBinary()); err != nil {
+		return false, err
+	}
+	a.log.Info("rendered xray config", "template", a.cfg.Xray.Render.Template, "path", a.xrayConfigPath())
+	return true, nil
+}
+
+// setStateSections applies the state's sniffing and DNS settings and the
+// wireguard peers by inbound tag to file and returns the parts that changed.
+func setStateSections(file *xrayconf.File, ds *model.State, sniffing, dns bool, peers map[string][]model.Client) ([]string, error) {
+	var changedParts []string
+	if sniffing {
+		for _, tag := range slices.Sorted(maps.Keys(ds.Sniffing)) {
+			changed, err := file.SetSniffing(tag, ds.Sniffing[tag])
+			if err != nil {
+				return nil, err
+			}
+			if changed {
+				changedParts = append(changedParts, "sniffing:"+tag)
+			}
+		}
+	}
+	if dns {
+		changed, err := file.SetDNS(*ds.DNS)
+		if err != nil {
+			return nil, fmt.Errorf("dns: %w", err)
+		}
+		if changed {
+			changedParts = append(changedParts, "dns")
+		}
+	}
+	for _, tag := range slices.Sorted(maps.Keys(peers)) {
+		changed, err := file.SetWireGuardPeers(tag, peers[tag])
+		if err != nil {
+			return nil, fmt.Errorf("wireguard peers: %w", err)
+		}
+		if changed {
+			changedParts = append(changedParts, "peers:"+tag)
+		}
+	}
+	return changedParts, nil
+}
+
+// inboundPorts reads the port of each inbound from the xray config so that
+// connections can be counted per inbound. It returns nil when the config
+// cannot be read.
+func (a *Agent) inboundPorts() map[string]int {
+	if a.cfg.Backend == config.BackendSingBox {
+		return nil
+	}
+	file, err := xrayconf.Load(a.xrayConfigPath())
+	if err != nil {
+		a.log.Debug("inbound ports not read", "err", err)
+		return nil
+	}
+	return file.InboundPorts()
+}
+
+// wireGuardPeers groups the state's wireguard clients by inbound tag, in
+// email order. The configured wireguard inbound and every inbound peers were
+// written to before are listed even without peers, so that removed peers are
+// dropped from the config. Clients without an inbound or with invalid keys
+// are logged and left out.
+func (a *Agent) wireGuardPeers(ds *model.State) map[string][]model.Client {
+	peers := map[string][]model.Client{}
+	if tag := a.cfg.Xray.InboundTags.WireGuard; tag != "" {
+		peers[tag] = []model.Client{}
+	}
+	for tag := range a.appliedPeers {
+		peers[tag] = []model.Client{}
+	}
+	for _, c := range model.WithInboundTags(ds.Clients, ds.InboundTags) {
+		if c.Proto != model.ProtoWireGuard {
+			continue
+		}
+		tag := cmp.Or(c.InboundTag, a.cfg.Xray.InboundTags.WireGuard)
+		if tag == "" {
+			a.log.Warn("wireguard peer skipped", "email", c.Email, "err", "no inbound tag for wireguard")
+			continue
+		}
+		if err := c.ValidatePeer(); err != nil {
+			a.log.Warn("wireguard peer skipped", "email", c.Email, "err", err)
+			continue
+		}
+		peers[tag] = append(peers[tag], c)
+	}
+	for _, list := range peers {
+		slices.SortFunc(list, func(x, y model.Client) int { return cmp.Compare(x.Email, y.Email) })
+	}
+	return peers
+}
+
+// notePeers records the peers written to the config. Inbounds other than
+// the configured one are forgotten once they have no peers left.
+func (a *Agent) notePeers(peers map[string][]model.Client) {
+	if peers == nil {
+		return
+	}
+	a.appliedPeers = maps.Clone(peers)
+	maps.DeleteFunc(a.appliedPeers, func(tag string, list []model.Client) bool {
+		return len(list) == 0 && tag != a.cfg.Xray.InboundTags.WireGuard
+	})
+}
+
+// inboundTags merges the state's per-proto overrides over xray.inbound_tags.
+func (a *Agent) inboundTags(overrides map[string]string) map[string]string {
+	tags := map[string]string{
+		"vless":  a.cfg.Xray.InboundTags.VLESS,
+		"vmess":  a.cfg.Xray.InboundTags.VMESS,
+		"trojan": a.cfg.Xray.InboundTags.TROJAN,
+	}
+	for proto, tag := range overrides {
+		if tag != "" {
+			tags[proto] = tag
+		}
+	}
+	return tags
+}
+
+func sniffingEqual(x, y model.Sniffing) bool {
+	return x.Enabled == y.Enabled && x.RouteOnly == y.RouteOnly && x.MetadataOnly == y.MetadataOnly &&
+		slices.Equal(x.DestOverride, y.DestOverride)
+}
@@ -0,0 +1,150 @@
+package agent
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/najahiiii/xray-agent/internal/config"
+	"github.com/najahiiii/xray-agent/internal/model"
+	"github.com/najahiiii/xray-agent/internal/xrayconf"
+)
+
+func TestApplyXrayConfigReportsOnlyRealChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{"inbounds":[{"tag":"vless-ws"}]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	origTester := xrayconf.Tester
+	xrayconf.Tester = func(context.Context, string, string) error { return nil }
+	t.Cleanup(func() { xrayconf.Tester = origTester })
+
+	cfg := &config.Config{}
+	cfg.Service.XrayConfig = path
+	a := &Agent{cfg: cfg, log: slog.New(slog.NewTextHandler(io.Discard, nil))}
+
+	desired := map[string]model.Sniffing{"vless-ws": {Enabled: true, DestOverride: []string{"http", "tls"}, RouteOnly: true}}
+	dns := &model.DNS{Servers: []model.DNSServer{{Address: "1.1.1.1"}}}
+	changed, err := a.applyXrayConfig(context.Background(), &model.State{Sniffing: desired, DNS: dns})
+	if err != nil || !changed {
+		t.Fatalf("first apply: changed=%v err=%v", changed, err)
+	}
+
+	// Same map again, and a fresh agent whose config already matches.
+	changed, err = a.applyXrayConfig(context.Background(), &model.State{Sniffing: desired, DNS: dns})
+	if err != nil || changed {
+		t.Fatalf("repeat apply: changed=%v err=%v", changed, err)
+	}
+	a.appliedSniffing, a.appliedDNS = nil, nil
+	changed, err = a.applyXrayConfig(context.Background(), &model.State{Sniffing: desired, DNS: dns})
+	if err != nil || changed {
+		t.Fatalf("matching config: changed=%v err=%v", changed, err)
+	}
+
+	// A DNS-only change rewrites the file without touching sniffing.
+	dns = &model.DNS{Servers: []model.DNSServer{{Address: "8.8.8.8"}}, QueryStrategy: "UseIPv4"}
+	changed, err = a.applyXrayConfig(context.Background(), &model.State{DNS: dns})
+	if err != nil || !changed {
+		t.Fatalf("dns change: changed=%v err=%v", changed, err)
+	}
+}
+
+func TestRenderXrayConfigRestartsOnlyOnChange(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.json")
+	tmpl := filepath.Join(dir, "config.json.tmpl")
+	err := os.WriteFile(tmpl, []byte(`{
+  "inbounds": [{"tag": "{{ .InboundTags.vless }}", "port": {{ .Vars.port }}, "streamSettings": {{ json .Vars.stream }}}],
+  "policy": {"levels": {"0": {"handshake": 4}}}
+}`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	origTester := xrayconf.Tester
+	xrayconf.Tester = func(context.Context, string, string) error { return nil }
+	t.Cleanup(func() { xrayconf.Tester = origTester })
+
+	cfg := &config.Config{}
+	cfg.Service.XrayConfig = path
+	cfg.Xray.InboundTags.VLESS = "vless-ws"
+	cfg.Xray.Render.Template = tmpl
+	a := &Agent{cfg: cfg, log: slog.New(slog.NewTextHandler(io.Discard, nil))}
+
+	ds := &model.State{
+		InboundTags: map[string]string{"vless": "vless-grpc"},
+		Render:      map[string]any{"port": 443, "stream": map[string]any{"network": "grpc"}},
+		Sniffing:    map[string]model.Sniffing{"vless-grpc": {Enabled: true, DestOverride: []string{"tls"}}},
+	}
+	if changed, err := a.applyXrayConfig(context.Background(), ds); err != nil || !changed {
+		t.Fatalf("first render: changed=%v err=%v", changed, err)
+	}
+	file, err := xrayconf.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in, err := file.Inbound("vless-grpc")
+	if err != nil || in["port"] != float64(443) || in["sniffing"] == nil {
+		t.Fatalf("rendered inbound = %v, %v", in, err)
+	}
+
+	if changed, err := a.applyXrayConfig(context.Background(), ds); err != nil || changed {
+		t.Fatalf("same state: changed=%v err=%v", changed, err)
+	}
+	ds.Render["port"] = 8443
+	if changed, err := a.applyXrayConfig(context.Background(), ds); err != nil || !changed {
+		t.Fatalf("new port: changed=%v err=%v", changed, err)
+	}
+	delete(ds.Render, "port")
+	if _, err := a.applyXrayConfig(context.Background(), ds); err == nil {
+		t.Fatal("rendered with a missing value")
+	}
+}
+
+func TestApplyXrayConfigWritesWireGuardPeers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	err := os.WriteFile(path, []byte(`{"inbounds":[{"tag":"wg","protocol":"wireguard","settings":{"secretKey":"SK","peers":[]}}]}`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	origTester := xrayconf.Tester
+	xrayconf.Tester = func(context.Context, string, string) error { return nil }
+	t.Cleanup(func() { xrayconf.Tester = origTester })
+
+	cfg := &config.Config{}
+	cfg.Service.XrayConfig = path
+	cfg.Xray.InboundTags.WireGuard = "wg"
+	a := &Agent{cfg: cfg, log: slog.New(slog.NewTextHandler(io.Discard, nil))}
+
+	key := "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="
+	ds := &model.State{Clients: []model.Client{
+		{Proto: "wireguard", Email: "b@wg", PublicKey: key, AllowedIPs: []string{"10.0.0.3/32"}},
+		{Proto: "wireguard", Email: "bad@wg", PublicKey: "short", AllowedIPs: []string{"10.0.0.4/32"}},
+		{Proto: "vless", ID: "1", Email: "v@x"},
+	}}
+	changed, err := a.applyXrayConfig(context.Background(), ds)
+	if err != nil || !changed {
+		t.Fatalf("first apply: changed=%v err=%v", changed, err)
+	}
+	file, err := xrayconf.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in, _ := file.Inbound("wg")
+	settings := in["settings"].(map[string]any)
+	if peers := settings["peers"].([]any); len(peers) != 1 || settings["secretKey"] != "SK" {
+		t.Fatalf("settings = %v", settings)
+	}
+
+	if changed, err := a.applyXrayConfig(context.Background(), ds); err != nil || changed {
+		t.Fatalf("repeat apply: changed=%v err=%v", changed, err)
+	}
+
+	// Dropping the last peer empties the inbound.
+	changed, err = a.applyXrayConfig(context.Background(), &model.State{})
+	if err != nil || !changed {
+		t.Fatalf("removal: changed=%v err=%v", changed, err)
+	}
+}
@@ -5,10 +5,12 @@ import (
 	_ "embed"
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"strings"
 
 	"github.com/najahiiii/xray-agent/internal/config"
+	"github.com/najahiiii/xray-agent/internal/initsys"
+	"github.com/najahiiii/xray-agent/internal/privsep"
 
 	"log/slog"
 
@@ -36,7 +38,13 @@ type Options struct {
 	Token       string
 	ServerSlug  string
 	TLSInsecure *bool
-	Logger      *slog.Logger
+	// Init overrides service.init from the config and is saved into it: auto,
+	// systemd, openrc, sysvinit or none.
+	Init string
+	// User runs the agent service as this account instead of root and is
+	// saved into service.user; "root" switches back. See prepareUser.
+	User   string
+	Logger *slog.Logger
 }
 
 func (o *Options) withDefaults() {
@@ -51,7 +59,8 @@ func (o *Options) withDefaults() {
 	}
 }
 
-// Install writes config (if absent) and installs/enables the systemd unit.
+// Install writes config (if absent) and installs/enables the agent service
+// for the configured init system.
 func Install(ctx context.Context, opts Options) error {
 	opts.withDefaults()
 	log := opts.Logger
@@ -64,18 +73,30 @@ func Install(ctx context.Context, opts Options) error {
 		return err
 	}
 
-	if log != nil {
-		log.Info("installing systemd unit", "path", opts.ServicePath)
+	kind, err := resolveInit(opts.Init, opts.ConfigPath)
+	if err != nil {
+		return err
 	}
-	if err := writeFile(opts.ServicePath, embeddedService, 0o644); err != nil {
-		return fmt.Errorf("write service: %w", err)
+	user := serviceUser(opts)
+	if user != "" {
+		if err := prepareUser(ctx, opts, kind, user); err != nil {
+			return err
+		}
 	}
-
-	if err := runCmd(ctx, "systemctl", "daemon-reload"); err != nil {
-		return fmt.Errorf("systemctl daemon-reload: %w", err)
+	if kind == initsys.None {
+		if log != nil {
+			log.Info("skipping agent service install; start it with `xray-agent run`")
+		}
+		return nil
 	}
-	if err := runCmd(ctx, "systemctl", "enable", "--now", "xray-agent"); err != nil {
-		return fmt.Errorf("systemctl enable --now xray-agent: %w", err)
+	svc := agentService(opts)
+	svc.User = user
+	svc.Directives = agentDirectives(opts.ConfigPath)
+	if log != nil {
+		log.Info("installing agent service", "init", kind, "path", initsys.Path(kind, svc))
+	}
+	if err := initsys.Install(ctx, kind, svc); err != nil {
+		return err
 	}
 	if log != nil {
 		log.Info("agent service installed and started")
@@ -83,10 +104,62 @@ func Install(ctx context.Context, opts Options) error {
 	return nil
 }
 
+func agentService(opts Options) initsys.Service {
+	return initsys.Service{
+		Name:        "xray-agent",
+		Description: "Xray Provisioning Agent",
+		Command:     opts.BinPath,
+		Args:        []string{"run", "--config", opts.ConfigPath},
+		After:       []string{"xray"},
+		StateDir:    config.DefaultStorageDir,
+		NoFile:      1048576,
+		SystemdUnit: embeddedService,
+		SystemdPath: opts.ServicePath,
+	}
+}
+
+// agentDirectives renders service.hardening from the config at path for the
+// agent unit. A read-only file system would stop the agent writing its own
+// paths, so with ProtectSystem= they stay writable through ReadWritePaths=;
+// the "-" prefix skips those that do not exist.
+func agentDirectives(path string) map[string]string {
+	cfg, err := config.Load(path)
+	if err != nil {
+		return nil
+	}
+	directives := cfg.Service.Hardening.Directives()
+	if p := cfg.Service.Hardening.ProtectSystem; p != "" && p != "false" {
+		var paths []string
+		for _, p := range privsep.Paths(cfg) {
+			paths = append(paths, "-"+p.Path)
+		}
+		directives["ReadWritePaths"] = strings.Join(paths, " ")
+	}
+	return directives
+}
+
+// resolveInit prefers an explicit override, then service.init from the config
+// at path, then auto-detection.
+func resolveInit(override string, path string) (initsys.Kind, error) {
+	if override == "" {
+		if cfg, err := config.Load(path); err == nil {
+			override = cfg.Service.Init
+		}
+	}
+	return initsys.Resolve(override)
+}
+
 func ensureConfig(opts Options) error {
 	log := opts.Logger
 	// If config exists, update GitHub token/control fields if provided
 	if _, err := os.Stat(opts.ConfigPath); err == nil {
+		if !config.IsYAML(opts.ConfigPath) {
+			// JSON and TOML configs are templated elsewhere and never rewritten.
+			if log != nil {
+				log.Warn("config is not YAML; leaving it unchanged", "path", opts.ConfigPath)
+			}
+			return nil
+		}
 		if err := updateConfigFields(opts); err != nil {
 			return err
 		}
@@ -98,6 +171,9 @@ func ensureConfig(opts Options) error {
 		return fmt.Errorf("check config: %w", err)
 	}
 
+	if err := requireYAML(opts.ConfigPath); err != nil {
+		return err
+	}
 	if log != nil {
 		log.Info("writing agent config", "path", opts.ConfigPath)
 	}
@@ -117,23 +193,43 @@ func updateConfigFields(opts Options) error {
 	if err != nil {
 		return fmt.Errorf("load existing config: %w", err)
 	}
+	if cfg.SOPS {
+		if opts.Logger != nil {
+			opts.Logger.Warn("config is sops-encrypted; leaving it unchanged", "path", opts.ConfigPath)
+		}
+		return nil
+	}
 	applyOptionalFields(cfg, opts)
-	out, err := yaml.Marshal(cfg)
+	out, err := yaml.Marshal(cfg.Sealed())
 	if err != nil {
 		return fmt.Errorf("marshal config: %w", err)
 	}
 	return writeFile(opts.ConfigPath, out, 0o600)
 }
 
+// splitURLs reads a comma-separated list of control URLs, as passed to
+// --control-base-url.
+func splitURLs(value string) config.URLList {
+	var urls config.URLList
+	for url := range strings.SplitSeq(value, ",") {
+		if url = strings.TrimSpace(url); url != "" {
+			urls = append(urls, url)
+		}
+	}
+	return urls
+}
+
 func applyOptionalFields(cfg *config.Config, opts Options) {
 	if opts.GitHubToken != "" {
 		cfg.GitHub.Token = opts.GitHubToken
+		cfg.GitHub.TokenFile = ""
 	}
 	if opts.BaseURL != "" {
-		cfg.Control.BaseURL = opts.BaseURL
+		cfg.Control.BaseURL = splitURLs(opts.BaseURL)
 	}
 	if opts.Token != "" {
 		cfg.Control.Token = opts.Token
+		cfg.Control.TokenFile = ""
 	}
 	if opts.ServerSlug != "" {
 		cfg.Control.ServerSlug = opts.ServerSlug
@@ -141,6 +237,15 @@ func applyOptionalFields(cfg *config.Config, opts Options) {
 	if opts.TLSInsecure != nil {
 		cfg.Control.TLSInsecure = *opts.TLSInsecure
 	}
+	if opts.Init != "" {
+		cfg.Service.Init = opts.Init
+	}
+	if opts.User != "" {
+		cfg.Service.User = opts.User
+		if opts.User == "root" {
+			cfg.Service.User = ""
+		}
+	}
 }
 
 func writeFile(path string, data []byte, perm os.FileMode) error {
@@ -150,13 +255,6 @@ func writeFile(path string, data []byte, perm os.FileMode) error {
 	return os.WriteFile(path, data, perm)
 }
 
-func runCmd(ctx context.Context, name string, args ...string) error {
-	cmd := exec.CommandContext(ctx, name, args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
-}
-
 func installBinary(opts Options) error {
 	src, err := os.Executable()
 	if err != nil {
@@ -175,6 +273,17 @@ func installBinary(opts Options) error {
 	return nil
 }
 
+// How UpdateControl makes a running agent pick up the new config.
+const (
+	// ApplyRestart restarts the agent service, dropping in-flight requests.
+	ApplyRestart = "restart"
+	// ApplyReload sends SIGHUP; the agent swaps in the new control URL,
+	// token and server slug without stopping its loops.
+	ApplyReload = "reload"
+	// ApplyNone only rewrites the config.
+	ApplyNone = "none"
+)
+
 type UpdateControlOptions struct {
 	ConfigPath  string
 	BaseURL     string
@@ -183,60 +292,181 @@ type UpdateControlOptions struct {
 	TLSInsecure *bool
 	GitHubToken string
 	Logger      *slog.Logger
-	Restart     bool
+	// Apply is ApplyRestart (default), ApplyReload or ApplyNone.
+	Apply string
 }
 
 // UpdateControl updates control.* fields in the agent config. Creates the config from the embedded sample if missing.
-func UpdateControl(ctx context.Context, opts UpdateControlOptions) error {
+// It returns the strategy actually used, which falls back to a restart when a
+// reload cannot apply the change and to none when no init system manages the agent.
+func UpdateControl(ctx context.Context, opts UpdateControlOptions) (string, error) {
 	path := opts.ConfigPath
 	if path == "" {
 		path = defaultConfigPath
 	}
 	log := opts.Logger
+	apply := opts.Apply
+	if apply == "" {
+		apply = ApplyRestart
+	}
+	if apply != ApplyRestart && apply != ApplyReload && apply != ApplyNone {
+		return "", fmt.Errorf("unsupported apply strategy %q (want restart, reload or none)", apply)
+	}
 
 	if opts.BaseURL == "" && opts.Token == "" && opts.ServerSlug == "" && opts.TLSInsecure == nil && opts.GitHubToken == "" {
-		return fmt.Errorf("no control fields provided for update")
+		return "", fmt.Errorf("no control fields provided for update")
+	}
+	if err := requireYAML(path); err != nil {
+		return "", err
 	}
 
 	cfg, err := loadConfig(path)
 	if err != nil {
-		return fmt.Errorf("load config: %w", err)
+		return "", fmt.Errorf("load config: %w", err)
+	}
+	if err := requirePlain(path, cfg); err != nil {
+		return "", err
 	}
 
 	if opts.BaseURL != "" {
-		cfg.Control.BaseURL = opts.BaseURL
+		cfg.Control.BaseURL = splitURLs(opts.BaseURL)
 	}
 	if opts.Token != "" {
 		cfg.Control.Token = opts.Token
+		cfg.Control.TokenFile = ""
 	}
 	if opts.ServerSlug != "" {
 		cfg.Control.ServerSlug = opts.ServerSlug
 	}
 	if opts.TLSInsecure != nil {
+		if apply == ApplyReload && cfg.Control.TLSInsecure != *opts.TLSInsecure {
+			// The HTTP transport is built once at startup.
+			apply = ApplyRestart
+		}
 		cfg.Control.TLSInsecure = *opts.TLSInsecure
 	}
 	if opts.GitHubToken != "" {
+		if apply == ApplyReload && cfg.GitHub.Token != opts.GitHubToken {
+			apply = ApplyRestart
+		}
 		cfg.GitHub.Token = opts.GitHubToken
+		cfg.GitHub.TokenFile = ""
 	}
 
-	out, err := yaml.Marshal(cfg)
+	out, err := yaml.Marshal(cfg.Sealed())
 	if err != nil {
-		return fmt.Errorf("marshal config: %w", err)
+		return "", fmt.Errorf("marshal config: %w", err)
 	}
 	if err := writeFile(path, out, 0o600); err != nil {
-		return fmt.Errorf("write config: %w", err)
+		return "", fmt.Errorf("write config: %w", err)
 	}
 	if log != nil {
 		log.Info("updated agent config control fields", "path", path)
 	}
-	if opts.Restart {
-		if err := runCmd(ctx, "systemctl", "restart", "xray-agent"); err != nil {
-			return fmt.Errorf("restart agent: %w", err)
+	if apply == ApplyNone {
+		return apply, nil
+	}
+
+	kind, err := initsys.Resolve(cfg.Service.Init)
+	if err != nil {
+		return "", err
+	}
+	if kind == initsys.None {
+		if log != nil {
+			log.Warn("no init system manages xray-agent; restart it (or its container) to apply the update")
+		}
+		return ApplyNone, nil
+	}
+	switch apply {
+	case ApplyReload:
+		if err := initsys.Reload(ctx, kind, "xray-agent"); err != nil {
+			return "", fmt.Errorf("reload agent: %w", err)
+		}
+		if log != nil {
+			log.Info("reloaded xray-agent service")
+		}
+	default:
+		if err := initsys.Restart(ctx, kind, "xray-agent"); err != nil {
+			return "", fmt.Errorf("restart agent: %w", err)
 		}
 		if log != nil {
 			log.Info("restarted xray-agent service")
 		}
 	}
+	return apply, nil
+}
+
+type UpdateXrayInstallOptions struct {
+	ConfigPath  string
+	BinDir      string
+	XrayConfig  string
+	ShareDir    string
+	ServicePath string
+	Logger      *slog.Logger
+}
+
+// UpdateXrayInstall points xray.install (and the binary and config the agent
+// launches when it supervises xray) at an existing install. Empty fields are
+// left unchanged.
+func UpdateXrayInstall(opts UpdateXrayInstallOptions) error {
+	path := opts.ConfigPath
+	if path == "" {
+		path = defaultConfigPath
+	}
+	if err := requireYAML(path); err != nil {
+		return err
+	}
+	cfg, err := loadConfig(path)
+	if err != nil {
+		return fmt.Errorf("load config: %w", err)
+	}
+	if err := requirePlain(path, cfg); err != nil {
+		return err
+	}
+
+	if opts.BinDir != "" {
+		cfg.Xray.Install.BinDir = opts.BinDir
+		cfg.Service.XrayBinary = filepath.Join(opts.BinDir, "xray")
+	}
+	if opts.XrayConfig != "" {
+		cfg.Xray.Install.ConfigPath = opts.XrayConfig
+		cfg.Service.XrayConfig = opts.XrayConfig
+	}
+	if opts.ShareDir != "" {
+		cfg.Xray.Install.ShareDir = opts.ShareDir
+	}
+	if opts.ServicePath != "" {
+		cfg.Xray.Install.ServicePath = opts.ServicePath
+	}
+
+	out, err := yaml.Marshal(cfg.Sealed())
+	if err != nil {
+		return fmt.Errorf("marshal config: %w", err)
+	}
+	if err := writeFile(path, out, 0o600); err != nil {
+		return fmt.Errorf("write config: %w", err)
+	}
+	if opts.Logger != nil {
+		opts.Logger.Info("updated agent config xray install paths", "path", path)
+	}
+	return nil
+}
+
+// requireYAML refuses to write path unless it is a YAML config; JSON and
+// TOML configs are only ever read.
+func requireYAML(path string) error {
+	if !config.IsYAML(path) {
+		return fmt.Errorf("%s is not a YAML config and cannot be rewritten; edit it directly", path)
+	}
+	return nil
+}
+
+// requirePlain refuses to write back a sops-encrypted config, which would
+// store its decrypted secrets in plain text.
+func requirePlain(path string, cfg *config.Config) error {
+	if cfg.SOPS {
+		return fmt.Errorf("%s is sops-encrypted and cannot be rewritten; edit it with sops", path)
+	}
 	return nil
 }
 
@@ -1,8 +1,10 @@
 package agentsetup
 
 import (
+	"context"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/najahiiii/xray-agent/internal/config"
@@ -25,7 +27,7 @@ func TestOptionsWithDefaults(t *testing.T) {
 
 func TestApplyOptionalFields(t *testing.T) {
 	cfg := &config.Config{}
-	cfg.Control.BaseURL = "https://old.example.com"
+	cfg.Control.BaseURL = config.URLList{"https://old.example.com"}
 	cfg.Control.Token = "old-token"
 	cfg.Control.ServerSlug = "old-slug"
 	cfg.Control.TLSInsecure = false
@@ -38,6 +40,7 @@ func TestApplyOptionalFields(t *testing.T) {
 		Token:       "new-token",
 		ServerSlug:  "new-slug",
 		TLSInsecure: &insecure,
+		Init:        "none",
 	}
 
 	applyOptionalFields(cfg, opts)
@@ -45,7 +48,7 @@ func TestApplyOptionalFields(t *testing.T) {
 	if cfg.GitHub.Token != "new-gh" {
 		t.Fatalf("GitHub.Token = %q, want %q", cfg.GitHub.Token, "new-gh")
 	}
-	if cfg.Control.BaseURL != "https://new.example.com" {
+	if cfg.Control.BaseURL.Primary() != "https://new.example.com" {
 		t.Fatalf("Control.BaseURL = %q, want %q", cfg.Control.BaseURL, "https://new.example.com")
 	}
 	if cfg.Control.Token != "new-token" {
@@ -57,11 +60,14 @@ func TestApplyOptionalFields(t *testing.T) {
 	if !cfg.Control.TLSInsecure {
 		t.Fatal("Control.TLSInsecure = false, want true")
 	}
+	if cfg.Service.Init != "none" {
+		t.Fatalf("Service.Init = %q, want %q", cfg.Service.Init, "none")
+	}
 }
 
 func TestApplyOptionalFieldsDoesNotOverrideEmptyValues(t *testing.T) {
 	cfg := &config.Config{}
-	cfg.Control.BaseURL = "https://existing.example.com"
+	cfg.Control.BaseURL = config.URLList{"https://existing.example.com"}
 	cfg.Control.Token = "existing-token"
 	cfg.Control.ServerSlug = "existing-slug"
 	cfg.Control.TLSInsecure = true
@@ -72,7 +78,7 @@ func TestApplyOptionalFieldsDoesNotOverrideEmptyValues(t *testing.T) {
 	if cfg.GitHub.Token != "existing-gh" {
 		t.Fatalf("GitHub.Token changed unexpectedly: %q", cfg.GitHub.Token)
 	}
-	if cfg.Control.BaseURL != "https://existing.example.com" {
+	if cfg.Control.BaseURL.Primary() != "https://existing.example.com" {
 		t.Fatalf("Control.BaseURL changed unexpectedly: %q", cfg.Control.BaseURL)
 	}
 	if cfg.Control.Token != "existing-token" {
@@ -121,10 +127,123 @@ func TestLoadConfigMissingFileUsesEmbeddedConfig(t *testing.T) {
 	if cfg == nil {
 		t.Fatal("loadConfig() returned nil config")
 	}
-	if cfg.Control.BaseURL == "" || cfg.Control.Token == "" || cfg.Control.ServerSlug == "" {
+	if len(cfg.Control.BaseURL) == 0 || cfg.Control.Token == "" || cfg.Control.ServerSlug == "" {
 		t.Fatalf("embedded control config not loaded: %+v", cfg.Control)
 	}
 	if cfg.Xray.APIServer == "" {
 		t.Fatal("embedded xray api_server not loaded")
 	}
 }
+
+func TestUpdateXrayInstallWritesPaths(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+
+	err := UpdateXrayInstall(UpdateXrayInstallOptions{
+		ConfigPath: path,
+		BinDir:     "/usr/local/xray",
+		XrayConfig: "/usr/local/xray/config.json",
+	})
+	if err != nil {
+		t.Fatalf("UpdateXrayInstall() error = %v", err)
+	}
+
+	cfg, err := config.Load(path)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if cfg.Xray.Install.BinDir != "/usr/local/xray" || cfg.Xray.Install.ConfigPath != "/usr/local/xray/config.json" {
+		t.Fatalf("install = %+v", cfg.Xray.Install)
+	}
+	if cfg.Service.XrayBinary != "/usr/local/xray/xray" || cfg.Service.XrayConfig != "/usr/local/xray/config.json" {
+		t.Fatalf("service = %q %q", cfg.Service.XrayBinary, cfg.Service.XrayConfig)
+	}
+	if cfg.Xray.Install.ShareDir != "" {
+		t.Fatalf("ShareDir = %q, want unchanged", cfg.Xray.Install.ShareDir)
+	}
+}
+
+func TestUpdateXrayInstallKeepsTokenFile(t *testing.T) {
+	dir := t.TempDir()
+	tokenFile := filepath.Join(dir, "token")
+	if err := os.WriteFile(tokenFile, []byte("s3cret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "config.yaml")
+	body := "control:\n  base_url: https://panel.example.com\n  token_file: " + tokenFile + "\n  server_slug: sg-1\nxray:\n  api_server: 127.0.0.1:10085\n  inbound_tags: {vless: vless, vmess: vmess, trojan: trojan}\n"
+	if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := UpdateXrayInstall(UpdateXrayInstallOptions{ConfigPath: path, BinDir: "/usr/local/xray"}); err != nil {
+		t.Fatalf("UpdateXrayInstall() error = %v", err)
+	}
+	out, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(out), "s3cret") {
+		t.Fatalf("rewritten config leaks the token:\n%s", out)
+	}
+	cfg, err := config.Load(path)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if cfg.Control.Token != "s3cret" || cfg.Control.TokenFile != tokenFile {
+		t.Fatalf("control token = %q from %q", cfg.Control.Token, cfg.Control.TokenFile)
+	}
+}
+
+func TestAgentDirectivesKeepsAgentPathsWritable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	cfg := `control:
+  base_url: https://panel.example.com
+  token: secret
+  server_slug: node-1
+xray:
+  api_server: 127.0.0.1:10085
+admin:
+  socket: none
+service:
+  init: none
+  hardening:
+    protect_system: strict
+    memory_max: 256M
+`
+	if err := os.WriteFile(path, []byte(cfg), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	got := agentDirectives(path)
+	if got["ProtectSystem"] != "strict" || got["MemoryMax"] != "256M" {
+		t.Fatalf("agentDirectives() = %v", got)
+	}
+	if rw := got["ReadWritePaths"]; !strings.Contains(rw, "-"+config.DefaultStorageDir) || !strings.Contains(rw, "-/etc/xray") {
+		t.Fatalf("ReadWritePaths = %q", rw)
+	}
+}
+
+func TestUpdateControlRefusesSOPSConfig(t *testing.T) {
+	orig := config.SOPSDecrypt
+	t.Cleanup(func() { config.SOPSDecrypt = orig })
+	config.SOPSDecrypt = func(string) ([]byte, error) {
+		return []byte("control:\n  base_url: https://panel.example.com\n  token: s3cret\n  server_slug: sg-1\nxray:\n  api_server: 127.0.0.1:10085\n  inbound_tags: {vless: vless, vmess: vmess, trojan: trojan}\n"), nil
+	}
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	body := "control:\n  token: ENC[AES256_GCM,data:xyz]\nsops:\n  version: 3.9.0\n"
+	if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := UpdateControl(context.Background(), UpdateControlOptions{ConfigPath: path, ServerSlug: "sg-2", Apply: ApplyNone})
+	if err == nil || !strings.Contains(err.Error(), "sops-encrypted") {
+		t.Fatalf("UpdateControl() error = %v, want a sops refusal", err)
+	}
+	if err := UpdateXrayInstall(UpdateXrayInstallOptions{ConfigPath: path, BinDir: "/usr/local/xray"}); err == nil {
+		t.Fatal("UpdateXrayInstall() rewrote a sops config")
+	}
+	if err := updateConfigFields(Options{ConfigPath: path, ServerSlug: "sg-2"}); err != nil {
+		t.Fatalf("updateConfigFields() error = %v", err)
+	}
+	if out, _ := os.ReadFile(path); string(out) != body {
+		t.Fatalf("sops config was rewritten:\n%s", out)
+	}
+}
@@ -0,0 +1,136 @@
+package agentsetup
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"github.com/najahiiii/xray-agent/internal/config"
+	"github.com/najahiiii/xray-agent/internal/initsys"
+	"github.com/najahiiii/xray-agent/internal/privsep"
+)
+
+// Hooks used by prepareUser; overridden in tests.
+var (
+	lookupUser = user.Lookup
+	lookPath   = exec.LookPath
+	runCommand = func(ctx context.Context, name string, args ...string) error {
+		cmd := exec.CommandContext(ctx, name, args...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		return cmd.Run()
+	}
+	polkitRulesPath = "/etc/polkit-1/rules.d/50-xray-agent.rules"
+)
+
+// polkitRule lets the service user manage the listed units, so an agent
+// without root can still restart xray and itself through systemctl.
+const polkitRule = `// Written by xray-agent setup --user. Lets the agent restart the services
+// it manages without running as root.
+polkit.addRule(function(action, subject) {
+	var units = [%s];
+	if (action.id == "org.freedesktop.systemd1.manage-units" &&
+	    subject.user == %q &&
+	    units.indexOf(action.lookup("unit")) >= 0) {
+		return polkit.Result.YES;
+	}
+});
+`
+
+// serviceUser returns the account the agent service runs as: opts.User, or
+// else service.user from the config. Root and empty both mean root and
+// return "".
+func serviceUser(opts Options) string {
+	name := opts.User
+	if name == "" {
+		if cfg, err := config.Load(opts.ConfigPath); err == nil {
+			name = cfg.Service.User
+		}
+	}
+	if name == "root" {
+		return ""
+	}
+	return name
+}
+
+// prepareUser makes name ready to run the agent: it is created as a system
+// user when missing, the agent's own paths are handed to it, the config and
+// secret files are made readable by its group and, under systemd, a polkit
+// rule lets it restart the services the agent manages.
+func prepareUser(ctx context.Context, opts Options, kind initsys.Kind, name string) error {
+	log := opts.Logger
+	cfg, err := config.Load(opts.ConfigPath)
+	if err != nil {
+		return fmt.Errorf("--user needs a complete config: %w", err)
+	}
+	u, err := ensureUser(ctx, name, cfg.Storage.Dir)
+	if err != nil {
+		return err
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return fmt.Errorf("user %s: uid %q: %w", name, u.Uid, err)
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return fmt.Errorf("user %s: gid %q: %w", name, u.Gid, err)
+	}
+
+	skipped, err := privsep.Prepare(privsep.Paths(cfg), uid, gid)
+	if err != nil {
+		return err
+	}
+	for _, p := range skipped {
+		if log != nil {
+			log.Warn("not handing a shared directory to the agent user; point the setting at a directory of its own", "setting", p.Setting, "path", p.Path)
+		}
+	}
+	for _, path := range append([]string{opts.ConfigPath}, cfg.SecretFiles()...) {
+		if err := os.Chown(path, -1, gid); err != nil {
+			return fmt.Errorf("chown %s: %w", path, err)
+		}
+		if err := os.Chmod(path, 0o640); err != nil {
+			return err
+		}
+	}
+
+	if kind == initsys.Systemd {
+		units := []string{`"xray.service"`, `"xray-agent.service"`}
+		if cfg.Backend == config.BackendSingBox {
+			units = append(units, strconv.Quote(cfg.SingBox.Service+".service"))
+		}
+		rule := fmt.Sprintf(polkitRule, strings.Join(units, ", "), name)
+		if err := writeFile(polkitRulesPath, []byte(rule), 0o644); err != nil {
+			return fmt.Errorf("write polkit rule: %w", err)
+		}
+	}
+	if log != nil {
+		log.Info("prepared agent user", "user", name, "uid", uid, "gid", gid)
+	}
+	return nil
+}
+
+// ensureUser looks up name and creates it as a system user with its own
+// group when it does not exist yet.
+func ensureUser(ctx context.Context, name, home string) (*user.User, error) {
+	if u, err := lookupUser(name); err == nil {
+		return u, nil
+	}
+	var err error
+	if _, lookErr := lookPath("useradd"); lookErr == nil {
+		err = runCommand(ctx, "useradd", "--system", "--user-group", "--no-create-home", "--home-dir", home, "--shell", "/usr/sbin/nologin", name)
+	} else {
+		// BusyBox systems such as Alpine only have adduser and addgroup.
+		if err = runCommand(ctx, "addgroup", "-S", name); err == nil {
+			err = runCommand(ctx, "adduser", "-S", "-D", "-H", "-h", home, "-s", "/sbin/nologin", "-G", name, name)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("create user %s: %w", name, err)
+	}
+	return lookupUser(name)
+}
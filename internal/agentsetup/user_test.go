@@ -0,0 +1,90 @@
+package agentsetup
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/najahiiii/xray-agent/internal/initsys"
+)
+
+func TestPrepareUserCreatesUserAndPolkitRule(t *testing.T) {
+	dir := t.TempDir()
+	cfgPath := filepath.Join(dir, "config.yaml")
+	cfg := `control:
+  base_url: https://panel.example.com
+  token: secret
+  server_slug: node-1
+xray:
+  api_server: 127.0.0.1:10085
+storage:
+  dir: ` + filepath.Join(dir, "state") + `
+  asset_cache_keep: -1
+admin:
+  socket: none
+certificates:
+  dir: ` + filepath.Join(dir, "certs") + `
+service:
+  init: none
+  xray_config: ` + filepath.Join(dir, "xray", "config.json") + `
+`
+	if err := os.WriteFile(cfgPath, []byte(cfg), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	created := false
+	var commands []string
+	oldLookup, oldLookPath, oldRun, oldRules := lookupUser, lookPath, runCommand, polkitRulesPath
+	t.Cleanup(func() { lookupUser, lookPath, runCommand, polkitRulesPath = oldLookup, oldLookPath, oldRun, oldRules })
+	lookupUser = func(name string) (*user.User, error) {
+		if !created {
+			return nil, user.UnknownUserError(name)
+		}
+		return &user.User{Username: name, Uid: strconv.Itoa(os.Getuid()), Gid: strconv.Itoa(os.Getgid())}, nil
+	}
+	lookPath = func(string) (string, error) { return "", errors.New("not found") }
+	runCommand = func(_ context.Context, name string, args ...string) error {
+		commands = append(commands, name+" "+strings.Join(args, " "))
+		created = name == "adduser"
+		return nil
+	}
+	polkitRulesPath = filepath.Join(dir, "polkit", "50-xray-agent.rules")
+
+	if err := prepareUser(context.Background(), Options{ConfigPath: cfgPath}, initsys.Systemd, "xray-agent"); err != nil {
+		t.Fatalf("prepareUser: %v", err)
+	}
+	if len(commands) != 2 || commands[0] != "addgroup -S xray-agent" || !strings.HasPrefix(commands[1], "adduser -S -D -H -h "+filepath.Join(dir, "state")) {
+		t.Fatalf("commands = %q", commands)
+	}
+	for _, path := range []string{filepath.Join(dir, "state"), filepath.Join(dir, "certs"), filepath.Join(dir, "xray")} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("owned path not created: %v", err)
+		}
+	}
+	if info, err := os.Stat(cfgPath); err != nil || info.Mode().Perm() != 0o640 {
+		t.Fatalf("config mode = %v, %v; want 0640", info.Mode().Perm(), err)
+	}
+	rule, err := os.ReadFile(polkitRulesPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`var units = ["xray.service", "xray-agent.service"];`, `subject.user == "xray-agent"`} {
+		if !strings.Contains(string(rule), want) {
+			t.Fatalf("polkit rule missing %q:\n%s", want, rule)
+		}
+	}
+}
+
+func TestServiceUser(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missing.yaml")
+	for in, want := range map[string]string{"": "", "root": "", "xray-agent": "xray-agent"} {
+		if got := serviceUser(Options{ConfigPath: path, User: in}); got != want {
+			t.Errorf("serviceUser(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
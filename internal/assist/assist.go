@@ -0,0 +1,306 @@
+// Package assist opens an emergency reverse SSH tunnel from the node to a
+// bastion chosen by the panel, so operators can reach a node whose inbound
+// access is broken (firewall mistakes, NAT) and repair it.
+package assist
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	DefaultSSHBinary   = "ssh"
+	DefaultLocalAddr   = "127.0.0.1:22"
+	DefaultMaxDuration = time.Hour
+)
+
+// startupGrace is how long Open waits for ssh to fail, e.g. on a rejected key
+// or a remote port that is already forwarded, before reporting success.
+var startupGrace = 5 * time.Second
+
+// ErrNotOpen is returned by Close when no tunnel is running.
+var ErrNotOpen = errors.New("no assist tunnel is open")
+
+// generateKey creates the tunnel key pair; overridden in tests.
+var generateKey = func(ctx context.Context, path string) error {
+	out, err := exec.CommandContext(ctx, "ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-C", "xray-agent-assist", "-f", path).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ssh-keygen: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+type Options struct {
+	SSHBinary string
+	// KeyFile is the private key used to log in to the bastion. It is created
+	// on first use; its public half is reported to the panel.
+	KeyFile string
+	// LocalAddr is what the bastion's forwarded port reaches on the node.
+	LocalAddr   string
+	MaxDuration time.Duration
+	Logger      *slog.Logger
+}
+
+// Request is the OPEN_ASSIST command payload.
+type Request struct {
+	Host string
+	Port int
+	User string
+	// RemotePort is the port opened on the bastion's loopback interface.
+	RemotePort int
+	// HostKey pins the bastion's SSH host key ("ssh-ed25519 AAAA...").
+	HostKey  string
+	Duration time.Duration
+}
+
+// Session describes an open tunnel.
+type Session struct {
+	Bastion    string
+	RemotePort int
+	PublicKey  string
+	OpenedAt   time.Time
+	ExpiresAt  time.Time
+}
+
+// Manager runs at most one tunnel at a time.
+type Manager struct {
+	opts Options
+	log  *slog.Logger
+
+	mu      sync.Mutex
+	cancel  context.CancelFunc
+	done    chan struct{}
+	session Session
+}
+
+func New(opts Options) *Manager {
+	if opts.SSHBinary == "" {
+		opts.SSHBinary = DefaultSSHBinary
+	}
+	if opts.LocalAddr == "" {
+		opts.LocalAddr = DefaultLocalAddr
+	}
+	if opts.MaxDuration <= 0 {
+		opts.MaxDuration = DefaultMaxDuration
+	}
+	log := opts.Logger
+	if log == nil {
+		log = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	return &Manager{opts: opts, log: log}
+}
+
+// ParseRequest validates an OPEN_ASSIST payload:
+//
+//	{"host": "bastion.example.com", "port": 22, "user": "assist",
+//	 "remote_port": 40022, "host_key": "ssh-ed25519 AAAA...", "duration_sec": 1800}
+func ParseRequest(payload map[string]any) (Request, error) {
+	req := Request{Port: 22}
+	req.Host, _ = payload["host"].(string)
+	req.User, _ = payload["user"].(string)
+	req.HostKey, _ = payload["host_key"].(string)
+	req.Host = strings.TrimSpace(req.Host)
+	req.User = strings.TrimSpace(req.User)
+	req.HostKey = strings.TrimSpace(req.HostKey)
+	if port, ok := intField(payload, "port"); ok {
+		req.Port = port
+	}
+	req.RemotePort, _ = intField(payload, "remote_port")
+	if sec, ok := intField(payload, "duration_sec"); ok {
+		req.Duration = time.Duration(sec) * time.Second
+	}
+
+	switch {
+	case req.Host == "" || strings.HasPrefix(req.Host, "-"):
+		return req, errors.New("host is required")
+	case req.User == "" || strings.HasPrefix(req.User, "-") || strings.ContainsAny(req.User, "@ "):
+		return req, errors.New("user is required")
+	case req.Port <= 0 || req.Port > 65535:
+		return req, fmt.Errorf("invalid port %d", req.Port)
+	case req.RemotePort <= 0 || req.RemotePort > 65535:
+		return req, fmt.Errorf("invalid remote_port %d", req.RemotePort)
+	case len(strings.Fields(req.HostKey)) < 2 || strings.ContainsAny(req.HostKey, "\r\n"):
+		return req, errors.New("host_key must be \"<type> <base64>\"")
+	case req.Duration < 0:
+		return req, errors.New("duration_sec must not be negative")
+	}
+	return req, nil
+}
+
+func intField(payload map[string]any, key string) (int, bool) {
+	switch v := payload[key].(type) {
+	case float64:
+		return int(v), true
+	case int:
+		return v, true
+	case string:
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		return n, err == nil
+	}
+	return 0, false
+}
+
+// PublicKey returns the tunnel's public key, creating the key pair if needed.
+func (m *Manager) PublicKey(ctx context.Context) (string, error) {
+	if _, err := os.Stat(m.opts.KeyFile); errors.Is(err, os.ErrNotExist) {
+		if err := os.MkdirAll(filepath.Dir(m.opts.KeyFile), 0o700); err != nil {
+			return "", err
+		}
+		if err := generateKey(ctx, m.opts.KeyFile); err != nil {
+			return "", err
+		}
+		m.log.Info("generated assist key", "path", m.opts.KeyFile)
+	}
+	data, err := os.ReadFile(m.opts.KeyFile + ".pub")
+	if err != nil {
+		return "", fmt.Errorf("read assist public key: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// Open replaces any running tunnel with one to req's bastion. It returns once
+// ssh has survived its startup grace period; the tunnel closes by itself when
+// the requested duration (capped at MaxDuration) has passed.
+func (m *Manager) Open(ctx context.Context, req Request) (Session, error) {
+	m.Close()
+
+	pub, err := m.PublicKey(ctx)
+	if err != nil {
+		return Session{PublicKey: pub}, err
+	}
+	duration := req.Duration
+	if duration <= 0 || duration > m.opts.MaxDuration {
+		duration = m.opts.MaxDuration
+	}
+
+	dir, err := os.MkdirTemp("", "xray-agent-assist-")
+	if err != nil {
+		return Session{PublicKey: pub}, err
+	}
+	knownHosts := filepath.Join(dir, "known_hosts")
+	hostPattern := req.Host
+	if req.Port != 22 {
+		hostPattern = fmt.Sprintf("[%s]:%d", req.Host, req.Port)
+	}
+	if err := os.WriteFile(knownHosts, []byte(hostPattern+" "+req.HostKey+"\n"), 0o600); err != nil {
+		os.RemoveAll(dir)
+		return Session{PublicKey: pub}, err
+	}
+
+	tunnelCtx, cancel := context.WithTimeout(context.Background(), duration)
+	cmd := exec.CommandContext(tunnelCtx, m.opts.SSHBinary, m.sshArgs(req, knownHosts)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(syscall.SIGTERM)
+	}
+	cmd.WaitDelay = 5 * time.Second
+	if err := cmd.Start(); err != nil {
+		cancel()
+		os.RemoveAll(dir)
+		return Session{PublicKey: pub}, fmt.Errorf("start ssh: %w", err)
+	}
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	select {
+	case err := <-exited:
+		cancel()
+		os.RemoveAll(dir)
+		return Session{PublicKey: pub}, fmt.Errorf("ssh exited: %w: %s", err, lastLine(stderr.String()))
+	case <-ctx.Done():
+		cancel()
+		<-exited
+		os.RemoveAll(dir)
+		return Session{PublicKey: pub}, ctx.Err()
+	case <-time.After(startupGrace):
+	}
+
+	now := time.Now().UTC()
+	session := Session{
+		Bastion:    net.JoinHostPort(req.Host, strconv.Itoa(req.Port)),
+		RemotePort: req.RemotePort,
+		PublicKey:  pub,
+		OpenedAt:   now,
+		ExpiresAt:  now.Add(duration),
+	}
+	done := make(chan struct{})
+	m.mu.Lock()
+	m.cancel = cancel
+	m.done = done
+	m.session = session
+	m.mu.Unlock()
+
+	m.log.Warn("assist tunnel open", "bastion", session.Bastion, "remote_port", req.RemotePort, "expires_at", session.ExpiresAt)
+	go func() {
+		err := <-exited
+		cancel()
+		os.RemoveAll(dir)
+		m.mu.Lock()
+		if m.done == done {
+			m.cancel, m.done = nil, nil
+		}
+		m.mu.Unlock()
+		close(done)
+		m.log.Warn("assist tunnel closed", "bastion", session.Bastion, "err", err)
+	}()
+	return session, nil
+}
+
+// Close stops the running tunnel and waits for ssh to exit.
+func (m *Manager) Close() error {
+	m.mu.Lock()
+	cancel, done := m.cancel, m.done
+	m.mu.Unlock()
+	if cancel == nil {
+		return ErrNotOpen
+	}
+	cancel()
+	<-done
+	return nil
+}
+
+// Current returns the open tunnel, if any.
+func (m *Manager) Current() (Session, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.session, m.done != nil
+}
+
+func (m *Manager) sshArgs(req Request, knownHosts string) []string {
+	return []string{
+		"-N", "-T",
+		"-i", m.opts.KeyFile,
+		"-p", strconv.Itoa(req.Port),
+		"-o", "BatchMode=yes",
+		"-o", "IdentitiesOnly=yes",
+		"-o", "ExitOnForwardFailure=yes",
+		"-o", "ServerAliveInterval=30",
+		"-o", "ServerAliveCountMax=3",
+		"-o", "StrictHostKeyChecking=yes",
+		"-o", "UserKnownHostsFile=" + knownHosts,
+		"-R", fmt.Sprintf("127.0.0.1:%d:%s", req.RemotePort, m.opts.LocalAddr),
+		"-l", req.User,
+		req.Host,
+	}
+}
+
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return lines[len(lines)-1]
+}
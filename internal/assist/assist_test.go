@@ -0,0 +1,143 @@
+package assist
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func fakeKey(t *testing.T) {
+	t.Helper()
+	original := generateKey
+	t.Cleanup(func() { generateKey = original })
+	generateKey = func(_ context.Context, path string) error {
+		if err := os.WriteFile(path, []byte("private"), 0o600); err != nil {
+			return err
+		}
+		return os.WriteFile(path+".pub", []byte("ssh-ed25519 AAAAnode xray-agent-assist\n"), 0o644)
+	}
+
+	grace := startupGrace
+	t.Cleanup(func() { startupGrace = grace })
+	startupGrace = 100 * time.Millisecond
+}
+
+func writeScript(t *testing.T, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ssh")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+body), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParseRequest(t *testing.T) {
+	valid := map[string]any{
+		"host":         "bastion.example.com",
+		"port":         float64(2222),
+		"user":         "assist",
+		"remote_port":  float64(40022),
+		"host_key":     "ssh-ed25519 AAAAbastion",
+		"duration_sec": "900",
+	}
+	req, err := ParseRequest(valid)
+	if err != nil {
+		t.Fatalf("ParseRequest: %v", err)
+	}
+	if req.Port != 2222 || req.RemotePort != 40022 || req.Duration != 15*time.Minute {
+		t.Fatalf("unexpected request: %+v", req)
+	}
+
+	for name, mutate := range map[string]func(map[string]any){
+		"missing host":   func(p map[string]any) { delete(p, "host") },
+		"option as host": func(p map[string]any) { p["host"] = "-oProxyCommand=sh" },
+		"user with at":   func(p map[string]any) { p["user"] = "a@b" },
+		"no remote port": func(p map[string]any) { delete(p, "remote_port") },
+		"bad host key":   func(p map[string]any) { p["host_key"] = "AAAA" },
+		"multi-line key": func(p map[string]any) { p["host_key"] = "ssh-ed25519 AAAA\nevil ssh-rsa BBBB" },
+	} {
+		payload := map[string]any{}
+		for k, v := range valid {
+			payload[k] = v
+		}
+		mutate(payload)
+		if _, err := ParseRequest(payload); err == nil {
+			t.Fatalf("%s: expected error", name)
+		}
+	}
+}
+
+func TestOpenAndCloseTunnel(t *testing.T) {
+	fakeKey(t)
+	dir := t.TempDir()
+	argsFile := filepath.Join(dir, "args")
+	hostsFile := filepath.Join(dir, "known_hosts")
+	// The fake ssh records its arguments and the pinned host key, then waits
+	// like a tunnel would.
+	script := writeScript(t, `echo "$@" > `+argsFile+`
+for arg; do case "$arg" in UserKnownHostsFile=*) cp "${arg#UserKnownHostsFile=}" `+hostsFile+`;; esac; done
+exec sleep 30
+`)
+	m := New(Options{SSHBinary: script, KeyFile: filepath.Join(dir, "keys", "assist_ed25519")})
+
+	session, err := m.Open(context.Background(), Request{
+		Host: "bastion.example.com", Port: 2222, User: "assist",
+		RemotePort: 40022, HostKey: "ssh-ed25519 AAAAbastion", Duration: time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if session.PublicKey != "ssh-ed25519 AAAAnode xray-agent-assist" || session.Bastion != "bastion.example.com:2222" {
+		t.Fatalf("unexpected session: %+v", session)
+	}
+	if got := session.ExpiresAt.Sub(session.OpenedAt); got != time.Minute {
+		t.Fatalf("session lasts %v, want 1m", got)
+	}
+	if _, ok := m.Current(); !ok {
+		t.Fatal("expected an open tunnel")
+	}
+
+	args, _ := os.ReadFile(argsFile)
+	for _, want := range []string{"-R 127.0.0.1:40022:127.0.0.1:22", "-p 2222", "-l assist bastion.example.com", "StrictHostKeyChecking=yes"} {
+		if !strings.Contains(string(args), want) {
+			t.Fatalf("ssh args missing %q: %s", want, args)
+		}
+	}
+	hosts, _ := os.ReadFile(hostsFile)
+	if string(hosts) != "[bastion.example.com]:2222 ssh-ed25519 AAAAbastion\n" {
+		t.Fatalf("unexpected known_hosts: %q", hosts)
+	}
+
+	if err := m.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if _, ok := m.Current(); ok {
+		t.Fatal("tunnel still open after Close")
+	}
+	if err := m.Close(); !errors.Is(err, ErrNotOpen) {
+		t.Fatalf("second Close: got %v, want ErrNotOpen", err)
+	}
+}
+
+func TestOpenReportsSSHFailure(t *testing.T) {
+	fakeKey(t)
+	script := writeScript(t, "echo 'assist@bastion: Permission denied (publickey).' >&2\nexit 255\n")
+	m := New(Options{SSHBinary: script, KeyFile: filepath.Join(t.TempDir(), "assist_ed25519")})
+
+	session, err := m.Open(context.Background(), Request{
+		Host: "bastion.example.com", Port: 22, User: "assist", RemotePort: 40022, HostKey: "ssh-ed25519 AAAA",
+	})
+	if err == nil || !strings.Contains(err.Error(), "Permission denied") {
+		t.Fatalf("Open: got %v, want permission denied", err)
+	}
+	if session.PublicKey == "" {
+		t.Fatal("public key should be reported even when the tunnel fails")
+	}
+	if _, ok := m.Current(); ok {
+		t.Fatal("failed tunnel reported as open")
+	}
+}
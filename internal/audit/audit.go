@@ -0,0 +1,161 @@
+// Package audit records the changes the agent applies to the core in an
+// append-only file of JSON lines, and optionally queues them for the panel.
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/najahiiii/xray-agent/internal/model"
+)
+
+// Sources and results of a change, see model.AuditEntry.
+const (
+	SourceState     = "state"
+	SourceReapply   = "reapply"
+	SourceReconcile = "reconcile"
+	SourceAbuse     = "abuse"
+	SourceBan       = "ban"
+	SourceBandwidth = "bandwidth_cap"
+	ResultOK        = "ok"
+	ResultFailed    = "failed"
+)
+
+const (
+	fileMode = 0o640
+	dirMode  = 0o755
+	// maxPending bounds the entries held for the panel between flushes;
+	// the oldest are dropped and counted once it is full.
+	maxPending = 1000
+)
+
+// Log appends audit entries to a file. A nil *Log records nothing, so
+// callers need not check whether auditing is enabled.
+type Log struct {
+	path   string
+	remote bool
+	log    *slog.Logger
+
+	mu      sync.Mutex
+	pending []model.AuditEntry
+	dropped int
+	// failing is set after a write failed, so it is logged only once until
+	// writes succeed again.
+	failing bool
+	now     func() time.Time
+}
+
+// New returns a Log writing to path. With remote set, entries are also kept
+// for Flush.
+func New(path string, remote bool, log *slog.Logger) *Log {
+	return &Log{path: path, remote: remote, log: log, now: time.Now}
+}
+
+type sourceKey struct{}
+
+type source struct {
+	name    string
+	version int64
+}
+
+// WithSource returns a context whose changes are recorded as caused by
+// name (SourceState, SourceReapply, SourceReconcile, SourceAbuse,
+// SourceBan) at the given config version.
+func WithSource(ctx context.Context, name string, configVersion int64) context.Context {
+	return context.WithValue(ctx, sourceKey{}, source{name: name, version: configVersion})
+}
+
+// Record appends one change. The time, source and config version are
+// filled in from ctx; err sets the result to failed.
+func (l *Log) Record(ctx context.Context, kind, action, subject, inbound string, err error) {
+	if l == nil {
+		return
+	}
+	e := model.AuditEntry{
+		Kind:    kind,
+		Action:  action,
+		Subject: subject,
+		Inbound: inbound,
+		Result:  ResultOK,
+	}
+	if src, ok := ctx.Value(sourceKey{}).(source); ok {
+		e.Source, e.ConfigVersion = src.name, src.version
+	}
+	if err != nil {
+		e.Result, e.Error = ResultFailed, err.Error()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e.Time = l.now().UTC()
+	if err := l.append(e); err != nil {
+		if !l.failing && l.log != nil {
+			l.log.Warn("cannot write audit log", "path", l.path, "err", err)
+		}
+		l.failing = true
+	} else {
+		l.failing = false
+	}
+	if l.remote {
+		if len(l.pending) == maxPending {
+			l.pending = l.pending[1:]
+			l.dropped++
+		}
+		l.pending = append(l.pending, e)
+	}
+}
+
+// append writes e as one line. The file is opened for every entry so an
+// external logrotate can move it away at any time.
+func (l *Log) append(e model.AuditEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(l.path), dirMode); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, fileMode)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Flush sends the entries queued for the panel. On failure they are put
+// back for the next flush.
+func (l *Log) Flush(ctx context.Context, send func(context.Context, *model.AuditPush) error) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	entries, dropped := l.pending, l.dropped
+	l.pending, l.dropped = nil, 0
+	l.mu.Unlock()
+	if len(entries) == 0 && dropped == 0 {
+		return nil
+	}
+
+	err := send(ctx, &model.AuditPush{ServerTime: time.Now().UTC(), Dropped: dropped, Entries: entries})
+	if err == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.pending = append(entries, l.pending...)
+	l.dropped += dropped
+	if over := len(l.pending) - maxPending; over > 0 {
+		l.pending = l.pending[over:]
+		l.dropped += over
+	}
+	return err
+}
@@ -0,0 +1,96 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/najahiiii/xray-agent/internal/model"
+)
+
+func TestRecordAppendsJSONLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sub", "audit.log")
+	l := New(path, false, nil)
+	l.now = func() time.Time { return time.Date(2026, 3, 1, 3, 12, 0, 0, time.UTC) }
+
+	ctx := WithSource(context.Background(), SourceState, 42)
+	l.Record(ctx, "user", "remove", "a@example.com", "vless-ws", nil)
+	l.Record(ctx, "route", "add", "cn", "", errors.New("outbound not found"))
+	l.Record(context.Background(), "user", "add", "b@example.com", "vless-ws", nil)
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var got []model.AuditEntry
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var e model.AuditEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			t.Fatalf("line %q: %v", sc.Text(), err)
+		}
+		got = append(got, e)
+	}
+	if len(got) != 3 {
+		t.Fatalf("expected 3 entries, got %+v", got)
+	}
+	want := model.AuditEntry{
+		Time:          time.Date(2026, 3, 1, 3, 12, 0, 0, time.UTC),
+		Source:        SourceState,
+		ConfigVersion: 42,
+		Kind:          "user",
+		Action:        "remove",
+		Subject:       "a@example.com",
+		Inbound:       "vless-ws",
+		Result:        ResultOK,
+	}
+	if got[0] != want {
+		t.Fatalf("entry = %+v, want %+v", got[0], want)
+	}
+	if got[1].Result != ResultFailed || got[1].Error != "outbound not found" {
+		t.Fatalf("unexpected failed entry: %+v", got[1])
+	}
+	if got[2].Source != "" || got[2].ConfigVersion != 0 {
+		t.Fatalf("unexpected source without context: %+v", got[2])
+	}
+	if len(l.pending) != 0 {
+		t.Fatalf("entries queued without remote: %d", len(l.pending))
+	}
+}
+
+func TestFlushRequeuesOnFailure(t *testing.T) {
+	l := New(filepath.Join(t.TempDir(), "audit.log"), true, nil)
+	ctx := context.Background()
+	l.Record(ctx, "user", "add", "a@example.com", "vless-ws", nil)
+	l.Record(ctx, "user", "add", "b@example.com", "vless-ws", nil)
+
+	if err := l.Flush(ctx, func(context.Context, *model.AuditPush) error { return errors.New("panel down") }); err == nil {
+		t.Fatal("expected error")
+	}
+	l.Record(ctx, "user", "remove", "c@example.com", "vless-ws", nil)
+
+	var pushed *model.AuditPush
+	if err := l.Flush(ctx, func(_ context.Context, p *model.AuditPush) error { pushed = p; return nil }); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if pushed == nil || len(pushed.Entries) != 3 || pushed.Entries[0].Subject != "a@example.com" || pushed.Entries[2].Subject != "c@example.com" {
+		t.Fatalf("unexpected push: %+v", pushed)
+	}
+	if err := l.Flush(ctx, func(context.Context, *model.AuditPush) error { t.Fatal("nothing to send"); return nil }); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNilLogRecordsNothing(t *testing.T) {
+	var l *Log
+	l.Record(context.Background(), "user", "add", "a@example.com", "", nil)
+	if err := l.Flush(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,131 @@
+// Package certs checks TLS certificates and installs them where xray's
+// inbounds expect them.
+package certs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Paths returns the default certificate and key files for domain under dir.
+func Paths(dir, domain string) (cert, key string) {
+	return filepath.Join(dir, domain+".crt"), filepath.Join(dir, domain+".key")
+}
+
+// ValidDomain rejects names that could escape the certificate directory.
+func ValidDomain(domain string) error {
+	if domain == "" || strings.ContainsAny(domain, `/\`) || strings.HasPrefix(domain, ".") {
+		return fmt.Errorf("invalid certificate domain %q", domain)
+	}
+	return nil
+}
+
+// Hash is the hex SHA-256 of cert followed by key.
+func Hash(cert, key []byte) string {
+	sum := sha256.New()
+	sum.Write(cert)
+	sum.Write(key)
+	return hex.EncodeToString(sum.Sum(nil))
+}
+
+// Check parses the pair and makes sure the key belongs to the certificate and
+// the certificate covers domain. It returns the certificate's expiry.
+func Check(domain string, cert, key []byte) (time.Time, error) {
+	pair, err := tls.X509KeyPair(cert, key)
+	if err != nil {
+		return time.Time{}, err
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return time.Time{}, err
+	}
+	host := domain
+	if rest, ok := strings.CutPrefix(domain, "*."); ok {
+		// A wildcard bundle must cover any name one label below rest.
+		host = "wildcard." + rest
+	}
+	if err := leaf.VerifyHostname(host); err != nil {
+		return leaf.NotAfter, err
+	}
+	if time.Now().After(leaf.NotAfter) {
+		return leaf.NotAfter, fmt.Errorf("certificate for %s expired at %s", domain, leaf.NotAfter.Format(time.RFC3339))
+	}
+	return leaf.NotAfter, nil
+}
+
+// Expiry returns when the certificate in certPath expires.
+func Expiry(certPath string) (time.Time, error) {
+	data, err := os.ReadFile(certPath)
+	if err != nil {
+		return time.Time{}, err
+	}
+	for rest := data; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return time.Time{}, errors.New("no certificate in " + certPath)
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		leaf, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return leaf.NotAfter, nil
+	}
+}
+
+// Install writes cert and key unless both files already hold them, and
+// reports whether anything changed. Each file is replaced atomically; the key
+// is readable by root only.
+func Install(certPath, keyPath string, cert, key []byte) (bool, error) {
+	if same(certPath, cert) && same(keyPath, key) {
+		return false, nil
+	}
+	if err := writeAtomic(keyPath, key, 0o600); err != nil {
+		return false, err
+	}
+	if err := writeAtomic(certPath, cert, 0o644); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func same(path string, data []byte) bool {
+	current, err := os.ReadFile(path)
+	return err == nil && bytes.Equal(current, data)
+}
+
+func writeAtomic(path string, data []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
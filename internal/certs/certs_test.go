@@ -0,0 +1,94 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func selfSigned(t *testing.T, domain string, notAfter time.Time) (cert, key []byte) {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: domain},
+		DNSNames:     []string{domain},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestCheck(t *testing.T) {
+	notAfter := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	cert, key := selfSigned(t, "edge.example.com", notAfter)
+	if got, err := Check("edge.example.com", cert, key); err != nil || !got.Equal(notAfter) {
+		t.Fatalf("Check = %v, %v", got, err)
+	}
+	if _, err := Check("other.example.com", cert, key); err == nil {
+		t.Fatal("Check accepted a certificate for another domain")
+	}
+	_, otherKey := selfSigned(t, "edge.example.com", notAfter)
+	if _, err := Check("edge.example.com", cert, otherKey); err == nil {
+		t.Fatal("Check accepted a mismatched key")
+	}
+	wildcard, wildcardKey := selfSigned(t, "*.example.com", notAfter)
+	if _, err := Check("*.example.com", wildcard, wildcardKey); err != nil {
+		t.Fatalf("Check(wildcard) = %v", err)
+	}
+	expired, expiredKey := selfSigned(t, "edge.example.com", time.Now().Add(-time.Minute))
+	if _, err := Check("edge.example.com", expired, expiredKey); err == nil {
+		t.Fatal("Check accepted an expired certificate")
+	}
+}
+
+func TestInstallSkipsIdenticalFiles(t *testing.T) {
+	cert, key := selfSigned(t, "edge.example.com", time.Now().Add(time.Hour))
+	certPath, keyPath := Paths(filepath.Join(t.TempDir(), "certs"), "edge.example.com")
+
+	changed, err := Install(certPath, keyPath, cert, key)
+	if err != nil || !changed {
+		t.Fatalf("first Install = %v, %v", changed, err)
+	}
+	info, err := os.Stat(keyPath)
+	if err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("key mode = %v, %v", info.Mode().Perm(), err)
+	}
+	if changed, err := Install(certPath, keyPath, cert, key); err != nil || changed {
+		t.Fatalf("repeat Install = %v, %v", changed, err)
+	}
+	if _, err := Expiry(certPath); err != nil {
+		t.Fatalf("Expiry: %v", err)
+	}
+}
+
+func TestValidDomain(t *testing.T) {
+	for _, domain := range []string{"", "../etc/passwd", "a/b", ".hidden"} {
+		if ValidDomain(domain) == nil {
+			t.Errorf("ValidDomain(%q) = nil", domain)
+		}
+	}
+	if err := ValidDomain("*.example.com"); err != nil {
+		t.Errorf("ValidDomain(wildcard) = %v", err)
+	}
+}
@@ -1,9 +1,18 @@
 package config
 
 import (
+	"cmp"
 	"errors"
 	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
 	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -16,31 +25,276 @@ const (
 	DefaultHeartbeatIntervalSec = 30
 	DefaultMetricsIntervalSec   = 30
 	DefaultCoreCheckIntervalSec = 43200
+	DefaultReconcileIntervalSec = 300
+	DefaultJitterPercent        = 10
 	DefaultAPITimeoutSec        = 5
+	DefaultApplyWorkers         = 8
+	DefaultStorageDir           = "/var/lib/xray-agent"
+	DefaultAssetCacheDir        = "/var/cache/xray-agent"
+	DefaultAgeKeyFile           = "/etc/xray-agent/age.key"
+	DefaultAuditFile            = "/var/log/xray-agent/audit.log"
+	HeartbeatFormatEmpty        = "empty"
+	HeartbeatFormatV1           = "v1"
+	DefaultLogShipLevel         = "warn"
+	DefaultLogShipIntervalSec   = 30
+	DefaultLogShipBatchSize     = 100
+	DefaultLogShipBufferSize    = 1000
+	DefaultServiceInit          = "auto"
+	ServiceInitNone             = "none"
+	DefaultXrayBinary           = "/usr/local/bin/xray"
+	DefaultXrayConfigPath       = "/etc/xray/config.json"
+	DefaultXrayNoFile           = 1048576
+	DefaultMaintenanceTokenName = "maintenance-token"
+	DefaultMaxRetryAfterSec     = 900
+	DefaultMaxClockSkewSec      = 30
+	TransportHTTP               = "http"
+	TransportMQTT               = "mqtt"
+	DefaultMQTTTopicPrefix      = "xray-agent"
+	DefaultMQTTKeepAliveSec     = 60
+	DefaultAssistSSHBinary      = "ssh"
+	DefaultAssistKeyName        = "assist_ed25519"
+	DefaultAssistLocalAddr      = "127.0.0.1:22"
+	DefaultAssistMaxDurationSec = 3600
+	DefaultStatsCheckpointSec   = 3600
+	DefaultSpeedtestDownloadURL = "https://speed.cloudflare.com/__down?bytes=100000000"
+	DefaultSpeedtestUploadURL   = "https://speed.cloudflare.com/__up"
+	DefaultSpeedtestUploadMB    = 25
+	DefaultSpeedtestTimeoutSec  = 15
+	DefaultCertificatesDir      = "/etc/xray/certs"
+	DefaultACMEDirectory        = "https://acme-v02.api.letsencrypt.org/directory"
+	DefaultACMEAccountKeyName   = "acme_account.key"
+	DefaultACMEHTTPAddr         = ":80"
+	DefaultACMETLSAddr          = ":443"
+	DefaultACMERenewBeforeDays  = 30
+	DefaultACMECheckIntervalSec = 3600
+	// acme.challenge proves domain control over HTTP on port 80 or over TLS
+	// on port 443.
+	ACMEChallengeHTTP01    = "http-01"
+	ACMEChallengeTLSALPN01 = "tls-alpn-01"
+	DefaultAdminSocket     = "/run/xray-agent/admin.sock"
+	DefaultRestartSteps    = 10
+	// AdminSocketNone disables the local admin API.
+	AdminSocketNone = "none"
+	// DefaultIPv6Probe is Cloudflare's public DNS over HTTPS, which answers
+	// TCP on 443 over IPv6 nearly everywhere.
+	DefaultIPv6Probe = "[2606:4700:4700::1111]:443"
+	// IPv6ProbeNone turns the network check off.
+	IPv6ProbeNone = "none"
+	// Access log privacy levels for destinations and rejection sources.
+	AccessLogFull                   = "full"
+	AccessLogDomain                 = "domain"
+	AccessLogMasked                 = "masked"
+	AccessLogNone                   = "none"
+	DefaultAccessLogIntervalSec     = 60
+	DefaultAccessLogTopDestinations = 20
+	DefaultAbuseIntervalSec         = 60
+	DefaultAbuseMinHits             = 3
+	DefaultAbuseMaxConnsPerMin      = 600
+	DefaultAbuseBlockOutbound       = "blocked"
+	DefaultAbuseBlockSec            = 3600
+	// Ban methods: nftables drops a banned address in the kernel, xray
+	// routes its connections to ban.block_outbound.
+	BanNFTables           = "nftables"
+	BanXray               = "xray"
+	DefaultBanMaxFailures = 10
+	DefaultBanFindTimeSec = 600
+	DefaultBanSec         = 3600
+	DefaultBanIntervalSec = 60
+	DefaultBanNFTBinary   = "nft"
+	DefaultBanNFTTable    = "xray_agent"
+	// DefaultUsageHistoryDirName is usage_history.dir's default, under
+	// storage.dir.
+	DefaultUsageHistoryDirName       = "usage"
+	DefaultUsageHistoryRetentionDays = 90
+	// bandwidth_cap.direction counts sent plus received, sent only or
+	// received only; bandwidth_cap.action blocks the inbounds not exempted
+	// or every proxied connection.
+	BandwidthTotal              = "total"
+	BandwidthOut                = "out"
+	BandwidthIn                 = "in"
+	BandwidthActionInbounds     = "inbounds"
+	BandwidthActionBlackhole    = "blackhole"
+	DefaultBandwidthResetDay    = 1
+	DefaultBandwidthIntervalSec = 60
+	// Backends are the proxy cores the agent can drive.
+	BackendXray           = "xray"
+	BackendSingBox        = "sing-box"
+	DefaultSingBoxBinary  = "/usr/local/bin/sing-box"
+	DefaultSingBoxConfig  = "/etc/sing-box/config.json"
+	DefaultSingBoxService = "sing-box"
+	DefaultSingBoxAPI     = "127.0.0.1:10085"
+	// Route apply modes: incremental updates only the changed rules, replace
+	// swaps the whole managed rule set in one AddRule call.
+	RouteApplyIncremental = "incremental"
+	RouteApplyReplace     = "replace"
 )
 
 type Config struct {
 	Control struct {
-		BaseURL     string `yaml:"base_url"`
-		Token       string `yaml:"token"`
+		// BaseURL is one panel URL or a list tried in order; the agent fails
+		// over to the next one while a panel is unreachable.
+		BaseURL URLList `yaml:"base_url"`
+		Token   string  `yaml:"token"`
+		// TokenFile reads Token from a file instead, e.g. a systemd
+		// credential, Kubernetes secret or Vault agent sink. A relative path
+		// is looked up in $CREDENTIALS_DIRECTORY when systemd sets it.
+		TokenFile   string `yaml:"token_file"`
 		ServerSlug  string `yaml:"server_slug"`
 		TLSInsecure bool   `yaml:"tls_insecure"`
+		// HeartbeatFormat is "empty" (legacy ok/version body) or "v1" (node status summary).
+		HeartbeatFormat string `yaml:"heartbeat_format"`
+		// MaintenanceToken is a short-lived secondary bearer token, tried when
+		// the panel rejects Token during a rotation. It requires an expiry.
+		MaintenanceToken          string    `yaml:"maintenance_token"`
+		MaintenanceTokenExpiresAt time.Time `yaml:"maintenance_token_expires_at,omitempty"`
+		// MaintenanceTokenFile holds "<token> <RFC3339 expiry>" and is re-read
+		// whenever Token is rejected, so it can be delivered without a restart.
+		MaintenanceTokenFile string `yaml:"maintenance_token_file"`
+		// MaxRetryAfterSec caps how long a Retry-After from the panel holds
+		// the agent's loops back.
+		MaxRetryAfterSec int `yaml:"max_retry_after_sec"`
+		// MaxClockSkewSec is how far the local clock may drift from the
+		// panel's before an error is logged; negative turns the check off.
+		MaxClockSkewSec int `yaml:"max_clock_skew_sec"`
+		// StateStream subscribes to the panel's state/stream SSE endpoint
+		// so state changes are fetched at once instead of on the next
+		// state_sec poll, which keeps running as a fallback.
+		StateStream bool `yaml:"state_stream"`
+		// Transport is http (default) or mqtt, which reaches the panel
+		// through a broker over one connection the agent opens.
+		Transport string `yaml:"transport"`
+		MQTT      struct {
+			// Broker is tcp://host:port or tls://host:port.
+			Broker string `yaml:"broker"`
+			// Username defaults to ServerSlug; the password is Token.
+			Username string `yaml:"username"`
+			// TopicPrefix roots this node's topics at
+			// <topic_prefix>/<server_slug>/.
+			TopicPrefix  string `yaml:"topic_prefix"`
+			KeepAliveSec int    `yaml:"keepalive_sec"`
+		} `yaml:"mqtt"`
 	} `yaml:"control"`
 
+	// Backend is the proxy core the agent drives: xray (default) or sing-box.
+	Backend string `yaml:"backend"`
+	// SingBox locates the sing-box install when Backend is sing-box. Users
+	// are written into Config and sing-box is reloaded through Service;
+	// traffic is read from the v2ray_api stats listener at APIServer.
+	SingBox struct {
+		Binary    string `yaml:"binary"`
+		Config    string `yaml:"config"`
+		Service   string `yaml:"service"`
+		APIServer string `yaml:"api_server"`
+	} `yaml:"sing_box"`
+
 	Xray struct {
 		Version            string `yaml:"version"`
 		APIServer          string `yaml:"api_server"`
 		APITimeoutSec      int    `yaml:"api_timeout_sec"`
 		StatsResetEachPush bool   `yaml:"stats_reset_each_push"`
-		InboundTags        struct {
+		// ApplyWorkers is how many user adds or removes are sent to xray at
+		// once; 1 applies them one after another.
+		ApplyWorkers int `yaml:"apply_workers"`
+		// APIRateLimit caps the calls that change xray (users, rules,
+		// outbounds) per second, so a large diff does not load the core;
+		// APIRateBurst is how many may go at once. 0 disables the limit.
+		APIRateLimit float64 `yaml:"api_rate_limit"`
+		APIRateBurst int     `yaml:"api_rate_burst"`
+		// APITLS secures the connection to APIServer, for an API exposed
+		// beyond loopback through a TLS inbound. CAFile verifies the core's
+		// certificate (system roots when empty); CertFile and KeyFile present
+		// a client certificate.
+		APITLS struct {
+			Enabled    bool   `yaml:"enabled"`
+			CAFile     string `yaml:"ca_file"`
+			CertFile   string `yaml:"cert_file"`
+			KeyFile    string `yaml:"key_file"`
+			ServerName string `yaml:"server_name"`
+			Insecure   bool   `yaml:"insecure"`
+		} `yaml:"api_tls"`
+		// APIToken is sent as a bearer token in the metadata of every API
+		// call, for a gRPC proxy in front of the core that checks it.
+		// APITokenFile reads it from a file like control.token_file.
+		APIToken     string `yaml:"api_token"`
+		APITokenFile string `yaml:"api_token_file"`
+		// RouteApply is how route changes reach xray: incremental (default)
+		// removes and adds the changed rules one by one, replace removes
+		// every managed rule and adds the new set in a single call so
+		// traffic never sees half of a change.
+		RouteApply string `yaml:"route_apply"`
+		// StatsCheckpointSec is how often a stats push lists every user with
+		// their running totals; other pushes carry only users with traffic.
+		// Negative disables checkpoints.
+		StatsCheckpointSec int `yaml:"stats_checkpoint_sec"`
+		// Arch overrides the platform of the installed core, as named in
+		// release assets (e.g. linux-arm64-v8a), for cross-provisioning;
+		// empty detects it from the running agent.
+		Arch        string `yaml:"arch"`
+		InboundTags struct {
 			VLESS  string `yaml:"vless"`
 			VMESS  string `yaml:"vmess"`
 			TROJAN string `yaml:"trojan"`
+			// WireGuard is optional; its peers are managed only when set or
+			// named by the state.
+			WireGuard string `yaml:"wireguard"`
 		} `yaml:"inbound_tags"`
+		// Limits are rendered into the xray service definition.
+		Limits struct {
+			NoFile      int               `yaml:"nofile"`
+			NProc       int               `yaml:"nproc"`
+			Environment map[string]string `yaml:"environment"`
+		} `yaml:"limits"`
+		// Hardening is rendered into the xray systemd unit.
+		Hardening Hardening `yaml:"hardening"`
+		// Hooks are shell commands run around core installs and updates.
+		Hooks struct {
+			PreUpdate  string `yaml:"pre_update"`
+			PostUpdate string `yaml:"post_update"`
+			OnFailure  string `yaml:"on_failure"`
+		} `yaml:"hooks"`
+		// Install overrides where xray-core's files live; empty fields keep the
+		// agent's defaults. `core --action adopt` fills them in for an install
+		// made by another script.
+		Install struct {
+			BinDir      string `yaml:"bin_dir"`
+			ConfigPath  string `yaml:"config_path"`
+			ShareDir    string `yaml:"share_dir"`
+			ServicePath string `yaml:"service_path"`
+			// VersionsDir keeps every installed release under <version>/xray,
+			// with bin_dir/xray linking to the active one; KeepVersions is
+			// how many are kept for `core --action rollback`.
+			VersionsDir  string `yaml:"versions_dir"`
+			KeepVersions int    `yaml:"keep_versions"`
+		} `yaml:"install"`
+		// Render makes the agent rebuild the whole xray config from Template and
+		// the state's render values on every sync, for inbounds, transports
+		// and policies the API cannot change. Empty edits the config in place.
+		Render struct {
+			Template string `yaml:"template"`
+		} `yaml:"render"`
 	} `yaml:"xray"`
 
 	GitHub struct {
 		Token string `yaml:"token"`
+		// TokenFile reads Token from a file, like control.token_file.
+		TokenFile string `yaml:"token_file"`
+		// Repo, AssetName and DgstOptional describe where xray-core releases
+		// come from, for forks and alternative builds; empty keeps
+		// XTLS/Xray-core and Xray-{arch}.zip.
+		Repo         string `yaml:"repo"`
+		AssetName    string `yaml:"asset_name"`
+		DgstOptional bool   `yaml:"dgst_optional"`
+		// Mirrors are fallback download sources for xray-core release assets.
+		Mirrors []string `yaml:"mirrors"`
+		// MinisignKey is a minisign public key release zips must be signed
+		// with (a <zip>.minisig asset); empty checks only the .dgst checksum.
+		MinisignKey string `yaml:"minisign_key"`
+		// DownloadProxy routes GitHub API calls and asset downloads through an
+		// http(s):// or socks5(h):// proxy; empty honours HTTP_PROXY/HTTPS_PROXY.
+		DownloadProxy string `yaml:"download_proxy"`
+		// DownloadTimeoutSec aborts a release download that received no data
+		// for this long (default 60); slow but moving downloads never time out.
+		DownloadTimeoutSec int `yaml:"download_timeout_sec"`
 	} `yaml:"github"`
 
 	Intervals struct {
@@ -50,32 +304,569 @@ type Config struct {
 		HeartbeatSec int `yaml:"heartbeat_sec"`
 		MetricsSec   int `yaml:"metrics_sec"`
 		CoreCheckSec int `yaml:"core_check_sec"`
+		// ReconcileSec is how often the users xray actually holds are
+		// checked against the applied state and missing ones added again
+		// (default 300, negative disables).
+		ReconcileSec int `yaml:"reconcile_sec"`
+		// ReportSec paces the combined report that replaces the heartbeat,
+		// stats and metrics pushes when the panel enables combined_report
+		// (default heartbeat_sec).
+		ReportSec int `yaml:"report_sec"`
+		// StartupJitterSec delays the first run of every loop by a random
+		// amount up to this many seconds (0 disables).
+		StartupJitterSec int `yaml:"startup_jitter_sec"`
+		// JitterPercent spreads each run by up to this share of its interval
+		// in either direction (default 10, negative disables, at most 50).
+		JitterPercent int `yaml:"jitter_percent"`
 	} `yaml:"intervals"`
 
+	Service struct {
+		// Init selects the init system for installed services: auto, systemd,
+		// openrc, sysvinit, or none to have the agent run xray as a child process.
+		Init string `yaml:"init"`
+		// XrayBinary and XrayConfig are what the agent launches when Init is none.
+		XrayBinary string `yaml:"xray_binary"`
+		XrayConfig string `yaml:"xray_config"`
+		// User is the unprivileged account the agent service runs as, set
+		// by `setup --user`; empty runs it as root.
+		User string `yaml:"user"`
+		// Hardening is rendered into the agent's systemd unit by setup.
+		Hardening Hardening `yaml:"hardening"`
+	} `yaml:"service"`
+
+	// Secrets configures how encrypted config values are opened. Tokens
+	// may be ASCII-armored age files, and the whole file may be encrypted
+	// with sops.
+	Secrets struct {
+		AgeKeyFile string `yaml:"age_key_file"`
+	} `yaml:"secrets"`
+
+	Storage struct {
+		Dir string `yaml:"dir"`
+		// AssetCacheDir keeps verified xray-core release zips so reinstalls
+		// and geodata updates skip the download; AssetCacheKeep is how many
+		// (default 3, negative disables the cache).
+		AssetCacheDir  string `yaml:"asset_cache_dir"`
+		AssetCacheKeep int    `yaml:"asset_cache_keep"`
+	} `yaml:"storage"`
+
+	// Assist lets the panel open a reverse SSH tunnel to a bastion for
+	// emergency access. It is off unless explicitly enabled.
+	Assist struct {
+		Enabled        bool   `yaml:"enabled"`
+		SSHBinary      string `yaml:"ssh_binary"`
+		KeyFile        string `yaml:"key_file"`
+		LocalAddr      string `yaml:"local_addr"`
+		MaxDurationSec int    `yaml:"max_duration_sec"`
+	} `yaml:"assist"`
+
+	// Speedtest is where the SPEEDTEST command downloads from and uploads
+	// to. Each direction stops after TimeoutSec.
+	Speedtest struct {
+		DownloadURL string `yaml:"download_url"`
+		UploadURL   string `yaml:"upload_url"`
+		UploadMB    int    `yaml:"upload_mb"`
+		TimeoutSec  int    `yaml:"timeout_sec"`
+	} `yaml:"speedtest"`
+
+	// Certificates are TLS certificates the panel hands out in the state.
+	// Each domain is written to <dir>/<domain>.crt and .key unless Paths
+	// names other files, which the xray config's inbounds then refer to.
+	Certificates struct {
+		Dir   string                     `yaml:"dir"`
+		Paths map[string]CertificatePath `yaml:"paths"`
+	} `yaml:"certificates"`
+
+	// ACME issues and renews certificates for Domains, and for the domains the
+	// panel lists in the state, answering HTTP-01 challenges on HTTPAddr or
+	// through files under Webroot, or TLS-ALPN-01 challenges on TLSAddr.
+	// Certificates are written like panel bundles (see Certificates). It is
+	// off unless explicitly enabled.
+	ACME struct {
+		Enabled          bool     `yaml:"enabled"`
+		Email            string   `yaml:"email"`
+		Directory        string   `yaml:"directory"`
+		AccountKeyFile   string   `yaml:"account_key_file"`
+		Domains          []string `yaml:"domains"`
+		Challenge        string   `yaml:"challenge"`
+		HTTPAddr         string   `yaml:"http_addr"`
+		Webroot          string   `yaml:"webroot"`
+		TLSAddr          string   `yaml:"tls_addr"`
+		RenewBeforeDays  int      `yaml:"renew_before_days"`
+		CheckIntervalSec int      `yaml:"check_interval_sec"`
+	} `yaml:"acme"`
+
+	// Commands.Allow lists the remote command types (e.g. RESTART_CORE,
+	// ROTATE_LOGS) the agent executes; empty allows every type it knows.
+	Commands struct {
+		Allow []string `yaml:"allow"`
+	} `yaml:"commands"`
+
+	// Features forces the panel's feature flags on or off on this node,
+	// whatever its rollout percentage.
+	Features map[string]bool `yaml:"features"`
+
+	// Metrics.Interfaces picks the network interfaces bandwidth is measured
+	// on. Entries are shell patterns such as "eth*". Without Include the
+	// interface of the default route is used, or every non-loopback
+	// interface when there is none.
+	Metrics struct {
+		Interfaces struct {
+			Include []string `yaml:"include"`
+			Exclude []string `yaml:"exclude"`
+		} `yaml:"interfaces"`
+		// IPv6Probe is the host:port a TCP connection is opened to over
+		// IPv6 to tell whether IPv6 egress works; "none" also stops
+		// reporting the node's public addresses.
+		IPv6Probe string `yaml:"ipv6_probe"`
+		// Alerts raise an alert event when a sampled metric stays above a
+		// threshold, and a resolved event once it drops back. Webhook also
+		// receives them, for nodes whose panel does not alert.
+		Alerts struct {
+			Rules   []AlertRule `yaml:"rules"`
+			Webhook string      `yaml:"webhook"`
+		} `yaml:"alerts"`
+	} `yaml:"metrics"`
+
+	// Admin.Socket is the unix socket of the local admin API that `top` and
+	// other CLI commands query; "none" disables it. Listen also serves the
+	// API on a loopback address for other tooling, which must send Token as
+	// a bearer token.
+	Admin struct {
+		Socket    string `yaml:"socket"`
+		Listen    string `yaml:"listen"`
+		Token     string `yaml:"token"`
+		TokenFile string `yaml:"token_file"`
+	} `yaml:"admin"`
+
+	// Debug.Listen serves pprof and expvar on a loopback address; empty
+	// disables the debug server.
+	Debug struct {
+		Listen string `yaml:"listen"`
+	} `yaml:"debug"`
+
+	// Events sends an activity feed of notable moments (state applied or
+	// failing, core updated or crashed, storage full) to the panel.
+	Events struct {
+		Enabled bool `yaml:"enabled"`
+	} `yaml:"events"`
+
+	// Audit appends every user, route and outbound change applied to xray
+	// to File as JSON lines, with the state version that caused it. Remote
+	// also delivers the entries to the panel after each sync.
+	Audit struct {
+		Enabled bool   `yaml:"enabled"`
+		File    string `yaml:"file"`
+		Remote  bool   `yaml:"remote"`
+	} `yaml:"audit"`
+
+	// AccessLog tails xray's access log and pushes per-user connection
+	// counts, destinations and rejections to the panel every IntervalSec.
+	// Destinations (full, domain or none) and Sources (full, masked or
+	// none) decide how much of them leaves the node.
+	AccessLog struct {
+		Enabled bool `yaml:"enabled"`
+		// Path defaults to log.access of the xray config.
+		Path                string   `yaml:"path"`
+		IntervalSec         int      `yaml:"interval_sec"`
+		Destinations        string   `yaml:"destinations"`
+		TopDestinations     int      `yaml:"top_destinations"`
+		ExcludeDestinations []string `yaml:"exclude_destinations"`
+		Sources             string   `yaml:"sources"`
+	} `yaml:"access_log"`
+
+	// Abuse reads the same access log for connections to TorrentPorts, to
+	// the BlockedOutbounds the routing sends forbidden traffic to, and for
+	// more than MaxConnectionsPerMin new connections a minute, and reports
+	// users with at least MinHits of a kind every IntervalSec. AutoBlock
+	// routes an offender's traffic to BlockOutbound for BlockSec.
+	Abuse struct {
+		Enabled              bool     `yaml:"enabled"`
+		IntervalSec          int      `yaml:"interval_sec"`
+		TorrentPorts         PortList `yaml:"torrent_ports"`
+		BlockedOutbounds     []string `yaml:"blocked_outbounds"`
+		MaxConnectionsPerMin int      `yaml:"max_connections_per_min"`
+		MinHits              int      `yaml:"min_hits"`
+		AutoBlock            bool     `yaml:"auto_block"`
+		BlockOutbound        string   `yaml:"block_outbound"`
+		BlockSec             int      `yaml:"block_sec"`
+	} `yaml:"abuse"`
+
+	// Ban counts the connections xray rejects per client address, such as
+	// probes and clients with a wrong id, and bans an address for BanSec
+	// once it had MaxFailures of them within FindTimeSec. Addresses in
+	// Ignore (IPs or CIDRs) are never banned. Bans and unbans are reported
+	// every IntervalSec.
+	Ban struct {
+		Enabled     bool     `yaml:"enabled"`
+		MaxFailures int      `yaml:"max_failures"`
+		FindTimeSec int      `yaml:"find_time_sec"`
+		BanSec      int      `yaml:"ban_sec"`
+		Ignore      []string `yaml:"ignore"`
+		IntervalSec int      `yaml:"interval_sec"`
+		// Method is nftables (the default) or xray.
+		Method string `yaml:"method"`
+		// NFTBinary and NFTTable are used by the nftables method; the agent
+		// owns the table and replaces it at startup.
+		NFTBinary string `yaml:"nft_binary"`
+		NFTTable  string `yaml:"nft_table"`
+		// BlockOutbound is where the xray method routes banned addresses;
+		// empty uses abuse.block_outbound.
+		BlockOutbound string `yaml:"block_outbound"`
+	} `yaml:"ban"`
+
+	// UsageHistory writes the usage read from the core to daily JSON-lines
+	// files in Dir, whether or not the panel accepted it, and deletes the
+	// days older than RetentionDays.
+	UsageHistory struct {
+		Enabled       bool   `yaml:"enabled"`
+		Dir           string `yaml:"dir"`
+		RetentionDays int    `yaml:"retention_days"`
+	} `yaml:"usage_history"`
+
+	// BandwidthCap counts the node's traffic on the interfaces metrics
+	// measures, from ResetDay (1-28, UTC) of each month. Once it reaches
+	// LimitGB (10^9 bytes, as providers bill) the agent routes traffic to
+	// BlockOutbound until the next reset day: that of every inbound but
+	// ExemptInbounds with Action inbounds, all of it with blackhole.
+	BandwidthCap struct {
+		Enabled  bool    `yaml:"enabled"`
+		LimitGB  float64 `yaml:"limit_gb"`
+		ResetDay int     `yaml:"reset_day"`
+		// Direction is total (the default), out or in.
+		Direction      string   `yaml:"direction"`
+		Action         string   `yaml:"action"`
+		ExemptInbounds []string `yaml:"exempt_inbounds"`
+		// BlockOutbound defaults to abuse.block_outbound.
+		BlockOutbound string `yaml:"block_outbound"`
+		IntervalSec   int    `yaml:"interval_sec"`
+	} `yaml:"bandwidth_cap"`
+
+	// GeoIP adds the country and AS of client addresses to the online users
+	// and stats pushes. Files are geoip.dat or MaxMind DB (.mmdb) files; for
+	// each field the first file that has it wins. Empty uses the geoip.dat
+	// in xray's share dir.
+	GeoIP struct {
+		Enabled bool     `yaml:"enabled"`
+		Files   []string `yaml:"files"`
+	} `yaml:"geoip"`
+
 	Logging struct {
-		Level string `yaml:"level"`
+		Level      string `yaml:"level"`
+		Format     string `yaml:"format"`
+		Output     string `yaml:"output"`
+		File       string `yaml:"file"`
+		MaxSizeMB  int    `yaml:"max_size_mb"`
+		MaxAgeDays int    `yaml:"max_age_days"`
+		MaxBackups int    `yaml:"max_backups"`
+		Remote     struct {
+			Enabled     bool   `yaml:"enabled"`
+			Level       string `yaml:"level"`
+			IntervalSec int    `yaml:"interval_sec"`
+			BatchSize   int    `yaml:"batch_size"`
+			BufferSize  int    `yaml:"buffer_size"`
+		} `yaml:"remote"`
 	} `yaml:"logging"`
+
+	// Profiles are named overlays, e.g. a staging control endpoint, selected
+	// with `run --profile`. Each holds any part of this file and is merged over
+	// it; see LoadProfile.
+	Profiles map[string]yaml.Node `yaml:"profiles,omitempty"`
+	// Profile is the name of the profile that was applied, if any.
+	Profile string `yaml:"-"`
+	// SOPS reports that the file is sops-encrypted. It is decrypted in
+	// memory only, so it must never be written back.
+	SOPS bool `yaml:"-"`
+
+	// sealed keeps secrets as the file had them; see Sealed.
+	sealed map[string]sealedSecret
+}
+
+// AlertRule fires when Metric is above Above in every sample for ForSec
+// seconds (0 fires on the first such sample).
+type AlertRule struct {
+	Metric string  `yaml:"metric"`
+	Above  float64 `yaml:"above"`
+	ForSec int     `yaml:"for_sec"`
+}
+
+// AlertMetrics are the metrics an AlertRule can watch. disk_percent is the
+// fullest of the sampled filesystems.
+var AlertMetrics = []string{"cpu_percent", "memory_percent", "bandwidth_up_mbps", "bandwidth_down_mbps", "disk_percent", "load1"}
+
+// Hardening is optional sandboxing and restart backoff for a systemd unit.
+// Empty fields keep what the unit ships with; OpenRC and sysvinit ignore it.
+type Hardening struct {
+	// ProtectSystem mounts /usr and /boot (true), also /etc (full) or the
+	// whole file system (strict) read-only.
+	ProtectSystem   string `yaml:"protect_system"`
+	NoNewPrivileges *bool  `yaml:"no_new_privileges"`
+	// MemoryMax is a hard memory cap, e.g. 512M or 50%.
+	MemoryMax string `yaml:"memory_max"`
+	// RestartSec is the delay before a restart. With RestartMaxDelaySec it
+	// grows to that delay over RestartSteps restarts (systemd 254+).
+	RestartSec         int `yaml:"restart_sec"`
+	RestartMaxDelaySec int `yaml:"restart_max_delay_sec"`
+	RestartSteps       int `yaml:"restart_steps"`
+}
+
+// Directives returns h as systemd [Service] directives.
+func (h Hardening) Directives() map[string]string {
+	d := map[string]string{}
+	if h.ProtectSystem != "" {
+		d["ProtectSystem"] = h.ProtectSystem
+	}
+	if h.NoNewPrivileges != nil {
+		d["NoNewPrivileges"] = "no"
+		if *h.NoNewPrivileges {
+			d["NoNewPrivileges"] = "yes"
+		}
+	}
+	if h.MemoryMax != "" {
+		d["MemoryMax"] = h.MemoryMax
+	}
+	if h.RestartSec > 0 {
+		d["RestartSec"] = strconv.Itoa(h.RestartSec)
+	}
+	if h.RestartMaxDelaySec > 0 {
+		d["RestartMaxDelaySec"] = strconv.Itoa(h.RestartMaxDelaySec)
+		d["RestartSteps"] = strconv.Itoa(cmp.Or(h.RestartSteps, DefaultRestartSteps))
+	}
+	return d
+}
+
+func (h Hardening) validate(name string) error {
+	switch h.ProtectSystem {
+	case "", "true", "false", "full", "strict":
+	default:
+		return fmt.Errorf("%s.protect_system must be true, false, full or strict, got %q", name, h.ProtectSystem)
+	}
+	if h.RestartSec < 0 || h.RestartMaxDelaySec < 0 || h.RestartSteps < 0 {
+		return fmt.Errorf("%s restart settings must not be negative", name)
+	}
+	if h.RestartMaxDelaySec > 0 && h.RestartMaxDelaySec < h.RestartSec {
+		return fmt.Errorf("%s.restart_max_delay_sec must be at least restart_sec", name)
+	}
+	return nil
+}
+
+// CertificatePath is where one domain's certificate chain and key go.
+type CertificatePath struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+}
+
+// PortList holds ports and port ranges such as "6881-6889".
+type PortList []string
+
+// Contains reports whether port is in one of the entries.
+func (l PortList) Contains(port int) bool {
+	for _, entry := range l {
+		lo, hi, _ := portRange(entry)
+		if port >= lo && port <= hi {
+			return true
+		}
+	}
+	return false
+}
+
+func (l PortList) validate(name string) error {
+	for _, entry := range l {
+		if _, _, err := portRange(entry); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func portRange(entry string) (lo, hi int, err error) {
+	from, to, isRange := strings.Cut(strings.TrimSpace(entry), "-")
+	lo, err = strconv.Atoi(strings.TrimSpace(from))
+	hi = lo
+	if err == nil && isRange {
+		hi, err = strconv.Atoi(strings.TrimSpace(to))
+	}
+	if err != nil || lo < 1 || hi > 65535 || lo > hi {
+		return 0, -1, fmt.Errorf("bad port or range %q", entry)
+	}
+	return lo, hi, nil
+}
+
+// URLList is a list of URLs that may be written as a single string.
+type URLList []string
+
+func (l *URLList) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		var url string
+		if err := node.Decode(&url); err != nil {
+			return err
+		}
+		*l = nil
+		if url != "" {
+			*l = URLList{url}
+		}
+		return nil
+	}
+	var urls []string
+	if err := node.Decode(&urls); err != nil {
+		return err
+	}
+	*l = urls
+	return nil
+}
+
+// MarshalYAML writes a single URL as a plain string, as older agents expect.
+func (l URLList) MarshalYAML() (any, error) {
+	switch len(l) {
+	case 0:
+		return "", nil
+	case 1:
+		return l[0], nil
+	}
+	return []string(l), nil
+}
+
+// Primary returns the first URL, or "" when there is none.
+func (l URLList) Primary() string {
+	if len(l) == 0 {
+		return ""
+	}
+	return l[0]
 }
 
 func Load(path string) (*Config, error) {
+	return LoadProfile(path, "")
+}
+
+// LoadProfile reads path with the named profile merged over the top-level
+// settings: mappings merge key by key, while scalars and lists replace the
+// top-level value. Defaults and checks apply to the merged result. An empty
+// name loads the top-level settings only.
+func LoadProfile(path, profile string) (*Config, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
+	if data, err = toYAML(path, data); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	encrypted := isSOPS(data)
+	if encrypted {
+		if data, err = SOPSDecrypt(path); err != nil {
+			return nil, err
+		}
+	}
 
 	var cfg Config
 	if err := yaml.Unmarshal(data, &cfg); err != nil {
 		return nil, err
 	}
+	cfg.SOPS = encrypted
+	if profile != "" {
+		overlay, ok := cfg.Profiles[profile]
+		if !ok {
+			return nil, fmt.Errorf("profile %q not found in %s", profile, path)
+		}
+		if err := overlay.Decode(&cfg); err != nil {
+			return nil, fmt.Errorf("profile %s: %w", profile, err)
+		}
+		cfg.Profile = profile
+	}
+	if err := resolveSecrets(&cfg); err != nil {
+		return nil, err
+	}
 
-	if cfg.Control.BaseURL == "" || cfg.Control.Token == "" || cfg.Control.ServerSlug == "" {
+	switch cfg.Control.Transport {
+	case "":
+		cfg.Control.Transport = TransportHTTP
+	case TransportHTTP, TransportMQTT:
+	default:
+		return nil, fmt.Errorf("control.transport must be http or mqtt, got %q", cfg.Control.Transport)
+	}
+	if cfg.Control.Transport == TransportMQTT {
+		if cfg.Control.MQTT.Broker == "" || cfg.Control.Token == "" || cfg.Control.ServerSlug == "" {
+			return nil, errors.New("control.mqtt.broker/token/server_slug required with control.transport mqtt")
+		}
+		if strings.ContainsAny(cfg.Control.ServerSlug, "/+#") {
+			return nil, fmt.Errorf("control.server_slug %q cannot be used in mqtt topics", cfg.Control.ServerSlug)
+		}
+		if cfg.Control.MQTT.Username == "" {
+			cfg.Control.MQTT.Username = cfg.Control.ServerSlug
+		}
+		if cfg.Control.MQTT.TopicPrefix == "" {
+			cfg.Control.MQTT.TopicPrefix = DefaultMQTTTopicPrefix
+		}
+		if cfg.Control.MQTT.KeepAliveSec <= 0 {
+			cfg.Control.MQTT.KeepAliveSec = DefaultMQTTKeepAliveSec
+		}
+	} else if len(cfg.Control.BaseURL) == 0 || cfg.Control.Token == "" || cfg.Control.ServerSlug == "" {
 		return nil, errors.New("control.base_url/token/server_slug required")
 	}
-	if cfg.Xray.APIServer == "" {
+	if slices.Contains(cfg.Control.BaseURL, "") {
+		return nil, errors.New("control.base_url must not contain empty entries")
+	}
+	switch cfg.Backend {
+	case "":
+		cfg.Backend = BackendXray
+	case BackendXray, BackendSingBox:
+	default:
+		return nil, fmt.Errorf("backend must be xray or sing-box, got %q", cfg.Backend)
+	}
+	if p := cfg.GitHub.DownloadProxy; p != "" {
+		u, err := url.Parse(p)
+		if err != nil || u.Host == "" || !slices.Contains([]string{"http", "https", "socks5", "socks5h"}, u.Scheme) {
+			return nil, fmt.Errorf("github.download_proxy must be an http, https, socks5 or socks5h URL, got %q", p)
+		}
+	}
+	if cfg.Xray.APIServer == "" && cfg.Backend == BackendXray {
 		return nil, errors.New("xray.api_server required")
 	}
-	if cfg.Xray.InboundTags.VLESS == "" || cfg.Xray.InboundTags.VMESS == "" || cfg.Xray.InboundTags.TROJAN == "" {
-		return nil, fmt.Errorf("xray.inbound_tags (vless/vmess/trojan) required")
+	if cfg.SingBox.Binary == "" {
+		cfg.SingBox.Binary = DefaultSingBoxBinary
+	}
+	if cfg.SingBox.Config == "" {
+		cfg.SingBox.Config = DefaultSingBoxConfig
+	}
+	if cfg.SingBox.Service == "" {
+		cfg.SingBox.Service = DefaultSingBoxService
+	}
+	if cfg.SingBox.APIServer == "" {
+		cfg.SingBox.APIServer = DefaultSingBoxAPI
+	}
+	// The xray backend discovers missing tags from the core at startup.
+	if cfg.Backend == BackendSingBox && (cfg.Xray.InboundTags.VLESS == "" || cfg.Xray.InboundTags.VMESS == "" || cfg.Xray.InboundTags.TROJAN == "") {
+		return nil, fmt.Errorf("xray.inbound_tags (vless/vmess/trojan) required with the sing-box backend")
+	}
+	if tls := cfg.Xray.APITLS; (tls.CertFile == "") != (tls.KeyFile == "") {
+		return nil, errors.New("xray.api_tls.cert_file and key_file must be set together")
+	}
+	if cfg.Xray.APIToken != "" && !cfg.Xray.APITLS.Enabled {
+		return nil, errors.New("xray.api_token requires xray.api_tls.enabled")
+	}
+	if cfg.Xray.APIRateLimit < 0 || cfg.Xray.APIRateBurst < 0 {
+		return nil, errors.New("xray.api_rate_limit and api_rate_burst must not be negative")
+	}
+	switch cfg.Xray.RouteApply {
+	case "":
+		cfg.Xray.RouteApply = RouteApplyIncremental
+	case RouteApplyIncremental, RouteApplyReplace:
+	default:
+		return nil, fmt.Errorf("xray.route_apply must be incremental or replace, got %q", cfg.Xray.RouteApply)
+	}
+	switch cfg.Control.HeartbeatFormat {
+	case "":
+		cfg.Control.HeartbeatFormat = HeartbeatFormatEmpty
+	case HeartbeatFormatEmpty, HeartbeatFormatV1:
+	default:
+		return nil, fmt.Errorf("control.heartbeat_format must be empty or v1, got %q", cfg.Control.HeartbeatFormat)
+	}
+	if cfg.Control.MaxRetryAfterSec == 0 {
+		cfg.Control.MaxRetryAfterSec = DefaultMaxRetryAfterSec
+	} else if cfg.Control.MaxRetryAfterSec < 0 {
+		return nil, errors.New("control.max_retry_after_sec must not be negative")
+	}
+	if cfg.Control.MaxClockSkewSec == 0 {
+		cfg.Control.MaxClockSkewSec = DefaultMaxClockSkewSec
 	}
 	if cfg.Intervals.StateSec == 0 {
 		cfg.Intervals.StateSec = DefaultStateIntervalSec
@@ -95,11 +886,337 @@ func Load(path string) (*Config, error) {
 	if cfg.Intervals.CoreCheckSec == 0 {
 		cfg.Intervals.CoreCheckSec = DefaultCoreCheckIntervalSec
 	}
+	if cfg.Intervals.ReconcileSec == 0 {
+		cfg.Intervals.ReconcileSec = DefaultReconcileIntervalSec
+	}
+	if cfg.Intervals.ReportSec <= 0 {
+		cfg.Intervals.ReportSec = cfg.Intervals.HeartbeatSec
+	}
+	if cfg.Intervals.StartupJitterSec < 0 {
+		return nil, fmt.Errorf("intervals.startup_jitter_sec must not be negative, got %d", cfg.Intervals.StartupJitterSec)
+	}
+	if cfg.Intervals.JitterPercent == 0 {
+		cfg.Intervals.JitterPercent = DefaultJitterPercent
+	}
+	if cfg.Intervals.JitterPercent > 50 {
+		return nil, fmt.Errorf("intervals.jitter_percent must be at most 50, got %d", cfg.Intervals.JitterPercent)
+	}
+	if cfg.Xray.StatsCheckpointSec == 0 {
+		cfg.Xray.StatsCheckpointSec = DefaultStatsCheckpointSec
+	}
 	if cfg.Xray.APITimeoutSec <= 0 {
 		cfg.Xray.APITimeoutSec = DefaultAPITimeoutSec
 	}
+	if cfg.Xray.ApplyWorkers <= 0 {
+		cfg.Xray.ApplyWorkers = DefaultApplyWorkers
+	}
 	if cfg.Xray.Version == "" {
 		cfg.Xray.Version = DefaultXrayVersion
 	}
+	switch cfg.Logging.Format {
+	case "":
+		cfg.Logging.Format = "text"
+	case "text", "json":
+	default:
+		return nil, fmt.Errorf("logging.format must be text or json, got %q", cfg.Logging.Format)
+	}
+	for i, r := range cfg.Metrics.Alerts.Rules {
+		if !slices.Contains(AlertMetrics, r.Metric) {
+			return nil, fmt.Errorf("metrics.alerts.rules[%d].metric must be one of %s, got %q", i, strings.Join(AlertMetrics, ", "), r.Metric)
+		}
+		if r.ForSec < 0 {
+			return nil, fmt.Errorf("metrics.alerts.rules[%d].for_sec must not be negative", i)
+		}
+	}
+	if err := cfg.Service.Hardening.validate("service.hardening"); err != nil {
+		return nil, err
+	}
+	if err := cfg.Xray.Hardening.validate("xray.hardening"); err != nil {
+		return nil, err
+	}
+	if h := cfg.Metrics.Alerts.Webhook; h != "" {
+		if u, err := url.Parse(h); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, errors.New("metrics.alerts.webhook must be an http or https URL")
+		}
+	}
+	if cfg.Audit.File == "" {
+		cfg.Audit.File = DefaultAuditFile
+	}
+	switch cfg.Logging.Output {
+	case "", "stdout", "journald", "syslog":
+	case "file":
+		if cfg.Logging.File == "" {
+			return nil, errors.New("logging.file required when logging.output is file")
+		}
+	default:
+		return nil, fmt.Errorf("logging.output must be stdout, file, journald or syslog, got %q", cfg.Logging.Output)
+	}
+	switch cfg.Logging.Remote.Level {
+	case "":
+		cfg.Logging.Remote.Level = DefaultLogShipLevel
+	case "debug", "info", "warn", "error":
+	default:
+		return nil, fmt.Errorf("logging.remote.level must be debug, info, warn or error, got %q", cfg.Logging.Remote.Level)
+	}
+	if cfg.Logging.Remote.IntervalSec <= 0 {
+		cfg.Logging.Remote.IntervalSec = DefaultLogShipIntervalSec
+	}
+	if cfg.Logging.Remote.BatchSize <= 0 {
+		cfg.Logging.Remote.BatchSize = DefaultLogShipBatchSize
+	}
+	if cfg.Logging.Remote.BufferSize <= 0 {
+		cfg.Logging.Remote.BufferSize = DefaultLogShipBufferSize
+	}
+	switch cfg.Service.Init {
+	case "":
+		cfg.Service.Init = DefaultServiceInit
+	case "auto", "systemd", "openrc", "sysvinit", ServiceInitNone:
+	default:
+		return nil, fmt.Errorf("service.init must be auto, systemd, openrc, sysvinit or none, got %q", cfg.Service.Init)
+	}
+	if cfg.Xray.Limits.NoFile <= 0 {
+		cfg.Xray.Limits.NoFile = DefaultXrayNoFile
+	}
+	if cfg.Xray.Limits.NProc < 0 {
+		return nil, fmt.Errorf("xray.limits.nproc must not be negative, got %d", cfg.Xray.Limits.NProc)
+	}
+	if cfg.Service.XrayBinary == "" {
+		cfg.Service.XrayBinary = DefaultXrayBinary
+	}
+	if cfg.Service.XrayConfig == "" {
+		cfg.Service.XrayConfig = DefaultXrayConfigPath
+	}
+	if cfg.Storage.Dir == "" {
+		cfg.Storage.Dir = DefaultStorageDir
+	}
+	if cfg.Storage.AssetCacheDir == "" {
+		cfg.Storage.AssetCacheDir = DefaultAssetCacheDir
+	}
+	if cfg.Control.MaintenanceToken != "" && cfg.Control.MaintenanceTokenExpiresAt.IsZero() {
+		return nil, errors.New("control.maintenance_token requires control.maintenance_token_expires_at")
+	}
+	if cfg.Control.MaintenanceTokenFile == "" {
+		cfg.Control.MaintenanceTokenFile = filepath.Join(cfg.Storage.Dir, DefaultMaintenanceTokenName)
+	}
+	if cfg.Assist.SSHBinary == "" {
+		cfg.Assist.SSHBinary = DefaultAssistSSHBinary
+	}
+	if cfg.Assist.KeyFile == "" {
+		cfg.Assist.KeyFile = filepath.Join(cfg.Storage.Dir, DefaultAssistKeyName)
+	}
+	if cfg.Assist.LocalAddr == "" {
+		cfg.Assist.LocalAddr = DefaultAssistLocalAddr
+	}
+	if cfg.Assist.MaxDurationSec <= 0 {
+		cfg.Assist.MaxDurationSec = DefaultAssistMaxDurationSec
+	}
+	if cfg.Speedtest.DownloadURL == "" {
+		cfg.Speedtest.DownloadURL = DefaultSpeedtestDownloadURL
+	}
+	if cfg.Speedtest.UploadURL == "" {
+		cfg.Speedtest.UploadURL = DefaultSpeedtestUploadURL
+	}
+	if cfg.Speedtest.UploadMB <= 0 {
+		cfg.Speedtest.UploadMB = DefaultSpeedtestUploadMB
+	}
+	if cfg.Speedtest.TimeoutSec <= 0 {
+		cfg.Speedtest.TimeoutSec = DefaultSpeedtestTimeoutSec
+	}
+	if cfg.Certificates.Dir == "" {
+		cfg.Certificates.Dir = DefaultCertificatesDir
+	}
+	for domain, p := range cfg.Certificates.Paths {
+		if p.Cert == "" || p.Key == "" {
+			return nil, fmt.Errorf("certificates.paths.%s needs both cert and key", domain)
+		}
+	}
+	for _, pattern := range slices.Concat(cfg.Metrics.Interfaces.Include, cfg.Metrics.Interfaces.Exclude) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("metrics.interfaces: bad pattern %q", pattern)
+		}
+	}
+	switch p := cfg.Metrics.IPv6Probe; p {
+	case "":
+		cfg.Metrics.IPv6Probe = DefaultIPv6Probe
+	case IPv6ProbeNone:
+	default:
+		if _, _, err := net.SplitHostPort(p); err != nil {
+			return nil, fmt.Errorf("metrics.ipv6_probe must be host:port or none, got %q", p)
+		}
+	}
+	if cfg.AccessLog.IntervalSec == 0 {
+		cfg.AccessLog.IntervalSec = DefaultAccessLogIntervalSec
+	} else if cfg.AccessLog.IntervalSec < 0 {
+		return nil, errors.New("access_log.interval_sec must not be negative")
+	}
+	if cfg.AccessLog.TopDestinations == 0 {
+		cfg.AccessLog.TopDestinations = DefaultAccessLogTopDestinations
+	}
+	switch cfg.AccessLog.Destinations {
+	case "":
+		cfg.AccessLog.Destinations = AccessLogDomain
+	case AccessLogFull, AccessLogDomain, AccessLogNone:
+	default:
+		return nil, fmt.Errorf("access_log.destinations must be full, domain or none, got %q", cfg.AccessLog.Destinations)
+	}
+	switch cfg.AccessLog.Sources {
+	case "":
+		cfg.AccessLog.Sources = AccessLogMasked
+	case AccessLogFull, AccessLogMasked, AccessLogNone:
+	default:
+		return nil, fmt.Errorf("access_log.sources must be full, masked or none, got %q", cfg.AccessLog.Sources)
+	}
+	for _, pattern := range cfg.AccessLog.ExcludeDestinations {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("access_log.exclude_destinations: bad pattern %q", pattern)
+		}
+	}
+	if cfg.Abuse.IntervalSec == 0 {
+		cfg.Abuse.IntervalSec = DefaultAbuseIntervalSec
+	} else if cfg.Abuse.IntervalSec < 0 {
+		return nil, errors.New("abuse.interval_sec must not be negative")
+	}
+	if cfg.Abuse.TorrentPorts == nil {
+		cfg.Abuse.TorrentPorts = PortList{"6881-6889", "6969", "51413"}
+	}
+	if err := cfg.Abuse.TorrentPorts.validate("abuse.torrent_ports"); err != nil {
+		return nil, err
+	}
+	if cfg.Abuse.BlockedOutbounds == nil {
+		cfg.Abuse.BlockedOutbounds = []string{"block", "blocked"}
+	}
+	if cfg.Abuse.MaxConnectionsPerMin == 0 {
+		cfg.Abuse.MaxConnectionsPerMin = DefaultAbuseMaxConnsPerMin
+	}
+	if cfg.Abuse.MinHits <= 0 {
+		cfg.Abuse.MinHits = DefaultAbuseMinHits
+	}
+	if cfg.Abuse.BlockOutbound == "" {
+		cfg.Abuse.BlockOutbound = DefaultAbuseBlockOutbound
+	}
+	if cfg.Abuse.BlockSec == 0 {
+		cfg.Abuse.BlockSec = DefaultAbuseBlockSec
+	} else if cfg.Abuse.BlockSec < 0 {
+		return nil, errors.New("abuse.block_sec must not be negative")
+	}
+	if cfg.Ban.MaxFailures <= 0 {
+		cfg.Ban.MaxFailures = DefaultBanMaxFailures
+	}
+	if cfg.Ban.FindTimeSec <= 0 {
+		cfg.Ban.FindTimeSec = DefaultBanFindTimeSec
+	}
+	if cfg.Ban.BanSec <= 0 {
+		cfg.Ban.BanSec = DefaultBanSec
+	}
+	if cfg.Ban.IntervalSec <= 0 {
+		cfg.Ban.IntervalSec = DefaultBanIntervalSec
+	}
+	for _, entry := range cfg.Ban.Ignore {
+		if _, err := netip.ParsePrefix(entry); err != nil {
+			if _, err := netip.ParseAddr(entry); err != nil {
+				return nil, fmt.Errorf("ban.ignore: %q is not an IP or CIDR", entry)
+			}
+		}
+	}
+	switch cfg.Ban.Method {
+	case "":
+		cfg.Ban.Method = BanNFTables
+	case BanNFTables, BanXray:
+	default:
+		return nil, fmt.Errorf("ban.method must be nftables or xray, got %q", cfg.Ban.Method)
+	}
+	if cfg.Ban.NFTBinary == "" {
+		cfg.Ban.NFTBinary = DefaultBanNFTBinary
+	}
+	if cfg.Ban.NFTTable == "" {
+		cfg.Ban.NFTTable = DefaultBanNFTTable
+	} else if strings.ContainsFunc(cfg.Ban.NFTTable, func(r rune) bool {
+		return r != '_' && (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') && (r < '0' || r > '9')
+	}) {
+		return nil, fmt.Errorf("ban.nft_table must be letters, digits and underscores, got %q", cfg.Ban.NFTTable)
+	}
+	if cfg.Ban.BlockOutbound == "" {
+		cfg.Ban.BlockOutbound = cfg.Abuse.BlockOutbound
+	}
+	if cfg.UsageHistory.Dir == "" {
+		cfg.UsageHistory.Dir = filepath.Join(cfg.Storage.Dir, DefaultUsageHistoryDirName)
+	}
+	if cfg.UsageHistory.RetentionDays < 0 {
+		return nil, fmt.Errorf("usage_history.retention_days must not be negative, got %d", cfg.UsageHistory.RetentionDays)
+	}
+	if cfg.UsageHistory.RetentionDays == 0 {
+		cfg.UsageHistory.RetentionDays = DefaultUsageHistoryRetentionDays
+	}
+	if cfg.BandwidthCap.Enabled && cfg.BandwidthCap.LimitGB <= 0 {
+		return nil, errors.New("bandwidth_cap.limit_gb must be positive")
+	}
+	if cfg.BandwidthCap.ResetDay == 0 {
+		cfg.BandwidthCap.ResetDay = DefaultBandwidthResetDay
+	} else if cfg.BandwidthCap.ResetDay < 1 || cfg.BandwidthCap.ResetDay > 28 {
+		return nil, fmt.Errorf("bandwidth_cap.reset_day must be 1-28, got %d", cfg.BandwidthCap.ResetDay)
+	}
+	switch cfg.BandwidthCap.Direction {
+	case "":
+		cfg.BandwidthCap.Direction = BandwidthTotal
+	case BandwidthTotal, BandwidthOut, BandwidthIn:
+	default:
+		return nil, fmt.Errorf("bandwidth_cap.direction must be total, out or in, got %q", cfg.BandwidthCap.Direction)
+	}
+	switch cfg.BandwidthCap.Action {
+	case "":
+		cfg.BandwidthCap.Action = BandwidthActionInbounds
+	case BandwidthActionInbounds, BandwidthActionBlackhole:
+	default:
+		return nil, fmt.Errorf("bandwidth_cap.action must be inbounds or blackhole, got %q", cfg.BandwidthCap.Action)
+	}
+	if cfg.BandwidthCap.BlockOutbound == "" {
+		cfg.BandwidthCap.BlockOutbound = cfg.Abuse.BlockOutbound
+	}
+	if cfg.BandwidthCap.IntervalSec <= 0 {
+		cfg.BandwidthCap.IntervalSec = DefaultBandwidthIntervalSec
+	}
+	if cfg.Admin.Socket == "" {
+		cfg.Admin.Socket = DefaultAdminSocket
+	}
+	if cfg.Admin.Listen != "" && cfg.Admin.Token == "" {
+		return nil, errors.New("admin.listen requires admin.token or admin.token_file")
+	}
+	if cfg.ACME.Directory == "" {
+		cfg.ACME.Directory = DefaultACMEDirectory
+	}
+	if cfg.ACME.AccountKeyFile == "" {
+		cfg.ACME.AccountKeyFile = filepath.Join(cfg.Storage.Dir, DefaultACMEAccountKeyName)
+	}
+	if cfg.ACME.HTTPAddr == "" {
+		cfg.ACME.HTTPAddr = DefaultACMEHTTPAddr
+	}
+	if cfg.ACME.TLSAddr == "" {
+		cfg.ACME.TLSAddr = DefaultACMETLSAddr
+	}
+	switch cfg.ACME.Challenge {
+	case "":
+		cfg.ACME.Challenge = ACMEChallengeHTTP01
+	case ACMEChallengeHTTP01:
+	case ACMEChallengeTLSALPN01:
+		if cfg.ACME.Webroot != "" {
+			return nil, errors.New("acme.webroot only applies to the http-01 challenge")
+		}
+	default:
+		return nil, fmt.Errorf("acme.challenge must be http-01 or tls-alpn-01, got %q", cfg.ACME.Challenge)
+	}
+	if cfg.ACME.RenewBeforeDays <= 0 {
+		cfg.ACME.RenewBeforeDays = DefaultACMERenewBeforeDays
+	}
+	if cfg.ACME.CheckIntervalSec <= 0 {
+		cfg.ACME.CheckIntervalSec = DefaultACMECheckIntervalSec
+	}
+	for _, domain := range cfg.ACME.Domains {
+		if strings.HasPrefix(domain, "*.") {
+			return nil, fmt.Errorf("acme.domains: %s: wildcard certificates need DNS-01, which is not supported", domain)
+		}
+	}
+	for i, name := range cfg.Commands.Allow {
+		cfg.Commands.Allow[i] = strings.ToUpper(strings.TrimSpace(name))
+	}
 	return &cfg, nil
 }
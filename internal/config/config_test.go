@@ -3,7 +3,10 @@ package config
 import (
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+
+	"gopkg.in/yaml.v3"
 )
 
 const baseYAML = `
@@ -52,6 +55,9 @@ intervals:
 	if cfg.Intervals.StateSec != 15 || cfg.Intervals.OnlineSec != 10 || cfg.Intervals.StatsSec != 60 || cfg.Intervals.HeartbeatSec != 30 || cfg.Intervals.MetricsSec != 30 || cfg.Intervals.CoreCheckSec != DefaultCoreCheckIntervalSec {
 		t.Fatalf("unexpected defaults: %+v", cfg.Intervals)
 	}
+	if cfg.Intervals.JitterPercent != DefaultJitterPercent || cfg.Intervals.StartupJitterSec != 0 {
+		t.Fatalf("unexpected jitter defaults: %+v", cfg.Intervals)
+	}
 	if cfg.Xray.APITimeoutSec != 5 {
 		t.Fatalf("expected default API timeout, got %d", cfg.Xray.APITimeoutSec)
 	}
@@ -69,3 +75,286 @@ xray: {}
 		t.Fatal("expected error for missing fields")
 	}
 }
+
+func TestLoadProfileMergesOverTopLevel(t *testing.T) {
+	path := writeConfig(t, baseYAML+`
+commands:
+  allow: ["RESTART_CORE", "ROTATE_LOGS"]
+logging:
+  level: info
+profiles:
+  staging:
+    control:
+      base_url: "https://staging.example.com"
+      token: "staging-token"
+    commands:
+      allow: ["ROTATE_LOGS"]
+    storage:
+      dir: /var/lib/xray-agent-staging
+`)
+
+	cfg, err := LoadProfile(path, "staging")
+	if err != nil {
+		t.Fatalf("LoadProfile: %v", err)
+	}
+	if cfg.Control.BaseURL.Primary() != "https://staging.example.com" || cfg.Control.Token != "staging-token" || cfg.Control.ServerSlug != "sg-1" {
+		t.Fatalf("control = %+v", cfg.Control)
+	}
+	if len(cfg.Commands.Allow) != 1 || cfg.Logging.Level != "info" || cfg.Storage.Dir != "/var/lib/xray-agent-staging" {
+		t.Fatalf("allow = %v, level = %q, storage = %q", cfg.Commands.Allow, cfg.Logging.Level, cfg.Storage.Dir)
+	}
+	if cfg.Profile != "staging" || cfg.Intervals.StateSec != DefaultStateIntervalSec {
+		t.Fatalf("profile = %q, state_sec = %d", cfg.Profile, cfg.Intervals.StateSec)
+	}
+
+	top, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if top.Control.BaseURL.Primary() != "https://panel.example.com" || len(top.Commands.Allow) != 2 || top.Profile != "" {
+		t.Fatalf("top-level config changed: %+v", top.Control)
+	}
+	if _, err := LoadProfile(path, "production"); err == nil {
+		t.Fatal("expected an error for an unknown profile")
+	}
+}
+
+func TestLoadAcceptsBaseURLList(t *testing.T) {
+	path := writeConfig(t, `
+control:
+  base_url:
+    - "https://panel-a.example.com"
+    - "https://panel-b.example.com"
+  token: "token"
+  server_slug: "sg-1"
+xray:
+  api_server: "127.0.0.1:10085"
+  inbound_tags: {vless: "vless", vmess: "vmess", trojan: "trojan"}
+`)
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if len(cfg.Control.BaseURL) != 2 || cfg.Control.BaseURL.Primary() != "https://panel-a.example.com" {
+		t.Fatalf("base_url = %v", cfg.Control.BaseURL)
+	}
+
+	single, err := Load(writeConfig(t, baseYAML))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	out, err := yaml.Marshal(single)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), "base_url: https://panel.example.com\n") {
+		t.Fatalf("single base_url not written as a string:\n%s", out)
+	}
+}
+
+func TestLoadBackend(t *testing.T) {
+	cfg, err := Load(writeConfig(t, baseYAML))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.Backend != BackendXray || cfg.SingBox.Config != DefaultSingBoxConfig {
+		t.Fatalf("backend = %q, sing_box.config = %q; want defaults", cfg.Backend, cfg.SingBox.Config)
+	}
+
+	noAPI := strings.Replace(baseYAML, `api_server: "127.0.0.1:10085"`, `api_server: ""`, 1)
+	if _, err := Load(writeConfig(t, noAPI)); err == nil {
+		t.Fatal("xray backend loaded without xray.api_server")
+	}
+	cfg, err = Load(writeConfig(t, noAPI+"backend: sing-box\n"))
+	if err != nil {
+		t.Fatalf("Load(sing-box): %v", err)
+	}
+	if cfg.SingBox.APIServer != DefaultSingBoxAPI {
+		t.Fatalf("sing_box.api_server = %q; want default", cfg.SingBox.APIServer)
+	}
+	if _, err := Load(writeConfig(t, baseYAML+"backend: v2ray\n")); err == nil {
+		t.Fatal("unknown backend accepted")
+	}
+}
+
+func TestLoadDownloadProxy(t *testing.T) {
+	if _, err := Load(writeConfig(t, baseYAML+"  download_proxy: socks5h://127.0.0.1:1080\n")); err != nil {
+		t.Fatalf("Load(socks5h proxy): %v", err)
+	}
+	for _, bad := range []string{"127.0.0.1:1080", "ftp://proxy.example"} {
+		if _, err := Load(writeConfig(t, baseYAML+"  download_proxy: "+bad+"\n")); err == nil {
+			t.Fatalf("download_proxy %q accepted", bad)
+		}
+	}
+}
+
+func TestLoadHardening(t *testing.T) {
+	cfg, err := Load(writeConfig(t, baseYAML+`service:
+  hardening:
+    protect_system: full
+    no_new_privileges: false
+    memory_max: 512M
+    restart_sec: 2
+    restart_max_delay_sec: 60
+`))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	want := map[string]string{
+		"ProtectSystem":      "full",
+		"NoNewPrivileges":    "no",
+		"MemoryMax":          "512M",
+		"RestartSec":         "2",
+		"RestartMaxDelaySec": "60",
+		"RestartSteps":       "10",
+	}
+	got := cfg.Service.Hardening.Directives()
+	if len(got) != len(want) {
+		t.Fatalf("Directives() = %v, want %v", got, want)
+	}
+	for key, value := range want {
+		if got[key] != value {
+			t.Fatalf("Directives()[%s] = %q, want %q", key, got[key], value)
+		}
+	}
+	if len(cfg.Xray.Hardening.Directives()) != 0 {
+		t.Fatalf("empty xray.hardening rendered %v", cfg.Xray.Hardening.Directives())
+	}
+
+	for _, bad := range []string{"    protect_system: readonly\n", "    restart_sec: 30\n    restart_max_delay_sec: 10\n"} {
+		if _, err := Load(writeConfig(t, baseYAML+"service:\n  hardening:\n"+bad)); err == nil {
+			t.Fatalf("service.hardening %q accepted", bad)
+		}
+	}
+}
+
+func TestLoadMQTTTransport(t *testing.T) {
+	noBase := strings.Replace(baseYAML, `  base_url: "https://panel.example.com"
+`, "", 1)
+	if _, err := Load(writeConfig(t, noBase)); err == nil {
+		t.Fatal("http transport loaded without control.base_url")
+	}
+	mqtt := strings.Replace(noBase, "  tls_insecure: false\n", "  tls_insecure: false\n  transport: mqtt\n  mqtt:\n    broker: tls://mqtt.example.com\n", 1)
+	cfg, err := Load(writeConfig(t, mqtt))
+	if err != nil {
+		t.Fatalf("Load(mqtt): %v", err)
+	}
+	if cfg.Control.MQTT.Username != "sg-1" || cfg.Control.MQTT.TopicPrefix != DefaultMQTTTopicPrefix || cfg.Control.MQTT.KeepAliveSec != DefaultMQTTKeepAliveSec {
+		t.Fatalf("mqtt defaults = %+v", cfg.Control.MQTT)
+	}
+	if _, err := Load(writeConfig(t, strings.Replace(mqtt, "    broker: tls://mqtt.example.com\n", "", 1))); err == nil {
+		t.Fatal("mqtt transport loaded without control.mqtt.broker")
+	}
+	if _, err := Load(writeConfig(t, strings.Replace(mqtt, "transport: mqtt", "transport: grpc", 1))); err == nil {
+		t.Fatal("unknown transport accepted")
+	}
+}
+
+func TestLoadAccessLog(t *testing.T) {
+	cfg, err := Load(writeConfig(t, baseYAML))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	al := cfg.AccessLog
+	if al.Destinations != AccessLogDomain || al.Sources != AccessLogMasked || al.IntervalSec != DefaultAccessLogIntervalSec || al.TopDestinations != DefaultAccessLogTopDestinations {
+		t.Fatalf("access_log defaults = %+v", al)
+	}
+	for _, bad := range []string{
+		"access_log:\n  destinations: hashed\n",
+		"access_log:\n  sources: domain\n",
+		"access_log:\n  exclude_destinations: [\"[\"]\n",
+	} {
+		if _, err := Load(writeConfig(t, baseYAML+bad)); err == nil {
+			t.Errorf("Load accepted %q", bad)
+		}
+	}
+}
+
+func TestLoadAbuse(t *testing.T) {
+	cfg, err := Load(writeConfig(t, baseYAML))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	ab := cfg.Abuse
+	if ab.IntervalSec != DefaultAbuseIntervalSec || ab.MinHits != DefaultAbuseMinHits || ab.BlockOutbound != DefaultAbuseBlockOutbound || ab.BlockSec != DefaultAbuseBlockSec {
+		t.Fatalf("abuse defaults = %+v", ab)
+	}
+	if !ab.TorrentPorts.Contains(6885) || !ab.TorrentPorts.Contains(51413) || ab.TorrentPorts.Contains(443) {
+		t.Fatalf("default torrent_ports = %v", ab.TorrentPorts)
+	}
+
+	cfg, err = Load(writeConfig(t, baseYAML+"abuse:\n  torrent_ports: []\n  blocked_outbounds: []\n"))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.Abuse.TorrentPorts.Contains(6881) || len(cfg.Abuse.BlockedOutbounds) != 0 {
+		t.Fatalf("empty lists were replaced by defaults: %+v", cfg.Abuse)
+	}
+
+	for _, bad := range []string{
+		"abuse:\n  torrent_ports: [\"6889-6881\"]\n",
+		"abuse:\n  torrent_ports: [\"70000\"]\n",
+		"abuse:\n  torrent_ports: [\"bt\"]\n",
+		"abuse:\n  block_sec: -1\n",
+	} {
+		if _, err := Load(writeConfig(t, baseYAML+bad)); err == nil {
+			t.Errorf("Load accepted %q", bad)
+		}
+	}
+}
+
+func TestLoadBan(t *testing.T) {
+	cfg, err := Load(writeConfig(t, baseYAML+"abuse:\n  block_outbound: blackhole\n"))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	b := cfg.Ban
+	if b.Method != BanNFTables || b.MaxFailures != DefaultBanMaxFailures || b.FindTimeSec != DefaultBanFindTimeSec || b.BanSec != DefaultBanSec ||
+		b.NFTBinary != DefaultBanNFTBinary || b.NFTTable != DefaultBanNFTTable || b.BlockOutbound != "blackhole" {
+		t.Fatalf("ban defaults = %+v", b)
+	}
+	for _, bad := range []string{
+		"ban:\n  method: iptables\n",
+		"ban:\n  ignore: [\"10.0.0.0/33\"]\n",
+		"ban:\n  nft_table: \"x; flush ruleset\"\n",
+	} {
+		if _, err := Load(writeConfig(t, baseYAML+bad)); err == nil {
+			t.Errorf("Load accepted %q", bad)
+		}
+	}
+}
+
+func TestLoadUsageHistory(t *testing.T) {
+	cfg, err := Load(writeConfig(t, baseYAML+"storage:\n  dir: /srv/agent\n"))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if h := cfg.UsageHistory; h.Dir != "/srv/agent/usage" || h.RetentionDays != DefaultUsageHistoryRetentionDays {
+		t.Fatalf("usage_history defaults = %+v", h)
+	}
+	if _, err := Load(writeConfig(t, baseYAML+"usage_history:\n  retention_days: -1\n")); err == nil {
+		t.Fatal("Load accepted a negative retention")
+	}
+}
+
+func TestLoadBandwidthCap(t *testing.T) {
+	cfg, err := Load(writeConfig(t, baseYAML+"abuse:\n  block_outbound: blackhole\nbandwidth_cap:\n  enabled: true\n  limit_gb: 2000\n"))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	b := cfg.BandwidthCap
+	if b.ResetDay != DefaultBandwidthResetDay || b.Direction != BandwidthTotal || b.Action != BandwidthActionInbounds ||
+		b.BlockOutbound != "blackhole" || b.IntervalSec != DefaultBandwidthIntervalSec {
+		t.Fatalf("bandwidth_cap defaults = %+v", b)
+	}
+	for _, bad := range []string{
+		"bandwidth_cap:\n  enabled: true\n",
+		"bandwidth_cap:\n  reset_day: 31\n",
+		"bandwidth_cap:\n  direction: up\n",
+		"bandwidth_cap:\n  action: shutdown\n",
+	} {
+		if _, err := Load(writeConfig(t, baseYAML+bad)); err == nil {
+			t.Errorf("Load accepted %q", bad)
+		}
+	}
+}
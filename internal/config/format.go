@@ -0,0 +1,124 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// IsYAML reports whether path is read as YAML. Files ending in .json or
+// .toml are read in those formats instead; the agent only writes YAML back.
+func IsYAML(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json", ".toml":
+		return false
+	}
+	return true
+}
+
+// toYAML converts a JSON or TOML config, told apart by the extension of
+// path, to YAML so the rest of loading is the same for every format.
+func toYAML(path string, data []byte) ([]byte, error) {
+	var doc any
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		var obj map[string]any
+		if err := dec.Decode(&obj); err != nil {
+			return nil, fmt.Errorf("json: %w", err)
+		}
+		if _, err := dec.Token(); !errors.Is(err, io.EOF) {
+			return nil, errors.New("json: unexpected data after the top-level object")
+		}
+		doc = obj
+	case ".toml":
+		var obj map[string]any
+		if err := toml.Unmarshal(data, &obj); err != nil {
+			return nil, err
+		}
+		doc = obj
+	default:
+		return data, nil
+	}
+	node, err := valueNode(doc)
+	if err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(node)
+}
+
+// valueNode builds the YAML node for a decoded JSON or TOML value, tagged
+// so numbers, booleans and timestamps keep their type. TOML local dates and
+// date-times are taken as UTC; local times without a date stay strings.
+func valueNode(v any) (*yaml.Node, error) {
+	scalar := func(tag, value string) *yaml.Node {
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: tag, Value: value}
+	}
+	switch v := v.(type) {
+	case nil:
+		return scalar("!!null", "null"), nil
+	case string:
+		return scalar("!!str", v), nil
+	case bool:
+		return scalar("!!bool", strconv.FormatBool(v)), nil
+	case int64:
+		return scalar("!!int", strconv.FormatInt(v, 10)), nil
+	case float64:
+		switch {
+		case math.IsInf(v, 1):
+			return scalar("!!float", ".inf"), nil
+		case math.IsInf(v, -1):
+			return scalar("!!float", "-.inf"), nil
+		case math.IsNaN(v):
+			return scalar("!!float", ".nan"), nil
+		}
+		return scalar("!!float", strconv.FormatFloat(v, 'g', -1, 64)), nil
+	case json.Number:
+		if strings.ContainsAny(v.String(), ".eE") {
+			return scalar("!!float", v.String()), nil
+		}
+		return scalar("!!int", v.String()), nil
+	case time.Time:
+		return scalar("!!timestamp", v.Format(time.RFC3339Nano)), nil
+	case toml.LocalDateTime:
+		return valueNode(v.AsTime(time.UTC))
+	case toml.LocalDate:
+		return valueNode(v.AsTime(time.UTC))
+	case toml.LocalTime:
+		return scalar("!!str", v.String()), nil
+	case []any:
+		node := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		for _, item := range v {
+			child, err := valueNode(item)
+			if err != nil {
+				return nil, err
+			}
+			node.Content = append(node.Content, child)
+		}
+		return node, nil
+	case map[string]any:
+		node := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		for _, k := range slices.Sorted(maps.Keys(v)) {
+			child, err := valueNode(v[k])
+			if err != nil {
+				return nil, err
+			}
+			node.Content = append(node.Content, scalar("!!str", k), child)
+		}
+		return node, nil
+	}
+	return nil, fmt.Errorf("unsupported config value %T", v)
+}
@@ -0,0 +1,128 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+func writeConfigAs(t *testing.T, name, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	return path
+}
+
+func TestLoadJSONAndTOML(t *testing.T) {
+	want, err := Load(writeConfig(t, baseYAML+`
+intervals:
+  stats_sec: 120
+`))
+	if err != nil {
+		t.Fatalf("Load yaml: %v", err)
+	}
+	want.Control.MaintenanceToken = "maint"
+	want.Control.MaintenanceTokenExpiresAt = time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	jsonCfg, err := Load(writeConfigAs(t, "config.json", `{
+	"control": {
+		"base_url": "https://panel.example.com",
+		"token": "token",
+		"server_slug": "sg-1",
+		"tls_insecure": false,
+		"maintenance_token": "maint",
+		"maintenance_token_expires_at": "2030-01-02T03:04:05Z"
+	},
+	"xray": {
+		"api_server": "127.0.0.1:10085",
+		"inbound_tags": {"vless": "vless", "vmess": "vmess", "trojan": "trojan"}
+	},
+	"intervals": {"stats_sec": 120}
+}`))
+	if err != nil {
+		t.Fatalf("Load json: %v", err)
+	}
+	tomlCfg, err := Load(writeConfigAs(t, "config.toml", `
+# same settings as TOML
+[control]
+base_url = "https://panel.example.com"
+token = 'token'
+server_slug = "sg-1"
+tls_insecure = false
+maintenance_token = "maint"
+maintenance_token_expires_at = 2030-01-02T03:04:05Z
+
+[xray]
+api_server = "127.0.0.1:10085"
+inbound_tags = { vless = "vless", vmess = "vmess", trojan = "trojan" }
+
+[intervals]
+stats_sec = 120 # seconds
+`))
+	if err != nil {
+		t.Fatalf("Load toml: %v", err)
+	}
+
+	for name, got := range map[string]*Config{"json": jsonCfg, "toml": tomlCfg} {
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s config = %+v\nwant %+v", name, got, want)
+		}
+	}
+}
+
+func TestLoadRejectsMalformedFormats(t *testing.T) {
+	for name, body := range map[string]string{
+		"config.json": `{"control": {}} {}`,
+		"config.toml": "[control]\ntoken = \"a\"\ntoken = \"b\"\n",
+	} {
+		if _, err := Load(writeConfigAs(t, name, body)); err == nil {
+			t.Errorf("Load(%s) succeeded", name)
+		}
+	}
+}
+
+func TestTOMLToYAML(t *testing.T) {
+	out, err := toYAML("config.toml", []byte(`
+title = "esc\t\"q\""
+ints = [1_000, 0x1f]
+ratio = 1.5
+local = 1979-05-27 07:32:00
+date = 1979-05-27
+clock = 07:32:00
+
+[[peers]]
+name = "p1"
+[[peers]]
+name = "p2"
+[peers.opts]
+on = false
+`))
+	if err != nil {
+		t.Fatalf("toYAML: %v", err)
+	}
+	var got map[string]any
+	if err := yaml.Unmarshal(out, &got); err != nil {
+		t.Fatalf("yaml: %v\n%s", err, out)
+	}
+	want := map[string]any{
+		"title": "esc\t\"q\"",
+		"ints":  []any{1000, 31},
+		"ratio": 1.5,
+		"local": time.Date(1979, 5, 27, 7, 32, 0, 0, time.UTC),
+		"date":  time.Date(1979, 5, 27, 0, 0, 0, 0, time.UTC),
+		"clock": "07:32:00",
+		"peers": []any{
+			map[string]any{"name": "p1"},
+			map[string]any{"name": "p2", "opts": map[string]any{"on": false}},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("toYAML = %#v\nwant %#v", got, want)
+	}
+}
@@ -0,0 +1,225 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"gopkg.in/yaml.v3"
+)
+
+// maxSecretSize bounds a decrypted config value.
+const maxSecretSize = 1 << 20
+
+// isAgeEncrypted reports whether value is an ASCII-armored age file.
+func isAgeEncrypted(value string) bool {
+	return strings.HasPrefix(strings.TrimSpace(value), armor.Header)
+}
+
+// ageDecrypt opens an ASCII-armored age file with ids.
+func ageDecrypt(value string, ids []age.Identity) ([]byte, error) {
+	r, err := age.Decrypt(armor.NewReader(strings.NewReader(strings.TrimSpace(value))), ids...)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(io.LimitReader(r, maxSecretSize))
+}
+
+// SOPSDecrypt decrypts a sops-encrypted config file; overridden in tests.
+var SOPSDecrypt = func(path string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("sops", "--decrypt", "--output-type", "yaml", path)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("sops --decrypt %s: %w: %s", path, err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// isSOPS reports whether data is a sops-encrypted YAML file, which carries
+// its metadata under a top-level sops key.
+func isSOPS(data []byte) bool {
+	var probe struct {
+		SOPS map[string]any `yaml:"sops"`
+	}
+	return yaml.Unmarshal(data, &probe) == nil && probe.SOPS != nil
+}
+
+// secretField is a config value that may be read from a file or be
+// age-encrypted. file is nil when the value has no *_file variant.
+type secretField struct {
+	name  string
+	value *string
+	file  *string
+}
+
+func secretFields(cfg *Config) []secretField {
+	return []secretField{
+		{"control.token", &cfg.Control.Token, &cfg.Control.TokenFile},
+		{"control.maintenance_token", &cfg.Control.MaintenanceToken, nil},
+		{"github.token", &cfg.GitHub.Token, &cfg.GitHub.TokenFile},
+		{"xray.api_token", &cfg.Xray.APIToken, &cfg.Xray.APITokenFile},
+		{"admin.token", &cfg.Admin.Token, &cfg.Admin.TokenFile},
+		// Slack, Discord and Telegram webhooks carry their token in the path.
+		{"metrics.alerts.webhook", &cfg.Metrics.Alerts.Webhook, nil},
+	}
+}
+
+// SecretFiles returns the files secrets are read from: the *_file
+// references in use and the age key, when it exists.
+func (c *Config) SecretFiles() []string {
+	var files []string
+	for _, f := range secretFields(c) {
+		if f.file != nil && *f.file != "" {
+			files = append(files, secretFilePath(*f.file))
+		}
+	}
+	if path := ageKeyFile(c); path != "" {
+		if _, err := os.Stat(path); err == nil {
+			files = append(files, path)
+		}
+	}
+	return files
+}
+
+// sealedSecret is a secret as written in the config file and as resolved.
+type sealedSecret struct {
+	raw, plain string
+}
+
+// resolveSecrets reads *_file references and replaces age-encrypted values
+// with their plaintext, remembering the originals for Sealed. The age
+// identities are only read when a value is encrypted.
+func resolveSecrets(cfg *Config) error {
+	var ids []age.Identity
+	for _, f := range secretFields(cfg) {
+		raw := *f.value
+		if f.file != nil && *f.file != "" {
+			if raw != "" {
+				return fmt.Errorf("%s and %s_file are mutually exclusive", f.name, f.name)
+			}
+			data, err := os.ReadFile(secretFilePath(*f.file))
+			if err != nil {
+				return fmt.Errorf("%s_file: %w", f.name, err)
+			}
+			*f.value = strings.TrimSpace(string(data))
+			if *f.value == "" {
+				return fmt.Errorf("%s_file %s is empty", f.name, *f.file)
+			}
+		}
+		if isAgeEncrypted(*f.value) {
+			if ids == nil {
+				path := ageKeyFile(cfg)
+				data, err := os.ReadFile(path)
+				if err != nil {
+					return fmt.Errorf("%s is age-encrypted: read key: %w", f.name, err)
+				}
+				if ids, err = age.ParseIdentities(bytes.NewReader(data)); err != nil {
+					return fmt.Errorf("age key %s: %w", path, err)
+				}
+			}
+			plain, err := ageDecrypt(*f.value, ids)
+			if err != nil {
+				return fmt.Errorf("decrypt %s: %w", f.name, err)
+			}
+			*f.value = strings.TrimSpace(string(plain))
+		}
+		if *f.value != raw {
+			if cfg.sealed == nil {
+				cfg.sealed = make(map[string]sealedSecret)
+			}
+			cfg.sealed[f.name] = sealedSecret{raw: raw, plain: *f.value}
+		}
+	}
+	return nil
+}
+
+// Sealed returns a copy of c to write back to disk: secrets that were read
+// from a *_file or decrypted at load time are restored to how the file had
+// them, unless they were changed since.
+func (c *Config) Sealed() *Config {
+	out := *c
+	out.sealed = nil
+	for _, f := range secretFields(&out) {
+		if s, ok := c.sealed[f.name]; ok && *f.value == s.plain {
+			*f.value = s.raw
+		}
+	}
+	return &out
+}
+
+// secretFilePath resolves a relative *_file path against the credentials
+// systemd passes in with LoadCredential=, if any.
+func secretFilePath(path string) string {
+	if dir := os.Getenv("CREDENTIALS_DIRECTORY"); dir != "" && !filepath.IsAbs(path) {
+		return filepath.Join(dir, path)
+	}
+	return path
+}
+
+// ageKeyFile returns secrets.age_key_file, or else the age.key credential
+// systemd passes in (LoadCredentialEncrypted= can keep it sealed by the TPM),
+// or else DefaultAgeKeyFile.
+func ageKeyFile(cfg *Config) string {
+	if cfg.Secrets.AgeKeyFile != "" {
+		return cfg.Secrets.AgeKeyFile
+	}
+	if dir := os.Getenv("CREDENTIALS_DIRECTORY"); dir != "" {
+		path := filepath.Join(dir, "age.key")
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return DefaultAgeKeyFile
+}
+
+// redactedValue stands in for a secret in Redacted output.
+const redactedValue = "REDACTED"
+
+// Redacted returns a copy of c that is safe to print: tokens and the alert
+// webhook are replaced, and passwords and query strings in URLs are masked.
+// Profiles are dropped, since the applied one is already merged in.
+func (c *Config) Redacted() *Config {
+	out := *c
+	out.sealed = nil
+	out.Profiles = nil
+	for _, f := range secretFields(&out) {
+		if *f.value != "" {
+			*f.value = redactedValue
+		}
+	}
+	out.Control.BaseURL = slices.Clone(c.Control.BaseURL)
+	for i, u := range out.Control.BaseURL {
+		out.Control.BaseURL[i] = redactURL(u)
+	}
+	out.GitHub.Mirrors = slices.Clone(c.GitHub.Mirrors)
+	for i, u := range out.GitHub.Mirrors {
+		out.GitHub.Mirrors[i] = redactURL(u)
+	}
+	out.GitHub.DownloadProxy = redactURL(c.GitHub.DownloadProxy)
+	out.Speedtest.DownloadURL = redactURL(c.Speedtest.DownloadURL)
+	out.Speedtest.UploadURL = redactURL(c.Speedtest.UploadURL)
+	return &out
+}
+
+// redactURL masks the password and the query string of s, where tokens
+// such as ?token= travel.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || (u.User == nil && u.RawQuery == "") {
+		return s
+	}
+	if u.RawQuery != "" {
+		u.RawQuery = redactedValue
+	}
+	return u.Redacted()
+}
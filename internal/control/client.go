@@ -11,6 +11,7 @@ import (
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/najahiiii/xray-agent/internal/config"
@@ -25,7 +26,57 @@ type Client struct {
 	log             *slog.Logger
 	agentVersion    string
 	xrayCoreVersion string
+	capabilities    *model.Capabilities
 	versionMu       sync.RWMutex
+	// usingMaintenance is set while requests only succeed with the
+	// maintenance token.
+	usingMaintenance atomic.Bool
+	// mqtt carries requests instead of HTTP with control.transport mqtt.
+	mqtt *mqttTransport
+	// updates is signalled when the panel pushes or announces a new state.
+	updates chan struct{}
+	// stateVersion is the config_version of the last state fetched.
+	stateVersion atomic.Int64
+
+	// throttledUntil is when the panel's last Retry-After runs out.
+	throttleMu     sync.Mutex
+	throttledUntil time.Time
+
+	// skew is the local clock minus the panel's, from the last Date header;
+	// skewWarned is set while it is over control.max_clock_skew_sec.
+	skewMu     sync.Mutex
+	skew       time.Duration
+	skewKnown  bool
+	skewWarned bool
+
+	// ep holds the control fields a reload can swap while requests run.
+	// active indexes the base URL that last answered; activeSince is when
+	// the client switched to it or last probed the primary.
+	epMu        sync.RWMutex
+	ep          endpoint
+	active      int
+	activeSince time.Time
+}
+
+type endpoint struct {
+	baseURLs   []string
+	token      string
+	serverSlug string
+	// The maintenance token fields of control; see maintenanceToken.
+	maintenanceToken     string
+	maintenanceExpiresAt time.Time
+	maintenanceFile      string
+}
+
+func newEndpoint(cfg *config.Config) endpoint {
+	return endpoint{
+		baseURLs:             cfg.Control.BaseURL,
+		token:                cfg.Control.Token,
+		serverSlug:           cfg.Control.ServerSlug,
+		maintenanceToken:     cfg.Control.MaintenanceToken,
+		maintenanceExpiresAt: cfg.Control.MaintenanceTokenExpiresAt,
+		maintenanceFile:      cfg.Control.MaintenanceTokenFile,
+	}
 }
 
 func NewClient(cfg *config.Config, log *slog.Logger, agentVersion string, xrayCoreVersion string) *Client {
@@ -39,12 +90,65 @@ func NewClient(cfg *config.Config, log *slog.Logger, agentVersion string, xrayCo
 		IdleConnTimeout:     90 * time.Second,
 		TLSHandshakeTimeout: 5 * time.Second,
 	}
-	return &Client{
+	c := &Client{
 		cfg:             cfg,
 		client:          &http.Client{Transport: tr, Timeout: 12 * time.Second},
+		updates:         make(chan struct{}, 1),
 		log:             log,
 		agentVersion:    agentVersion,
 		xrayCoreVersion: normalizeTaggedVersion(xrayCoreVersion),
+		ep:              newEndpoint(cfg),
+	}
+	c.stateVersion.Store(-1)
+	if cfg.Control.Transport == config.TransportMQTT {
+		c.mqtt = newMQTTTransport(cfg, log, c.notifyState)
+	}
+	return c
+}
+
+func (c *Client) endpoint() endpoint {
+	c.epMu.RLock()
+	defer c.epMu.RUnlock()
+	return c.ep
+}
+
+// Reload switches to the control base URL, token, server slug and maintenance
+// token in cfg, so update-config can rotate them without restarting the agent. A changed
+// tls_insecure needs a new transport and only takes effect after a restart.
+func (c *Client) Reload(cfg *config.Config) {
+	c.epMu.Lock()
+	prev := c.ep
+	c.ep = newEndpoint(cfg)
+	c.active = 0
+	c.epMu.Unlock()
+	if c.mqtt != nil && (prev.token != cfg.Control.Token || prev.serverSlug != cfg.Control.ServerSlug) {
+		c.mqtt.reset()
+	}
+	if cfg.Control.TLSInsecure != c.cfg.Control.TLSInsecure {
+		c.log.Warn("control.tls_insecure changed; restart the agent to apply it")
+	}
+}
+
+// SetOneShot marks the client as used by a short CLI command. Over MQTT it
+// then connects with a session of its own, so it neither takes over the
+// running agent's connection nor receives its commands.
+func (c *Client) SetOneShot() {
+	if c.mqtt != nil {
+		c.mqtt.oneShot = true
+	}
+}
+
+// StateUpdates is signalled when the panel pushes a new state over MQTT or
+// announces one on the state stream, so the state loop can fetch it without
+// waiting for its next run.
+func (c *Client) StateUpdates() <-chan struct{} {
+	return c.updates
+}
+
+func (c *Client) notifyState() {
+	select {
+	case c.updates <- struct{}{}:
+	default:
 	}
 }
 
@@ -58,6 +162,13 @@ func (c *Client) SetXrayCoreVersion(version string) {
 	c.xrayCoreVersion = normalizeTaggedVersion(version)
 }
 
+// SetCapabilities sets what the heartbeat advertises to the panel.
+func (c *Client) SetCapabilities(caps model.Capabilities) {
+	c.versionMu.Lock()
+	defer c.versionMu.Unlock()
+	c.capabilities = &caps
+}
+
 func normalizeTaggedVersion(version string) string {
 	version = strings.TrimSpace(version)
 	if version == "" {
@@ -70,18 +181,25 @@ func normalizeTaggedVersion(version string) string {
 }
 
 func (c *Client) auth(req *http.Request) {
-	req.Header.Set("Authorization", "Bearer "+c.cfg.Control.Token)
+	req.Header.Set("Authorization", "Bearer "+c.endpoint().token)
+}
+
+// agentURL returns the URL of path under this node's agent API, on the
+// control endpoint in use.
+func (c *Client) agentURL(path string) string {
+	ep := c.endpoint()
+	return fmt.Sprintf("%s/api/agents/%s/%s", c.baseURL(), ep.serverSlug, path)
 }
 
 func (c *Client) GetState(ctx context.Context) (*model.State, error) {
-	url := fmt.Sprintf("%s/api/agents/%s/state", c.cfg.Control.BaseURL, c.cfg.Control.ServerSlug)
+	url := c.agentURL("state")
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return nil, err
 	}
 	c.auth(req)
 
-	resp, err := c.client.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -96,11 +214,12 @@ func (c *Client) GetState(ctx context.Context) (*model.State, error) {
 	if err := json.NewDecoder(resp.Body).Decode(&ds); err != nil {
 		return nil, err
 	}
+	c.stateVersion.Store(ds.ConfigVersion)
 	return &ds, nil
 }
 
 func (c *Client) PostStats(ctx context.Context, p *model.StatsPush) error {
-	url := fmt.Sprintf("%s/api/agents/%s/stats", c.cfg.Control.BaseURL, c.cfg.Control.ServerSlug)
+	url := c.agentURL("stats")
 	var buf bytes.Buffer
 	if err := json.NewEncoder(&buf).Encode(p); err != nil {
 		return err
@@ -113,7 +232,7 @@ func (c *Client) PostStats(ctx context.Context, p *model.StatsPush) error {
 	req.Header.Set("Content-Type", "application/json")
 	c.auth(req)
 
-	resp, err := c.client.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return err
 	}
@@ -130,7 +249,7 @@ func (c *Client) PostOnlineUsers(ctx context.Context, p *model.OnlineUsersPush)
 	if p == nil {
 		return nil
 	}
-	url := fmt.Sprintf("%s/api/agents/%s/online", c.cfg.Control.BaseURL, c.cfg.Control.ServerSlug)
+	url := c.agentURL("online")
 	var buf bytes.Buffer
 	if err := json.NewEncoder(&buf).Encode(p); err != nil {
 		return err
@@ -143,7 +262,7 @@ func (c *Client) PostOnlineUsers(ctx context.Context, p *model.OnlineUsersPush)
 	req.Header.Set("Content-Type", "application/json")
 	c.auth(req)
 
-	resp, err := c.client.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return err
 	}
@@ -156,11 +275,95 @@ func (c *Client) PostOnlineUsers(ctx context.Context, p *model.OnlineUsersPush)
 	return nil
 }
 
+// PostAccessLog sends one interval's access log summary.
+func (c *Client) PostAccessLog(ctx context.Context, p *model.AccessLogPush) error {
+	url := c.agentURL("access-log")
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(p); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	c.auth(req)
+
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("post access log http %d: %s", resp.StatusCode, string(b))
+	}
+	return nil
+}
+
+// PostAbuse reports the abuse violations of one interval.
+func (c *Client) PostAbuse(ctx context.Context, p *model.AbusePush) error {
+	url := c.agentURL("abuse")
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(p); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	c.auth(req)
+
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("post abuse http %d: %s", resp.StatusCode, string(b))
+	}
+	return nil
+}
+
+// PostBans reports source bans added and lifted.
+func (c *Client) PostBans(ctx context.Context, p *model.BanPush) error {
+	url := c.agentURL("bans")
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(p); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	c.auth(req)
+
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("post bans http %d: %s", resp.StatusCode, string(b))
+	}
+	return nil
+}
+
 func (c *Client) PostMetrics(ctx context.Context, p *model.ServerMetricPush) error {
 	if p == nil {
 		return nil
 	}
-	url := fmt.Sprintf("%s/api/agents/%s/metrics", c.cfg.Control.BaseURL, c.cfg.Control.ServerSlug)
+	url := c.agentURL("metrics")
 	var buf bytes.Buffer
 	if err := json.NewEncoder(&buf).Encode(p); err != nil {
 		return err
@@ -173,7 +376,7 @@ func (c *Client) PostMetrics(ctx context.Context, p *model.ServerMetricPush) err
 	req.Header.Set("Content-Type", "application/json")
 	c.auth(req)
 
-	resp, err := c.client.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return err
 	}
@@ -186,19 +389,165 @@ func (c *Client) PostMetrics(ctx context.Context, p *model.ServerMetricPush) err
 	return nil
 }
 
-func (c *Client) Heartbeat(ctx context.Context) error {
-	url := fmt.Sprintf("%s/api/agents/%s/heartbeat", c.cfg.Control.BaseURL, c.cfg.Control.ServerSlug)
-	payload := model.HeartbeatPush{OK: true}
-	c.versionMu.RLock()
-	xrayCoreVersion := c.xrayCoreVersion
-	c.versionMu.RUnlock()
-	if c.agentVersion != "" {
-		payload.AgentVersion = c.agentVersion
+// PostSpeedtest reports the outcome of a SPEEDTEST command.
+func (c *Client) PostSpeedtest(ctx context.Context, p *model.SpeedtestResult) error {
+	url := c.agentURL("speedtest")
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(p); err != nil {
+		return err
 	}
-	if xrayCoreVersion != "" {
-		payload.XrayCoreVersion = xrayCoreVersion
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	c.auth(req)
+
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("post speedtest http %d: %s", resp.StatusCode, string(b))
+	}
+	return nil
+}
+
+func (c *Client) PostLogs(ctx context.Context, p *model.LogsPush) error {
+	if p == nil || len(p.Entries) == 0 {
+		return nil
+	}
+	url := c.agentURL("logs")
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(p); err != nil {
+		return err
 	}
 
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	c.auth(req)
+
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("post logs http %d: %s", resp.StatusCode, string(b))
+	}
+	return nil
+}
+
+// PostAudit delivers audit entries of applied user, route and outbound
+// changes.
+func (c *Client) PostAudit(ctx context.Context, p *model.AuditPush) error {
+	if p == nil || len(p.Entries) == 0 && p.Dropped == 0 {
+		return nil
+	}
+	url := c.agentURL("audit")
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(p); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	c.auth(req)
+
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("post audit http %d: %s", resp.StatusCode, string(b))
+	}
+	return nil
+}
+
+// PostDrift reports how the running core differs from the applied state.
+func (c *Client) PostDrift(ctx context.Context, r *model.DriftReport) error {
+	if r == nil {
+		return nil
+	}
+	url := c.agentURL("drift")
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(r); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	c.auth(req)
+
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("post drift http %d: %s", resp.StatusCode, string(b))
+	}
+	return nil
+}
+
+// PostEvent adds one event to the node's activity feed on the panel.
+func (c *Client) PostEvent(ctx context.Context, e *model.AgentEvent) error {
+	if e == nil {
+		return nil
+	}
+	url := c.agentURL("events")
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(e); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	c.auth(req)
+
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("post event http %d: %s", resp.StatusCode, string(b))
+	}
+	return nil
+}
+
+// Heartbeat posts liveness and the agent's capabilities. status is attached
+// only when control.heartbeat_format is v1 so older panels keep receiving the
+// legacy body.
+func (c *Client) Heartbeat(ctx context.Context, status *model.NodeStatus) error {
+	url := c.agentURL("heartbeat")
+	payload := c.heartbeatPayload(status)
+
 	var buf bytes.Buffer
 	if err := json.NewEncoder(&buf).Encode(&payload); err != nil {
 		return err
@@ -211,7 +560,7 @@ func (c *Client) Heartbeat(ctx context.Context) error {
 	req.Header.Set("Content-Type", "application/json")
 	c.auth(req)
 
-	resp, err := c.client.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return err
 	}
@@ -224,19 +573,71 @@ func (c *Client) Heartbeat(ctx context.Context) error {
 	return nil
 }
 
+// PostReport sends one interval's heartbeat together with the stats and
+// metrics pushes, either of which may be nil, in a single request.
+func (c *Client) PostReport(ctx context.Context, status *model.NodeStatus, stats *model.StatsPush, metrics *model.ServerMetricPush) error {
+	url := c.agentURL("report")
+	payload := model.ReportPush{Heartbeat: c.heartbeatPayload(status), Stats: stats, Metrics: metrics}
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(&payload); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	c.auth(req)
+
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("post report http %d: %s", resp.StatusCode, string(b))
+	}
+	return nil
+}
+
+// heartbeatPayload builds the heartbeat body for status.
+func (c *Client) heartbeatPayload(status *model.NodeStatus) model.HeartbeatPush {
+	payload := model.HeartbeatPush{OK: true}
+	if status != nil && c.cfg.Control.HeartbeatFormat == config.HeartbeatFormatV1 {
+		node := *status
+		node.Format = config.HeartbeatFormatV1
+		payload.NodeStatus = &node
+		payload.OK = node.Status != model.NodeStatusError
+	}
+	c.versionMu.RLock()
+	xrayCoreVersion := c.xrayCoreVersion
+	payload.Capabilities = c.capabilities
+	c.versionMu.RUnlock()
+	if c.agentVersion != "" {
+		payload.AgentVersion = c.agentVersion
+	}
+	if xrayCoreVersion != "" {
+		payload.XrayCoreVersion = xrayCoreVersion
+	}
+	if skew, ok := c.ClockSkew(); ok {
+		ms := skew.Milliseconds()
+		payload.ClockSkewMs = &ms
+	}
+	return payload
+}
+
 func (c *Client) GetNextCommand(ctx context.Context) (*model.AgentCommand, error) {
-	url := fmt.Sprintf(
-		"%s/api/agents/%s/commands/next",
-		c.cfg.Control.BaseURL,
-		c.cfg.Control.ServerSlug,
-	)
+	url := c.agentURL("commands/next")
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return nil, err
 	}
 	c.auth(req)
 
-	resp, err := c.client.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -265,12 +666,7 @@ func (c *Client) AckCommand(ctx context.Context, commandID string, ack *model.Ag
 		return fmt.Errorf("ack payload required")
 	}
 
-	url := fmt.Sprintf(
-		"%s/api/agents/%s/commands/%s/ack",
-		c.cfg.Control.BaseURL,
-		c.cfg.Control.ServerSlug,
-		commandID,
-	)
+	url := c.agentURL("commands/" + commandID + "/ack")
 	var buf bytes.Buffer
 	if err := json.NewEncoder(&buf).Encode(ack); err != nil {
 		return err
@@ -283,7 +679,7 @@ func (c *Client) AckCommand(ctx context.Context, commandID string, ack *model.Ag
 	req.Header.Set("Content-Type", "application/json")
 	c.auth(req)
 
-	resp, err := c.client.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return err
 	}
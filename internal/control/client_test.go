@@ -73,7 +73,7 @@ func TestClientStateAndPosts(t *testing.T) {
 	defer srv.Close()
 
 	cfg := &config.Config{}
-	cfg.Control.BaseURL = srv.URL
+	cfg.Control.BaseURL = config.URLList{srv.URL}
 	cfg.Control.Token = "token"
 	cfg.Control.ServerSlug = "sg"
 
@@ -106,7 +106,7 @@ func TestClientStateAndPosts(t *testing.T) {
 	if err := client.PostMetrics(ctx, &model.ServerMetricPush{CPUPercent: floatPtr(10)}); err != nil {
 		t.Fatalf("PostMetrics: %v", err)
 	}
-	if err := client.Heartbeat(ctx); err != nil {
+	if err := client.Heartbeat(ctx, nil); err != nil {
 		t.Fatalf("Heartbeat: %v", err)
 	}
 	if !statsHit || !onlineHit || !hbHit || !metricsHit {
@@ -132,7 +132,7 @@ func TestClientSetXrayCoreVersionUpdatesHeartbeatPayload(t *testing.T) {
 	defer srv.Close()
 
 	cfg := &config.Config{}
-	cfg.Control.BaseURL = srv.URL
+	cfg.Control.BaseURL = config.URLList{srv.URL}
 	cfg.Control.Token = "token"
 	cfg.Control.ServerSlug = "sg"
 
@@ -142,7 +142,7 @@ func TestClientSetXrayCoreVersionUpdatesHeartbeatPayload(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
 
-	if err := client.Heartbeat(ctx); err != nil {
+	if err := client.Heartbeat(ctx, nil); err != nil {
 		t.Fatalf("Heartbeat: %v", err)
 	}
 
@@ -151,6 +151,66 @@ func TestClientSetXrayCoreVersionUpdatesHeartbeatPayload(t *testing.T) {
 	}
 }
 
+func TestClientHeartbeatAdvertisesCapabilities(t *testing.T) {
+	var heartbeat model.HeartbeatPush
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&heartbeat); err != nil {
+			t.Fatalf("decode heartbeat body: %v", err)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	cfg := &config.Config{}
+	cfg.Control.BaseURL = config.URLList{srv.URL}
+	cfg.Control.ServerSlug = "sg"
+
+	client := NewClient(cfg, testLogger(), "v1.0.3", "")
+	client.SetCapabilities(model.Capabilities{OS: "linux", Arch: "arm64", Protocols: []string{"vless"}, Features: []string{"routes"}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// The legacy body carries capabilities too.
+	if err := client.Heartbeat(ctx, nil); err != nil {
+		t.Fatalf("Heartbeat: %v", err)
+	}
+	caps := heartbeat.Capabilities
+	if caps == nil || caps.Arch != "arm64" || len(caps.Protocols) != 1 || caps.Features[0] != "routes" {
+		t.Fatalf("capabilities = %+v", caps)
+	}
+}
+
+func TestClientReloadSwitchesEndpointAndToken(t *testing.T) {
+	var gotPath, gotAuth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath, gotAuth = r.URL.Path, r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	cfg := &config.Config{}
+	cfg.Control.BaseURL = config.URLList{"http://127.0.0.1:1"}
+	cfg.Control.Token = "old"
+	cfg.Control.ServerSlug = "sg"
+	client := NewClient(cfg, testLogger(), "v1.0.3", "")
+
+	next := &config.Config{}
+	next.Control.BaseURL = config.URLList{srv.URL}
+	next.Control.Token = "new"
+	next.Control.ServerSlug = "sg-2"
+	client.Reload(next)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := client.Heartbeat(ctx, nil); err != nil {
+		t.Fatalf("Heartbeat: %v", err)
+	}
+	if gotPath != "/api/agents/sg-2/heartbeat" || gotAuth != "Bearer new" {
+		t.Fatalf("request = %s %q", gotPath, gotAuth)
+	}
+}
+
 func TestClientSetXrayCoreVersionNormalizesHeartbeatPayload(t *testing.T) {
 	var heartbeat model.HeartbeatPush
 	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -169,7 +229,7 @@ func TestClientSetXrayCoreVersionNormalizesHeartbeatPayload(t *testing.T) {
 	defer srv.Close()
 
 	cfg := &config.Config{}
-	cfg.Control.BaseURL = srv.URL
+	cfg.Control.BaseURL = config.URLList{srv.URL}
 	cfg.Control.Token = "token"
 	cfg.Control.ServerSlug = "sg"
 
@@ -179,7 +239,7 @@ func TestClientSetXrayCoreVersionNormalizesHeartbeatPayload(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
 
-	if err := client.Heartbeat(ctx); err != nil {
+	if err := client.Heartbeat(ctx, nil); err != nil {
 		t.Fatalf("Heartbeat: %v", err)
 	}
 
@@ -191,3 +251,83 @@ func TestClientSetXrayCoreVersionNormalizesHeartbeatPayload(t *testing.T) {
 func floatPtr(v float64) *float64 {
 	return &v
 }
+
+func TestClientPostLogs(t *testing.T) {
+	var push model.LogsPush
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/agents/sg/logs" || r.Method != http.MethodPost {
+			t.Fatalf("unexpected request: %s %s", r.Method, r.URL.Path)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&push); err != nil {
+			t.Fatalf("decode logs body: %v", err)
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	cfg := &config.Config{}
+	cfg.Control.BaseURL = config.URLList{srv.URL}
+	cfg.Control.Token = "token"
+	cfg.Control.ServerSlug = "sg"
+
+	client := NewClient(cfg, testLogger(), "v1.0.3", "")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := client.PostLogs(ctx, &model.LogsPush{}); err != nil {
+		t.Fatalf("PostLogs empty: %v", err)
+	}
+	err := client.PostLogs(ctx, &model.LogsPush{
+		Dropped: 2,
+		Entries: []model.LogEntry{{Level: "ERROR", Message: "state-sync", Attrs: map[string]string{"err": "boom"}}},
+	})
+	if err != nil {
+		t.Fatalf("PostLogs: %v", err)
+	}
+	if push.Dropped != 2 || len(push.Entries) != 1 || push.Entries[0].Attrs["err"] != "boom" {
+		t.Fatalf("unexpected logs push: %+v", push)
+	}
+}
+
+func TestClientHeartbeatFormatV1(t *testing.T) {
+	var bodies []map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Fatalf("decode heartbeat body: %v", err)
+		}
+		bodies = append(bodies, body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	cfg := &config.Config{}
+	cfg.Control.BaseURL = config.URLList{srv.URL}
+	cfg.Control.Token = "token"
+	cfg.Control.ServerSlug = "sg"
+	cfg.Control.HeartbeatFormat = config.HeartbeatFormatEmpty
+
+	client := NewClient(cfg, testLogger(), "v1.0.3", "v25.10.15")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	status := &model.NodeStatus{Status: model.NodeStatusError, ConfigVersion: 7}
+	if err := client.Heartbeat(ctx, status); err != nil {
+		t.Fatalf("Heartbeat empty: %v", err)
+	}
+	cfg.Control.HeartbeatFormat = config.HeartbeatFormatV1
+	if err := client.Heartbeat(ctx, status); err != nil {
+		t.Fatalf("Heartbeat v1: %v", err)
+	}
+
+	if _, ok := bodies[0]["status"]; ok || bodies[0]["ok"] != true {
+		t.Fatalf("legacy heartbeat must not carry status: %+v", bodies[0])
+	}
+	v1 := bodies[1]
+	if v1["format"] != "v1" || v1["status"] != "error" || v1["ok"] != false || v1["config_version"] != float64(7) {
+		t.Fatalf("unexpected v1 heartbeat: %+v", v1)
+	}
+	if v1["agent_version"] != "v1.0.3" {
+		t.Fatalf("v1 heartbeat lost version fields: %+v", v1)
+	}
+}
@@ -0,0 +1,122 @@
+package control
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// primaryRecheckInterval is how long the client stays on a fallback control
+// endpoint before it tries the primary again.
+const primaryRecheckInterval = 5 * time.Minute
+
+var errRequestBodyUsed = errors.New("request body cannot be sent to another control endpoint")
+
+// baseURL returns the control endpoint requests should go to: the one that
+// last answered, or the primary once every primaryRecheckInterval while on a
+// fallback.
+func (c *Client) baseURL() string {
+	c.epMu.Lock()
+	defer c.epMu.Unlock()
+	if len(c.ep.baseURLs) == 0 {
+		return ""
+	}
+	if c.active != 0 && time.Since(c.activeSince) >= primaryRecheckInterval {
+		c.activeSince = time.Now()
+		return c.ep.baseURLs[0]
+	}
+	return c.ep.baseURLs[c.active]
+}
+
+// failover sends req to the control endpoint it was built for and, when that
+// panel cannot be reached or answers 502-504, to the other endpoints in order.
+// The endpoint that answers is used for later requests.
+func (c *Client) failover(req *http.Request) (*http.Response, error) {
+	ep := c.endpoint()
+	target := req.URL.String()
+	first := slices.IndexFunc(ep.baseURLs, func(base string) bool {
+		return strings.HasPrefix(target, base+"/")
+	})
+	if len(ep.baseURLs) < 2 || first < 0 {
+		return c.send(req)
+	}
+	path := target[len(ep.baseURLs[first]):]
+
+	var (
+		resp *http.Response
+		err  error
+	)
+	for n := range len(ep.baseURLs) {
+		i := (first + n) % len(ep.baseURLs)
+		attempt := req
+		if n > 0 {
+			if attempt, err = retarget(req, ep.baseURLs[i]+path); err != nil {
+				return nil, err
+			}
+		}
+		resp, err = c.send(attempt)
+		if err == nil && !endpointDown(resp.StatusCode) {
+			c.noteEndpoint(ep.baseURLs, i)
+			return resp, nil
+		}
+		if req.Context().Err() != nil || n == len(ep.baseURLs)-1 {
+			break
+		}
+		if err != nil {
+			c.log.Debug("control endpoint unreachable; trying the next one", "base_url", ep.baseURLs[i], "err", err)
+		} else {
+			c.log.Debug("control endpoint unavailable; trying the next one", "base_url", ep.baseURLs[i], "status", resp.StatusCode)
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+	}
+	return resp, err
+}
+
+// noteEndpoint remembers the endpoint at index i of baseURLs as the one to
+// use, unless a reload replaced the list meanwhile.
+func (c *Client) noteEndpoint(baseURLs []string, i int) {
+	c.epMu.Lock()
+	defer c.epMu.Unlock()
+	if c.active == i || !slices.Equal(c.ep.baseURLs, baseURLs) {
+		return
+	}
+	from := c.ep.baseURLs[c.active]
+	c.active = i
+	c.activeSince = time.Now()
+	if i == 0 {
+		c.log.Info("primary control endpoint is back", "base_url", baseURLs[0])
+		return
+	}
+	c.log.Warn("control endpoint failed over", "from", from, "to", baseURLs[i])
+}
+
+// retarget copies req for another URL, with a fresh body.
+func retarget(req *http.Request, target string) (*http.Request, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	out := req.Clone(req.Context())
+	out.URL = u
+	out.Host = ""
+	if req.Body != nil {
+		if req.GetBody == nil {
+			return nil, errRequestBodyUsed
+		}
+		if out.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// endpointDown reports whether status means the panel behind an endpoint is
+// down rather than that it rejected the request.
+func endpointDown(status int) bool {
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
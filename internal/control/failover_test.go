@@ -0,0 +1,96 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/najahiiii/xray-agent/internal/config"
+	"github.com/najahiiii/xray-agent/internal/model"
+)
+
+func TestClientFailsOverBetweenControlEndpoints(t *testing.T) {
+	down := httptest.NewServer(http.NotFoundHandler())
+	downURL := down.URL
+	down.Close()
+
+	var primaryUp atomic.Bool
+	var primaryHits, fallbackHits atomic.Int32
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		primaryHits.Add(1)
+		if !primaryUp.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(model.State{ConfigVersion: 1})
+	}))
+	defer primary.Close()
+	var statsBody []byte
+	fallback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fallbackHits.Add(1)
+		if r.URL.Path == "/api/agents/sg/stats" {
+			statsBody, _ = io.ReadAll(r.Body)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(model.State{ConfigVersion: 2})
+	}))
+	defer fallback.Close()
+
+	cfg := &config.Config{}
+	cfg.Control.BaseURL = config.URLList{primary.URL, downURL, fallback.URL}
+	cfg.Control.Token = "t"
+	cfg.Control.ServerSlug = "sg"
+	c := NewClient(cfg, testLogger(), "v-test", "")
+	ctx := context.Background()
+
+	ds, err := c.GetState(ctx)
+	if err != nil || ds.ConfigVersion != 2 {
+		t.Fatalf("GetState while the primary is down: %+v, %v", ds, err)
+	}
+	if err := c.PostStats(ctx, &model.StatsPush{Sequence: 4}); err != nil {
+		t.Fatalf("PostStats: %v", err)
+	}
+	if primaryHits.Load() != 1 || fallbackHits.Load() != 2 {
+		t.Fatalf("hits: primary=%d fallback=%d; the fallback should be remembered", primaryHits.Load(), fallbackHits.Load())
+	}
+	var push model.StatsPush
+	if err := json.Unmarshal(statsBody, &push); err != nil || push.Sequence != 4 {
+		t.Fatalf("stats body = %q", statsBody)
+	}
+
+	// Once the recheck interval passed, the primary is tried first again.
+	primaryUp.Store(true)
+	c.epMu.Lock()
+	c.activeSince = time.Now().Add(-primaryRecheckInterval)
+	c.epMu.Unlock()
+	if ds, err := c.GetState(ctx); err != nil || ds.ConfigVersion != 1 {
+		t.Fatalf("GetState after the primary recovered: %+v, %v", ds, err)
+	}
+	if c.baseURL() != primary.URL {
+		t.Fatalf("client stayed on %s", c.baseURL())
+	}
+}
+
+func TestClientReturnsLastFailureWhenEveryEndpointIsDown(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	cfg := &config.Config{}
+	cfg.Control.BaseURL = config.URLList{srv.URL, srv.URL + "/second"}
+	cfg.Control.Token = "t"
+	cfg.Control.ServerSlug = "sg"
+	c := NewClient(cfg, testLogger(), "v-test", "")
+	if _, err := c.GetState(context.Background()); err == nil {
+		t.Fatal("expected an error")
+	}
+	if c.baseURL() != srv.URL {
+		t.Fatalf("client switched to %s without an answer", c.baseURL())
+	}
+}
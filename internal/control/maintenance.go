@@ -0,0 +1,114 @@
+package control
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// maintenanceToken returns the secondary bearer token if one is configured or
+// has been dropped into control.maintenance_token_file, and has not expired.
+// The file is read on every call so an operator can deliver a token to a node
+// whose primary token was rotated wrongly without restarting the agent.
+func (c *Client) maintenanceToken() (string, time.Time, error) {
+	ep := c.endpoint()
+	now := time.Now()
+	if ep.maintenanceToken != "" && now.Before(ep.maintenanceExpiresAt) {
+		return ep.maintenanceToken, ep.maintenanceExpiresAt, nil
+	}
+	if ep.maintenanceFile == "" {
+		return "", time.Time{}, nil
+	}
+	data, err := os.ReadFile(ep.maintenanceFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", time.Time{}, nil
+	}
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	token, expiresAt, err := parseMaintenanceToken(string(data))
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("%s: %w", ep.maintenanceFile, err)
+	}
+	if !now.Before(expiresAt) {
+		return "", time.Time{}, nil
+	}
+	return token, expiresAt, nil
+}
+
+// parseMaintenanceToken reads "<token> <RFC3339 expiry>". A token without an
+// expiry is rejected so a forgotten file cannot grant access indefinitely.
+func parseMaintenanceToken(data string) (string, time.Time, error) {
+	fields := strings.Fields(data)
+	if len(fields) != 2 {
+		return "", time.Time{}, errors.New("want \"<token> <RFC3339 expiry>\"")
+	}
+	expiresAt, err := time.Parse(time.RFC3339, fields[1])
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("invalid expiry: %w", err)
+	}
+	return fields[0], expiresAt, nil
+}
+
+// send sends req with the primary token. If the panel rejects it with 401 or
+// 403 and a maintenance token is valid, the request is retried once with the
+// maintenance token, so a botched rotation of the primary token does not cut
+// the node off until update-config is run by hand.
+func (c *Client) send(req *http.Request) (*http.Response, error) {
+	client := c.httpClient(req.Context())
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized && resp.StatusCode != http.StatusForbidden {
+		c.noteMaintenance(false, time.Time{})
+		return resp, nil
+	}
+
+	token, expiresAt, tokenErr := c.maintenanceToken()
+	if tokenErr != nil {
+		c.log.Warn("ignoring maintenance token", "err", tokenErr)
+	}
+	if token == "" || (req.Body != nil && req.GetBody == nil) {
+		return resp, nil
+	}
+
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return resp, nil
+		}
+		retry.Body = body
+	}
+	retry.Header.Set("Authorization", "Bearer "+token)
+	second, err := client.Do(retry)
+	if err != nil {
+		return resp, nil
+	}
+	if second.StatusCode == http.StatusUnauthorized || second.StatusCode == http.StatusForbidden {
+		second.Body.Close()
+		return resp, nil
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	c.noteMaintenance(true, expiresAt)
+	return second, nil
+}
+
+// noteMaintenance logs when the client starts or stops relying on the
+// maintenance token, rather than on every request.
+func (c *Client) noteMaintenance(using bool, expiresAt time.Time) {
+	if c.usingMaintenance.Swap(using) == using {
+		return
+	}
+	if using {
+		c.log.Warn("primary control token rejected; authenticating with maintenance token", "expires_at", expiresAt)
+		return
+	}
+	c.log.Info("primary control token accepted again")
+}
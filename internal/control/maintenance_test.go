@@ -0,0 +1,88 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/najahiiii/xray-agent/internal/config"
+	"github.com/najahiiii/xray-agent/internal/model"
+)
+
+func TestClientFallsBackToMaintenanceToken(t *testing.T) {
+	var statsBody []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer rotated" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/api/agents/sg/state":
+			_ = json.NewEncoder(w).Encode(model.State{ConfigVersion: 7})
+		case "/api/agents/sg/stats":
+			statsBody, _ = io.ReadAll(r.Body)
+		}
+	}))
+	defer srv.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "maintenance-token")
+	cfg := &config.Config{}
+	cfg.Control.BaseURL = config.URLList{srv.URL}
+	cfg.Control.Token = "stale"
+	cfg.Control.ServerSlug = "sg"
+	cfg.Control.MaintenanceTokenFile = tokenFile
+	c := NewClient(cfg, testLogger(), "v-test", "")
+
+	if _, err := c.GetState(context.Background()); err == nil {
+		t.Fatal("expected 401 without a maintenance token")
+	}
+
+	expiry := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	if err := os.WriteFile(tokenFile, []byte("rotated "+expiry+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ds, err := c.GetState(context.Background())
+	if err != nil || ds.ConfigVersion != 7 {
+		t.Fatalf("GetState with maintenance token: %+v, %v", ds, err)
+	}
+	if err := c.PostStats(context.Background(), &model.StatsPush{Sequence: 3}); err != nil {
+		t.Fatalf("PostStats with maintenance token: %v", err)
+	}
+	var push model.StatsPush
+	if err := json.Unmarshal(statsBody, &push); err != nil || push.Sequence != 3 {
+		t.Fatalf("retried request lost its body: %q", statsBody)
+	}
+
+	expired := time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+	if err := os.WriteFile(tokenFile, []byte("rotated "+expired+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetState(context.Background()); err == nil {
+		t.Fatal("expired maintenance token should not be used")
+	}
+
+	// A reload brings in a maintenance token set in the config.
+	reloaded := *cfg
+	reloaded.Control.MaintenanceToken = "rotated"
+	reloaded.Control.MaintenanceTokenExpiresAt = time.Now().Add(time.Hour)
+	c.Reload(&reloaded)
+	if _, err := c.GetState(context.Background()); err != nil {
+		t.Fatalf("GetState with a reloaded maintenance token: %v", err)
+	}
+}
+
+func TestParseMaintenanceToken(t *testing.T) {
+	if _, _, err := parseMaintenanceToken("only-a-token\n"); err == nil {
+		t.Fatal("expected error for token without expiry")
+	}
+	token, expiresAt, err := parseMaintenanceToken("abc 2026-03-05T12:00:00Z\n")
+	if err != nil || token != "abc" || !expiresAt.Equal(time.Date(2026, time.March, 5, 12, 0, 0, 0, time.UTC)) {
+		t.Fatalf("parseMaintenanceToken: %q %v %v", token, expiresAt, err)
+	}
+}
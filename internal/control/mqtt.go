@@ -0,0 +1,330 @@
+package control
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/najahiiii/xray-agent/internal/config"
+
+	"log/slog"
+)
+
+const (
+	// mqttDialTimeout bounds connecting and subscribing to the broker.
+	mqttDialTimeout = 10 * time.Second
+	// mqttStateWait is how long the first state request waits for the
+	// retained state after subscribing.
+	mqttStateWait = 5 * time.Second
+	// mqttMaxCommands caps the commands held unacknowledged until the
+	// command loop picks them up; older ones are dropped first. It stays
+	// below the in-flight window of brokers (mosquitto allows 20
+	// unacknowledged messages per client by default), which stop delivering
+	// to a client that reaches it.
+	mqttMaxCommands = 16
+)
+
+// mqttTransport carries the agent API over an MQTT broker for
+// control.transport mqtt. A request for <path> under the agent API is
+// published to <topic_prefix>/<server_slug>/<path>, while the state and
+// commands the panel publishes to .../state and .../commands are kept here
+// and returned for GET state and GET commands/next. The connection is opened
+// by the first request and again by the next one after it drops; the broker
+// keeps the session, so commands published meanwhile are not lost. A command
+// is only acknowledged to the broker once commands/next hands it out, so the
+// broker redelivers the ones still queued here when the agent stops.
+type mqttTransport struct {
+	cfg *config.Config
+	log *slog.Logger
+
+	// dialMu serializes connection attempts; mu guards the rest and is
+	// never held while waiting on the broker, since the reading goroutine
+	// needs it to deliver messages.
+	dialMu   sync.Mutex
+	mu       sync.Mutex
+	conn     paho.Client
+	lost     error
+	slug     string
+	state    []byte
+	arrived  chan struct{}
+	commands []paho.Message
+	// notify is called whenever a new state arrives.
+	notify func()
+	// oneShot connects with a throwaway session instead of the agent's.
+	oneShot bool
+}
+
+func newMQTTTransport(cfg *config.Config, log *slog.Logger, notify func()) *mqttTransport {
+	return &mqttTransport{
+		cfg:     cfg,
+		log:     log,
+		arrived: make(chan struct{}),
+		notify:  notify,
+	}
+}
+
+func (t *mqttTransport) topic(slug, path string) string {
+	return t.cfg.Control.MQTT.TopicPrefix + "/" + slug + "/" + path
+}
+
+// roundTrip answers req, built for the agent API of ep, through the broker.
+func (t *mqttTransport) roundTrip(req *http.Request, ep endpoint) (*http.Response, error) {
+	path, ok := strings.CutPrefix(req.URL.Path, "/api/agents/"+ep.serverSlug+"/")
+	if !ok {
+		return nil, fmt.Errorf("%s %s is not available over mqtt", req.Method, req.URL.Path)
+	}
+	ctx := req.Context()
+	conn, err := t.connect(ctx, ep)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case req.Method == http.MethodGet && path == "state":
+		body, err := t.awaitState(ctx, ep.serverSlug)
+		if err != nil {
+			return nil, err
+		}
+		return mqttResponse(req, body), nil
+	case req.Method == http.MethodGet && path == "commands/next":
+		return mqttResponse(req, t.nextCommand()), nil
+	case req.Method == http.MethodPost:
+		var body []byte
+		if req.Body != nil {
+			if body, err = io.ReadAll(req.Body); err != nil {
+				return nil, err
+			}
+		}
+		if err := await(ctx, conn.Publish(t.topic(ep.serverSlug, path), 1, false, body)); err != nil {
+			return nil, fmt.Errorf("mqtt publish %s: %w", path, err)
+		}
+		return mqttResponse(req, nil), nil
+	}
+	return nil, fmt.Errorf("%s %s is not available over mqtt", req.Method, req.URL.Path)
+}
+
+// connect returns the open connection, dialing and subscribing first when
+// there is none.
+func (t *mqttTransport) connect(ctx context.Context, ep endpoint) (paho.Client, error) {
+	t.dialMu.Lock()
+	defer t.dialMu.Unlock()
+	t.mu.Lock()
+	if t.conn != nil {
+		if t.conn.IsConnectionOpen() {
+			conn := t.conn
+			t.mu.Unlock()
+			return conn, nil
+		}
+		t.log.Warn("mqtt connection lost; reconnecting", "err", t.lost)
+		// The broker delivers the commands that were never acknowledged
+		// again on the new connection.
+		t.conn, t.commands = nil, nil
+	}
+	if t.slug != ep.serverSlug {
+		// A reload moved the node to other topics; what was received for
+		// the old slug no longer applies.
+		t.slug, t.state, t.commands = ep.serverSlug, nil, nil
+		t.arrived = make(chan struct{})
+	}
+	t.mu.Unlock()
+
+	broker, err := mqttBrokerURL(t.cfg.Control.MQTT.Broker)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, mqttDialTimeout)
+	defer cancel()
+	clientID := t.cfg.Control.MQTT.TopicPrefix + "-" + ep.serverSlug
+	if t.oneShot {
+		clientID += fmt.Sprintf("-cli-%d", os.Getpid())
+	}
+	opts := paho.NewClientOptions().
+		AddBroker(broker).
+		SetClientID(clientID).
+		// The broker keeps the agent's subscriptions and queues commands
+		// for it while it is disconnected.
+		SetCleanSession(t.oneShot).
+		SetUsername(t.cfg.Control.MQTT.Username).
+		SetPassword(ep.token).
+		SetKeepAlive(time.Duration(t.cfg.Control.MQTT.KeepAliveSec) * time.Second).
+		SetTLSConfig(&tls.Config{ //nolint:gosec
+			InsecureSkipVerify: t.cfg.Control.TLSInsecure,
+			MinVersion:         tls.VersionTLS12,
+		}).
+		SetConnectTimeout(mqttDialTimeout).
+		// Reconnecting is left to the next request, and commands are
+		// acknowledged by nextCommand.
+		SetAutoReconnect(false).
+		SetAutoAckDisabled(true).
+		SetConnectionLostHandler(func(_ paho.Client, err error) {
+			t.mu.Lock()
+			t.lost = err
+			t.mu.Unlock()
+		})
+	conn := paho.NewClient(opts)
+	if err := await(ctx, conn.Connect()); err != nil {
+		// A connect that completes after the timeout would otherwise keep a
+		// client with the agent's ID alive.
+		conn.Disconnect(0)
+		return nil, fmt.Errorf("mqtt connect %s: %w", broker, err)
+	}
+	// The state is subscribed at QoS 0: it is retained and sent again on
+	// every subscribe, and must not wait behind unacknowledged commands.
+	topics := map[string]byte{t.topic(ep.serverSlug, "state"): 0, t.topic(ep.serverSlug, "commands"): 1}
+	sub := conn.SubscribeMultiple(topics, func(_ paho.Client, m paho.Message) { t.receive(ep.serverSlug, m) })
+	err = await(ctx, sub)
+	if err == nil {
+		for topic, code := range sub.(*paho.SubscribeToken).Result() {
+			if code == 0x80 {
+				err = fmt.Errorf("subscription to %s refused", topic)
+			}
+		}
+	}
+	if err != nil {
+		conn.Disconnect(0)
+		return nil, fmt.Errorf("mqtt subscribe: %w", err)
+	}
+	t.log.Info("connected to mqtt broker", "broker", broker, "topics", t.topic(ep.serverSlug, "#"))
+	t.mu.Lock()
+	t.conn = conn
+	t.mu.Unlock()
+	return conn, nil
+}
+
+// mqttBrokerURL checks control.mqtt.broker and fills in the default port,
+// 1883 or 8883 with TLS.
+func mqttBrokerURL(broker string) (string, error) {
+	u, err := url.Parse(broker)
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("mqtt: invalid broker %q", broker)
+	}
+	port := "1883"
+	switch u.Scheme {
+	case "tcp", "mqtt":
+	case "tls", "ssl", "mqtts":
+		port = "8883"
+	default:
+		return "", fmt.Errorf("mqtt: broker %q must use tcp:// or tls://", broker)
+	}
+	if u.Port() != "" {
+		port = u.Port()
+	}
+	u.Host = net.JoinHostPort(u.Hostname(), port)
+	return u.String(), nil
+}
+
+// await waits for tok to complete, giving up when ctx is done.
+func await(ctx context.Context, tok paho.Token) error {
+	select {
+	case <-tok.Done():
+		return tok.Error()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// receive keeps a state or command the panel published for slug. Commands
+// are acknowledged once nextCommand hands them out, anything else right away.
+func (t *mqttTransport) receive(slug string, m paho.Message) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if slug != t.slug {
+		m.Ack()
+		return
+	}
+	switch m.Topic() {
+	case t.topic(slug, "state"):
+		m.Ack()
+		first := t.state == nil
+		t.state = m.Payload()
+		if first {
+			close(t.arrived)
+		}
+		t.notify()
+	case t.topic(slug, "commands"):
+		if !json.Valid(m.Payload()) {
+			t.log.Warn("ignoring malformed mqtt command", "topic", m.Topic())
+			m.Ack()
+			return
+		}
+		if len(t.commands) == mqttMaxCommands {
+			t.log.Warn("mqtt command queue full; dropping the oldest command")
+			t.commands[0].Ack()
+			t.commands = t.commands[1:]
+		}
+		t.commands = append(t.commands, m)
+	default:
+		m.Ack()
+	}
+}
+
+// awaitState returns the last state received, waiting briefly for the
+// retained one right after subscribing.
+func (t *mqttTransport) awaitState(ctx context.Context, slug string) ([]byte, error) {
+	t.mu.Lock()
+	arrived := t.arrived
+	t.mu.Unlock()
+	timer := time.NewTimer(mqttStateWait)
+	defer timer.Stop()
+	select {
+	case <-arrived:
+	case <-timer.C:
+		return nil, fmt.Errorf("no state published to %s yet", t.topic(slug, "state"))
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.state, nil
+}
+
+// nextCommand pops the oldest queued command as a commands/next body.
+func (t *mqttTransport) nextCommand() []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.commands) == 0 {
+		return []byte(`{"command":null}`)
+	}
+	cmd := t.commands[0]
+	t.commands = t.commands[1:]
+	cmd.Ack()
+	body, _ := json.Marshal(struct {
+		Command json.RawMessage `json:"command"`
+	}{cmd.Payload()})
+	return body
+}
+
+// reset drops the connection so the next request reconnects with the
+// current token and slug.
+func (t *mqttTransport) reset() {
+	t.mu.Lock()
+	conn := t.conn
+	t.conn, t.commands = nil, nil
+	t.mu.Unlock()
+	// Disconnect waits for the client's goroutines, which may need t.mu to
+	// deliver a message.
+	if conn != nil {
+		conn.Disconnect(250)
+	}
+}
+
+func mqttResponse(req *http.Request, body []byte) *http.Response {
+	return &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       io.NopCloser(bytes.NewReader(body)),
+		Request:    req,
+	}
+}
@@ -0,0 +1,115 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/najahiiii/xray-agent/internal/config"
+	"github.com/najahiiii/xray-agent/internal/model"
+	"github.com/najahiiii/xray-agent/testsupport"
+)
+
+func TestClientOverMQTT(t *testing.T) {
+	broker := testsupport.NewBroker(t)
+	broker.RequireLogin("sg", "t")
+	broker.Publish("xray-agent/sg/state", []byte(`{"config_version":7}`), true)
+
+	cfg := &config.Config{}
+	cfg.Control.Token = "t"
+	cfg.Control.ServerSlug = "sg"
+	cfg.Control.Transport = config.TransportMQTT
+	cfg.Control.MQTT.Broker = "tcp://" + broker.Addr
+	cfg.Control.MQTT.Username = "sg"
+	cfg.Control.MQTT.TopicPrefix = "xray-agent"
+	c := NewClient(cfg, testLogger(), "v-test", "")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	ds, err := c.GetState(ctx)
+	if err != nil || ds.ConfigVersion != 7 {
+		t.Fatalf("GetState = %+v, %v", ds, err)
+	}
+	if err := c.PostStats(ctx, &model.StatsPush{Sequence: 3}); err != nil {
+		t.Fatalf("PostStats: %v", err)
+	}
+	msgs := broker.Published("xray-agent/sg/stats")
+	var push model.StatsPush
+	if len(msgs) != 1 || json.Unmarshal(msgs[0].Payload, &push) != nil || push.Sequence != 3 {
+		t.Fatalf("published stats = %+v", msgs)
+	}
+
+	// A pushed state wakes the state loop and replaces the retained one.
+	<-c.StateUpdates() // signalled by the retained state
+	broker.Publish("xray-agent/sg/state", []byte(`{"config_version":8}`), true)
+	select {
+	case <-c.StateUpdates():
+	case <-ctx.Done():
+		t.Fatal("no state update signalled")
+	}
+	if ds, err := c.GetState(ctx); err != nil || ds.ConfigVersion != 8 {
+		t.Fatalf("GetState after push = %+v, %v", ds, err)
+	}
+
+	if cmd, err := c.GetNextCommand(ctx); err != nil || cmd != nil {
+		t.Fatalf("GetNextCommand with none queued = %+v, %v", cmd, err)
+	}
+	// The state comes at QoS 0 and needs no ack; a command is acknowledged
+	// only once the command loop takes it.
+	broker.Publish("xray-agent/sg/commands", []byte(`{"id":"c1","type":"RESTART_XRAY"}`), false)
+	for queued := 0; queued == 0 && ctx.Err() == nil; time.Sleep(10 * time.Millisecond) {
+		c.mqtt.mu.Lock()
+		queued = len(c.mqtt.commands)
+		c.mqtt.mu.Unlock()
+	}
+	if n := broker.Acks(); n != 0 {
+		t.Fatalf("acks with the command queued = %d, want 0", n)
+	}
+	cmd, err := c.GetNextCommand(ctx)
+	if err != nil || cmd == nil || cmd.ID != "c1" {
+		t.Fatalf("GetNextCommand = %+v, %v", cmd, err)
+	}
+	waitForAcks(ctx, t, broker, 1)
+	if err := c.AckCommand(ctx, "c1", &model.AgentCommandAck{Status: model.AgentCommandAckSucceeded}); err != nil {
+		t.Fatalf("AckCommand: %v", err)
+	}
+	if msgs := broker.Published("xray-agent/sg/commands/c1/ack"); len(msgs) != 1 {
+		t.Fatalf("published acks = %+v", msgs)
+	}
+
+	// A dropped connection is opened again by the next request.
+	broker.DropClients()
+	time.Sleep(50 * time.Millisecond)
+	if err := c.Heartbeat(ctx, nil); err != nil {
+		t.Fatalf("Heartbeat after the broker dropped the agent: %v", err)
+	}
+	if broker.Connects() != 2 || len(broker.Published("xray-agent/sg/heartbeat")) != 1 {
+		t.Fatalf("connects = %d, heartbeats = %d", broker.Connects(), len(broker.Published("xray-agent/sg/heartbeat")))
+	}
+}
+
+func waitForAcks(ctx context.Context, t *testing.T, broker *testsupport.Broker, want int) {
+	t.Helper()
+	for broker.Acks() < want {
+		if ctx.Err() != nil {
+			t.Fatalf("broker got %d acks, want %d", broker.Acks(), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMQTTBrokerURL(t *testing.T) {
+	for broker, want := range map[string]string{
+		"tcp://mqtt.example.com":   "tcp://mqtt.example.com:1883",
+		"tls://mqtt.example.com":   "tls://mqtt.example.com:8883",
+		"mqtts://10.0.0.1:9883":    "mqtts://10.0.0.1:9883",
+		"https://mqtt.example.com": "",
+		"mqtt.example.com:1883":    "",
+	} {
+		got, err := mqttBrokerURL(broker)
+		if got != want || (err == nil) != (want != "") {
+			t.Errorf("mqttBrokerURL(%q) = %q, %v, want %q", broker, got, err, want)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package control
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/najahiiii/xray-agent/internal/model"
+)
+
+// Register enrolls this node with the panel at baseURL using a one-time
+// bootstrap token and returns the server slug and permanent token it assigns.
+// It runs before the agent has a config, so it does not use a Client.
+func Register(ctx context.Context, baseURL, bootstrapToken string, tlsInsecure bool, p *model.RegisterRequest) (*model.RegisterResponse, error) {
+	if bootstrapToken == "" {
+		return nil, errors.New("bootstrap token required")
+	}
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(p); err != nil {
+		return nil, err
+	}
+	url := strings.TrimRight(baseURL, "/") + "/api/agents/register"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, &buf)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+bootstrapToken)
+
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{ //nolint:gosec
+				InsecureSkipVerify: tlsInsecure,
+				MinVersion:         tls.VersionTLS12,
+			},
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("register http %d: %s", resp.StatusCode, string(b))
+	}
+	var out model.RegisterResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, err
+	}
+	if out.ServerSlug == "" || out.Token == "" {
+		return nil, errors.New("register: panel returned no server_slug or token")
+	}
+	if strings.ContainsAny(out.ServerSlug, "/?#") {
+		return nil, fmt.Errorf("register: invalid server_slug %q", out.ServerSlug)
+	}
+	return &out, nil
+}
@@ -0,0 +1,46 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/najahiiii/xray-agent/internal/model"
+)
+
+func TestRegisterExchangesBootstrapToken(t *testing.T) {
+	var got model.RegisterRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/agents/register" || r.Header.Get("Authorization") != "Bearer boot" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_ = json.NewDecoder(r.Body).Decode(&got)
+		_ = json.NewEncoder(w).Encode(model.RegisterResponse{ServerSlug: "sg-7", Token: "permanent"})
+	}))
+	defer srv.Close()
+
+	resp, err := Register(context.Background(), srv.URL+"/", "boot", false, &model.RegisterRequest{Hostname: "edge-7", OS: "linux", Arch: "amd64"})
+	if err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	if resp.ServerSlug != "sg-7" || resp.Token != "permanent" || got.Hostname != "edge-7" {
+		t.Fatalf("resp = %+v, request = %+v", resp, got)
+	}
+	if _, err := Register(context.Background(), srv.URL, "wrong", false, &model.RegisterRequest{}); err == nil {
+		t.Fatal("expected an error for a rejected bootstrap token")
+	}
+}
+
+func TestRegisterRejectsIncompleteIdentity(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(model.RegisterResponse{ServerSlug: "../admin", Token: "t"})
+	}))
+	defer srv.Close()
+
+	if _, err := Register(context.Background(), srv.URL, "boot", false, &model.RegisterRequest{}); err == nil {
+		t.Fatal("accepted a slug that escapes the agent API path")
+	}
+}
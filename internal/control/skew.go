@@ -0,0 +1,47 @@
+package control
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/najahiiii/xray-agent/internal/config"
+)
+
+// ClockSkew returns how far the local clock is ahead of the panel's (behind
+// when negative), as last measured from the Date header of a panel response.
+// ok is false until a response carried one.
+func (c *Client) ClockSkew() (skew time.Duration, ok bool) {
+	c.skewMu.Lock()
+	defer c.skewMu.Unlock()
+	return c.skew, c.skewKnown
+}
+
+// noteClockSkew measures the skew against resp, sent at start and received
+// at end. Date has second resolution, so the panel's clock is taken to be
+// half a second past it, and the local clock at the midpoint of the round
+// trip; the estimate is good to about half a second plus half the round trip.
+func (c *Client) noteClockSkew(resp *http.Response, start, end time.Time) {
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return
+	}
+	local := start.Add(end.Sub(start) / 2)
+	skew := local.Sub(date.Add(500 * time.Millisecond)).Round(time.Millisecond)
+
+	limit := time.Duration(c.cfg.Control.MaxClockSkewSec) * time.Second
+	if c.cfg.Control.MaxClockSkewSec == 0 {
+		limit = config.DefaultMaxClockSkewSec * time.Second
+	}
+	over := limit > 0 && (skew > limit || skew < -limit)
+
+	c.skewMu.Lock()
+	defer c.skewMu.Unlock()
+	switch {
+	case over && !c.skewWarned:
+		c.log.Error("local clock disagrees with the control panel; stats and metrics timestamps will be wrong, check NTP",
+			"skew", skew, "max", limit)
+	case !over && c.skewWarned:
+		c.log.Info("local clock agrees with the control panel again", "skew", skew)
+	}
+	c.skew, c.skewKnown, c.skewWarned = skew, true, over
+}
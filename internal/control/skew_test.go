@@ -0,0 +1,79 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/najahiiii/xray-agent/internal/config"
+	"github.com/najahiiii/xray-agent/internal/model"
+)
+
+func TestClientMeasuresClockSkew(t *testing.T) {
+	var offset time.Duration
+	var beats []model.HeartbeatPush
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var beat model.HeartbeatPush
+		_ = json.NewDecoder(r.Body).Decode(&beat)
+		beats = append(beats, beat)
+		w.Header().Set("Date", time.Now().Add(offset).UTC().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	cfg := &config.Config{}
+	cfg.Control.BaseURL = config.URLList{srv.URL}
+	cfg.Control.ServerSlug = "sg"
+	cfg.Control.MaxClockSkewSec = 30
+	c := NewClient(cfg, testLogger(), "v-test", "")
+	ctx := context.Background()
+
+	if _, ok := c.ClockSkew(); ok {
+		t.Fatal("skew known before any response")
+	}
+	offset = -time.Hour
+	if err := c.Heartbeat(ctx, nil); err != nil {
+		t.Fatalf("Heartbeat: %v", err)
+	}
+	skew, ok := c.ClockSkew()
+	if !ok || skew < time.Hour-2*time.Second || skew > time.Hour+2*time.Second {
+		t.Fatalf("ClockSkew() = %v, %v; want about 1h", skew, ok)
+	}
+	if beats[0].ClockSkewMs != nil {
+		t.Fatalf("first heartbeat carried clock_skew_ms %d before any measurement", *beats[0].ClockSkewMs)
+	}
+	if !c.skewWarned {
+		t.Fatal("a one hour skew was not flagged")
+	}
+
+	offset = 0
+	if err := c.Heartbeat(ctx, nil); err != nil {
+		t.Fatalf("Heartbeat: %v", err)
+	}
+	if ms := beats[1].ClockSkewMs; ms == nil || *ms < 3590_000 {
+		t.Fatalf("second heartbeat clock_skew_ms = %v, want the 1h measured before", ms)
+	}
+	if skew, _ := c.ClockSkew(); skew > 2*time.Second || skew < -2*time.Second {
+		t.Fatalf("ClockSkew() = %v after the clocks agree", skew)
+	}
+	if c.skewWarned {
+		t.Fatal("skew still flagged after the clocks agree")
+	}
+}
+
+func TestClockSkewCheckDisabled(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Control.MaxClockSkewSec = -1
+	c := NewClient(cfg, testLogger(), "v-test", "")
+	resp := &http.Response{Header: http.Header{"Date": {time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)}}}
+	c.noteClockSkew(resp, time.Now(), time.Now())
+	if skew, ok := c.ClockSkew(); !ok || skew > -time.Hour+2*time.Second {
+		t.Fatalf("ClockSkew() = %v, %v; want about -1h", skew, ok)
+	}
+	if c.skewWarned {
+		t.Fatal("skew flagged with the check disabled")
+	}
+}
@@ -0,0 +1,133 @@
+package control
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// streamIdleTimeout drops a state stream that sent nothing, not even a
+// keep-alive comment, for this long.
+const streamIdleTimeout = 2 * time.Minute
+
+var (
+	// ErrStreamUnsupported is returned by StreamState when the panel has no
+	// state stream.
+	ErrStreamUnsupported = errors.New("panel has no state stream")
+	// ErrStreamRejected is returned by StreamState when the panel answers
+	// 401 or 403 even after the maintenance token was tried.
+	ErrStreamRejected = errors.New("panel rejected the state stream credentials")
+)
+
+// streamingKey marks the context of a request whose response is read for
+// longer than the request timeout of Client.client.
+type streamingKey struct{}
+
+// httpClient returns the client to send a request with ctx on: one without
+// the request timeout for a stream, Client.client otherwise.
+func (c *Client) httpClient(ctx context.Context) *http.Client {
+	if ctx.Value(streamingKey{}) != nil {
+		return &http.Client{Transport: c.client.Transport}
+	}
+	return c.client
+}
+
+// StreamState subscribes to GET state/stream, a Server-Sent Events stream on
+// which the panel announces state changes, and signals StateUpdates for each
+// announced config_version newer than the last state fetched. It returns when
+// the stream ends, fails or goes idle, or parent is done. The request goes
+// out like any other, with the maintenance token fallback and endpoint
+// failover.
+func (c *Client) StreamState(parent context.Context) error {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	req, err := http.NewRequestWithContext(context.WithValue(ctx, streamingKey{}, true), http.MethodGet, c.agentURL("state/stream"), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	c.auth(req)
+
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusMethodNotAllowed:
+		return ErrStreamUnsupported
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return fmt.Errorf("%w: http %d", ErrStreamRejected, resp.StatusCode)
+	case resp.StatusCode/100 != 2:
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("state stream http %d: %s", resp.StatusCode, string(b))
+	}
+
+	idle := time.AfterFunc(streamIdleTimeout, cancel)
+	defer idle.Stop()
+	var event, data string
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		idle.Reset(streamIdleTimeout)
+		line := sc.Text()
+		switch {
+		case line == "":
+			if data != "" || event != "" {
+				c.announceState(event, data)
+			}
+			event, data = "", ""
+		case strings.HasPrefix(line, ":"):
+			// Keep-alive comment.
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			if data != "" {
+				data += "\n"
+			}
+			data += strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " ")
+		}
+	}
+	switch {
+	case parent.Err() != nil:
+		return parent.Err()
+	case ctx.Err() != nil:
+		return fmt.Errorf("state stream idle for %s", streamIdleTimeout)
+	case sc.Err() != nil:
+		return sc.Err()
+	}
+	return errors.New("state stream closed by the panel")
+}
+
+// announceState signals StateUpdates for a stream event, unless it names a
+// config_version the agent already has. Events without a readable version
+// always signal; the state sync skips an unchanged state anyway.
+func (c *Client) announceState(event, data string) {
+	if event != "" && event != "message" && event != "config_version" {
+		return
+	}
+	version, ok := parseAnnouncedVersion(data)
+	if ok && version <= c.stateVersion.Load() {
+		return
+	}
+	c.notifyState()
+}
+
+// parseAnnouncedVersion reads {"config_version": N} or a bare N.
+func parseAnnouncedVersion(data string) (int64, bool) {
+	var body struct {
+		ConfigVersion *int64 `json:"config_version"`
+	}
+	if err := json.Unmarshal([]byte(data), &body); err == nil && body.ConfigVersion != nil {
+		return *body.ConfigVersion, true
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(data), 10, 64)
+	return n, err == nil
+}
@@ -0,0 +1,133 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/najahiiii/xray-agent/internal/config"
+	"github.com/najahiiii/xray-agent/internal/model"
+)
+
+func TestStreamStateSignalsNewVersions(t *testing.T) {
+	announce := make(chan string)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/agents/sg/state":
+			_ = json.NewEncoder(w).Encode(model.State{ConfigVersion: 5})
+		case "/api/agents/sg/state/stream":
+			if r.Header.Get("Authorization") != "Bearer t" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprint(w, ": connected\n\n")
+			w.(http.Flusher).Flush()
+			for event := range announce {
+				fmt.Fprint(w, event)
+				w.(http.Flusher).Flush()
+			}
+		}
+	}))
+	defer srv.Close()
+
+	cfg := &config.Config{}
+	cfg.Control.BaseURL = config.URLList{srv.URL}
+	cfg.Control.Token = "t"
+	cfg.Control.ServerSlug = "sg"
+	c := NewClient(cfg, testLogger(), "v-test", "")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := c.GetState(ctx); err != nil {
+		t.Fatalf("GetState: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- c.StreamState(ctx) }()
+
+	// The version the agent already has is not announced again.
+	announce <- "event: config_version\ndata: {\"config_version\": 5}\n\n"
+	announce <- ": keep-alive\n\n"
+	select {
+	case <-c.StateUpdates():
+		t.Fatal("signalled for the config_version already fetched")
+	case <-time.After(100 * time.Millisecond):
+	}
+	announce <- "event: config_version\ndata: {\"config_version\": 6}\n\n"
+	select {
+	case <-c.StateUpdates():
+	case <-ctx.Done():
+		t.Fatal("newer config_version not signalled")
+	}
+	announce <- "data: 7\n\n"
+	select {
+	case <-c.StateUpdates():
+	case <-ctx.Done():
+		t.Fatal("bare config_version not signalled")
+	}
+
+	close(announce)
+	if err := <-done; err == nil || ctx.Err() != nil {
+		t.Fatalf("StreamState after the panel closed the stream: %v", err)
+	}
+}
+
+func TestStreamStateUnsupported(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	cfg := &config.Config{}
+	cfg.Control.BaseURL = config.URLList{srv.URL}
+	cfg.Control.ServerSlug = "sg"
+	c := NewClient(cfg, testLogger(), "v-test", "")
+
+	if err := c.StreamState(context.Background()); !errors.Is(err, ErrStreamUnsupported) {
+		t.Fatalf("StreamState against a panel without a stream: %v", err)
+	}
+}
+
+func TestStreamStateAuthenticatesLikeOtherRequests(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer maint" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: 1\n\n")
+	}))
+	defer srv.Close()
+
+	cfg := &config.Config{}
+	cfg.Control.BaseURL = config.URLList{down.URL, srv.URL}
+	cfg.Control.Token = "rotated-wrongly"
+	cfg.Control.ServerSlug = "sg"
+	cfg.Control.MaintenanceToken = "maint"
+	cfg.Control.MaintenanceTokenExpiresAt = time.Now().Add(time.Hour)
+	c := NewClient(cfg, testLogger(), "v-test", "")
+
+	// The stream fails over to the endpoint that is up and falls back to the
+	// maintenance token there.
+	if err := c.StreamState(context.Background()); err == nil || errors.Is(err, ErrStreamRejected) {
+		t.Fatalf("StreamState: %v", err)
+	}
+	select {
+	case <-c.StateUpdates():
+	default:
+		t.Fatal("announced version not signalled")
+	}
+
+	reloaded := *cfg
+	reloaded.Control.MaintenanceToken = ""
+	c.Reload(&reloaded)
+	if err := c.StreamState(context.Background()); !errors.Is(err, ErrStreamRejected) {
+		t.Fatalf("StreamState with a rejected token: %v", err)
+	}
+}
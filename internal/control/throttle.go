@@ -0,0 +1,98 @@
+package control
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/najahiiii/xray-agent/internal/config"
+)
+
+// defaultThrottleDelay is how long the agent backs off after a 429 that does
+// not say how long to wait.
+const defaultThrottleDelay = 30 * time.Second
+
+// do sends req through failover, or the broker with control.transport mqtt,
+// and notes when the panel asks the agent to slow down and how far the local
+// clock is off from the panel's.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	if c.mqtt != nil {
+		return c.mqtt.roundTrip(req, c.endpoint())
+	}
+	start := time.Now()
+	resp, err := c.failover(req)
+	if err != nil {
+		return nil, err
+	}
+	c.noteClockSkew(resp, start, time.Now())
+	if delay, ok := c.throttleDelay(resp, time.Now()); ok {
+		c.noteThrottle(time.Now().Add(delay), resp.StatusCode)
+	}
+	return resp, nil
+}
+
+// ThrottledUntil returns when the panel last asked the agent to retry, or the
+// zero time when it has not. The agent loops hold their next run until then.
+func (c *Client) ThrottledUntil() time.Time {
+	c.throttleMu.Lock()
+	defer c.throttleMu.Unlock()
+	return c.throttledUntil
+}
+
+// throttleDelay returns how long to back off after resp: the Retry-After of a
+// 429, or of a 503 that carries one, capped at control.max_retry_after_sec.
+func (c *Client) throttleDelay(resp *http.Response, now time.Time) (time.Duration, bool) {
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests:
+	case http.StatusServiceUnavailable:
+		if resp.Header.Get("Retry-After") == "" {
+			return 0, false
+		}
+	default:
+		return 0, false
+	}
+	delay, ok := parseRetryAfter(resp.Header.Get("Retry-After"), now)
+	if !ok {
+		delay = defaultThrottleDelay
+	}
+	maxDelay := time.Duration(c.cfg.Control.MaxRetryAfterSec) * time.Second
+	if maxDelay <= 0 {
+		maxDelay = config.DefaultMaxRetryAfterSec * time.Second
+	}
+	return min(delay, maxDelay), delay > 0
+}
+
+// parseRetryAfter reads a Retry-After value in delay seconds or as an HTTP
+// date.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if secs, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(min(secs, int64(24*time.Hour/time.Second))) * time.Second, true
+	}
+	at, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	return max(at.Sub(now), 0), true
+}
+
+// noteThrottle extends the back-off to until and logs when a new one starts
+// rather than on every throttled request.
+func (c *Client) noteThrottle(until time.Time, status int) {
+	c.throttleMu.Lock()
+	defer c.throttleMu.Unlock()
+	if !until.After(c.throttledUntil) {
+		return
+	}
+	if !c.throttledUntil.After(time.Now()) {
+		c.log.Warn("control panel is throttling the agent; backing off", "status", status, "until", until.Format(time.RFC3339))
+	}
+	c.throttledUntil = until
+}
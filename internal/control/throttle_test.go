@@ -0,0 +1,84 @@
+package control
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/najahiiii/xray-agent/internal/config"
+	"github.com/najahiiii/xray-agent/internal/model"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2025, 11, 7, 3, 12, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{value: "120", want: 2 * time.Minute, ok: true},
+		{value: " 0 ", want: 0, ok: true},
+		{value: "Fri, 07 Nov 2025 03:13:30 GMT", want: 90 * time.Second, ok: true},
+		{value: "Fri, 07 Nov 2025 03:11:00 GMT", want: 0, ok: true},
+		{value: "", ok: false},
+		{value: "-5", ok: false},
+		{value: "soon", ok: false},
+	} {
+		got, ok := parseRetryAfter(tc.value, now)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("parseRetryAfter(%q) = %v, %v; want %v, %v", tc.value, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestClientRecordsRetryAfter(t *testing.T) {
+	var status int
+	var retryAfter string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if retryAfter != "" {
+			w.Header().Set("Retry-After", retryAfter)
+		}
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	cfg := &config.Config{}
+	cfg.Control.BaseURL = config.URLList{srv.URL}
+	cfg.Control.ServerSlug = "sg"
+	cfg.Control.MaxRetryAfterSec = 300
+	c := NewClient(cfg, testLogger(), "v-test", "")
+	ctx := context.Background()
+
+	status = http.StatusServiceUnavailable
+	if err := c.Heartbeat(ctx, nil); err == nil {
+		t.Fatal("Heartbeat succeeded on 503")
+	}
+	if !c.ThrottledUntil().IsZero() {
+		t.Fatalf("a 503 without Retry-After throttled the client until %v", c.ThrottledUntil())
+	}
+
+	status, retryAfter = http.StatusTooManyRequests, "60"
+	start := time.Now()
+	if err := c.PostStats(ctx, &model.StatsPush{}); err == nil {
+		t.Fatal("PostStats succeeded on 429")
+	}
+	if got := c.ThrottledUntil().Sub(start); got < 59*time.Second || got > 61*time.Second {
+		t.Fatalf("throttled for %v, want about 60s", got)
+	}
+
+	// Retry-After is capped at control.max_retry_after_sec.
+	retryAfter = "86400"
+	_ = c.Heartbeat(ctx, nil)
+	if got := c.ThrottledUntil().Sub(start); got < 299*time.Second || got > 301*time.Second {
+		t.Fatalf("throttled for %v, want the 300s cap", got)
+	}
+
+	// A shorter Retry-After does not cut an earlier back-off short.
+	retryAfter = "1"
+	_ = c.Heartbeat(ctx, nil)
+	if got := c.ThrottledUntil().Sub(start); got < 299*time.Second {
+		t.Fatalf("throttled for %v after a shorter Retry-After, want the earlier 300s", got)
+	}
+}
@@ -0,0 +1,43 @@
+package debugserver
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValidateListen(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:6060", "[::1]:6060", "localhost:6060"} {
+		if err := ValidateListen(addr); err != nil {
+			t.Fatalf("ValidateListen(%q): %v", addr, err)
+		}
+	}
+	for _, addr := range []string{"0.0.0.0:6060", ":6060", "10.0.0.1:6060", "127.0.0.1"} {
+		if err := ValidateListen(addr); err == nil {
+			t.Fatalf("ValidateListen(%q): expected error", addr)
+		}
+	}
+}
+
+func TestHandlerServesPprofAndExpvar(t *testing.T) {
+	srv := httptest.NewServer(Handler())
+	defer srv.Close()
+
+	for path, want := range map[string]string{
+		"/debug/pprof/":                  "goroutine",
+		"/debug/pprof/goroutine?debug=1": "goroutine profile",
+		"/debug/vars":                    "memstats",
+	} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), want) {
+			t.Fatalf("GET %s: status %d, body missing %q", path, resp.StatusCode, want)
+		}
+	}
+}
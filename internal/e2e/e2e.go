@@ -0,0 +1,386 @@
+// Package e2e runs a smoke test of the agent against a real xray-core binary
+// and an in-process mock control panel.
+package e2e
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/najahiiii/xray-agent/internal/agent"
+	"github.com/najahiiii/xray-agent/internal/config"
+	"github.com/najahiiii/xray-agent/internal/control"
+	"github.com/najahiiii/xray-agent/internal/metrics"
+	"github.com/najahiiii/xray-agent/internal/model"
+	"github.com/najahiiii/xray-agent/internal/stats"
+	"github.com/najahiiii/xray-agent/internal/xray"
+
+	handlerService "github.com/xtls/xray-core/app/proxyman/command"
+	routerService "github.com/xtls/xray-core/app/router/command"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+const (
+	defaultXrayBin = "xray"
+	defaultTimeout = 60 * time.Second
+	apiReadyWait   = 10 * time.Second
+	serverSlug     = "e2e"
+	vlessTag       = "e2e-vless"
+	vmessTag       = "e2e-vmess"
+	trojanTag      = "e2e-trojan"
+	routeTag       = "e2e-block-private"
+)
+
+// Options configures Run.
+type Options struct {
+	// XrayBin is the xray-core binary to launch (default "xray" from PATH).
+	XrayBin string
+	// Timeout bounds the whole run.
+	Timeout time.Duration
+	// KeepDir leaves the generated config and xray output on disk.
+	KeepDir bool
+	Logger  *slog.Logger
+}
+
+// Result summarizes what the mock panel and the xray runtime observed.
+type Result struct {
+	WorkDir       string
+	StateRequests int
+	StatsUsers    int
+	MetricsPushes int
+	Heartbeats    int
+	InboundUsers  map[string][]string
+	RuleTags      []string
+}
+
+var desiredState = model.State{
+	ConfigVersion: 1,
+	Clients: []model.Client{
+		{Proto: "vless", ID: "6f1b3c2a-1d2e-4f5a-9b8c-7d6e5f4a3b2c", Email: "vless@e2e"},
+		{Proto: "vmess", ID: "0c9d8e7f-6a5b-4c3d-8e2f-1a0b9c8d7e6f", Email: "vmess@e2e"},
+		{Proto: "trojan", Password: "e2e-trojan-pass", Email: "trojan@e2e"},
+	},
+	Routes: []model.RouteRule{
+		{Tag: routeTag, OutboundTag: "blocked", IP: []string{"geoip:private"}},
+	},
+}
+
+// Run starts xray with a generated config, points an agent at it and at a mock
+// panel, runs one full cycle, and verifies the panel and runtime state.
+func Run(ctx context.Context, opts Options) (*Result, error) {
+	if opts.XrayBin == "" {
+		opts.XrayBin = defaultXrayBin
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultTimeout
+	}
+	log := opts.Logger
+	if log == nil {
+		log = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+
+	xrayBin, err := exec.LookPath(opts.XrayBin)
+	if err != nil {
+		return nil, fmt.Errorf("locate xray binary: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
+
+	workDir, err := os.MkdirTemp("", "xray-agent-e2e-*")
+	if err != nil {
+		return nil, err
+	}
+	if !opts.KeepDir {
+		defer os.RemoveAll(workDir)
+	}
+
+	ports, err := freePorts(4)
+	if err != nil {
+		return nil, err
+	}
+	apiAddr := fmt.Sprintf("127.0.0.1:%d", ports[0])
+
+	xrayConfig, err := buildXrayConfig(ports[0], ports[1], ports[2], ports[3])
+	if err != nil {
+		return nil, err
+	}
+	configPath := filepath.Join(workDir, "xray.json")
+	if err := os.WriteFile(configPath, xrayConfig, 0o600); err != nil {
+		return nil, err
+	}
+
+	stopXray, err := startXray(ctx, xrayBin, configPath, filepath.Join(workDir, "xray.log"))
+	if err != nil {
+		return nil, err
+	}
+	defer stopXray()
+
+	if err := waitForAPI(ctx, apiAddr); err != nil {
+		return nil, err
+	}
+	log.Info("e2e xray-core started", "api", apiAddr, "work_dir", workDir)
+
+	panel := newMockPanel()
+	srv := httptest.NewServer(panel)
+	defer srv.Close()
+
+	cfg := &config.Config{}
+	cfg.Control.BaseURL = config.URLList{srv.URL}
+	cfg.Control.Token = panel.token
+	cfg.Control.ServerSlug = serverSlug
+	cfg.Xray.APIServer = apiAddr
+	cfg.Xray.APITimeoutSec = config.DefaultAPITimeoutSec
+	cfg.Xray.StatsResetEachPush = true
+	cfg.Xray.InboundTags.VLESS = vlessTag
+	cfg.Xray.InboundTags.VMESS = vmessTag
+	cfg.Xray.InboundTags.TROJAN = trojanTag
+
+	ctrl := control.NewClient(cfg, log, "e2e", "")
+	agt := agent.New(cfg, log, ctrl, xray.NewManager(cfg, log), stats.New(cfg, log), metrics.New(log, metrics.Options{}))
+	if err := agt.RunOnce(ctx); err != nil {
+		return nil, fmt.Errorf("agent cycle: %w", err)
+	}
+
+	res := &Result{WorkDir: workDir}
+	panel.fill(res)
+	if res.InboundUsers, res.RuleTags, err = inspectRuntime(ctx, apiAddr); err != nil {
+		return res, err
+	}
+	return res, verify(res)
+}
+
+func verify(res *Result) error {
+	var errs []error
+	if res.StateRequests == 0 {
+		errs = append(errs, errors.New("panel never served state"))
+	}
+	if res.StatsUsers != len(desiredState.Clients) {
+		errs = append(errs, fmt.Errorf("stats push carried %d users, want %d", res.StatsUsers, len(desiredState.Clients)))
+	}
+	if res.MetricsPushes == 0 {
+		errs = append(errs, errors.New("panel received no metrics"))
+	}
+	if res.Heartbeats == 0 {
+		errs = append(errs, errors.New("panel received no heartbeat"))
+	}
+	for _, c := range desiredState.Clients {
+		tag := map[string]string{"vless": vlessTag, "vmess": vmessTag, "trojan": trojanTag}[c.Proto]
+		if !slices.Contains(res.InboundUsers[tag], c.Email) {
+			errs = append(errs, fmt.Errorf("user %s missing from inbound %s", c.Email, tag))
+		}
+	}
+	if !slices.Contains(res.RuleTags, routeTag) {
+		errs = append(errs, fmt.Errorf("route %s missing from runtime rules", routeTag))
+	}
+	return errors.Join(errs...)
+}
+
+// buildXrayConfig renders a minimal xray config exposing the API services and
+// one inbound per supported protocol, all bound to localhost.
+func buildXrayConfig(apiPort, vlessPort, vmessPort, trojanPort int) ([]byte, error) {
+	level := map[string]any{
+		"statsUserUplink":   true,
+		"statsUserDownlink": true,
+		"statsUserOnline":   true,
+	}
+	cfg := map[string]any{
+		"log": map[string]any{"loglevel": "warning"},
+		"api": map[string]any{
+			"tag":      "api",
+			"services": []string{"HandlerService", "RoutingService", "StatsService"},
+		},
+		"stats":  map[string]any{},
+		"policy": map[string]any{"levels": map[string]any{"0": level}},
+		"inbounds": []map[string]any{
+			{
+				"tag": "api", "listen": "127.0.0.1", "port": apiPort, "protocol": "dokodemo-door",
+				"settings": map[string]any{"address": "127.0.0.1"},
+			},
+			{
+				"tag": vlessTag, "listen": "127.0.0.1", "port": vlessPort, "protocol": "vless",
+				"settings": map[string]any{"clients": []any{}, "decryption": "none"},
+			},
+			{
+				"tag": vmessTag, "listen": "127.0.0.1", "port": vmessPort, "protocol": "vmess",
+				"settings": map[string]any{"clients": []any{}},
+			},
+			{
+				"tag": trojanTag, "listen": "127.0.0.1", "port": trojanPort, "protocol": "trojan",
+				"settings": map[string]any{"clients": []any{}},
+			},
+		},
+		"outbounds": []map[string]any{
+			{"protocol": "freedom", "tag": "direct"},
+			{"protocol": "blackhole", "tag": "blocked"},
+		},
+		"routing": map[string]any{
+			"rules": []map[string]any{
+				{"type": "field", "inboundTag": []string{"api"}, "outboundTag": "api"},
+			},
+		},
+	}
+	return json.MarshalIndent(cfg, "", "  ")
+}
+
+func freePorts(n int) ([]int, error) {
+	ports := make([]int, 0, n)
+	listeners := make([]net.Listener, 0, n)
+	defer func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
+	for range n {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, l)
+		ports = append(ports, l.Addr().(*net.TCPAddr).Port)
+	}
+	return ports, nil
+}
+
+func startXray(ctx context.Context, bin string, configPath string, logPath string) (func(), error) {
+	logFile, err := os.Create(logPath)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.CommandContext(ctx, bin, "run", "-c", configPath)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	if err := cmd.Start(); err != nil {
+		logFile.Close()
+		return nil, fmt.Errorf("start xray: %w", err)
+	}
+	return func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		logFile.Close()
+	}, nil
+}
+
+func waitForAPI(ctx context.Context, addr string) error {
+	deadline := time.Now().Add(apiReadyWait)
+	for {
+		conn, err := net.DialTimeout("tcp", addr, 500*time.Millisecond)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("xray api %s not ready: %w", addr, err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+}
+
+func inspectRuntime(ctx context.Context, apiAddr string) (map[string][]string, []string, error) {
+	conn, err := grpc.NewClient(apiAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+
+	handler := handlerService.NewHandlerServiceClient(conn)
+	users := map[string][]string{}
+	for _, tag := range []string{vlessTag, vmessTag, trojanTag} {
+		resp, err := handler.GetInboundUsers(ctx, &handlerService.GetInboundUserRequest{Tag: tag})
+		if err != nil {
+			return nil, nil, fmt.Errorf("list users on %s: %w", tag, err)
+		}
+		for _, u := range resp.GetUsers() {
+			users[tag] = append(users[tag], u.GetEmail())
+		}
+	}
+
+	rules, err := routerService.NewRoutingServiceClient(conn).ListRule(ctx, &routerService.ListRuleRequest{})
+	if err != nil {
+		return nil, nil, fmt.Errorf("list rules: %w", err)
+	}
+	var ruleTags []string
+	for _, r := range rules.GetRules() {
+		ruleTags = append(ruleTags, r.GetRuleTag())
+	}
+	return users, ruleTags, nil
+}
+
+// mockPanel implements the subset of the control API the agent calls during
+// one cycle and counts what it receives.
+type mockPanel struct {
+	token string
+
+	mu            sync.Mutex
+	stateRequests int
+	statsUsers    int
+	metrics       int
+	heartbeats    int
+}
+
+func newMockPanel() *mockPanel {
+	return &mockPanel{token: "e2e-token"}
+}
+
+func (p *mockPanel) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer "+p.token {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	prefix := "/api/agents/" + serverSlug + "/"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		http.NotFound(w, r)
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch strings.TrimPrefix(r.URL.Path, prefix) {
+	case "state":
+		p.stateRequests++
+		_ = json.NewEncoder(w).Encode(desiredState)
+	case "stats":
+		var push model.StatsPush
+		if err := json.NewDecoder(r.Body).Decode(&push); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		p.statsUsers += len(push.Users)
+	case "metrics":
+		p.metrics++
+	case "heartbeat":
+		p.heartbeats++
+	case "online":
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (p *mockPanel) fill(res *Result) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	res.StateRequests = p.stateRequests
+	res.StatsUsers = p.statsUsers
+	res.MetricsPushes = p.metrics
+	res.Heartbeats = p.heartbeats
+}
@@ -0,0 +1,59 @@
+package e2e
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestBuildXrayConfigExposesAPIAndInbounds(t *testing.T) {
+	raw, err := buildXrayConfig(10085, 20001, 20002, 20003)
+	if err != nil {
+		t.Fatalf("buildXrayConfig: %v", err)
+	}
+
+	var cfg struct {
+		API struct {
+			Services []string `json:"services"`
+		} `json:"api"`
+		Inbounds []struct {
+			Tag      string `json:"tag"`
+			Port     int    `json:"port"`
+			Protocol string `json:"protocol"`
+		} `json:"inbounds"`
+	}
+	if err := json.Unmarshal(raw, &cfg); err != nil {
+		t.Fatalf("decode config: %v", err)
+	}
+	if len(cfg.API.Services) != 3 {
+		t.Fatalf("unexpected api services: %+v", cfg.API.Services)
+	}
+
+	want := map[string]string{"api": "dokodemo-door", vlessTag: "vless", vmessTag: "vmess", trojanTag: "trojan"}
+	for _, in := range cfg.Inbounds {
+		if want[in.Tag] != in.Protocol {
+			t.Fatalf("inbound %s has protocol %s", in.Tag, in.Protocol)
+		}
+		delete(want, in.Tag)
+	}
+	if len(want) != 0 {
+		t.Fatalf("missing inbounds: %+v", want)
+	}
+}
+
+func TestVerifyReportsMissingUsers(t *testing.T) {
+	res := &Result{
+		StateRequests: 1,
+		StatsUsers:    len(desiredState.Clients),
+		MetricsPushes: 1,
+		Heartbeats:    1,
+		InboundUsers:  map[string][]string{vlessTag: {"vless@e2e"}, vmessTag: {"vmess@e2e"}},
+		RuleTags:      []string{routeTag},
+	}
+	if err := verify(res); err == nil {
+		t.Fatal("expected missing trojan user to fail verification")
+	}
+	res.InboundUsers[trojanTag] = []string{"trojan@e2e"}
+	if err := verify(res); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+}
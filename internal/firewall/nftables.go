@@ -0,0 +1,94 @@
+// Package firewall bans client addresses in the kernel with nftables.
+package firewall
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/netip"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// runNFT runs nft with args and script on stdin; overridden in tests.
+var runNFT = func(ctx context.Context, binary, script string, args ...string) error {
+	cmd := exec.CommandContext(ctx, binary, args...)
+	cmd.Stdin = strings.NewReader(script)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%s: %w: %s", binary, err, msg)
+		}
+		return fmt.Errorf("%s: %w", binary, err)
+	}
+	return nil
+}
+
+// NFTables keeps banned addresses in the sets of one inet table that it
+// owns: banned4 and banned6, whose elements time out on their own, and an
+// input chain that drops packets from them.
+type NFTables struct {
+	binary string
+	table  string
+}
+
+func NewNFTables(binary, table string) *NFTables {
+	return &NFTables{binary: binary, table: table}
+}
+
+// Setup replaces the table with an empty one. Bans of an earlier run are
+// dropped with it, like the expiry the agent kept for them.
+func (n *NFTables) Setup(ctx context.Context) error {
+	// Adding the table first lets the delete succeed when it is missing.
+	script := fmt.Sprintf(`table inet %[1]s
+delete table inet %[1]s
+table inet %[1]s {
+	set banned4 {
+		type ipv4_addr
+		flags timeout
+	}
+	set banned6 {
+		type ipv6_addr
+		flags timeout
+	}
+	chain input {
+		type filter hook input priority -5; policy accept;
+		ip saddr @banned4 drop
+		ip6 saddr @banned6 drop
+	}
+}
+`, n.table)
+	if err := runNFT(ctx, n.binary, script, "-f", "-"); err != nil {
+		return fmt.Errorf("create nftables table %s: %w", n.table, err)
+	}
+	return nil
+}
+
+// Ban drops the packets of addr for d. The kernel lifts the ban by itself,
+// so it also ends when the agent is not running.
+func (n *NFTables) Ban(ctx context.Context, addr netip.Addr, d time.Duration) error {
+	script := fmt.Sprintf("add element inet %s %s { %s timeout %ds }\n", n.table, n.set(addr), addr, int(d.Seconds()))
+	if err := runNFT(ctx, n.binary, script, "-f", "-"); err != nil {
+		return fmt.Errorf("ban %s: %w", addr, err)
+	}
+	return nil
+}
+
+// Unban lifts the ban of addr. A ban that already timed out is no error.
+func (n *NFTables) Unban(ctx context.Context, addr netip.Addr) error {
+	script := fmt.Sprintf("delete element inet %s %s { %s }\n", n.table, n.set(addr), addr)
+	err := runNFT(ctx, n.binary, script, "-f", "-")
+	if err != nil && !strings.Contains(err.Error(), "No such file or directory") {
+		return fmt.Errorf("unban %s: %w", addr, err)
+	}
+	return nil
+}
+
+func (n *NFTables) set(addr netip.Addr) string {
+	if addr.Is4() {
+		return "banned4"
+	}
+	return "banned6"
+}
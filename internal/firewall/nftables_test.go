@@ -0,0 +1,61 @@
+package firewall
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNFTablesScripts(t *testing.T) {
+	orig := runNFT
+	t.Cleanup(func() { runNFT = orig })
+	var scripts []string
+	var fail error
+	runNFT = func(_ context.Context, binary, script string, args ...string) error {
+		if binary != "/usr/sbin/nft" || strings.Join(args, " ") != "-f -" {
+			t.Errorf("ran %s %v", binary, args)
+		}
+		scripts = append(scripts, script)
+		return fail
+	}
+
+	n := NewNFTables("/usr/sbin/nft", "agent_bans")
+	ctx := context.Background()
+	if err := n.Setup(ctx); err != nil {
+		t.Fatalf("Setup: %v", err)
+	}
+	if !strings.HasPrefix(scripts[0], "table inet agent_bans\ndelete table inet agent_bans\n") || !strings.Contains(scripts[0], "ip6 saddr @banned6 drop") {
+		t.Fatalf("setup script:\n%s", scripts[0])
+	}
+
+	if err := n.Ban(ctx, netip.MustParseAddr("203.0.113.5"), time.Hour); err != nil {
+		t.Fatalf("Ban: %v", err)
+	}
+	if err := n.Ban(ctx, netip.MustParseAddr("2001:db8::5"), 90*time.Second); err != nil {
+		t.Fatalf("Ban: %v", err)
+	}
+	if err := n.Unban(ctx, netip.MustParseAddr("203.0.113.5")); err != nil {
+		t.Fatalf("Unban: %v", err)
+	}
+	want := []string{
+		"add element inet agent_bans banned4 { 203.0.113.5 timeout 3600s }\n",
+		"add element inet agent_bans banned6 { 2001:db8::5 timeout 90s }\n",
+		"delete element inet agent_bans banned4 { 203.0.113.5 }\n",
+	}
+	for i, w := range want {
+		if scripts[i+1] != w {
+			t.Errorf("script %d = %q, want %q", i+1, scripts[i+1], w)
+		}
+	}
+
+	fail = errors.New("nft: exit status 1: Error: Could not process rule: No such file or directory")
+	if err := n.Unban(ctx, netip.MustParseAddr("203.0.113.5")); err != nil {
+		t.Fatalf("Unban of an expired ban: %v", err)
+	}
+	if err := n.Ban(ctx, netip.MustParseAddr("203.0.113.5"), time.Hour); err == nil {
+		t.Fatal("Ban ignored an nft failure")
+	}
+}
@@ -0,0 +1,119 @@
+package geoip
+
+import (
+	"cmp"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/najahiiii/xray-agent/internal/model"
+
+	"github.com/xtls/xray-core/app/router"
+	"google.golang.org/protobuf/proto"
+)
+
+// datRange is a run of addresses that a geoip.dat file gives one country.
+type datRange struct {
+	first, last netip.Addr
+	country     string
+}
+
+// dat is an xray geoip.dat file: country codes with their CIDR lists. It
+// has no AS data.
+type dat struct {
+	// ranges are sorted by first address, IPv4 before IPv6.
+	ranges []datRange
+}
+
+// parseDat reads a geoip.dat file. Lists that are not a country, such as
+// private, cloudflare or telegram, are skipped, as are inverted lists.
+func parseDat(b []byte) (*dat, error) {
+	var list router.GeoIPList
+	if err := proto.Unmarshal(b, &list); err != nil {
+		return nil, err
+	}
+	d := &dat{}
+	for _, entry := range list.GetEntry() {
+		code := strings.ToUpper(entry.GetCountryCode())
+		if len(code) != 2 || entry.GetReverseMatch() {
+			continue
+		}
+		for _, cidr := range entry.GetCidr() {
+			ip, ok := netip.AddrFromSlice(cidr.GetIp())
+			if !ok {
+				continue
+			}
+			prefix, err := ip.Unmap().Prefix(int(cidr.GetPrefix()))
+			if err != nil {
+				continue
+			}
+			d.ranges = append(d.ranges, datRange{first: prefix.Addr(), last: lastAddr(prefix), country: code})
+		}
+	}
+	slices.SortFunc(d.ranges, func(a, b datRange) int {
+		return cmp.Or(a.first.Compare(b.first), b.last.Compare(a.last))
+	})
+	d.ranges = flatten(d.ranges)
+	return d, nil
+}
+
+// flatten turns ranges sorted by first address, wider first, into disjoint
+// ones. CIDRs either nest or do not overlap at all; where they nest the
+// narrower one wins, so a country's carve-out of another's block is kept.
+func flatten(ranges []datRange) []datRange {
+	var out, open []datRange
+	var pos netip.Addr
+	emit := func(last netip.Addr, country string) {
+		if pos.IsValid() && pos.Compare(last) <= 0 {
+			out = append(out, datRange{first: pos, last: last, country: country})
+		}
+	}
+	closeBefore := func(next netip.Addr) {
+		for len(open) > 0 {
+			top := open[len(open)-1]
+			if next.IsValid() && top.last.Compare(next) >= 0 {
+				return
+			}
+			emit(top.last, top.country)
+			pos = top.last.Next()
+			open = open[:len(open)-1]
+		}
+	}
+	for _, r := range ranges {
+		closeBefore(r.first)
+		if len(open) > 0 {
+			top := open[len(open)-1]
+			emit(r.first.Prev(), top.country)
+		}
+		open = append(open, r)
+		pos = r.first
+	}
+	closeBefore(netip.Addr{})
+	return out
+}
+
+// lookup sets the country of addr when it is empty.
+func (d *dat) lookup(addr netip.Addr, info *model.GeoInfo) error {
+	if info.Country != "" {
+		return nil
+	}
+	i, found := slices.BinarySearchFunc(d.ranges, addr, func(r datRange, a netip.Addr) int {
+		return r.first.Compare(a)
+	})
+	if !found {
+		i--
+	}
+	if i >= 0 && addr.Compare(d.ranges[i].last) <= 0 {
+		info.Country = d.ranges[i].country
+	}
+	return nil
+}
+
+func lastAddr(p netip.Prefix) netip.Addr {
+	b := p.Addr().AsSlice()
+	for i := p.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 1 << (7 - i%8)
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
@@ -0,0 +1,129 @@
+// Package geoip resolves the country and autonomous system of client
+// addresses from local files: xray's geoip.dat and MaxMind DB (.mmdb) files
+// such as GeoLite2-Country, GeoLite2-ASN or the DB-IP and IPinfo databases.
+package geoip
+
+import (
+	"log/slog"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/najahiiii/xray-agent/internal/model"
+)
+
+// checkInterval is how often the files are checked for changes.
+const checkInterval = time.Minute
+
+type database interface {
+	lookup(addr netip.Addr, info *model.GeoInfo) error
+}
+
+type file struct {
+	path    string
+	modTime time.Time
+	size    int64
+	db      database
+}
+
+// Resolver looks addresses up in a list of files. For each field the first
+// file that has it wins, so a country file can be paired with an ASN file.
+// Files are loaded on first use and again when they change on disk; a file
+// that is missing or does not parse is skipped until it changes. It is safe
+// for concurrent use.
+type Resolver struct {
+	log *slog.Logger
+	now func() time.Time
+
+	mu        sync.Mutex
+	files     []file
+	checkedAt time.Time
+}
+
+// New returns a Resolver over paths. Paths ending in .mmdb are read as
+// MaxMind DB files, anything else as geoip.dat.
+func New(paths []string, log *slog.Logger) *Resolver {
+	r := &Resolver{log: log, now: time.Now}
+	for _, p := range paths {
+		r.files = append(r.files, file{path: p})
+	}
+	return r
+}
+
+// Lookup returns what the files know about addr. Private, loopback and
+// other non-public addresses resolve to nothing.
+func (r *Resolver) Lookup(addr netip.Addr) model.GeoInfo {
+	var info model.GeoInfo
+	addr = addr.Unmap()
+	if !addr.IsValid() || !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return info
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.refresh()
+	for _, f := range r.files {
+		if f.db == nil {
+			continue
+		}
+		if err := f.db.lookup(addr, &info); err != nil {
+			r.log.Debug("geoip lookup", "file", f.path, "addr", addr, "err", err)
+		}
+	}
+	return info
+}
+
+// LookupString is Lookup for an address in text form, as xray reports them;
+// an address that does not parse resolves to nothing.
+func (r *Resolver) LookupString(s string) model.GeoInfo {
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return model.GeoInfo{}
+	}
+	return r.Lookup(addr)
+}
+
+// refresh loads files that are new or changed since the last check. Called
+// with mu held.
+func (r *Resolver) refresh() {
+	now := r.now()
+	if !r.checkedAt.IsZero() && now.Sub(r.checkedAt) < checkInterval {
+		return
+	}
+	r.checkedAt = now
+	for i := range r.files {
+		f := &r.files[i]
+		st, err := os.Stat(f.path)
+		if err != nil {
+			if f.db != nil || f.modTime.IsZero() {
+				r.log.Warn("geoip file unavailable", "file", f.path, "err", err)
+			}
+			f.db, f.modTime, f.size = nil, time.Unix(0, 0), 0
+			continue
+		}
+		if st.ModTime().Equal(f.modTime) && st.Size() == f.size {
+			continue
+		}
+		f.modTime, f.size = st.ModTime(), st.Size()
+		db, err := load(f.path)
+		if err != nil {
+			r.log.Warn("geoip file not loaded", "file", f.path, "err", err)
+			f.db = nil
+			continue
+		}
+		f.db = db
+		r.log.Info("geoip file loaded", "file", f.path)
+	}
+}
+
+func load(path string) (database, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasSuffix(strings.ToLower(path), ".mmdb") {
+		return parseMMDB(b)
+	}
+	return parseDat(b)
+}
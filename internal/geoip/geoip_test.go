@@ -0,0 +1,258 @@
+package geoip
+
+import (
+	"io"
+	"log/slog"
+	"maps"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/najahiiii/xray-agent/internal/model"
+
+	"github.com/xtls/xray-core/app/router"
+	"google.golang.org/protobuf/proto"
+)
+
+func writeDat(t *testing.T, path string, entries map[string][]string) {
+	t.Helper()
+	var list router.GeoIPList
+	for _, code := range slices.Sorted(maps.Keys(entries)) {
+		entry := &router.GeoIP{CountryCode: code}
+		for _, s := range entries[code] {
+			p := netip.MustParsePrefix(s)
+			entry.Cidr = append(entry.Cidr, &router.CIDR{Ip: p.Addr().AsSlice(), Prefix: uint32(p.Bits())})
+		}
+		list.Entry = append(list.Entry, entry)
+	}
+	b, err := proto.Marshal(&list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type (
+	mmdbPointer uint
+	mmdbUint16  uint16
+)
+
+// MaxMind DB data types written by mmdbValue.
+const (
+	typePointer = 1
+	typeString  = 2
+	typeUint16  = 5
+	typeUint32  = 6
+	typeMap     = 7
+)
+
+// metadataMarker precedes the metadata map at the end of a MaxMind DB file.
+var metadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+// mmdbValue encodes v in the MaxMind DB data format.
+func mmdbValue(v any) []byte {
+	ctrl := func(typ, size int) []byte {
+		var extra []byte
+		if size >= 29 {
+			extra = []byte{byte(size - 29)}
+			size = 29
+		}
+		if typ < 8 {
+			return append([]byte{byte(typ<<5 | size)}, extra...)
+		}
+		return append([]byte{byte(size), byte(typ - 7)}, extra...)
+	}
+	uintBytes := func(n uint64) []byte {
+		var b []byte
+		for ; n > 0; n >>= 8 {
+			b = append([]byte{byte(n)}, b...)
+		}
+		return b
+	}
+	switch v := v.(type) {
+	case mmdbPointer:
+		return []byte{typePointer << 5, byte(v)}
+	case string:
+		return append(ctrl(typeString, len(v)), v...)
+	case mmdbUint16:
+		b := uintBytes(uint64(v))
+		return append(ctrl(typeUint16, len(b)), b...)
+	case uint32:
+		b := uintBytes(uint64(v))
+		return append(ctrl(typeUint32, len(b)), b...)
+	case map[string]any:
+		out := ctrl(typeMap, len(v))
+		for _, k := range slices.Sorted(maps.Keys(v)) {
+			out = append(out, mmdbValue(k)...)
+			out = append(out, mmdbValue(v[k])...)
+		}
+		return out
+	}
+	panic("unsupported mmdb value")
+}
+
+// writeMMDB writes an IPv4 database with 24-bit records that maps each
+// prefix to a record in the data section.
+func writeMMDB(t *testing.T, path string, data []byte, records map[string]int) {
+	t.Helper()
+	type node struct {
+		child [2]int
+		leaf  [2]int
+	}
+	nodes := []node{{}}
+	for s, off := range records {
+		p := netip.MustParsePrefix(s)
+		ip := p.Addr().AsSlice()
+		n := 0
+		for i := range p.Bits() {
+			bit := ip[i/8] >> (7 - i%8) & 1
+			if i == p.Bits()-1 {
+				nodes[n].leaf[bit] = off + 1
+				break
+			}
+			if nodes[n].child[bit] == 0 {
+				nodes = append(nodes, node{})
+				nodes[n].child[bit] = len(nodes) - 1
+			}
+			n = nodes[n].child[bit]
+		}
+	}
+	count := len(nodes)
+	var out []byte
+	for _, n := range nodes {
+		for bit := range 2 {
+			rec := count
+			if n.child[bit] != 0 {
+				rec = n.child[bit]
+			} else if n.leaf[bit] != 0 {
+				rec = count + 16 + n.leaf[bit] - 1
+			}
+			out = append(out, byte(rec>>16), byte(rec>>8), byte(rec))
+		}
+	}
+	out = append(out, make([]byte, 16)...)
+	out = append(out, data...)
+	out = append(out, metadataMarker...)
+	out = append(out, mmdbValue(map[string]any{
+		"node_count":  uint32(count),
+		"record_size": mmdbUint16(24),
+		"ip_version":  mmdbUint16(4),
+	})...)
+	if err := os.WriteFile(path, out, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testResolver(paths ...string) *Resolver {
+	return New(paths, slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+func TestResolverDat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "geoip.dat")
+	writeDat(t, path, map[string][]string{
+		"us":      {"8.0.0.0/8"},
+		"gb":      {"8.8.8.0/24"},
+		"de":      {"2a00::/16"},
+		"private": {"10.0.0.0/8"},
+	})
+	r := testResolver(path)
+
+	for addr, want := range map[string]string{
+		"8.8.8.8":        "GB",
+		"8.9.0.1":        "US",
+		"8.8.9.1":        "US",
+		"8.255.1.1":      "US",
+		"9.0.0.1":        "",
+		"2a00::1":        "DE",
+		"2a01::1":        "",
+		"10.0.0.1":       "",
+		"127.0.0.1":      "",
+		"not an ip":      "",
+		"::ffff:8.8.8.8": "GB",
+	} {
+		if got := r.LookupString(addr); got != (model.GeoInfo{Country: want}) {
+			t.Errorf("%s: got %+v, want %q", addr, got, want)
+		}
+	}
+}
+
+func TestResolverMMDB(t *testing.T) {
+	dir := t.TempDir()
+	// The country code is shared through a pointer, as real databases do.
+	data := mmdbValue("AU")
+	cloudflare := len(data)
+	data = append(data, mmdbValue(map[string]any{
+		"country":                        map[string]any{"iso_code": mmdbPointer(0)},
+		"autonomous_system_number":       uint32(13335),
+		"autonomous_system_organization": "CLOUDFLARENET",
+	})...)
+	ipinfo := len(data)
+	data = append(data, mmdbValue(map[string]any{
+		"country_code": "sg",
+		"asn":          "AS4773",
+		"as_name":      "MobileOne",
+	})...)
+	path := filepath.Join(dir, "asn.mmdb")
+	writeMMDB(t, path, data, map[string]int{"1.1.1.0/24": cloudflare, "1.2.0.0/16": ipinfo})
+
+	datPath := filepath.Join(dir, "geoip.dat")
+	writeDat(t, datPath, map[string][]string{"jp": {"1.1.0.0/16"}})
+
+	r := testResolver(path)
+	if got, want := r.LookupString("1.1.1.1"), (model.GeoInfo{Country: "AU", ASN: 13335, ASOrg: "CLOUDFLARENET"}); got != want {
+		t.Fatalf("1.1.1.1: got %+v, want %+v", got, want)
+	}
+	if got, want := r.LookupString("1.2.200.1"), (model.GeoInfo{Country: "SG", ASN: 4773, ASOrg: "MobileOne"}); got != want {
+		t.Fatalf("1.2.200.1: got %+v, want %+v", got, want)
+	}
+	if got := r.LookupString("1.3.0.1"); !got.IsZero() {
+		t.Fatalf("1.3.0.1: got %+v", got)
+	}
+	if got := r.LookupString("2606:4700::1"); !got.IsZero() {
+		t.Fatalf("IPv6 in an IPv4 database: got %+v", got)
+	}
+
+	// The first file wins per field: the country from geoip.dat, the AS
+	// from the database after it.
+	r = testResolver(datPath, path)
+	if got, want := r.LookupString("1.1.1.1"), (model.GeoInfo{Country: "JP", ASN: 13335, ASOrg: "CLOUDFLARENET"}); got != want {
+		t.Fatalf("combined: got %+v, want %+v", got, want)
+	}
+}
+
+func TestResolverReloadsChangedFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "geoip.dat")
+	r := testResolver(path, filepath.Join(dir, "broken.mmdb"))
+	now := time.Now()
+	r.now = func() time.Time { return now }
+
+	if got := r.LookupString("8.8.8.8"); !got.IsZero() {
+		t.Fatalf("missing file: got %+v", got)
+	}
+	writeDat(t, path, map[string][]string{"us": {"8.0.0.0/8"}})
+	if err := os.WriteFile(filepath.Join(dir, "broken.mmdb"), []byte("junk"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.LookupString("8.8.8.8"); !got.IsZero() {
+		t.Fatalf("checked again within the interval: got %+v", got)
+	}
+	now = now.Add(checkInterval)
+	if got := r.LookupString("8.8.8.8"); got.Country != "US" {
+		t.Fatalf("after the file appeared: got %+v", got)
+	}
+
+	writeDat(t, path, map[string][]string{"us": {"8.0.0.0/8"}, "gb": {"8.8.8.0/24"}})
+	if err := os.Chtimes(path, now, now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(checkInterval)
+	if got := r.LookupString("8.8.8.8"); got.Country != "GB" {
+		t.Fatalf("after the file changed: got %+v", got)
+	}
+}
@@ -0,0 +1,81 @@
+package geoip
+
+import (
+	"cmp"
+	"math"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/najahiiii/xray-agent/internal/model"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// mmdb is a MaxMind DB file. See https://maxmind.github.io/MaxMind-DB/.
+type mmdb struct {
+	r *maxminddb.Reader
+}
+
+func parseMMDB(b []byte) (*mmdb, error) {
+	r, err := maxminddb.FromBytes(b)
+	if err != nil {
+		return nil, err
+	}
+	return &mmdb{r: r}, nil
+}
+
+// mmdbRecord holds the fields read from a record of a GeoLite2/GeoIP2
+// Country, City or ASN database, or of the DB-IP and IPinfo layouts.
+type mmdbRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+	CountryCode string `maxminddb:"country_code"`
+	ASNumber    uint64 `maxminddb:"autonomous_system_number"`
+	ASOrg       string `maxminddb:"autonomous_system_organization"`
+	// ASN is "AS4773" in IPinfo files, a number in others.
+	ASN    any    `maxminddb:"asn"`
+	ASName string `maxminddb:"as_name"`
+}
+
+func (db *mmdb) lookup(addr netip.Addr, info *model.GeoInfo) error {
+	if addr.Is6() && db.r.Metadata.IPVersion == 4 {
+		return nil
+	}
+	var rec mmdbRecord
+	if err := db.r.Lookup(addr.AsSlice(), &rec); err != nil {
+		return err
+	}
+	fill(&rec, info)
+	return nil
+}
+
+// fill sets the fields of info that are still empty from rec.
+func fill(rec *mmdbRecord, info *model.GeoInfo) {
+	if info.Country == "" {
+		for _, s := range []string{rec.Country.ISOCode, rec.RegisteredCountry.ISOCode, rec.CountryCode} {
+			if s != "" {
+				info.Country = strings.ToUpper(s)
+				break
+			}
+		}
+	}
+	if info.ASN == 0 {
+		n := rec.ASNumber
+		if n == 0 {
+			switch v := rec.ASN.(type) {
+			case string:
+				n, _ = strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(v), "AS"), 10, 32)
+			case uint64:
+				n = v
+			}
+		}
+		info.ASN = uint32(min(n, math.MaxUint32))
+	}
+	if info.ASOrg == "" {
+		info.ASOrg = cmp.Or(rec.ASOrg, rec.ASName)
+	}
+}
@@ -0,0 +1,346 @@
+// Package initsys installs and controls long-running services under systemd,
+// OpenRC or sysvinit.
+package initsys
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	_ "embed"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+type Kind string
+
+const (
+	Auto     Kind = "auto"
+	Systemd  Kind = "systemd"
+	OpenRC   Kind = "openrc"
+	SysVinit Kind = "sysvinit"
+	// None installs no service definitions; the agent runs xray as a child
+	// process instead, e.g. as the entrypoint of a container.
+	None Kind = "none"
+)
+
+// ErrNoService is returned by Restart when no init system manages services.
+var ErrNoService = errors.New("no init system manages services")
+
+const initScriptDir = "/etc/init.d"
+
+//go:embed assets/openrc.tmpl
+var openrcTemplate string
+
+//go:embed assets/sysvinit.tmpl
+var sysvinitTemplate string
+
+// Paths probed by Detect; overridden in tests.
+var (
+	systemdRunDir = "/run/systemd/system"
+	openrcBinary  = "/sbin/openrc-run"
+)
+
+// runCommand executes an init-system command; overridden in tests.
+var runCommand = func(ctx context.Context, name string, args ...string) error {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// Service describes a daemon to install. SystemdUnit is used verbatim under
+// systemd; OpenRC and sysvinit scripts are rendered from the other fields.
+type Service struct {
+	Name        string
+	Description string
+	Command     string
+	Args        []string
+	// After lists services that should be started first.
+	After []string
+	// StateDir is created before start, like systemd's StateDirectory=.
+	StateDir string
+	// NoFile raises the open file limit, like systemd's LimitNOFILE=.
+	NoFile int
+	// NProc caps the number of processes, like systemd's LimitNPROC=.
+	NProc int
+	// Environment is exported to the daemon, like systemd's Environment=.
+	Environment map[string]string
+	// User and Group run the daemon unprivileged, like systemd's User= and
+	// Group=. Group defaults to User; empty runs it as root.
+	User  string
+	Group string
+	// Directives are further systemd [Service] settings, such as
+	// ProtectSystem=; OpenRC and sysvinit scripts ignore them.
+	Directives map[string]string
+
+	SystemdUnit []byte
+	SystemdPath string
+}
+
+// ArgsLine joins Args for the rendered shell scripts.
+func (s Service) ArgsLine() string {
+	return strings.Join(s.Args, " ")
+}
+
+// Owner returns "user:group" for User and Group, or "" to run as root.
+func (s Service) Owner() string {
+	if s.User == "" {
+		return ""
+	}
+	return s.User + ":" + cmp.Or(s.Group, s.User)
+}
+
+// UlimitArgs returns the ulimit flags for NoFile and NProc, e.g. "-n 1048576".
+func (s Service) UlimitArgs() string {
+	var args []string
+	if s.NoFile > 0 {
+		args = append(args, fmt.Sprintf("-n %d", s.NoFile))
+	}
+	if s.NProc > 0 {
+		args = append(args, fmt.Sprintf("-u %d", s.NProc))
+	}
+	return strings.Join(args, " ")
+}
+
+// Parse validates an init system name. Empty means Auto.
+func Parse(value string) (Kind, error) {
+	switch kind := Kind(strings.ToLower(strings.TrimSpace(value))); kind {
+	case "":
+		return Auto, nil
+	case Auto, Systemd, OpenRC, SysVinit, None:
+		return kind, nil
+	default:
+		return "", fmt.Errorf("unsupported init system %q (want auto, systemd, openrc, sysvinit or none)", value)
+	}
+}
+
+// Detect guesses the running init system: systemd when it is PID 1, OpenRC
+// when openrc-run is installed, sysvinit otherwise.
+func Detect() Kind {
+	if info, err := os.Stat(systemdRunDir); err == nil && info.IsDir() {
+		return Systemd
+	}
+	if _, err := os.Stat(openrcBinary); err == nil {
+		return OpenRC
+	}
+	return SysVinit
+}
+
+// Resolve parses value and replaces Auto with the detected init system.
+func Resolve(value string) (Kind, error) {
+	kind, err := Parse(value)
+	if err != nil {
+		return "", err
+	}
+	if kind == Auto {
+		return Detect(), nil
+	}
+	return kind, nil
+}
+
+// Path returns where the service definition for svc is written, or "" for None.
+func Path(kind Kind, svc Service) string {
+	switch kind {
+	case Systemd:
+		return svc.SystemdPath
+	case None:
+		return ""
+	}
+	return filepath.Join(initScriptDir, svc.Name)
+}
+
+// Render returns the service definition for kind.
+func Render(kind Kind, svc Service) ([]byte, error) {
+	var text string
+	switch kind {
+	case Systemd:
+		return systemdUnit(svc), nil
+	case OpenRC:
+		text = openrcTemplate
+	case SysVinit:
+		text = sysvinitTemplate
+	default:
+		return nil, fmt.Errorf("unsupported init system %q", kind)
+	}
+
+	tmpl, err := template.New(string(kind)).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, svc); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Install writes the service definition, enables it at boot and (re)starts it.
+// It does nothing for None.
+func Install(ctx context.Context, kind Kind, svc Service) error {
+	if kind == None {
+		return nil
+	}
+	data, err := Render(kind, svc)
+	if err != nil {
+		return err
+	}
+	path := Path(kind, svc)
+	perm := os.FileMode(0o755)
+	if kind == Systemd {
+		perm = 0o644
+	}
+	if err := writeFile(path, data, perm); err != nil {
+		return fmt.Errorf("write %s service: %w", kind, err)
+	}
+
+	switch kind {
+	case Systemd:
+		if err := DaemonReload(ctx, kind); err != nil {
+			return err
+		}
+		if err := runCommand(ctx, "systemctl", "enable", "--now", svc.Name); err != nil {
+			return fmt.Errorf("systemctl enable --now %s: %w", svc.Name, err)
+		}
+		return nil
+	case OpenRC:
+		if err := runCommand(ctx, "rc-update", "add", svc.Name, "default"); err != nil {
+			return fmt.Errorf("rc-update add %s: %w", svc.Name, err)
+		}
+	case SysVinit:
+		if err := enableSysVinit(ctx, svc.Name); err != nil {
+			return err
+		}
+	}
+	return Restart(ctx, kind, svc.Name)
+}
+
+// Uninstall stops svc, disables it at boot and removes its definition. Stop
+// and disable failures are ignored since the service may already be gone. It
+// does nothing for None.
+func Uninstall(ctx context.Context, kind Kind, svc Service) error {
+	if kind == None {
+		return nil
+	}
+	if err := Disable(ctx, kind, svc.Name); err != nil {
+		return err
+	}
+	path := Path(kind, svc)
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("remove %s: %w", path, err)
+	}
+	return DaemonReload(ctx, kind)
+}
+
+// Disable stops name and disables it at boot. Failures are ignored since the
+// service may already be gone. It does nothing for None.
+func Disable(ctx context.Context, kind Kind, name string) error {
+	switch kind {
+	case None:
+	case Systemd:
+		_ = runCommand(ctx, "systemctl", "disable", "--now", name)
+	case OpenRC:
+		_ = runCommand(ctx, "rc-service", name, "stop")
+		_ = runCommand(ctx, "rc-update", "del", name, "default")
+	case SysVinit:
+		_ = runCommand(ctx, filepath.Join(initScriptDir, name), "stop")
+		if _, err := exec.LookPath("update-rc.d"); err == nil {
+			_ = runCommand(ctx, "update-rc.d", "-f", name, "remove")
+		} else {
+			_ = runCommand(ctx, "chkconfig", "--del", name)
+		}
+	default:
+		return fmt.Errorf("unsupported init system %q", kind)
+	}
+	return nil
+}
+
+// DaemonReload makes systemd pick up changed or removed units. OpenRC and
+// sysvinit read their scripts on every call, so it does nothing for them.
+func DaemonReload(ctx context.Context, kind Kind) error {
+	if kind != Systemd {
+		return nil
+	}
+	if err := runCommand(ctx, "systemctl", "daemon-reload"); err != nil {
+		return fmt.Errorf("systemctl daemon-reload: %w", err)
+	}
+	return nil
+}
+
+// Restart restarts an installed service.
+func Restart(ctx context.Context, kind Kind, name string) error {
+	argv, err := RestartCommand(kind, name)
+	if err != nil {
+		return err
+	}
+	if err := runCommand(ctx, argv[0], argv[1:]...); err != nil {
+		return fmt.Errorf("restart %s via %s: %w", name, kind, err)
+	}
+	return nil
+}
+
+// RestartCommand returns the command line Restart runs, for callers that
+// have to run it detached, e.g. to restart their own service.
+func RestartCommand(kind Kind, name string) ([]string, error) {
+	switch kind {
+	case Systemd:
+		return []string{"systemctl", "restart", name}, nil
+	case OpenRC:
+		return []string{"rc-service", name, "restart"}, nil
+	case SysVinit:
+		return []string{filepath.Join(initScriptDir, name), "restart"}, nil
+	case None:
+		return nil, ErrNoService
+	default:
+		return nil, fmt.Errorf("unsupported init system %q", kind)
+	}
+}
+
+// Reload sends SIGHUP to the main process of an installed service. Both
+// rendered scripts keep the PID in /run/<name>.pid.
+func Reload(ctx context.Context, kind Kind, name string) error {
+	var err error
+	switch kind {
+	case Systemd:
+		err = runCommand(ctx, "systemctl", "kill", "--signal=HUP", "--kill-whom=main", name)
+	case OpenRC, SysVinit:
+		err = runCommand(ctx, "start-stop-daemon", "--stop", "--signal", "HUP", "--pidfile", "/run/"+name+".pid")
+	case None:
+		return ErrNoService
+	default:
+		return fmt.Errorf("unsupported init system %q", kind)
+	}
+	if err != nil {
+		return fmt.Errorf("reload %s via %s: %w", name, kind, err)
+	}
+	return nil
+}
+
+// enableSysVinit registers the script with update-rc.d (Debian/Devuan) or
+// chkconfig (RHEL-style), whichever is available.
+func enableSysVinit(ctx context.Context, name string) error {
+	if _, err := exec.LookPath("update-rc.d"); err == nil {
+		if err := runCommand(ctx, "update-rc.d", name, "defaults"); err != nil {
+			return fmt.Errorf("update-rc.d %s defaults: %w", name, err)
+		}
+		return nil
+	}
+	if err := runCommand(ctx, "chkconfig", "--add", name); err != nil {
+		return fmt.Errorf("chkconfig --add %s: %w", name, err)
+	}
+	return nil
+}
+
+func writeFile(path string, data []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, data, perm); err != nil {
+		return err
+	}
+	return os.Chmod(path, perm)
+}
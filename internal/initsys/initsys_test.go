@@ -0,0 +1,201 @@
+package initsys
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testService() Service {
+	return Service{
+		Name:        "xray-agent",
+		Description: "Xray Provisioning Agent",
+		Command:     "/usr/local/bin/xray-agent",
+		Args:        []string{"run", "--config", "/etc/xray-agent/config.yaml"},
+		After:       []string{"xray"},
+		StateDir:    "/var/lib/xray-agent",
+		NoFile:      1048576,
+		SystemdUnit: []byte("[Unit]\n"),
+		SystemdPath: "/usr/lib/systemd/system/xray-agent.service",
+	}
+}
+
+func TestParse(t *testing.T) {
+	for in, want := range map[string]Kind{"": Auto, "auto": Auto, "OpenRC": OpenRC, " sysvinit ": SysVinit, "systemd": Systemd, "none": None} {
+		got, err := Parse(in)
+		if err != nil || got != want {
+			t.Fatalf("Parse(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	if _, err := Parse("upstart"); err == nil {
+		t.Fatal("expected unsupported init system error")
+	}
+}
+
+func TestDetect(t *testing.T) {
+	origSystemd, origOpenRC := systemdRunDir, openrcBinary
+	t.Cleanup(func() { systemdRunDir, openrcBinary = origSystemd, origOpenRC })
+
+	dir := t.TempDir()
+	systemdRunDir = filepath.Join(dir, "systemd")
+	openrcBinary = filepath.Join(dir, "openrc-run")
+	if got := Detect(); got != SysVinit {
+		t.Fatalf("Detect() = %q, want sysvinit", got)
+	}
+	if err := os.WriteFile(openrcBinary, nil, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if got := Detect(); got != OpenRC {
+		t.Fatalf("Detect() = %q, want openrc", got)
+	}
+	if err := os.Mkdir(systemdRunDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if got := Detect(); got != Systemd {
+		t.Fatalf("Detect() = %q, want systemd", got)
+	}
+}
+
+func TestRenderScripts(t *testing.T) {
+	svc := testService()
+
+	openrc, err := Render(OpenRC, svc)
+	if err != nil {
+		t.Fatalf("Render(openrc): %v", err)
+	}
+	for _, want := range []string{
+		"#!/sbin/openrc-run",
+		`command="/usr/local/bin/xray-agent"`,
+		`command_args="run --config /etc/xray-agent/config.yaml"`,
+		`rc_ulimit="-n 1048576"`,
+		"after xray",
+		"checkpath --directory --mode 0755 /var/lib/xray-agent",
+	} {
+		if !strings.Contains(string(openrc), want) {
+			t.Fatalf("openrc script missing %q:\n%s", want, openrc)
+		}
+	}
+
+	sysv, err := Render(SysVinit, svc)
+	if err != nil {
+		t.Fatalf("Render(sysvinit): %v", err)
+	}
+	for _, want := range []string{
+		"# Provides:          xray-agent",
+		"# Required-Start:    $network $remote_fs xray",
+		`DAEMON_ARGS="run --config /etc/xray-agent/config.yaml"`,
+		"ulimit -n 1048576",
+		"mkdir -p /var/lib/xray-agent",
+	} {
+		if !strings.Contains(string(sysv), want) {
+			t.Fatalf("sysvinit script missing %q:\n%s", want, sysv)
+		}
+	}
+
+	unit, err := Render(Systemd, svc)
+	if err != nil || !strings.HasPrefix(string(unit), "[Unit]\n") || !strings.Contains(string(unit), "LimitNOFILE=1048576") {
+		t.Fatalf("Render(systemd) = %q, %v", unit, err)
+	}
+	if got := Path(OpenRC, svc); got != "/etc/init.d/xray-agent" {
+		t.Fatalf("Path(openrc) = %q", got)
+	}
+}
+
+func TestRestartCommands(t *testing.T) {
+	orig := runCommand
+	t.Cleanup(func() { runCommand = orig })
+
+	var got []string
+	runCommand = func(_ context.Context, name string, args ...string) error {
+		got = append(got, strings.Join(append([]string{name}, args...), " "))
+		return nil
+	}
+	for _, kind := range []Kind{Systemd, OpenRC, SysVinit} {
+		if err := Restart(context.Background(), kind, "xray"); err != nil {
+			t.Fatalf("Restart(%s): %v", kind, err)
+		}
+	}
+	want := []string{"systemctl restart xray", "rc-service xray restart", "/etc/init.d/xray restart"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Fatalf("commands = %v, want %v", got, want)
+	}
+}
+
+func TestReloadCommands(t *testing.T) {
+	orig := runCommand
+	t.Cleanup(func() { runCommand = orig })
+
+	var got []string
+	runCommand = func(_ context.Context, name string, args ...string) error {
+		got = append(got, strings.Join(append([]string{name}, args...), " "))
+		return nil
+	}
+	for _, kind := range []Kind{Systemd, OpenRC} {
+		if err := Reload(context.Background(), kind, "xray-agent"); err != nil {
+			t.Fatalf("Reload(%s): %v", kind, err)
+		}
+	}
+	want := []string{
+		"systemctl kill --signal=HUP --kill-whom=main xray-agent",
+		"start-stop-daemon --stop --signal HUP --pidfile /run/xray-agent.pid",
+	}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Fatalf("commands = %v, want %v", got, want)
+	}
+	if err := Reload(context.Background(), None, "xray-agent"); !errors.Is(err, ErrNoService) {
+		t.Fatalf("Reload(none) = %v, want ErrNoService", err)
+	}
+}
+
+func TestUninstallSystemd(t *testing.T) {
+	orig := runCommand
+	t.Cleanup(func() { runCommand = orig })
+
+	var got []string
+	runCommand = func(_ context.Context, name string, args ...string) error {
+		got = append(got, strings.Join(append([]string{name}, args...), " "))
+		return errors.New("unit not loaded")
+	}
+	svc := testService()
+	svc.SystemdPath = filepath.Join(t.TempDir(), "xray-agent.service")
+	if err := os.WriteFile(svc.SystemdPath, svc.SystemdUnit, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	err := Uninstall(context.Background(), Systemd, svc)
+	if err == nil || !strings.Contains(err.Error(), "daemon-reload") {
+		t.Fatalf("Uninstall = %v, want only the daemon-reload failure reported", err)
+	}
+	if _, err := os.Stat(svc.SystemdPath); !os.IsNotExist(err) {
+		t.Fatalf("unit still present, stat err = %v", err)
+	}
+	want := []string{"systemctl disable --now xray-agent", "systemctl daemon-reload"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Fatalf("commands = %v, want %v", got, want)
+	}
+}
+
+func TestNoneSkipsServiceManagement(t *testing.T) {
+	orig := runCommand
+	t.Cleanup(func() { runCommand = orig })
+	runCommand = func(_ context.Context, name string, args ...string) error {
+		t.Fatalf("unexpected command %s %v", name, args)
+		return nil
+	}
+
+	if err := Install(context.Background(), None, testService()); err != nil {
+		t.Fatalf("Install(none): %v", err)
+	}
+	if err := Uninstall(context.Background(), None, testService()); err != nil {
+		t.Fatalf("Uninstall(none): %v", err)
+	}
+	if err := Restart(context.Background(), None, "xray"); !errors.Is(err, ErrNoService) {
+		t.Fatalf("Restart(none) = %v, want ErrNoService", err)
+	}
+	if got := Path(None, testService()); got != "" {
+		t.Fatalf("Path(none) = %q", got)
+	}
+}
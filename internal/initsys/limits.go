@@ -0,0 +1,229 @@
+package initsys
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// procDir is read by Verify; overridden in tests.
+var procDir = "/proc"
+
+// commandOutput runs an init-system query; overridden in tests.
+var commandOutput = func(ctx context.Context, name string, args ...string) ([]byte, error) {
+	return exec.CommandContext(ctx, name, args...).Output()
+}
+
+// systemdUnit returns svc.SystemdUnit with LimitNOFILE=, LimitNPROC=, User=,
+// Group=, Environment= and svc.Directives set from svc. Existing lines are
+// replaced in place; anything missing is appended to the [Service] section.
+func systemdUnit(svc Service) []byte {
+	directives := maps.Clone(svc.Directives)
+	if directives == nil {
+		directives = map[string]string{}
+	}
+	if svc.NoFile > 0 {
+		directives["LimitNOFILE"] = strconv.Itoa(svc.NoFile)
+	}
+	if svc.NProc > 0 {
+		directives["LimitNPROC"] = strconv.Itoa(svc.NProc)
+	}
+	if owner := svc.Owner(); owner != "" {
+		directives["User"], directives["Group"], _ = strings.Cut(owner, ":")
+	}
+	if len(directives) == 0 && len(svc.Environment) == 0 {
+		return svc.SystemdUnit
+	}
+
+	lines := strings.Split(strings.TrimRight(string(svc.SystemdUnit), "\n"), "\n")
+	var out []string
+	inService := false
+	// insertAt is where leftover directives go: after the last non-blank line
+	// of the [Service] section.
+	insertAt := -1
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") {
+			inService = trimmed == "[Service]"
+		} else if key, _, ok := strings.Cut(trimmed, "="); ok && inService {
+			if value, managed := directives[key]; managed {
+				line = key + "=" + value
+				delete(directives, key)
+			}
+		}
+		out = append(out, line)
+		if inService && trimmed != "" {
+			insertAt = len(out)
+		}
+	}
+	var extra []string
+	for _, key := range slices.Sorted(maps.Keys(directives)) {
+		extra = append(extra, key+"="+directives[key])
+	}
+	for _, key := range slices.Sorted(maps.Keys(svc.Environment)) {
+		extra = append(extra, fmt.Sprintf("Environment=%q", key+"="+svc.Environment[key]))
+	}
+	if insertAt < 0 {
+		out = append(out, "", "[Service]")
+		insertAt = len(out)
+	}
+	out = slices.Insert(out, insertAt, extra...)
+	return []byte(strings.Join(out, "\n") + "\n")
+}
+
+// Sync rewrites the service definition when it no longer matches svc and then
+// restarts the service so the new limits apply. It reports whether anything
+// changed. Services that are not installed yet are left alone.
+func Sync(ctx context.Context, kind Kind, svc Service) (bool, error) {
+	if kind == None {
+		return false, nil
+	}
+	data, err := Render(kind, svc)
+	if err != nil {
+		return false, err
+	}
+	path := Path(kind, svc)
+	current, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if bytes.Equal(current, data) {
+		return false, nil
+	}
+
+	perm := os.FileMode(0o755)
+	if kind == Systemd {
+		perm = 0o644
+	}
+	if err := writeFile(path, data, perm); err != nil {
+		return false, fmt.Errorf("write %s service: %w", kind, err)
+	}
+	if err := DaemonReload(ctx, kind); err != nil {
+		return false, err
+	}
+	return true, Restart(ctx, kind, svc.Name)
+}
+
+// MainPID returns the pid of the running service, or 0 if it is not running.
+func MainPID(ctx context.Context, kind Kind, name string) (int, error) {
+	var raw []byte
+	var err error
+	switch kind {
+	case Systemd:
+		raw, err = commandOutput(ctx, "systemctl", "show", "--property=MainPID", "--value", name)
+		if err != nil {
+			return 0, fmt.Errorf("systemctl show %s: %w", name, err)
+		}
+	case OpenRC, SysVinit:
+		raw, err = os.ReadFile(filepath.Join("/run", name+".pid"))
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	default:
+		return 0, ErrNoService
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(raw)))
+	if err != nil {
+		return 0, fmt.Errorf("parse pid of %s: %w", name, err)
+	}
+	return pid, nil
+}
+
+// Verify checks that the running service process has the limits and
+// environment from svc, which catches units that were edited but never
+// restarted and hosts whose hard limits are lower than requested.
+func Verify(ctx context.Context, kind Kind, svc Service) error {
+	pid, err := MainPID(ctx, kind, svc.Name)
+	if err != nil {
+		return err
+	}
+	if pid <= 0 {
+		return fmt.Errorf("%s is not running", svc.Name)
+	}
+
+	limits, err := readProcLimits(pid)
+	if err != nil {
+		return err
+	}
+	var problems []string
+	check := func(name string, want int) {
+		if want <= 0 {
+			return
+		}
+		got, ok := limits[name]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s: not reported", name))
+		} else if got != "unlimited" && got != strconv.Itoa(want) {
+			problems = append(problems, fmt.Sprintf("%s: got %s, want %d", name, got, want))
+		}
+	}
+	check("Max open files", svc.NoFile)
+	check("Max processes", svc.NProc)
+
+	if len(svc.Environment) > 0 {
+		env, err := readProcEnviron(pid)
+		if err != nil {
+			return err
+		}
+		for _, key := range slices.Sorted(maps.Keys(svc.Environment)) {
+			if got := env[key]; got != svc.Environment[key] {
+				problems = append(problems, fmt.Sprintf("%s: got %q, want %q", key, got, svc.Environment[key]))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s (pid %d) limits differ: %s", svc.Name, pid, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// readProcLimits returns the soft limit of each row in /proc/<pid>/limits.
+func readProcLimits(pid int) (map[string]string, error) {
+	raw, err := os.ReadFile(filepath.Join(procDir, strconv.Itoa(pid), "limits"))
+	if err != nil {
+		return nil, err
+	}
+	limits := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for scanner.Scan() {
+		line := scanner.Text()
+		// Columns are fixed width: a 26 character name, then soft and hard limits.
+		if len(line) <= 26 || strings.HasPrefix(line, "Limit") {
+			continue
+		}
+		fields := strings.Fields(line[26:])
+		if len(fields) == 0 {
+			continue
+		}
+		limits[strings.TrimSpace(line[:26])] = fields[0]
+	}
+	return limits, scanner.Err()
+}
+
+func readProcEnviron(pid int) (map[string]string, error) {
+	raw, err := os.ReadFile(filepath.Join(procDir, strconv.Itoa(pid), "environ"))
+	if err != nil {
+		return nil, err
+	}
+	env := map[string]string{}
+	for _, kv := range bytes.Split(raw, []byte{0}) {
+		if key, value, ok := strings.Cut(string(kv), "="); ok {
+			env[key] = value
+		}
+	}
+	return env, nil
+}
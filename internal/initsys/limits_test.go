@@ -0,0 +1,198 @@
+package initsys
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testUnit = `[Unit]
+Description=Xray Core Service
+
+[Service]
+ExecStart=/usr/local/bin/xray -config /etc/xray/config.json
+LimitNOFILE=1048576
+
+[Install]
+WantedBy=multi-user.target
+`
+
+func TestSystemdUnitRendersLimits(t *testing.T) {
+	svc := Service{
+		Name:        "xray",
+		NoFile:      65535,
+		NProc:       4096,
+		Environment: map[string]string{"XRAY_LOCATION_ASSET": "/usr/local/share/xray"},
+		SystemdUnit: []byte(testUnit),
+	}
+	want := `[Unit]
+Description=Xray Core Service
+
+[Service]
+ExecStart=/usr/local/bin/xray -config /etc/xray/config.json
+LimitNOFILE=65535
+LimitNPROC=4096
+Environment="XRAY_LOCATION_ASSET=/usr/local/share/xray"
+
+[Install]
+WantedBy=multi-user.target
+`
+	if got := string(systemdUnit(svc)); got != want {
+		t.Fatalf("systemdUnit() =\n%s\nwant\n%s", got, want)
+	}
+
+	svc = Service{NoFile: 1048576, SystemdUnit: []byte(testUnit)}
+	if got := string(systemdUnit(svc)); got != testUnit {
+		t.Fatalf("unchanged limits rewrote the unit:\n%s", got)
+	}
+}
+
+func TestRenderScriptLimits(t *testing.T) {
+	svc := testService()
+	svc.NProc = 4096
+	svc.Environment = map[string]string{"XRAY_LOCATION_ASSET": "/usr/local/share/xray"}
+
+	openrc, err := Render(OpenRC, svc)
+	if err != nil {
+		t.Fatalf("Render(openrc): %v", err)
+	}
+	for _, want := range []string{`rc_ulimit="-n 1048576 -u 4096"`, `export XRAY_LOCATION_ASSET="/usr/local/share/xray"`} {
+		if !strings.Contains(string(openrc), want) {
+			t.Fatalf("openrc script missing %q:\n%s", want, openrc)
+		}
+	}
+	sysv, err := Render(SysVinit, svc)
+	if err != nil {
+		t.Fatalf("Render(sysvinit): %v", err)
+	}
+	for _, want := range []string{"ulimit -u 4096", `export XRAY_LOCATION_ASSET="/usr/local/share/xray"`} {
+		if !strings.Contains(string(sysv), want) {
+			t.Fatalf("sysvinit script missing %q:\n%s", want, sysv)
+		}
+	}
+}
+
+func TestSyncRewritesChangedUnit(t *testing.T) {
+	origRun := runCommand
+	t.Cleanup(func() { runCommand = origRun })
+	var commands []string
+	runCommand = func(_ context.Context, name string, args ...string) error {
+		commands = append(commands, strings.Join(append([]string{name}, args...), " "))
+		return nil
+	}
+
+	path := filepath.Join(t.TempDir(), "xray.service")
+	svc := Service{Name: "xray", NoFile: 65535, SystemdUnit: []byte(testUnit), SystemdPath: path}
+
+	if changed, err := Sync(context.Background(), Systemd, svc); err != nil || changed {
+		t.Fatalf("Sync on missing unit = %v, %v; want false, nil", changed, err)
+	}
+	if err := os.WriteFile(path, []byte(testUnit), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	changed, err := Sync(context.Background(), Systemd, svc)
+	if err != nil || !changed {
+		t.Fatalf("Sync = %v, %v; want true, nil", changed, err)
+	}
+	if got := strings.Join(commands, "|"); got != "systemctl daemon-reload|systemctl restart xray" {
+		t.Fatalf("commands = %s", got)
+	}
+	data, _ := os.ReadFile(path)
+	if !strings.Contains(string(data), "LimitNOFILE=65535") {
+		t.Fatalf("unit not rewritten:\n%s", data)
+	}
+
+	commands = nil
+	if changed, err := Sync(context.Background(), Systemd, svc); err != nil || changed {
+		t.Fatalf("second Sync = %v, %v; want false, nil", changed, err)
+	}
+	if len(commands) != 0 {
+		t.Fatalf("unexpected commands on unchanged unit: %v", commands)
+	}
+}
+
+func TestVerifyReadsProcess(t *testing.T) {
+	origProc, origOutput := procDir, commandOutput
+	t.Cleanup(func() { procDir, commandOutput = origProc, origOutput })
+
+	procDir = t.TempDir()
+	commandOutput = func(_ context.Context, name string, args ...string) ([]byte, error) {
+		return []byte("4242\n"), nil
+	}
+	pidDir := filepath.Join(procDir, "4242")
+	if err := os.Mkdir(pidDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	limits := "Limit                     Soft Limit           Hard Limit           Units     \n" +
+		"Max processes             4096                 4096                 processes \n" +
+		"Max open files            1024                 524288               files     \n"
+	if err := os.WriteFile(filepath.Join(pidDir, "limits"), []byte(limits), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(pidDir, "environ"), []byte("PATH=/usr/bin\x00XRAY_LOCATION_ASSET=/usr/local/share/xray\x00"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	svc := Service{Name: "xray", NProc: 4096, Environment: map[string]string{"XRAY_LOCATION_ASSET": "/usr/local/share/xray"}}
+	if err := Verify(context.Background(), Systemd, svc); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	svc.NoFile = 1048576
+	err := Verify(context.Background(), Systemd, svc)
+	if err == nil || !strings.Contains(err.Error(), "Max open files: got 1024, want 1048576") {
+		t.Fatalf("Verify error = %v", err)
+	}
+}
+
+func TestRenderUser(t *testing.T) {
+	svc := testService()
+	svc.User = "xray-agent"
+	svc.SystemdUnit = []byte(testUnit)
+
+	unit, err := Render(Systemd, svc)
+	if err != nil {
+		t.Fatalf("Render(systemd): %v", err)
+	}
+	for _, want := range []string{"User=xray-agent\n", "Group=xray-agent\n"} {
+		if !strings.Contains(string(unit), want) {
+			t.Fatalf("systemd unit missing %q:\n%s", want, unit)
+		}
+	}
+	openrc, err := Render(OpenRC, svc)
+	if err != nil {
+		t.Fatalf("Render(openrc): %v", err)
+	}
+	for _, want := range []string{
+		`command_user="xray-agent:xray-agent"`,
+		"checkpath --directory --mode 0755 --owner xray-agent:xray-agent /var/lib/xray-agent",
+	} {
+		if !strings.Contains(string(openrc), want) {
+			t.Fatalf("openrc script missing %q:\n%s", want, openrc)
+		}
+	}
+	svc.Group = "nogroup"
+	sysv, err := Render(SysVinit, svc)
+	if err != nil {
+		t.Fatalf("Render(sysvinit): %v", err)
+	}
+	for _, want := range []string{"--chuid xray-agent:nogroup", `chown xray-agent:nogroup "$LOGFILE" /var/lib/xray-agent`} {
+		if !strings.Contains(string(sysv), want) {
+			t.Fatalf("sysvinit script missing %q:\n%s", want, sysv)
+		}
+	}
+}
+
+func TestSystemdUnitRendersDirectives(t *testing.T) {
+	svc := Service{
+		SystemdUnit: []byte(testUnit),
+		Directives:  map[string]string{"LimitNOFILE": "4096", "ProtectSystem": "full", "MemoryMax": "512M"},
+	}
+	got := string(systemdUnit(svc))
+	for _, want := range []string{"LimitNOFILE=4096\nMemoryMax=512M\nProtectSystem=full\n\n[Install]"} {
+		if !strings.Contains(got, want) {
+			t.Fatalf("systemdUnit() missing %q:\n%s", want, got)
+		}
+	}
+}
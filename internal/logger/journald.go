@@ -0,0 +1,184 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const defaultJournalSocket = "/run/systemd/journal/socket"
+
+// journaldSink speaks the native journal protocol over the datagram socket so
+// attributes end up as indexed journal fields instead of one text line.
+type journaldSink struct {
+	identifier string
+	socket     string
+
+	mu   sync.Mutex
+	conn *net.UnixConn
+}
+
+func newJournaldSink(identifier string, socket string) (*journaldSink, error) {
+	if socket == "" {
+		socket = defaultJournalSocket
+	}
+	s := &journaldSink{identifier: identifier, socket: socket}
+	if err := s.dial(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *journaldSink) dial() error {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: s.socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	return nil
+}
+
+func (s *journaldSink) emit(level slog.Level, msg string, fields []field) error {
+	var buf bytes.Buffer
+	writeJournalField(&buf, "MESSAGE", msg)
+	writeJournalField(&buf, "PRIORITY", strconv.Itoa(syslogPriority(level)))
+	if s.identifier != "" {
+		writeJournalField(&buf, "SYSLOG_IDENTIFIER", s.identifier)
+	}
+	for _, f := range fields {
+		if key := journalFieldName(f.key); key != "" {
+			writeJournalField(&buf, key, f.value)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		if err := s.dial(); err != nil {
+			return err
+		}
+	}
+	_, err := s.conn.Write(buf.Bytes())
+	if errors.Is(err, syscall.EMSGSIZE) || errors.Is(err, syscall.ENOBUFS) {
+		// Too big for one datagram, e.g. a long stack or command output.
+		return s.sendFD(buf.Bytes())
+	}
+	if err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+// sendFD passes an entry that does not fit in a datagram as a sealed memfd,
+// the way sd_journal_send does.
+func (s *journaldSink) sendFD(entry []byte) error {
+	fd, err := unix.MemfdCreate("journal-entry", unix.MFD_CLOEXEC|unix.MFD_ALLOW_SEALING)
+	if err != nil {
+		return fmt.Errorf("journal entry of %d bytes: %w", len(entry), err)
+	}
+	f := os.NewFile(uintptr(fd), "journal-entry")
+	defer f.Close()
+	if _, err := f.Write(entry); err != nil {
+		return err
+	}
+	if _, err := unix.FcntlInt(f.Fd(), unix.F_ADD_SEALS, unix.F_SEAL_SHRINK|unix.F_SEAL_GROW|unix.F_SEAL_WRITE|unix.F_SEAL_SEAL); err != nil {
+		return err
+	}
+	// WriteMsgUnix refuses a connected datagram socket, so send on the fd.
+	raw, err := s.conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	if ctrlErr := raw.Write(func(sock uintptr) bool {
+		err = unix.Sendmsg(int(sock), nil, unix.UnixRights(int(f.Fd())), nil, 0)
+		return err != unix.EAGAIN
+	}); ctrlErr != nil {
+		return ctrlErr
+	}
+	return err
+}
+
+func (s *journaldSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// writeJournalField uses the binary length-prefixed form for values that
+// contain newlines, as required by the journal protocol.
+func writeJournalField(buf *bytes.Buffer, key string, value string) {
+	buf.WriteString(key)
+	if !strings.Contains(value, "\n") {
+		buf.WriteByte('=')
+		buf.WriteString(value)
+		buf.WriteByte('\n')
+		return
+	}
+	buf.WriteByte('\n')
+	var size [8]byte
+	binary.LittleEndian.PutUint64(size[:], uint64(len(value)))
+	buf.Write(size[:])
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+// reservedJournalFields are fields the sink sets itself or that journald
+// and journalctl give a meaning to; attributes of the same name get an
+// ATTR_ prefix rather than a second MESSAGE= or PRIORITY=.
+var reservedJournalFields = []string{
+	"MESSAGE", "MESSAGE_ID", "PRIORITY", "CODE_FILE", "CODE_LINE", "CODE_FUNC", "ERRNO",
+	"SYSLOG_FACILITY", "SYSLOG_IDENTIFIER", "SYSLOG_PID", "SYSLOG_TIMESTAMP", "SYSLOG_RAW",
+	"INVOCATION_ID", "USER_INVOCATION_ID", "DOCUMENTATION", "TID", "UNIT", "USER_UNIT",
+}
+
+// journalFieldName maps an attribute key onto the journal's [A-Z0-9_] field
+// alphabet. Keys may not start with an underscore or a digit, and reserved
+// names are prefixed.
+func journalFieldName(key string) string {
+	var b strings.Builder
+	for _, r := range strings.ToUpper(key) {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	name := strings.TrimLeft(b.String(), "_0123456789")
+	if slices.Contains(reservedJournalFields, name) {
+		return "ATTR_" + name
+	}
+	return name
+}
+
+// syslogPriority maps slog levels onto syslog severities.
+func syslogPriority(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return 3
+	case level >= slog.LevelWarn:
+		return 4
+	case level >= slog.LevelInfo:
+		return 6
+	default:
+		return 7
+	}
+}
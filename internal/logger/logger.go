@@ -1,27 +1,113 @@
 package logger
 
 import (
+	"fmt"
+	"io"
 	"log/slog"
 	"os"
+	"strings"
 	"time"
 )
 
+const (
+	OutputStdout  = "stdout"
+	OutputFile    = "file"
+	OutputJournal = "journald"
+	OutputSyslog  = "syslog"
+
+	defaultIdentifier = "xray-agent"
+)
+
+// Options selects the log level, encoding and destination.
+type Options struct {
+	Level string
+	// Format is "text" (default) or "json"; ignored by journald and syslog outputs.
+	Format string
+	// Output is stdout, file, journald or syslog. Empty picks file when File
+	// is set and stdout otherwise.
+	Output string
+	// Identifier tags journald/syslog entries (default xray-agent).
+	Identifier string
+	// JournalSocket overrides the journald socket path.
+	JournalSocket string
+	// File is the rotating log file used by the file output.
+	File       string
+	MaxSizeMB  int
+	MaxAgeDays int
+	MaxBackups int
+}
+
+// RetentionSetter is implemented by the closer Open returns for the file
+// output, so rotated-file retention can change at runtime.
+type RetentionSetter interface {
+	SetRetention(maxAgeDays int, maxBackups int)
+}
+
+// Rotator is implemented by the closer Open returns for the file output, so
+// the log can be rotated on demand.
+type Rotator interface {
+	Rotate() error
+}
+
 // New builds a slog logger with UTC timestamps.
 func New(level string) *slog.Logger {
-	var l slog.Level
-	switch level {
-	case "debug":
-		l = slog.LevelDebug
-	case "warn":
-		l = slog.LevelWarn
-	case "error":
-		l = slog.LevelError
+	return slog.New(newHandler(os.Stdout, "text", level))
+}
+
+// Open builds a logger from opts. The returned closer releases the log file, if any.
+func Open(opts Options) (*slog.Logger, io.Closer, error) {
+	format := strings.ToLower(strings.TrimSpace(opts.Format))
+	switch format {
+	case "", "text", "json":
 	default:
-		l = slog.LevelInfo
+		return nil, nil, fmt.Errorf("unsupported log format: %s", opts.Format)
+	}
+
+	identifier := opts.Identifier
+	if identifier == "" {
+		identifier = defaultIdentifier
 	}
 
-	handler := slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
-		Level: l,
+	output := strings.ToLower(strings.TrimSpace(opts.Output))
+	if output == "" {
+		output = OutputStdout
+		if opts.File != "" {
+			output = OutputFile
+		}
+	}
+
+	switch output {
+	case OutputStdout:
+		return slog.New(newHandler(os.Stdout, format, opts.Level)), nopCloser{}, nil
+	case OutputFile:
+		if opts.File == "" {
+			return nil, nil, fmt.Errorf("log output %s requires a file path", output)
+		}
+		rf, err := newRotatingFile(opts.File, opts.MaxSizeMB, opts.MaxAgeDays, opts.MaxBackups)
+		if err != nil {
+			return nil, nil, fmt.Errorf("open log file: %w", err)
+		}
+		return slog.New(newHandler(rf, format, opts.Level)), rf, nil
+	case OutputJournal:
+		js, err := newJournaldSink(identifier, opts.JournalSocket)
+		if err != nil {
+			return nil, nil, fmt.Errorf("connect journald: %w", err)
+		}
+		return slog.New(newSinkHandler(js, parseLevel(opts.Level))), js, nil
+	case OutputSyslog:
+		ss, err := newSyslogSink(identifier)
+		if err != nil {
+			return nil, nil, fmt.Errorf("connect syslog: %w", err)
+		}
+		return slog.New(newSinkHandler(ss, parseLevel(opts.Level))), ss, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported log output: %s", opts.Output)
+	}
+}
+
+func newHandler(out io.Writer, format string, level string) slog.Handler {
+	handlerOpts := &slog.HandlerOptions{
+		Level: parseLevel(level),
 		ReplaceAttr: func(groups []string, attr slog.Attr) slog.Attr {
 			if attr.Key == slog.TimeKey {
 				if t, ok := attr.Value.Any().(time.Time); ok {
@@ -30,6 +116,26 @@ func New(level string) *slog.Logger {
 			}
 			return attr
 		},
-	})
-	return slog.New(handler)
+	}
+	if format == "json" {
+		return slog.NewJSONHandler(out, handlerOpts)
+	}
+	return slog.NewTextHandler(out, handlerOpts)
 }
+
+func parseLevel(level string) slog.Level {
+	switch level {
+	case "debug":
+		return slog.LevelDebug
+	case "warn":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
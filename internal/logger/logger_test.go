@@ -1,9 +1,19 @@
 package logger
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"io"
 	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
 )
 
 func TestLevels(t *testing.T) {
@@ -28,3 +38,258 @@ func TestLevels(t *testing.T) {
 		}
 	}
 }
+
+func TestOpenJSONFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent.log")
+	log, closer, err := Open(Options{Level: "info", Format: "json", File: path})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	log.Info("hello", "k", "v")
+	if err := closer.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read log: %v", err)
+	}
+	var entry map[string]any
+	if err := json.Unmarshal(data, &entry); err != nil {
+		t.Fatalf("expected json log line, got %q: %v", data, err)
+	}
+	if entry["msg"] != "hello" || entry["k"] != "v" {
+		t.Fatalf("unexpected entry: %+v", entry)
+	}
+}
+
+func TestOpenRejectsUnknownFormat(t *testing.T) {
+	if _, _, err := Open(Options{Format: "xml"}); err == nil {
+		t.Fatal("expected error for unknown format")
+	}
+}
+
+func TestRotatingFileRotatesAndPrunes(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "agent.log")
+	rf, err := newRotatingFile(path, 1, 0, 2)
+	if err != nil {
+		t.Fatalf("newRotatingFile: %v", err)
+	}
+	defer rf.Close()
+
+	clock := time.Date(2026, time.March, 5, 12, 0, 0, 0, time.UTC)
+	rf.now = func() time.Time {
+		clock = clock.Add(time.Second)
+		return clock
+	}
+
+	chunk := bytes.Repeat([]byte("x"), bytesPerMegabyte/2+1)
+	for range 5 {
+		if _, err := rf.Write(chunk); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	backups := rf.backups()
+	if len(backups) != 2 {
+		t.Fatalf("expected 2 backups after pruning, got %d", len(backups))
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat active log: %v", err)
+	}
+	if info.Size() != int64(len(chunk)) {
+		t.Fatalf("active log size = %d, want %d", info.Size(), len(chunk))
+	}
+}
+
+func TestOpenJournaldWritesNativeFields(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "journal.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("listen journal socket: %v", err)
+	}
+	defer conn.Close()
+
+	log, closer, err := Open(Options{Level: "info", Output: OutputJournal, JournalSocket: socket})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer closer.Close()
+
+	log.With("component", "state").Warn("state-sync", "err", "line1\nline2")
+
+	buf := make([]byte, 4096)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("read journal datagram: %v", err)
+	}
+	got := buf[:n]
+	for _, want := range []string{"MESSAGE=state-sync\n", "PRIORITY=4\n", "SYSLOG_IDENTIFIER=xray-agent\n", "COMPONENT=state\n", "ERR\n"} {
+		if !bytes.Contains(got, []byte(want)) {
+			t.Fatalf("journal datagram missing %q: %q", want, got)
+		}
+	}
+}
+
+func TestJournaldPassesOversizedEntriesAsMemfd(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "journal.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("listen journal socket: %v", err)
+	}
+	defer conn.Close()
+	sink, err := newJournaldSink("xray-agent", socket)
+	if err != nil {
+		t.Fatalf("newJournaldSink: %v", err)
+	}
+	defer sink.Close()
+
+	big := strings.Repeat("x", 4<<20)
+	if err := sink.emit(slog.LevelInfo, "dump", []field{{key: "output", value: big}}); err != nil {
+		t.Fatalf("emit: %v", err)
+	}
+	buf, oob := make([]byte, 64), make([]byte, unix.CmsgSpace(4))
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		t.Fatalf("read journal datagram: %v", err)
+	}
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("control messages = %v, %v", msgs, err)
+	}
+	fds, err := unix.ParseUnixRights(&msgs[0])
+	if err != nil || len(fds) != 1 {
+		t.Fatalf("passed fds = %v, %v", fds, err)
+	}
+	f := os.NewFile(uintptr(fds[0]), "journal-entry")
+	defer f.Close()
+	// The descriptor shares the sink's offset; journald reads from 0 too.
+	entry, err := io.ReadAll(io.NewSectionReader(f, 0, 8<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(entry, []byte("MESSAGE=dump\n")) || !bytes.Contains(entry, []byte("OUTPUT="+big+"\n")) {
+		t.Fatalf("memfd entry of %d bytes lacks the fields", len(entry))
+	}
+	if sink.conn == nil {
+		t.Fatal("connection torn down after an oversized entry")
+	}
+}
+
+func TestJournalFieldName(t *testing.T) {
+	cases := map[string]string{
+		"command_id": "COMMAND_ID",
+		"up-mbps":    "UP_MBPS",
+		"sys.stats":  "SYS_STATS",
+		"_private":   "PRIVATE",
+		"1st":        "ST",
+		"":           "",
+		"message":    "ATTR_MESSAGE",
+		"priority":   "ATTR_PRIORITY",
+		"message_id": "ATTR_MESSAGE_ID",
+	}
+	for in, want := range cases {
+		if got := journalFieldName(in); got != want {
+			t.Fatalf("journalFieldName(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestRotatingFileSetRetentionPrunes(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "agent.log")
+	rf, err := newRotatingFile(path, 1, 0, 0)
+	if err != nil {
+		t.Fatalf("newRotatingFile: %v", err)
+	}
+	defer rf.Close()
+
+	clock := time.Date(2026, time.March, 5, 12, 0, 0, 0, time.UTC)
+	rf.now = func() time.Time {
+		clock = clock.Add(time.Second)
+		return clock
+	}
+	chunk := bytes.Repeat([]byte("x"), bytesPerMegabyte/2+1)
+	for range 5 {
+		if _, err := rf.Write(chunk); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if got := len(rf.backups()); got != 4 {
+		t.Fatalf("expected 4 backups before retention change, got %d", got)
+	}
+
+	var rs RetentionSetter = rf
+	rs.SetRetention(0, 1)
+	if got := len(rf.backups()); got != 1 {
+		t.Fatalf("expected 1 backup after retention change, got %d", got)
+	}
+}
+
+func TestRotatingFileRotateOnDemand(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent.log")
+	rf, err := newRotatingFile(path, 1, 0, 0)
+	if err != nil {
+		t.Fatalf("newRotatingFile: %v", err)
+	}
+	defer rf.Close()
+
+	if _, err := rf.Write([]byte("before\n")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	var r Rotator = rf
+	if err := r.Rotate(); err != nil {
+		t.Fatalf("Rotate: %v", err)
+	}
+	if _, err := rf.Write([]byte("after\n")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if got := len(rf.backups()); got != 1 {
+		t.Fatalf("expected 1 backup after Rotate, got %d", got)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil || string(data) != "after\n" {
+		t.Fatalf("current log = %q, %v", data, err)
+	}
+}
+
+func TestRotatingFileFallsBackWhenFileUnwritable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent.log")
+	rf, err := newRotatingFile(path, 1, 0, 0)
+	if err != nil {
+		t.Fatalf("newRotatingFile: %v", err)
+	}
+	defer rf.Close()
+
+	clock := time.Date(2026, time.March, 5, 12, 0, 0, 0, time.UTC)
+	rf.now = func() time.Time { return clock }
+	var fallback bytes.Buffer
+	rf.fallback = &fallback
+
+	// A closed descriptor fails writes the way a read-only remount does.
+	rf.file.Close()
+	if n, err := rf.Write([]byte("first\n")); err != nil || n != len("first\n") {
+		t.Fatalf("Write during failure: n=%d err=%v", n, err)
+	}
+	if _, err := rf.Write([]byte("second\n")); err != nil {
+		t.Fatalf("Write during fallback: %v", err)
+	}
+	out := fallback.String()
+	if strings.Count(out, "cannot write log file") != 1 || !strings.Contains(out, "first\n") || !strings.Contains(out, "second\n") {
+		t.Fatalf("unexpected fallback output: %q", out)
+	}
+
+	rf.file = nil
+	clock = clock.Add(fallbackRetry)
+	if _, err := rf.Write([]byte("third\n")); err != nil {
+		t.Fatalf("Write after recovery: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil || string(data) != "third\n" {
+		t.Fatalf("log file after recovery: %q, %v", data, err)
+	}
+}
@@ -0,0 +1,88 @@
+package logger
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"sync"
+
+	"github.com/najahiiii/xray-agent/internal/model"
+)
+
+// DefaultRecentSize is how many records Recent keeps by default.
+const DefaultRecentSize = 100
+
+// Recent is a slog.Handler that passes every record to the wrapped handler
+// and keeps the latest info and higher records in memory, for the local
+// admin API.
+type Recent struct {
+	next   slog.Handler
+	ring   *recentRing
+	attrs  []field
+	groups []string
+}
+
+type recentRing struct {
+	mu      sync.Mutex
+	size    int
+	entries []model.LogEntry
+}
+
+func NewRecent(next slog.Handler, size int) *Recent {
+	if size <= 0 {
+		size = DefaultRecentSize
+	}
+	return &Recent{next: next, ring: &recentRing{size: size}}
+}
+
+func (h *Recent) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= slog.LevelInfo || h.next.Enabled(ctx, level)
+}
+
+func (h *Recent) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= slog.LevelInfo {
+		entry := newLogEntry(r, h.attrs, h.groups)
+		h.ring.mu.Lock()
+		if len(h.ring.entries) >= h.ring.size {
+			h.ring.entries = h.ring.entries[1:]
+		}
+		h.ring.entries = append(h.ring.entries, entry)
+		h.ring.mu.Unlock()
+	}
+	if !h.next.Enabled(ctx, r.Level) {
+		return nil
+	}
+	return h.next.Handle(ctx, r)
+}
+
+func (h *Recent) WithAttrs(attrs []slog.Attr) slog.Handler {
+	next := *h
+	next.next = h.next.WithAttrs(attrs)
+	next.attrs = slices.Clone(h.attrs)
+	for _, attr := range attrs {
+		next.attrs = appendAttr(next.attrs, h.groups, attr)
+	}
+	return &next
+}
+
+func (h *Recent) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	next := *h
+	next.next = h.next.WithGroup(name)
+	next.groups = append(slices.Clone(h.groups), name)
+	return &next
+}
+
+// Entries returns up to n of the latest records, oldest first; n <= 0 returns
+// all of them.
+func (h *Recent) Entries(n int) []model.LogEntry {
+	h.ring.mu.Lock()
+	defer h.ring.mu.Unlock()
+	entries := h.ring.entries
+	if n > 0 && len(entries) > n {
+		entries = entries[len(entries)-n:]
+	}
+	return slices.Clone(entries)
+}
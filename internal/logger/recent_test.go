@@ -0,0 +1,32 @@
+package logger
+
+import (
+	"bytes"
+	"log/slog"
+	"testing"
+)
+
+func TestRecentKeepsLatestInfoRecords(t *testing.T) {
+	var out bytes.Buffer
+	recent := NewRecent(newHandler(&out, "text", "warn"), 2)
+	log := slog.New(recent).With("component", "agent")
+
+	log.Debug("noise")
+	log.Info("first")
+	log.Info("second", "users", 3)
+	log.Warn("third")
+
+	entries := recent.Entries(0)
+	if len(entries) != 2 || entries[0].Message != "second" || entries[1].Message != "third" {
+		t.Fatalf("entries = %+v", entries)
+	}
+	if entries[0].Attrs["component"] != "agent" || entries[0].Attrs["users"] != "3" {
+		t.Fatalf("attrs = %+v", entries[0].Attrs)
+	}
+	if got := recent.Entries(1); len(got) != 1 || got[0].Message != "third" {
+		t.Fatalf("Entries(1) = %+v", got)
+	}
+	if bytes.Contains(out.Bytes(), []byte("second")) || !bytes.Contains(out.Bytes(), []byte("third")) {
+		t.Fatalf("wrapped handler level not respected: %q", out.String())
+	}
+}
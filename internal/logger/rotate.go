@@ -0,0 +1,239 @@
+package logger
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/najahiiii/xray-agent/internal/state"
+)
+
+const (
+	defaultMaxSizeMB    = 100
+	backupTimeFormat    = "20060102T150405.000"
+	rotatedFileMode     = 0o640
+	rotatedFileDirMode  = 0o755
+	bytesPerMegabyte    = 1024 * 1024
+	backupNameSeparator = "-"
+	// fallbackRetry is how long writes go to the fallback writer after the log
+	// file could not be written.
+	fallbackRetry = time.Minute
+)
+
+// rotatingFile is an io.WriteCloser that rotates the log file once it grows
+// past maxSize and prunes rotated backups by age and count.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+	now  func() time.Time
+	// fallback receives log lines while the file is not writable, e.g. on a
+	// read-only or full filesystem, so logging never fails the caller.
+	fallback      io.Writer
+	fallbackUntil time.Time
+}
+
+func newRotatingFile(path string, maxSizeMB int, maxAgeDays int, maxBackups int) (*rotatingFile, error) {
+	if maxSizeMB <= 0 {
+		maxSizeMB = defaultMaxSizeMB
+	}
+	r := &rotatingFile{
+		path:       path,
+		maxSize:    int64(maxSizeMB) * bytesPerMegabyte,
+		maxAge:     time.Duration(maxAgeDays) * 24 * time.Hour,
+		maxBackups: maxBackups,
+		now:        time.Now,
+		fallback:   os.Stderr,
+	}
+	if err := r.open(); err != nil {
+		if state.StorageCondition(err) == "" {
+			return nil, err
+		}
+		r.startFallback(err)
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.now().Before(r.fallbackUntil) {
+		return r.fallback.Write(p)
+	}
+	n, err := r.writeFile(p)
+	if err != nil && n == 0 {
+		r.startFallback(err)
+		return r.fallback.Write(p)
+	}
+	r.fallbackUntil = time.Time{}
+	return n, err
+}
+
+func (r *rotatingFile) writeFile(p []byte) (int, error) {
+	if r.file == nil {
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	if r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// startFallback switches writes to the fallback writer for fallbackRetry and
+// says so once on the fallback itself.
+func (r *rotatingFile) startFallback(err error) {
+	if r.fallbackUntil.IsZero() {
+		fmt.Fprintf(r.fallback, "xray-agent: cannot write log file %s: %v; logging to stderr, retrying every %s\n", r.path, err, fallbackRetry)
+	}
+	r.fallbackUntil = r.now().Add(fallbackRetry)
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+func (r *rotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(r.path), rotatedFileDirMode); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, rotatedFileMode)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.file = f
+	r.size = info.Size()
+	return nil
+}
+
+func (r *rotatingFile) rotate() error {
+	if r.file != nil {
+		if err := r.file.Close(); err != nil {
+			return err
+		}
+		r.file = nil
+	}
+
+	if err := os.Rename(r.path, r.backupName(r.now())); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("rotate log file: %w", err)
+	}
+	if err := r.open(); err != nil {
+		return err
+	}
+	r.prune()
+	return nil
+}
+
+// Rotate starts a new log file now, regardless of its size.
+func (r *rotatingFile) Rotate() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rotate()
+}
+
+func (r *rotatingFile) backupName(at time.Time) string {
+	dir := filepath.Dir(r.path)
+	ext := filepath.Ext(r.path)
+	base := strings.TrimSuffix(filepath.Base(r.path), ext)
+	return filepath.Join(dir, base+backupNameSeparator+at.UTC().Format(backupTimeFormat)+ext)
+}
+
+// SetRetention changes how many rotated backups are kept and for how long,
+// and prunes right away. Zero keeps all, as in the config.
+func (r *rotatingFile) SetRetention(maxAgeDays int, maxBackups int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.maxAge = time.Duration(maxAgeDays) * 24 * time.Hour
+	r.maxBackups = maxBackups
+	r.prune()
+}
+
+// prune removes rotated backups older than maxAge and keeps at most maxBackups.
+func (r *rotatingFile) prune() {
+	if r.maxAge <= 0 && r.maxBackups <= 0 {
+		return
+	}
+
+	backups := r.backups()
+	cutoff := r.now().Add(-r.maxAge)
+	keep := backups[:0]
+	for _, b := range backups {
+		if r.maxAge > 0 && b.at.Before(cutoff) {
+			os.Remove(b.path)
+			continue
+		}
+		keep = append(keep, b)
+	}
+
+	if r.maxBackups > 0 && len(keep) > r.maxBackups {
+		for _, b := range keep[:len(keep)-r.maxBackups] {
+			os.Remove(b.path)
+		}
+	}
+}
+
+type logBackup struct {
+	path string
+	at   time.Time
+}
+
+// backups lists rotated files for this log, oldest first.
+func (r *rotatingFile) backups() []logBackup {
+	dir := filepath.Dir(r.path)
+	ext := filepath.Ext(r.path)
+	prefix := strings.TrimSuffix(filepath.Base(r.path), ext) + backupNameSeparator
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+
+	var out []logBackup
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ext) {
+			continue
+		}
+		stamp := strings.TrimSuffix(strings.TrimPrefix(name, prefix), ext)
+		at, err := time.Parse(backupTimeFormat, stamp)
+		if err != nil {
+			continue
+		}
+		out = append(out, logBackup{path: filepath.Join(dir, name), at: at})
+	}
+
+	slices.SortFunc(out, func(a, b logBackup) int {
+		return a.at.Compare(b.at)
+	})
+	return out
+}
@@ -0,0 +1,240 @@
+package logger
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/najahiiii/xray-agent/internal/model"
+)
+
+const (
+	defaultShipBufferSize = 1000
+	defaultShipBatchSize  = 100
+	defaultShipInterval   = 30 * time.Second
+	shipFinalFlushTimeout = 5 * time.Second
+)
+
+// ShipFunc delivers one batch of log entries to the control panel.
+type ShipFunc func(ctx context.Context, push *model.LogsPush) error
+
+// ShipOptions configures a Shipper.
+type ShipOptions struct {
+	// Level is the minimum level that is shipped (default warn).
+	Level string
+	// BufferSize bounds the entries held between flushes; the oldest are
+	// dropped and counted once it is full.
+	BufferSize int
+	// BatchSize caps the entries sent per request.
+	BatchSize int
+	Interval  time.Duration
+}
+
+// Shipper is a slog.Handler that passes every record to the wrapped handler
+// and additionally buffers records at or above its level for Run to ship.
+type Shipper struct {
+	next   slog.Handler
+	buf    *shipBuffer
+	attrs  []field
+	groups []string
+}
+
+type shipBuffer struct {
+	level    slog.Level
+	batch    int
+	interval time.Duration
+
+	mu   sync.Mutex
+	size int
+	// maxAge drops entries that waited longer than this; zero keeps them.
+	maxAge  time.Duration
+	entries []model.LogEntry
+	dropped int
+}
+
+func NewShipper(next slog.Handler, opts ShipOptions) *Shipper {
+	level := slog.LevelWarn
+	if opts.Level != "" {
+		level = parseLevel(opts.Level)
+	}
+	b := &shipBuffer{
+		level:    level,
+		size:     opts.BufferSize,
+		batch:    opts.BatchSize,
+		interval: opts.Interval,
+	}
+	if b.size <= 0 {
+		b.size = defaultShipBufferSize
+	}
+	if b.batch <= 0 {
+		b.batch = defaultShipBatchSize
+	}
+	if b.interval <= 0 {
+		b.interval = defaultShipInterval
+	}
+	return &Shipper{next: next, buf: b}
+}
+
+func (s *Shipper) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= s.buf.level || s.next.Enabled(ctx, level)
+}
+
+func (s *Shipper) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= s.buf.level {
+		s.buf.add(newLogEntry(r, s.attrs, s.groups))
+	}
+	if !s.next.Enabled(ctx, r.Level) {
+		return nil
+	}
+	return s.next.Handle(ctx, r)
+}
+
+func (s *Shipper) WithAttrs(attrs []slog.Attr) slog.Handler {
+	next := *s
+	next.next = s.next.WithAttrs(attrs)
+	next.attrs = slices.Clone(s.attrs)
+	for _, attr := range attrs {
+		next.attrs = appendAttr(next.attrs, s.groups, attr)
+	}
+	return &next
+}
+
+func (s *Shipper) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return s
+	}
+	next := *s
+	next.next = s.next.WithGroup(name)
+	next.groups = append(slices.Clone(s.groups), name)
+	return &next
+}
+
+// SetRetention changes how many entries are held between flushes (zero
+// restores the default) and how old an undelivered entry may get before it
+// is dropped (zero keeps entries until the buffer overflows).
+func (s *Shipper) SetRetention(bufferSize int, maxAge time.Duration) {
+	if bufferSize <= 0 {
+		bufferSize = defaultShipBufferSize
+	}
+	b := s.buf
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.size = bufferSize
+	b.maxAge = maxAge
+	if over := len(b.entries) - b.size; over > 0 {
+		b.entries = b.entries[over:]
+		b.dropped += over
+	}
+}
+
+// Run flushes buffered entries every interval until ctx is done, then makes a
+// final bounded attempt to drain what is left. Delivery failures are reported
+// on stderr rather than through the logger so they are not shipped in turn.
+func (s *Shipper) Run(ctx context.Context, send ShipFunc) {
+	ticker := time.NewTicker(s.buf.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(context.Background(), shipFinalFlushTimeout)
+			defer cancel()
+			if err := s.Flush(flushCtx, send); err != nil {
+				fmt.Fprintf(os.Stderr, "ship logs: %v\n", err)
+			}
+			return
+		case <-ticker.C:
+			if err := s.Flush(ctx, send); err != nil {
+				fmt.Fprintf(os.Stderr, "ship logs: %v\n", err)
+			}
+		}
+	}
+}
+
+// Flush sends buffered entries in batches. Entries from a failed batch are
+// put back so the next flush retries them.
+func (s *Shipper) Flush(ctx context.Context, send ShipFunc) error {
+	for {
+		entries, dropped := s.buf.take()
+		if len(entries) == 0 {
+			return nil
+		}
+		push := &model.LogsPush{
+			ServerTime: time.Now().UTC(),
+			Dropped:    dropped,
+			Entries:    entries,
+		}
+		if err := send(ctx, push); err != nil {
+			s.buf.requeue(entries, dropped)
+			return err
+		}
+	}
+}
+
+// newLogEntry flattens r and the handler's attrs into a LogEntry.
+func newLogEntry(r slog.Record, attrs []field, groups []string) model.LogEntry {
+	fields := slices.Clone(attrs)
+	r.Attrs(func(attr slog.Attr) bool {
+		fields = appendAttr(fields, groups, attr)
+		return true
+	})
+	entry := model.LogEntry{
+		Time:    r.Time.UTC(),
+		Level:   r.Level.String(),
+		Message: r.Message,
+	}
+	if len(fields) > 0 {
+		entry.Attrs = make(map[string]string, len(fields))
+		for _, f := range fields {
+			entry.Attrs[f.key] = f.value
+		}
+	}
+	return entry
+}
+
+func (b *shipBuffer) add(entry model.LogEntry) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.entries) >= b.size {
+		b.entries = b.entries[1:]
+		b.dropped++
+	}
+	b.entries = append(b.entries, entry)
+}
+
+func (b *shipBuffer) take() ([]model.LogEntry, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.maxAge > 0 {
+		cutoff := time.Now().Add(-b.maxAge)
+		stale := 0
+		for stale < len(b.entries) && b.entries[stale].Time.Before(cutoff) {
+			stale++
+		}
+		b.entries = b.entries[stale:]
+		b.dropped += stale
+	}
+	n := min(len(b.entries), b.batch)
+	entries := slices.Clone(b.entries[:n])
+	b.entries = b.entries[n:]
+	dropped := b.dropped
+	b.dropped = 0
+	return entries, dropped
+}
+
+// requeue puts a failed batch back in front of newer entries, keeping the
+// newest ones if that overflows the buffer.
+func (b *shipBuffer) requeue(entries []model.LogEntry, dropped int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.entries = append(slices.Clone(entries), b.entries...)
+	b.dropped += dropped
+	if over := len(b.entries) - b.size; over > 0 {
+		b.entries = b.entries[over:]
+		b.dropped += over
+	}
+}
@@ -0,0 +1,100 @@
+package logger
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/najahiiii/xray-agent/internal/model"
+)
+
+func TestShipperBuffersWarnAndRetries(t *testing.T) {
+	var out bytes.Buffer
+	shipper := NewShipper(newHandler(&out, "text", "info"), ShipOptions{BufferSize: 3, BatchSize: 2})
+	log := slog.New(shipper).With("component", "agent")
+
+	log.Info("routine")
+	log.Warn("stats-sync", "err", "boom")
+	log.WithGroup("xray").Error("apply failed", "tag", "vless-in")
+	if !bytes.Contains(out.Bytes(), []byte("routine")) || !bytes.Contains(out.Bytes(), []byte("apply failed")) {
+		t.Fatalf("expected records forwarded to wrapped handler, got %q", out.String())
+	}
+
+	failing := func(context.Context, *model.LogsPush) error { return errors.New("panel down") }
+	if err := shipper.Flush(context.Background(), failing); err == nil {
+		t.Fatal("expected flush error")
+	}
+
+	var pushes []*model.LogsPush
+	send := func(_ context.Context, p *model.LogsPush) error {
+		pushes = append(pushes, p)
+		return nil
+	}
+	if err := shipper.Flush(context.Background(), send); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if len(pushes) != 1 || len(pushes[0].Entries) != 2 {
+		t.Fatalf("expected one batch of two entries, got %+v", pushes)
+	}
+	first, second := pushes[0].Entries[0], pushes[0].Entries[1]
+	if first.Message != "stats-sync" || first.Level != "WARN" || first.Attrs["err"] != "boom" || first.Attrs["component"] != "agent" {
+		t.Fatalf("unexpected first entry: %+v", first)
+	}
+	if second.Attrs["xray.tag"] != "vless-in" {
+		t.Fatalf("expected grouped attr, got %+v", second.Attrs)
+	}
+}
+
+func TestShipperCountsDroppedEntries(t *testing.T) {
+	shipper := NewShipper(slog.DiscardHandler, ShipOptions{BufferSize: 2, BatchSize: 10})
+	log := slog.New(shipper)
+	for range 5 {
+		log.Error("boom")
+	}
+
+	var got *model.LogsPush
+	if err := shipper.Flush(context.Background(), func(_ context.Context, p *model.LogsPush) error {
+		got = p
+		return nil
+	}); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if got == nil || len(got.Entries) != 2 || got.Dropped != 3 {
+		t.Fatalf("unexpected push: %+v", got)
+	}
+}
+
+func TestShipperSetRetention(t *testing.T) {
+	shipper := NewShipper(slog.DiscardHandler, ShipOptions{BufferSize: 10, BatchSize: 10})
+	log := slog.New(shipper)
+	for range 4 {
+		log.Error("boom")
+	}
+	shipper.SetRetention(3, 0)
+
+	var got *model.LogsPush
+	send := func(_ context.Context, p *model.LogsPush) error {
+		got = p
+		return nil
+	}
+	if err := shipper.Flush(context.Background(), send); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if got == nil || len(got.Entries) != 3 || got.Dropped != 1 {
+		t.Fatalf("unexpected push after shrinking buffer: %+v", got)
+	}
+
+	shipper.SetRetention(0, time.Minute)
+	shipper.buf.add(model.LogEntry{Time: time.Now().Add(-2 * time.Minute), Message: "stale"})
+	shipper.buf.add(model.LogEntry{Time: time.Now(), Message: "fresh"})
+	got = nil
+	if err := shipper.Flush(context.Background(), send); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if got == nil || len(got.Entries) != 1 || got.Entries[0].Message != "fresh" || got.Dropped != 1 {
+		t.Fatalf("unexpected push after max age: %+v", got)
+	}
+}
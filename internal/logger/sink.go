@@ -0,0 +1,108 @@
+package logger
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+)
+
+// field is one flattened attribute; nested groups are joined with ".".
+type field struct {
+	key   string
+	value string
+}
+
+// sink receives fully resolved records from sinkHandler.
+type sink interface {
+	emit(level slog.Level, msg string, fields []field) error
+}
+
+// sinkHandler adapts a sink (journald, syslog) to slog.Handler. Timestamps are
+// left to the receiving daemon.
+type sinkHandler struct {
+	sink   sink
+	level  slog.Leveler
+	attrs  []field
+	groups []string
+}
+
+func newSinkHandler(s sink, level slog.Leveler) *sinkHandler {
+	return &sinkHandler{sink: s, level: level}
+}
+
+func (h *sinkHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *sinkHandler) Handle(_ context.Context, r slog.Record) error {
+	fields := slices.Clone(h.attrs)
+	r.Attrs(func(attr slog.Attr) bool {
+		fields = appendAttr(fields, h.groups, attr)
+		return true
+	})
+	if err := h.sink.emit(r.Level, r.Message, fields); err != nil {
+		// Never lose a record just because the daemon socket is gone.
+		fmt.Fprintf(os.Stderr, "%s %s%s\n", r.Level, r.Message, formatFields(fields))
+		return err
+	}
+	return nil
+}
+
+func (h *sinkHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	next := *h
+	next.attrs = slices.Clone(h.attrs)
+	for _, attr := range attrs {
+		next.attrs = appendAttr(next.attrs, h.groups, attr)
+	}
+	return &next
+}
+
+func (h *sinkHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	next := *h
+	next.groups = append(slices.Clone(h.groups), name)
+	return &next
+}
+
+func appendAttr(fields []field, groups []string, attr slog.Attr) []field {
+	attr.Value = attr.Value.Resolve()
+	if attr.Equal(slog.Attr{}) {
+		return fields
+	}
+	if attr.Value.Kind() == slog.KindGroup {
+		nested := groups
+		if attr.Key != "" {
+			nested = append(slices.Clone(groups), attr.Key)
+		}
+		for _, child := range attr.Value.Group() {
+			fields = appendAttr(fields, nested, child)
+		}
+		return fields
+	}
+
+	key := attr.Key
+	if len(groups) > 0 {
+		key = strings.Join(groups, ".") + "." + key
+	}
+	return append(fields, field{key: key, value: attr.Value.String()})
+}
+
+func formatFields(fields []field) string {
+	var b strings.Builder
+	for _, f := range fields {
+		b.WriteByte(' ')
+		b.WriteString(f.key)
+		b.WriteByte('=')
+		if strings.ContainsAny(f.value, " \t\n\"=") || f.value == "" {
+			fmt.Fprintf(&b, "%q", f.value)
+		} else {
+			b.WriteString(f.value)
+		}
+	}
+	return b.String()
+}
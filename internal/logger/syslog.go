@@ -0,0 +1,38 @@
+package logger
+
+import (
+	"log/slog"
+	"log/syslog"
+)
+
+// syslogSink forwards records to the local syslog daemon with a severity
+// matching the slog level.
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+func newSyslogSink(identifier string) (*syslogSink, error) {
+	w, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, identifier)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogSink{w: w}, nil
+}
+
+func (s *syslogSink) emit(level slog.Level, msg string, fields []field) error {
+	line := msg + formatFields(fields)
+	switch syslogPriority(level) {
+	case 3:
+		return s.w.Err(line)
+	case 4:
+		return s.w.Warning(line)
+	case 6:
+		return s.w.Info(line)
+	default:
+		return s.w.Debug(line)
+	}
+}
+
+func (s *syslogSink) Close() error {
+	return s.w.Close()
+}
@@ -0,0 +1,250 @@
+// Package logtail prints and follows the agent's and xray's logs, from files
+// or the systemd journal, for the logs command.
+package logtail
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// pollInterval is how often a followed file is checked for new lines,
+// truncation and rotation.
+var pollInterval = 250 * time.Millisecond
+
+// Journalctl is the journalctl binary Journal runs; overridden in tests.
+var Journalctl = "journalctl"
+
+// Line is one log line and the name of the log it came from.
+type Line struct {
+	Source string
+	Text   string
+}
+
+// Filter selects lines by level and by the email they mention.
+type Filter struct {
+	// MinLevel drops lines below it. Lines without a recognizable level,
+	// such as xray access log lines, are kept.
+	MinLevel slog.Level
+	// Email keeps only lines that contain it; empty keeps all.
+	Email string
+}
+
+// Match reports whether a log line passes f.
+func (f Filter) Match(text string) bool {
+	if f.Email != "" && !strings.Contains(text, f.Email) {
+		return false
+	}
+	if level, ok := Level(text); ok && level < f.MinLevel {
+		return false
+	}
+	return true
+}
+
+var (
+	agentLevel = regexp.MustCompile(`(?:^|\s)level=([A-Z]+)|"level":"([A-Z]+)"`)
+	xrayLevel  = regexp.MustCompile(`\[(Debug|Info|Warning|Error)\]`)
+)
+
+// Level returns the level of an agent log line, in text or JSON format, or
+// of an xray error log line.
+func Level(text string) (slog.Level, bool) {
+	if m := agentLevel.FindStringSubmatch(text); m != nil {
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(m[1] + m[2])); err == nil {
+			return level, true
+		}
+	}
+	if m := xrayLevel.FindStringSubmatch(text); m != nil {
+		switch m[1] {
+		case "Debug":
+			return slog.LevelDebug, true
+		case "Info":
+			return slog.LevelInfo, true
+		case "Warning":
+			return slog.LevelWarn, true
+		default:
+			return slog.LevelError, true
+		}
+	}
+	return 0, false
+}
+
+// File sends the last n lines of path that match to out and, with follow,
+// every matching line appended after them until ctx is done. A followed
+// file that is truncated is read again from the start, and one that is
+// rotated away is finished before its replacement is opened.
+func File(ctx context.Context, source, path string, n int, follow bool, match func(string) bool, out chan<- Line) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { f.Close() }()
+
+	// Keep the last n matches while reading up to the end.
+	var last []string
+	r := bufio.NewReader(f)
+	var offset int64
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				return err
+			}
+			break
+		}
+		offset += int64(len(line))
+		if text := strings.TrimRight(line, "\r\n"); match(text) && n > 0 {
+			if len(last) == n {
+				last = last[1:]
+			}
+			last = append(last, text)
+		}
+	}
+	for _, text := range last {
+		if !send(ctx, out, Line{source, text}) {
+			return nil
+		}
+	}
+	if !follow {
+		return nil
+	}
+
+	var partial []byte
+	buf := make([]byte, 32*1024)
+	emit := func(data []byte) bool {
+		partial = append(partial, data...)
+		for {
+			i := bytes.IndexByte(partial, '\n')
+			if i < 0 {
+				return true
+			}
+			text := strings.TrimRight(string(partial[:i]), "\r")
+			partial = partial[i+1:]
+			if match(text) && !send(ctx, out, Line{source, text}) {
+				return false
+			}
+		}
+	}
+	drain := func() (bool, error) {
+		for {
+			k, err := f.ReadAt(buf, offset)
+			offset += int64(k)
+			if !emit(buf[:k]) {
+				return false, nil
+			}
+			if errors.Is(err, io.EOF) || k == 0 {
+				return true, nil
+			}
+			if err != nil {
+				return false, err
+			}
+		}
+	}
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		if ok, err := drain(); !ok {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		opened, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		current, err := os.Stat(path)
+		switch {
+		case err != nil:
+			// Between a rotation's rename and the new file being created.
+			continue
+		case !os.SameFile(opened, current):
+			if ok, err := drain(); !ok {
+				return err
+			}
+			next, err := os.Open(path)
+			if err != nil {
+				continue
+			}
+			f.Close()
+			f, offset, partial = next, 0, nil
+		case current.Size() < offset:
+			offset, partial = 0, nil
+		}
+	}
+}
+
+// Journal sends the last n journal entries selected by args (e.g.
+// "-t", "xray-agent") to out and, with follow, new ones until ctx is done.
+// priority, when set, is passed as journalctl -p.
+func Journal(ctx context.Context, source string, args []string, priority string, n int, follow bool, match func(string) bool, out chan<- Line) error {
+	args = append([]string{"--no-pager", "-o", "short-iso", "-n", fmt.Sprint(n)}, args...)
+	if priority != "" {
+		args = append(args, "-p", priority)
+	}
+	if follow {
+		args = append(args, "-f")
+	}
+	cmd := exec.CommandContext(ctx, Journalctl, args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("%s: %w", Journalctl, err)
+	}
+	sc := bufio.NewScanner(stdout)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		text := sc.Text()
+		// journalctl marks the end of the entries it found.
+		if text == "-- No entries --" || !match(text) {
+			continue
+		}
+		if !send(ctx, out, Line{source, text}) {
+			break
+		}
+	}
+	if err := cmd.Wait(); err != nil && ctx.Err() == nil {
+		return fmt.Errorf("%s: %w: %s", Journalctl, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// JournalPriority maps a level onto journalctl -p.
+func JournalPriority(level slog.Level) string {
+	switch {
+	case level >= slog.LevelError:
+		return "err"
+	case level >= slog.LevelWarn:
+		return "warning"
+	case level >= slog.LevelInfo:
+		return "info"
+	default:
+		return "debug"
+	}
+}
+
+func send(ctx context.Context, out chan<- Line, l Line) bool {
+	select {
+	case out <- l:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
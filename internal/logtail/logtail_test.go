@@ -0,0 +1,140 @@
+package logtail
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFilterMatch(t *testing.T) {
+	f := Filter{MinLevel: slog.LevelWarn, Email: "a@example.com"}
+	for _, tc := range []struct {
+		line string
+		want bool
+	}{
+		{`time=2026-10-16T03:12:04Z level=WARN msg="add user failed" email=a@example.com`, true},
+		{`time=2026-10-16T03:12:04Z level=INFO msg="user added" email=a@example.com`, false},
+		{`{"time":"2026-10-16T03:12:04Z","level":"ERROR","msg":"add user failed","email":"a@example.com"}`, true},
+		{`time=2026-10-16T03:12:04Z level=ERROR msg="sync failed"`, false},
+		{`2026/10/16 03:12:04.123456 [Warning] [123] a@example.com: connection ends`, true},
+		{`2026/10/16 03:12:04.123456 [Info] [123] a@example.com: tunneling request`, false},
+		// Access log lines have no level.
+		{`2026/10/16 03:12:04.123456 from 198.51.100.7:51234 accepted tcp:example.com:443 [vless-in >> direct] email: a@example.com`, true},
+	} {
+		if got := f.Match(tc.line); got != tc.want {
+			t.Errorf("Match(%q) = %v, want %v", tc.line, got, tc.want)
+		}
+	}
+}
+
+func TestFileTailsAndFollowsRotation(t *testing.T) {
+	pollInterval = 10 * time.Millisecond
+	path := filepath.Join(t.TempDir(), "agent.log")
+	if err := os.WriteFile(path, []byte("one\nskip two\nthree\nfour\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	match := func(s string) bool { return !strings.HasPrefix(s, "skip") }
+
+	out := make(chan Line, 16)
+	if err := File(context.Background(), "agent", path, 2, false, match, out); err != nil {
+		t.Fatalf("File: %v", err)
+	}
+	close(out)
+	var got []string
+	for l := range out {
+		got = append(got, l.Text)
+	}
+	if !slices.Equal(got, []string{"three", "four"}) {
+		t.Fatalf("tail = %q", got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	out = make(chan Line, 16)
+	done := make(chan error, 1)
+	go func() { done <- File(ctx, "agent", path, 1, true, match, out) }()
+	next := func() string {
+		t.Helper()
+		select {
+		case l := <-out:
+			return l.Text
+		case <-time.After(5 * time.Second):
+			t.Fatal("no line")
+			return ""
+		}
+	}
+	if got := next(); got != "four" {
+		t.Fatalf("first line = %q", got)
+	}
+
+	appendLine := func(path, text string) {
+		t.Helper()
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := f.WriteString(text); err != nil {
+			t.Fatal(err)
+		}
+	}
+	appendLine(path, "fi")
+	appendLine(path, "ve\nskip six\n")
+	if got := next(); got != "five" {
+		t.Fatalf("appended line = %q", got)
+	}
+
+	// Rotation: the old file is renamed and a new one created.
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	appendLine(path+".1", "seven\n")
+	appendLine(path, "eight\n")
+	if a, b := next(), next(); a != "seven" || b != "eight" {
+		t.Fatalf("lines around rotation = %q, %q", a, b)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("File: %v", err)
+	}
+}
+
+func TestJournalRunsJournalctl(t *testing.T) {
+	dir := t.TempDir()
+	argsFile := filepath.Join(dir, "args")
+	script := filepath.Join(dir, "journalctl")
+	body := "#!/bin/sh\necho \"$@\" > " + argsFile + "\necho 'line one'\necho 'skip me'\necho '-- No entries --'\n"
+	if err := os.WriteFile(script, []byte(body), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	old := Journalctl
+	Journalctl = script
+	t.Cleanup(func() { Journalctl = old })
+
+	out := make(chan Line, 4)
+	match := func(s string) bool { return !strings.HasPrefix(s, "skip") }
+	if err := Journal(context.Background(), "agent", []string{"-t", "xray-agent"}, "warning", 20, false, match, out); err != nil {
+		t.Fatalf("Journal: %v", err)
+	}
+	close(out)
+	var got []Line
+	for l := range out {
+		got = append(got, l)
+	}
+	if len(got) != 1 || got[0] != (Line{"agent", "line one"}) {
+		t.Fatalf("lines = %+v", got)
+	}
+	args, err := os.ReadFile(argsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "--no-pager -o short-iso -n 20 -t xray-agent -p warning\n"; string(args) != want {
+		t.Fatalf("journalctl args = %q, want %q", args, want)
+	}
+}
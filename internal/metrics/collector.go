@@ -1,27 +1,52 @@
 package metrics
 
 import (
+	"bufio"
 	"context"
 	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/najahiiii/xray-agent/internal/model"
 	"github.com/shirou/gopsutil/v4/cpu"
+	"github.com/shirou/gopsutil/v4/disk"
+	"github.com/shirou/gopsutil/v4/load"
 	"github.com/shirou/gopsutil/v4/mem"
 	"github.com/shirou/gopsutil/v4/net"
 )
 
+// DiskPaths are the paths whose filesystem usage is sampled. Paths that do
+// not exist on the host are skipped.
+var DiskPaths = []string{"/", "/var/log"}
+
+// Options selects the interfaces bandwidth is measured on. Both lists hold
+// shell patterns; without Include the default route's interface is used.
+// IPv6Probe is the host:port dialed to tell whether IPv6 egress works; the
+// network check is off when it is empty.
+type Options struct {
+	Include   []string
+	Exclude   []string
+	IPv6Probe string
+}
+
 type Collector struct {
-	log *slog.Logger
+	log  *slog.Logger
+	opts Options
 
 	mu      sync.Mutex
 	lastNet *net.IOCountersStat
 	lastAt  time.Time
+
+	netMu   sync.Mutex
+	network *model.NetworkStatus
 }
 
-func New(log *slog.Logger) *Collector {
-	return &Collector{log: log}
+func New(log *slog.Logger, opts Options) *Collector {
+	return &Collector{log: log, opts: opts}
 }
 
 func (c *Collector) Sample(ctx context.Context) *model.ServerMetricPush {
@@ -50,23 +75,50 @@ func (c *Collector) Sample(ctx context.Context) *model.ServerMetricPush {
 		hasData = true
 	}
 
+	if disks := c.diskUsage(ctx); len(disks) > 0 {
+		sample.Disks = disks
+		hasData = true
+	}
+
+	if avg, err := load.AvgWithContext(ctx); err != nil {
+		c.log.Debug("metrics load sample failed", "err", err)
+	} else if avg != nil {
+		sample.LoadAverage = &model.LoadAverage{Load1: avg.Load1, Load5: avg.Load5, Load15: avg.Load15}
+		hasData = true
+	}
+
 	if !hasData {
 		return nil
 	}
 	return sample
 }
 
-func (c *Collector) netThroughput(ctx context.Context) (float64, float64, bool) {
-	stats, err := net.IOCountersWithContext(ctx, false)
-	if err != nil || len(stats) == 0 {
+func (c *Collector) diskUsage(ctx context.Context) []model.DiskUsage {
+	var disks []model.DiskUsage
+	for _, path := range DiskPaths {
+		usage, err := disk.UsageWithContext(ctx, path)
 		if err != nil {
-			c.log.Debug("metrics net sample failed", "err", err)
+			c.log.Debug("metrics disk sample failed", "path", path, "err", err)
+			continue
 		}
+		disks = append(disks, model.DiskUsage{
+			Path:        path,
+			UsedPercent: usage.UsedPercent,
+			TotalBytes:  usage.Total,
+			FreeBytes:   usage.Free,
+		})
+	}
+	return disks
+}
+
+func (c *Collector) netThroughput(ctx context.Context) (float64, float64, bool) {
+	sent, recv, ok := c.NetBytes(ctx)
+	if !ok {
 		return 0, 0, false
 	}
 
 	now := time.Now()
-	total := stats[0]
+	total := net.IOCountersStat{BytesSent: sent, BytesRecv: recv}
 
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -96,6 +148,69 @@ func (c *Collector) netThroughput(ctx context.Context) (float64, float64, bool)
 	return upMbps, downMbps, true
 }
 
+// NetBytes returns the bytes sent and received on the measured interfaces
+// since they came up, as the kernel counts them. ok is false when the
+// counters cannot be read.
+func (c *Collector) NetBytes(ctx context.Context) (sent, recv uint64, ok bool) {
+	stats, err := net.IOCountersWithContext(ctx, true)
+	if err != nil || len(stats) == 0 {
+		if err != nil {
+			c.log.Debug("metrics net sample failed", "err", err)
+		}
+		return 0, 0, false
+	}
+	for _, nic := range stats {
+		if c.measured(nic.Name) {
+			sent += nic.BytesSent
+			recv += nic.BytesRecv
+		}
+	}
+	return sent, recv, true
+}
+
+// measured reports whether traffic on the interface name counts towards the
+// bandwidth sample.
+func (c *Collector) measured(name string) bool {
+	if matchAny(c.opts.Exclude, name) {
+		return false
+	}
+	if len(c.opts.Include) > 0 {
+		return matchAny(c.opts.Include, name)
+	}
+	if route := defaultRouteInterfaces(); len(route) > 0 {
+		return slices.Contains(route, name)
+	}
+	return name != "lo"
+}
+
+func matchAny(patterns []string, name string) bool {
+	return slices.ContainsFunc(patterns, func(p string) bool {
+		ok, _ := filepath.Match(p, name)
+		return ok
+	})
+}
+
+// defaultRouteInterfaces returns the interfaces of the IPv4 default routes
+// from /proc/net/route, or nil when there is none.
+func defaultRouteInterfaces() []string {
+	f, err := os.Open(filepath.Join(procNet, "route"))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var ifaces []string
+	sc := bufio.NewScanner(f)
+	sc.Scan() // header
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) >= 2 && fields[1] == "00000000" && !slices.Contains(ifaces, fields[0]) {
+			ifaces = append(ifaces, fields[0])
+		}
+	}
+	return ifaces
+}
+
 func diffUint64(curr, prev uint64) uint64 {
 	if curr >= prev {
 		return curr - prev
@@ -1,7 +1,13 @@
 package metrics
 
 import (
+	"context"
+	"log/slog"
+	"maps"
 	"math"
+	"os"
+	"path/filepath"
+	"slices"
 	"testing"
 )
 
@@ -58,3 +64,86 @@ func TestFloatPtr(t *testing.T) {
 		t.Fatalf("floatPtr() value = %v, want %v", *got, 12.5)
 	}
 }
+
+func TestConnectionsCountsEstablishedByPort(t *testing.T) {
+	dir := t.TempDir()
+	tcp := `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000:01BB 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 1 1 0000000000000000 100 0 0 10 0
+   1: 0100007F:01BB 0200007F:C350 01 00000000:00000000 00:00000000 00000000     0        0 2 1 0000000000000000 20 4 30 10 -1
+   2: 0100007F:01BB 0200007F:C351 01 00000000:00000000 00:00000000 00000000     0        0 3 1 0000000000000000 20 4 30 10 -1
+   3: 0100007F:C352 0200007F:01BB 01 00000000:00000000 00:00000000 00000000     0        0 4 1 0000000000000000 20 4 30 10 -1
+`
+	tcp6 := `  sl  local_address                         remote_address                        st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000000000000000000001000000:2711 00000000000000000000000001000000:D000 01 00000000:00000000 00:00000000 00000000     0        0 5 1 0000000000000000 20 4 30 10 -1
+`
+	if err := os.WriteFile(filepath.Join(dir, "tcp"), []byte(tcp), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "tcp6"), []byte(tcp6), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	orig := procNet
+	procNet = dir
+	t.Cleanup(func() { procNet = orig })
+
+	got := New(slog.New(slog.DiscardHandler), Options{}).Connections(map[string]int{"vless": 443, "vmess": 10001, "trojan": 8443})
+	want := map[string]int{"vless": 2, "vmess": 1, "trojan": 0}
+	if !maps.Equal(got, want) {
+		t.Fatalf("Connections() = %v, want %v", got, want)
+	}
+}
+
+func TestDiskUsageSkipsMissingPaths(t *testing.T) {
+	orig := DiskPaths
+	DiskPaths = []string{t.TempDir(), filepath.Join(t.TempDir(), "missing")}
+	t.Cleanup(func() { DiskPaths = orig })
+
+	disks := New(slog.New(slog.DiscardHandler), Options{}).diskUsage(context.Background())
+	if len(disks) != 1 || disks[0].Path != DiskPaths[0] || disks[0].TotalBytes == 0 {
+		t.Fatalf("diskUsage() = %+v, want only %s", disks, DiskPaths[0])
+	}
+}
+
+func TestMeasuredInterfaces(t *testing.T) {
+	dir := t.TempDir()
+	route := "Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT\n" +
+		"eth0\t00000000\t0101A8C0\t0003\t0\t0\t100\t00000000\t0\t0\t0\n" +
+		"eth0\t0001A8C0\t00000000\t0001\t0\t0\t100\t00FFFFFF\t0\t0\t0\n" +
+		"docker0\t000011AC\t00000000\t0001\t0\t0\t0\t0000FFFF\t0\t0\t0\n"
+	if err := os.WriteFile(filepath.Join(dir, "route"), []byte(route), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	orig := procNet
+	procNet = dir
+	t.Cleanup(func() { procNet = orig })
+
+	cases := []struct {
+		name string
+		opts Options
+		want []string
+	}{
+		{name: "default route", want: []string{"eth0"}},
+		{name: "include patterns", opts: Options{Include: []string{"eth*", "wg0"}}, want: []string{"eth0", "eth1", "wg0"}},
+		{name: "exclude wins", opts: Options{Include: []string{"eth*"}, Exclude: []string{"eth1"}}, want: []string{"eth0"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := New(slog.New(slog.DiscardHandler), tc.opts)
+			var got []string
+			for _, name := range []string{"lo", "eth0", "eth1", "docker0", "wg0"} {
+				if c.measured(name) {
+					got = append(got, name)
+				}
+			}
+			if !slices.Equal(got, tc.want) {
+				t.Fatalf("measured = %v, want %v", got, tc.want)
+			}
+		})
+	}
+
+	procNet = t.TempDir()
+	c := New(slog.New(slog.DiscardHandler), Options{Exclude: []string{"docker*"}})
+	if c.measured("lo") || c.measured("docker0") || !c.measured("eth1") {
+		t.Fatal("without a default route every non-loopback, non-excluded interface should be measured")
+	}
+}
@@ -0,0 +1,76 @@
+package metrics
+
+import (
+	"bufio"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// procNet is where the kernel's socket tables are read from; overridden in
+// tests.
+var procNet = "/proc/net"
+
+// tcpEstablished is the st column of an established socket in /proc/net/tcp.
+const tcpEstablished = "01"
+
+// Connections counts the established TCP connections whose local port is one
+// of ports, keyed by the same names as ports (the inbound tags). Sockets of
+// both /proc/net/tcp and tcp6 are counted. It returns nil on systems without
+// procfs.
+func (c *Collector) Connections(ports map[string]int) map[string]int {
+	if len(ports) == 0 {
+		return nil
+	}
+	byPort := map[int]int{}
+	var found bool
+	for _, name := range []string{"tcp", "tcp6"} {
+		err := countEstablished(filepath.Join(procNet, name), byPort)
+		switch {
+		case err == nil:
+			found = true
+		case !errors.Is(err, fs.ErrNotExist):
+			c.log.Debug("metrics connections sample failed", "file", name, "err", err)
+		}
+	}
+	if !found {
+		return nil
+	}
+	res := make(map[string]int, len(ports))
+	for tag, port := range ports {
+		res[tag] = byPort[port]
+	}
+	return res
+}
+
+// countEstablished adds the established sockets of a /proc/net/tcp style
+// table to byPort by local port.
+func countEstablished(path string, byPort map[int]int) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	sc.Scan() // header
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 4 || fields[3] != tcpEstablished {
+			continue
+		}
+		_, hexPort, ok := strings.Cut(fields[1], ":")
+		if !ok {
+			continue
+		}
+		port, err := strconv.ParseUint(hexPort, 16, 16)
+		if err != nil {
+			continue
+		}
+		byPort[int(port)]++
+	}
+	return sc.Err()
+}
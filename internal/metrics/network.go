@@ -0,0 +1,93 @@
+package metrics
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/najahiiii/xray-agent/internal/model"
+)
+
+const (
+	// networkCheckInterval is how long a network check is reused; addresses
+	// and IPv6 reachability rarely change between metrics samples.
+	networkCheckInterval = 10 * time.Minute
+	// networkProbeTimeout bounds the IPv6 egress probe.
+	networkProbeTimeout = 3 * time.Second
+	// routeProbe4 and routeProbe6 are only used to ask the kernel which
+	// source address it picks for the internet; no packet is sent to them.
+	routeProbe4 = "192.0.2.1:53"
+	routeProbe6 = "[2001:db8::1]:53"
+)
+
+// Network returns the node's public addresses and whether IPv6 egress
+// works, checking again once the last check is networkCheckInterval old.
+// It returns nil when Options.IPv6Probe is empty.
+func (c *Collector) Network(ctx context.Context) *model.NetworkStatus {
+	if c.opts.IPv6Probe == "" {
+		return nil
+	}
+	c.netMu.Lock()
+	defer c.netMu.Unlock()
+	if c.network != nil && time.Since(c.network.CheckedAt) < networkCheckInterval {
+		return c.network
+	}
+
+	st := &model.NetworkStatus{CheckedAt: time.Now().UTC()}
+	if addr, ok := egressAddr("udp4", routeProbe4); ok {
+		st.PublicIPv4 = addr.String()
+	}
+	if addr, ok := egressAddr("udp6", routeProbe6); ok {
+		st.PublicIPv6 = addr.String()
+		st.IPv6Egress = c.probeIPv6(ctx)
+	}
+	if c.network == nil || c.network.IPv6Egress != st.IPv6Egress {
+		c.log.Info("network check", "ipv4", st.PublicIPv4, "ipv6", st.PublicIPv6, "ipv6_egress", st.IPv6Egress)
+	}
+	c.network = st
+	return st
+}
+
+// LastNetwork returns the last network check without running a new one, or
+// nil before the first.
+func (c *Collector) LastNetwork() *model.NetworkStatus {
+	c.netMu.Lock()
+	defer c.netMu.Unlock()
+	return c.network
+}
+
+// probeIPv6 opens a TCP connection to Options.IPv6Probe over IPv6.
+func (c *Collector) probeIPv6(ctx context.Context) bool {
+	d := net.Dialer{Timeout: networkProbeTimeout}
+	conn, err := d.DialContext(ctx, "tcp6", c.opts.IPv6Probe)
+	if err != nil {
+		c.log.Debug("ipv6 egress probe failed", "target", c.opts.IPv6Probe, "err", err)
+		return false
+	}
+	_ = conn.Close()
+	return true
+}
+
+// egressAddr returns the source address the kernel routes internet traffic
+// of network from, when it is a public one. Behind NAT there is none.
+func egressAddr(network, target string) (netip.Addr, bool) {
+	conn, err := net.Dial(network, target)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	defer conn.Close()
+	ap, err := netip.ParseAddrPort(conn.LocalAddr().String())
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	addr := ap.Addr().Unmap()
+	return addr, isPublic(addr)
+}
+
+func isPublic(addr netip.Addr) bool {
+	return addr.IsGlobalUnicast() && !addr.IsPrivate() && !sharedAddressSpace.Contains(addr)
+}
+
+// sharedAddressSpace is the carrier-grade NAT range of RFC 6598.
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
@@ -0,0 +1,67 @@
+package metrics
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestIsPublic(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"203.0.113.10":   true,
+		"2001:db8:10::1": true,
+		"10.0.0.5":       false,
+		"192.168.1.2":    false,
+		"100.72.0.1":     false,
+		"127.0.0.1":      false,
+		"169.254.1.1":    false,
+		"fd00::1":        false,
+		"fe80::1":        false,
+		"::1":            false,
+	} {
+		if got := isPublic(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("isPublic(%s) = %v, want %v", addr, got, want)
+		}
+	}
+}
+
+func TestNetworkCheck(t *testing.T) {
+	c := New(slog.New(slog.DiscardHandler), Options{})
+	if st := c.Network(context.Background()); st != nil {
+		t.Fatalf("Network() without ipv6_probe = %+v, want nil", st)
+	}
+
+	c = New(slog.New(slog.DiscardHandler), Options{IPv6Probe: "[::1]:1"})
+	if c.LastNetwork() != nil {
+		t.Fatal("LastNetwork() before any check is not nil")
+	}
+	first := c.Network(context.Background())
+	if first == nil || first.CheckedAt.IsZero() {
+		t.Fatalf("Network() = %+v, want a check", first)
+	}
+	if again := c.Network(context.Background()); again != first {
+		t.Fatal("Network() checked again within the check interval")
+	}
+	if c.LastNetwork() != first {
+		t.Fatal("LastNetwork() does not return the last check")
+	}
+}
+
+func TestProbeIPv6(t *testing.T) {
+	lis, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	defer lis.Close()
+
+	c := New(slog.New(slog.DiscardHandler), Options{IPv6Probe: lis.Addr().String()})
+	if !c.probeIPv6(context.Background()) {
+		t.Fatal("probe of a listening IPv6 address failed")
+	}
+	lis.Close()
+	if c.probeIPv6(context.Background()) {
+		t.Fatal("probe of a closed IPv6 address succeeded")
+	}
+}
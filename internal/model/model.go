@@ -1,12 +1,197 @@
 package model
 
-import "time"
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+)
 
 type State struct {
-	ConfigVersion int64          `json:"config_version"`
-	Clients       []Client       `json:"clients"`
-	Routes        []RouteRule    `json:"routes,omitempty"`
-	Meta          map[string]any `json:"meta,omitempty"`
+	ConfigVersion int64       `json:"config_version"`
+	Clients       []Client    `json:"clients"`
+	Routes        []RouteRule `json:"routes,omitempty"`
+	// Outbounds are added to xray alongside the ones in its config.
+	Outbounds []Outbound `json:"outbounds,omitempty"`
+	// InboundTags overrides xray.inbound_tags per proto, e.g. {"vless": "vless-grpc"}.
+	InboundTags map[string]string `json:"inbound_tags,omitempty"`
+	// Retention overrides the local retention settings; nil keeps them.
+	Retention *RetentionPolicy `json:"retention,omitempty"`
+	// Sniffing sets the sniffing block of inbounds by tag. Inbounds that are
+	// not listed keep what the xray config has.
+	Sniffing map[string]Sniffing `json:"sniffing,omitempty"`
+	// DNS replaces the dns section of the xray config; nil leaves it alone.
+	DNS *DNS `json:"dns,omitempty"`
+	// Certificates are written to disk for TLS and Reality inbounds.
+	Certificates []CertificateBundle `json:"certificates,omitempty"`
+	// ACMEDomains are issued through ACME on top of acme.domains from the
+	// agent config, when ACME is enabled.
+	ACMEDomains []string `json:"acme_domains,omitempty"`
+	// Features are flags for agent behaviors that roll out gradually.
+	Features map[string]FeatureFlag `json:"features,omitempty"`
+	// Render holds the values xray.render.template is rendered with.
+	Render map[string]any `json:"render,omitempty"`
+	Meta   map[string]any `json:"meta,omitempty"`
+}
+
+// RetentionPolicy bounds what the agent keeps on disk and in memory. A nil
+// field leaves the corresponding local config value in effect.
+type RetentionPolicy struct {
+	// SpoolMaxAgeSec drops undelivered spooled records older than this.
+	SpoolMaxAgeSec *int `json:"spool_max_age_sec,omitempty"`
+	// BackupCount caps the rotated log files kept next to the log file.
+	BackupCount *int `json:"backup_count,omitempty"`
+	// LogMaxAgeDays deletes rotated log files older than this.
+	LogMaxAgeDays *int `json:"log_max_age_days,omitempty"`
+	// HistoryCacheSize caps the records held in memory between pushes.
+	HistoryCacheSize *int `json:"history_cache_size,omitempty"`
+}
+
+// Validate rejects negative values; zero keeps everything, as in the config.
+func (p *RetentionPolicy) Validate() error {
+	if p == nil {
+		return nil
+	}
+	for name, v := range map[string]*int{
+		"spool_max_age_sec":  p.SpoolMaxAgeSec,
+		"backup_count":       p.BackupCount,
+		"log_max_age_days":   p.LogMaxAgeDays,
+		"history_cache_size": p.HistoryCacheSize,
+	} {
+		if v != nil && *v < 0 {
+			return fmt.Errorf("retention.%s must not be negative, got %d", name, *v)
+		}
+	}
+	return nil
+}
+
+// Equal compares two policies field by field; nil equals an empty policy.
+func (p *RetentionPolicy) Equal(o *RetentionPolicy) bool {
+	var a, b RetentionPolicy
+	if p != nil {
+		a = *p
+	}
+	if o != nil {
+		b = *o
+	}
+	eq := func(x, y *int) bool {
+		return (x == nil && y == nil) || (x != nil && y != nil && *x == *y)
+	}
+	return eq(a.SpoolMaxAgeSec, b.SpoolMaxAgeSec) &&
+		eq(a.BackupCount, b.BackupCount) &&
+		eq(a.LogMaxAgeDays, b.LogMaxAgeDays) &&
+		eq(a.HistoryCacheSize, b.HistoryCacheSize)
+}
+
+// Sniffing is an inbound's traffic sniffing setup. DestOverride lists the
+// protocols whose sniffed domain replaces the destination: http, tls, quic,
+// fakedns or fakedns+others.
+type Sniffing struct {
+	Enabled      bool     `json:"enabled"`
+	DestOverride []string `json:"dest_override,omitempty"`
+	// RouteOnly uses the sniffed domain for routing only, keeping the
+	// original destination for the connection.
+	RouteOnly    bool `json:"route_only,omitempty"`
+	MetadataOnly bool `json:"metadata_only,omitempty"`
+}
+
+var sniffingProtocols = []string{"http", "tls", "quic", "fakedns", "fakedns+others"}
+
+// Validate rejects unknown destOverride protocols.
+func (s Sniffing) Validate() error {
+	for _, p := range s.DestOverride {
+		if !slices.Contains(sniffingProtocols, p) {
+			return fmt.Errorf("unsupported dest_override %q (want one of %v)", p, sniffingProtocols)
+		}
+	}
+	return nil
+}
+
+// DNS is the node's resolver setup. Servers are queried in order; a server
+// with Domains is preferred for those domains, which is how per-domain DNS
+// routing is expressed. Hosts maps a domain to fixed addresses or, with a
+// single non-IP value, to another domain.
+type DNS struct {
+	Servers []DNSServer         `json:"servers"`
+	Hosts   map[string][]string `json:"hosts,omitempty"`
+	// QueryStrategy is UseIP (default), UseIPv4 or UseIPv6.
+	QueryStrategy string `json:"query_strategy,omitempty"`
+	DisableCache  bool   `json:"disable_cache,omitempty"`
+}
+
+// DNSServer is one upstream resolver, e.g. "1.1.1.1", "https://dns.google/dns-query"
+// or "localhost".
+type DNSServer struct {
+	Address      string   `json:"address"`
+	Port         int      `json:"port,omitempty"`
+	Domains      []string `json:"domains,omitempty"`
+	ExpectIPs    []string `json:"expect_ips,omitempty"`
+	SkipFallback bool     `json:"skip_fallback,omitempty"`
+}
+
+var dnsQueryStrategies = []string{"", "UseIP", "UseIPv4", "UseIPv6"}
+
+// Validate rejects servers without an address, out-of-range ports and
+// unknown query strategies.
+func (d DNS) Validate() error {
+	if !slices.Contains(dnsQueryStrategies, d.QueryStrategy) {
+		return fmt.Errorf("unsupported query_strategy %q (want UseIP, UseIPv4 or UseIPv6)", d.QueryStrategy)
+	}
+	for i, srv := range d.Servers {
+		if strings.TrimSpace(srv.Address) == "" {
+			return fmt.Errorf("dns server %d has no address", i)
+		}
+		if srv.Port < 0 || srv.Port > 65535 {
+			return fmt.Errorf("dns server %s: port %d out of range", srv.Address, srv.Port)
+		}
+	}
+	for domain, addrs := range d.Hosts {
+		if len(addrs) == 0 {
+			return fmt.Errorf("dns host %s has no addresses", domain)
+		}
+	}
+	return nil
+}
+
+// FeatureFlag enables an agent behavior on Percent of the fleet, chosen by
+// hashing each node's slug. In JSON it is either {"percent": 25} or a bool,
+// which means 100 or 0.
+type FeatureFlag struct {
+	Percent float64 `json:"percent"`
+}
+
+func (f *FeatureFlag) UnmarshalJSON(data []byte) error {
+	var on bool
+	if err := json.Unmarshal(data, &on); err == nil {
+		f.Percent = 0
+		if on {
+			f.Percent = 100
+		}
+		return nil
+	}
+	type plain FeatureFlag
+	return json.Unmarshal(data, (*plain)(f))
+}
+
+// CertificateBundle is the PEM certificate chain and private key for one
+// domain. Hash is the hex SHA-256 of Cert followed by Key and guards against
+// truncated or mixed-up bundles.
+type CertificateBundle struct {
+	Domain string `json:"domain"`
+	Cert   string `json:"cert"`
+	Key    string `json:"key"`
+	Hash   string `json:"hash"`
+}
+
+// IntOr returns *v, or def when v is nil.
+func IntOr(v *int, def int) int {
+	if v == nil {
+		return def
+	}
+	return *v
 }
 
 type AgentCommandType string
@@ -16,6 +201,18 @@ const (
 	AgentCommandTypeRestartAgent AgentCommandType = "RESTART_AGENT"
 	AgentCommandTypeUpdateAgent  AgentCommandType = "UPDATE_AGENT"
 	AgentCommandTypeUpdateCore   AgentCommandType = "UPDATE_CORE"
+	AgentCommandTypeOpenAssist   AgentCommandType = "OPEN_ASSIST"
+	AgentCommandTypeCloseAssist  AgentCommandType = "CLOSE_ASSIST"
+	// AgentCommandTypeResync fetches and applies the state immediately.
+	AgentCommandTypeResync AgentCommandType = "RESYNC"
+	// AgentCommandTypeUpdateGeodata replaces geoip.dat/geosite.dat and
+	// restarts xray.
+	AgentCommandTypeUpdateGeodata AgentCommandType = "UPDATE_GEODATA"
+	// AgentCommandTypeRotateLogs starts a new agent log file.
+	AgentCommandTypeRotateLogs AgentCommandType = "ROTATE_LOGS"
+	// AgentCommandTypeSpeedtest measures the node's bandwidth in the
+	// background and posts a SpeedtestResult.
+	AgentCommandTypeSpeedtest AgentCommandType = "SPEEDTEST"
 )
 
 type AgentCommand struct {
@@ -43,11 +240,88 @@ type Client struct {
 	ID       string `json:"id,omitempty"`
 	Password string `json:"password,omitempty"`
 	Email    string `json:"email"`
+	// Flow is the VLESS flow control, e.g. xtls-rprx-vision; empty uses none.
+	Flow string `json:"flow,omitempty"`
+	// Level selects the xray policy level (policy.levels in the xray config)
+	// the client's connections use.
+	Level uint32 `json:"level,omitempty"`
+	// InboundTag places the client on a specific inbound; empty uses the
+	// inbound configured for Proto.
+	InboundTag string `json:"inbound_tag,omitempty"`
+	// PublicKey, PreSharedKey and AllowedIPs describe a wireguard peer.
+	PublicKey    string   `json:"public_key,omitempty"`
+	PreSharedKey string   `json:"pre_shared_key,omitempty"`
+	AllowedIPs   []string `json:"allowed_ips,omitempty"`
+}
+
+// ProtoWireGuard clients are peers of xray's wireguard inbound. The inbound
+// has no user API, so they are written into the xray config instead.
+const ProtoWireGuard = "wireguard"
+
+// ValidatePeer checks the wireguard fields of c: base64 keys of 32 bytes and
+// at least one allowed CIDR.
+func (c Client) ValidatePeer() error {
+	if !isWireGuardKey(c.PublicKey) {
+		return fmt.Errorf("peer %s: public_key must be a base64 32-byte key", c.Email)
+	}
+	if c.PreSharedKey != "" && !isWireGuardKey(c.PreSharedKey) {
+		return fmt.Errorf("peer %s: pre_shared_key must be a base64 32-byte key", c.Email)
+	}
+	if len(c.AllowedIPs) == 0 {
+		return fmt.Errorf("peer %s: allowed_ips required", c.Email)
+	}
+	for _, cidr := range c.AllowedIPs {
+		if _, err := netip.ParsePrefix(cidr); err != nil {
+			return fmt.Errorf("peer %s: allowed_ips: %w", c.Email, err)
+		}
+	}
+	return nil
+}
+
+func isWireGuardKey(s string) bool {
+	raw, err := base64.StdEncoding.DecodeString(s)
+	return err == nil && len(raw) == 32
+}
+
+// WithInboundTags fills InboundTag from a per-proto override map for clients
+// that do not name an inbound themselves.
+func WithInboundTags(clients []Client, tags map[string]string) []Client {
+	if len(tags) == 0 {
+		return clients
+	}
+	out := make([]Client, len(clients))
+	for i, c := range clients {
+		if c.InboundTag == "" {
+			c.InboundTag = tags[c.Proto]
+		}
+		out[i] = c
+	}
+	return out
 }
 
 type StatsPush struct {
-	ServerTime time.Time   `json:"server_time"`
-	Users      []UserUsage `json:"users"`
+	ServerTime time.Time           `json:"server_time"`
+	Sequence   uint64              `json:"sequence,omitempty"`
+	Restart    *StatsRestartMarker `json:"restart,omitempty"`
+	// Checkpoint pushes list every user with TotalUplink and TotalDownlink;
+	// other pushes leave out users without new traffic.
+	Checkpoint bool `json:"checkpoint,omitempty"`
+	// CounterReset is set when xray restarted since the previous push; the
+	// usage is still exact, this only flags the event.
+	CounterReset bool `json:"counter_reset,omitempty"`
+	// Replayed is set when a restarted agent resends a push the panel may
+	// already have accepted; it keeps its original Sequence.
+	Replayed bool        `json:"replayed,omitempty"`
+	Users    []UserUsage `json:"users"`
+}
+
+// StatsRestartMarker is attached to the first stats push after the agent starts
+// so the panel can audit gaps in the push sequence.
+type StatsRestartMarker struct {
+	StartedAt        time.Time  `json:"started_at"`
+	PreviousSequence uint64     `json:"previous_sequence,omitempty"`
+	PreviousSavedAt  *time.Time `json:"previous_saved_at,omitempty"`
+	CountersRestored bool       `json:"counters_restored"`
 }
 
 type OnlineUsersPush struct {
@@ -55,10 +329,310 @@ type OnlineUsersPush struct {
 	Users      []OnlineUserInfo `json:"users"`
 }
 
-type HeartbeatPush struct {
-	OK              bool   `json:"ok"`
+// RegisterRequest is sent with a one-time bootstrap token to enroll a new
+// node.
+type RegisterRequest struct {
+	Hostname        string `json:"hostname"`
 	AgentVersion    string `json:"agent_version,omitempty"`
 	XrayCoreVersion string `json:"xray_core_version,omitempty"`
+	OS              string `json:"os"`
+	Arch            string `json:"arch"`
+}
+
+// RegisterResponse carries the permanent identity the panel assigned.
+type RegisterResponse struct {
+	ServerSlug string `json:"server_slug"`
+	Token      string `json:"token"`
+}
+
+type HeartbeatPush struct {
+	OK              bool          `json:"ok"`
+	AgentVersion    string        `json:"agent_version,omitempty"`
+	XrayCoreVersion string        `json:"xray_core_version,omitempty"`
+	Capabilities    *Capabilities `json:"capabilities,omitempty"`
+	// ClockSkewMs is the local clock minus the panel's, measured from the
+	// Date header of its responses; absent until one carried it.
+	ClockSkewMs *int64 `json:"clock_skew_ms,omitempty"`
+	// NodeStatus is only sent with control.heartbeat_format v1.
+	*NodeStatus
+}
+
+// ReportPush bundles one interval's heartbeat, stats and metrics in a single
+// request, for panels that enable the combined_report feature. Stats and
+// Metrics are left out when there is nothing to send.
+type ReportPush struct {
+	Heartbeat HeartbeatPush     `json:"heartbeat"`
+	Stats     *StatsPush        `json:"stats,omitempty"`
+	Metrics   *ServerMetricPush `json:"metrics,omitempty"`
+}
+
+// Capabilities tell the panel what the agent can apply, so it can leave out
+// state sections a node would ignore.
+type Capabilities struct {
+	OS   string `json:"os"`
+	Arch string `json:"arch"`
+	// Backend is the proxy core the agent drives: xray or sing-box.
+	Backend string `json:"backend"`
+	// Protocols are the client protos the agent can provision.
+	Protocols []string `json:"protocols"`
+	// Features are the optional state sections the agent applies.
+	Features []string `json:"features"`
+}
+
+const (
+	NodeStatusOK       = "ok"
+	NodeStatusDegraded = "degraded"
+	NodeStatusError    = "error"
+)
+
+// NodeStatus summarizes agent health for the v1 heartbeat body.
+type NodeStatus struct {
+	Format        string `json:"format"`
+	Status        string `json:"status"`
+	ConfigVersion int64  `json:"config_version"`
+	// Clients is the number of clients of that version.
+	Clients int `json:"clients"`
+	// Xray is how the agent sees the local xray-core; nil before it is known.
+	Xray *XrayStatus `json:"xray,omitempty"`
+	// Features are the state's feature flags as decided for this node.
+	Features map[string]bool `json:"features,omitempty"`
+	// Routes is the outcome of each route rule of that version.
+	Routes     []RouteResult              `json:"routes,omitempty"`
+	StartedAt  time.Time                  `json:"started_at"`
+	UptimeSec  int64                      `json:"uptime_sec"`
+	Subsystems map[string]SubsystemStatus `json:"subsystems,omitempty"`
+	Timers     map[string]int             `json:"timers,omitempty"`
+	// Storage is set while local writes fail because the filesystem is
+	// read-only or full.
+	Storage *StorageStatus `json:"storage,omitempty"`
+	// Network is the last network check; nil before one ran.
+	Network *NetworkStatus `json:"network,omitempty"`
+	// BandwidthCap is set with bandwidth_cap.enabled once traffic was
+	// counted.
+	BandwidthCap *BandwidthCapStatus `json:"bandwidth_cap,omitempty"`
+	// Usage is the node's usage per UTC day and month, without the users.
+	Usage *UsageRollups `json:"usage,omitempty"`
+}
+
+// UsageRollups are the usage the agent read from the core in the current
+// and previous UTC day and month.
+type UsageRollups struct {
+	Today     UsageTotals `json:"today"`
+	Yesterday UsageTotals `json:"yesterday"`
+	Month     UsageTotals `json:"month"`
+	LastMonth UsageTotals `json:"last_month"`
+}
+
+// UsageTotals is the usage of one day (2006-01-02) or month (2006-01).
+// Users, busiest first, is only served by the local admin API.
+type UsageTotals struct {
+	Period   string       `json:"period"`
+	Uplink   int64        `json:"uplink"`
+	Downlink int64        `json:"downlink"`
+	Users    []UsageTotal `json:"users,omitempty"`
+}
+
+type UsageTotal struct {
+	Email    string `json:"email"`
+	Uplink   int64  `json:"uplink"`
+	Downlink int64  `json:"downlink"`
+}
+
+// BandwidthCapStatus is the node's traffic in the current billing period
+// against its cap.
+type BandwidthCapStatus struct {
+	PeriodStart time.Time `json:"period_start"`
+	ResetAt     time.Time `json:"reset_at"`
+	// UsedBytes counts the configured direction; SentBytes and RecvBytes
+	// are both directions.
+	UsedBytes  uint64     `json:"used_bytes"`
+	LimitBytes uint64     `json:"limit_bytes"`
+	SentBytes  uint64     `json:"sent_bytes"`
+	RecvBytes  uint64     `json:"recv_bytes"`
+	CappedAt   *time.Time `json:"capped_at,omitempty"`
+}
+
+// NetworkStatus is the node's public addressing, for panels that generate
+// dual-stack client configs. An address is empty when the node reaches the
+// internet from a private one (behind NAT) or not at all over that family.
+type NetworkStatus struct {
+	PublicIPv4 string `json:"public_ipv4,omitempty"`
+	PublicIPv6 string `json:"public_ipv6,omitempty"`
+	// IPv6Egress is set when a TCP connection to metrics.ipv6_probe over
+	// IPv6 succeeded.
+	IPv6Egress bool      `json:"ipv6_egress"`
+	CheckedAt  time.Time `json:"checked_at"`
+}
+
+const (
+	XrayRunning     = "running"
+	XrayUnreachable = "unreachable"
+)
+
+// XrayStatus reports whether xray-core's API answers.
+type XrayStatus struct {
+	State string `json:"state"`
+	Error string `json:"error,omitempty"`
+}
+
+// StorageStatus reports a storage condition that keeps the agent from
+// persisting local state. Syncing continues from memory meanwhile.
+type StorageStatus struct {
+	Condition string    `json:"condition"`
+	Path      string    `json:"path"`
+	Error     string    `json:"error"`
+	Since     time.Time `json:"since"`
+}
+
+type SubsystemStatus struct {
+	Status              string     `json:"status"`
+	LastSuccessAt       *time.Time `json:"last_success_at,omitempty"`
+	LastErrorAt         *time.Time `json:"last_error_at,omitempty"`
+	LastError           string     `json:"last_error,omitempty"`
+	ConsecutiveFailures int        `json:"consecutive_failures,omitempty"`
+}
+
+// AdminStatus is the local admin API's view of the agent, served at
+// GET /v1/status for `xray-agent top`.
+type AdminStatus struct {
+	*NodeStatus
+	Users int `json:"users"`
+	// ActiveUsers moved traffic since the previous sample.
+	ActiveUsers int `json:"active_users"`
+	// SampleSec is the window Throughput was measured over; zero on the first
+	// sample after the agent started.
+	SampleSec  float64          `json:"sample_sec"`
+	Throughput []UserThroughput `json:"throughput,omitempty"`
+	// Events are the latest agent log records, oldest first.
+	Events []LogEntry `json:"events,omitempty"`
+}
+
+// AdminClient is an applied client as listed by the local admin API at
+// GET /v1/clients; credentials are left out.
+type AdminClient struct {
+	Email      string `json:"email"`
+	Proto      string `json:"proto"`
+	InboundTag string `json:"inbound_tag,omitempty"`
+	Flow       string `json:"flow,omitempty"`
+	Level      uint32 `json:"level,omitempty"`
+}
+
+// AdminSyncResult answers POST /v1/sync on the local admin API.
+type AdminSyncResult struct {
+	// ConfigVersion is the state version applied after the sync.
+	ConfigVersion int64 `json:"config_version"`
+	Clients       int   `json:"clients"`
+	Routes        int   `json:"routes"`
+}
+
+// UserThroughput is one user's traffic rate over the last sample.
+type UserThroughput struct {
+	Email            string `json:"email"`
+	UplinkBytesSec   int64  `json:"uplink_bytes_sec"`
+	DownlinkBytesSec int64  `json:"downlink_bytes_sec"`
+}
+
+// LogsPush carries buffered warn/error agent log records.
+type LogsPush struct {
+	ServerTime time.Time  `json:"server_time"`
+	Dropped    int        `json:"dropped,omitempty"`
+	Entries    []LogEntry `json:"entries"`
+}
+
+type LogEntry struct {
+	Time    time.Time         `json:"time"`
+	Level   string            `json:"level"`
+	Message string            `json:"message"`
+	Attrs   map[string]string `json:"attrs,omitempty"`
+}
+
+// AgentEvent is one entry of a node's activity feed on the panel.
+type AgentEvent struct {
+	Time time.Time `json:"time"`
+	Type string    `json:"type"`
+	// Severity is info, warn or error.
+	Severity string            `json:"severity"`
+	Message  string            `json:"message"`
+	Attrs    map[string]string `json:"attrs,omitempty"`
+}
+
+// Event types and severities of an AgentEvent.
+const (
+	EventSyncApplied     = "sync_applied"
+	EventSyncFailed      = "sync_failed"
+	EventCoreUpdated     = "core_updated"
+	EventCoreCrashed     = "core_crashed"
+	EventStorageFull     = "storage_full"
+	EventStorageReadOnly = "storage_read_only"
+	EventAlert           = "alert"
+	EventAlertResolved   = "alert_resolved"
+	EventBandwidthCapped = "bandwidth_capped"
+	EventBandwidthLifted = "bandwidth_cap_lifted"
+
+	SeverityInfo  = "info"
+	SeverityWarn  = "warn"
+	SeverityError = "error"
+)
+
+// DriftReport lists where the running core differs from the applied state,
+// as found by the periodic reconcile. An empty report clears earlier drift.
+type DriftReport struct {
+	ServerTime    time.Time   `json:"server_time"`
+	ConfigVersion int64       `json:"config_version"`
+	Users         []DriftItem `json:"users"`
+	Routes        []DriftItem `json:"routes"`
+}
+
+// DriftItem is one user or route rule that differs between the state and
+// the core.
+type DriftItem struct {
+	// Subject is the user's email or the rule tag.
+	Subject string `json:"subject"`
+	Inbound string `json:"inbound,omitempty"`
+	// Status is DriftMissing, DriftExtra or DriftOutboundMismatch.
+	Status string `json:"status"`
+	// Outbound is where the core's rule sends traffic, for route rules.
+	Outbound string `json:"outbound,omitempty"`
+	// Repaired is set when the agent added a missing item back.
+	Repaired bool `json:"repaired,omitempty"`
+}
+
+// Statuses of a DriftItem.
+const (
+	// DriftMissing items were applied but are not in the core.
+	DriftMissing = "missing"
+	// DriftExtra items are in the core but not in the state, e.g. added by
+	// hand or from the static xray config.
+	DriftExtra = "extra"
+	// DriftOutboundMismatch rules send traffic to another outbound.
+	DriftOutboundMismatch = "outbound_mismatch"
+)
+
+// AuditPush carries audit entries to the panel; see AuditEntry.
+type AuditPush struct {
+	ServerTime time.Time    `json:"server_time"`
+	Dropped    int          `json:"dropped,omitempty"`
+	Entries    []AuditEntry `json:"entries"`
+}
+
+// AuditEntry is one user, route or outbound change applied to the core.
+type AuditEntry struct {
+	Time time.Time `json:"time"`
+	// Source is what made the agent apply the change: "state" for a state
+	// sync, "reapply" when xray lost its runtime state and everything was
+	// added again, "abuse" and "ban" for the agent's temporary abuse blocks
+	// and source bans.
+	Source        string `json:"source"`
+	ConfigVersion int64  `json:"config_version,omitempty"`
+	// Kind is user, route or outbound; Action is add, remove, update or
+	// move (a user added on another inbound).
+	Kind    string `json:"kind"`
+	Action  string `json:"action"`
+	Subject string `json:"subject"`
+	Inbound string `json:"inbound,omitempty"`
+	// Result is ok or failed, with the reason in Error.
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
 }
 
 type ServerMetricPush struct {
@@ -68,12 +642,149 @@ type ServerMetricPush struct {
 	BandwidthDownMbps *float64      `json:"bandwidth_down_mbps,omitempty"`
 	BandwidthUpMbps   *float64      `json:"bandwidth_up_mbps,omitempty"`
 	XraySysStats      *XraySysStats `json:"xray_sys_stats,omitempty"`
+	// Connections counts established TCP connections by inbound tag.
+	Connections map[string]int `json:"connections,omitempty"`
+	Disks       []DiskUsage    `json:"disks,omitempty"`
+	LoadAverage *LoadAverage   `json:"load_average,omitempty"`
+	Network     *NetworkStatus `json:"network,omitempty"`
+	// Aggregate is set on samples that summarize a period the panel could
+	// not be reached. The top-level values are then the averages and the
+	// other fields the last sample of the period.
+	Aggregate *MetricAggregate `json:"aggregate,omitempty"`
+}
+
+// MetricAggregate summarizes the samples taken between From and To.
+type MetricAggregate struct {
+	From              time.Time  `json:"from"`
+	To                time.Time  `json:"to"`
+	Samples           int        `json:"samples"`
+	CPUPercent        *MinAvgMax `json:"cpu_percent,omitempty"`
+	MemoryPercent     *MinAvgMax `json:"memory_percent,omitempty"`
+	BandwidthDownMbps *MinAvgMax `json:"bandwidth_down_mbps,omitempty"`
+	BandwidthUpMbps   *MinAvgMax `json:"bandwidth_up_mbps,omitempty"`
+}
+
+type MinAvgMax struct {
+	Min float64 `json:"min"`
+	Avg float64 `json:"avg"`
+	Max float64 `json:"max"`
+}
+
+// DiskUsage is the usage of the filesystem that holds Path.
+type DiskUsage struct {
+	Path        string  `json:"path"`
+	UsedPercent float64 `json:"used_percent"`
+	TotalBytes  uint64  `json:"total_bytes"`
+	FreeBytes   uint64  `json:"free_bytes"`
+}
+
+// LoadAverage is the 1, 5 and 15 minute system load average.
+type LoadAverage struct {
+	Load1  float64 `json:"load1"`
+	Load5  float64 `json:"load5"`
+	Load15 float64 `json:"load15"`
 }
 
 type UserUsage struct {
 	Email    string `json:"email"`
 	Uplink   int64  `json:"uplink"`
 	Downlink int64  `json:"downlink"`
+	// TotalUplink and TotalDownlink are the usage delivered to the panel
+	// since the agent started tracking the user, this push included. They
+	// are only set on checkpoint pushes.
+	TotalUplink   *int64 `json:"total_uplink,omitempty"`
+	TotalDownlink *int64 `json:"total_downlink,omitempty"`
+	// IPs are the source addresses the user is online from when the push
+	// is collected, for device counts and geo display.
+	IPs []string `json:"ips,omitempty"`
+	// IPGeo is the country and AS of the IPs, by address, when geoip is
+	// enabled. Addresses the agent could not resolve are left out.
+	IPGeo map[string]GeoInfo `json:"ip_geo,omitempty"`
+}
+
+// AccessLogPush summarizes the xray access log between From and To.
+type AccessLogPush struct {
+	ServerTime time.Time       `json:"server_time"`
+	From       time.Time       `json:"from"`
+	To         time.Time       `json:"to"`
+	Users      []AccessLogUser `json:"users,omitempty"`
+	// Rejections are connections xray refused before a user was known,
+	// such as probes and clients with a wrong id.
+	Rejections []AccessLogRejection `json:"rejections,omitempty"`
+}
+
+type AccessLogUser struct {
+	Email       string `json:"email"`
+	Connections int    `json:"connections"`
+	// Sources is the number of distinct client addresses.
+	Sources int `json:"sources"`
+	// Destinations are the most connected-to hosts, busiest first, as the
+	// access_log.destinations privacy setting allows.
+	Destinations []AccessLogDestination `json:"destinations,omitempty"`
+}
+
+type AccessLogDestination struct {
+	Host        string `json:"host"`
+	Connections int    `json:"connections"`
+}
+
+type AccessLogRejection struct {
+	// Source is the client address as access_log.sources allows; empty
+	// when sources are not reported.
+	Source string `json:"source,omitempty"`
+	Reason string `json:"reason"`
+	Count  int    `json:"count"`
+}
+
+// Abuse kinds.
+const (
+	AbuseTorrentPort     = "torrent_port"
+	AbuseBlockedOutbound = "blocked_outbound"
+	AbuseConnectionChurn = "connection_churn"
+)
+
+// AbusePush lists the users that showed abuse patterns between From and To.
+type AbusePush struct {
+	ServerTime time.Time        `json:"server_time"`
+	From       time.Time        `json:"from"`
+	To         time.Time        `json:"to"`
+	Violations []AbuseViolation `json:"violations"`
+}
+
+type AbuseViolation struct {
+	Email string `json:"email"`
+	Kind  string `json:"kind"`
+	// Count is the number of offending connections; for connection_churn
+	// the most new connections seen in one minute.
+	Count int `json:"count"`
+	// Example is the first offending destination as host:port; empty for
+	// connection_churn.
+	Example string `json:"example,omitempty"`
+	// BlockedUntil is set when the agent routes the user's traffic to the
+	// block outbound because of this or an earlier violation.
+	BlockedUntil *time.Time `json:"blocked_until,omitempty"`
+}
+
+// BanPush reports the client addresses the agent banned and the bans it
+// lifted since the last accepted push.
+type BanPush struct {
+	ServerTime time.Time   `json:"server_time"`
+	Banned     []SourceBan `json:"banned,omitempty"`
+	Lifted     []SourceBan `json:"lifted,omitempty"`
+	// Active is the number of addresses banned now.
+	Active int `json:"active"`
+}
+
+type SourceBan struct {
+	Address string `json:"address"`
+	// Failures is the number of rejected connections that led to the ban.
+	Failures int `json:"failures"`
+	// Reason is why xray rejected the last of them.
+	Reason string `json:"reason,omitempty"`
+	// Method is nftables or xray.
+	Method   string    `json:"method"`
+	BannedAt time.Time `json:"banned_at"`
+	Until    time.Time `json:"until"`
 }
 
 type OnlineUserInfo struct {
@@ -85,6 +796,21 @@ type OnlineUserInfo struct {
 type OnlineUserIP struct {
 	Address    string    `json:"address"`
 	LastSeenAt time.Time `json:"last_seen_at"`
+	GeoInfo
+}
+
+// GeoInfo is where a client address is, as the agent's geoip files place
+// it. Fields the files do not have are empty.
+type GeoInfo struct {
+	// Country is the ISO 3166-1 alpha-2 code, upper case.
+	Country string `json:"country,omitempty"`
+	ASN     uint32 `json:"asn,omitempty"`
+	ASOrg   string `json:"as_org,omitempty"`
+}
+
+// IsZero reports whether nothing is known about the address.
+func (g GeoInfo) IsZero() bool {
+	return g == GeoInfo{}
 }
 
 type RouteRule struct {
@@ -97,6 +823,20 @@ type RouteRule struct {
 	SourcePort  string   `json:"source_port,omitempty"`
 	InboundTag  []string `json:"inbound_tag,omitempty"`
 	Protocol    []string `json:"protocol,omitempty"`
+	// User matches the emails of the clients the traffic belongs to, e.g. to
+	// send some users through a dedicated outbound.
+	User []string `json:"user,omitempty"`
+	// Network is "tcp", "udp" or "tcp,udp".
+	Network string `json:"network,omitempty"`
+	// Source matches client addresses: CIDRs, IPs or geoip: entries.
+	Source []string `json:"source,omitempty"`
+	// Attrs matches sniffed HTTP attributes such as ":method" or ":path";
+	// values are regular expressions.
+	Attrs map[string]string `json:"attrs,omitempty"`
+	// Unsupported lists the matcher keys the panel sent that the agent does
+	// not know. Such a rule is skipped, since applying it without them would
+	// match more traffic than intended.
+	Unsupported []string `json:"-"`
 }
 
 type XraySysStats struct {
@@ -111,3 +851,17 @@ type XraySysStats struct {
 	PauseTotalNs uint64 `json:"pause_total_ns"`
 	Uptime       uint32 `json:"uptime"`
 }
+
+// SpeedtestResult is posted when a SPEEDTEST command finishes. A direction
+// that failed has no Mbps and its error in Error.
+type SpeedtestResult struct {
+	CommandID     string    `json:"command_id"`
+	StartedAt     time.Time `json:"started_at"`
+	FinishedAt    time.Time `json:"finished_at"`
+	LatencyMs     *float64  `json:"latency_ms,omitempty"`
+	DownloadMbps  *float64  `json:"download_mbps,omitempty"`
+	UploadMbps    *float64  `json:"upload_mbps,omitempty"`
+	DownloadBytes int64     `json:"download_bytes"`
+	UploadBytes   int64     `json:"upload_bytes"`
+	Error         string    `json:"error,omitempty"`
+}
@@ -25,3 +25,31 @@ func TestStateJSONRoundTrip(t *testing.T) {
 		t.Fatalf("round trip mismatch: %+v", decoded)
 	}
 }
+
+func TestWithInboundTags(t *testing.T) {
+	clients := []Client{
+		{Proto: "vless", Email: "a@example.com"},
+		{Proto: "vless", Email: "b@example.com", InboundTag: "vless-reality"},
+		{Proto: "trojan", Email: "c@example.com"},
+	}
+	got := WithInboundTags(clients, map[string]string{"vless": "vless-grpc"})
+	if got[0].InboundTag != "vless-grpc" || got[1].InboundTag != "vless-reality" || got[2].InboundTag != "" {
+		t.Fatalf("unexpected tags: %+v", got)
+	}
+	if clients[0].InboundTag != "" {
+		t.Fatal("input clients were modified")
+	}
+}
+
+func TestFeatureFlagAcceptsBoolOrPercent(t *testing.T) {
+	var ds State
+	if err := json.Unmarshal([]byte(`{"features": {"on": true, "off": false, "canary": {"percent": 12.5}}}`), &ds); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if ds.Features["on"].Percent != 100 || ds.Features["off"].Percent != 0 || ds.Features["canary"].Percent != 12.5 {
+		t.Fatalf("features = %+v", ds.Features)
+	}
+	if err := json.Unmarshal([]byte(`{"features": {"bad": "yes"}}`), &ds); err == nil {
+		t.Fatal("expected an error for a string flag")
+	}
+}
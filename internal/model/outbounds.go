@@ -0,0 +1,103 @@
+package model
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+)
+
+// outboundProtocols are the outbound protocols the agent can build.
+var outboundProtocols = []string{"vless", "vmess", "trojan", "shadowsocks", "socks", "http", "freedom", "blackhole"}
+
+// Outbound is an outbound the agent adds to xray through HandlerService, e.g.
+// a relay to another node that route rules send traffic to.
+type Outbound struct {
+	Tag      string `json:"tag"`
+	Protocol string `json:"protocol"`
+	// Server is the remote end; freedom and blackhole have none.
+	Server    *OutboundServer    `json:"server,omitempty"`
+	Transport *OutboundTransport `json:"transport,omitempty"`
+	// ProxyTag dials the server through another outbound, chaining proxies.
+	ProxyTag string `json:"proxy_tag,omitempty"`
+}
+
+// OutboundServer is the address and credentials of an outbound's remote end.
+type OutboundServer struct {
+	Address string `json:"address"`
+	Port    int    `json:"port"`
+	// ID is the UUID for vless and vmess.
+	ID   string `json:"id,omitempty"`
+	Flow string `json:"flow,omitempty"`
+	// Password is used by trojan, shadowsocks, and socks and http with User.
+	Password string `json:"password,omitempty"`
+	User     string `json:"user,omitempty"`
+	// Method is the shadowsocks cipher.
+	Method string `json:"method,omitempty"`
+}
+
+// OutboundTransport is the subset of xray's streamSettings the panel can set.
+type OutboundTransport struct {
+	// Network is tcp (the default), ws, grpc, httpupgrade or xhttp.
+	Network string `json:"network,omitempty"`
+	// Security is none (the default), tls or reality.
+	Security    string   `json:"security,omitempty"`
+	ServerName  string   `json:"server_name,omitempty"`
+	Fingerprint string   `json:"fingerprint,omitempty"`
+	ALPN        []string `json:"alpn,omitempty"`
+	// PublicKey and ShortID are the REALITY parameters of the server.
+	PublicKey string `json:"public_key,omitempty"`
+	ShortID   string `json:"short_id,omitempty"`
+	// Path and Host apply to ws, httpupgrade and xhttp.
+	Path string `json:"path,omitempty"`
+	Host string `json:"host,omitempty"`
+	// ServiceName applies to grpc.
+	ServiceName string `json:"service_name,omitempty"`
+}
+
+// Validate checks what xray would otherwise only reject when the outbound
+// is added.
+func (o Outbound) Validate() error {
+	if o.Tag == "" {
+		return fmt.Errorf("outbound tag required")
+	}
+	if !slices.Contains(outboundProtocols, o.Protocol) {
+		return fmt.Errorf("outbound %s: unsupported protocol %q", o.Tag, o.Protocol)
+	}
+	if t := o.Transport; t != nil {
+		if !slices.Contains([]string{"", "tcp", "ws", "grpc", "httpupgrade", "xhttp"}, t.Network) {
+			return fmt.Errorf("outbound %s: unsupported network %q", o.Tag, t.Network)
+		}
+		if !slices.Contains([]string{"", "none", "tls", "reality"}, t.Security) {
+			return fmt.Errorf("outbound %s: unsupported security %q", o.Tag, t.Security)
+		}
+	}
+	if o.ProxyTag == o.Tag {
+		return fmt.Errorf("outbound %s: proxy_tag points at itself", o.Tag)
+	}
+	if o.Protocol == "freedom" || o.Protocol == "blackhole" {
+		return nil
+	}
+	if o.Server == nil || o.Server.Address == "" || o.Server.Port <= 0 || o.Server.Port > 65535 {
+		return fmt.Errorf("outbound %s: server address and port required", o.Tag)
+	}
+	switch o.Protocol {
+	case "vless", "vmess":
+		if o.Server.ID == "" {
+			return fmt.Errorf("outbound %s: server id required", o.Tag)
+		}
+	case "trojan":
+		if o.Server.Password == "" {
+			return fmt.Errorf("outbound %s: server password required", o.Tag)
+		}
+	case "shadowsocks":
+		if o.Server.Password == "" || o.Server.Method == "" {
+			return fmt.Errorf("outbound %s: server method and password required", o.Tag)
+		}
+	}
+	return nil
+}
+
+// Equal compares two outbounds field by field.
+func (o Outbound) Equal(p Outbound) bool {
+	return reflect.DeepEqual(o, p)
+}
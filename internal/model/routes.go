@@ -1,6 +1,60 @@
 package model
 
-import "slices"
+import (
+	"encoding/json"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// Route application results reported per rule in the v1 heartbeat.
+const (
+	RouteApplied = "applied"
+	RouteFailed  = "failed"
+	RouteSkipped = "skipped"
+)
+
+// RouteResult is the outcome of applying one route rule of the state.
+type RouteResult struct {
+	Tag    string `json:"tag"`
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// routeRuleKeys are the JSON keys RouteRule decodes.
+var routeRuleKeys = func() map[string]bool {
+	keys := map[string]bool{}
+	t := reflect.TypeFor[RouteRule]()
+	for i := range t.NumField() {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			keys[name] = true
+		}
+	}
+	return keys
+}()
+
+// UnmarshalJSON decodes a rule and records unknown keys in Unsupported.
+func (r *RouteRule) UnmarshalJSON(data []byte) error {
+	type plain RouteRule
+	var rule plain
+	if err := json.Unmarshal(data, &rule); err != nil {
+		return err
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	rule.Unsupported = nil
+	for key, value := range raw {
+		if !routeRuleKeys[key] && string(value) != "null" {
+			rule.Unsupported = append(rule.Unsupported, key)
+		}
+	}
+	slices.Sort(rule.Unsupported)
+	*r = RouteRule(rule)
+	return nil
+}
 
 // NormalizeRouteRules deduplicates route tags using last-write-wins semantics.
 // This matches how the agent state store snapshots routes by tag.
@@ -1,6 +1,7 @@
 package model
 
 import (
+	"encoding/json"
 	"reflect"
 	"testing"
 )
@@ -29,3 +30,18 @@ func TestNormalizeRouteRulesKeepsLastOccurrence(t *testing.T) {
 		t.Fatalf("duplicate tags mismatch: got %#v want %#v", duplicateTags, wantDuplicateTags)
 	}
 }
+
+func TestRouteRuleRecordsUnsupportedMatchers(t *testing.T) {
+	t.Parallel()
+
+	var rule RouteRule
+	if err := json.Unmarshal([]byte(`{"tag":"r","outbound_tag":"direct","ip":["1.1.1.1"],"network":"udp","process":["curl"],"attrs":null}`), &rule); err != nil {
+		t.Fatal(err)
+	}
+	if rule.Tag != "r" || len(rule.IP) != 1 || rule.Network != "udp" {
+		t.Fatalf("known fields lost: %+v", rule)
+	}
+	if want := []string{"process"}; !reflect.DeepEqual(rule.Unsupported, want) {
+		t.Fatalf("Unsupported = %v, want %v", rule.Unsupported, want)
+	}
+}
@@ -0,0 +1,271 @@
+// Package privsep supports running the agent as an unprivileged user: it
+// lists the paths the agent writes, hands the agent's own paths over to the
+// service user at setup, and checks at startup which configured features
+// still need root.
+package privsep
+
+import (
+	"bufio"
+	"cmp"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/najahiiii/xray-agent/internal/acme"
+	"github.com/najahiiii/xray-agent/internal/config"
+	"github.com/najahiiii/xray-agent/internal/xraycore"
+)
+
+// DefaultUser is the account `setup --user` creates when none is named.
+const DefaultUser = "xray-agent"
+
+// Path is a file or directory the agent writes while running. Settings that
+// name a file the agent replaces or rotates list its directory.
+type Path struct {
+	// Setting is the config key that names the path.
+	Setting string
+	Path    string
+	// Owned paths belong to the agent alone, so setup gives them to the
+	// service user. The rest are shared with xray-core or the system.
+	Owned bool
+	// Feature is what stops working when Path is not writable.
+	Feature string
+}
+
+// systemDirs are never handed to the service user, even when a setting
+// puts an agent file directly inside one.
+var systemDirs = map[string]bool{
+	"/": true, "/etc": true, "/run": true, "/tmp": true, "/usr": true, "/usr/bin": true,
+	"/usr/local": true, "/usr/local/bin": true, "/usr/local/etc": true, "/usr/local/share": true,
+	"/usr/share": true, "/var": true, "/var/cache": true, "/var/lib": true, "/var/log": true,
+}
+
+// agentDirs are the directories the agent lays out by default. Setup hands
+// them over with what is already in them, which an agent that ran as root
+// before left there.
+var agentDirs = []string{
+	config.DefaultStorageDir, config.DefaultAssetCacheDir, filepath.Dir(config.DefaultAuditFile),
+	filepath.Dir(config.DefaultXrayConfigPath), config.DefaultCertificatesDir,
+}
+
+// Paths returns what the agent writes with cfg.
+func Paths(cfg *config.Config) []Path {
+	xray := xraycore.AgentLayout(xraycore.Options{
+		Init:        cfg.Service.Init,
+		BinDir:      cfg.Xray.Install.BinDir,
+		ConfigPath:  cmp.Or(cfg.Xray.Install.ConfigPath, cfg.Service.XrayConfig),
+		ShareDir:    cfg.Xray.Install.ShareDir,
+		ServicePath: cfg.Xray.Install.ServicePath,
+	})
+	paths := []Path{
+		{Setting: "storage.dir", Path: cfg.Storage.Dir, Owned: true, Feature: "state, counters and the instance lock"},
+	}
+	if cfg.Storage.AssetCacheKeep >= 0 && cfg.Storage.AssetCacheDir != "" {
+		paths = append(paths, Path{Setting: "storage.asset_cache_dir", Path: cfg.Storage.AssetCacheDir, Owned: true, Feature: "the release zip cache"})
+	}
+	if cfg.Logging.File != "" && (cfg.Logging.Output == "" || cfg.Logging.Output == "file") {
+		paths = append(paths, Path{Setting: "logging.file", Path: filepath.Dir(cfg.Logging.File), Owned: true, Feature: "the log file and its rotation"})
+	}
+	if cfg.Audit.Enabled {
+		paths = append(paths, Path{Setting: "audit.file", Path: filepath.Dir(cfg.Audit.File), Owned: true, Feature: "the audit log"})
+	}
+	if cfg.UsageHistory.Enabled {
+		paths = append(paths, Path{Setting: "usage_history.dir", Path: cfg.UsageHistory.Dir, Owned: true, Feature: "the usage history"})
+	}
+	if cfg.Admin.Socket != "" && cfg.Admin.Socket != config.AdminSocketNone {
+		paths = append(paths, Path{Setting: "admin.socket", Path: filepath.Dir(cfg.Admin.Socket), Feature: "the admin API used by top, clients and sync"})
+	}
+	if cfg.Certificates.Dir != "" {
+		paths = append(paths, Path{Setting: "certificates.dir", Path: cfg.Certificates.Dir, Owned: true, Feature: "certificates from the panel and ACME"})
+	}
+	if xray.Config != "" {
+		paths = append(paths, Path{Setting: "xray.install.config_path", Path: filepath.Dir(xray.Config), Owned: true, Feature: "changes saved to the xray config"})
+	}
+	if xray.Binary != "" {
+		paths = append(paths, Path{Setting: "xray.install.bin_dir", Path: filepath.Dir(xray.Binary), Feature: "xray-core installs and updates"})
+	}
+	if dir := cfg.Xray.Install.VersionsDir; dir != "" {
+		paths = append(paths, Path{Setting: "xray.install.versions_dir", Path: dir, Feature: "xray-core installs and rollbacks"})
+	}
+	if xray.ShareDir != "" {
+		paths = append(paths, Path{Setting: "xray.install.share_dir", Path: xray.ShareDir, Feature: "geodata updates"})
+	}
+	if xray.Service != "" {
+		paths = append(paths, Path{Setting: "xray.install.service_path", Path: xray.Service, Feature: "xray service limit updates"})
+	}
+	return paths
+}
+
+// Problem is a configured feature the current user cannot use.
+type Problem struct {
+	Setting string
+	Path    string
+	Feature string
+	// Fix is what to change, for the log line.
+	Fix string
+}
+
+// Check returns the paths the current user cannot write and the
+// capabilities configured features lack: CAP_NET_BIND_SERVICE when ACME
+// answers challenges itself on a privileged port, CAP_NET_ADMIN for nftables
+// source bans. Root has no problems.
+func Check(cfg *config.Config, paths []Path) []Problem {
+	if os.Geteuid() == 0 {
+		return nil
+	}
+	var problems []Problem
+	for _, p := range paths {
+		if writable(p.Path) {
+			continue
+		}
+		fix := fmt.Sprintf("point %s at a path uid %d can write, or run the agent as root", p.Setting, os.Geteuid())
+		switch {
+		case p.Owned && claimable(p.Path, os.Geteuid()):
+			fix = fmt.Sprintf("run `xray-agent setup --user %s` as root to hand it to the service user", cmp.Or(cfg.Service.User, DefaultUser))
+		case p.Setting == "admin.socket":
+			fix = "set RuntimeDirectory=xray-agent in the unit, or move admin.socket under storage.dir"
+		}
+		problems = append(problems, Problem{Setting: p.Setting, Path: p.Path, Feature: p.Feature, Fix: fix})
+	}
+	addr := cmp.Or(cfg.ACME.HTTPAddr, acme.DefaultHTTPAddr)
+	if cfg.ACME.Enabled && cfg.ACME.Webroot == "" && privilegedPort(addr) && !hasCapability(capNetBindService) {
+		problems = append(problems, Problem{
+			Setting: "acme.http_addr",
+			Path:    addr,
+			Feature: "ACME HTTP-01 challenges",
+			Fix:     "add AmbientCapabilities=CAP_NET_BIND_SERVICE to the unit, or set acme.webroot",
+		})
+	}
+	if cfg.Ban.Enabled && cfg.Ban.Method == config.BanNFTables && !hasCapability(capNetAdmin) {
+		problems = append(problems, Problem{
+			Setting: "ban.method",
+			Path:    "nftables table " + cfg.Ban.NFTTable,
+			Feature: "source bans",
+			Fix:     "add AmbientCapabilities=CAP_NET_ADMIN to the unit, or set ban.method: xray",
+		})
+	}
+	return problems
+}
+
+// Prepare creates the owned paths and gives them, with everything already
+// in them, to uid and gid. It returns the owned paths it left alone because
+// they may hold files the agent did not create; see claimable.
+func Prepare(paths []Path, uid, gid int) ([]Path, error) {
+	var skipped []Path
+	for _, p := range paths {
+		if !p.Owned {
+			continue
+		}
+		if !claimable(p.Path, uid) {
+			skipped = append(skipped, p)
+			continue
+		}
+		if err := os.MkdirAll(p.Path, 0o755); err != nil {
+			return skipped, fmt.Errorf("%s: %w", p.Setting, err)
+		}
+		err := filepath.WalkDir(p.Path, func(path string, _ fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			return os.Lchown(path, uid, gid)
+		})
+		if err != nil {
+			return skipped, fmt.Errorf("%s: chown: %w", p.Setting, err)
+		}
+	}
+	return skipped, nil
+}
+
+// claimable reports whether path can be handed to uid with everything in
+// it: it is one of agentDirs or a directory named xray-agent, does not exist
+// yet, is empty, or already belongs to uid. Anything else, like /opt for a
+// logging.file of /opt/agent.log, may hold files that are not the agent's.
+func claimable(path string, uid int) bool {
+	path = filepath.Clean(path)
+	if systemDirs[path] {
+		return false
+	}
+	if filepath.Base(path) == "xray-agent" {
+		return true
+	}
+	for _, dir := range agentDirs {
+		if path == dir || strings.HasPrefix(path, dir+"/") {
+			return true
+		}
+	}
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return true
+	}
+	if err != nil || !info.IsDir() {
+		return false
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok && int(st.Uid) == uid {
+		return true
+	}
+	entries, err := os.ReadDir(path)
+	return err == nil && len(entries) == 0
+}
+
+// writable reports whether the current user can write path or, when it does
+// not exist yet, create it in its nearest existing parent.
+func writable(path string) bool {
+	for {
+		if _, err := os.Lstat(path); err == nil {
+			return syscall.Access(path, 0x2) == nil // W_OK
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return false
+		}
+		path = parent
+	}
+}
+
+func privilegedPort(addr string) bool {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	n, err := strconv.Atoi(port)
+	return err == nil && n > 0 && n < 1024
+}
+
+const (
+	capNetBindService = 10
+	capNetAdmin       = 12
+)
+
+// procStatus is read by hasCapability; overridden in tests.
+var procStatus = "/proc/self/status"
+
+// hasCapability reports whether bit cap is in the effective capability set.
+func hasCapability(cap uint) bool {
+	f, err := os.Open(procStatus)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if value, ok := strings.CutPrefix(sc.Text(), "CapEff:"); ok {
+			mask, err := strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+			return err == nil && mask&(1<<cap) != 0
+		}
+	}
+	return false
+}
+
+// DeniedHint returns advice for systemctl output showing that polkit refused
+// the agent user, or "" for other failures.
+func DeniedHint(output string) string {
+	if !strings.Contains(output, "Access denied") && !strings.Contains(output, "Interactive authentication required") {
+		return ""
+	}
+	return "the agent user may not manage this unit; run `xray-agent setup --user <user>` as root to install the polkit rule"
+}
@@ -0,0 +1,125 @@
+package privsep
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/najahiiii/xray-agent/internal/config"
+)
+
+func TestPathsAndPrepare(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &config.Config{}
+	cfg.Storage.Dir = filepath.Join(dir, "state")
+	cfg.Storage.AssetCacheKeep = -1
+	cfg.Logging.File = "/var/log/agent.log"
+	cfg.Admin.Socket = config.AdminSocketNone
+	cfg.Service.Init = "none"
+	cfg.Service.XrayConfig = filepath.Join(dir, "xray", "config.json")
+	cfg.Xray.Install.BinDir = "/usr/local/bin"
+
+	byName := map[string]Path{}
+	for _, p := range Paths(cfg) {
+		byName[p.Setting] = p
+	}
+	for setting, want := range map[string]Path{
+		"storage.dir":              {Setting: "storage.dir", Path: cfg.Storage.Dir, Owned: true},
+		"logging.file":             {Setting: "logging.file", Path: "/var/log", Owned: true},
+		"xray.install.config_path": {Setting: "xray.install.config_path", Path: filepath.Join(dir, "xray"), Owned: true},
+		"xray.install.bin_dir":     {Setting: "xray.install.bin_dir", Path: "/usr/local/bin"},
+	} {
+		got := byName[setting]
+		got.Feature = ""
+		if got != want {
+			t.Errorf("Paths()[%s] = %+v, want %+v", setting, got, want)
+		}
+	}
+	for _, setting := range []string{"storage.asset_cache_dir", "admin.socket", "xray.install.service_path"} {
+		if p, ok := byName[setting]; ok {
+			t.Errorf("unexpected path %+v", p)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, "xray"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(cfg.Service.XrayConfig, []byte("{}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	skipped, err := Prepare(Paths(cfg), os.Getuid(), os.Getgid())
+	if err != nil {
+		t.Fatalf("Prepare: %v", err)
+	}
+	if len(skipped) != 1 || skipped[0].Setting != "logging.file" {
+		t.Fatalf("skipped = %+v, want logging.file", skipped)
+	}
+	if info, err := os.Stat(cfg.Storage.Dir); err != nil || !info.IsDir() {
+		t.Fatalf("storage.dir not created: %v", err)
+	}
+}
+
+func TestPrepareLeavesSharedDirectories(t *testing.T) {
+	dir := t.TempDir()
+	shared := filepath.Join(dir, "opt")
+	empty := filepath.Join(dir, "empty")
+	for _, d := range []string{shared, empty} {
+		if err := os.Mkdir(d, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(shared, "other"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// Owned by someone else, as /opt is by root, and not empty.
+	uid := os.Getuid() + 1
+	paths := []Path{
+		{Setting: "logging.file", Path: shared, Owned: true},
+		{Setting: "audit.file", Path: empty, Owned: true},
+		{Setting: "storage.dir", Path: filepath.Join(dir, "new"), Owned: true},
+	}
+	if !claimable(empty, uid) || !claimable(paths[2].Path, uid) || !claimable(filepath.Join(shared, "xray-agent"), uid) {
+		t.Fatal("claimable refused a directory of the agent's own")
+	}
+	if claimable(shared, uid) {
+		t.Fatal("claimable accepted a directory holding other files")
+	}
+	if os.Getuid() != 0 {
+		return
+	}
+	skipped, err := Prepare(paths, uid, os.Getgid())
+	if err != nil {
+		t.Fatalf("Prepare: %v", err)
+	}
+	if len(skipped) != 1 || skipped[0].Setting != "logging.file" {
+		t.Fatalf("skipped = %+v, want logging.file", skipped)
+	}
+}
+
+func TestHasCapability(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "status")
+	old := procStatus
+	procStatus = path
+	t.Cleanup(func() { procStatus = old })
+
+	for mask, want := range map[string]bool{"0000000000000400": true, "00000000000003ff": false} {
+		if err := os.WriteFile(path, []byte("Name:\txray-agent\nCapEff:\t"+mask+"\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if got := hasCapability(capNetBindService); got != want {
+			t.Errorf("hasCapability with CapEff %s = %v, want %v", mask, got, want)
+		}
+	}
+	if !privilegedPort(":80") || privilegedPort("127.0.0.1:8080") || privilegedPort("bad") {
+		t.Error("privilegedPort misjudged a port")
+	}
+}
+
+func TestDeniedHint(t *testing.T) {
+	if DeniedHint("Failed to restart xray.service: Access denied") == "" {
+		t.Error("no hint for access denied")
+	}
+	if DeniedHint("Failed to restart xray.service: Unit xray.service not found.") != "" {
+		t.Error("hint for a missing unit")
+	}
+}
@@ -0,0 +1,32 @@
+// Package rollout decides whether a node takes part in a percentage rollout.
+// The decision only depends on the node's slug and the feature name, so every
+// agent reaches it on its own and raising the percentage only ever adds
+// nodes.
+package rollout
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// buckets is the resolution of a rollout percentage (0.01%).
+const buckets = 10000
+
+// Bucket places slug in [0, 100) for feature. The feature name is part of
+// the hash so that each feature starts with a different set of nodes.
+func Bucket(slug, feature string) float64 {
+	sum := sha256.Sum256([]byte(feature + "\x00" + slug))
+	return float64(binary.BigEndian.Uint64(sum[:8])%buckets) * 100 / buckets
+}
+
+// Enabled reports whether slug is within the first percent of the fleet for
+// feature. 0 or less includes no node and 100 or more includes every node.
+func Enabled(slug, feature string, percent float64) bool {
+	if percent <= 0 {
+		return false
+	}
+	if percent >= 100 {
+		return true
+	}
+	return Bucket(slug, feature) < percent
+}
@@ -0,0 +1,49 @@
+package rollout
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestEnabledIsStableAndMonotonic(t *testing.T) {
+	const nodes = 2000
+	included := 0
+	for i := range nodes {
+		slug := fmt.Sprintf("node-%d", i)
+		at25 := Enabled(slug, "new-sync", 25)
+		if at25 != Enabled(slug, "new-sync", 25) {
+			t.Fatalf("%s: decision changed between calls", slug)
+		}
+		if at25 && !Enabled(slug, "new-sync", 50) {
+			t.Fatalf("%s: left the rollout when it grew", slug)
+		}
+		if at25 {
+			included++
+		}
+	}
+	if share := float64(included) / nodes; share < 0.2 || share > 0.3 {
+		t.Fatalf("25%% rollout included %.1f%% of nodes", share*100)
+	}
+}
+
+func TestEnabledBounds(t *testing.T) {
+	if Enabled("sg-1", "f", 0) || Enabled("sg-1", "f", -5) {
+		t.Fatal("0% included a node")
+	}
+	if !Enabled("sg-1", "f", 100) || !Enabled("sg-1", "f", 150) {
+		t.Fatal("100% left a node out")
+	}
+}
+
+func TestBucketDependsOnFeature(t *testing.T) {
+	same := 0
+	for i := range 100 {
+		slug := fmt.Sprintf("node-%d", i)
+		if Bucket(slug, "a") == Bucket(slug, "b") {
+			same++
+		}
+	}
+	if same > 5 {
+		t.Fatalf("%d of 100 nodes share buckets across features", same)
+	}
+}
@@ -0,0 +1,269 @@
+// Package singbox drives a sing-box node with the same state the agent
+// applies to xray. sing-box has no API to add users at runtime, so users are
+// written into the inbounds of its config file, which is checked with
+// `sing-box check` and picked up with a reload. Per-user traffic comes from
+// sing-box's v2ray_api stats service.
+package singbox
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/najahiiii/xray-agent/internal/config"
+	"github.com/najahiiii/xray-agent/internal/initsys"
+	"github.com/najahiiii/xray-agent/internal/model"
+
+	"log/slog"
+)
+
+// ErrUnsupported is returned for state sections sing-box cannot apply.
+var ErrUnsupported = errors.New("not supported by the sing-box backend")
+
+// Checker validates a candidate config; overridden in tests.
+var Checker = func(ctx context.Context, binary, path string) error {
+	out, err := exec.CommandContext(ctx, binary, "check", "-c", path).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("sing-box check: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// Reloader makes the running sing-box re-read its config; overridden in
+// tests.
+var Reloader = func(ctx context.Context, cfg *config.Config) error {
+	kind, err := initsys.Resolve(cfg.Service.Init)
+	if err != nil {
+		return err
+	}
+	return initsys.Reload(ctx, kind, cfg.SingBox.Service)
+}
+
+type Manager struct {
+	cfg *config.Config
+	log *slog.Logger
+}
+
+func NewManager(cfg *config.Config, log *slog.Logger) *Manager {
+	return &Manager{cfg: cfg, log: log}
+}
+
+// Protocols lists the client protos the manager can provision.
+func Protocols() []string {
+	return []string{"vless", "vmess", "trojan"}
+}
+
+// State writes the desired users into the sing-box config and reloads
+// sing-box when the file changed. Route rules cannot be applied and are all
+// returned in failedRoutes.
+func (m *Manager) State(ctx context.Context, currentClients map[string]model.Client, desiredClients []model.Client, currentRoutes map[string]model.RouteRule, desiredRoutes []model.RouteRule) (changed bool, failedRoutes map[string]error, err error) {
+	failedRoutes = make(map[string]error, len(desiredRoutes))
+	for _, r := range desiredRoutes {
+		failedRoutes[r.Tag] = fmt.Errorf("route rules are %w", ErrUnsupported)
+	}
+	if len(currentClients) == len(desiredClients) && !slices.ContainsFunc(desiredClients, func(c model.Client) bool {
+		cur, ok := currentClients[c.Email]
+		return !ok || !reflect.DeepEqual(cur, c)
+	}) {
+		return false, failedRoutes, nil
+	}
+	changed, err = m.writeUsers(ctx, desiredClients)
+	if err != nil {
+		return false, nil, err
+	}
+	return changed, failedRoutes, nil
+}
+
+// Outbounds cannot be applied; every outbound is returned in failed.
+func (m *Manager) Outbounds(ctx context.Context, current map[string]model.Outbound, desired []model.Outbound) (changed bool, failed map[string]error, err error) {
+	failed = make(map[string]error, len(desired))
+	for _, o := range desired {
+		failed[o.Tag] = fmt.Errorf("outbounds are %w", ErrUnsupported)
+	}
+	return false, failed, nil
+}
+
+// writeUsers replaces the users of every inbound the agent manages, the ones
+// in xray.inbound_tags and the ones clients name, and lists all users for
+// v2ray_api stats.
+func (m *Manager) writeUsers(ctx context.Context, clients []model.Client) (bool, error) {
+	path := m.cfg.SingBox.Config
+	old, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	var doc map[string]any
+	if err := json.Unmarshal(old, &doc); err != nil {
+		return false, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if doc == nil {
+		doc = map[string]any{}
+	}
+
+	byTag := map[string][]model.Client{}
+	for _, proto := range Protocols() {
+		byTag[m.tagForProto(proto)] = nil
+	}
+	for _, c := range clients {
+		tag := cmp.Or(c.InboundTag, m.tagForProto(c.Proto))
+		if tag == "" {
+			return false, fmt.Errorf("inbound tag for proto %s not configured", c.Proto)
+		}
+		byTag[tag] = append(byTag[tag], c)
+	}
+	delete(byTag, "")
+	for _, tag := range slices.Sorted(maps.Keys(byTag)) {
+		if err := setUsers(doc, tag, byTag[tag]); err != nil {
+			return false, err
+		}
+	}
+	setStatsUsers(doc, clients)
+
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return false, err
+	}
+	data = append(data, '\n')
+	if bytes.Equal(old, data) {
+		return false, nil
+	}
+	if err := m.replaceConfig(ctx, path, old, data); err != nil {
+		return false, err
+	}
+	if err := Reloader(ctx, m.cfg); err != nil {
+		return false, fmt.Errorf("reload sing-box: %w", err)
+	}
+	if m.log != nil {
+		m.log.Info("updated sing-box users", "users", len(clients))
+	}
+	return true, nil
+}
+
+// replaceConfig checks data and then atomically replaces path with it,
+// keeping the previous version as <path>.bak.
+func (m *Manager) replaceConfig(ctx context.Context, path string, old, data []byte) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".new-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpPath, info.Mode().Perm()); err != nil {
+		return err
+	}
+	if err := Checker(ctx, m.cfg.SingBox.Binary, tmpPath); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+".bak", old, info.Mode().Perm()); err != nil {
+		return fmt.Errorf("back up %s: %w", path, err)
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// setUsers replaces the users of the inbound tagged tag. An inbound without
+// clients may be missing from the config.
+func setUsers(doc map[string]any, tag string, clients []model.Client) error {
+	var in map[string]any
+	inbounds, _ := doc["inbounds"].([]any)
+	for _, raw := range inbounds {
+		if obj, ok := raw.(map[string]any); ok && obj["tag"] == tag {
+			in = obj
+		}
+	}
+	if in == nil {
+		if len(clients) == 0 {
+			return nil
+		}
+		return fmt.Errorf("no inbound with tag %s", tag)
+	}
+
+	slices.SortFunc(clients, func(a, b model.Client) int { return cmp.Compare(a.Email, b.Email) })
+	users := make([]any, 0, len(clients))
+	for _, c := range clients {
+		if in["type"] != c.Proto {
+			return fmt.Errorf("user %s: inbound %s is %v, not %s", c.Email, tag, in["type"], c.Proto)
+		}
+		user := map[string]any{"name": c.Email}
+		switch c.Proto {
+		case "vless":
+			user["uuid"] = c.ID
+			if c.Flow != "" {
+				user["flow"] = c.Flow
+			}
+		case "vmess":
+			user["uuid"] = c.ID
+		case "trojan":
+			user["password"] = c.Password
+		default:
+			return fmt.Errorf("unsupported proto %s", c.Proto)
+		}
+		users = append(users, user)
+	}
+	in["users"] = users
+	return nil
+}
+
+// setStatsUsers enables per-user counters in experimental.v2ray_api for
+// every client; sing-box only counts the users listed there.
+func setStatsUsers(doc map[string]any, clients []model.Client) {
+	experimental, _ := doc["experimental"].(map[string]any)
+	if experimental == nil {
+		experimental = map[string]any{}
+		doc["experimental"] = experimental
+	}
+	api, _ := experimental["v2ray_api"].(map[string]any)
+	if api == nil {
+		api = map[string]any{}
+		experimental["v2ray_api"] = api
+	}
+	stats, _ := api["stats"].(map[string]any)
+	if stats == nil {
+		stats = map[string]any{}
+		api["stats"] = stats
+	}
+	emails := make([]string, 0, len(clients))
+	for _, c := range clients {
+		emails = append(emails, c.Email)
+	}
+	slices.Sort(emails)
+	users := make([]any, len(emails))
+	for i, e := range emails {
+		users[i] = e
+	}
+	stats["enabled"] = true
+	stats["users"] = users
+}
+
+func (m *Manager) tagForProto(proto string) string {
+	switch proto {
+	case "vless":
+		return m.cfg.Xray.InboundTags.VLESS
+	case "vmess":
+		return m.cfg.Xray.InboundTags.VMESS
+	case "trojan":
+		return m.cfg.Xray.InboundTags.TROJAN
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,185 @@
+package singbox
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/najahiiii/xray-agent/internal/config"
+	"github.com/najahiiii/xray-agent/internal/model"
+
+	statscommand "github.com/xtls/xray-core/app/stats/command"
+	"google.golang.org/grpc"
+)
+
+const sampleConfig = `{
+  "inbounds": [
+    {"type": "vless", "tag": "vless-in", "listen_port": 443, "users": [{"name": "old@x", "uuid": "u0"}]},
+    {"type": "trojan", "tag": "trojan-in", "listen_port": 8443},
+    {"type": "direct", "tag": "dns-in"}
+  ],
+  "outbounds": [{"type": "direct", "tag": "direct"}]
+}
+`
+
+func testManager(t *testing.T) (*Manager, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(sampleConfig), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{}
+	cfg.SingBox.Binary = "sing-box"
+	cfg.SingBox.Config = path
+	cfg.Xray.InboundTags.VLESS = "vless-in"
+	cfg.Xray.InboundTags.VMESS = "vmess-in"
+	cfg.Xray.InboundTags.TROJAN = "trojan-in"
+	return NewManager(cfg, nil), path
+}
+
+func stubCore(t *testing.T, checkErr error) (checks, reloads *int) {
+	t.Helper()
+	origChecker, origReloader := Checker, Reloader
+	checks, reloads = new(int), new(int)
+	Checker = func(context.Context, string, string) error {
+		*checks++
+		return checkErr
+	}
+	Reloader = func(context.Context, *config.Config) error {
+		*reloads++
+		return nil
+	}
+	t.Cleanup(func() { Checker, Reloader = origChecker, origReloader })
+	return checks, reloads
+}
+
+func TestStateWritesUsersAndReloads(t *testing.T) {
+	m, path := testManager(t)
+	checks, reloads := stubCore(t, nil)
+	clients := []model.Client{
+		{Proto: "vless", ID: "u1", Email: "b@x", Flow: "xtls-rprx-vision"},
+		{Proto: "trojan", Password: "p1", Email: "a@x"},
+	}
+	routes := []model.RouteRule{{Tag: "block-ads", OutboundTag: "blocked"}}
+
+	changed, failed, err := m.State(context.Background(), nil, clients, nil, routes)
+	if err != nil || !changed {
+		t.Fatalf("State = %v, %v; want changed", changed, err)
+	}
+	if !errors.Is(failed["block-ads"], ErrUnsupported) {
+		t.Fatalf("failed routes = %v; want block-ads unsupported", failed)
+	}
+	if *checks != 1 || *reloads != 1 {
+		t.Fatalf("checks=%d reloads=%d; want 1 each", *checks, *reloads)
+	}
+
+	var doc struct {
+		Inbounds []struct {
+			Tag   string           `json:"tag"`
+			Users []map[string]any `json:"users"`
+		} `json:"inbounds"`
+		Outbounds    []any `json:"outbounds"`
+		Experimental struct {
+			V2RayAPI struct {
+				Stats struct {
+					Enabled bool     `json:"enabled"`
+					Users   []string `json:"users"`
+				} `json:"stats"`
+			} `json:"v2ray_api"`
+		} `json:"experimental"`
+	}
+	data, _ := os.ReadFile(path)
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatal(err)
+	}
+	users := map[string][]map[string]any{}
+	for _, in := range doc.Inbounds {
+		users[in.Tag] = in.Users
+	}
+	if want := []map[string]any{{"name": "b@x", "uuid": "u1", "flow": "xtls-rprx-vision"}}; !reflect.DeepEqual(users["vless-in"], want) {
+		t.Fatalf("vless users = %v; want %v", users["vless-in"], want)
+	}
+	if want := []map[string]any{{"name": "a@x", "password": "p1"}}; !reflect.DeepEqual(users["trojan-in"], want) {
+		t.Fatalf("trojan users = %v; want %v", users["trojan-in"], want)
+	}
+	if users["dns-in"] != nil || len(doc.Outbounds) != 1 {
+		t.Fatalf("unmanaged sections changed: %s", data)
+	}
+	if stats := doc.Experimental.V2RayAPI.Stats; !stats.Enabled || !reflect.DeepEqual(stats.Users, []string{"a@x", "b@x"}) {
+		t.Fatalf("v2ray_api stats = %+v", stats)
+	}
+	if backup, _ := os.ReadFile(path + ".bak"); string(backup) != sampleConfig {
+		t.Fatalf("backup = %q; want the previous config", backup)
+	}
+
+	current := map[string]model.Client{"b@x": clients[0], "a@x": clients[1]}
+	changed, _, err = m.State(context.Background(), current, clients, nil, nil)
+	if err != nil || changed || *checks != 1 {
+		t.Fatalf("unchanged State = %v, %v (checks=%d); want no rewrite", changed, err, *checks)
+	}
+}
+
+func TestStateKeepsConfigWhenCheckFails(t *testing.T) {
+	m, path := testManager(t)
+	_, reloads := stubCore(t, errors.New("bad config"))
+
+	_, _, err := m.State(context.Background(), nil, []model.Client{{Proto: "vless", ID: "u1", Email: "a@x"}}, nil, nil)
+	if err == nil {
+		t.Fatal("State succeeded; want check error")
+	}
+	if data, _ := os.ReadFile(path); string(data) != sampleConfig || *reloads != 0 {
+		t.Fatalf("config replaced or reloaded (reloads=%d) after failed check", *reloads)
+	}
+}
+
+func TestStateRejectsInboundOfOtherType(t *testing.T) {
+	m, _ := testManager(t)
+	stubCore(t, nil)
+
+	_, _, err := m.State(context.Background(), nil, []model.Client{{Proto: "vmess", ID: "u1", Email: "a@x", InboundTag: "trojan-in"}}, nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "not vmess") {
+		t.Fatalf("State = %v; want inbound type error", err)
+	}
+}
+
+func TestCollectorUsesV2RayStatsService(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var methods []string
+	srv := grpc.NewServer(grpc.UnknownServiceHandler(func(_ any, stream grpc.ServerStream) error {
+		method, _ := grpc.MethodFromServerStream(stream)
+		methods = append(methods, method)
+		var req statscommand.QueryStatsRequest
+		if err := stream.RecvMsg(&req); err != nil {
+			return err
+		}
+		value := int64(10)
+		if strings.HasSuffix(req.Pattern, "downlink") {
+			value = 20
+		}
+		return stream.SendMsg(&statscommand.QueryStatsResponse{Stat: []*statscommand.Stat{{Name: req.Pattern, Value: value}}})
+	}))
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	cfg := &config.Config{}
+	cfg.SingBox.APIServer = lis.Addr().String()
+	got, err := NewCollector(cfg, nil).QueryUserBytes(context.Background(), []string{"a@x"})
+	if err != nil {
+		t.Fatalf("QueryUserBytes: %v", err)
+	}
+	if got["a@x"] != [2]int64{10, 20} {
+		t.Fatalf("usage = %v; want [10 20]", got["a@x"])
+	}
+	if len(methods) != 2 || methods[0] != statsService+"QueryStats" {
+		t.Fatalf("methods = %v; want v2ray QueryStats", methods)
+	}
+}
@@ -0,0 +1,109 @@
+package singbox
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/najahiiii/xray-agent/internal/config"
+	"github.com/najahiiii/xray-agent/internal/model"
+
+	statscommand "github.com/xtls/xray-core/app/stats/command"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"log/slog"
+)
+
+// statsService is the gRPC service sing-box's v2ray_api serves. It keeps
+// v2ray's proto package, whose messages match xray's field for field, so
+// xray's generated types are reused with v2ray's method names.
+const statsService = "/v2ray.core.app.stats.command.StatsService/"
+
+// Collector reads traffic counters from sing-box's v2ray_api.
+type Collector struct {
+	cfg *config.Config
+	log *slog.Logger
+}
+
+func NewCollector(cfg *config.Config, log *slog.Logger) *Collector {
+	return &Collector{cfg: cfg, log: log}
+}
+
+// QueryUserBytes reads the uplink and downlink counters of emails without
+// resetting them.
+func (c *Collector) QueryUserBytes(ctx context.Context, emails []string) (map[string][2]int64, error) {
+	return c.userBytes(ctx, emails, false)
+}
+
+// ResetUserBytes reads and zeroes the counters of emails.
+func (c *Collector) ResetUserBytes(ctx context.Context, emails []string) (map[string][2]int64, error) {
+	return c.userBytes(ctx, emails, true)
+}
+
+func (c *Collector) userBytes(ctx context.Context, emails []string, reset bool) (map[string][2]int64, error) {
+	conn, err := grpc.NewClient(c.cfg.SingBox.APIServer, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+	conn.Connect()
+	defer conn.Close()
+
+	res := make(map[string][2]int64, len(emails))
+	for _, email := range emails {
+		var usage [2]int64
+		for i, dir := range []string{"uplink", "downlink"} {
+			usage[i], err = querySingle(ctx, conn, fmt.Sprintf("user>>>%s>>>traffic>>>%s", email, dir), reset)
+			if err != nil {
+				return nil, err
+			}
+		}
+		res[email] = usage
+	}
+	return res, nil
+}
+
+func querySingle(ctx context.Context, conn *grpc.ClientConn, name string, reset bool) (int64, error) {
+	var resp statscommand.QueryStatsResponse
+	err := conn.Invoke(ctx, statsService+"QueryStats", &statscommand.QueryStatsRequest{Pattern: name, Reset_: reset}, &resp)
+	if err != nil {
+		return 0, fmt.Errorf("stats query %s: %w", name, err)
+	}
+	for _, stat := range resp.GetStat() {
+		if stat.GetName() == name {
+			return stat.GetValue(), nil
+		}
+	}
+	return 0, nil
+}
+
+// OnlineUsers is not available: sing-box does not track online users.
+func (c *Collector) OnlineUsers(ctx context.Context) ([]model.OnlineUserInfo, error) {
+	return nil, fmt.Errorf("online users are %w", ErrUnsupported)
+}
+
+// SysStats reads sing-box's runtime statistics.
+func (c *Collector) SysStats(ctx context.Context) (*model.XraySysStats, error) {
+	conn, err := grpc.NewClient(c.cfg.SingBox.APIServer, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+	conn.Connect()
+	defer conn.Close()
+
+	var resp statscommand.SysStatsResponse
+	if err := conn.Invoke(ctx, statsService+"GetSysStats", &statscommand.SysStatsRequest{}, &resp); err != nil {
+		return nil, fmt.Errorf("sys stats query: %w", err)
+	}
+	return &model.XraySysStats{
+		NumGoroutine: resp.GetNumGoroutine(),
+		NumGC:        resp.GetNumGC(),
+		Alloc:        resp.GetAlloc(),
+		TotalAlloc:   resp.GetTotalAlloc(),
+		Sys:          resp.GetSys(),
+		Mallocs:      resp.GetMallocs(),
+		Frees:        resp.GetFrees(),
+		LiveObjects:  resp.GetLiveObjects(),
+		PauseTotalNs: resp.GetPauseTotalNs(),
+		Uptime:       resp.GetUptime(),
+	}, nil
+}
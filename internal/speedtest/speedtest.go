@@ -0,0 +1,135 @@
+// Package speedtest measures a node's download and upload bandwidth against
+// plain HTTP endpoints, like speed.cloudflare.com's __down and __up.
+package speedtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/najahiiii/xray-agent/internal/model"
+)
+
+type Options struct {
+	// DownloadURL is fetched and discarded; UploadURL receives UploadBytes
+	// zero bytes in a POST.
+	DownloadURL string
+	UploadURL   string
+	UploadBytes int64
+	// Timeout bounds each direction. A download cut short by it still
+	// counts what arrived so far.
+	Timeout time.Duration
+	Client  *http.Client
+}
+
+// Run measures the download and then the upload direction. Failures are
+// reported in the result, so it always returns one.
+func Run(ctx context.Context, opts Options) *model.SpeedtestResult {
+	client := opts.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res := &model.SpeedtestResult{StartedAt: time.Now().UTC()}
+	var errs []string
+
+	latency, n, elapsed, err := download(ctx, client, opts)
+	res.DownloadBytes = n
+	if latency > 0 {
+		res.LatencyMs = floatPtr(float64(latency.Microseconds()) / 1000)
+	}
+	if err != nil {
+		errs = append(errs, "download: "+err.Error())
+	} else {
+		res.DownloadMbps = floatPtr(mbps(n, elapsed))
+	}
+
+	n, elapsed, err = upload(ctx, client, opts)
+	res.UploadBytes = n
+	if err != nil {
+		errs = append(errs, "upload: "+err.Error())
+	} else {
+		res.UploadMbps = floatPtr(mbps(n, elapsed))
+	}
+
+	res.Error = strings.Join(errs, "; ")
+	res.FinishedAt = time.Now().UTC()
+	return res
+}
+
+// download returns the time to the response headers, the bytes read and how
+// long reading them took.
+func download(ctx context.Context, client *http.Client, opts Options) (time.Duration, int64, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, opts.DownloadURL, nil)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer resp.Body.Close()
+	latency := time.Since(start)
+	if resp.StatusCode/100 != 2 {
+		return latency, 0, 0, fmt.Errorf("http %d", resp.StatusCode)
+	}
+
+	start = time.Now()
+	n, err := io.Copy(io.Discard, resp.Body)
+	elapsed := time.Since(start)
+	if err != nil && !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return latency, n, elapsed, err
+	}
+	if n == 0 {
+		return latency, 0, elapsed, errors.New("no data received")
+	}
+	return latency, n, elapsed, nil
+}
+
+func upload(ctx context.Context, client *http.Client, opts Options) (int64, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, opts.UploadURL, io.LimitReader(zeros{}, opts.UploadBytes))
+	if err != nil {
+		return 0, 0, err
+	}
+	req.ContentLength = opts.UploadBytes
+	req.Header.Set("Content-Type", "application/octet-stream")
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+	elapsed := time.Since(start)
+	if resp.StatusCode/100 != 2 {
+		return 0, elapsed, fmt.Errorf("http %d", resp.StatusCode)
+	}
+	return opts.UploadBytes, elapsed, nil
+}
+
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+func mbps(n int64, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(n) * 8 / elapsed.Seconds() / 1_000_000
+}
+
+func floatPtr(v float64) *float64 {
+	return &v
+}
@@ -0,0 +1,69 @@
+package speedtest
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunMeasuresBothDirections(t *testing.T) {
+	var uploaded int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/down":
+			w.Write(make([]byte, 1<<20))
+		case "/up":
+			uploaded, _ = io.Copy(io.Discard, r.Body)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	res := Run(context.Background(), Options{
+		DownloadURL: server.URL + "/down",
+		UploadURL:   server.URL + "/up",
+		UploadBytes: 512 << 10,
+		Timeout:     5 * time.Second,
+	})
+	if res.Error != "" {
+		t.Fatalf("Run error: %s", res.Error)
+	}
+	if res.DownloadBytes != 1<<20 || res.DownloadMbps == nil || *res.DownloadMbps <= 0 {
+		t.Fatalf("download = %d bytes, %v Mbps", res.DownloadBytes, res.DownloadMbps)
+	}
+	if uploaded != 512<<10 || res.UploadBytes != uploaded || res.UploadMbps == nil {
+		t.Fatalf("upload = %d bytes (server got %d), %v Mbps", res.UploadBytes, uploaded, res.UploadMbps)
+	}
+	if res.LatencyMs == nil {
+		t.Fatal("latency not measured")
+	}
+}
+
+func TestRunReportsFailedDirection(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/up" {
+			http.Error(w, "nope", http.StatusForbidden)
+			return
+		}
+		w.Write([]byte("data"))
+	}))
+	t.Cleanup(server.Close)
+
+	res := Run(context.Background(), Options{
+		DownloadURL: server.URL + "/down",
+		UploadURL:   server.URL + "/up",
+		UploadBytes: 1024,
+		Timeout:     5 * time.Second,
+	})
+	if res.DownloadMbps == nil || res.UploadMbps != nil {
+		t.Fatalf("download %v, upload %v; want only download", res.DownloadMbps, res.UploadMbps)
+	}
+	if !strings.Contains(res.Error, "upload: http 403") {
+		t.Fatalf("error = %q", res.Error)
+	}
+}
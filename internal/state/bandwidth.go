@@ -0,0 +1,62 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+)
+
+// BandwidthSnapshot is the on-disk form of the node traffic counted for
+// bandwidth_cap.
+type BandwidthSnapshot struct {
+	// PeriodStart is the reset day the count started from.
+	PeriodStart time.Time `json:"period_start"`
+	Sent        uint64    `json:"sent"`
+	Recv        uint64    `json:"recv"`
+	// LastSent and LastRecv are the interface counters at ReadAt; the next
+	// read counts the difference.
+	LastSent uint64    `json:"last_sent"`
+	LastRecv uint64    `json:"last_recv"`
+	ReadAt   time.Time `json:"read_at"`
+	// CappedAt is when the count passed the cap in this period.
+	CappedAt *time.Time `json:"capped_at,omitempty"`
+}
+
+// BandwidthStore persists the bandwidth count so the cap holds across agent
+// restarts.
+type BandwidthStore struct {
+	path string
+}
+
+func NewBandwidthStore(path string) *BandwidthStore {
+	return &BandwidthStore{path: path}
+}
+
+func (s *BandwidthStore) Path() string {
+	return s.path
+}
+
+// Load returns nil without error when nothing has been saved yet.
+func (s *BandwidthStore) Load() (*BandwidthSnapshot, error) {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var snap BandwidthSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, err
+	}
+	return &snap, nil
+}
+
+func (s *BandwidthStore) Save(snap *BandwidthSnapshot) error {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data, 0o600)
+}
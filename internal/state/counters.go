@@ -0,0 +1,120 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/najahiiii/xray-agent/internal/model"
+)
+
+// CounterSnapshot is the on-disk form of the stats delta bookkeeping.
+type CounterSnapshot struct {
+	Sequence uint64              `json:"sequence"`
+	SavedAt  time.Time           `json:"saved_at"`
+	Counters map[string][2]int64 `json:"counters,omitempty"`
+	// Pending is usage read by a counter reset that has not reached the panel.
+	Pending map[string][2]int64 `json:"pending,omitempty"`
+	// Recorded is the part of Pending already counted in Rollups and the
+	// usage history.
+	Recorded map[string][2]int64 `json:"recorded,omitempty"`
+	Rollups  *UsageRollups       `json:"rollups,omitempty"`
+	// Totals is the usage delivered to the panel per user.
+	Totals map[string][2]int64 `json:"totals,omitempty"`
+	// CoreUptime is xray's uptime in seconds when Counters were read.
+	CoreUptime uint32 `json:"core_uptime,omitempty"`
+	// InFlight is a push the panel has not yet confirmed, with
+	// stats_reset_each_push. It is saved before the push is sent.
+	InFlight *InFlightStats `json:"in_flight,omitempty"`
+}
+
+// InFlightStats is a stats push and the counters it was computed from. An
+// agent that stops before the panel confirms the push replays it, with the
+// same sequence, before querying the counters again.
+type InFlightStats struct {
+	Push       *model.StatsPush    `json:"push"`
+	Counters   map[string][2]int64 `json:"counters"`
+	CoreUptime uint32              `json:"core_uptime,omitempty"`
+}
+
+// CounterStore persists the last seen cumulative counters and push sequence
+// so a restarted agent can continue where the previous process stopped.
+type CounterStore struct {
+	path string
+}
+
+func NewCounterStore(path string) *CounterStore {
+	return &CounterStore{path: path}
+}
+
+func (s *CounterStore) Path() string {
+	return s.path
+}
+
+// Load returns nil without error when no snapshot has been written yet.
+func (s *CounterStore) Load() (*CounterSnapshot, error) {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var snap CounterSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, err
+	}
+	if snap.Counters == nil {
+		snap.Counters = map[string][2]int64{}
+	}
+	return &snap, nil
+}
+
+func (s *CounterStore) Save(snap *CounterSnapshot) error {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data, 0o600)
+}
+
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmpFile.Name()
+
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmpFile.Chmod(perm); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
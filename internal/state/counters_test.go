@@ -0,0 +1,39 @@
+package state
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCounterStoreRoundTrip(t *testing.T) {
+	store := NewCounterStore(filepath.Join(t.TempDir(), "nested", "stats-counters.json"))
+
+	snap, err := store.Load()
+	if err != nil {
+		t.Fatalf("Load before save: %v", err)
+	}
+	if snap != nil {
+		t.Fatalf("expected nil snapshot before save, got %+v", snap)
+	}
+
+	savedAt := time.Date(2026, time.March, 5, 12, 0, 0, 0, time.UTC)
+	if err := store.Save(&CounterSnapshot{
+		Sequence: 7,
+		SavedAt:  savedAt,
+		Counters: map[string][2]int64{"user@example.com": {100, 200}},
+	}); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	snap, err = store.Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if snap == nil || snap.Sequence != 7 || !snap.SavedAt.Equal(savedAt) {
+		t.Fatalf("unexpected snapshot: %+v", snap)
+	}
+	if got := snap.Counters["user@example.com"]; got != [2]int64{100, 200} {
+		t.Fatalf("unexpected counters: %+v", snap.Counters)
+	}
+}
@@ -0,0 +1,70 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// LockFile is the name of the instance lock in storage.dir.
+const LockFile = "agent.lock"
+
+// LockedError is returned by AcquireLock while another process holds the
+// lock. PID is 0 when the holder did not record one.
+type LockedError struct {
+	Path string
+	PID  int
+}
+
+func (e *LockedError) Error() string {
+	if e.PID == 0 {
+		return fmt.Sprintf("another xray-agent holds %s", e.Path)
+	}
+	return fmt.Sprintf("another xray-agent (pid %d) holds %s", e.PID, e.Path)
+}
+
+// Lock is a held instance lock.
+type Lock struct {
+	f *os.File
+}
+
+// AcquireLock takes an exclusive flock on path and writes the PID into it,
+// so that only one agent runs per storage directory. The kernel drops the
+// lock when its holder exits, so a lock file left by a crashed agent is
+// taken over without a staleness check. It fails with *LockedError while
+// another agent is running.
+func AcquireLock(path string) (*Lock, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		defer f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			data, _ := os.ReadFile(path)
+			pid, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+			return nil, &LockedError{Path: path, PID: pid}
+		}
+		return nil, fmt.Errorf("lock %s: %w", path, err)
+	}
+	if err := f.Truncate(0); err == nil {
+		_, _ = f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	return &Lock{f: f}, nil
+}
+
+// Release drops the lock. The file is left in place: removing it could let
+// a third agent lock a new file while a second one holds the old.
+func (l *Lock) Release() error {
+	if l == nil {
+		return nil
+	}
+	return l.f.Close()
+}
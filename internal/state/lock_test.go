@@ -0,0 +1,38 @@
+package state
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestAcquireLockIsExclusive(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sub", LockFile)
+	first, err := AcquireLock(path)
+	if err != nil {
+		t.Fatalf("AcquireLock: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil || strings.TrimSpace(string(data)) != strconv.Itoa(os.Getpid()) {
+		t.Fatalf("lock file = %q, %v", data, err)
+	}
+
+	_, err = AcquireLock(path)
+	var locked *LockedError
+	if !errors.As(err, &locked) || locked.PID != os.Getpid() || locked.Path != path {
+		t.Fatalf("second AcquireLock = %v", err)
+	}
+
+	if err := first.Release(); err != nil {
+		t.Fatal(err)
+	}
+	// A lock file without a holder, as left by a crashed agent, is taken over.
+	second, err := AcquireLock(path)
+	if err != nil {
+		t.Fatalf("AcquireLock after release: %v", err)
+	}
+	second.Release()
+}
@@ -0,0 +1,67 @@
+package state
+
+import (
+	"maps"
+	"time"
+)
+
+// UsagePeriod is the usage per user in one UTC day (2006-01-02) or month
+// (2006-01).
+type UsagePeriod struct {
+	Period string              `json:"period,omitempty"`
+	Users  map[string][2]int64 `json:"users,omitempty"`
+}
+
+// UsageRollups are the per-user totals of the current and previous UTC day
+// and month.
+type UsageRollups struct {
+	Day       UsagePeriod `json:"day"`
+	PrevDay   UsagePeriod `json:"prev_day"`
+	Month     UsagePeriod `json:"month"`
+	PrevMonth UsagePeriod `json:"prev_month"`
+}
+
+const monthLayout = "2006-01"
+
+// Clone returns a copy that shares no maps with r.
+func (r UsageRollups) Clone() UsageRollups {
+	for _, p := range []*UsagePeriod{&r.Day, &r.PrevDay, &r.Month, &r.PrevMonth} {
+		p.Users = maps.Clone(p.Users)
+	}
+	return r
+}
+
+// Add counts usage of email at at, moving to a new day or month first when
+// at is past the current one.
+func (r *UsageRollups) Add(at time.Time, email string, usage [2]int64) {
+	r.Roll(at)
+	for _, p := range []*UsagePeriod{&r.Day, &r.Month} {
+		if p.Users == nil {
+			p.Users = map[string][2]int64{}
+		}
+		u := p.Users[email]
+		p.Users[email] = [2]int64{u[0] + usage[0], u[1] + usage[1]}
+	}
+}
+
+// Roll moves to the day and month of now. The current period becomes the
+// previous one only when it is the one right before; older totals are
+// dropped. Times before the current period leave it alone.
+func (r *UsageRollups) Roll(now time.Time) {
+	now = now.UTC()
+	roll(&r.Day, &r.PrevDay, now.Format(time.DateOnly), now.AddDate(0, 0, -1).Format(time.DateOnly))
+	first := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	roll(&r.Month, &r.PrevMonth, first.Format(monthLayout), first.AddDate(0, -1, 0).Format(monthLayout))
+}
+
+func roll(cur, prev *UsagePeriod, period, before string) {
+	if cur.Period >= period {
+		return
+	}
+	if cur.Period == before {
+		*prev = *cur
+	} else {
+		*prev = UsagePeriod{Period: before}
+	}
+	*cur = UsagePeriod{Period: period}
+}
@@ -0,0 +1,36 @@
+package state
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUsageRollupsRoll(t *testing.T) {
+	var r UsageRollups
+	day := time.Date(2025, 11, 30, 23, 0, 0, 0, time.UTC)
+	r.Add(day, "a@example.com", [2]int64{1, 2})
+	r.Add(day.Add(30*time.Minute), "a@example.com", [2]int64{10, 20})
+	r.Add(day.Add(2*time.Hour), "b@example.com", [2]int64{5, 5})
+
+	if r.Day.Period != "2025-12-01" || r.PrevDay.Period != "2025-11-30" || r.PrevDay.Users["a@example.com"] != [2]int64{11, 22} {
+		t.Fatalf("days = %+v / %+v", r.Day, r.PrevDay)
+	}
+	if r.Month.Period != "2025-12" || len(r.Month.Users) != 1 || r.PrevMonth.Users["a@example.com"] != [2]int64{11, 22} {
+		t.Fatalf("months = %+v / %+v", r.Month, r.PrevMonth)
+	}
+
+	// A late sample does not move the periods back.
+	r.Add(day, "c@example.com", [2]int64{1, 1})
+	if r.Day.Period != "2025-12-01" || r.Day.Users["c@example.com"] != [2]int64{1, 1} {
+		t.Fatalf("day after a late sample = %+v", r.Day)
+	}
+
+	// After a gap the previous day is empty rather than an older one.
+	r.Roll(time.Date(2025, 12, 3, 1, 0, 0, 0, time.UTC))
+	if r.Day.Period != "2025-12-03" || r.PrevDay.Period != "2025-12-02" || len(r.PrevDay.Users) != 0 || len(r.Day.Users) != 0 {
+		t.Fatalf("days after a gap = %+v / %+v", r.Day, r.PrevDay)
+	}
+	if r.Month.Users["b@example.com"] != [2]int64{5, 5} {
+		t.Fatalf("month after a gap = %+v", r.Month)
+	}
+}
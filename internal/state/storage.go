@@ -0,0 +1,46 @@
+package state
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// Storage conditions that make local writes fail until an operator steps in.
+const (
+	StorageReadOnly = "read_only"
+	StorageFull     = "full"
+)
+
+// StorageCondition classifies a write error as a read-only filesystem or a
+// full disk (including an exhausted quota). Other errors return "".
+func StorageCondition(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, syscall.EROFS):
+		return StorageReadOnly
+	case errors.Is(err, syscall.ENOSPC), errors.Is(err, syscall.EDQUOT):
+		return StorageFull
+	}
+	return ""
+}
+
+// ProbeWritable creates and removes a small file in dir to find out whether
+// the agent can persist anything there.
+func ProbeWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".probe-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	_, err = f.Write([]byte("ok"))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	os.Remove(name)
+	return err
+}
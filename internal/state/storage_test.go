@@ -0,0 +1,31 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestStorageCondition(t *testing.T) {
+	cases := []struct {
+		err  error
+		want string
+	}{
+		{err: nil, want: ""},
+		{err: &os.PathError{Op: "open", Path: "/etc/x", Err: syscall.EROFS}, want: StorageReadOnly},
+		{err: fmt.Errorf("save: %w", &os.PathError{Op: "write", Path: "/var/x", Err: syscall.ENOSPC}), want: StorageFull},
+		{err: &os.PathError{Op: "write", Path: "/var/x", Err: syscall.EDQUOT}, want: StorageFull},
+		{err: errors.New("permission denied"), want: ""},
+	}
+	for _, tc := range cases {
+		if got := StorageCondition(tc.err); got != tc.want {
+			t.Fatalf("StorageCondition(%v) = %q, want %q", tc.err, got, tc.want)
+		}
+	}
+
+	if err := ProbeWritable(t.TempDir()); err != nil {
+		t.Fatalf("ProbeWritable: %v", err)
+	}
+}
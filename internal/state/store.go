@@ -59,6 +59,13 @@ func (s *Store) Update(version int64, clients []model.Client, routes []model.Rou
 	s.routes = nextRoutes
 }
 
+// Version returns the last applied config version, or -1 before the first sync.
+func (s *Store) Version() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.lastVersion
+}
+
 func (s *Store) Emails() []string {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
@@ -93,7 +100,7 @@ func (s *Store) RoutesSnapshot() map[string]model.RouteRule {
 }
 
 func equalClient(a, b model.Client) bool {
-	return a.Proto == b.Proto && a.ID == b.ID && a.Password == b.Password
+	return a.Proto == b.Proto && a.ID == b.ID && a.Password == b.Password && a.Flow == b.Flow && a.Level == b.Level && a.InboundTag == b.InboundTag
 }
 
 func equalRoute(a, b model.RouteRule) bool {
@@ -9,10 +9,9 @@ import (
 
 	"github.com/najahiiii/xray-agent/internal/config"
 	"github.com/najahiiii/xray-agent/internal/model"
+	"github.com/najahiiii/xray-agent/internal/xrayapi"
 
 	statscommand "github.com/xtls/xray-core/app/stats/command"
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
 
 	"log/slog"
 )
@@ -31,8 +30,23 @@ func New(cfg *config.Config, log *slog.Logger) *Collector {
 	return &Collector{cfg: cfg, log: log}
 }
 
+// QueryUserBytes reads the uplink and downlink counters of emails without
+// resetting them.
 func (c *Collector) QueryUserBytes(ctx context.Context, emails []string) (map[string][2]int64, error) {
-	conn, err := grpc.NewClient(c.cfg.Xray.APIServer, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	return c.userBytes(ctx, emails, false)
+}
+
+// ResetUserBytes reads and zeroes the counters of emails. The values returned
+// include traffic counted since the last QueryUserBytes.
+func (c *Collector) ResetUserBytes(ctx context.Context, emails []string) (map[string][2]int64, error) {
+	if c.log != nil {
+		c.log.Debug("resetting user traffic counters", "users", len(emails))
+	}
+	return c.userBytes(ctx, emails, true)
+}
+
+func (c *Collector) userBytes(ctx context.Context, emails []string, reset bool) (map[string][2]int64, error) {
+	conn, err := xrayapi.Dial(c.cfg)
 	if err != nil {
 		return nil, err
 	}
@@ -42,7 +56,7 @@ func (c *Collector) QueryUserBytes(ctx context.Context, emails []string) (map[st
 	client := statscommand.NewStatsServiceClient(conn)
 	res := make(map[string][2]int64, len(emails))
 	for _, email := range emails {
-		up, dn, err := c.fetch(ctx, client, email)
+		up, dn, err := c.fetch(ctx, client, email, reset)
 		if err != nil {
 			return nil, err
 		}
@@ -51,23 +65,19 @@ func (c *Collector) QueryUserBytes(ctx context.Context, emails []string) (map[st
 	return res, nil
 }
 
-func (c *Collector) fetch(ctx context.Context, client statscommand.StatsServiceClient, email string) (int64, int64, error) {
-	up, err := c.querySingle(ctx, client, fmt.Sprintf("user>>>%s>>>traffic>>>uplink", email))
+func (c *Collector) fetch(ctx context.Context, client statscommand.StatsServiceClient, email string, reset bool) (int64, int64, error) {
+	up, err := c.querySingle(ctx, client, fmt.Sprintf("user>>>%s>>>traffic>>>uplink", email), reset)
 	if err != nil {
 		return 0, 0, err
 	}
-	down, err := c.querySingle(ctx, client, fmt.Sprintf("user>>>%s>>>traffic>>>downlink", email))
+	down, err := c.querySingle(ctx, client, fmt.Sprintf("user>>>%s>>>traffic>>>downlink", email), reset)
 	if err != nil {
 		return 0, 0, err
 	}
 	return up, down, nil
 }
 
-func (c *Collector) querySingle(ctx context.Context, client statscommand.StatsServiceClient, name string) (int64, error) {
-	reset := c.cfg.Xray.StatsResetEachPush
-	if reset && c.log != nil {
-		c.log.Debug("stats reset enabled, resetting counters", "name", name)
-	}
+func (c *Collector) querySingle(ctx context.Context, client statscommand.StatsServiceClient, name string, reset bool) (int64, error) {
 	resp, err := client.QueryStats(ctx, &statscommand.QueryStatsRequest{
 		Pattern: name,
 		Reset_:  reset,
@@ -83,8 +93,60 @@ func (c *Collector) querySingle(ctx context.Context, client statscommand.StatsSe
 	return 0, nil
 }
 
+// Traffic holds the uplink and downlink byte counters of the core by user
+// email and by inbound tag.
+type Traffic struct {
+	Users    map[string][2]int64
+	Inbounds map[string][2]int64
+}
+
+// QueryTraffic reads every user and inbound traffic counter of the core in
+// one call, without resetting them. Unlike QueryUserBytes it needs no list
+// of emails, so it also shows users the agent does not know about.
+func (c *Collector) QueryTraffic(ctx context.Context) (*Traffic, error) {
+	conn, err := xrayapi.Dial(c.cfg)
+	if err != nil {
+		return nil, err
+	}
+	conn.Connect()
+	defer conn.Close()
+
+	resp, err := statscommand.NewStatsServiceClient(conn).QueryStats(ctx, &statscommand.QueryStatsRequest{Pattern: ">>>traffic>>>"})
+	if err != nil {
+		return nil, fmt.Errorf("stats query: %w", err)
+	}
+	t := &Traffic{Users: map[string][2]int64{}, Inbounds: map[string][2]int64{}}
+	for _, stat := range resp.GetStat() {
+		// e.g. user>>>a@example.com>>>traffic>>>uplink
+		parts := strings.Split(stat.GetName(), ">>>")
+		if len(parts) != 4 || parts[2] != "traffic" {
+			continue
+		}
+		var into map[string][2]int64
+		switch parts[0] {
+		case "user":
+			into = t.Users
+		case "inbound":
+			into = t.Inbounds
+		default:
+			continue
+		}
+		v := into[parts[1]]
+		switch parts[3] {
+		case "uplink":
+			v[0] = stat.GetValue()
+		case "downlink":
+			v[1] = stat.GetValue()
+		default:
+			continue
+		}
+		into[parts[1]] = v
+	}
+	return t, nil
+}
+
 func (c *Collector) OnlineUsers(ctx context.Context) ([]model.OnlineUserInfo, error) {
-	conn, err := grpc.NewClient(c.cfg.Xray.APIServer, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	conn, err := xrayapi.Dial(c.cfg)
 	if err != nil {
 		return nil, err
 	}
@@ -148,7 +210,7 @@ func (c *Collector) onlineUserIPs(ctx context.Context, client statscommand.Stats
 }
 
 func (c *Collector) SysStats(ctx context.Context) (*model.XraySysStats, error) {
-	conn, err := grpc.NewClient(c.cfg.Xray.APIServer, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	conn, err := xrayapi.Dial(c.cfg)
 	if err != nil {
 		return nil, err
 	}
@@ -2,74 +2,29 @@ package stats
 
 import (
 	"context"
-	"net"
-	"slices"
 	"testing"
 	"time"
 
 	"github.com/najahiiii/xray-agent/internal/config"
-
-	statscommand "github.com/xtls/xray-core/app/stats/command"
-	"google.golang.org/grpc"
+	"github.com/najahiiii/xray-agent/testsupport"
 )
 
-type fakeStatsServer struct {
-	statscommand.UnimplementedStatsServiceServer
-	values    map[string][2]int64
-	onlineIPs map[string]map[string]int64
-}
-
-func (f *fakeStatsServer) QueryStats(ctx context.Context, req *statscommand.QueryStatsRequest) (*statscommand.QueryStatsResponse, error) {
-	resp := &statscommand.QueryStatsResponse{}
-	for email, usage := range f.values {
-		resp.Stat = append(resp.Stat,
-			&statscommand.Stat{Name: "user>>>" + email + ">>>traffic>>>uplink", Value: usage[0]},
-			&statscommand.Stat{Name: "user>>>" + email + ">>>traffic>>>downlink", Value: usage[1]},
-		)
-	}
-	return resp, nil
-}
-
-func (f *fakeStatsServer) GetAllOnlineUsers(ctx context.Context, req *statscommand.GetAllOnlineUsersRequest) (*statscommand.GetAllOnlineUsersResponse, error) {
-	users := make([]string, 0, len(f.onlineIPs))
-	for email := range f.onlineIPs {
-		users = append(users, "user>>>"+email+">>>online")
-	}
-	slices.Sort(users)
-	return &statscommand.GetAllOnlineUsersResponse{Users: users}, nil
-}
-
-func (f *fakeStatsServer) GetStatsOnlineIpList(ctx context.Context, req *statscommand.GetStatsRequest) (*statscommand.GetStatsOnlineIpListResponse, error) {
-	email, ok := emailFromOnlineStatName(req.GetName())
-	if !ok {
-		return &statscommand.GetStatsOnlineIpListResponse{Name: req.GetName()}, nil
-	}
-	return &statscommand.GetStatsOnlineIpListResponse{
-		Name: req.GetName(),
-		Ips:  f.onlineIPs[email],
-	}, nil
-}
-
-func startStatsServer(t *testing.T, values map[string][2]int64, onlineIPs map[string]map[string]int64) (string, func()) {
+func startStatsServer(t *testing.T, values map[string][2]int64, onlineIPs map[string]map[string]int64) string {
 	t.Helper()
-	lis, err := net.Listen("tcp", "127.0.0.1:0")
-	if err != nil {
-		t.Fatalf("listen: %v", err)
+	core := testsupport.NewCore(t)
+	for email, usage := range values {
+		core.SetUserTraffic(email, usage[0], usage[1])
 	}
-	server := grpc.NewServer()
-	statscommand.RegisterStatsServiceServer(server, &fakeStatsServer{values: values, onlineIPs: onlineIPs})
-	go server.Serve(lis)
-	return lis.Addr().String(), func() {
-		server.Stop()
-		_ = lis.Close()
+	for email, ips := range onlineIPs {
+		core.SetOnlineIPs(email, ips)
 	}
+	return core.Addr
 }
 
 func TestCollectorQueryUserBytes(t *testing.T) {
-	addr, closeFn := startStatsServer(t, map[string][2]int64{
+	addr := startStatsServer(t, map[string][2]int64{
 		"user@example.com": {100, 200},
 	}, nil)
-	defer closeFn()
 
 	cfg := &config.Config{}
 	cfg.Xray.APIServer = addr
@@ -88,7 +43,7 @@ func TestCollectorQueryUserBytes(t *testing.T) {
 
 func TestCollectorOnlineUsers(t *testing.T) {
 	now := time.Now().UTC().Unix()
-	addr, closeFn := startStatsServer(
+	addr := startStatsServer(
 		t,
 		nil,
 		map[string]map[string]int64{
@@ -98,7 +53,6 @@ func TestCollectorOnlineUsers(t *testing.T) {
 			},
 		},
 	)
-	defer closeFn()
 
 	cfg := &config.Config{}
 	cfg.Xray.APIServer = addr
@@ -122,3 +76,30 @@ func TestCollectorOnlineUsers(t *testing.T) {
 		t.Fatalf("unexpected ip payload: %+v", out[0].IPs)
 	}
 }
+
+func TestCollectorQueryTraffic(t *testing.T) {
+	core := testsupport.NewCore(t)
+	core.SetUserTraffic("a@example.com", 100, 200)
+	core.SetUserTraffic("b@example.com", 0, 5)
+	core.SetInboundTraffic("vless-in", 1000, 2000)
+	core.SetInboundTraffic("api", 1, 1)
+
+	cfg := &config.Config{}
+	cfg.Xray.APIServer = core.Addr
+	cfg.Xray.APITimeoutSec = 1
+
+	traffic, err := New(cfg, nil).QueryTraffic(context.Background())
+	if err != nil {
+		t.Fatalf("QueryTraffic: %v", err)
+	}
+	if len(traffic.Users) != 2 || traffic.Users["a@example.com"] != [2]int64{100, 200} || traffic.Users["b@example.com"] != [2]int64{0, 5} {
+		t.Fatalf("unexpected users: %v", traffic.Users)
+	}
+	if len(traffic.Inbounds) != 2 || traffic.Inbounds["vless-in"] != [2]int64{1000, 2000} {
+		t.Fatalf("unexpected inbounds: %v", traffic.Inbounds)
+	}
+	// Reading does not reset the counters.
+	if got := core.Counter("user>>>a@example.com>>>traffic>>>uplink"); got != 100 {
+		t.Fatalf("counter reset to %d", got)
+	}
+}
@@ -0,0 +1,194 @@
+// Package supervisor runs xray as a child of the agent when no init system
+// manages it, restarting it with backoff whenever it exits.
+package supervisor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultStopTimeout = 10 * time.Second
+	minRestartDelay    = time.Second
+	maxRestartDelay    = 30 * time.Second
+	// stableAfter resets the restart backoff once a child has run this long.
+	stableAfter = time.Minute
+)
+
+var errStopped = errors.New("supervisor stopped")
+
+type Options struct {
+	Binary string
+	Args   []string
+	// StopTimeout is how long a child gets to exit after SIGTERM before it is
+	// killed (default 10s).
+	StopTimeout time.Duration
+	// Stdout and Stderr receive the child's output (default os.Stdout and
+	// os.Stderr, which is where container runtimes collect logs).
+	Stdout io.Writer
+	Stderr io.Writer
+	Logger *slog.Logger
+}
+
+// Supervisor keeps one child process running until its context is done.
+type Supervisor struct {
+	opts     Options
+	log      *slog.Logger
+	restarts chan chan error
+	done     chan struct{}
+}
+
+type child struct {
+	cmd       *exec.Cmd
+	cancel    context.CancelFunc
+	startedAt time.Time
+	exited    chan error
+}
+
+func New(opts Options) *Supervisor {
+	if opts.StopTimeout <= 0 {
+		opts.StopTimeout = defaultStopTimeout
+	}
+	if opts.Stdout == nil {
+		opts.Stdout = os.Stdout
+	}
+	if opts.Stderr == nil {
+		opts.Stderr = os.Stderr
+	}
+	log := opts.Logger
+	if log == nil {
+		log = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	return &Supervisor{
+		opts:     opts,
+		log:      log,
+		restarts: make(chan chan error),
+		done:     make(chan struct{}),
+	}
+}
+
+// Start launches the child and keeps it running in the background until ctx
+// is done, at which point the child is stopped and Done is closed. Only a
+// failure to launch the first child is returned; later crashes are retried.
+func (s *Supervisor) Start(ctx context.Context) error {
+	c, err := s.spawn()
+	if err != nil {
+		close(s.done)
+		return err
+	}
+	go s.loop(ctx, c)
+	return nil
+}
+
+// Done is closed once the child has been stopped after ctx was cancelled.
+func (s *Supervisor) Done() <-chan struct{} {
+	return s.done
+}
+
+// Restart stops the running child and launches a new one, e.g. after the
+// binary was replaced. It returns the launch error, if any; the supervisor
+// keeps retrying in that case.
+func (s *Supervisor) Restart(ctx context.Context) error {
+	reply := make(chan error, 1)
+	select {
+	case s.restarts <- reply:
+	case <-s.done:
+		return errStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-reply:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Supervisor) loop(ctx context.Context, c *child) {
+	defer close(s.done)
+
+	delay := minRestartDelay
+	var retry <-chan time.Time
+	for {
+		var exited <-chan error
+		if c != nil {
+			exited = c.exited
+		}
+
+		select {
+		case <-ctx.Done():
+			if c != nil {
+				c.stop()
+			}
+			s.log.Info("xray stopped")
+			return
+		case reply := <-s.restarts:
+			if c != nil {
+				c.stop()
+			}
+			var err error
+			c, err = s.spawn()
+			retry = nil
+			if err != nil {
+				retry = time.After(delay)
+			}
+			reply <- err
+		case err := <-exited:
+			uptime := time.Since(c.startedAt)
+			c = nil
+			if uptime >= stableAfter {
+				delay = minRestartDelay
+			}
+			s.log.Warn("xray exited; restarting", "err", err, "uptime", uptime.Round(time.Second), "delay", delay)
+			retry = time.After(delay)
+			delay = min(delay*2, maxRestartDelay)
+		case <-retry:
+			retry = nil
+			var err error
+			if c, err = s.spawn(); err != nil {
+				s.log.Warn("xray start failed", "err", err, "delay", delay)
+				retry = time.After(delay)
+				delay = min(delay*2, maxRestartDelay)
+			}
+		}
+	}
+}
+
+func (s *Supervisor) spawn() (*child, error) {
+	// The child gets its own context so that stopping it is always an
+	// explicit SIGTERM followed by a bounded wait.
+	ctx, cancel := context.WithCancel(context.Background())
+	cmd := exec.CommandContext(ctx, s.opts.Binary, s.opts.Args...)
+	cmd.Stdout = s.opts.Stdout
+	cmd.Stderr = s.opts.Stderr
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(syscall.SIGTERM)
+	}
+	cmd.WaitDelay = s.opts.StopTimeout
+	if err := cmd.Start(); err != nil {
+		cancel()
+		return nil, fmt.Errorf("start %s: %w", s.opts.Binary, err)
+	}
+	s.log.Info("xray started", "pid", cmd.Process.Pid, "binary", s.opts.Binary)
+
+	c := &child{cmd: cmd, cancel: cancel, startedAt: time.Now(), exited: make(chan error, 1)}
+	go func() {
+		c.exited <- cmd.Wait()
+	}()
+	return c, nil
+}
+
+// stop sends SIGTERM and waits for the child, which exec kills after
+// StopTimeout if it is still running.
+func (c *child) stop() {
+	c.cancel()
+	<-c.exited
+}
@@ -0,0 +1,105 @@
+package supervisor
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lockedBuffer collects child output written from exec's copy goroutines.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) lines() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return strings.Fields(b.buf.String())
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSupervisorRestartsExitedChild(t *testing.T) {
+	out := &lockedBuffer{}
+	s := New(Options{
+		Binary: "/bin/sh",
+		Args:   []string{"-c", "echo started"},
+		Stdout: out,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := s.Start(ctx); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	waitFor(t, "second start", func() bool { return len(out.lines()) >= 2 })
+	cancel()
+	<-s.Done()
+}
+
+func TestSupervisorRestartReplacesChild(t *testing.T) {
+	out := &lockedBuffer{}
+	s := New(Options{
+		Binary:      "/bin/sh",
+		Args:        []string{"-c", "echo $$; exec sleep 30"},
+		StopTimeout: time.Second,
+		Stdout:      out,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := s.Start(ctx); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	waitFor(t, "first pid", func() bool { return len(out.lines()) == 1 })
+
+	if err := s.Restart(ctx); err != nil {
+		t.Fatalf("Restart: %v", err)
+	}
+	waitFor(t, "second pid", func() bool { return len(out.lines()) == 2 })
+	pids := out.lines()
+	if pids[0] == pids[1] {
+		t.Fatalf("restart kept pid %s", pids[0])
+	}
+
+	cancel()
+	select {
+	case <-s.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("supervisor did not stop")
+	}
+	if _, err := os.Stat(filepath.Join("/proc", pids[1])); err == nil {
+		t.Fatalf("child %s still running after stop", pids[1])
+	}
+	if err := s.Restart(context.Background()); err == nil {
+		t.Fatal("expected Restart to fail after stop")
+	}
+}
+
+func TestSupervisorStartFailure(t *testing.T) {
+	s := New(Options{Binary: filepath.Join(t.TempDir(), "missing")})
+	if err := s.Start(context.Background()); err == nil {
+		t.Fatal("expected start error")
+	}
+	<-s.Done()
+}
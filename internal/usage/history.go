@@ -0,0 +1,200 @@
+// Package usage keeps the per-user usage the agent reads from the core on
+// the node, so it can be checked against the panel's records and exported.
+package usage
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	fileMode   = 0o640
+	dirMode    = 0o750
+	filePrefix = "usage-"
+	fileSuffix = ".jsonl"
+	dayLayout  = "2006-01-02"
+)
+
+// Sample is the usage of one user since the previous sample.
+type Sample struct {
+	Time     time.Time `json:"time"`
+	Email    string    `json:"email"`
+	Uplink   int64     `json:"uplink"`
+	Downlink int64     `json:"downlink"`
+}
+
+// History stores samples as JSON lines, one file per UTC day named
+// usage-YYYY-MM-DD.jsonl, and deletes the files of days past its retention.
+// It is safe for concurrent use.
+type History struct {
+	dir           string
+	retentionDays int
+
+	mu       sync.Mutex
+	prunedAt string
+}
+
+// NewHistory returns a History in dir keeping retentionDays days; 0 keeps
+// every day.
+func NewHistory(dir string, retentionDays int) *History {
+	return &History{dir: dir, retentionDays: retentionDays}
+}
+
+func (h *History) Dir() string {
+	return h.dir
+}
+
+// Append writes samples to the files of their days. The files are opened
+// for every call, so they can be copied or moved away at any time. The
+// first write of a day also prunes the days past the retention.
+func (h *History) Append(samples []Sample) error {
+	if len(samples) == 0 {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := os.MkdirAll(h.dir, dirMode); err != nil {
+		return err
+	}
+	byDay := map[string][]byte{}
+	var days []string
+	for _, s := range samples {
+		line, err := json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		day := s.Time.UTC().Format(dayLayout)
+		if _, ok := byDay[day]; !ok {
+			days = append(days, day)
+		}
+		byDay[day] = append(append(byDay[day], line...), '\n')
+	}
+	for _, day := range days {
+		f, err := os.OpenFile(h.path(day), os.O_CREATE|os.O_WRONLY|os.O_APPEND, fileMode)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(byDay[day]); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+	if today := slices.Max(days); today != h.prunedAt {
+		h.prunedAt = today
+		if _, err := h.prune(samples[0].Time); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Prune deletes the files of days more than the retention before now and
+// returns how many it deleted.
+func (h *History) Prune(now time.Time) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.prune(now)
+}
+
+func (h *History) prune(now time.Time) (int, error) {
+	if h.retentionDays <= 0 {
+		return 0, nil
+	}
+	oldest := now.UTC().AddDate(0, 0, -h.retentionDays).Format(dayLayout)
+	days, err := h.days()
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, day := range days {
+		if day >= oldest {
+			break
+		}
+		if err := os.Remove(h.path(day)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// Read calls fn with the samples from from up to but excluding to, oldest
+// day first and in the order they were written within a day. Lines that do
+// not parse, such as one cut short by a crash, are skipped. An error from
+// fn stops the read and is returned.
+func (h *History) Read(from, to time.Time, fn func(Sample) error) error {
+	days, err := h.days()
+	if err != nil {
+		return err
+	}
+	first, last := from.UTC().Format(dayLayout), to.UTC().Format(dayLayout)
+	for _, day := range days {
+		if day < first || day > last {
+			continue
+		}
+		if err := h.readDay(day, from, to, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *History) readDay(day string, from, to time.Time, fn func(Sample) error) error {
+	f, err := os.Open(h.path(day))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var s Sample
+		if json.Unmarshal(sc.Bytes(), &s) != nil || s.Time.Before(from) || !s.Time.Before(to) {
+			continue
+		}
+		if err := fn(s); err != nil {
+			return err
+		}
+	}
+	return sc.Err()
+}
+
+// days lists the days with a file, oldest first.
+func (h *History) days() ([]string, error) {
+	entries, err := os.ReadDir(h.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var days []string
+	for _, e := range entries {
+		day, ok := strings.CutPrefix(e.Name(), filePrefix)
+		if !ok {
+			continue
+		}
+		day, ok = strings.CutSuffix(day, fileSuffix)
+		if _, err := time.Parse(dayLayout, day); ok && err == nil {
+			days = append(days, day)
+		}
+	}
+	slices.Sort(days)
+	return days, nil
+}
+
+func (h *History) path(day string) string {
+	return filepath.Join(h.dir, filePrefix+day+fileSuffix)
+}
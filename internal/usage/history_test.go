@@ -0,0 +1,64 @@
+package usage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHistoryAppendReadPrune(t *testing.T) {
+	dir := t.TempDir()
+	h := NewHistory(dir, 2)
+	day := time.Date(2025, 11, 7, 23, 59, 0, 0, time.UTC)
+	samples := []Sample{
+		{Time: day.AddDate(0, 0, -3), Email: "a@example.com", Uplink: 1, Downlink: 2},
+		{Time: day, Email: "a@example.com", Uplink: 3, Downlink: 4},
+		{Time: day, Email: "b@example.com", Uplink: 5, Downlink: 6},
+	}
+	if err := h.Append(samples[:1]); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	if err := h.Append(samples[1:]); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	// The sample three days back is past the retention of the newer day.
+	if _, err := os.Stat(filepath.Join(dir, "usage-2025-11-04.jsonl")); !os.IsNotExist(err) {
+		t.Fatalf("old day not pruned: %v", err)
+	}
+
+	// A line cut short by a crash and unrelated files are skipped.
+	f, err := os.OpenFile(filepath.Join(dir, "usage-2025-11-07.jsonl"), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"time":"2025-11-07T23:59:30Z","email":"c@exa`)
+	f.Close()
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("x"), 0o600)
+
+	var got []Sample
+	read := func(from, to time.Time) {
+		got = nil
+		if err := h.Read(from, to, func(s Sample) error {
+			got = append(got, s)
+			return nil
+		}); err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+	}
+	read(day.AddDate(0, 0, -10), day.Add(time.Minute))
+	if len(got) != 2 || got[0] != samples[1] || got[1] != samples[2] {
+		t.Fatalf("samples = %+v", got)
+	}
+	read(day.Add(-time.Hour), day)
+	if len(got) != 0 {
+		t.Fatalf("samples before the window = %+v", got)
+	}
+
+	if n, err := h.Prune(day.AddDate(0, 0, 3)); err != nil || n != 1 {
+		t.Fatalf("Prune = %d, %v", n, err)
+	}
+	if n, err := NewHistory(dir, 0).Prune(day.AddDate(1, 0, 0)); err != nil || n != 0 {
+		t.Fatalf("Prune without retention = %d, %v", n, err)
+	}
+}
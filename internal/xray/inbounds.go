@@ -0,0 +1,127 @@
+package xray
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/najahiiii/xray-agent/internal/config"
+	"github.com/najahiiii/xray-agent/internal/xrayapi"
+	"github.com/najahiiii/xray-agent/internal/xrayconf"
+
+	handlerService "github.com/xtls/xray-core/app/proxyman/command"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ErrListInboundsUnsupported is returned by ListInbounds when the core
+// predates the HandlerService.ListInbounds call.
+var ErrListInboundsUnsupported = errors.New("xray core does not support listing inbounds")
+
+// ListInbounds returns the proxy protocol (vless, vmess, trojan, ...) of
+// every tagged inbound of the running core, by tag.
+func (m *Manager) ListInbounds(ctx context.Context) (map[string]string, error) {
+	conn, err := xrayapi.Dial(m.cfg)
+	if err != nil {
+		return nil, err
+	}
+	conn.Connect()
+	defer conn.Close()
+
+	callCtx, cancel := context.WithTimeout(ctx, m.apiTimeout())
+	defer cancel()
+	resp, err := handlerService.NewHandlerServiceClient(conn).ListInbounds(callCtx, &handlerService.ListInboundsRequest{})
+	if err != nil {
+		if status.Code(err) == codes.Unimplemented {
+			return nil, ErrListInboundsUnsupported
+		}
+		return nil, err
+	}
+	inbounds := make(map[string]string, len(resp.GetInbounds()))
+	for _, in := range resp.GetInbounds() {
+		if in.GetTag() != "" {
+			inbounds[in.GetTag()] = inboundProtocol(in.GetProxySettings().GetType())
+		}
+	}
+	return inbounds, nil
+}
+
+// inboundProtocol turns a proxy settings type such as
+// xray.proxy.vless.inbound.Config into vless.
+func inboundProtocol(typ string) string {
+	parts := strings.Split(typ, ".")
+	if len(parts) < 3 || parts[0] != "xray" || parts[1] != "proxy" {
+		return ""
+	}
+	return parts[2]
+}
+
+// DiscoverInbounds lists the inbounds of the running core, or of the xray
+// config at configPath when the core cannot be asked, e.g. because it is
+// still starting or too old to list inbounds. source names where they came
+// from.
+func (m *Manager) DiscoverInbounds(ctx context.Context, configPath string) (inbounds map[string]string, source string, err error) {
+	inbounds, apiErr := m.ListInbounds(ctx)
+	if apiErr == nil {
+		return inbounds, "core", nil
+	}
+	file, err := xrayconf.Load(configPath)
+	if err != nil {
+		return nil, "", fmt.Errorf("list inbounds: %w; read %s: %w", apiErr, configPath, err)
+	}
+	return file.InboundProtocols(), configPath, nil
+}
+
+// ResolveInboundTags checks xray.inbound_tags against the discovered
+// inbounds (protocol by tag). A configured tag that does not exist is an
+// error; an empty vless, vmess or trojan tag is filled in when exactly one
+// inbound has that protocol. It returns the tags it filled in, by proto.
+func ResolveInboundTags(cfg *config.Config, inbounds map[string]string) (map[string]string, error) {
+	tags := &cfg.Xray.InboundTags
+	fields := []struct {
+		proto string
+		tag   *string
+	}{
+		{"vless", &tags.VLESS},
+		{"vmess", &tags.VMESS},
+		{"trojan", &tags.TROJAN},
+		{"wireguard", &tags.WireGuard},
+	}
+	known := strings.Join(slices.Sorted(maps.Keys(inbounds)), ", ")
+	filled := map[string]string{}
+	var errs []error
+	for _, f := range fields {
+		if *f.tag != "" {
+			if _, ok := inbounds[*f.tag]; !ok {
+				errs = append(errs, fmt.Errorf("xray.inbound_tags.%s: no inbound tagged %q (inbounds: %s)", f.proto, *f.tag, known))
+			}
+			continue
+		}
+		// WireGuard peers are only managed when asked for.
+		if f.proto == "wireguard" {
+			continue
+		}
+		var candidates []string
+		for tag, proto := range inbounds {
+			if proto == f.proto {
+				candidates = append(candidates, tag)
+			}
+		}
+		switch len(candidates) {
+		case 0:
+		case 1:
+			*f.tag = candidates[0]
+			filled[f.proto] = candidates[0]
+		default:
+			slices.Sort(candidates)
+			errs = append(errs, fmt.Errorf("xray.inbound_tags.%s is not set and there are several %s inbounds (%s); set it to one of them", f.proto, f.proto, strings.Join(candidates, ", ")))
+		}
+	}
+	if len(errs) == 0 && tags.VLESS == "" && tags.VMESS == "" && tags.TROJAN == "" {
+		errs = append(errs, fmt.Errorf("xray.inbound_tags: no vless, vmess or trojan inbound is configured or found (inbounds: %s)", known))
+	}
+	return filled, errors.Join(errs...)
+}
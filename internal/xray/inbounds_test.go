@@ -0,0 +1,99 @@
+package xray
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/najahiiii/xray-agent/internal/config"
+	"github.com/najahiiii/xray-agent/internal/model"
+	"github.com/najahiiii/xray-agent/testsupport"
+)
+
+func TestDiscoverInbounds(t *testing.T) {
+	core := testsupport.NewCore(t)
+	core.AddProtocolInbound("vless", "vless-in")
+	core.AddProtocolInbound("trojan", "trojan-in")
+	core.AddInbound("api")
+
+	cfg := &config.Config{}
+	cfg.Xray.APIServer = core.Addr
+	cfg.Xray.APITimeoutSec = 1
+	mgr := NewManager(cfg, nil)
+
+	got, source, err := mgr.DiscoverInbounds(context.Background(), "/nonexistent/config.json")
+	if err != nil {
+		t.Fatalf("DiscoverInbounds: %v", err)
+	}
+	want := map[string]string{"vless-in": "vless", "trojan-in": "trojan", "api": ""}
+	if source != "core" || !reflect.DeepEqual(got, want) {
+		t.Fatalf("DiscoverInbounds = %v from %s, want %v from the core", got, source, want)
+	}
+
+	// Without the core, the inbounds come from the xray config.
+	core.Close()
+	path := filepath.Join(t.TempDir(), "config.json")
+	body := `{"inbounds": [{"tag": "vmess-in", "protocol": "vmess", "port": 443}, {"protocol": "socks"}]}`
+	if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	got, source, err = mgr.DiscoverInbounds(context.Background(), path)
+	if err != nil {
+		t.Fatalf("DiscoverInbounds from file: %v", err)
+	}
+	if source != path || !reflect.DeepEqual(got, map[string]string{"vmess-in": "vmess"}) {
+		t.Fatalf("DiscoverInbounds = %v from %s", got, source)
+	}
+}
+
+func TestResolveInboundTags(t *testing.T) {
+	inbounds := map[string]string{"vless-a": "vless", "vless-b": "vless", "vm": "vmess", "tj": "trojan", "wg": "wireguard"}
+
+	cfg := &config.Config{}
+	cfg.Xray.InboundTags.VLESS = "vless-b"
+	filled, err := ResolveInboundTags(cfg, inbounds)
+	if err != nil {
+		t.Fatalf("ResolveInboundTags: %v", err)
+	}
+	tags := cfg.Xray.InboundTags
+	if tags.VLESS != "vless-b" || tags.VMESS != "vm" || tags.TROJAN != "tj" || tags.WireGuard != "" {
+		t.Fatalf("inbound tags = %+v", tags)
+	}
+	if !reflect.DeepEqual(filled, map[string]string{"vmess": "vm", "trojan": "tj"}) {
+		t.Fatalf("filled = %v", filled)
+	}
+
+	for name, tc := range map[string]struct {
+		vless, want string
+		inbounds    map[string]string
+	}{
+		"missing tag": {vless: "vless", want: `xray.inbound_tags.vless: no inbound tagged "vless"`, inbounds: inbounds},
+		"ambiguous":   {want: "several vless inbounds (vless-a, vless-b)", inbounds: inbounds},
+		"none":        {want: "no vless, vmess or trojan inbound", inbounds: map[string]string{"api": "dokodemo"}},
+	} {
+		cfg := &config.Config{}
+		cfg.Xray.InboundTags.VLESS = tc.vless
+		if _, err := ResolveInboundTags(cfg, tc.inbounds); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: err = %v, want %q", name, err, tc.want)
+		}
+	}
+}
+
+func TestManagerStateNamesMissingInbound(t *testing.T) {
+	core := testsupport.NewCore(t)
+	core.SetStrict(true)
+
+	cfg := &config.Config{}
+	cfg.Xray.APIServer = core.Addr
+	cfg.Xray.APITimeoutSec = 1
+	cfg.Xray.InboundTags.VLESS = "vless-tag"
+
+	desired := []model.Client{{Proto: "vless", ID: "1", Email: "a@example.com"}}
+	_, _, err := NewManager(cfg, nil).State(context.Background(), nil, desired, nil, nil)
+	if err == nil || !strings.Contains(err.Error(), `xray has no inbound tagged "vless-tag"`) {
+		t.Fatalf("State = %v, want an error naming the missing inbound", err)
+	}
+}
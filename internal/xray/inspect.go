@@ -0,0 +1,185 @@
+package xray
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/najahiiii/xray-agent/internal/model"
+	"github.com/najahiiii/xray-agent/internal/xrayapi"
+
+	handlerService "github.com/xtls/xray-core/app/proxyman/command"
+	routerService "github.com/xtls/xray-core/app/router/command"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Rule comparison results reported by CompareRules.
+const (
+	RuleInSync           = "in_sync"
+	RuleMissing          = "missing"
+	RuleOutboundMismatch = "outbound_mismatch"
+	RuleUnmanaged        = "unmanaged"
+	RuleUnverified       = "unverified"
+)
+
+// ErrListRulesUnsupported is returned by ListRules when the core predates the
+// RoutingService.ListRule call.
+var ErrListRulesUnsupported = errors.New("xray core does not support listing routing rules")
+
+// CoreRule is a routing rule as reported by the core. ListRule only exposes
+// the rule tag and the outbound tag, so matchers cannot be compared.
+type CoreRule struct {
+	RuleTag     string `json:"rule_tag"`
+	OutboundTag string `json:"outbound_tag,omitempty"`
+}
+
+// RuleReport compares one rule tag between the agent and the core.
+type RuleReport struct {
+	Tag     string           `json:"tag"`
+	Status  string           `json:"status"`
+	Managed *model.RouteRule `json:"managed,omitempty"`
+	Core    *CoreRule        `json:"core,omitempty"`
+}
+
+// ListRules returns the routing rules currently installed in the core, in
+// match order.
+func (m *Manager) ListRules(ctx context.Context) ([]CoreRule, error) {
+	conn, err := xrayapi.Dial(m.cfg)
+	if err != nil {
+		return nil, err
+	}
+	conn.Connect()
+	defer conn.Close()
+
+	callCtx, cancel := context.WithTimeout(ctx, m.apiTimeout())
+	defer cancel()
+	resp, err := routerService.NewRoutingServiceClient(conn).ListRule(callCtx, &routerService.ListRuleRequest{})
+	if err != nil {
+		if status.Code(err) == codes.Unimplemented {
+			return nil, ErrListRulesUnsupported
+		}
+		return nil, err
+	}
+
+	rules := make([]CoreRule, 0, len(resp.GetRules()))
+	for _, r := range resp.GetRules() {
+		rules = append(rules, CoreRule{RuleTag: r.GetRuleTag(), OutboundTag: r.GetTag()})
+	}
+	return rules, nil
+}
+
+// CompareRules lines up the managed routes with the core's rules by tag.
+// Managed routes come first in their own order, followed by untagged or
+// foreign core rules as unmanaged. With a nil core list (the core cannot list
+// rules) every managed route is reported as unverified.
+func CompareRules(managed []model.RouteRule, core []CoreRule) []RuleReport {
+	coreByTag := make(map[string]CoreRule, len(core))
+	for _, r := range core {
+		if r.RuleTag != "" {
+			coreByTag[r.RuleTag] = r
+		}
+	}
+
+	reports := make([]RuleReport, 0, len(managed)+len(core))
+	seen := make(map[string]bool, len(managed))
+	for _, want := range managed {
+		seen[want.Tag] = true
+		report := RuleReport{Tag: want.Tag, Managed: &want}
+		got, ok := coreByTag[want.Tag]
+		switch {
+		case core == nil:
+			report.Status = RuleUnverified
+		case !ok:
+			report.Status = RuleMissing
+		case want.OutboundTag != "" && got.OutboundTag != want.OutboundTag:
+			report.Status = RuleOutboundMismatch
+			report.Core = &got
+		default:
+			report.Status = RuleInSync
+			report.Core = &got
+		}
+		reports = append(reports, report)
+	}
+	for _, r := range core {
+		if seen[r.RuleTag] {
+			continue
+		}
+		reports = append(reports, RuleReport{Tag: r.RuleTag, Status: RuleUnmanaged, Core: &r})
+	}
+	return reports
+}
+
+// RulesInSync reports whether no managed route is missing from the core or
+// points at another outbound. Unmanaged core rules, e.g. from the static xray
+// config, do not count as drift.
+func RulesInSync(reports []RuleReport) bool {
+	return !slices.ContainsFunc(reports, func(r RuleReport) bool {
+		return r.Status == RuleMissing || r.Status == RuleOutboundMismatch
+	})
+}
+
+// ErrListUsersUnsupported is returned by ListUsers when the core predates
+// the HandlerService.GetInboundUsers call.
+var ErrListUsersUnsupported = errors.New("xray core does not support listing inbound users")
+
+// CoreUser is a user as reported by one of the core's inbounds.
+type CoreUser struct {
+	InboundTag string `json:"inbound_tag"`
+	Proto      string `json:"proto"`
+	Email      string `json:"email"`
+}
+
+// ListUsers returns the users of every vless, vmess and trojan inbound of
+// the core, sorted by inbound tag and email. Inbounds are discovered with
+// ListInbounds; a core that cannot list them is asked for the configured
+// xray.inbound_tags instead.
+func (m *Manager) ListUsers(ctx context.Context) ([]CoreUser, error) {
+	inbounds, err := m.ListInbounds(ctx)
+	if errors.Is(err, ErrListInboundsUnsupported) {
+		inbounds = map[string]string{}
+		for _, proto := range Protocols() {
+			if tag := m.tagForProto(proto); tag != "" {
+				inbounds[tag] = proto
+			}
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	conn, err := xrayapi.Dial(m.cfg)
+	if err != nil {
+		return nil, err
+	}
+	conn.Connect()
+	defer conn.Close()
+	client := handlerService.NewHandlerServiceClient(conn)
+
+	var users []CoreUser
+	for _, tag := range slices.Sorted(maps.Keys(inbounds)) {
+		proto := inbounds[tag]
+		if !slices.Contains(Protocols(), proto) {
+			continue
+		}
+		callCtx, cancel := context.WithTimeout(ctx, m.apiTimeout())
+		resp, err := client.GetInboundUsers(callCtx, &handlerService.GetInboundUserRequest{Tag: tag})
+		cancel()
+		if err != nil {
+			if status.Code(err) == codes.Unimplemented {
+				return nil, ErrListUsersUnsupported
+			}
+			return nil, fmt.Errorf("inbound %s: %w", tag, err)
+		}
+		var emails []string
+		for _, u := range resp.GetUsers() {
+			emails = append(emails, u.GetEmail())
+		}
+		slices.Sort(emails)
+		for _, email := range emails {
+			users = append(users, CoreUser{InboundTag: tag, Proto: proto, Email: email})
+		}
+	}
+	return users, nil
+}
@@ -0,0 +1,118 @@
+package xray
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/najahiiii/xray-agent/internal/config"
+	"github.com/najahiiii/xray-agent/internal/model"
+	"github.com/najahiiii/xray-agent/testsupport"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestListRulesAndCompare(t *testing.T) {
+	core := testsupport.NewCore(t)
+	cfg := &config.Config{}
+	cfg.Xray.APIServer = core.Addr
+	cfg.Xray.APITimeoutSec = 1
+	mgr := NewManager(cfg, nil)
+
+	managed := []model.RouteRule{
+		{Tag: "ads", OutboundTag: "blocked", Domain: []string{"domain:ads.example.com"}},
+		{Tag: "cn", OutboundTag: "direct", IP: []string{"10.0.0.0/8"}},
+		{Tag: "lb", BalancerTag: "pool", Port: "443"},
+	}
+	if _, _, err := mgr.State(context.Background(), map[string]model.Client{}, nil, map[string]model.RouteRule{}, managed[:1]); err != nil {
+		t.Fatalf("State: %v", err)
+	}
+	core.SeedRule("cn", "proxy")
+	core.SeedRule("static", "direct")
+
+	rules, err := mgr.ListRules(context.Background())
+	if err != nil {
+		t.Fatalf("ListRules: %v", err)
+	}
+	if len(rules) != 3 || rules[0] != (CoreRule{RuleTag: "ads", OutboundTag: "blocked"}) {
+		t.Fatalf("unexpected core rules: %+v", rules)
+	}
+
+	reports := CompareRules(managed, rules)
+	want := map[string]string{
+		"ads":    RuleInSync,
+		"cn":     RuleOutboundMismatch,
+		"lb":     RuleMissing,
+		"static": RuleUnmanaged,
+	}
+	if len(reports) != len(want) {
+		t.Fatalf("unexpected reports: %+v", reports)
+	}
+	for _, r := range reports {
+		if want[r.Tag] != r.Status {
+			t.Fatalf("%s: status %s, want %s", r.Tag, r.Status, want[r.Tag])
+		}
+	}
+	if RulesInSync(reports) {
+		t.Fatal("expected drift")
+	}
+	if !RulesInSync(CompareRules(managed[:1], rules[:1])) {
+		t.Fatal("expected in sync")
+	}
+}
+
+func TestCompareRulesWithoutCoreList(t *testing.T) {
+	reports := CompareRules([]model.RouteRule{{Tag: "ads", OutboundTag: "blocked"}}, nil)
+	if len(reports) != 1 || reports[0].Status != RuleUnverified {
+		t.Fatalf("unexpected reports: %+v", reports)
+	}
+}
+
+func TestListUsers(t *testing.T) {
+	core := testsupport.NewCore(t)
+	core.AddProtocolInbound("vless", "vless-in")
+	core.AddProtocolInbound("trojan", "trojan-in")
+	core.AddProtocolInbound("dokodemo-door", "api")
+	cfg := &config.Config{}
+	cfg.Xray.APIServer = core.Addr
+	cfg.Xray.APITimeoutSec = 1
+	cfg.Xray.InboundTags.VLESS = "vless-in"
+	cfg.Xray.InboundTags.TROJAN = "trojan-in"
+	mgr := NewManager(cfg, nil)
+
+	desired := []model.Client{
+		{Proto: "vless", ID: "11111111-1111-1111-1111-111111111111", Email: "b@example.com"},
+		{Proto: "vless", ID: "22222222-2222-2222-2222-222222222222", Email: "a@example.com"},
+		{Proto: "trojan", Password: "secret", Email: "c@example.com"},
+	}
+	if _, _, err := mgr.State(context.Background(), map[string]model.Client{}, desired, map[string]model.RouteRule{}, nil); err != nil {
+		t.Fatalf("State: %v", err)
+	}
+
+	users, err := mgr.ListUsers(context.Background())
+	if err != nil {
+		t.Fatalf("ListUsers: %v", err)
+	}
+	want := []CoreUser{
+		{InboundTag: "trojan-in", Proto: "trojan", Email: "c@example.com"},
+		{InboundTag: "vless-in", Proto: "vless", Email: "a@example.com"},
+		{InboundTag: "vless-in", Proto: "vless", Email: "b@example.com"},
+	}
+	if !slices.Equal(users, want) {
+		t.Fatalf("ListUsers = %+v, want %+v", users, want)
+	}
+
+	// A core without ListInbounds is asked for the configured tags.
+	core.FailMethod(testsupport.MethodListInbounds, status.Error(codes.Unimplemented, "unknown method"))
+	users, err = mgr.ListUsers(context.Background())
+	if err != nil || !slices.Equal(users, want) {
+		t.Fatalf("ListUsers without ListInbounds = %+v, %v", users, err)
+	}
+
+	core.FailMethod(testsupport.MethodGetInboundUsers, status.Error(codes.Unimplemented, "unknown method"))
+	if _, err := mgr.ListUsers(context.Background()); !errors.Is(err, ErrListUsersUnsupported) {
+		t.Fatalf("ListUsers error = %v", err)
+	}
+}
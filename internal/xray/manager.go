@@ -3,13 +3,19 @@ package xray
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"maps"
+	"math"
 	"slices"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/najahiiii/xray-agent/internal/audit"
 	"github.com/najahiiii/xray-agent/internal/config"
 	"github.com/najahiiii/xray-agent/internal/model"
+	"github.com/najahiiii/xray-agent/internal/xrayapi"
 
 	handlerService "github.com/xtls/xray-core/app/proxyman/command"
 	routerService "github.com/xtls/xray-core/app/router/command"
@@ -19,9 +25,8 @@ import (
 	"github.com/xtls/xray-core/proxy/trojan"
 	"github.com/xtls/xray-core/proxy/vless"
 	"github.com/xtls/xray-core/proxy/vmess"
-	"google.golang.org/grpc"
+	"golang.org/x/time/rate"
 	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/status"
 
 	"log/slog"
@@ -30,33 +35,46 @@ import (
 type Manager struct {
 	cfg *config.Config
 	log *slog.Logger
+
+	mu      sync.Mutex
+	limiter *rate.Limiter
+	audit   *audit.Log
 }
 
 func NewManager(cfg *config.Config, log *slog.Logger) *Manager {
 	return &Manager{cfg: cfg, log: log}
 }
 
-func (m *Manager) State(ctx context.Context, currentClients map[string]model.Client, desiredClients []model.Client, currentRoutes map[string]model.RouteRule, desiredRoutes []model.RouteRule) (bool, error) {
+// SetAudit records every user, route and outbound change in l.
+func (m *Manager) SetAudit(l *audit.Log) {
+	m.audit = l
+}
+
+// State applies the desired users and route rules. A rule xray rejects does
+// not stop the others; it is returned in failedRoutes by tag and is no
+// longer in xray. err is only set when xray could not be reached or a user
+// change failed.
+func (m *Manager) State(ctx context.Context, currentClients map[string]model.Client, desiredClients []model.Client, currentRoutes map[string]model.RouteRule, desiredRoutes []model.RouteRule) (changed bool, failedRoutes map[string]error, err error) {
 	clientsChanged, err := m.applyViaHandler(ctx, currentClients, desiredClients)
 	if err != nil {
-		return false, err
+		return false, nil, err
 	}
 
-	routesChanged, err := m.applyRoutes(ctx, currentRoutes, desiredRoutes)
+	routesChanged, failedRoutes, err := m.applyRoutes(ctx, currentRoutes, desiredRoutes)
 	if err != nil {
-		return clientsChanged, err
+		return clientsChanged, nil, err
 	}
 
-	return clientsChanged || routesChanged, nil
+	return clientsChanged || routesChanged, failedRoutes, nil
 }
 
 func (m *Manager) applyViaHandler(ctx context.Context, current map[string]model.Client, desired []model.Client) (bool, error) {
-	adds, removes := diffClients(current, desired)
+	adds, removes, moved := m.diffClients(current, desired)
 	if len(adds) == 0 && len(removes) == 0 {
 		return false, nil
 	}
 
-	conn, err := grpc.NewClient(m.cfg.Xray.APIServer, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	conn, err := xrayapi.Dial(m.cfg)
 	if err != nil {
 		return false, err
 	}
@@ -65,21 +83,52 @@ func (m *Manager) applyViaHandler(ctx context.Context, current map[string]model.
 
 	client := handlerService.NewHandlerServiceClient(conn)
 
-	for _, c := range removes {
-		if err := m.removeUser(ctx, client, c); err != nil {
-			return false, err
+	// Removes finish before any add starts, so a user that is removed and
+	// added again in one sync ends up added.
+	workers := m.cfg.Xray.ApplyWorkers
+	if err := forEach(ctx, workers, removes, func(ctx context.Context, c model.Client) error {
+		err := m.removeUser(ctx, client, c)
+		m.audit.Record(ctx, "user", "remove", c.Email, m.inboundTag(c), err)
+		if err != nil {
+			return fmt.Errorf("remove %s: %w", c.Email, err)
 		}
+		return nil
+	}); err != nil {
+		return false, err
 	}
-	for _, c := range adds {
-		if err := m.addUser(ctx, client, c); err != nil {
-			return false, err
+	if err := forEach(ctx, workers, adds, func(ctx context.Context, c model.Client) error {
+		action := "add"
+		if cur, ok := current[c.Email]; ok && m.inboundTag(cur) != m.inboundTag(c) {
+			action = "move"
+		} else if ok {
+			action = "update"
 		}
+		err := m.addUser(ctx, client, c)
+		m.audit.Record(ctx, "user", action, c.Email, m.inboundTag(c), err)
+		return err
+	}); err != nil {
+		return false, err
+	}
+	// Users switching inbounds are already live on the new tag, so dropping
+	// them from the old one no longer disconnects anybody.
+	if err := forEach(ctx, workers, moved, func(ctx context.Context, c model.Client) error {
+		err := m.removeUser(ctx, client, c)
+		m.audit.Record(ctx, "user", "remove", c.Email, m.inboundTag(c), err)
+		if err != nil {
+			return fmt.Errorf("remove %s from previous inbound %s: %w", c.Email, m.inboundTag(c), err)
+		}
+		return nil
+	}); err != nil {
+		return false, err
+	}
+	if len(moved) > 0 && m.log != nil {
+		m.log.Info("moved users to new inbound tags", "count", len(moved))
 	}
 	return true, nil
 }
 
 func (m *Manager) removeUser(ctx context.Context, client handlerService.HandlerServiceClient, c model.Client) error {
-	tag := m.tagForProto(c.Proto)
+	tag := m.inboundTag(c)
 	if tag == "" {
 		return fmt.Errorf("inbound tag for proto %s not configured", c.Proto)
 	}
@@ -87,6 +136,9 @@ func (m *Manager) removeUser(ctx context.Context, client handlerService.HandlerS
 		Tag:       tag,
 		Operation: serial.ToTypedMessage(&handlerService.RemoveUserOperation{Email: c.Email}),
 	}
+	if err := m.throttle(ctx); err != nil {
+		return err
+	}
 	callCtx, cancel := context.WithTimeout(ctx, m.apiTimeout())
 	defer cancel()
 
@@ -95,14 +147,16 @@ func (m *Manager) removeUser(ctx context.Context, client handlerService.HandlerS
 }
 
 func (m *Manager) addUser(ctx context.Context, client handlerService.HandlerServiceClient, c model.Client) error {
-	// ensure we don't leave stale runtime users (e.g., after agent restart)
+	// xray refuses a second user with the same email, so drop the one it may
+	// still have: a stale user after an agent restart, or the old
+	// credentials of a user changed in place.
 	_ = m.removeUser(ctx, client, c)
 
 	user, err := buildUser(c)
 	if err != nil {
 		return err
 	}
-	tag := m.tagForProto(c.Proto)
+	tag := m.inboundTag(c)
 	if tag == "" {
 		return fmt.Errorf("inbound tag for proto %s not configured", c.Proto)
 	}
@@ -110,39 +164,169 @@ func (m *Manager) addUser(ctx context.Context, client handlerService.HandlerServ
 		Tag:       tag,
 		Operation: serial.ToTypedMessage(&handlerService.AddUserOperation{User: user}),
 	}
+	if err := m.throttle(ctx); err != nil {
+		return err
+	}
 	callCtx, cancel := context.WithTimeout(ctx, m.apiTimeout())
 	defer cancel()
 
 	_, err = client.AlterInbound(callCtx, req)
-	return err
+	if isHandlerNotFoundError(err) {
+		return fmt.Errorf("add %s: xray has no inbound tagged %q: %w", c.Email, tag, err)
+	}
+	if err != nil {
+		return fmt.Errorf("add %s: %w", c.Email, err)
+	}
+	return nil
 }
 
-func (m *Manager) applyRoutes(ctx context.Context, current map[string]model.RouteRule, desired []model.RouteRule) (bool, error) {
+// isHandlerNotFoundError reports whether AlterInbound failed because the
+// inbound tag does not exist.
+func isHandlerNotFoundError(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "failed to get handler") ||
+		strings.Contains(msg, "handler") && strings.Contains(msg, "not found")
+}
+
+func (m *Manager) applyRoutes(ctx context.Context, current map[string]model.RouteRule, desired []model.RouteRule) (bool, map[string]error, error) {
 	adds, removes := diffRoutes(current, desired)
 	if len(adds) == 0 && len(removes) == 0 {
-		return false, nil
+		return false, nil, nil
 	}
 
-	conn, err := grpc.NewClient(m.cfg.Xray.APIServer, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	conn, err := xrayapi.Dial(m.cfg)
 	if err != nil {
-		return false, err
+		return false, nil, err
 	}
 	conn.Connect()
 	defer conn.Close()
 
 	client := routerService.NewRoutingServiceClient(conn)
+	if m.cfg.Xray.RouteApply == config.RouteApplyReplace {
+		return m.replaceRoutes(ctx, client, current, desired)
+	}
 
 	for _, r := range removes {
-		if err := m.removeRoute(ctx, client, r); err != nil {
-			return false, err
+		err := m.removeRoute(ctx, client, r)
+		m.audit.Record(ctx, "route", "remove", r.Tag, "", err)
+		if err != nil {
+			return false, nil, err
 		}
 	}
+	failed := map[string]error{}
 	for _, r := range adds {
-		if err := m.addRoute(ctx, client, r); err != nil {
-			return false, err
+		err := m.addRoute(ctx, client, r)
+		m.audit.Record(ctx, "route", "add", r.Tag, "", err)
+		if err != nil {
+			if isUnreachableError(err) {
+				return false, nil, err
+			}
+			failed[r.Tag] = err
 		}
 	}
-	return true, nil
+	return len(removes) > 0 || len(failed) < len(adds), failed, nil
+}
+
+// replaceRoutes swaps the managed rule set: it removes every managed rule
+// and adds all desired ones in a single AddRule call, so xray never routes
+// with part of the old set and part of the new one. Rules that do not build
+// are left out and reported in failed. When xray rejects the whole set, the
+// rules are added one by one to find the ones it refuses.
+func (m *Manager) replaceRoutes(ctx context.Context, client routerService.RoutingServiceClient, current map[string]model.RouteRule, desired []model.RouteRule) (bool, map[string]error, error) {
+	desired, _ = model.NormalizeRouteRules(desired)
+	failed := map[string]error{}
+	valid := desired
+	tmsg, err := buildRoutingConfig(desired...)
+	if err != nil {
+		valid = nil
+		for _, r := range desired {
+			if _, err := buildRoutingConfig(r); err != nil {
+				failed[r.Tag] = err
+				m.audit.Record(ctx, "route", "add", r.Tag, "", err)
+			} else {
+				valid = append(valid, r)
+			}
+		}
+		tmsg = nil
+		if len(valid) > 0 {
+			if tmsg, err = buildRoutingConfig(valid...); err != nil {
+				return false, nil, err
+			}
+		}
+	}
+
+	// Desired tags are removed too, in case xray still has them from before
+	// an agent restart; AddRule refuses duplicate tags.
+	stale := slices.Collect(maps.Keys(current))
+	for _, r := range valid {
+		if _, ok := current[r.Tag]; !ok {
+			stale = append(stale, r.Tag)
+		}
+	}
+	for _, tag := range stale {
+		err := m.removeRoute(ctx, client, model.RouteRule{Tag: tag})
+		if err != nil && isRouteNotFoundError(err) {
+			err = nil
+		}
+		if _, ok := current[tag]; ok {
+			m.audit.Record(ctx, "route", "remove", tag, "", err)
+		}
+		if err != nil {
+			return false, nil, fmt.Errorf("remove route %q: %w", tag, err)
+		}
+	}
+	if tmsg == nil {
+		return len(current) > 0, failed, nil
+	}
+
+	if err := m.throttle(ctx); err != nil {
+		return false, nil, err
+	}
+	callCtx, cancel := context.WithTimeout(ctx, m.apiTimeout())
+	_, err = client.AddRule(callCtx, &routerService.AddRuleRequest{Config: tmsg, ShouldAppend: true})
+	cancel()
+	if err == nil {
+		for _, r := range valid {
+			m.audit.Record(ctx, "route", "add", r.Tag, "", nil)
+		}
+		return true, failed, nil
+	}
+	if isUnreachableError(err) {
+		return false, nil, err
+	}
+	if m.log != nil {
+		m.log.Warn("xray rejected the route set; adding rules one by one", "err", err)
+	}
+	added := 0
+	for _, r := range valid {
+		err := m.addRoute(ctx, client, r)
+		m.audit.Record(ctx, "route", "add", r.Tag, "", err)
+		if err != nil {
+			if isUnreachableError(err) {
+				return false, nil, err
+			}
+			failed[r.Tag] = err
+			continue
+		}
+		added++
+	}
+	return len(current) > 0 || added > 0, failed, nil
+}
+
+// isUnreachableError reports whether err means xray could not be asked at
+// all, as opposed to xray rejecting a rule.
+func isUnreachableError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Canceled:
+		return true
+	}
+	return false
 }
 
 func (m *Manager) removeRoute(ctx context.Context, client routerService.RoutingServiceClient, r model.RouteRule) error {
@@ -150,6 +334,9 @@ func (m *Manager) removeRoute(ctx context.Context, client routerService.RoutingS
 		return fmt.Errorf("route tag required for removal")
 	}
 	req := &routerService.RemoveRuleRequest{RuleTag: r.Tag}
+	if err := m.throttle(ctx); err != nil {
+		return err
+	}
 	callCtx, cancel := context.WithTimeout(ctx, m.apiTimeout())
 	defer cancel()
 
@@ -178,6 +365,9 @@ func (m *Manager) addRoute(ctx context.Context, client routerService.RoutingServ
 		Config:       tmsg,
 		ShouldAppend: true,
 	}
+	if err := m.throttle(ctx); err != nil {
+		return err
+	}
 	callCtx, cancel := context.WithTimeout(ctx, m.apiTimeout())
 	defer cancel()
 
@@ -212,6 +402,15 @@ func isRouteNotFoundError(err error) bool {
 		strings.Contains(msg, "no such")
 }
 
+// inboundTag returns the inbound a client lives on: its own InboundTag, or
+// the one configured for its proto.
+func (m *Manager) inboundTag(c model.Client) string {
+	if c.InboundTag != "" {
+		return c.InboundTag
+	}
+	return m.tagForProto(c.Proto)
+}
+
 func (m *Manager) tagForProto(proto string) string {
 	switch proto {
 	case "vless":
@@ -225,11 +424,25 @@ func (m *Manager) tagForProto(proto string) string {
 	}
 }
 
+// Protocols lists the client protos the manager can provision.
+func Protocols() []string {
+	return []string{"vless", "vmess", "trojan"}
+}
+
+// vlessFlows are the flows xray accepts for VLESS users.
+var vlessFlows = []string{"", "xtls-rprx-vision", "xtls-rprx-vision-udp443"}
+
 func buildUser(c model.Client) (*protocol.User, error) {
-	user := &protocol.User{Email: c.Email}
+	if c.Flow != "" && c.Proto != "vless" {
+		return nil, fmt.Errorf("user %s: flow is only supported for vless", c.Email)
+	}
+	user := &protocol.User{Email: c.Email, Level: c.Level}
 	switch c.Proto {
 	case "vless":
-		user.Account = serial.ToTypedMessage(&vless.Account{Id: c.ID, Encryption: "none"})
+		if !slices.Contains(vlessFlows, c.Flow) {
+			return nil, fmt.Errorf("user %s: unsupported flow %q", c.Email, c.Flow)
+		}
+		user.Account = serial.ToTypedMessage(&vless.Account{Id: c.ID, Flow: c.Flow, Encryption: "none"})
 	case "vmess":
 		user.Account = serial.ToTypedMessage(&vmess.Account{Id: c.ID})
 	case "trojan":
@@ -240,26 +453,38 @@ func buildUser(c model.Client) (*protocol.User, error) {
 	return user, nil
 }
 
-func diffClients(current map[string]model.Client, dc []model.Client) (adds, removes []model.Client) {
+// diffClients returns the users to add and remove. A user whose inbound tag
+// changes is returned in moved rather than removes so that it can be dropped
+// from the old inbound after it was added to the new one (make-before-break).
+func (m *Manager) diffClients(current map[string]model.Client, dc []model.Client) (adds, removes, moved []model.Client) {
 	Map := make(map[string]model.Client, len(dc))
 	for _, c := range dc {
 		Map[c.Email] = c
 	}
 	for email, cur := range current {
-		if want, ok := Map[email]; !ok || !equalClient(cur, want) {
+		want, ok := Map[email]
+		switch {
+		case ok && m.equalClient(cur, want):
+		case ok && m.inboundTag(cur) != m.inboundTag(want):
+			moved = append(moved, cur)
+		case ok:
+			// Changed in place (new id, password, flow or level): addUser
+			// drops the old entry right before adding the new one, so the
+			// email is gone for one call rather than the whole remove pass.
+		default:
 			removes = append(removes, cur)
 		}
 	}
 	for _, want := range dc {
-		if cur, ok := current[want.Email]; !ok || !equalClient(cur, want) {
+		if cur, ok := current[want.Email]; !ok || !m.equalClient(cur, want) {
 			adds = append(adds, want)
 		}
 	}
 	return
 }
 
-func equalClient(a, b model.Client) bool {
-	return a.Proto == b.Proto && a.ID == b.ID && a.Password == b.Password
+func (m *Manager) equalClient(a, b model.Client) bool {
+	return a.Proto == b.Proto && a.ID == b.ID && a.Password == b.Password && a.Flow == b.Flow && a.Level == b.Level && m.inboundTag(a) == m.inboundTag(b)
 }
 
 func diffRoutes(current map[string]model.RouteRule, desired []model.RouteRule) (adds, removes []model.RouteRule) {
@@ -291,10 +516,37 @@ func equalRouteRule(a, b model.RouteRule) bool {
 		slices.Equal(a.Domain, b.Domain) &&
 		slices.Equal(a.IP, b.IP) &&
 		slices.Equal(a.InboundTag, b.InboundTag) &&
-		slices.Equal(a.Protocol, b.Protocol)
+		slices.Equal(a.Protocol, b.Protocol) &&
+		slices.Equal(a.User, b.User) &&
+		a.Network == b.Network &&
+		slices.Equal(a.Source, b.Source) &&
+		maps.Equal(a.Attrs, b.Attrs)
 }
 
-func buildRoutingConfig(r model.RouteRule) (*serial.TypedMessage, error) {
+// buildRoutingConfig turns rules into one RouterConfig for AddRule.
+func buildRoutingConfig(rules ...model.RouteRule) (*serial.TypedMessage, error) {
+	var rc conf.RouterConfig
+	for _, r := range rules {
+		raw, err := fieldRule(r)
+		if err != nil {
+			return nil, err
+		}
+		rc.RuleList = append(rc.RuleList, raw)
+	}
+	cfg, err := rc.Build()
+	if err != nil {
+		return nil, err
+	}
+
+	tmsg := serial.ToTypedMessage(cfg)
+	if tmsg == nil {
+		return nil, fmt.Errorf("failed to create routing typed message")
+	}
+	return tmsg, nil
+}
+
+// fieldRule returns r as an xray field rule.
+func fieldRule(r model.RouteRule) (json.RawMessage, error) {
 	if r.Tag == "" {
 		return nil, fmt.Errorf("route tag required")
 	}
@@ -302,53 +554,71 @@ func buildRoutingConfig(r model.RouteRule) (*serial.TypedMessage, error) {
 		return nil, fmt.Errorf("route %s: outbound_tag or balancer_tag required", r.Tag)
 	}
 
-	fieldRule := map[string]any{
+	rule := map[string]any{
 		"type":    "field",
 		"ruleTag": r.Tag,
 	}
 	if r.OutboundTag != "" {
-		fieldRule["outboundTag"] = r.OutboundTag
+		rule["outboundTag"] = r.OutboundTag
 	}
 	if r.BalancerTag != "" {
-		fieldRule["balancerTag"] = r.BalancerTag
+		rule["balancerTag"] = r.BalancerTag
 	}
 	if len(r.Domain) > 0 {
-		fieldRule["domain"] = r.Domain
+		rule["domain"] = r.Domain
 	}
 	if len(r.IP) > 0 {
-		fieldRule["ip"] = r.IP
+		rule["ip"] = r.IP
 	}
 	if r.Port != "" {
-		fieldRule["port"] = r.Port
+		rule["port"] = r.Port
 	}
 	if r.SourcePort != "" {
-		fieldRule["sourcePort"] = r.SourcePort
+		rule["sourcePort"] = r.SourcePort
 	}
 	if len(r.InboundTag) > 0 {
-		fieldRule["inboundTag"] = r.InboundTag
+		rule["inboundTag"] = r.InboundTag
 	}
 	if len(r.Protocol) > 0 {
-		fieldRule["protocol"] = r.Protocol
+		rule["protocol"] = r.Protocol
 	}
-
-	rawRule, err := json.Marshal(fieldRule)
-	if err != nil {
-		return nil, err
+	if len(r.User) > 0 {
+		rule["user"] = r.User
 	}
-
-	rc := conf.RouterConfig{
-		RuleList: []json.RawMessage{rawRule},
+	if r.Network != "" {
+		rule["network"] = r.Network
 	}
-	cfg, err := rc.Build()
-	if err != nil {
-		return nil, err
+	if len(r.Source) > 0 {
+		rule["source"] = r.Source
 	}
-
-	tmsg := serial.ToTypedMessage(cfg)
-	if tmsg == nil {
-		return nil, fmt.Errorf("route %s: failed to create typed message", r.Tag)
+	if len(r.Attrs) > 0 {
+		rule["attrs"] = r.Attrs
 	}
-	return tmsg, nil
+
+	return json.Marshal(rule)
+}
+
+// throttle waits until xray.api_rate_limit allows another call that changes
+// xray. The limit is read on every call, so a reload applies at once.
+func (m *Manager) throttle(ctx context.Context) error {
+	limit := m.cfg.Xray.APIRateLimit
+	if limit <= 0 {
+		return nil
+	}
+	burst := m.cfg.Xray.APIRateBurst
+	if burst <= 0 {
+		burst = max(1, int(math.Ceil(limit)))
+	}
+	m.mu.Lock()
+	if m.limiter == nil {
+		m.limiter = rate.NewLimiter(rate.Limit(limit), burst)
+	} else if m.limiter.Limit() != rate.Limit(limit) || m.limiter.Burst() != burst {
+		m.limiter.SetLimit(rate.Limit(limit))
+		m.limiter.SetBurst(burst)
+	}
+	l := m.limiter
+	m.mu.Unlock()
+	return l.Wait(ctx)
 }
 
 func (m *Manager) apiTimeout() time.Duration {
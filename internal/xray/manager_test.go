@@ -2,133 +2,152 @@ package xray
 
 import (
 	"context"
-	"fmt"
-	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/najahiiii/xray-agent/internal/audit"
 	"github.com/najahiiii/xray-agent/internal/config"
 	"github.com/najahiiii/xray-agent/internal/model"
+	"github.com/najahiiii/xray-agent/testsupport"
 
-	handlerService "github.com/xtls/xray-core/app/proxyman/command"
-	routerService "github.com/xtls/xray-core/app/router/command"
-	"google.golang.org/grpc"
+	"github.com/xtls/xray-core/app/router"
+	xnet "github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/proxy/vless"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
-type handlerOp struct {
-	tag   string
-	kind  string
-	email string
-}
-
-type fakeHandlerServer struct {
-	handlerService.UnimplementedHandlerServiceServer
-	ops []handlerOp
-}
+func TestManagerState(t *testing.T) {
+	core := testsupport.NewCore(t)
+	addr := core.Addr
 
-type routeOp struct {
-	tag  string
-	kind string
-}
+	cfg := &config.Config{}
+	cfg.Xray.APIServer = addr
+	cfg.Xray.APITimeoutSec = 1
+	cfg.Xray.InboundTags.VLESS = "vless-tag"
 
-type fakeRoutingServer struct {
-	routerService.UnimplementedRoutingServiceServer
-	ops       []routeOp
-	removeErr error
-}
+	mgr := NewManager(cfg, nil)
+	current := map[string]model.Client{
+		"a@example.com": {Proto: "vless", ID: "1", Email: "a@example.com"},
+	}
+	desired := []model.Client{
+		{Proto: "vless", ID: "2", Email: "b@example.com"},
+	}
 
-func (f *fakeHandlerServer) AlterInbound(ctx context.Context, req *handlerService.AlterInboundRequest) (*handlerService.AlterInboundResponse, error) {
-	msg, err := req.Operation.GetInstance()
+	changed, _, err := mgr.State(context.Background(), current, desired, map[string]model.RouteRule{}, nil)
 	if err != nil {
-		return nil, err
+		t.Fatalf("State: %v", err)
 	}
-	switch op := msg.(type) {
-	case *handlerService.AddUserOperation:
-		f.ops = append(f.ops, handlerOp{tag: req.Tag, kind: "add", email: op.User.Email})
-	case *handlerService.RemoveUserOperation:
-		f.ops = append(f.ops, handlerOp{tag: req.Tag, kind: "remove", email: op.Email})
-	default:
-		return nil, fmt.Errorf("unknown op %T", op)
+	if !changed {
+		t.Fatal("expected change")
 	}
-	return &handlerService.AlterInboundResponse{}, nil
-}
-
-func (f *fakeRoutingServer) AddRule(ctx context.Context, req *routerService.AddRuleRequest) (*routerService.AddRuleResponse, error) {
-	if _, err := req.Config.GetInstance(); err != nil {
-		return nil, err
+	ops := core.HandlerOps()
+	if len(ops) != 3 {
+		t.Fatalf("expected 3 operations, got %d", len(ops))
 	}
-	f.ops = append(f.ops, routeOp{kind: "add"})
-	return &routerService.AddRuleResponse{}, nil
-}
-
-func (f *fakeRoutingServer) RemoveRule(ctx context.Context, req *routerService.RemoveRuleRequest) (*routerService.RemoveRuleResponse, error) {
-	f.ops = append(f.ops, routeOp{tag: req.RuleTag, kind: "remove"})
-	if f.removeErr != nil {
-		return nil, f.removeErr
+	if ops[0].Kind != testsupport.OpRemove || ops[0].Email != "a@example.com" {
+		t.Fatalf("unexpected ops: %+v", ops)
 	}
-	return &routerService.RemoveRuleResponse{}, nil
-}
-
-func startAPIServer(t *testing.T) (*fakeHandlerServer, *fakeRoutingServer, string, func()) {
-	t.Helper()
-	lis, err := net.Listen("tcp", "127.0.0.1:0")
-	if err != nil {
-		t.Fatalf("listen: %v", err)
-	}
-	server := grpc.NewServer()
-	fs := &fakeHandlerServer{}
-	rs := &fakeRoutingServer{}
-	handlerService.RegisterHandlerServiceServer(server, fs)
-	routerService.RegisterRoutingServiceServer(server, rs)
-	go server.Serve(lis)
-	return fs, rs, lis.Addr().String(), func() {
-		server.Stop()
-		_ = lis.Close()
+	if ops[1].Kind != testsupport.OpRemove || ops[1].Email != "b@example.com" {
+		t.Fatalf("unexpected ops: %+v", ops)
+	}
+	if ops[2].Kind != testsupport.OpAdd || ops[2].Email != "b@example.com" {
+		t.Fatalf("unexpected ops: %+v", ops)
 	}
 }
 
-func TestManagerState(t *testing.T) {
-	fs, _, addr, closeFn := startAPIServer(t)
-	defer closeFn()
+func TestManagerStateUpdatesUserInPlace(t *testing.T) {
+	core := testsupport.NewCore(t)
+	core.AddInbound("vless-tag")
+	core.SetStrict(true)
 
 	cfg := &config.Config{}
-	cfg.Xray.APIServer = addr
+	cfg.Xray.APIServer = core.Addr
 	cfg.Xray.APITimeoutSec = 1
 	cfg.Xray.InboundTags.VLESS = "vless-tag"
-
 	mgr := NewManager(cfg, nil)
-	current := map[string]model.Client{
-		"a@example.com": {Proto: "vless", ID: "1", Email: "a@example.com"},
+
+	a := model.Client{Proto: "vless", ID: "1", Email: "a@example.com"}
+	b := model.Client{Proto: "vless", ID: "2", Email: "b@example.com"}
+	if _, _, err := mgr.State(context.Background(), map[string]model.Client{}, []model.Client{a, b}, map[string]model.RouteRule{}, nil); err != nil {
+		t.Fatalf("initial State: %v", err)
 	}
-	desired := []model.Client{
-		{Proto: "vless", ID: "2", Email: "b@example.com"},
+	core.ResetOps()
+
+	auditPath := filepath.Join(t.TempDir(), "audit.log")
+	mgr.SetAudit(audit.New(auditPath, false, nil))
+	rotated := a
+	rotated.ID = "3"
+	current := map[string]model.Client{a.Email: a, b.Email: b}
+	ctx := audit.WithSource(context.Background(), audit.SourceState, 7)
+	if _, _, err := mgr.State(ctx, current, []model.Client{rotated}, map[string]model.RouteRule{}, nil); err != nil {
+		t.Fatalf("State: %v", err)
 	}
 
-	changed, err := mgr.State(context.Background(), current, desired, map[string]model.RouteRule{}, nil)
+	// b goes in the remove pass; a is swapped with back-to-back calls.
+	ops := core.HandlerOps()
+	if len(ops) != 3 {
+		t.Fatalf("expected 3 operations, got %+v", ops)
+	}
+	if ops[0].Kind != testsupport.OpRemove || ops[0].Email != b.Email {
+		t.Fatalf("unexpected ops: %+v", ops)
+	}
+	if ops[1].Kind != testsupport.OpRemove || ops[1].Email != a.Email || ops[2].Kind != testsupport.OpAdd || ops[2].Email != a.Email {
+		t.Fatalf("unexpected ops: %+v", ops)
+	}
+	if got := core.Users("vless-tag"); !slices.Equal(got, []string{a.Email}) {
+		t.Fatalf("users = %v", got)
+	}
+
+	data, err := os.ReadFile(auditPath)
 	if err != nil {
-		t.Fatalf("State: %v", err)
+		t.Fatal(err)
 	}
-	if !changed {
-		t.Fatal("expected change")
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 ||
+		!strings.Contains(lines[0], `"config_version":7,"kind":"user","action":"remove","subject":"b@example.com"`) ||
+		!strings.Contains(lines[1], `"action":"update","subject":"a@example.com","inbound":"vless-tag","result":"ok"`) {
+		t.Fatalf("unexpected audit log:\n%s", data)
 	}
-	if len(fs.ops) != 3 {
-		t.Fatalf("expected 3 operations, got %d", len(fs.ops))
+}
+
+func TestManagerStateRateLimitsMutations(t *testing.T) {
+	core := testsupport.NewCore(t)
+	core.AddInbound("vless-tag")
+
+	cfg := &config.Config{}
+	cfg.Xray.APIServer = core.Addr
+	cfg.Xray.APITimeoutSec = 1
+	cfg.Xray.InboundTags.VLESS = "vless-tag"
+	cfg.Xray.ApplyWorkers = 4
+	cfg.Xray.APIRateLimit = 20
+	cfg.Xray.APIRateBurst = 1
+	mgr := NewManager(cfg, nil)
+
+	var desired []model.Client
+	for _, email := range []string{"a", "b", "c", "d", "e", "f"} {
+		desired = append(desired, model.Client{Proto: "vless", ID: email, Email: email + "@example.com"})
 	}
-	if fs.ops[0].kind != "remove" || fs.ops[0].email != "a@example.com" {
-		t.Fatalf("unexpected ops: %+v", fs.ops)
+	start := time.Now()
+	if _, _, err := mgr.State(context.Background(), map[string]model.Client{}, desired, map[string]model.RouteRule{}, nil); err != nil {
+		t.Fatalf("State: %v", err)
 	}
-	if fs.ops[1].kind != "remove" || fs.ops[1].email != "b@example.com" {
-		t.Fatalf("unexpected ops: %+v", fs.ops)
+	// Each add is a stale remove plus the add: 12 calls at 20/s.
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Fatalf("12 calls took %s, want them spread by the rate limit", elapsed)
 	}
-	if fs.ops[2].kind != "add" || fs.ops[2].email != "b@example.com" {
-		t.Fatalf("unexpected ops: %+v", fs.ops)
+	if ops := core.HandlerOps(); len(ops) != 12 {
+		t.Fatalf("expected 12 operations, got %d", len(ops))
 	}
 }
 
 func TestManagerStatePreRemovesStaleRouteBeforeAdd(t *testing.T) {
-	_, rs, addr, closeFn := startAPIServer(t)
-	defer closeFn()
+	core := testsupport.NewCore(t)
+	addr := core.Addr
 
 	cfg := &config.Config{}
 	cfg.Xray.APIServer = addr
@@ -139,7 +158,7 @@ func TestManagerStatePreRemovesStaleRouteBeforeAdd(t *testing.T) {
 		{Tag: "re-route-ipv4", OutboundTag: "direct", IP: []string{"8.8.8.8/32"}},
 	}
 
-	changed, err := mgr.State(
+	changed, _, err := mgr.State(
 		context.Background(),
 		map[string]model.Client{},
 		nil,
@@ -153,21 +172,22 @@ func TestManagerStatePreRemovesStaleRouteBeforeAdd(t *testing.T) {
 		t.Fatal("expected change")
 	}
 
-	if len(rs.ops) != 2 {
-		t.Fatalf("expected 2 route operations, got %d", len(rs.ops))
+	routeOps := core.RouteOps()
+	if len(routeOps) != 2 {
+		t.Fatalf("expected 2 route operations, got %d", len(routeOps))
 	}
-	if rs.ops[0].kind != "remove" || rs.ops[0].tag != "re-route-ipv4" {
-		t.Fatalf("unexpected route ops: %+v", rs.ops)
+	if routeOps[0].Kind != testsupport.OpRemove || routeOps[0].Tag != "re-route-ipv4" {
+		t.Fatalf("unexpected route ops: %+v", routeOps)
 	}
-	if rs.ops[1].kind != "add" {
-		t.Fatalf("unexpected route ops: %+v", rs.ops)
+	if routeOps[1].Kind != testsupport.OpAdd || routeOps[1].Tag != "re-route-ipv4" {
+		t.Fatalf("unexpected route ops: %+v", routeOps)
 	}
 }
 
 func TestManagerStateRouteRemoveNotFoundStillAdds(t *testing.T) {
-	_, rs, addr, closeFn := startAPIServer(t)
-	defer closeFn()
-	rs.removeErr = status.Error(codes.NotFound, "rule not found")
+	core := testsupport.NewCore(t)
+	addr := core.Addr
+	core.FailMethod(testsupport.MethodRemoveRule, status.Error(codes.NotFound, "rule not found"))
 
 	cfg := &config.Config{}
 	cfg.Xray.APIServer = addr
@@ -178,7 +198,7 @@ func TestManagerStateRouteRemoveNotFoundStillAdds(t *testing.T) {
 		{Tag: "re-route-ipv4", OutboundTag: "direct", IP: []string{"8.8.8.8/32"}},
 	}
 
-	changed, err := mgr.State(
+	changed, _, err := mgr.State(
 		context.Background(),
 		map[string]model.Client{},
 		nil,
@@ -192,21 +212,22 @@ func TestManagerStateRouteRemoveNotFoundStillAdds(t *testing.T) {
 		t.Fatal("expected change")
 	}
 
-	if len(rs.ops) != 2 {
-		t.Fatalf("expected 2 route operations, got %d", len(rs.ops))
+	routeOps := core.RouteOps()
+	if len(routeOps) != 2 {
+		t.Fatalf("expected 2 route operations, got %d", len(routeOps))
 	}
-	if rs.ops[0].kind != "remove" || rs.ops[0].tag != "re-route-ipv4" {
-		t.Fatalf("unexpected route ops: %+v", rs.ops)
+	if routeOps[0].Kind != testsupport.OpRemove || routeOps[0].Tag != "re-route-ipv4" {
+		t.Fatalf("unexpected route ops: %+v", routeOps)
 	}
-	if rs.ops[1].kind != "add" {
-		t.Fatalf("unexpected route ops: %+v", rs.ops)
+	if routeOps[1].Kind != testsupport.OpAdd || routeOps[1].Tag != "re-route-ipv4" {
+		t.Fatalf("unexpected route ops: %+v", routeOps)
 	}
 }
 
 func TestManagerStateRouteRemoveFailureStopsAdd(t *testing.T) {
-	_, rs, addr, closeFn := startAPIServer(t)
-	defer closeFn()
-	rs.removeErr = status.Error(codes.DeadlineExceeded, "timeout")
+	core := testsupport.NewCore(t)
+	addr := core.Addr
+	core.FailMethod(testsupport.MethodRemoveRule, status.Error(codes.DeadlineExceeded, "timeout"))
 
 	cfg := &config.Config{}
 	cfg.Xray.APIServer = addr
@@ -217,7 +238,7 @@ func TestManagerStateRouteRemoveFailureStopsAdd(t *testing.T) {
 		{Tag: "re-route-ipv4", OutboundTag: "direct", IP: []string{"8.8.8.8/32"}},
 	}
 
-	changed, err := mgr.State(
+	changed, _, err := mgr.State(
 		context.Background(),
 		map[string]model.Client{},
 		nil,
@@ -231,10 +252,232 @@ func TestManagerStateRouteRemoveFailureStopsAdd(t *testing.T) {
 		t.Fatal("did not expect changed when remove route failed")
 	}
 
-	if len(rs.ops) != 1 {
-		t.Fatalf("expected only remove operation, got %d", len(rs.ops))
+	routeOps := core.RouteOps()
+	if len(routeOps) != 1 {
+		t.Fatalf("expected only remove operation, got %d", len(routeOps))
+	}
+	if routeOps[0].Kind != testsupport.OpRemove || routeOps[0].Tag != "re-route-ipv4" {
+		t.Fatalf("unexpected route ops: %+v", routeOps)
+	}
+}
+
+func TestManagerStateReplacesRoutesInOneCall(t *testing.T) {
+	core := testsupport.NewCore(t)
+	core.SetStrict(true)
+	core.SeedRule("old", "direct")
+
+	cfg := &config.Config{}
+	cfg.Xray.APIServer = core.Addr
+	cfg.Xray.APITimeoutSec = 1
+	cfg.Xray.RouteApply = config.RouteApplyReplace
+	mgr := NewManager(cfg, nil)
+
+	current := map[string]model.RouteRule{
+		"old": {Tag: "old", OutboundTag: "direct", IP: []string{"1.1.1.1/32"}},
+	}
+	desired := []model.RouteRule{
+		{Tag: "a", OutboundTag: "direct", IP: []string{"8.8.8.8/32"}},
+		{Tag: "b", OutboundTag: "proxy", Domain: []string{"example.com"}},
+		{Tag: "bad", OutboundTag: "direct", IP: []string{"not-an-ip"}},
+	}
+
+	changed, failed, err := mgr.State(context.Background(), map[string]model.Client{}, nil, current, desired)
+	if err != nil {
+		t.Fatalf("State: %v", err)
+	}
+	if !changed {
+		t.Fatal("expected change")
+	}
+	if _, ok := failed["bad"]; !ok || len(failed) != 1 {
+		t.Fatalf("expected only the bad rule to fail, got %v", failed)
 	}
-	if rs.ops[0].kind != "remove" || rs.ops[0].tag != "re-route-ipv4" {
-		t.Fatalf("unexpected route ops: %+v", rs.ops)
+
+	var kinds []string
+	for _, op := range core.RouteOps() {
+		kinds = append(kinds, string(op.Kind)+":"+op.Tag)
+	}
+	want := []string{"remove:old", "remove:a", "remove:b", "add:a", "add:b"}
+	if !slices.Equal(kinds, want) {
+		t.Fatalf("route ops = %v, want %v", kinds, want)
+	}
+	if tags := core.RuleTags(); !slices.Equal(tags, []string{"a", "b"}) {
+		t.Fatalf("rule tags = %v", tags)
+	}
+}
+
+func TestManagerStateMovesUsersMakeBeforeBreak(t *testing.T) {
+	core := testsupport.NewCore(t)
+	core.AddInbound("vless-ws", "vless-grpc")
+	core.SetStrict(true)
+
+	cfg := &config.Config{}
+	cfg.Xray.APIServer = core.Addr
+	cfg.Xray.APITimeoutSec = 1
+	cfg.Xray.InboundTags.VLESS = "vless-ws"
+	mgr := NewManager(cfg, nil)
+
+	user := model.Client{Proto: "vless", ID: "1", Email: "a@example.com"}
+	if _, _, err := mgr.State(context.Background(), map[string]model.Client{}, []model.Client{user}, map[string]model.RouteRule{}, nil); err != nil {
+		t.Fatalf("initial State: %v", err)
+	}
+	core.ResetOps()
+
+	moved := model.WithInboundTags([]model.Client{user}, map[string]string{"vless": "vless-grpc"})
+	current := map[string]model.Client{user.Email: user}
+	if _, _, err := mgr.State(context.Background(), current, moved, map[string]model.RouteRule{}, nil); err != nil {
+		t.Fatalf("State: %v", err)
+	}
+
+	var adds, removes []string
+	addedAt, removedAt := -1, -1
+	for i, op := range core.HandlerOps() {
+		switch {
+		case op.Kind == testsupport.OpAdd:
+			adds = append(adds, op.Tag)
+			addedAt = i
+		case op.Kind == testsupport.OpRemove && op.Tag == "vless-ws":
+			removes = append(removes, op.Tag)
+			removedAt = i
+		}
+	}
+	if len(adds) != 1 || adds[0] != "vless-grpc" || len(removes) != 1 {
+		t.Fatalf("unexpected ops: %+v", core.HandlerOps())
+	}
+	if removedAt < addedAt {
+		t.Fatalf("old inbound removed before new inbound was added: %+v", core.HandlerOps())
+	}
+	if got := core.Users("vless-grpc"); len(got) != 1 || got[0] != user.Email {
+		t.Fatalf("new inbound users = %v", got)
+	}
+	if got := core.Users("vless-ws"); len(got) != 0 {
+		t.Fatalf("old inbound users = %v", got)
+	}
+}
+
+func TestManagerStateMoveKeepsOldInboundWhenAddFails(t *testing.T) {
+	core := testsupport.NewCore(t)
+	core.AddInbound("vless-ws")
+	core.SetStrict(true)
+
+	cfg := &config.Config{}
+	cfg.Xray.APIServer = core.Addr
+	cfg.Xray.APITimeoutSec = 1
+	cfg.Xray.InboundTags.VLESS = "vless-ws"
+	mgr := NewManager(cfg, nil)
+
+	user := model.Client{Proto: "vless", ID: "1", Email: "a@example.com"}
+	if _, _, err := mgr.State(context.Background(), map[string]model.Client{}, []model.Client{user}, map[string]model.RouteRule{}, nil); err != nil {
+		t.Fatalf("initial State: %v", err)
+	}
+
+	moved := user
+	moved.InboundTag = "missing"
+	current := map[string]model.Client{user.Email: user}
+	if _, _, err := mgr.State(context.Background(), current, []model.Client{moved}, map[string]model.RouteRule{}, nil); err == nil {
+		t.Fatal("expected error adding to a missing inbound")
+	}
+	if got := core.Users("vless-ws"); len(got) != 1 {
+		t.Fatalf("user dropped from old inbound: %v", got)
+	}
+}
+
+func TestManagerStateAppliesVLESSFlow(t *testing.T) {
+	core := testsupport.NewCore(t)
+	cfg := &config.Config{}
+	cfg.Xray.APIServer = core.Addr
+	cfg.Xray.APITimeoutSec = 1
+	cfg.Xray.InboundTags.VLESS = "vless-tag"
+	mgr := NewManager(cfg, nil)
+
+	plain := model.Client{Proto: "vless", ID: "1", Email: "a@example.com"}
+	vision := plain
+	vision.Flow = "xtls-rprx-vision"
+	changed, _, err := mgr.State(context.Background(), map[string]model.Client{plain.Email: plain}, []model.Client{vision}, nil, nil)
+	if err != nil || !changed {
+		t.Fatalf("State = %v, %v", changed, err)
+	}
+	msg, err := core.User("vless-tag", "a@example.com").GetAccount().GetInstance()
+	if err != nil {
+		t.Fatalf("decode account: %v", err)
+	}
+	if acc := msg.(*vless.Account); acc.Flow != "xtls-rprx-vision" {
+		t.Fatalf("flow = %q", acc.Flow)
+	}
+
+	if _, err := buildUser(model.Client{Proto: "trojan", Password: "p", Email: "t@example.com", Flow: "xtls-rprx-vision"}); err == nil {
+		t.Fatal("accepted a flow for trojan")
+	}
+	if _, err := buildUser(model.Client{Proto: "vless", ID: "1", Email: "v@example.com", Flow: "xtls-rprx-direct"}); err == nil {
+		t.Fatal("accepted an unsupported flow")
+	}
+}
+
+func TestManagerStateAppliesUserLevel(t *testing.T) {
+	core := testsupport.NewCore(t)
+	cfg := &config.Config{}
+	cfg.Xray.APIServer = core.Addr
+	cfg.Xray.APITimeoutSec = 1
+	cfg.Xray.InboundTags.TROJAN = "trojan-tag"
+	mgr := NewManager(cfg, nil)
+
+	c := model.Client{Proto: "trojan", Password: "p", Email: "a@example.com"}
+	raised := c
+	raised.Level = 2
+	changed, _, err := mgr.State(context.Background(), map[string]model.Client{c.Email: c}, []model.Client{raised}, nil, nil)
+	if err != nil || !changed {
+		t.Fatalf("State = %v, %v", changed, err)
+	}
+	if got := core.User("trojan-tag", "a@example.com").GetLevel(); got != 2 {
+		t.Fatalf("level = %d", got)
+	}
+}
+
+func TestBuildRoutingConfigMatchesUsers(t *testing.T) {
+	tmsg, err := buildRoutingConfig(model.RouteRule{Tag: "unlock", OutboundTag: "relay-res", User: []string{"a@planA", "b@planA"}})
+	if err != nil {
+		t.Fatalf("buildRoutingConfig: %v", err)
+	}
+	inst, err := tmsg.GetInstance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := inst.(*router.Config).GetRule()
+	if len(rules) != 1 || !slices.Equal(rules[0].GetUserEmail(), []string{"a@planA", "b@planA"}) || rules[0].GetTag() != "relay-res" {
+		t.Fatalf("rules = %v", rules)
+	}
+}
+
+func TestBuildRoutingConfigNetworkSourceAttrs(t *testing.T) {
+	tmsg, err := buildRoutingConfig(model.RouteRule{
+		Tag:         "lan-udp",
+		OutboundTag: "direct",
+		Network:     "udp",
+		Source:      []string{"10.0.0.0/8"},
+		Attrs:       map[string]string{":method": "GET"},
+	})
+	if err != nil {
+		t.Fatalf("buildRoutingConfig: %v", err)
+	}
+	inst, err := tmsg.GetInstance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := inst.(*router.Config).GetRule()
+	if len(rules) != 1 {
+		t.Fatalf("rules = %v", rules)
+	}
+	r := rules[0]
+	if len(r.GetNetworks()) != 1 || r.GetNetworks()[0] != xnet.Network_UDP {
+		t.Fatalf("networks = %v", r.GetNetworks())
+	}
+	if len(r.GetSourceGeoip()) != 1 || len(r.GetSourceGeoip()[0].GetCidr()) != 1 {
+		t.Fatalf("source = %v", r.GetSourceGeoip())
+	}
+	if r.GetAttributes()[":method"] != "GET" {
+		t.Fatalf("attrs = %v", r.GetAttributes())
+	}
+
+	if _, err := buildRoutingConfig(model.RouteRule{Tag: "bad", OutboundTag: "direct", Source: []string{"not-a-cidr"}}); err == nil {
+		t.Fatal("buildRoutingConfig accepted an invalid source")
 	}
 }
@@ -0,0 +1,203 @@
+package xray
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/najahiiii/xray-agent/internal/model"
+	"github.com/najahiiii/xray-agent/internal/xrayapi"
+
+	handlerService "github.com/xtls/xray-core/app/proxyman/command"
+	"github.com/xtls/xray-core/core"
+	"github.com/xtls/xray-core/infra/conf"
+)
+
+// Outbounds applies the desired outbounds. Like route rules, an outbound xray
+// rejects does not stop the others; it is returned in failed by tag and is
+// not in xray. err is only set when xray could not be reached.
+func (m *Manager) Outbounds(ctx context.Context, current map[string]model.Outbound, desired []model.Outbound) (changed bool, failed map[string]error, err error) {
+	adds, removes := diffOutbounds(current, desired)
+	if len(adds) == 0 && len(removes) == 0 {
+		return false, nil, nil
+	}
+
+	conn, err := xrayapi.Dial(m.cfg)
+	if err != nil {
+		return false, nil, err
+	}
+	conn.Connect()
+	defer conn.Close()
+
+	client := handlerService.NewHandlerServiceClient(conn)
+
+	for _, o := range removes {
+		err := m.removeOutbound(ctx, client, o.Tag)
+		m.audit.Record(ctx, "outbound", "remove", o.Tag, "", err)
+		if err != nil {
+			return false, nil, err
+		}
+	}
+	failed = map[string]error{}
+	for _, o := range adds {
+		err := m.addOutbound(ctx, client, o)
+		m.audit.Record(ctx, "outbound", "add", o.Tag, "", err)
+		if err != nil {
+			if isUnreachableError(err) {
+				return false, nil, err
+			}
+			failed[o.Tag] = err
+		}
+	}
+	return len(removes) > 0 || len(failed) < len(adds), failed, nil
+}
+
+func (m *Manager) removeOutbound(ctx context.Context, client handlerService.HandlerServiceClient, tag string) error {
+	if err := m.throttle(ctx); err != nil {
+		return err
+	}
+	callCtx, cancel := context.WithTimeout(ctx, m.apiTimeout())
+	defer cancel()
+
+	// xray reports success for tags it does not know.
+	_, err := client.RemoveOutbound(callCtx, &handlerService.RemoveOutboundRequest{Tag: tag})
+	return err
+}
+
+func (m *Manager) addOutbound(ctx context.Context, client handlerService.HandlerServiceClient, o model.Outbound) error {
+	handler, err := buildOutbound(o)
+	if err != nil {
+		return err
+	}
+	// A changed outbound, or one left over from before an agent restart,
+	// has to go first since xray rejects duplicate tags.
+	if err := m.removeOutbound(ctx, client, o.Tag); err != nil {
+		return fmt.Errorf("remove stale outbound %q before add: %w", o.Tag, err)
+	}
+
+	if err := m.throttle(ctx); err != nil {
+		return err
+	}
+	callCtx, cancel := context.WithTimeout(ctx, m.apiTimeout())
+	defer cancel()
+
+	_, err = client.AddOutbound(callCtx, &handlerService.AddOutboundRequest{Outbound: handler})
+	return err
+}
+
+func diffOutbounds(current map[string]model.Outbound, desired []model.Outbound) (adds, removes []model.Outbound) {
+	desiredMap := make(map[string]model.Outbound, len(desired))
+	for _, o := range desired {
+		desiredMap[o.Tag] = o
+	}
+	for tag, cur := range current {
+		if _, ok := desiredMap[tag]; !ok {
+			removes = append(removes, cur)
+		}
+	}
+	for _, want := range desired {
+		if cur, ok := current[want.Tag]; !ok || !cur.Equal(want) {
+			adds = append(adds, want)
+		}
+	}
+	return
+}
+
+// buildOutbound translates o into xray's JSON outbound format and builds it
+// the way xray builds its config file.
+func buildOutbound(o model.Outbound) (*core.OutboundHandlerConfig, error) {
+	if err := o.Validate(); err != nil {
+		return nil, err
+	}
+
+	settings := map[string]any{}
+	if s := o.Server; s != nil {
+		settings["address"] = s.Address
+		settings["port"] = s.Port
+		switch o.Protocol {
+		case "vless":
+			settings["id"] = s.ID
+			settings["encryption"] = "none"
+			if s.Flow != "" {
+				settings["flow"] = s.Flow
+			}
+		case "vmess":
+			settings["id"] = s.ID
+		case "trojan":
+			settings["password"] = s.Password
+		case "shadowsocks":
+			settings["method"] = s.Method
+			settings["password"] = s.Password
+		case "socks", "http":
+			if s.User != "" {
+				settings["user"] = s.User
+				settings["pass"] = s.Password
+			}
+		}
+	}
+	rawSettings, err := json.Marshal(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := map[string]any{
+		"tag":      o.Tag,
+		"protocol": o.Protocol,
+		"settings": json.RawMessage(rawSettings),
+	}
+	if stream := streamSettings(o); len(stream) > 0 {
+		raw["streamSettings"] = stream
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	var detour conf.OutboundDetourConfig
+	if err := json.Unmarshal(data, &detour); err != nil {
+		return nil, fmt.Errorf("outbound %s: %w", o.Tag, err)
+	}
+	handler, err := detour.Build()
+	if err != nil {
+		return nil, fmt.Errorf("outbound %s: %w", o.Tag, err)
+	}
+	return handler, nil
+}
+
+func streamSettings(o model.Outbound) map[string]any {
+	stream := map[string]any{}
+	if o.ProxyTag != "" {
+		stream["sockopt"] = map[string]any{"dialerProxy": o.ProxyTag}
+	}
+	t := o.Transport
+	if t == nil {
+		return stream
+	}
+	if t.Network != "" {
+		stream["network"] = t.Network
+	}
+	switch t.Network {
+	case "ws", "httpupgrade", "xhttp":
+		stream[t.Network+"Settings"] = map[string]any{"path": t.Path, "host": t.Host}
+	case "grpc":
+		stream["grpcSettings"] = map[string]any{"serviceName": t.ServiceName}
+	}
+	switch t.Security {
+	case "tls":
+		tls := map[string]any{"serverName": t.ServerName, "fingerprint": t.Fingerprint}
+		if len(t.ALPN) > 0 {
+			tls["alpn"] = t.ALPN
+		}
+		stream["security"] = "tls"
+		stream["tlsSettings"] = tls
+	case "reality":
+		stream["security"] = "reality"
+		stream["realitySettings"] = map[string]any{
+			"serverName":  t.ServerName,
+			"fingerprint": t.Fingerprint,
+			"publicKey":   t.PublicKey,
+			"shortId":     t.ShortID,
+		}
+	}
+	return stream
+}
@@ -0,0 +1,86 @@
+package xray
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/najahiiii/xray-agent/internal/config"
+	"github.com/najahiiii/xray-agent/internal/model"
+	"github.com/najahiiii/xray-agent/testsupport"
+)
+
+func TestBuildOutbound(t *testing.T) {
+	cases := []model.Outbound{
+		{Tag: "direct", Protocol: "freedom"},
+		{
+			Tag: "relay-sg", Protocol: "vless",
+			Server:    &model.OutboundServer{Address: "sg.example.com", Port: 443, ID: "b831381d-6324-4d53-ad4f-8cda48b30811", Flow: "xtls-rprx-vision"},
+			Transport: &model.OutboundTransport{Security: "reality", ServerName: "www.example.com", Fingerprint: "chrome", PublicKey: "Z84J2IelR9ch3k8VtlVhhs5ycBUlXA7wHBWcBrjqnAw", ShortID: "6ba85179e30d4fc2"},
+		},
+		{
+			Tag: "relay-ws", Protocol: "trojan", ProxyTag: "relay-sg",
+			Server:    &model.OutboundServer{Address: "ws.example.com", Port: 443, Password: "secret"},
+			Transport: &model.OutboundTransport{Network: "ws", Path: "/tunnel", Security: "tls", ServerName: "ws.example.com", ALPN: []string{"http/1.1"}},
+		},
+		{Tag: "ss", Protocol: "shadowsocks", Server: &model.OutboundServer{Address: "10.0.0.2", Port: 8388, Method: "aes-128-gcm", Password: "pw"}},
+	}
+	for _, o := range cases {
+		h, err := buildOutbound(o)
+		if err != nil {
+			t.Fatalf("buildOutbound(%s): %v", o.Tag, err)
+		}
+		if h.Tag != o.Tag {
+			t.Fatalf("built tag %q, want %q", h.Tag, o.Tag)
+		}
+	}
+
+	invalid := []model.Outbound{
+		{Tag: "no-server", Protocol: "vless"},
+		{Tag: "wireguard", Protocol: "wireguard"},
+		{Tag: "no-id", Protocol: "vmess", Server: &model.OutboundServer{Address: "a", Port: 1}},
+		{Tag: "loop", Protocol: "freedom", ProxyTag: "loop"},
+		{Tag: "kcp", Protocol: "freedom", Transport: &model.OutboundTransport{Network: "kcp"}},
+	}
+	for _, o := range invalid {
+		if _, err := buildOutbound(o); err == nil {
+			t.Fatalf("buildOutbound(%s) accepted an invalid outbound", o.Tag)
+		}
+	}
+}
+
+func TestManagerOutbounds(t *testing.T) {
+	core := testsupport.NewCore(t)
+	cfg := &config.Config{}
+	cfg.Xray.APIServer = core.Addr
+	cfg.Xray.APITimeoutSec = 1
+	mgr := NewManager(cfg, nil)
+	ctx := context.Background()
+
+	relay := model.Outbound{Tag: "relay", Protocol: "trojan", Server: &model.OutboundServer{Address: "relay.example.com", Port: 443, Password: "a"}}
+	direct := model.Outbound{Tag: "direct-2", Protocol: "freedom"}
+	changed, failed, err := mgr.Outbounds(ctx, nil, []model.Outbound{relay, direct})
+	if err != nil || !changed || len(failed) != 0 {
+		t.Fatalf("Outbounds = %v, %v, %v", changed, failed, err)
+	}
+	if tags := core.OutboundTags(); !slices.Equal(tags, []string{"relay", "direct-2"}) {
+		t.Fatalf("outbounds in xray = %v", tags)
+	}
+
+	// Changing one outbound replaces it; dropping one removes it.
+	current := map[string]model.Outbound{relay.Tag: relay, direct.Tag: direct}
+	moved := relay
+	moved.Server = &model.OutboundServer{Address: "relay2.example.com", Port: 443, Password: "a"}
+	if _, _, err := mgr.Outbounds(ctx, current, []model.Outbound{moved}); err != nil {
+		t.Fatalf("Outbounds: %v", err)
+	}
+	if tags := core.OutboundTags(); !slices.Equal(tags, []string{"relay"}) {
+		t.Fatalf("outbounds in xray = %v", tags)
+	}
+
+	// Unchanged outbounds make no calls.
+	core.FailMethod(testsupport.MethodRemoveOutbound, context.DeadlineExceeded)
+	if changed, _, err := mgr.Outbounds(ctx, map[string]model.Outbound{moved.Tag: moved}, []model.Outbound{moved}); err != nil || changed {
+		t.Fatalf("unchanged Outbounds = %v, %v", changed, err)
+	}
+}
@@ -0,0 +1,64 @@
+package xray
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// maxJoinedErrors caps how many failures forEach reports one by one, so a
+// bad inbound tag on thousands of users does not produce a huge error.
+const maxJoinedErrors = 5
+
+// forEach runs fn for every item on up to workers goroutines and returns
+// the failures joined. Once xray is unreachable or ctx is done no further
+// items are started, since they would only wait out their timeouts.
+func forEach[T any](ctx context.Context, workers int, items []T, fn func(context.Context, T) error) error {
+	workers = max(1, min(workers, len(items)))
+	var (
+		mu     sync.Mutex
+		errs   []error
+		failed int
+		stop   atomic.Bool
+		wg     sync.WaitGroup
+	)
+	next := make(chan T)
+	for range workers {
+		wg.Go(func() {
+			for item := range next {
+				err := fn(ctx, item)
+				if err == nil {
+					continue
+				}
+				if isUnreachableError(err) {
+					stop.Store(true)
+				}
+				mu.Lock()
+				failed++
+				if len(errs) < maxJoinedErrors {
+					errs = append(errs, err)
+				}
+				mu.Unlock()
+			}
+		})
+	}
+	started := 0
+	for _, item := range items {
+		if stop.Load() || ctx.Err() != nil {
+			break
+		}
+		next <- item
+		started++
+	}
+	close(next)
+	wg.Wait()
+	if started < len(items) && failed == 0 {
+		return ctx.Err()
+	}
+	if failed > len(errs) {
+		errs = append(errs, fmt.Errorf("%d more failed", failed-len(errs)))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,66 @@
+package xray
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestForEachBoundsWorkersAndJoinsErrors(t *testing.T) {
+	items := make([]int, 40)
+	for i := range items {
+		items[i] = i
+	}
+	var inFlight, peak atomic.Int32
+	var mu sync.Mutex
+	seen := map[int]bool{}
+	err := forEach(context.Background(), 4, items, func(_ context.Context, i int) error {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		seen[i] = true
+		mu.Unlock()
+		if i%4 == 0 {
+			return errors.New("bad user")
+		}
+		return nil
+	})
+	if p := peak.Load(); p > 4 || p < 2 {
+		t.Fatalf("peak concurrency = %d, want 2..4", p)
+	}
+	if len(seen) != len(items) {
+		t.Fatalf("ran %d items, want %d", len(seen), len(items))
+	}
+	if err == nil || strings.Count(err.Error(), "bad user") != maxJoinedErrors || !strings.Contains(err.Error(), "5 more failed") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestForEachStopsWhenUnreachable(t *testing.T) {
+	items := make([]int, 100)
+	var calls atomic.Int32
+	err := forEach(context.Background(), 2, items, func(context.Context, int) error {
+		calls.Add(1)
+		return status.Error(codes.Unavailable, "connection refused")
+	})
+	if !isUnreachableError(err) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n := calls.Load(); n > 4 {
+		t.Fatalf("expected to stop after xray became unreachable, made %d calls", n)
+	}
+}
@@ -0,0 +1,77 @@
+// Package xrayapi opens gRPC connections to the xray API server with the
+// transport security and credentials from the config.
+package xrayapi
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/najahiiii/xray-agent/internal/config"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// Dial returns a client for xray.api_server. Without xray.api_tls the
+// connection is plaintext, as xray's own API listener expects. Certificate
+// files are read on every call, so renewed ones are picked up.
+func Dial(cfg *config.Config) (*grpc.ClientConn, error) {
+	opts, err := DialOptions(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return grpc.NewClient(cfg.Xray.APIServer, opts...)
+}
+
+// DialOptions returns the transport and per-call credentials for
+// xray.api_server.
+func DialOptions(cfg *config.Config) ([]grpc.DialOption, error) {
+	t := cfg.Xray.APITLS
+	if !t.Enabled {
+		return []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}, nil
+	}
+	tc := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.Insecure,
+	}
+	if t.CAFile != "" {
+		pem, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("xray.api_tls.ca_file: %w", err)
+		}
+		tc.RootCAs = x509.NewCertPool()
+		if !tc.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("xray.api_tls.ca_file %s: no certificates found", t.CAFile)
+		}
+	}
+	if t.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("xray.api_tls client certificate: %w", err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	opts := []grpc.DialOption{grpc.WithTransportCredentials(credentials.NewTLS(tc))}
+	if cfg.Xray.APIToken != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(bearerToken(cfg.Xray.APIToken)))
+	}
+	return opts, nil
+}
+
+// bearerToken sends "authorization: Bearer <token>" with every call.
+type bearerToken string
+
+func (b bearerToken) GetRequestMetadata(context.Context, ...string) (map[string]string, error) {
+	if b == "" {
+		return nil, errors.New("empty xray api token")
+	}
+	return map[string]string{"authorization": "Bearer " + string(b)}, nil
+}
+
+func (bearerToken) RequireTransportSecurity() bool { return true }
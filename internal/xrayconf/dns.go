@@ -0,0 +1,97 @@
+package xrayconf
+
+import (
+	"maps"
+	"reflect"
+	"slices"
+
+	"github.com/najahiiii/xray-agent/internal/model"
+)
+
+// SetDNS writes d into the dns section and reports whether anything changed.
+// Keys the model does not cover, such as tag or clientIp, are left alone.
+func (f *File) SetDNS(d model.DNS) (bool, error) {
+	if err := d.Validate(); err != nil {
+		return false, err
+	}
+	dns, _ := f.doc["dns"].(map[string]any)
+	if dns == nil {
+		dns = map[string]any{}
+	}
+
+	// nil removes the key, leaving xray's default.
+	want := map[string]any{"servers": nil, "hosts": nil, "queryStrategy": nil, "disableCache": nil}
+	if len(d.Servers) > 0 {
+		servers := make([]any, 0, len(d.Servers))
+		for _, srv := range d.Servers {
+			servers = append(servers, dnsServer(srv))
+		}
+		want["servers"] = servers
+	}
+	if len(d.Hosts) > 0 {
+		hosts := make(map[string]any, len(d.Hosts))
+		for domain, addrs := range d.Hosts {
+			if len(addrs) == 1 {
+				hosts[domain] = addrs[0]
+			} else {
+				hosts[domain] = anySlice(addrs)
+			}
+		}
+		want["hosts"] = hosts
+	}
+	if d.QueryStrategy != "" {
+		want["queryStrategy"] = d.QueryStrategy
+	}
+	if d.DisableCache {
+		want["disableCache"] = true
+	}
+
+	changed := false
+	for _, key := range slices.Sorted(maps.Keys(want)) {
+		value := want[key]
+		if reflect.DeepEqual(dns[key], value) {
+			continue
+		}
+		if value == nil {
+			delete(dns, key)
+		} else {
+			dns[key] = value
+		}
+		changed = true
+	}
+	if changed {
+		f.doc["dns"] = dns
+	}
+	return changed, nil
+}
+
+// dnsServer uses xray's short string form when only the address is set.
+// Values are typed as encoding/json decodes them so they compare equal to a
+// loaded config.
+func dnsServer(srv model.DNSServer) any {
+	if srv.Port == 0 && len(srv.Domains) == 0 && len(srv.ExpectIPs) == 0 && !srv.SkipFallback {
+		return srv.Address
+	}
+	obj := map[string]any{"address": srv.Address}
+	if srv.Port != 0 {
+		obj["port"] = float64(srv.Port)
+	}
+	if len(srv.Domains) > 0 {
+		obj["domains"] = anySlice(srv.Domains)
+	}
+	if len(srv.ExpectIPs) > 0 {
+		obj["expectIPs"] = anySlice(srv.ExpectIPs)
+	}
+	if srv.SkipFallback {
+		obj["skipFallback"] = true
+	}
+	return obj
+}
+
+func anySlice(values []string) []any {
+	out := make([]any, len(values))
+	for i, v := range values {
+		out[i] = v
+	}
+	return out
+}
@@ -0,0 +1,51 @@
+package xrayconf
+
+import (
+	"strconv"
+	"strings"
+)
+
+// InboundPorts maps the tag of every inbound that listens on a single port
+// to that port. Port ranges and inbounds without a tag are skipped.
+func (f *File) InboundPorts() map[string]int {
+	ports := map[string]int{}
+	inbounds, _ := f.doc["inbounds"].([]any)
+	for _, raw := range inbounds {
+		in, ok := raw.(map[string]any)
+		if !ok {
+			continue
+		}
+		tag, _ := in["tag"].(string)
+		if tag == "" {
+			continue
+		}
+		switch p := in["port"].(type) {
+		case float64:
+			if p > 0 && p <= 65535 && p == float64(int(p)) {
+				ports[tag] = int(p)
+			}
+		case string:
+			if n, err := strconv.Atoi(strings.TrimSpace(p)); err == nil && n > 0 && n <= 65535 {
+				ports[tag] = n
+			}
+		}
+	}
+	return ports
+}
+
+// InboundProtocols maps the tag of every inbound to its protocol, such as
+// vless or dokodemo-door. Inbounds without a tag are skipped.
+func (f *File) InboundProtocols() map[string]string {
+	protocols := map[string]string{}
+	inbounds, _ := f.doc["inbounds"].([]any)
+	for _, raw := range inbounds {
+		in, ok := raw.(map[string]any)
+		if !ok {
+			continue
+		}
+		if tag, _ := in["tag"].(string); tag != "" {
+			protocols[tag], _ = in["protocol"].(string)
+		}
+	}
+	return protocols
+}
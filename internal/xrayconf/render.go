@@ -0,0 +1,67 @@
+package xrayconf
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/template"
+)
+
+// templateFuncs are available to config templates in addition to the
+// text/template builtins.
+var templateFuncs = template.FuncMap{
+	// json writes v as a JSON value, e.g. {{ json .Vars.inbounds }}.
+	"json": func(v any) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+// Render executes the text/template at tmplPath with data and returns the
+// result as the config for path. Referencing a missing map key is an error,
+// so a template never renders half a config. The file keeps the mode of the
+// existing config, or 0644 for a new one.
+func Render(path, tmplPath string, data any) (*File, error) {
+	tmpl, err := template.New(filepath.Base(tmplPath)).Funcs(templateFuncs).Option("missingkey=error").ParseFiles(tmplPath)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	var doc map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &doc); err != nil {
+		return nil, fmt.Errorf("%s rendered invalid JSON: %w", tmplPath, err)
+	}
+	if doc == nil {
+		doc = map[string]any{}
+	}
+
+	perm := os.FileMode(0o644)
+	if info, err := os.Stat(path); err == nil {
+		perm = info.Mode().Perm()
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return &File{path: path, perm: perm, doc: doc}, nil
+}
+
+// Changed reports whether saving the file would change what is on disk.
+func (f *File) Changed() (bool, error) {
+	data, err := f.encode()
+	if err != nil {
+		return false, err
+	}
+	old, err := os.ReadFile(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return !bytes.Equal(old, data), nil
+}
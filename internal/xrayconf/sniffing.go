@@ -0,0 +1,54 @@
+package xrayconf
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/najahiiii/xray-agent/internal/model"
+)
+
+// SetSniffing writes s into the sniffing block of the inbound tagged tag and
+// reports whether anything changed. Sniffing keys the model does not cover,
+// such as domainsExcluded, are left alone.
+func (f *File) SetSniffing(tag string, s model.Sniffing) (bool, error) {
+	if err := s.Validate(); err != nil {
+		return false, fmt.Errorf("inbound %s: %w", tag, err)
+	}
+	in, err := f.Inbound(tag)
+	if err != nil {
+		return false, err
+	}
+	sniffing, _ := in["sniffing"].(map[string]any)
+	if sniffing == nil {
+		sniffing = map[string]any{}
+	}
+
+	destOverride := make([]any, 0, len(s.DestOverride))
+	for _, p := range s.DestOverride {
+		destOverride = append(destOverride, p)
+	}
+	want := map[string]any{
+		"enabled":      s.Enabled,
+		"destOverride": destOverride,
+		"routeOnly":    s.RouteOnly,
+		"metadataOnly": s.MetadataOnly,
+	}
+	// Missing keys count as xray's defaults, so an inbound without a
+	// sniffing block matches a disabled one.
+	defaults := map[string]any{"enabled": false, "destOverride": []any{}, "routeOnly": false, "metadataOnly": false}
+	changed := false
+	for key, value := range want {
+		current, ok := sniffing[key]
+		if !ok {
+			current = defaults[key]
+		}
+		if !reflect.DeepEqual(current, value) {
+			sniffing[key] = value
+			changed = true
+		}
+	}
+	if changed {
+		in["sniffing"] = sniffing
+	}
+	return changed, nil
+}
@@ -0,0 +1,47 @@
+package xrayconf
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/najahiiii/xray-agent/internal/model"
+)
+
+// SetWireGuardPeers replaces the peers of the wireguard inbound tagged tag
+// and reports whether anything changed. Other settings of the inbound, such
+// as its secretKey, are left alone.
+func (f *File) SetWireGuardPeers(tag string, peers []model.Client) (bool, error) {
+	in, err := f.Inbound(tag)
+	if err != nil {
+		return false, err
+	}
+	if in["protocol"] != model.ProtoWireGuard {
+		return false, fmt.Errorf("inbound %s is not a wireguard inbound", tag)
+	}
+	settings, _ := in["settings"].(map[string]any)
+	if settings == nil {
+		settings = map[string]any{}
+	}
+
+	want := make([]any, 0, len(peers))
+	for _, p := range peers {
+		if err := p.ValidatePeer(); err != nil {
+			return false, err
+		}
+		peer := map[string]any{"publicKey": p.PublicKey, "allowedIPs": anySlice(p.AllowedIPs)}
+		if p.PreSharedKey != "" {
+			peer["preSharedKey"] = p.PreSharedKey
+		}
+		want = append(want, peer)
+	}
+	current, _ := settings["peers"].([]any)
+	if current == nil {
+		current = []any{}
+	}
+	if reflect.DeepEqual(current, want) {
+		return false, nil
+	}
+	settings["peers"] = want
+	in["settings"] = settings
+	return true, nil
+}
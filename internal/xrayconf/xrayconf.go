@@ -0,0 +1,124 @@
+// Package xrayconf edits the xray JSON config for settings that the gRPC API
+// cannot change at runtime. Fields the agent does not manage are kept as they
+// are; only key order and indentation are normalized on save.
+package xrayconf
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// ErrNoInbound is returned when the config has no inbound with a given tag.
+var ErrNoInbound = errors.New("no inbound with this tag")
+
+// Tester checks a candidate config before it replaces the live one;
+// overridden in tests.
+var Tester = func(ctx context.Context, binary, path string) error {
+	out, err := exec.CommandContext(ctx, binary, "-test", "-config", path).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("xray -test: %w: %s", err, lastLine(string(out)))
+	}
+	return nil
+}
+
+// File is a loaded xray config.
+type File struct {
+	path string
+	perm os.FileMode
+	doc  map[string]any
+}
+
+func Load(path string) (*File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]any
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if doc == nil {
+		doc = map[string]any{}
+	}
+	return &File{path: path, perm: info.Mode().Perm(), doc: doc}, nil
+}
+
+// Inbound returns the inbound object tagged tag, or ErrNoInbound.
+func (f *File) Inbound(tag string) (map[string]any, error) {
+	inbounds, _ := f.doc["inbounds"].([]any)
+	for _, raw := range inbounds {
+		if in, ok := raw.(map[string]any); ok && in["tag"] == tag {
+			return in, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrNoInbound, tag)
+}
+
+// LogPaths returns the files of the config's access and error logs. Empty
+// means xray logs to stdout, and "none" that the log is off.
+func (f *File) LogPaths() (access, errorLog string) {
+	section, _ := f.doc["log"].(map[string]any)
+	access, _ = section["access"].(string)
+	errorLog, _ = section["error"].(string)
+	return access, errorLog
+}
+
+// Apply tests the edited config with binary and then atomically replaces the
+// file, keeping the previous version as <path>.bak.
+func (f *File) Apply(ctx context.Context, binary string) error {
+	data, err := f.encode()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".new-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpPath, f.perm); err != nil {
+		return err
+	}
+	if err := Tester(ctx, binary, tmpPath); err != nil {
+		return err
+	}
+
+	if old, err := os.ReadFile(f.path); err == nil && !bytes.Equal(old, data) {
+		if err := os.WriteFile(f.path+".bak", old, f.perm); err != nil {
+			return fmt.Errorf("back up %s: %w", f.path, err)
+		}
+	}
+	return os.Rename(tmpPath, f.path)
+}
+
+func (f *File) encode() ([]byte, error) {
+	data, err := json.MarshalIndent(f.doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return lines[len(lines)-1]
+}
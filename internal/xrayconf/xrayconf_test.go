@@ -0,0 +1,223 @@
+package xrayconf
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/najahiiii/xray-agent/internal/model"
+)
+
+const sampleConfig = `{
+  "inbounds": [
+    {"tag": "vless-ws", "port": 10001, "sniffing": {"enabled": true, "destOverride": ["http", "tls"], "domainsExcluded": ["courier.push.apple.com"]}},
+    {"tag": "vmess-ws", "port": 10002}
+  ],
+  "log": {"loglevel": "warning"}
+}
+`
+
+func writeSample(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(sampleConfig), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func stubTester(t *testing.T, err error) *[]string {
+	t.Helper()
+	orig := Tester
+	var tested []string
+	Tester = func(_ context.Context, binary, path string) error {
+		tested = append(tested, binary+" "+path)
+		return err
+	}
+	t.Cleanup(func() { Tester = orig })
+	return &tested
+}
+
+func TestSetSniffingKeepsUnmanagedKeys(t *testing.T) {
+	path := writeSample(t)
+	tested := stubTester(t, nil)
+	file, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	changed, err := file.SetSniffing("vless-ws", model.Sniffing{Enabled: true, DestOverride: []string{"http", "tls"}})
+	if err != nil || changed {
+		t.Fatalf("SetSniffing(same) = %v, %v; want unchanged", changed, err)
+	}
+	changed, err = file.SetSniffing("vmess-ws", model.Sniffing{Enabled: true, DestOverride: []string{"quic"}, RouteOnly: true})
+	if err != nil || !changed {
+		t.Fatalf("SetSniffing(new) = %v, %v; want changed", changed, err)
+	}
+	if _, err := file.SetSniffing("missing", model.Sniffing{}); !errors.Is(err, ErrNoInbound) {
+		t.Fatalf("SetSniffing(missing) = %v, want ErrNoInbound", err)
+	}
+	if _, err := file.SetSniffing("vless-ws", model.Sniffing{DestOverride: []string{"smtp"}}); err == nil {
+		t.Fatal("SetSniffing accepted an unknown protocol")
+	}
+
+	if err := file.Apply(context.Background(), "/usr/local/bin/xray"); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if len(*tested) != 1 {
+		t.Fatalf("tested = %v", *tested)
+	}
+
+	var doc struct {
+		Inbounds []struct {
+			Tag      string         `json:"tag"`
+			Sniffing map[string]any `json:"sniffing"`
+		} `json:"inbounds"`
+		Log map[string]any `json:"log"`
+	}
+	data, _ := os.ReadFile(path)
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatalf("saved config: %v", err)
+	}
+	if doc.Log["loglevel"] != "warning" || doc.Inbounds[0].Sniffing["domainsExcluded"] == nil {
+		t.Fatalf("unmanaged fields lost: %s", data)
+	}
+	if doc.Inbounds[1].Sniffing["routeOnly"] != true {
+		t.Fatalf("vmess sniffing = %v", doc.Inbounds[1].Sniffing)
+	}
+	if backup, err := os.ReadFile(path + ".bak"); err != nil || string(backup) != sampleConfig {
+		t.Fatalf("backup = %q, %v", backup, err)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0o640 {
+		t.Fatalf("mode = %v, want 0640", info.Mode().Perm())
+	}
+}
+
+func TestApplyKeepsConfigWhenTestFails(t *testing.T) {
+	path := writeSample(t)
+	stubTester(t, errors.New("invalid"))
+	file, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if _, err := file.SetSniffing("vmess-ws", model.Sniffing{Enabled: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Apply(context.Background(), "xray"); err == nil {
+		t.Fatal("Apply succeeded despite a failing test")
+	}
+	if data, _ := os.ReadFile(path); string(data) != sampleConfig {
+		t.Fatalf("config replaced: %s", data)
+	}
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 1 {
+		t.Fatalf("leftover files: %v", entries)
+	}
+}
+
+func TestSetDNSRoundTrips(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{"dns":{"tag":"dns-in","queryStrategy":"UseIPv4","servers":["8.8.8.8"]}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	stubTester(t, nil)
+	file, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	desired := model.DNS{
+		Servers: []model.DNSServer{
+			{Address: "1.1.1.1"},
+			{Address: "223.5.5.5", Port: 53, Domains: []string{"geosite:cn"}, ExpectIPs: []string{"geoip:cn"}, SkipFallback: true},
+		},
+		Hosts: map[string][]string{"panel.example.com": {"10.0.0.2"}, "dual.example.com": {"10.0.0.3", "fd00::3"}},
+	}
+	if changed, err := file.SetDNS(desired); err != nil || !changed {
+		t.Fatalf("SetDNS = %v, %v; want changed", changed, err)
+	}
+	if err := file.Apply(context.Background(), "xray"); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+
+	reloaded, err := Load(path)
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if changed, err := reloaded.SetDNS(desired); err != nil || changed {
+		t.Fatalf("SetDNS(same) = %v, %v; want unchanged", changed, err)
+	}
+	dns := reloaded.doc["dns"].(map[string]any)
+	if dns["tag"] != "dns-in" {
+		t.Fatalf("unmanaged tag lost: %v", dns)
+	}
+	if _, ok := dns["queryStrategy"]; ok {
+		t.Fatalf("queryStrategy kept after the panel dropped it: %v", dns)
+	}
+	if servers := dns["servers"].([]any); servers[0] != "1.1.1.1" || servers[1].(map[string]any)["skipFallback"] != true {
+		t.Fatalf("servers = %v", servers)
+	}
+
+	if _, err := file.SetDNS(model.DNS{Servers: []model.DNSServer{{Address: " "}}}); err == nil {
+		t.Fatal("SetDNS accepted a server without an address")
+	}
+}
+
+func TestRenderRejectsInvalidJSON(t *testing.T) {
+	dir := t.TempDir()
+	tmpl := filepath.Join(dir, "config.json.tmpl")
+	if err := os.WriteFile(tmpl, []byte(`{"log": {{ .Level }}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "config.json")
+	if _, err := Render(path, tmpl, map[string]any{"Level": "warning"}); err == nil {
+		t.Fatal("Render accepted an unquoted string")
+	}
+	file, err := Render(path, tmpl, map[string]any{"Level": `{"loglevel": "warning"}`})
+	if err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+	if changed, err := file.Changed(); err != nil || !changed {
+		t.Fatalf("Changed() for a new file = %v, %v", changed, err)
+	}
+}
+
+func TestSetWireGuardPeersRequiresWireGuardInbound(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{"inbounds":[{"tag":"vless-ws","protocol":"vless"}]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.SetWireGuardPeers("vless-ws", nil); err == nil {
+		t.Fatal("wrote peers into a vless inbound")
+	}
+	if _, err := file.SetWireGuardPeers("wg", nil); !errors.Is(err, ErrNoInbound) {
+		t.Fatalf("SetWireGuardPeers(missing) = %v, want ErrNoInbound", err)
+	}
+}
+
+func TestInboundPortsSkipsRangesAndUntagged(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	config := `{"inbounds": [
+  {"tag": "vless-ws", "port": 10001},
+  {"tag": "vmess-ws", "port": "10002"},
+  {"tag": "dokodemo", "port": "20000-20010"},
+  {"port": 443}
+]}`
+	if err := os.WriteFile(path, []byte(config), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	file, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	got := file.InboundPorts()
+	if len(got) != 2 || got["vless-ws"] != 10001 || got["vmess-ws"] != 10002 {
+		t.Fatalf("InboundPorts() = %v", got)
+	}
+}
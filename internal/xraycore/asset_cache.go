@@ -0,0 +1,80 @@
+package xraycore
+
+import (
+	"cmp"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+const defaultAssetCacheKeep = 3
+
+// cachedAssetPath is where the release zip named asset of version with the
+// given sha256 is cached. Keying by checksum means a re-published asset is
+// never served from a stale copy.
+func cachedAssetPath(opts Options, version, asset, sum string) string {
+	return filepath.Join(opts.AssetCacheDir, strings.ToLower(ensureTagPrefix(version)+"_"+sum[:16]+"_"+asset))
+}
+
+// assetCacheEnabled reports whether release zips are cached.
+func (o Options) assetCacheEnabled() bool {
+	return o.AssetCacheDir != "" && o.AssetCacheKeep >= 0
+}
+
+// loadCachedAsset copies a cached zip to dest when one matching dgstPath is
+// cached, and reports whether it did.
+func loadCachedAsset(opts Options, cached, dest, dgstPath string) bool {
+	if _, err := os.Stat(cached); err != nil {
+		return false
+	}
+	if err := verifySHA256(cached, dgstPath); err != nil {
+		_ = os.Remove(cached)
+		return false
+	}
+	if err := copyFile(cached, dest, 0o644); err != nil {
+		return false
+	}
+	now := time.Now()
+	_ = os.Chtimes(cached, now, now)
+	if opts.Logger != nil {
+		opts.Logger.Info("using cached xray release asset", "path", cached)
+	}
+	return true
+}
+
+// storeCachedAsset keeps a verified zip for later installs and drops the
+// oldest cached zips beyond AssetCacheKeep. Failures only cost a download
+// next time, so they are logged.
+func storeCachedAsset(opts Options, src, cached string) {
+	if err := copyFile(src, cached, 0o644); err != nil {
+		if opts.Logger != nil {
+			opts.Logger.Warn("cache xray release asset", "err", err)
+		}
+		return
+	}
+	entries, err := os.ReadDir(opts.AssetCacheDir)
+	if err != nil {
+		return
+	}
+	type zipFile struct {
+		path string
+		mod  time.Time
+	}
+	var zips []zipFile
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || !info.Mode().IsRegular() || !strings.HasSuffix(e.Name(), ".zip") {
+			continue
+		}
+		zips = append(zips, zipFile{filepath.Join(opts.AssetCacheDir, e.Name()), info.ModTime()})
+	}
+	slices.SortFunc(zips, func(a, b zipFile) int { return cmp.Or(b.mod.Compare(a.mod), strings.Compare(b.path, a.path)) })
+	keep := cmp.Or(opts.AssetCacheKeep, defaultAssetCacheKeep)
+	for i, z := range zips {
+		if i >= keep && z.path != cached {
+			_ = os.Remove(z.path)
+		}
+	}
+}
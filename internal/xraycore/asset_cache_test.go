@@ -0,0 +1,73 @@
+package xraycore
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFetchReleaseAssetsReusesCachedZip(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, _ := zw.Create("xray")
+	_, _ = w.Write([]byte("binary"))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	zipData := buf.Bytes()
+
+	zipHits := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/Xray-linux-64.zip":
+			zipHits++
+			_, _ = w.Write(zipData)
+		case "/Xray-linux-64.zip.dgst":
+			fmt.Fprintf(w, "SHA2-256= %x\n", sha256.Sum256(zipData))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	release := &releaseInfo{TagName: "v1.0.0", Assets: []releaseAsset{
+		{Name: "Xray-linux-64.zip", BrowserDownloadURL: srv.URL + "/Xray-linux-64.zip"},
+		{Name: "Xray-linux-64.zip.dgst", BrowserDownloadURL: srv.URL + "/Xray-linux-64.zip.dgst"},
+	}}
+	opts := Options{Arch: "linux-64", AssetName: defaultAssetName, AssetCacheDir: t.TempDir()}
+
+	for i := range 2 {
+		unzipDir, _, err := fetchReleaseAssets(context.Background(), opts, release, t.TempDir())
+		if err != nil {
+			t.Fatalf("fetchReleaseAssets #%d: %v", i, err)
+		}
+		if data, _ := os.ReadFile(filepath.Join(unzipDir, "xray")); string(data) != "binary" {
+			t.Fatalf("unzipped binary = %q", data)
+		}
+	}
+	if zipHits != 1 {
+		t.Fatalf("zip downloaded %d times; want once", zipHits)
+	}
+
+	// A corrupted cache entry is dropped and downloaded again.
+	cached, _ := filepath.Glob(filepath.Join(opts.AssetCacheDir, "*.zip"))
+	if len(cached) != 1 {
+		t.Fatalf("cached zips = %v", cached)
+	}
+	if err := os.WriteFile(cached[0], []byte("garbage"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := fetchReleaseAssets(context.Background(), opts, release, t.TempDir()); err != nil {
+		t.Fatalf("fetchReleaseAssets after corruption: %v", err)
+	}
+	if zipHits != 2 {
+		t.Fatalf("zip downloaded %d times; want a fresh download after corruption", zipHits)
+	}
+}
@@ -0,0 +1,297 @@
+package xraycore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// proxySchemes are the proxy URL schemes net/http can dial.
+var proxySchemes = []string{"http", "https", "socks5", "socks5h"}
+
+// httpClient returns a client for GitHub and asset downloads. Requests go
+// through o.Proxy when set and otherwise honour HTTP_PROXY, HTTPS_PROXY and
+// NO_PROXY.
+func (o Options) httpClient(timeout time.Duration) (*http.Client, error) {
+	proxy := http.ProxyFromEnvironment
+	if o.Proxy != "" {
+		u, err := url.Parse(o.Proxy)
+		if err != nil || u.Host == "" || !slices.Contains(proxySchemes, u.Scheme) {
+			return nil, fmt.Errorf("invalid download proxy %q", o.Proxy)
+		}
+		proxy = http.ProxyURL(u)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxy
+	return &http.Client{Timeout: timeout, Transport: transport}, nil
+}
+
+// downloadClient has no overall timeout, so a large asset on a slow link may
+// take as long as it keeps making progress; downloadOnce enforces the idle
+// timeout instead.
+func (o Options) downloadClient() (*http.Client, error) {
+	client, err := o.httpClient(0)
+	if err != nil {
+		return nil, err
+	}
+	client.Transport.(*http.Transport).ResponseHeaderTimeout = o.idleTimeout()
+	return client, nil
+}
+
+func (o Options) idleTimeout() time.Duration {
+	if o.DownloadIdleTimeout > 0 {
+		return o.DownloadIdleTimeout
+	}
+	return defaultDownloadIdleTimeout
+}
+
+const (
+	defaultDownloadIdleTimeout = 60 * time.Second
+	downloadAttempts           = 3
+	downloadRetryGap           = 2 * time.Second
+	// downloadProgressEvery is how often a running download is logged.
+	downloadProgressEvery = 5 * time.Second
+)
+
+// downloadWithMirrors fetches rawURL into dest, trying the original URL first
+// and then each mirror. Every source gets a few resumed attempts before moving
+// on; the partial file is kept across sources because the zip is checked
+// afterwards against a checksum that never comes from a mirror (see
+// downloadChecksum) or against the minisign key.
+func downloadWithMirrors(ctx context.Context, rawURL string, dest string, opts Options) error {
+	client, err := opts.downloadClient()
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for i, src := range downloadSources(rawURL, opts.Mirrors) {
+		token := ""
+		if i == 0 {
+			// Never hand the GitHub token to a third-party mirror.
+			token = opts.Token
+		}
+		err := downloadResumable(ctx, client, src, dest, token, opts)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if opts.Logger != nil {
+			opts.Logger.Warn("download source failed", "url", src, "err", err)
+		}
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// downloadChecksum fetches a .dgst asset. Mirrors are not trusted to serve
+// checksums: one that serves the zip could serve a matching .dgst too. They
+// are only used when minisign_key is set, because the signature is then
+// checked against a key that never left this host.
+func downloadChecksum(ctx context.Context, rawURL string, dest string, opts Options) error {
+	if opts.MinisignKey == "" {
+		opts.Mirrors = nil
+	}
+	return downloadWithMirrors(ctx, rawURL, dest, opts)
+}
+
+// downloadSources expands mirrors for rawURL. A mirror may contain {url} (the
+// full original URL) or {path} (its path, e.g. /XTLS/Xray-core/releases/...);
+// otherwise the original URL is appended, which is how ghproxy-style proxies
+// work.
+func downloadSources(rawURL string, mirrors []string) []string {
+	sources := []string{rawURL}
+	path := rawURL
+	if u, err := url.Parse(rawURL); err == nil {
+		path = u.Path
+	}
+	for _, m := range mirrors {
+		m = strings.TrimSpace(m)
+		switch {
+		case m == "":
+			continue
+		case strings.Contains(m, "{url}"):
+			sources = append(sources, strings.ReplaceAll(m, "{url}", rawURL))
+		case strings.Contains(m, "{path}"):
+			sources = append(sources, strings.ReplaceAll(m, "{path}", path))
+		default:
+			sources = append(sources, strings.TrimRight(m, "/")+"/"+rawURL)
+		}
+	}
+	return sources
+}
+
+func downloadResumable(ctx context.Context, client *http.Client, rawURL string, dest string, token string, opts Options) error {
+	var lastErr error
+	for attempt := 1; attempt <= downloadAttempts; attempt++ {
+		if attempt > 1 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(downloadRetryGap):
+			}
+		}
+		lastErr = downloadOnce(ctx, client, rawURL, dest, token, opts)
+		if lastErr == nil {
+			return nil
+		}
+		var status *httpStatusError
+		if errors.As(lastErr, &status) && status.code/100 == 4 && status.code != http.StatusRequestedRangeNotSatisfiable {
+			return lastErr
+		}
+		if opts.Logger != nil {
+			opts.Logger.Debug("download attempt failed", "url", rawURL, "attempt", attempt, "err", lastErr)
+		}
+	}
+	return lastErr
+}
+
+// idleReader pushes the idle timer back on every read that returns data.
+type idleReader struct {
+	r     io.Reader
+	timer *time.Timer
+	idle  time.Duration
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.timer.Reset(r.idle)
+	}
+	return n, err
+}
+
+// downloadProgress logs how far a download got every downloadProgressEvery.
+type downloadProgress struct {
+	log         *slog.Logger
+	url         string
+	offset      int64 // bytes already on disk from an earlier attempt
+	total       int64 // 0 when the size is unknown
+	done        int64
+	start, last time.Time
+}
+
+func (p *downloadProgress) Write(b []byte) (int, error) {
+	p.done += int64(len(b))
+	if now := time.Now(); p.log != nil && now.Sub(p.last) >= downloadProgressEvery {
+		p.last = now
+		attrs := []any{"asset", path.Base(p.url), "bytes", p.offset + p.done, "speed_kbps", p.speedKBps(now)}
+		if p.total > 0 {
+			attrs = append(attrs, "percent", (p.offset+p.done)*100/p.total)
+		}
+		p.log.Info("downloading", attrs...)
+	}
+	return len(b), nil
+}
+
+func (p *downloadProgress) finish() {
+	if p.log != nil {
+		p.log.Info("downloaded", "asset", path.Base(p.url), "bytes", p.offset+p.done, "seconds", time.Since(p.start).Round(100*time.Millisecond).Seconds(), "speed_kbps", p.speedKBps(time.Now()))
+	}
+}
+
+func (p *downloadProgress) speedKBps(now time.Time) int64 {
+	elapsed := now.Sub(p.start).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return int64(float64(p.done) / 1024 / elapsed)
+}
+
+type httpStatusError struct {
+	url  string
+	code int
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("download %s: http %d", e.url, e.code)
+}
+
+// downloadOnce continues an existing partial dest with a Range request. A
+// server that ignores Range restarts the file; 416 means the partial file is
+// unusable and it is discarded for the next attempt. The transfer is
+// cancelled once no data arrived for the idle timeout.
+func downloadOnce(ctx context.Context, client *http.Client, rawURL string, dest string, token string, opts Options) error {
+	var offset int64
+	if info, err := os.Stat(dest); err == nil {
+		offset = info.Size()
+	}
+
+	idle := opts.idleTimeout()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var stalled atomic.Bool
+	timer := time.AfterFunc(idle, func() {
+		stalled.Store(true)
+		cancel()
+	})
+	defer timer.Stop()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		flags |= os.O_APPEND
+	case resp.StatusCode/100 == 2:
+		flags |= os.O_TRUNC
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		_ = os.Remove(dest)
+		return &httpStatusError{url: rawURL, code: resp.StatusCode}
+	default:
+		return &httpStatusError{url: rawURL, code: resp.StatusCode}
+	}
+
+	f, err := os.OpenFile(dest, flags, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if flags&os.O_APPEND == 0 {
+		offset = 0
+	}
+	progress := &downloadProgress{log: opts.Logger, url: rawURL, offset: offset, start: time.Now()}
+	if resp.ContentLength > 0 {
+		progress.total = offset + resp.ContentLength
+	}
+	progress.last = progress.start
+	body := &idleReader{r: resp.Body, timer: timer, idle: idle}
+	n, err := io.Copy(io.MultiWriter(f, progress), io.LimitReader(body, maxDownloadSize-offset+1))
+	if err != nil {
+		if stalled.Load() {
+			return fmt.Errorf("download %s: no data for %s", rawURL, idle)
+		}
+		return err
+	}
+	progress.finish()
+	if offset+n > maxDownloadSize {
+		_ = os.Remove(dest)
+		return fmt.Errorf("download %s: larger than %d bytes", rawURL, maxDownloadSize)
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package xraycore
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDownloadResumesPartialFile(t *testing.T) {
+	content := "0123456789abcdef"
+	var ranges []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		offset := 0
+		if rng := r.Header.Get("Range"); rng != "" {
+			offset, _ = strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rng, "bytes="), "-"))
+			w.Header().Set("Content-Range", "bytes "+strconv.Itoa(offset)+"-"+strconv.Itoa(len(content)-1)+"/"+strconv.Itoa(len(content)))
+			w.WriteHeader(http.StatusPartialContent)
+		}
+		_, _ = w.Write([]byte(content[offset:]))
+	}))
+	defer srv.Close()
+
+	dest := filepath.Join(t.TempDir(), "xray.zip")
+	if err := os.WriteFile(dest, []byte(content[:6]), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := downloadWithMirrors(context.Background(), srv.URL+"/xray.zip", dest, Options{}); err != nil {
+		t.Fatalf("downloadWithMirrors: %v", err)
+	}
+	got, _ := os.ReadFile(dest)
+	if string(got) != content {
+		t.Fatalf("unexpected content %q", got)
+	}
+	if len(ranges) != 1 || ranges[0] != "bytes=6-" {
+		t.Fatalf("expected a single resumed request, got %v", ranges)
+	}
+}
+
+func TestDownloadFallsBackToMirrorWithoutToken(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer gh-token" {
+			t.Errorf("origin should receive the token")
+		}
+		http.NotFound(w, r)
+	}))
+	defer origin.Close()
+
+	var mirrorPath string
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			t.Errorf("mirror must not receive the GitHub token")
+		}
+		mirrorPath = r.URL.Path
+		_, _ = w.Write([]byte("zip"))
+	}))
+	defer mirror.Close()
+
+	dest := filepath.Join(t.TempDir(), "xray.zip")
+	opts := Options{Token: "gh-token", Mirrors: []string{mirror.URL + "/cdn{path}"}}
+	if err := downloadWithMirrors(context.Background(), origin.URL+"/XTLS/Xray-core/releases/download/v1/Xray-linux-64.zip", dest, opts); err != nil {
+		t.Fatalf("downloadWithMirrors: %v", err)
+	}
+	if mirrorPath != "/cdn/XTLS/Xray-core/releases/download/v1/Xray-linux-64.zip" {
+		t.Fatalf("unexpected mirror path %q", mirrorPath)
+	}
+}
+
+func TestDownloadUsesConfiguredProxy(t *testing.T) {
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+		_, _ = w.Write([]byte("zip"))
+	}))
+	defer proxy.Close()
+
+	dest := filepath.Join(t.TempDir(), "xray.zip")
+	raw := "http://github.invalid/XTLS/Xray-core/releases/download/v1/Xray-linux-64.zip"
+	if err := downloadWithMirrors(context.Background(), raw, dest, Options{Proxy: proxy.URL}); err != nil {
+		t.Fatalf("downloadWithMirrors: %v", err)
+	}
+	if proxied != raw {
+		t.Fatalf("proxy saw %q; want %q", proxied, raw)
+	}
+
+	if err := downloadWithMirrors(context.Background(), raw, dest, Options{Proxy: "ftp://proxy.example"}); err == nil || !strings.Contains(err.Error(), "invalid download proxy") {
+		t.Fatalf("expected invalid proxy error, got %v", err)
+	}
+}
+
+func TestDownloadSources(t *testing.T) {
+	raw := "https://github.com/XTLS/Xray-core/releases/download/v1/Xray-linux-64.zip"
+	got := downloadSources(raw, []string{"https://ghproxy.example/", "https://cdn.example/xray{path}", "https://m.example/?u={url}", " "})
+	want := []string{
+		raw,
+		"https://ghproxy.example/" + raw,
+		"https://cdn.example/xray/XTLS/Xray-core/releases/download/v1/Xray-linux-64.zip",
+		"https://m.example/?u=" + raw,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("downloadSources() = %v, want %v", got, want)
+	}
+}
+
+func TestPinnedReleaseMatchesAssetPicker(t *testing.T) {
+	rel, tag := pinnedRelease(Options{Repo: "XTLS/Xray-core", Version: "25.10.15", Arch: "linux-64", AssetName: defaultAssetName})
+	if tag != "v25.10.15" {
+		t.Fatalf("tag = %q", tag)
+	}
+	zipURL, dgstURL, err := pickAssetURLs(rel, "Xray-linux-64.zip")
+	if err != nil {
+		t.Fatalf("pickAssetURLs: %v", err)
+	}
+	if zipURL != "https://github.com/XTLS/Xray-core/releases/download/v25.10.15/Xray-linux-64.zip" || dgstURL != zipURL+".dgst" {
+		t.Fatalf("unexpected urls %s %s", zipURL, dgstURL)
+	}
+	if sigURL := pickSignatureURL(rel, "Xray-linux-64.zip"); sigURL != zipURL+minisignSuffix {
+		t.Fatalf("unexpected signature url %s", sigURL)
+	}
+}
+
+func TestDownloadIdleTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flusher := w.(http.Flusher)
+		for i := range 6 {
+			_, _ = w.Write([]byte("chunk"))
+			flusher.Flush()
+			if r.URL.Path == "/stall" && i == 1 {
+				select {
+				case <-r.Context().Done():
+				case <-time.After(2 * time.Second):
+				}
+				return
+			}
+			time.Sleep(40 * time.Millisecond)
+		}
+	}))
+	defer srv.Close()
+
+	opts := Options{DownloadIdleTimeout: 150 * time.Millisecond}
+	client, err := opts.downloadClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Slower in total than the idle timeout, but never idle for that long.
+	slow := filepath.Join(t.TempDir(), "slow.zip")
+	if err := downloadOnce(context.Background(), client, srv.URL+"/slow", slow, "", opts); err != nil {
+		t.Fatalf("steady download failed: %v", err)
+	}
+	if data, _ := os.ReadFile(slow); len(data) != 30 {
+		t.Fatalf("downloaded %d bytes, want 30", len(data))
+	}
+
+	err = downloadOnce(context.Background(), client, srv.URL+"/stall", filepath.Join(t.TempDir(), "stall.zip"), "", opts)
+	if err == nil || !strings.Contains(err.Error(), "no data for") {
+		t.Fatalf("expected idle timeout, got %v", err)
+	}
+}
+
+func TestDownloadChecksumSkipsMirrors(t *testing.T) {
+	origin := httptest.NewServer(http.NotFoundHandler())
+	defer origin.Close()
+	var mirrorHits int
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirrorHits++
+		_, _ = w.Write([]byte("sha256: 00"))
+	}))
+	defer mirror.Close()
+
+	raw := origin.URL + "/XTLS/Xray-core/releases/download/v1/Xray-linux-64.zip.dgst"
+	dest := filepath.Join(t.TempDir(), "xray.zip.dgst")
+	opts := Options{Mirrors: []string{mirror.URL + "{path}"}}
+	if err := downloadChecksum(context.Background(), raw, dest, opts); err == nil {
+		t.Fatal("downloadChecksum fell back to a mirror")
+	}
+	if mirrorHits != 0 {
+		t.Fatalf("mirror served %d checksum requests", mirrorHits)
+	}
+
+	opts.MinisignKey = "RWQ..."
+	if err := downloadChecksum(context.Background(), raw, dest, opts); err != nil || mirrorHits != 1 {
+		t.Fatalf("downloadChecksum with minisign_key = %v, mirror hits %d", err, mirrorHits)
+	}
+}
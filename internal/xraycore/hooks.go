@@ -0,0 +1,61 @@
+package xraycore
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const hookTimeout = 5 * time.Minute
+
+// Hooks are shell commands run by InstallOrUpdate around a core upgrade,
+// e.g. to drain traffic, snapshot configs or notify monitoring. They see
+// XRAY_FROM_VERSION and XRAY_TO_VERSION, and OnFailure also XRAY_ERROR.
+type Hooks struct {
+	// PreUpdate runs before the release is downloaded; a failure aborts the
+	// update.
+	PreUpdate string
+	// PostUpdate runs after the new core is installed; a failure is logged.
+	PostUpdate string
+	// OnFailure runs when PreUpdate or the update itself fails.
+	OnFailure string
+}
+
+// hookRunner runs one hook command; overridden in tests.
+var hookRunner = func(ctx context.Context, command string, env []string) error {
+	ctx, cancel := context.WithTimeout(ctx, hookTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.Env = append(os.Environ(), env...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func runHook(ctx context.Context, opts Options, name, command string, env []string) error {
+	if command == "" {
+		return nil
+	}
+	if opts.Logger != nil {
+		opts.Logger.Info("running xray core hook", "hook", name)
+	}
+	if err := hookRunner(ctx, command, env); err != nil {
+		return fmt.Errorf("%s hook: %w", name, err)
+	}
+	return nil
+}
+
+// runFailureHook reports cause to the on_failure hook. Its own failure is
+// only logged so the original error is what callers see.
+func runFailureHook(ctx context.Context, opts Options, env []string, cause error) {
+	// The update may have failed because ctx ended; still notify.
+	ctx = context.WithoutCancel(ctx)
+	if err := runHook(ctx, opts, "on_failure", opts.Hooks.OnFailure, append(env, "XRAY_ERROR="+cause.Error())); err != nil && opts.Logger != nil {
+		opts.Logger.Warn("xray core hook failed", "err", err)
+	}
+}
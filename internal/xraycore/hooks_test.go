@@ -0,0 +1,85 @@
+package xraycore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+type hookCall struct {
+	command string
+	env     []string
+}
+
+func recordHooks(t *testing.T, fail map[string]bool) *[]hookCall {
+	t.Helper()
+	orig := hookRunner
+	t.Cleanup(func() { hookRunner = orig })
+	calls := &[]hookCall{}
+	hookRunner = func(_ context.Context, command string, env []string) error {
+		*calls = append(*calls, hookCall{command, env})
+		if fail[command] {
+			return errors.New("exit status 1")
+		}
+		return nil
+	}
+	return calls
+}
+
+func hookOptions(t *testing.T) Options {
+	return Options{
+		Version:     "v1.2.3",
+		Arch:        "linux-64",
+		BinDir:      t.TempDir(),
+		VersionsDir: t.TempDir(),
+		Hooks:       Hooks{PreUpdate: "pre", PostUpdate: "post", OnFailure: "fail"},
+	}
+}
+
+func TestPreUpdateHookFailureAbortsUpdate(t *testing.T) {
+	var downloads int
+	useReleaseServer(t, func(w http.ResponseWriter, r *http.Request) {
+		downloads++
+		_ = json.NewEncoder(w).Encode(releaseInfo{TagName: "v1.2.3"})
+	})
+	calls := recordHooks(t, map[string]bool{"pre": true})
+
+	_, err := InstallOrUpdate(context.Background(), hookOptions(t))
+	if err == nil || !strings.Contains(err.Error(), "pre_update hook") {
+		t.Fatalf("InstallOrUpdate = %v; want pre_update hook error", err)
+	}
+	if len(*calls) != 2 || (*calls)[1].command != "fail" {
+		t.Fatalf("hooks run = %+v; want pre then fail", *calls)
+	}
+	if !slices.Contains((*calls)[1].env, "XRAY_TO_VERSION=v1.2.3") || !slices.ContainsFunc((*calls)[1].env, func(e string) bool {
+		return strings.HasPrefix(e, "XRAY_ERROR=pre_update hook")
+	}) {
+		t.Fatalf("on_failure env = %v", (*calls)[1].env)
+	}
+	if downloads != 1 {
+		t.Fatalf("release requests = %d; want only the lookup", downloads)
+	}
+}
+
+func TestFailedUpdateRunsFailureHook(t *testing.T) {
+	useReleaseServer(t, func(w http.ResponseWriter, r *http.Request) {
+		// No assets for the arch, so the install fails after pre_update.
+		_ = json.NewEncoder(w).Encode(releaseInfo{TagName: "v1.2.3"})
+	})
+	calls := recordHooks(t, nil)
+
+	if _, err := InstallOrUpdate(context.Background(), hookOptions(t)); err == nil {
+		t.Fatal("InstallOrUpdate succeeded without release assets")
+	}
+	var run []string
+	for _, c := range *calls {
+		run = append(run, c.command)
+	}
+	if !slices.Equal(run, []string{"pre", "fail"}) {
+		t.Fatalf("hooks run = %v; want [pre fail]", run)
+	}
+}
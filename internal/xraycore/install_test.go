@@ -0,0 +1,95 @@
+package xraycore
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeUnzipped(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatalf("WriteFile(%s): %v", name, err)
+		}
+	}
+	return dir
+}
+
+func TestInstallBinaryAndDataVerifiesGeodataDigest(t *testing.T) {
+	unzipDir := writeUnzipped(t, map[string]string{
+		"xray":        "binary",
+		"geoip.dat":   "geoip-data",
+		"geosite.dat": "geosite-data",
+	})
+	opts := Options{BinDir: t.TempDir(), ShareDir: t.TempDir(), VersionsDir: t.TempDir()}
+
+	badDgst := filepath.Join(t.TempDir(), "geoip.dat.dgst")
+	if err := os.WriteFile(badDgst, []byte("SHA2-256= "+strings.Repeat("0", 64)+"\n"), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	err := installBinaryAndData(unzipDir, opts, "v1", map[string]string{"geoip.dat": badDgst})
+	if err == nil || !strings.Contains(err.Error(), "geoip.dat") {
+		t.Fatalf("expected geoip checksum failure, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(opts.BinDir, "xray")); !os.IsNotExist(err) {
+		t.Fatalf("nothing should be installed after a failed check, stat err = %v", err)
+	}
+
+	goodDgst := filepath.Join(t.TempDir(), "geoip.dat.dgst")
+	if err := os.WriteFile(goodDgst, []byte(fmt.Sprintf("SHA2-256= %x\n", sha256.Sum256([]byte("geoip-data")))), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := installBinaryAndData(unzipDir, opts, "v1", map[string]string{"geoip.dat": goodDgst}); err != nil {
+		t.Fatalf("installBinaryAndData: %v", err)
+	}
+	for _, path := range []string{filepath.Join(opts.BinDir, "xray"), filepath.Join(opts.ShareDir, "geoip.dat"), filepath.Join(opts.ShareDir, "geosite.dat")} {
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("expected %s installed: %v", path, err)
+		}
+	}
+}
+
+func TestInstallBinaryAndDataRejectsEmptyGeodata(t *testing.T) {
+	unzipDir := writeUnzipped(t, map[string]string{"xray": "binary", "geosite.dat": ""})
+	err := installBinaryAndData(unzipDir, Options{BinDir: t.TempDir(), ShareDir: t.TempDir(), VersionsDir: t.TempDir()}, "v1", nil)
+	if err == nil || !strings.Contains(err.Error(), "empty") {
+		t.Fatalf("expected empty geodata to be rejected, got %v", err)
+	}
+}
+
+func TestPickGeodataDigestURLs(t *testing.T) {
+	rel := &releaseInfo{Assets: []releaseAsset{
+		{Name: "Xray-linux-64.zip.dgst", BrowserDownloadURL: "https://example.com/xray.dgst"},
+		{Name: "geoip.dat.dgst", BrowserDownloadURL: "https://example.com/geoip.dgst"},
+	}}
+	got := pickGeodataDigestURLs(rel)
+	if len(got) != 1 || got["geoip.dat"] != "https://example.com/geoip.dgst" {
+		t.Fatalf("unexpected digests: %+v", got)
+	}
+}
+
+func TestUnzipRejectsPathTraversal(t *testing.T) {
+	zipPath := filepath.Join(t.TempDir(), "evil.zip")
+	f, err := os.Create(zipPath)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	zw := zip.NewWriter(f)
+	w, err := zw.Create("../escape")
+	if err != nil {
+		t.Fatalf("zip Create: %v", err)
+	}
+	_, _ = w.Write([]byte("x"))
+	_ = zw.Close()
+	_ = f.Close()
+
+	if err := unzip(zipPath, filepath.Join(t.TempDir(), "out")); err == nil || !strings.Contains(err.Error(), "escapes") {
+		t.Fatalf("expected traversal to be rejected, got %v", err)
+	}
+}
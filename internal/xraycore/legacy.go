@@ -0,0 +1,285 @@
+package xraycore
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/najahiiii/xray-agent/internal/initsys"
+)
+
+// Layout is where an xray install keeps its files.
+type Layout struct {
+	Binary   string `json:"binary,omitempty"`
+	Config   string `json:"config,omitempty"`
+	ShareDir string `json:"share_dir,omitempty"`
+	// Service is the service definition file and ServiceName the name the
+	// init system knows it by.
+	Service     string `json:"service,omitempty"`
+	ServiceName string `json:"service_name,omitempty"`
+}
+
+// ErrNoInstall is returned when no existing xray install was found.
+var ErrNoInstall = errors.New("no existing xray install found")
+
+// Paths probed by DetectLayout after the agent's own layout. Service files
+// under /etc/systemd/system come first because they shadow packaged units.
+// fsRoot prefixes every probe; overridden in tests.
+var (
+	fsRoot         = "/"
+	legacyBinaries = []string{"/usr/local/bin/xray", "/usr/bin/xray", "/usr/local/xray/xray", "/opt/xray/xray"}
+	legacyConfigs  = []string{"/etc/xray/config.json", "/usr/local/etc/xray/config.json", "/usr/local/xray/config.json", "/opt/xray/config.json"}
+	legacyShares   = []string{"/usr/local/share/xray", "/usr/share/xray", "/usr/local/xray", "/opt/xray"}
+	legacyServices = []string{
+		"/etc/systemd/system/xray.service",
+		"/usr/lib/systemd/system/xray.service",
+		"/lib/systemd/system/xray.service",
+		"/etc/systemd/system/xray-core.service",
+		"/etc/init.d/xray",
+	}
+)
+
+// Hooks used by Migrate; overridden in tests.
+var (
+	configTester     = testConfig
+	serviceSwitcher  = switchService
+	serviceInstaller = installService
+)
+
+// AgentLayout returns where opts installs xray. Service is empty when no init
+// system manages xray.
+func AgentLayout(opts Options) Layout {
+	opts.withDefaults()
+	layout := Layout{
+		Binary:   filepath.Join(opts.BinDir, opts.binaryName()),
+		Config:   opts.ConfigPath,
+		ShareDir: opts.ShareDir,
+	}
+	if kind, err := initsys.Resolve(opts.Init); err == nil && kind != initsys.None {
+		svc := xrayService(opts)
+		layout.Service = initsys.Path(kind, svc)
+		layout.ServiceName = svc.Name
+	}
+	return layout
+}
+
+// DetectLayout finds an existing xray install, whether done by the agent or
+// by another script. The binary and config named in the service's ExecStart
+// win over probed paths, since that is what actually runs. Fields stay empty
+// when nothing is found.
+func DetectLayout(opts Options) Layout {
+	agent := AgentLayout(opts)
+	var found Layout
+
+	for _, path := range legacyServices {
+		if exists(path) {
+			found.Service = path
+			found.ServiceName = strings.TrimSuffix(filepath.Base(path), ".service")
+			found.Binary, found.Config = parseExecStart(rooted(path))
+			break
+		}
+	}
+	if found.Binary == "" || !exists(found.Binary) {
+		found.Binary = firstExisting(append([]string{agent.Binary}, legacyBinaries...))
+	}
+	if found.Config == "" || !exists(found.Config) {
+		found.Config = firstExisting(append([]string{agent.Config}, legacyConfigs...))
+	}
+	for _, dir := range append([]string{agent.ShareDir}, legacyShares...) {
+		if exists(filepath.Join(dir, "geoip.dat")) || exists(filepath.Join(dir, "geosite.dat")) {
+			found.ShareDir = dir
+			break
+		}
+	}
+	return found
+}
+
+// Differences lists the fields of l that are set and differ from agent.
+func (l Layout) Differences(agent Layout) []string {
+	var diff []string
+	for _, f := range []struct{ name, got, want string }{
+		{"binary", l.Binary, agent.Binary},
+		{"config", l.Config, agent.Config},
+		{"share_dir", l.ShareDir, agent.ShareDir},
+		{"service", l.Service, agent.Service},
+		{"service_name", l.ServiceName, agent.ServiceName},
+	} {
+		if f.got != "" && f.got != f.want {
+			diff = append(diff, fmt.Sprintf("%s: %s (agent expects %s)", f.name, f.got, f.want))
+		}
+	}
+	return diff
+}
+
+// AdoptOptions points opts at the files of an existing install so that
+// updates replace them in place instead of installing a second copy. Only a
+// service named xray can be adopted, because that is the name restarts use.
+func AdoptOptions(opts Options, from Layout) (Options, error) {
+	if from.ServiceName != "" && from.ServiceName != "xray" {
+		return opts, fmt.Errorf("service %s cannot be adopted (only xray); migrate instead", from.ServiceName)
+	}
+	if from.Binary != "" {
+		opts.BinDir = filepath.Dir(from.Binary)
+	}
+	if from.Config != "" {
+		opts.ConfigPath = from.Config
+	}
+	if from.ShareDir != "" {
+		opts.ShareDir = from.ShareDir
+	}
+	if from.Service != "" && strings.HasSuffix(from.Service, ".service") {
+		opts.ServicePath = from.Service
+	}
+	return opts, nil
+}
+
+// MigrateResult lists what Migrate copied and where it kept backups.
+type MigrateResult struct {
+	Copied  []string `json:"copied"`
+	Backups []string `json:"backups"`
+}
+
+// Migrate copies an existing install into the agent's layout, backing up any
+// file it replaces as <path>.bak-<timestamp>. The new config is tested before
+// the old service is disabled (and its definition backed up) and the agent's
+// service is installed. Source files are left in place.
+func Migrate(ctx context.Context, opts Options, from Layout) (*MigrateResult, error) {
+	opts.withDefaults()
+	to := AgentLayout(opts)
+	stamp := time.Now().UTC().Format("20060102T150405")
+	res := &MigrateResult{}
+
+	copyOne := func(src, dst string, perm os.FileMode) error {
+		if src == "" || src == dst || !exists(src) {
+			return nil
+		}
+		if exists(dst) {
+			backup := dst + ".bak-" + stamp
+			if err := copyFile(rooted(dst), rooted(backup), perm); err != nil {
+				return fmt.Errorf("back up %s: %w", dst, err)
+			}
+			res.Backups = append(res.Backups, backup)
+		}
+		if err := copyFile(rooted(src), rooted(dst), perm); err != nil {
+			return fmt.Errorf("copy %s to %s: %w", src, dst, err)
+		}
+		res.Copied = append(res.Copied, src+" -> "+dst)
+		return nil
+	}
+
+	if err := copyOne(from.Binary, to.Binary, 0o755); err != nil {
+		return res, err
+	}
+	if err := copyOne(from.Config, to.Config, 0o644); err != nil {
+		return res, err
+	}
+	if from.ShareDir != "" && from.ShareDir != to.ShareDir {
+		for _, name := range geodataFiles {
+			if err := copyOne(filepath.Join(from.ShareDir, name), filepath.Join(to.ShareDir, name), 0o644); err != nil {
+				return res, err
+			}
+		}
+	}
+	if err := configTester(ctx, opts); err != nil {
+		return res, fmt.Errorf("test migrated config: %w", err)
+	}
+
+	if from.Service != "" && (from.Service != to.Service || from.ServiceName != to.ServiceName) {
+		backup := from.Service + ".bak-" + stamp
+		if err := serviceSwitcher(ctx, opts, from, backup); err != nil {
+			return res, err
+		}
+		res.Backups = append(res.Backups, backup)
+	}
+	if err := serviceInstaller(ctx, opts); err != nil {
+		return res, err
+	}
+	return res, nil
+}
+
+// switchService stops and disables the old service and moves its definition
+// to backup so it can no longer shadow or fight the agent's service. With
+// service.init none the old service still belongs to the host's init system.
+func switchService(ctx context.Context, opts Options, from Layout, backup string) error {
+	kind, err := initsys.Resolve(opts.Init)
+	if err != nil {
+		return err
+	}
+	if kind == initsys.None {
+		kind = initsys.Detect()
+	}
+	if err := initsys.Disable(ctx, kind, from.ServiceName); err != nil {
+		return err
+	}
+	if err := os.Rename(rooted(from.Service), rooted(backup)); err != nil {
+		return fmt.Errorf("back up %s: %w", from.Service, err)
+	}
+	return initsys.DaemonReload(ctx, kind)
+}
+
+// parseExecStart returns the binary and -config/-c argument from a systemd
+// unit's ExecStart or an OpenRC script's command and command_args.
+func parseExecStart(path string) (binary, config string) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", ""
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		var args string
+		switch {
+		case strings.HasPrefix(line, "ExecStart="):
+			args = strings.TrimLeft(strings.TrimPrefix(line, "ExecStart="), "@-:+!")
+		case strings.HasPrefix(line, "command="):
+			if fields := strings.Fields(strings.Trim(strings.TrimPrefix(line, "command="), `"'`)); len(fields) > 0 && binary == "" {
+				binary = fields[0]
+			}
+			continue
+		case strings.HasPrefix(line, "command_args="):
+			args = "_ " + strings.Trim(strings.TrimPrefix(line, "command_args="), `"'`)
+		default:
+			continue
+		}
+		fields := strings.Fields(args)
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] != "_" && binary == "" {
+			binary = fields[0]
+		}
+		for i, field := range fields {
+			if (field == "-config" || field == "-c" || field == "--config") && i+1 < len(fields) {
+				config = fields[i+1]
+			} else if v, ok := strings.CutPrefix(field, "-config="); ok {
+				config = v
+			}
+		}
+	}
+	return binary, config
+}
+
+func rooted(path string) string {
+	return filepath.Join(fsRoot, path)
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(rooted(path))
+	return err == nil
+}
+
+func firstExisting(paths []string) string {
+	for _, path := range paths {
+		if exists(path) {
+			return path
+		}
+	}
+	return ""
+}
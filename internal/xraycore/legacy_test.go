@@ -0,0 +1,136 @@
+package xraycore
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeRooted(t *testing.T, path, content string) {
+	t.Helper()
+	full := rooted(path)
+	if err := os.MkdirAll(filepath.Dir(full), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(full, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func useFakeRoot(t *testing.T) {
+	t.Helper()
+	orig := fsRoot
+	fsRoot = t.TempDir()
+	t.Cleanup(func() { fsRoot = orig })
+}
+
+func TestParseExecStart(t *testing.T) {
+	dir := t.TempDir()
+	unit := filepath.Join(dir, "xray.service")
+	os.WriteFile(unit, []byte("[Service]\nExecStart=/usr/local/xray/xray run -c /usr/local/xray/config.json\n"), 0o644)
+	if bin, cfg := parseExecStart(unit); bin != "/usr/local/xray/xray" || cfg != "/usr/local/xray/config.json" {
+		t.Fatalf("systemd = %q %q", bin, cfg)
+	}
+
+	script := filepath.Join(dir, "xray")
+	os.WriteFile(script, []byte("#!/sbin/openrc-run\ncommand=\"/opt/xray/xray\"\ncommand_args=\"-config=/opt/xray/config.json\"\n"), 0o755)
+	if bin, cfg := parseExecStart(script); bin != "/opt/xray/xray" || cfg != "/opt/xray/config.json" {
+		t.Fatalf("openrc = %q %q", bin, cfg)
+	}
+}
+
+func TestDetectLayoutPrefersService(t *testing.T) {
+	useFakeRoot(t)
+	writeRooted(t, "/etc/systemd/system/xray.service", "[Service]\nExecStart=/usr/local/xray/xray run -config /usr/local/xray/config.json\n")
+	writeRooted(t, "/usr/local/xray/xray", "bin")
+	writeRooted(t, "/usr/local/xray/config.json", "{}")
+	writeRooted(t, "/usr/local/xray/geoip.dat", "geo")
+	writeRooted(t, "/usr/local/bin/xray", "other")
+
+	found := DetectLayout(Options{Init: "systemd"})
+	want := Layout{
+		Binary:      "/usr/local/xray/xray",
+		Config:      "/usr/local/xray/config.json",
+		ShareDir:    "/usr/local/xray",
+		Service:     "/etc/systemd/system/xray.service",
+		ServiceName: "xray",
+	}
+	if found != want {
+		t.Fatalf("DetectLayout = %+v, want %+v", found, want)
+	}
+	if diffs := found.Differences(AgentLayout(Options{Init: "systemd"})); len(diffs) != 4 {
+		t.Fatalf("Differences = %v", diffs)
+	}
+
+	adopted, err := AdoptOptions(Options{}, found)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if adopted.BinDir != "/usr/local/xray" || adopted.ConfigPath != found.Config || adopted.ShareDir != found.ShareDir || adopted.ServicePath != found.Service {
+		t.Fatalf("AdoptOptions = %+v", adopted)
+	}
+	if _, err := AdoptOptions(Options{}, Layout{ServiceName: "xray-core"}); err == nil {
+		t.Fatal("AdoptOptions accepted a service not named xray")
+	}
+}
+
+func TestDetectLayoutNothingInstalled(t *testing.T) {
+	useFakeRoot(t)
+	if found := DetectLayout(Options{Init: "systemd"}); found != (Layout{}) {
+		t.Fatalf("DetectLayout = %+v, want empty", found)
+	}
+}
+
+func TestMigrateBacksUpAndSwitchesService(t *testing.T) {
+	useFakeRoot(t)
+	origTester, origSwitcher, origInstaller := configTester, serviceSwitcher, serviceInstaller
+	t.Cleanup(func() {
+		configTester, serviceSwitcher, serviceInstaller = origTester, origSwitcher, origInstaller
+	})
+	configTester = func(context.Context, Options) error { return nil }
+	var switched, installed bool
+	serviceSwitcher = func(_ context.Context, _ Options, from Layout, backup string) error {
+		switched = true
+		return os.Rename(rooted(from.Service), rooted(backup))
+	}
+	serviceInstaller = func(context.Context, Options) error {
+		installed = true
+		return nil
+	}
+
+	writeRooted(t, "/usr/local/xray/xray", "legacy-bin")
+	writeRooted(t, "/usr/local/xray/config.json", "legacy-config")
+	writeRooted(t, "/usr/local/xray/geosite.dat", "geosite")
+	writeRooted(t, "/etc/systemd/system/xray-core.service", "[Service]\nExecStart=/usr/local/xray/xray -config /usr/local/xray/config.json\n")
+	writeRooted(t, "/etc/xray/config.json", "agent-config")
+
+	opts := Options{Init: "systemd"}
+	found := DetectLayout(opts)
+	res, err := Migrate(context.Background(), opts, found)
+	if err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	if !switched || !installed {
+		t.Fatalf("switched=%v installed=%v", switched, installed)
+	}
+	if data, _ := os.ReadFile(rooted("/etc/xray/config.json")); string(data) != "legacy-config" {
+		t.Fatalf("config = %q", data)
+	}
+	if data, _ := os.ReadFile(rooted("/usr/local/share/xray/geosite.dat")); string(data) != "geosite" {
+		t.Fatalf("geosite = %q", data)
+	}
+	if len(res.Backups) != 2 || !strings.HasPrefix(res.Backups[0], "/etc/xray/config.json.bak-") {
+		t.Fatalf("backups = %v", res.Backups)
+	}
+	if data, _ := os.ReadFile(rooted(res.Backups[0])); string(data) != "agent-config" {
+		t.Fatalf("config backup = %q", data)
+	}
+	if exists("/etc/systemd/system/xray-core.service") {
+		t.Fatal("old service definition still in place")
+	}
+	if data, _ := os.ReadFile(rooted("/usr/local/xray/config.json")); string(data) != "legacy-config" {
+		t.Fatal("Migrate modified the source install")
+	}
+}
@@ -0,0 +1,87 @@
+package xraycore
+
+import (
+	"context"
+	"maps"
+	"path/filepath"
+	"strings"
+
+	"github.com/najahiiii/xray-agent/internal/initsys"
+)
+
+const defaultNoFile = 1048576
+
+// Limits are the resource limits and environment of the xray service. The
+// default file descriptor limit of most distributions (1024) makes xray drop
+// connections long before CPU or bandwidth run out.
+type Limits struct {
+	// NoFile is the open file limit (default 1048576).
+	NoFile int
+	// NProc caps the number of processes/threads; 0 leaves the system default.
+	NProc int
+	// Environment is added to the service environment.
+	// XRAY_LOCATION_ASSET defaults to ShareDir so geodata is always found.
+	Environment map[string]string
+	// Directives are further systemd [Service] settings, such as the
+	// sandboxing and restart backoff from xray.hardening.
+	Directives map[string]string
+}
+
+func xrayService(opts Options) initsys.Service {
+	noFile := opts.Limits.NoFile
+	if noFile <= 0 {
+		noFile = defaultNoFile
+	}
+	env := maps.Clone(opts.Limits.Environment)
+	if env == nil {
+		env = map[string]string{}
+	}
+	if _, ok := env["XRAY_LOCATION_ASSET"]; !ok {
+		env["XRAY_LOCATION_ASSET"] = opts.ShareDir
+	}
+	return initsys.Service{
+		Name:        "xray",
+		Description: "Xray Core Service",
+		Command:     filepath.Join(opts.BinDir, opts.binaryName()),
+		Args:        []string{"-config", opts.ConfigPath},
+		NoFile:      noFile,
+		NProc:       opts.Limits.NProc,
+		Environment: env,
+		Directives:  opts.Limits.Directives,
+		SystemdUnit: systemdUnit(opts),
+		SystemdPath: opts.ServicePath,
+	}
+}
+
+// systemdUnit points the embedded unit at opts' binary and config, which
+// differ from the defaults after `core --action adopt`.
+func systemdUnit(opts Options) []byte {
+	unit := strings.ReplaceAll(string(embeddedServiceUnit), filepath.Join(defaultBinDir, "xray"), filepath.Join(opts.BinDir, opts.binaryName()))
+	unit = strings.ReplaceAll(unit, defaultConfigPath, opts.ConfigPath)
+	return []byte(unit)
+}
+
+// ApplyLimits brings an installed xray service definition in line with
+// opts.Limits, restarting xray if it had to be rewritten, and then checks that
+// the running process actually has those limits. It does nothing when the
+// agent supervises xray itself.
+func ApplyLimits(ctx context.Context, opts Options) error {
+	opts.withDefaults()
+	kind, err := initsys.Resolve(opts.Init)
+	if err != nil {
+		return err
+	}
+	if kind == initsys.None {
+		return nil
+	}
+
+	svc := xrayService(opts)
+	changed, err := initsys.Sync(ctx, kind, svc)
+	if err != nil {
+		return err
+	}
+	if changed && opts.Logger != nil {
+		opts.Logger.Info("xray service limits updated; restarted xray", "init", kind, "nofile", svc.NoFile, "nproc", svc.NProc)
+	}
+	return initsys.Verify(ctx, kind, svc)
+}
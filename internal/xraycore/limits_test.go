@@ -0,0 +1,43 @@
+package xraycore
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestXrayServiceLimits(t *testing.T) {
+	opts := Options{}
+	opts.withDefaults()
+	svc := xrayService(opts)
+	if svc.NoFile != defaultNoFile || svc.NProc != 0 {
+		t.Fatalf("default limits = nofile %d nproc %d", svc.NoFile, svc.NProc)
+	}
+	if got := svc.Environment["XRAY_LOCATION_ASSET"]; got != defaultShareDir {
+		t.Fatalf("XRAY_LOCATION_ASSET = %q, want %q", got, defaultShareDir)
+	}
+
+	opts.Limits = Limits{
+		NoFile:      65535,
+		NProc:       4096,
+		Environment: map[string]string{"XRAY_LOCATION_ASSET": "/opt/xray", "GOMAXPROCS": "2"},
+	}
+	svc = xrayService(opts)
+	if svc.NoFile != 65535 || svc.NProc != 4096 {
+		t.Fatalf("limits = nofile %d nproc %d", svc.NoFile, svc.NProc)
+	}
+	if svc.Environment["XRAY_LOCATION_ASSET"] != "/opt/xray" || svc.Environment["GOMAXPROCS"] != "2" {
+		t.Fatalf("environment = %v", svc.Environment)
+	}
+}
+
+func TestXrayServiceUnitUsesAdoptedPaths(t *testing.T) {
+	opts := Options{BinDir: "/usr/local/xray", ConfigPath: "/usr/local/xray/config.json"}
+	opts.withDefaults()
+	unit := string(xrayService(opts).SystemdUnit)
+	if !strings.Contains(unit, "ExecStart=/usr/local/xray/xray -config /usr/local/xray/config.json") {
+		t.Fatalf("unit does not use adopted paths:\n%s", unit)
+	}
+	if strings.Contains(unit, "/usr/local/bin/xray") || strings.Contains(unit, "/etc/xray/config.json") {
+		t.Fatalf("unit still has default paths:\n%s", unit)
+	}
+}
@@ -0,0 +1,95 @@
+package xraycore
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// minisignSuffix names the signature asset published next to a release zip.
+const minisignSuffix = ".minisig"
+
+type minisignKey struct {
+	id  [8]byte
+	key ed25519.PublicKey
+}
+
+// parseMinisignKey accepts the base64 public key line of a minisign .pub
+// file, or the whole file.
+func parseMinisignKey(s string) (*minisignKey, error) {
+	line := ""
+	for l := range strings.Lines(s) {
+		l = strings.TrimSpace(l)
+		if l != "" && !strings.HasPrefix(l, "untrusted comment:") {
+			line = l
+		}
+	}
+	raw, err := base64.StdEncoding.DecodeString(line)
+	if err != nil || len(raw) != 2+8+ed25519.PublicKeySize || string(raw[:2]) != "Ed" {
+		return nil, errors.New("invalid minisign public key")
+	}
+	k := &minisignKey{key: ed25519.PublicKey(raw[10:])}
+	copy(k.id[:], raw[2:10])
+	return k, nil
+}
+
+// verifyMinisign checks path against the minisign signature in sigPath.
+// Both the legacy (Ed) and the prehashed (ED, BLAKE2b-512) signatures are
+// accepted, and the trusted comment must be signed too.
+func verifyMinisign(path, sigPath string, key *minisignKey) error {
+	data, err := os.ReadFile(sigPath)
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n")
+	if len(lines) < 4 || !strings.HasPrefix(lines[2], "trusted comment: ") {
+		return errors.New("malformed minisign signature")
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[1]))
+	if err != nil || len(sig) != 2+8+ed25519.SignatureSize {
+		return errors.New("malformed minisign signature")
+	}
+	globalSig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[3]))
+	if err != nil || len(globalSig) != ed25519.SignatureSize {
+		return errors.New("malformed minisign signature")
+	}
+	if !bytes.Equal(sig[2:10], key.id[:]) {
+		return fmt.Errorf("signature key id %X does not match the configured key %X", sig[2:10], key.id[:])
+	}
+
+	var msg []byte
+	switch string(sig[:2]) {
+	case "ED":
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		h, _ := blake2b.New512(nil)
+		if _, err := io.Copy(h, f); err != nil {
+			return err
+		}
+		msg = h.Sum(nil)
+	case "Ed":
+		if msg, err = os.ReadFile(path); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported minisign algorithm %q", sig[:2])
+	}
+	if !ed25519.Verify(key.key, msg, sig[10:]) {
+		return errors.New("minisign signature mismatch")
+	}
+	trusted := strings.TrimPrefix(lines[2], "trusted comment: ")
+	if !ed25519.Verify(key.key, append(sig[10:], trusted...), globalSig) {
+		return errors.New("minisign trusted comment signature mismatch")
+	}
+	return nil
+}
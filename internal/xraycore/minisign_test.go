@@ -0,0 +1,91 @@
+package xraycore
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// signMinisign writes a minisign signature of data by priv, prehashed like
+// `minisign -S -H` when prehash is set.
+func signMinisign(t *testing.T, path string, priv ed25519.PrivateKey, id []byte, data []byte, prehash bool) {
+	t.Helper()
+	algo, msg := "Ed", data
+	if prehash {
+		sum := blake2b.Sum512(data)
+		algo, msg = "ED", sum[:]
+	}
+	sig := ed25519.Sign(priv, msg)
+	trusted := "timestamp:1700000000\tfile:Xray-linux-64.zip"
+	global := ed25519.Sign(priv, append(append([]byte{}, sig...), trusted...))
+	blob := append(append([]byte(algo), id...), sig...)
+	content := "untrusted comment: signature from minisign secret key\n" +
+		base64.StdEncoding.EncodeToString(blob) + "\n" +
+		"trusted comment: " + trusted + "\n" +
+		base64.StdEncoding.EncodeToString(global) + "\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+}
+
+func testMinisignKey(t *testing.T) (ed25519.PrivateKey, []byte, *minisignKey) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	pubFile := "untrusted comment: minisign public key 0807060504030201\n" +
+		base64.StdEncoding.EncodeToString(append(append([]byte("Ed"), id...), pub...)) + "\n"
+	key, err := parseMinisignKey(pubFile)
+	if err != nil {
+		t.Fatalf("parseMinisignKey: %v", err)
+	}
+	return priv, id, key
+}
+
+func TestVerifyMinisign(t *testing.T) {
+	priv, id, key := testMinisignKey(t)
+	dir := t.TempDir()
+	zipPath := filepath.Join(dir, "xray.zip")
+	if err := os.WriteFile(zipPath, []byte("release zip"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	sigPath := zipPath + minisignSuffix
+
+	for _, prehash := range []bool{false, true} {
+		signMinisign(t, sigPath, priv, id, []byte("release zip"), prehash)
+		if err := verifyMinisign(zipPath, sigPath, key); err != nil {
+			t.Fatalf("verifyMinisign(prehash=%v): %v", prehash, err)
+		}
+	}
+
+	signMinisign(t, sigPath, priv, id, []byte("tampered zip"), true)
+	if err := verifyMinisign(zipPath, sigPath, key); err == nil || !strings.Contains(err.Error(), "mismatch") {
+		t.Fatalf("expected mismatch for another file, got %v", err)
+	}
+
+	signMinisign(t, sigPath, priv, []byte{8, 7, 6, 5, 4, 3, 2, 1}, []byte("release zip"), true)
+	if err := verifyMinisign(zipPath, sigPath, key); err == nil || !strings.Contains(err.Error(), "key id") {
+		t.Fatalf("expected key id mismatch, got %v", err)
+	}
+
+	_, otherPriv, _ := ed25519.GenerateKey(nil)
+	signMinisign(t, sigPath, otherPriv, id, []byte("release zip"), true)
+	if err := verifyMinisign(zipPath, sigPath, key); err == nil {
+		t.Fatal("expected a signature by another key to be rejected")
+	}
+}
+
+func TestParseMinisignKeyRejectsGarbage(t *testing.T) {
+	for _, s := range []string{"", "not base64!", base64.StdEncoding.EncodeToString([]byte("Ed short"))} {
+		if _, err := parseMinisignKey(s); err == nil {
+			t.Fatalf("parseMinisignKey(%q) succeeded", s)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package xraycore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// releaseCacheTTL is how long a release response is served without
+	// contacting GitHub at all. After that a conditional request is made,
+	// which does not count against the rate limit when it returns 304.
+	releaseCacheTTL     = 10 * time.Minute
+	releaseCacheFile    = "github-release-cache.json"
+	defaultRateLimitTTL = time.Minute
+)
+
+// RateLimitError is returned when GitHub rejected the release request for
+// rate limiting and no cached response is available.
+type RateLimitError struct {
+	Until time.Time
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("github api rate limited until %s", e.Until.UTC().Format(time.RFC3339))
+}
+
+type releaseCacheEntry struct {
+	ETag      string      `json:"etag,omitempty"`
+	FetchedAt time.Time   `json:"fetched_at"`
+	Release   releaseInfo `json:"release"`
+}
+
+type releaseCacheData struct {
+	Entries      map[string]*releaseCacheEntry `json:"entries"`
+	BackoffUntil time.Time                     `json:"backoff_until,omitempty"`
+}
+
+// releaseCache is shared by every fetchRelease call in the process and is
+// optionally mirrored to Options.CacheDir so restarts keep the ETag and any
+// active backoff.
+type releaseCache struct {
+	mu     sync.Mutex
+	dir    string
+	loaded bool
+	data   releaseCacheData
+}
+
+var githubReleaseCache = &releaseCache{}
+
+// lookup returns a copy of the cached entry for url and the current backoff.
+func (c *releaseCache) lookup(dir string, url string) (*releaseCacheEntry, time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.loadLocked(dir)
+
+	entry, ok := c.data.Entries[url]
+	if !ok {
+		return nil, c.data.BackoffUntil
+	}
+	cp := *entry
+	return &cp, c.data.BackoffUntil
+}
+
+func (c *releaseCache) store(dir string, url string, entry *releaseCacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.loadLocked(dir)
+	c.data.Entries[url] = entry
+	c.data.BackoffUntil = time.Time{}
+	c.saveLocked()
+}
+
+func (c *releaseCache) backoff(dir string, until time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.loadLocked(dir)
+	if until.After(c.data.BackoffUntil) {
+		c.data.BackoffUntil = until
+	}
+	c.saveLocked()
+}
+
+func (c *releaseCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dir = ""
+	c.loaded = false
+	c.data = releaseCacheData{}
+}
+
+// loadLocked reads the on-disk cache the first time dir is seen. A missing or
+// unreadable file just starts an empty cache.
+func (c *releaseCache) loadLocked(dir string) {
+	if c.loaded && c.dir == dir {
+		return
+	}
+	c.dir = dir
+	c.loaded = true
+	c.data = releaseCacheData{Entries: map[string]*releaseCacheEntry{}}
+	if dir == "" {
+		return
+	}
+	raw, err := os.ReadFile(filepath.Join(dir, releaseCacheFile))
+	if err != nil {
+		return
+	}
+	var data releaseCacheData
+	if err := json.Unmarshal(raw, &data); err != nil || data.Entries == nil {
+		return
+	}
+	c.data = data
+}
+
+func (c *releaseCache) saveLocked() {
+	if c.dir == "" {
+		return
+	}
+	raw, err := json.Marshal(c.data)
+	if err != nil {
+		return
+	}
+	_ = writeBytes(filepath.Join(c.dir, releaseCacheFile), raw, 0o600)
+}
+
+// rateLimitUntil reports when a 403/429 response allows the next request, or
+// the zero time if the response is not a rate-limit rejection.
+func rateLimitUntil(resp *http.Response, now time.Time) time.Time {
+	if resp.StatusCode != http.StatusForbidden && resp.StatusCode != http.StatusTooManyRequests {
+		return time.Time{}
+	}
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+		return now.Add(time.Duration(secs) * time.Second)
+	}
+	if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		if reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+			if until := time.Unix(reset, 0); until.After(now) {
+				return until
+			}
+		}
+		return now.Add(defaultRateLimitTTL)
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return now.Add(defaultRateLimitTTL)
+	}
+	return time.Time{}
+}
+
+// IsRateLimited reports whether err is a GitHub rate-limit rejection.
+func IsRateLimited(err error) bool {
+	var rl *RateLimitError
+	return errors.As(err, &rl)
+}
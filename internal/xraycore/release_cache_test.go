@@ -0,0 +1,137 @@
+package xraycore
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func useReleaseServer(t *testing.T, handler http.HandlerFunc) {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	originalBase := githubAPIBase
+	githubAPIBase = srv.URL
+	githubReleaseCache.reset()
+	t.Cleanup(func() {
+		srv.Close()
+		githubAPIBase = originalBase
+		githubReleaseCache.reset()
+	})
+}
+
+// ageReleaseCache makes every cached entry older than the TTL.
+func ageReleaseCache(t *testing.T, dir string) {
+	t.Helper()
+	githubReleaseCache.mu.Lock()
+	defer githubReleaseCache.mu.Unlock()
+	githubReleaseCache.loadLocked(dir)
+	for _, entry := range githubReleaseCache.data.Entries {
+		entry.FetchedAt = entry.FetchedAt.Add(-2 * releaseCacheTTL)
+	}
+}
+
+func TestFetchReleaseUsesCacheAndETag(t *testing.T) {
+	var hits, conditional int
+	useReleaseServer(t, func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			conditional++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		_ = json.NewEncoder(w).Encode(releaseInfo{TagName: "v25.10.15"})
+	})
+
+	dir := t.TempDir()
+	opts := Options{Repo: "XTLS/Xray-core", CacheDir: dir}
+	for range 3 {
+		_, version, err := fetchRelease(context.Background(), opts)
+		if err != nil {
+			t.Fatalf("fetchRelease: %v", err)
+		}
+		if version != "v25.10.15" {
+			t.Fatalf("unexpected version %q", version)
+		}
+	}
+	if hits != 1 {
+		t.Fatalf("expected fresh cache to avoid requests, got %d hits", hits)
+	}
+
+	ageReleaseCache(t, dir)
+	if _, _, err := fetchRelease(context.Background(), opts); err != nil {
+		t.Fatalf("fetchRelease after ttl: %v", err)
+	}
+	if conditional != 1 {
+		t.Fatalf("expected a conditional revalidation, got %d", conditional)
+	}
+
+	// A new process starts from the persisted cache and still sends the ETag.
+	githubReleaseCache.reset()
+	ageReleaseCache(t, dir)
+	if _, _, err := fetchRelease(context.Background(), opts); err != nil {
+		t.Fatalf("fetchRelease from disk cache: %v", err)
+	}
+	if conditional != 2 {
+		t.Fatalf("expected persisted etag to be reused, got %d conditional requests", conditional)
+	}
+}
+
+func TestFetchReleaseBacksOffWhenRateLimited(t *testing.T) {
+	var hits int
+	reset := time.Now().Add(time.Hour).Unix()
+	useReleaseServer(t, func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset, 10))
+		http.Error(w, `{"message":"API rate limit exceeded"}`, http.StatusForbidden)
+	})
+
+	opts := Options{Repo: "XTLS/Xray-core"}
+	for range 3 {
+		_, _, err := fetchRelease(context.Background(), opts)
+		if !IsRateLimited(err) {
+			t.Fatalf("expected rate limit error, got %v", err)
+		}
+	}
+	if hits != 1 {
+		t.Fatalf("expected backoff to suppress requests, got %d hits", hits)
+	}
+
+	githubReleaseCache.mu.Lock()
+	until := githubReleaseCache.data.BackoffUntil
+	githubReleaseCache.mu.Unlock()
+	if until.Unix() != reset {
+		t.Fatalf("backoff until %v, want %v", until, time.Unix(reset, 0))
+	}
+}
+
+func TestFetchReleaseServesStaleCacheWhileRateLimited(t *testing.T) {
+	limited := false
+	useReleaseServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if limited {
+			w.Header().Set("Retry-After", "120")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(releaseInfo{TagName: "v25.10.15"})
+	})
+
+	opts := Options{Repo: "XTLS/Xray-core"}
+	if _, _, err := fetchRelease(context.Background(), opts); err != nil {
+		t.Fatalf("fetchRelease: %v", err)
+	}
+	limited = true
+	ageReleaseCache(t, "")
+	_, version, err := fetchRelease(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("expected stale cache while rate limited, got %v", err)
+	}
+	if version != "v25.10.15" {
+		t.Fatalf("unexpected version %q", version)
+	}
+}
@@ -0,0 +1,82 @@
+package xraycore
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/najahiiii/xray-agent/internal/initsys"
+)
+
+// UninstallResult lists what Uninstall removed.
+type UninstallResult struct {
+	Removed []string
+}
+
+// Uninstall stops and removes the xray service, then deletes the binary,
+// the kept versions and the geodata. purge also deletes the config and
+// xray's log and state directories. Directories whose name does not contain
+// "xray" are never removed whole; only the files the agent put there are.
+func Uninstall(ctx context.Context, opts Options, purge bool) (*UninstallResult, error) {
+	opts.withDefaults()
+	res := &UninstallResult{}
+
+	kind, err := initsys.Resolve(opts.Init)
+	if err != nil {
+		return nil, err
+	}
+	if kind == initsys.None {
+		if opts.Logger != nil {
+			opts.Logger.Info("xray is supervised by the agent; stop the agent before removing xray")
+		}
+	} else {
+		svc := xrayService(opts)
+		if err := initsys.Uninstall(ctx, kind, svc); err != nil {
+			return nil, err
+		}
+		res.Removed = append(res.Removed, initsys.Path(kind, svc))
+	}
+
+	var errs []error
+	remove := func(path string) {
+		if _, err := os.Lstat(path); err != nil {
+			return
+		}
+		if err := os.RemoveAll(path); err != nil {
+			errs = append(errs, err)
+			return
+		}
+		res.Removed = append(res.Removed, path)
+	}
+	versions, err := keptVersions(opts)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	remove(filepath.Join(opts.BinDir, opts.binaryName()))
+	removeXrayDir(opts.VersionsDir, versions, remove)
+	removeXrayDir(opts.ShareDir, geodataFiles, remove)
+	if purge {
+		removeXrayDir(filepath.Dir(opts.ConfigPath), []string{filepath.Base(opts.ConfigPath)}, remove)
+		for _, dir := range stateDirs {
+			remove(dir)
+		}
+	}
+	if opts.Logger != nil {
+		opts.Logger.Info("xray core uninstalled", "removed", len(res.Removed), "purge", purge)
+	}
+	return res, errors.Join(errs...)
+}
+
+// removeXrayDir removes dir when it is xray's own directory, and otherwise
+// only files in it.
+func removeXrayDir(dir string, files []string, remove func(string)) {
+	if strings.Contains(strings.ToLower(filepath.Base(dir)), "xray") {
+		remove(dir)
+		return
+	}
+	for _, name := range files {
+		remove(filepath.Join(dir, name))
+	}
+}
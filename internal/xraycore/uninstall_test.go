@@ -0,0 +1,71 @@
+package xraycore
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUninstall(t *testing.T) {
+	root := t.TempDir()
+	opts := Options{
+		Init:        "none",
+		BinDir:      filepath.Join(root, "bin"),
+		VersionsDir: filepath.Join(root, "lib", "xray"),
+		ShareDir:    filepath.Join(root, "share"),
+		ConfigPath:  filepath.Join(root, "etc", "xray", "config.json"),
+	}
+	origStateDirs := stateDirs
+	stateDirs = []string{filepath.Join(root, "log", "xray")}
+	t.Cleanup(func() { stateDirs = origStateDirs })
+
+	for _, path := range []string{
+		filepath.Join(opts.VersionsDir, "v1", "xray"),
+		filepath.Join(opts.ShareDir, "geoip.dat"),
+		filepath.Join(opts.ShareDir, "other.dat"),
+		opts.ConfigPath,
+		filepath.Join(stateDirs[0], "access.log"),
+	} {
+		writeTestFile(t, path)
+	}
+	if err := switchBinary(opts, filepath.Join(opts.VersionsDir, "v1")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Uninstall(context.Background(), opts, false); err != nil {
+		t.Fatalf("Uninstall: %v", err)
+	}
+	for _, gone := range []string{filepath.Join(opts.BinDir, "xray"), opts.VersionsDir, filepath.Join(opts.ShareDir, "geoip.dat")} {
+		if _, err := os.Lstat(gone); !os.IsNotExist(err) {
+			t.Fatalf("%s still present, stat err = %v", gone, err)
+		}
+	}
+	for _, kept := range []string{filepath.Join(opts.ShareDir, "other.dat"), opts.ConfigPath, stateDirs[0]} {
+		if _, err := os.Stat(kept); err != nil {
+			t.Fatalf("%s removed without purge: %v", kept, err)
+		}
+	}
+
+	if _, err := Uninstall(context.Background(), opts, true); err != nil {
+		t.Fatalf("Uninstall(purge): %v", err)
+	}
+	for _, gone := range []string{filepath.Dir(opts.ConfigPath), stateDirs[0]} {
+		if _, err := os.Stat(gone); !os.IsNotExist(err) {
+			t.Fatalf("%s still present after purge, stat err = %v", gone, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(opts.ShareDir, "other.dat")); err != nil {
+		t.Fatalf("foreign file in a shared directory removed: %v", err)
+	}
+}
+
+func writeTestFile(t *testing.T, path string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
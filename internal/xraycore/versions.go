@@ -0,0 +1,220 @@
+package xraycore
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/najahiiii/xray-agent/internal/initsys"
+)
+
+// Every installed release keeps its binary in VersionsDir/<version>/xray and
+// BinDir/xray is a symlink to the active one, so a rollback only flips the
+// link. Geodata is shared and not versioned.
+const (
+	defaultVersionsDir  = "/usr/local/lib/xray"
+	defaultKeepVersions = 3
+)
+
+// ErrNoPreviousVersion is returned by Rollback when no other version is kept.
+var ErrNoPreviousVersion = errors.New("no previous xray version to roll back to")
+
+// serviceRestarter restarts xray after a rollback; overridden in tests.
+var serviceRestarter = func(ctx context.Context, opts Options) error {
+	kind, err := initsys.Resolve(opts.Init)
+	if err != nil {
+		return err
+	}
+	if kind == initsys.None {
+		if opts.Logger != nil {
+			opts.Logger.Info("xray is supervised by the agent; restart the agent to run the rolled back version")
+		}
+		return nil
+	}
+	return initsys.Restart(ctx, kind, xrayService(opts).Name)
+}
+
+// installVersionedBinary copies src to the directory of version and points
+// BinDir/xray at it, then prunes versions beyond KeepVersions.
+func installVersionedBinary(src string, opts Options, version string) error {
+	dir := filepath.Join(opts.VersionsDir, ensureTagPrefix(version))
+	if err := copyFile(src, filepath.Join(dir, opts.binaryName()), 0o755); err != nil {
+		return err
+	}
+	touch(dir)
+	if err := switchBinary(opts, dir); err != nil {
+		return err
+	}
+	return pruneVersions(opts)
+}
+
+// preserveBinary moves a plain BinDir/xray left by an install without
+// versioning into the directory of its version, so it can be rolled back to.
+func preserveBinary(opts Options, version string) error {
+	bin := filepath.Join(opts.BinDir, opts.binaryName())
+	info, err := os.Lstat(bin)
+	if err != nil || !info.Mode().IsRegular() || version == "" {
+		return nil
+	}
+	dir := filepath.Join(opts.VersionsDir, ensureTagPrefix(version))
+	if err := copyFile(bin, filepath.Join(dir, opts.binaryName()), 0o755); err != nil {
+		return fmt.Errorf("keep xray %s: %w", version, err)
+	}
+	// Older than the version about to be installed.
+	old := time.Now().Add(-time.Second)
+	_ = os.Chtimes(dir, old, old)
+	return nil
+}
+
+// switchBinary atomically replaces BinDir/xray with a symlink into dir.
+func switchBinary(opts Options, dir string) error {
+	if err := os.MkdirAll(opts.BinDir, 0o755); err != nil {
+		return err
+	}
+	link := filepath.Join(opts.BinDir, opts.binaryName())
+	tmp := link + ".new"
+	_ = os.Remove(tmp)
+	if err := os.Symlink(filepath.Join(dir, opts.binaryName()), tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, link); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// keptVersions lists the versions in VersionsDir, most recently installed or
+// activated first.
+func keptVersions(opts Options) ([]string, error) {
+	entries, err := os.ReadDir(opts.VersionsDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	type kept struct {
+		name string
+		mod  time.Time
+	}
+	var found []kept
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(opts.VersionsDir, e.Name(), opts.binaryName())); err != nil {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		found = append(found, kept{e.Name(), info.ModTime()})
+	}
+	slices.SortFunc(found, func(a, b kept) int {
+		return cmp.Or(b.mod.Compare(a.mod), strings.Compare(b.name, a.name))
+	})
+	names := make([]string, len(found))
+	for i, k := range found {
+		names[i] = k.name
+	}
+	return names, nil
+}
+
+// activeVersion returns the version BinDir/xray links to, or "" when it is
+// not a link into VersionsDir.
+func activeVersion(opts Options) string {
+	target, err := os.Readlink(filepath.Join(opts.BinDir, opts.binaryName()))
+	if err != nil {
+		return ""
+	}
+	dir := filepath.Dir(target)
+	if filepath.Dir(dir) != filepath.Clean(opts.VersionsDir) {
+		return ""
+	}
+	return filepath.Base(dir)
+}
+
+func pruneVersions(opts Options) error {
+	versions, err := keptVersions(opts)
+	if err != nil {
+		return err
+	}
+	active := activeVersion(opts)
+	keep := max(opts.KeepVersions, 1)
+	for i, v := range versions {
+		if i < keep || v == active {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(opts.VersionsDir, v)); err != nil {
+			return err
+		}
+		if opts.Logger != nil {
+			opts.Logger.Info("removed old xray version", "version", v)
+		}
+	}
+	return nil
+}
+
+// Rollback points BinDir/xray back at opts.Version, or at the most recent
+// other kept version when it is empty, checks the config with that binary
+// and restarts the xray service.
+func Rollback(ctx context.Context, opts Options) (*InstallResult, error) {
+	opts.withDefaults()
+	versions, err := keptVersions(opts)
+	if err != nil {
+		return nil, err
+	}
+	from := activeVersion(opts)
+	to := ""
+	if opts.Version != "" {
+		to = ensureTagPrefix(opts.Version)
+		if !slices.Contains(versions, to) {
+			return nil, fmt.Errorf("xray %s is not kept in %s", to, opts.VersionsDir)
+		}
+	} else {
+		for _, v := range versions {
+			if v != from {
+				to = v
+				break
+			}
+		}
+		if to == "" {
+			return nil, ErrNoPreviousVersion
+		}
+	}
+	if to == from {
+		return &InstallResult{FromVersion: from, ToVersion: to}, nil
+	}
+
+	dir := filepath.Join(opts.VersionsDir, to)
+	if err := switchBinary(opts, dir); err != nil {
+		return nil, err
+	}
+	if err := configTester(ctx, opts); err != nil {
+		if from != "" {
+			_ = switchBinary(opts, filepath.Join(opts.VersionsDir, from))
+		}
+		return nil, fmt.Errorf("xray %s rejects the config: %w", to, err)
+	}
+	touch(dir)
+	if err := serviceRestarter(ctx, opts); err != nil {
+		return nil, fmt.Errorf("restart xray: %w", err)
+	}
+	if opts.Logger != nil {
+		opts.Logger.Info("xray core rolled back", "from", from, "to", to)
+	}
+	return &InstallResult{FromVersion: from, ToVersion: to, Updated: true}, nil
+}
+
+func touch(path string) {
+	now := time.Now()
+	_ = os.Chtimes(path, now, now)
+}
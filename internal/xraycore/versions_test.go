@@ -0,0 +1,99 @@
+package xraycore
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func versionedOptions(t *testing.T) Options {
+	t.Helper()
+	opts := Options{BinDir: t.TempDir(), VersionsDir: t.TempDir(), KeepVersions: 2}
+	origTester, origRestarter := configTester, serviceRestarter
+	t.Cleanup(func() { configTester, serviceRestarter = origTester, origRestarter })
+	configTester = func(context.Context, Options) error { return nil }
+	serviceRestarter = func(context.Context, Options) error { return nil }
+	return opts
+}
+
+func installFake(t *testing.T, opts Options, version string) {
+	t.Helper()
+	src := filepath.Join(t.TempDir(), "xray")
+	if err := os.WriteFile(src, []byte("xray "+version), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := installVersionedBinary(src, opts, version); err != nil {
+		t.Fatalf("installVersionedBinary(%s): %v", version, err)
+	}
+}
+
+func activeBinary(t *testing.T, opts Options) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(opts.BinDir, "xray"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestInstallKeepsVersionsAndPrunes(t *testing.T) {
+	opts := versionedOptions(t)
+	if err := os.WriteFile(filepath.Join(opts.BinDir, "xray"), []byte("xray v0"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := preserveBinary(opts, "v0"); err != nil {
+		t.Fatalf("preserveBinary: %v", err)
+	}
+	installFake(t, opts, "v1")
+	installFake(t, opts, "v2")
+
+	if got := activeBinary(t, opts); got != "xray v2" {
+		t.Fatalf("active binary = %q; want v2", got)
+	}
+	versions, err := keptVersions(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(versions, []string{"v2", "v1"}) {
+		t.Fatalf("kept versions = %v; want [v2 v1]", versions)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	opts := versionedOptions(t)
+	var restarts int
+	serviceRestarter = func(context.Context, Options) error {
+		restarts++
+		return nil
+	}
+	if _, err := Rollback(context.Background(), opts); !errors.Is(err, ErrNoPreviousVersion) {
+		t.Fatalf("Rollback without versions = %v; want ErrNoPreviousVersion", err)
+	}
+	installFake(t, opts, "v1")
+	installFake(t, opts, "v2")
+
+	res, err := Rollback(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("Rollback: %v", err)
+	}
+	if res.FromVersion != "v2" || res.ToVersion != "v1" || activeBinary(t, opts) != "xray v1" || restarts != 1 {
+		t.Fatalf("Rollback = %+v, binary %q, restarts %d; want v2 -> v1", res, activeBinary(t, opts), restarts)
+	}
+
+	opts.Version = "v3"
+	if _, err := Rollback(context.Background(), opts); err == nil {
+		t.Fatal("Rollback to a version that is not kept succeeded")
+	}
+
+	opts.Version = "2"
+	configTester = func(context.Context, Options) error { return errors.New("bad config") }
+	if _, err := Rollback(context.Background(), opts); err == nil {
+		t.Fatal("Rollback succeeded although the config test failed")
+	}
+	if got := activeBinary(t, opts); got != "xray v1" || restarts != 1 {
+		t.Fatalf("binary %q after failed config test, restarts %d; want v1 kept", got, restarts)
+	}
+}
@@ -20,16 +20,27 @@ import (
 
 	_ "embed"
 	"log/slog"
+
+	"github.com/najahiiii/xray-agent/internal/initsys"
 )
 
 const (
 	defaultRepo        = "XTLS/Xray-core"
+	defaultAssetName   = "Xray-{arch}.zip"
 	defaultBinDir      = "/usr/local/bin"
 	defaultConfigPath  = "/etc/xray/config.json"
 	defaultServicePath = "/usr/lib/systemd/system/xray.service"
 	defaultShareDir    = "/usr/local/share/xray"
+
+	// Sanity limits for files written by and for a privileged process.
+	maxDownloadSize = 256 << 20
+	maxBinarySize   = 200 << 20
+	maxGeodataSize  = 128 << 20
+	maxUnzipSize    = 512 << 20
 )
 
+var geodataFiles = []string{"geoip.dat", "geosite.dat"}
+
 //go:embed assets/xray-config-sample.json
 var embeddedSampleConfig []byte
 
@@ -40,16 +51,55 @@ type Options struct {
 	// GitHub release options
 	Repo string
 	Arch string
+	// AssetName is the name of the release zip, with {arch} and {version}
+	// (the tag) filled in; default Xray-{arch}.zip. The zip must hold the
+	// binary as "xray" at its root.
+	AssetName string
+	// DigestOptional installs a release without a <asset>.dgst checksum
+	// instead of refusing it, for forks that do not publish one.
+	DigestOptional bool
 	// optional tag, e.g. v1.8.24
 	Version string
 	// optional GitHub token
 	Token string
+	// CacheDir persists release responses and rate-limit backoff across
+	// restarts; empty keeps the cache in memory only.
+	CacheDir string
+	// AssetCacheDir keeps verified release zips, keyed by version, checksum
+	// and asset name, so reinstalls skip the download; empty disables it.
+	// AssetCacheKeep is how many zips are kept (default 3, negative
+	// disables the cache).
+	AssetCacheDir  string
+	AssetCacheKeep int
+	// DownloadIdleTimeout aborts a download attempt that received no data
+	// for this long (default 60s); there is no limit on the total time.
+	DownloadIdleTimeout time.Duration
+	// Mirrors are tried in order when a release asset cannot be downloaded
+	// from GitHub; see downloadSources for the accepted forms.
+	Mirrors []string
+	// MinisignKey, when set, requires the release zip to carry a valid
+	// <zip>.minisig signature by this key on top of the .dgst checksum.
+	MinisignKey string
+	// Proxy is an http(s):// or socks5(h):// URL used for GitHub and asset
+	// downloads; empty falls back to HTTP_PROXY/HTTPS_PROXY.
+	Proxy string
 
 	// Install paths
 	BinDir      string
 	ConfigPath  string
 	ServicePath string
 	ShareDir    string
+	// VersionsDir keeps one directory per installed release; BinDir/xray
+	// links to the active one. KeepVersions is how many are kept.
+	VersionsDir  string
+	KeepVersions int
+	// Init selects the init system for the xray service (default auto-detect);
+	// "none" installs no service because the agent supervises xray itself.
+	Init string
+	// Limits are rendered into the xray service definition.
+	Limits Limits
+	// Hooks run around InstallOrUpdate.
+	Hooks Hooks
 
 	// Controls
 	Logger *slog.Logger
@@ -71,6 +121,9 @@ func (o *Options) withDefaults() {
 	if o.Repo == "" {
 		o.Repo = defaultRepo
 	}
+	if o.AssetName == "" {
+		o.AssetName = defaultAssetName
+	}
 	if o.BinDir == "" {
 		o.BinDir = defaultBinDir
 	}
@@ -83,6 +136,12 @@ func (o *Options) withDefaults() {
 	if o.ShareDir == "" {
 		o.ShareDir = defaultShareDir
 	}
+	if o.VersionsDir == "" {
+		o.VersionsDir = defaultVersionsDir
+	}
+	if o.KeepVersions <= 0 {
+		o.KeepVersions = defaultKeepVersions
+	}
 	if o.Arch == "" {
 		o.Arch = detectArch()
 	}
@@ -92,7 +151,7 @@ func Check(ctx context.Context, opts Options) (*CheckResult, error) {
 	opts.withDefaults()
 	log := opts.Logger
 
-	installed := installedVersion(ctx)
+	installed := opts.installedVersion(ctx)
 	latest, err := fetchLatestVersion(ctx, opts)
 	if err != nil {
 		return nil, err
@@ -113,10 +172,18 @@ func InstallOrUpdate(ctx context.Context, opts Options) (*InstallResult, error)
 	opts.withDefaults()
 	log := opts.Logger
 
-	installed := installedVersion(ctx)
+	installed := opts.installedVersion(ctx)
 	release, targetVersion, err := fetchRelease(ctx, opts)
 	if err != nil {
-		return nil, err
+		if opts.Version == "" || len(opts.Mirrors) == 0 {
+			return nil, err
+		}
+		// A pinned version has predictable asset URLs, so mirrors can still
+		// serve it when api.github.com is unreachable.
+		release, targetVersion = pinnedRelease(opts)
+		if log != nil {
+			log.Warn("github release lookup failed; using pinned asset urls", "version", targetVersion, "err", err)
+		}
 	}
 
 	if normalizeVersion(installed) == normalizeVersion(targetVersion) {
@@ -130,68 +197,235 @@ func InstallOrUpdate(ctx context.Context, opts Options) (*InstallResult, error)
 		log.Info("installing xray core", "from", installed, "to", targetVersion, "arch", opts.Arch)
 	}
 
+	hookEnv := []string{"XRAY_FROM_VERSION=" + installed, "XRAY_TO_VERSION=" + targetVersion}
+	if err := runHook(ctx, opts, "pre_update", opts.Hooks.PreUpdate, hookEnv); err != nil {
+		runFailureHook(ctx, opts, hookEnv, err)
+		return nil, err
+	}
+	if err := installRelease(ctx, opts, release, installed, targetVersion); err != nil {
+		runFailureHook(ctx, opts, hookEnv, err)
+		return nil, err
+	}
+	if err := runHook(ctx, opts, "post_update", opts.Hooks.PostUpdate, hookEnv); err != nil && log != nil {
+		log.Warn("xray core hook failed", "err", err)
+	}
+
+	if log != nil {
+		log.Info("xray core installed", "version", targetVersion)
+	}
+	return &InstallResult{FromVersion: installed, ToVersion: targetVersion, Updated: true}, nil
+}
+
+// installRelease downloads release and installs it as targetVersion over
+// installed.
+func installRelease(ctx context.Context, opts Options, release *releaseInfo, installed, targetVersion string) error {
 	tmpDir, err := os.MkdirTemp("", "xraycore-*")
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer os.RemoveAll(tmpDir)
 
-	zipURL, dgstURL, err := pickAssetURLs(release, opts.Arch)
+	unzipDir, geoDigests, err := fetchReleaseAssets(ctx, opts, release, tmpDir)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	zipPath := filepath.Join(tmpDir, "xray.zip")
-	dgstPath := filepath.Join(tmpDir, "xray.zip.dgst")
-
-	if err := download(ctx, zipURL, zipPath, opts.Token); err != nil {
-		return nil, fmt.Errorf("download zip: %w", err)
+	if err := createWorkDirs(opts); err != nil {
+		return err
 	}
-	if err := download(ctx, dgstURL, dgstPath, opts.Token); err != nil {
-		return nil, fmt.Errorf("download dgst: %w", err)
+	if err := preserveBinary(opts, installed); err != nil {
+		return err
 	}
-	if err := verifySHA256(zipPath, dgstPath); err != nil {
-		return nil, err
+	if err := installBinaryAndData(unzipDir, opts, targetVersion, geoDigests); err != nil {
+		return err
+	}
+	if err := copySampleConfig(opts); err != nil {
+		return err
+	}
+	if err := testConfig(ctx, opts); err != nil {
+		return err
 	}
+	return installService(ctx, opts)
+}
 
-	unzipDir := filepath.Join(tmpDir, "unzipped")
-	if err := unzip(zipPath, unzipDir); err != nil {
-		return nil, fmt.Errorf("unzip: %w", err)
+// GeodataResult reports what UpdateGeodata replaced.
+type GeodataResult struct {
+	Version string
+	Files   []string
+}
+
+// UpdateGeodata replaces geoip.dat and geosite.dat with the copies shipped in
+// the release of opts.Version (the latest release when empty), checked the
+// same way as a full install. The xray binary is left alone; xray has to be
+// restarted to load the new files.
+func UpdateGeodata(ctx context.Context, opts Options) (*GeodataResult, error) {
+	opts.withDefaults()
+	release, version, err := fetchRelease(ctx, opts)
+	if err != nil {
+		if opts.Version == "" || len(opts.Mirrors) == 0 {
+			return nil, err
+		}
+		release, version = pinnedRelease(opts)
 	}
 
-	if err := createWorkDirs(opts); err != nil {
+	tmpDir, err := os.MkdirTemp("", "xraycore-*")
+	if err != nil {
 		return nil, err
 	}
-	if err := installBinaryAndData(unzipDir, opts); err != nil {
+	defer os.RemoveAll(tmpDir)
+
+	unzipDir, geoDigests, err := fetchReleaseAssets(ctx, opts, release, tmpDir)
+	if err != nil {
 		return nil, err
 	}
-	if err := copySampleConfig(opts); err != nil {
+	files, err := checkGeodata(unzipDir, geoDigests)
+	if err != nil {
 		return nil, err
 	}
-	if err := testConfig(ctx, opts); err != nil {
-		return nil, err
+	if len(files) == 0 {
+		return nil, fmt.Errorf("release %s ships no geodata", version)
 	}
-	if err := installSystemdService(opts); err != nil {
+	if err := os.MkdirAll(opts.ShareDir, 0o755); err != nil {
 		return nil, err
 	}
+	for _, name := range files {
+		if err := copyFile(filepath.Join(unzipDir, name), filepath.Join(opts.ShareDir, name), 0o644); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Logger != nil {
+		opts.Logger.Info("xray geodata updated", "version", version, "files", files)
+	}
+	return &GeodataResult{Version: version, Files: files}, nil
+}
 
-	if log != nil {
-		log.Info("xray core installed", "version", targetVersion)
+// fetchReleaseAssets downloads and verifies the release zip for opts.Arch and
+// unpacks it under tmpDir. It returns the unpacked directory and the geodata
+// .dgst files published with the release (file name -> dgst path).
+func fetchReleaseAssets(ctx context.Context, opts Options, release *releaseInfo, tmpDir string) (string, map[string]string, error) {
+	assetName := opts.assetName(release.TagName)
+	zipURL, dgstURL, err := pickAssetURLs(release, assetName)
+	if err != nil {
+		return "", nil, err
 	}
-	return &InstallResult{FromVersion: installed, ToVersion: targetVersion, Updated: true}, nil
+	if dgstURL == "" && !opts.DigestOptional {
+		return "", nil, fmt.Errorf("asset %s.dgst not found", assetName)
+	}
+	var sigKey *minisignKey
+	sigURL := ""
+	if opts.MinisignKey != "" {
+		if sigKey, err = parseMinisignKey(opts.MinisignKey); err != nil {
+			return "", nil, err
+		}
+		if sigURL = pickSignatureURL(release, assetName); sigURL == "" {
+			return "", nil, fmt.Errorf("asset %s%s not found", assetName, minisignSuffix)
+		}
+	}
+
+	zipPath := filepath.Join(tmpDir, "xray.zip")
+	dgstPath := filepath.Join(tmpDir, "xray.zip.dgst")
+
+	// The checksum comes first so a cached zip can be looked up by it.
+	cached := ""
+	if dgstURL != "" {
+		if err := downloadChecksum(ctx, dgstURL, dgstPath, opts); err != nil {
+			return "", nil, fmt.Errorf("download dgst: %w", err)
+		}
+		if sum, err := dgstSHA256(dgstPath); err == nil && opts.assetCacheEnabled() {
+			cached = cachedAssetPath(opts, release.TagName, assetName, sum)
+		}
+	} else if opts.Logger != nil {
+		opts.Logger.Warn("release has no checksum; installing unverified", "asset", assetName)
+	}
+	if cached == "" || !loadCachedAsset(opts, cached, zipPath, dgstPath) {
+		if err := downloadWithMirrors(ctx, zipURL, zipPath, opts); err != nil {
+			return "", nil, fmt.Errorf("download zip: %w", err)
+		}
+		if dgstURL != "" {
+			if err := verifySHA256(zipPath, dgstPath); err != nil {
+				return "", nil, err
+			}
+		}
+		if cached != "" {
+			storeCachedAsset(opts, zipPath, cached)
+		}
+	}
+	if sigKey != nil {
+		sigPath := zipPath + minisignSuffix
+		if err := downloadWithMirrors(ctx, sigURL, sigPath, opts); err != nil {
+			return "", nil, fmt.Errorf("download signature: %w", err)
+		}
+		if err := verifyMinisign(zipPath, sigPath, sigKey); err != nil {
+			return "", nil, fmt.Errorf("verify signature: %w", err)
+		}
+	}
+
+	geoDigests := map[string]string{}
+	for name, url := range pickGeodataDigestURLs(release) {
+		path := filepath.Join(tmpDir, name+".dgst")
+		if err := downloadChecksum(ctx, url, path, opts); err != nil {
+			return "", nil, fmt.Errorf("download %s dgst: %w", name, err)
+		}
+		geoDigests[name] = path
+	}
+
+	unzipDir := filepath.Join(tmpDir, "unzipped")
+	if err := unzip(zipPath, unzipDir); err != nil {
+		return "", nil, fmt.Errorf("unzip: %w", err)
+	}
+	return unzipDir, geoDigests, nil
 }
 
 func detectArch() string {
-	switch runtime.GOARCH {
+	return releaseArch(runtime.GOOS, runtime.GOARCH)
+}
+
+// releaseArch maps a GOOS/GOARCH pair to the platform part of Xray-core's
+// release asset names, e.g. linux/arm64 -> linux-arm64-v8a. Unknown pairs
+// are returned as goos-goarch.
+func releaseArch(goos, goarch string) string {
+	if goos == "darwin" {
+		goos = "macos"
+	}
+	switch goarch {
 	case "amd64":
-		return "linux-64"
+		return goos + "-64"
+	case "386":
+		return goos + "-32"
 	case "arm64":
-		return "linux-arm64-v8a"
+		return goos + "-arm64-v8a"
 	case "arm":
-		return "linux-arm32-v7a"
+		// GOARM is not known at runtime; v7 is what current boards run.
+		return goos + "-arm32-v7a"
+	case "mips", "mipsle":
+		return goos + "-" + strings.Replace(goarch, "mips", "mips32", 1)
 	default:
-		return runtime.GOARCH
+		// mips64, mips64le, riscv64, loong64, ppc64, ppc64le and s390x keep
+		// their GOARCH name.
+		return goos + "-" + goarch
+	}
+}
+
+// binaryName is the name of the xray binary in release zips for o.Arch and
+// the name it is installed under.
+func (o Options) binaryName() string {
+	if strings.HasPrefix(o.Arch, "windows-") {
+		return "xray.exe"
+	}
+	return "xray"
+}
+
+// crossArch reports whether o.Arch was overridden to another platform, in
+// which case the installed binary cannot be run here. ARM revisions
+// (arm32-v6 vs -v7a) count as the same platform.
+func (o Options) crossArch() bool {
+	family := func(arch string) string {
+		if i := strings.LastIndex(arch, "-v"); i > 0 && strings.Contains(arch, "-arm") {
+			return arch[:i]
+		}
+		return arch
 	}
+	return o.Arch != "" && family(o.Arch) != family(detectArch())
 }
 
 func fetchLatestVersion(ctx context.Context, opts Options) (string, error) {
@@ -215,102 +449,181 @@ type releaseInfo struct {
 	Assets  []releaseAsset `json:"assets"`
 }
 
+var githubAPIBase = "https://api.github.com"
+
 func fetchRelease(ctx context.Context, opts Options) (*releaseInfo, string, error) {
-	client := &http.Client{Timeout: 20 * time.Second}
-	url := fmt.Sprintf("https://api.github.com/repos/%s/releases/latest", opts.Repo)
+	client, err := opts.httpClient(20 * time.Second)
+	if err != nil {
+		return nil, "", err
+	}
+	url := fmt.Sprintf("%s/repos/%s/releases/latest", githubAPIBase, opts.Repo)
 	tag := ""
 	if opts.Version != "" {
 		tag = ensureTagPrefix(opts.Version)
-		url = fmt.Sprintf("https://api.github.com/repos/%s/releases/tags/%s", opts.Repo, tag)
+		url = fmt.Sprintf("%s/repos/%s/releases/tags/%s", githubAPIBase, opts.Repo, tag)
 	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	rel, err := fetchReleaseCached(ctx, client, url, opts)
 	if err != nil {
 		return nil, "", err
 	}
+	version := rel.TagName
+	if tag != "" {
+		version = tag
+	}
+	return rel, version, nil
+}
+
+// fetchReleaseCached serves url from the release cache while it is fresh,
+// revalidates it with If-None-Match afterwards, and falls back to a stale copy
+// while GitHub is rate limiting us.
+func fetchReleaseCached(ctx context.Context, client *http.Client, url string, opts Options) (*releaseInfo, error) {
+	now := time.Now()
+	cached, backoffUntil := githubReleaseCache.lookup(opts.CacheDir, url)
+	if cached != nil && now.Sub(cached.FetchedAt) < releaseCacheTTL {
+		return &cached.Release, nil
+	}
+	if now.Before(backoffUntil) {
+		if cached != nil {
+			return &cached.Release, nil
+		}
+		return nil, &RateLimitError{Until: backoffUntil}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
 	req.Header.Set("Accept", "application/vnd.github+json")
 	if opts.Token != "" {
 		req.Header.Set("Authorization", "Bearer "+opts.Token)
 	}
+	if cached != nil && cached.ETag != "" {
+		req.Header.Set("If-None-Match", cached.ETag)
+	}
 
 	resp, err := client.Do(req)
 	if err != nil {
-		return nil, "", err
+		return nil, err
 	}
 	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		cached.FetchedAt = now
+		githubReleaseCache.store(opts.CacheDir, url, cached)
+		return &cached.Release, nil
+	}
+	if until := rateLimitUntil(resp, now); !until.IsZero() {
+		githubReleaseCache.backoff(opts.CacheDir, until)
+		if opts.Logger != nil {
+			opts.Logger.Warn("github api rate limited", "until", until.UTC(), "cached", cached != nil)
+		}
+		if cached != nil {
+			return &cached.Release, nil
+		}
+		return nil, &RateLimitError{Until: until}
+	}
 	if resp.StatusCode/100 != 2 {
 		b, _ := io.ReadAll(resp.Body)
-		return nil, "", fmt.Errorf("github release http %d: %s", resp.StatusCode, string(b))
+		return nil, fmt.Errorf("github release http %d: %s", resp.StatusCode, string(b))
 	}
 
 	var rel releaseInfo
 	if err := json.NewDecoder(resp.Body).Decode(&rel); err != nil {
-		return nil, "", err
-	}
-	version := rel.TagName
-	if tag != "" {
-		version = tag
+		return nil, err
 	}
-	return &rel, version, nil
+	githubReleaseCache.store(opts.CacheDir, url, &releaseCacheEntry{
+		ETag:      resp.Header.Get("ETag"),
+		FetchedAt: now,
+		Release:   rel,
+	})
+	return &rel, nil
 }
 
-func pickAssetURLs(rel *releaseInfo, arch string) (zipURL, dgstURL string, err error) {
-	zipPattern := fmt.Sprintf("^Xray-%s\\.zip$", arch)
-	dgstPattern := fmt.Sprintf("^Xray-%s\\.zip\\.dgst$", arch)
+// pinnedRelease builds the release GitHub would return for opts.Version from
+// the standard release download URL layout.
+func pinnedRelease(opts Options) (*releaseInfo, string) {
+	tag := ensureTagPrefix(opts.Version)
+	base := fmt.Sprintf("https://github.com/%s/releases/download/%s/", opts.Repo, tag)
+	zipName := opts.assetName(tag)
+	return &releaseInfo{
+		TagName: tag,
+		Assets: []releaseAsset{
+			{Name: zipName, BrowserDownloadURL: base + zipName},
+			{Name: zipName + ".dgst", BrowserDownloadURL: base + zipName + ".dgst"},
+			{Name: zipName + minisignSuffix, BrowserDownloadURL: base + zipName + minisignSuffix},
+		},
+	}, tag
+}
+
+// assetName returns the release zip name for version.
+func (o Options) assetName(version string) string {
+	return strings.NewReplacer("{arch}", o.Arch, "{version}", version).Replace(o.AssetName)
+}
 
+// pickAssetURLs returns the URLs of the asset named name and of its .dgst
+// checksum, which is "" when the release has none.
+func pickAssetURLs(rel *releaseInfo, name string) (zipURL, dgstURL string, err error) {
 	for _, a := range rel.Assets {
-		switch {
-		case regexp.MustCompile(zipPattern).MatchString(a.Name):
+		switch a.Name {
+		case name:
 			zipURL = a.BrowserDownloadURL
-		case regexp.MustCompile(dgstPattern).MatchString(a.Name):
+		case name + ".dgst":
 			dgstURL = a.BrowserDownloadURL
 		}
 	}
-	if zipURL == "" || dgstURL == "" {
-		return "", "", fmt.Errorf("asset not found for arch=%s", arch)
+	if zipURL == "" {
+		return "", "", fmt.Errorf("asset %s not found", name)
 	}
 	return zipURL, dgstURL, nil
 }
 
-func download(ctx context.Context, url, dest, token string) error {
-	client := &http.Client{Timeout: 60 * time.Second}
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
-	if err != nil {
-		return err
-	}
-	if token != "" {
-		req.Header.Set("Authorization", "Bearer "+token)
-	}
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode/100 != 2 {
-		return fmt.Errorf("download %s: http %d", url, resp.StatusCode)
+// pickSignatureURL returns the URL of the minisign signature of the asset
+// named name, or "" when the release has none.
+func pickSignatureURL(rel *releaseInfo, name string) string {
+	for _, a := range rel.Assets {
+		if a.Name == name+minisignSuffix {
+			return a.BrowserDownloadURL
+		}
 	}
-	f, err := os.Create(dest)
-	if err != nil {
-		return err
+	return ""
+}
+
+// pickGeodataDigestURLs returns dgst asset URLs for geodata files the release
+// publishes checksums for, keyed by geodata file name.
+func pickGeodataDigestURLs(rel *releaseInfo) map[string]string {
+	urls := map[string]string{}
+	for _, a := range rel.Assets {
+		for _, name := range geodataFiles {
+			if a.Name == name+".dgst" {
+				urls[name] = a.BrowserDownloadURL
+			}
+		}
 	}
-	defer f.Close()
-	_, err = io.Copy(f, resp.Body)
-	return err
+	return urls
 }
 
-func verifySHA256(zipPath, dgstPath string) error {
+// dgstSHA256 returns the sha256 listed in a .dgst file, lower-cased.
+func dgstSHA256(dgstPath string) (string, error) {
 	dgstBytes, err := os.ReadFile(dgstPath)
 	if err != nil {
-		return err
+		return "", err
 	}
 	re := regexp.MustCompile(`(?i)\b([a-f0-9]{64})\b`)
 	m := re.FindSubmatch(dgstBytes)
 	if len(m) < 2 {
-		return errors.New("sha256 not found in dgst file")
+		return "", errors.New("sha256 not found in dgst file")
+	}
+	return strings.ToLower(string(m[1])), nil
+}
+
+func verifySHA256(path, dgstPath string) error {
+	want, err := dgstSHA256(dgstPath)
+	if err != nil {
+		return err
 	}
-	want := string(m[1])
 
-	file, err := os.Open(zipPath)
+	file, err := os.Open(path)
 	if err != nil {
 		return err
 	}
@@ -337,8 +650,16 @@ func unzip(src, dest string) error {
 		return err
 	}
 
+	var total uint64
 	for _, f := range r.File {
 		outPath := filepath.Join(dest, f.Name)
+		if !strings.HasPrefix(outPath, filepath.Clean(dest)+string(os.PathSeparator)) {
+			return fmt.Errorf("zip entry %q escapes destination", f.Name)
+		}
+		total += f.UncompressedSize64
+		if total > maxUnzipSize {
+			return fmt.Errorf("zip contents exceed %d bytes", maxUnzipSize)
+		}
 		if f.FileInfo().IsDir() {
 			if err := os.MkdirAll(outPath, f.Mode()); err != nil {
 				return err
@@ -358,7 +679,8 @@ func unzip(src, dest string) error {
 			rc.Close()
 			return err
 		}
-		if _, err := io.Copy(w, rc); err != nil {
+		// The header size can lie; cap what is actually written too.
+		if _, err := io.Copy(w, io.LimitReader(rc, int64(f.UncompressedSize64))); err != nil {
 			rc.Close()
 			w.Close()
 			return err
@@ -369,8 +691,11 @@ func unzip(src, dest string) error {
 	return nil
 }
 
+// stateDirs hold xray's logs and state; overridden in tests.
+var stateDirs = []string{"/var/log/xray", "/var/lib/xray"}
+
 func createWorkDirs(opts Options) error {
-	for _, dir := range []string{"/etc/xray", "/var/log/xray", "/var/lib/xray", opts.ShareDir} {
+	for _, dir := range append([]string{"/etc/xray", opts.ShareDir}, stateDirs...) {
 		if err := os.MkdirAll(dir, 0o755); err != nil {
 			return err
 		}
@@ -378,24 +703,64 @@ func createWorkDirs(opts Options) error {
 	return nil
 }
 
-func installBinaryAndData(unzipDir string, opts Options) error {
-	src := filepath.Join(unzipDir, "xray")
-	dest := filepath.Join(opts.BinDir, "xray")
-	if err := os.MkdirAll(opts.BinDir, 0o755); err != nil {
+// installBinaryAndData installs the xray binary as version and copies the
+// geodata into place after checking their sizes. Geodata with a matching
+// .dgst release asset in geoDigests (file name -> dgst path) must also match
+// its checksum.
+func installBinaryAndData(unzipDir string, opts Options, version string, geoDigests map[string]string) error {
+	src := filepath.Join(unzipDir, opts.binaryName())
+	if err := checkFileSize(src, maxBinarySize); err != nil {
 		return err
 	}
-	if err := copyFile(src, dest, 0o755); err != nil {
+
+	geodata, err := checkGeodata(unzipDir, geoDigests)
+	if err != nil {
 		return err
 	}
 
-	for _, name := range []string{"geoip.dat", "geosite.dat"} {
+	if err := installVersionedBinary(src, opts, version); err != nil {
+		return err
+	}
+	for _, name := range geodata {
+		if err := copyFile(filepath.Join(unzipDir, name), filepath.Join(opts.ShareDir, name), 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkGeodata returns the geodata files present in unzipDir after checking
+// their sizes and, where geoDigests has one, their checksums.
+func checkGeodata(unzipDir string, geoDigests map[string]string) ([]string, error) {
+	var geodata []string
+	for _, name := range geodataFiles {
 		srcPath := filepath.Join(unzipDir, name)
-		if _, err := os.Stat(srcPath); err == nil {
-			destPath := filepath.Join(opts.ShareDir, name)
-			if err := copyFile(srcPath, destPath, 0o644); err != nil {
-				return err
+		if _, err := os.Stat(srcPath); err != nil {
+			continue
+		}
+		if err := checkFileSize(srcPath, maxGeodataSize); err != nil {
+			return nil, err
+		}
+		if dgstPath, ok := geoDigests[name]; ok {
+			if err := verifySHA256(srcPath, dgstPath); err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
 			}
 		}
+		geodata = append(geodata, name)
+	}
+	return geodata, nil
+}
+
+func checkFileSize(path string, limit int64) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		return fmt.Errorf("%s is empty", filepath.Base(path))
+	}
+	if info.Size() > limit {
+		return fmt.Errorf("%s is %d bytes, over the %d byte limit", filepath.Base(path), info.Size(), limit)
 	}
 	return nil
 }
@@ -407,18 +772,31 @@ func copySampleConfig(opts Options) error {
 	return writeBytes(opts.ConfigPath, embeddedSampleConfig, 0o644)
 }
 
-func installSystemdService(opts Options) error {
-	if err := writeBytes(opts.ServicePath, embeddedServiceUnit, 0o644); err != nil {
+func installService(ctx context.Context, opts Options) error {
+	kind, err := initsys.Resolve(opts.Init)
+	if err != nil {
 		return err
 	}
-	if err := runCmd(exec.Command("systemctl", "daemon-reload")); err != nil {
-		return err
+	if kind == initsys.None {
+		if opts.Logger != nil {
+			opts.Logger.Info("skipping xray service install; the agent supervises xray")
+		}
+		return nil
+	}
+	if opts.Logger != nil {
+		opts.Logger.Info("installing xray service", "init", kind)
 	}
-	return runCmd(exec.Command("systemctl", "enable", "--now", "xray"))
+	return initsys.Install(ctx, kind, xrayService(opts))
 }
 
 func testConfig(ctx context.Context, opts Options) error {
-	cmd := exec.CommandContext(ctx, filepath.Join(opts.BinDir, "xray"), "-test", "-config", opts.ConfigPath)
+	if opts.crossArch() {
+		if opts.Logger != nil {
+			opts.Logger.Info("skipping xray config test for another platform", "arch", opts.Arch)
+		}
+		return nil
+	}
+	cmd := exec.CommandContext(ctx, filepath.Join(opts.BinDir, opts.binaryName()), "-test", "-config", opts.ConfigPath)
 	return runCmd(cmd)
 }
 
@@ -481,7 +859,20 @@ func writeStream(dest string, r io.Reader, perm os.FileMode) error {
 }
 
 func installedVersion(ctx context.Context) string {
-	cmd := exec.CommandContext(ctx, "xray", "-version")
+	return binaryVersion(ctx, "xray")
+}
+
+// installedVersion asks the binary in BinDir first, so an adopted install
+// outside PATH is still recognised.
+func (o Options) installedVersion(ctx context.Context) string {
+	if v := binaryVersion(ctx, filepath.Join(o.BinDir, o.binaryName())); v != "" {
+		return v
+	}
+	return installedVersion(ctx)
+}
+
+func binaryVersion(ctx context.Context, binary string) string {
+	cmd := exec.CommandContext(ctx, binary, "-version")
 	out, err := cmd.Output()
 	if err != nil {
 		return ""
@@ -113,7 +113,7 @@ func TestPickAssetURLs(t *testing.T) {
 		},
 	}
 
-	zipURL, dgstURL, err := pickAssetURLs(rel, "linux-64")
+	zipURL, dgstURL, err := pickAssetURLs(rel, "Xray-linux-64.zip")
 	if err != nil {
 		t.Fatalf("pickAssetURLs() error = %v", err)
 	}
@@ -132,8 +132,24 @@ func TestPickAssetURLsMissingAsset(t *testing.T) {
 		},
 	}
 
-	if _, _, err := pickAssetURLs(rel, "linux-64"); err == nil {
-		t.Fatal("pickAssetURLs() expected error for missing dgst asset")
+	zipURL, dgstURL, err := pickAssetURLs(rel, "Xray-linux-64.zip")
+	if err != nil || zipURL == "" || dgstURL != "" {
+		t.Fatalf("pickAssetURLs() = %q, %q, %v; want the zip without a dgst", zipURL, dgstURL, err)
+	}
+	if _, _, err := pickAssetURLs(rel, "Xray-linux-arm64-v8a.zip"); err == nil {
+		t.Fatal("pickAssetURLs() expected error for missing zip asset")
+	}
+}
+
+func TestAssetNameTemplate(t *testing.T) {
+	opts := Options{Repo: "someone/xray-fork", Arch: "linux-64", Version: "1.2.3", AssetName: "xray-fork_{version}_{arch}.zip"}
+	if got := opts.assetName("v1.2.3"); got != "xray-fork_v1.2.3_linux-64.zip" {
+		t.Fatalf("assetName = %q", got)
+	}
+	rel, _ := pinnedRelease(opts)
+	zipURL, _, err := pickAssetURLs(rel, opts.assetName(rel.TagName))
+	if err != nil || zipURL != "https://github.com/someone/xray-fork/releases/download/v1.2.3/xray-fork_v1.2.3_linux-64.zip" {
+		t.Fatalf("pinned zip url = %q, %v", zipURL, err)
 	}
 }
 
@@ -178,3 +194,35 @@ func TestVerifySHA256Mismatch(t *testing.T) {
 		t.Fatalf("verifySHA256() error = %v, want mismatch message", err)
 	}
 }
+
+func TestReleaseArch(t *testing.T) {
+	for _, tc := range []struct{ goos, goarch, want string }{
+		{"linux", "amd64", "linux-64"},
+		{"linux", "386", "linux-32"},
+		{"linux", "arm64", "linux-arm64-v8a"},
+		{"linux", "arm", "linux-arm32-v7a"},
+		{"linux", "mips", "linux-mips32"},
+		{"linux", "mipsle", "linux-mips32le"},
+		{"linux", "mips64le", "linux-mips64le"},
+		{"linux", "riscv64", "linux-riscv64"},
+		{"freebsd", "amd64", "freebsd-64"},
+		{"windows", "amd64", "windows-64"},
+		{"darwin", "arm64", "macos-arm64-v8a"},
+	} {
+		if got := releaseArch(tc.goos, tc.goarch); got != tc.want {
+			t.Errorf("releaseArch(%s, %s) = %q, want %q", tc.goos, tc.goarch, got, tc.want)
+		}
+	}
+	if got := (Options{Arch: "windows-64"}).binaryName(); got != "xray.exe" {
+		t.Errorf("binaryName(windows-64) = %q, want xray.exe", got)
+	}
+}
+
+func TestCrossArch(t *testing.T) {
+	if (Options{Arch: detectArch()}).crossArch() || (Options{}).crossArch() {
+		t.Fatal("the detected platform is not cross")
+	}
+	if !(Options{Arch: "windows-arm64-v8a"}).crossArch() {
+		t.Fatal("windows-arm64-v8a should be cross from this host")
+	}
+}
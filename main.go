@@ -1,28 +1,53 @@
 package main
 
 import (
+	"cmp"
 	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"maps"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"runtime"
 	"runtime/debug"
+	"slices"
 	"strings"
+	"sync"
 	"syscall"
+	"text/tabwriter"
+	"time"
 
 	_ "embed"
 	"log/slog"
 
+	"github.com/najahiiii/xray-agent/internal/admin"
 	"github.com/najahiiii/xray-agent/internal/agent"
 	"github.com/najahiiii/xray-agent/internal/agentsetup"
+	"github.com/najahiiii/xray-agent/internal/audit"
 	"github.com/najahiiii/xray-agent/internal/config"
 	"github.com/najahiiii/xray-agent/internal/control"
+	"github.com/najahiiii/xray-agent/internal/debugserver"
+	"github.com/najahiiii/xray-agent/internal/e2e"
 	"github.com/najahiiii/xray-agent/internal/logger"
+	"github.com/najahiiii/xray-agent/internal/logtail"
 	"github.com/najahiiii/xray-agent/internal/metrics"
+	"github.com/najahiiii/xray-agent/internal/model"
+	"github.com/najahiiii/xray-agent/internal/privsep"
+	"github.com/najahiiii/xray-agent/internal/singbox"
+	"github.com/najahiiii/xray-agent/internal/state"
 	internalStats "github.com/najahiiii/xray-agent/internal/stats"
+	"github.com/najahiiii/xray-agent/internal/supervisor"
+	"github.com/najahiiii/xray-agent/internal/usage"
 	"github.com/najahiiii/xray-agent/internal/xray"
+	"github.com/najahiiii/xray-agent/internal/xrayconf"
 	"github.com/najahiiii/xray-agent/internal/xraycore"
+
+	"gopkg.in/yaml.v3"
 )
 
 const defaultConfigPath = "/etc/xray-agent/config.yaml"
@@ -30,6 +55,10 @@ const defaultConfigPath = "/etc/xray-agent/config.yaml"
 //go:embed version
 var embeddedVersion string
 
+// buildDate is set by release builds with -ldflags "-X main.buildDate=...";
+// other builds report the commit time instead, when known.
+var buildDate string
+
 var (
 	xrayCoreInstaller        = xraycore.InstallOrUpdate
 	xrayCoreInstalledVersion = xraycore.InstalledVersion
@@ -49,10 +78,28 @@ func main() {
 		setupCommand(args[1:])
 	case "update-config":
 		updateConfigCommand(args[1:])
+	case "register":
+		registerCommand(args[1:])
 	case "run":
 		runAgent(args[1:])
+	case "routes":
+		routesCommand(args[1:])
+	case "top":
+		topCommand(args[1:])
+	case "clients":
+		clientsCommand(args[1:])
+	case "stats":
+		statsCommand(args[1:])
+	case "logs":
+		logsCommand(args[1:])
+	case "usage":
+		usageCommand(args[1:])
+	case "config":
+		configCommand(args[1:])
 	case "version", "-v", "--version":
-		printVersion()
+		versionCommand(args[1:])
+	case "e2e":
+		e2eCommand(args[1:])
 	default:
 		printHelp()
 	}
@@ -68,10 +115,12 @@ func coreCommand(args []string) {
 func runCoreCommand(args []string) error {
 	fs := flag.NewFlagSet("core", flag.ContinueOnError)
 	fs.SetOutput(io.Discard)
-	action := fs.String("action", "check", "core action: check|install")
+	action := fs.String("action", "check", "core action: check|install|rollback|uninstall|limits|detect|adopt|migrate")
 	version := fs.String("version", "", "target xray-core version (default internal)")
 	ghTokenFlag := fs.String("github-token", "", "GitHub token (optional)")
 	cfgPath := fs.String("config", defaultConfigPath, "config path (optional, to read defaults)")
+	noService := fs.Bool("no-service", false, "install binary and data only; the agent supervises xray (service.init: none)")
+	purge := fs.Bool("purge", false, "uninstall: also remove the xray config and log/state directories")
 	if err := fs.Parse(args); err != nil {
 		return err
 	}
@@ -96,15 +145,57 @@ func runCoreCommand(args []string) error {
 		}
 	}
 	cfgToken := ""
+	cacheDir := ""
+	initSystem := ""
+	var mirrors []string
+	minisignKey := ""
+	downloadProxy := ""
+	repo, assetName, dgstOptional := "", "", false
+	arch := ""
+	var downloadTimeout time.Duration
+	assetCacheDir, assetCacheKeep := "", 0
+	var limits xraycore.Limits
+	var hooks xraycore.Hooks
 	if cfgFromFile != nil {
+		limits = coreLimits(cfgFromFile)
+		hooks = coreHooks(cfgFromFile)
 		cfgToken = cfgFromFile.GitHub.Token
+		cacheDir = cfgFromFile.Storage.Dir
+		mirrors = cfgFromFile.GitHub.Mirrors
+		minisignKey = cfgFromFile.GitHub.MinisignKey
+		downloadProxy = cfgFromFile.GitHub.DownloadProxy
+		repo, assetName, dgstOptional = cfgFromFile.GitHub.Repo, cfgFromFile.GitHub.AssetName, cfgFromFile.GitHub.DgstOptional
+		arch = cfgFromFile.Xray.Arch
+		downloadTimeout = time.Duration(cfgFromFile.GitHub.DownloadTimeoutSec) * time.Second
+		assetCacheDir, assetCacheKeep = cfgFromFile.Storage.AssetCacheDir, cfgFromFile.Storage.AssetCacheKeep
+		initSystem = cfgFromFile.Service.Init
+	}
+	if *noService {
+		initSystem = config.ServiceInitNone
 	}
 	targetToken := resolveGitHubToken(*ghTokenFlag, cfgToken)
 
 	opts := xraycore.Options{
-		Version: targetVersion,
-		Token:   targetToken,
-		Logger:  log,
+		Repo:                repo,
+		Arch:                arch,
+		AssetName:           assetName,
+		DigestOptional:      dgstOptional,
+		Version:             targetVersion,
+		Token:               targetToken,
+		CacheDir:            cacheDir,
+		AssetCacheDir:       assetCacheDir,
+		AssetCacheKeep:      assetCacheKeep,
+		Mirrors:             mirrors,
+		MinisignKey:         minisignKey,
+		Proxy:               downloadProxy,
+		DownloadIdleTimeout: downloadTimeout,
+		Init:                initSystem,
+		Limits:              limits,
+		Hooks:               hooks,
+		Logger:              log,
+	}
+	if cfgFromFile != nil {
+		applyInstallPaths(&opts, cfgFromFile)
 	}
 
 	switch *action {
@@ -120,6 +211,73 @@ func runCoreCommand(args []string) error {
 			return fmt.Errorf("xray-core install: %w", err)
 		}
 		log.Info("xray-core install", "from", res.FromVersion, "to", res.ToVersion, "updated", res.Updated)
+	case "rollback":
+		// Without --version, roll back to the previously active version
+		// rather than the configured one.
+		opts.Version = *version
+		res, err := xraycore.Rollback(ctx, opts)
+		if err != nil {
+			return fmt.Errorf("xray-core rollback: %w", err)
+		}
+		log.Info("xray-core rollback", "from", res.FromVersion, "to", res.ToVersion, "updated", res.Updated)
+	case "uninstall":
+		res, err := xraycore.Uninstall(ctx, opts, *purge)
+		if res != nil {
+			for _, path := range res.Removed {
+				log.Info("xray-core uninstall removed", "path", path)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("xray-core uninstall: %w", err)
+		}
+	case "limits":
+		if err := xraycore.ApplyLimits(ctx, opts); err != nil {
+			return fmt.Errorf("xray-core limits: %w", err)
+		}
+		log.Info("xray-core limits verified")
+	case "detect":
+		found := xraycore.DetectLayout(opts)
+		if found.Binary == "" {
+			return xraycore.ErrNoInstall
+		}
+		out, _ := json.MarshalIndent(found, "", "  ")
+		fmt.Println(string(out))
+		for _, diff := range found.Differences(xraycore.AgentLayout(opts)) {
+			log.Info("xray-core layout differs", "field", diff)
+		}
+	case "adopt":
+		found := xraycore.DetectLayout(opts)
+		if found.Binary == "" {
+			return xraycore.ErrNoInstall
+		}
+		adopted, err := xraycore.AdoptOptions(opts, found)
+		if err != nil {
+			return fmt.Errorf("xray-core adopt: %w", err)
+		}
+		if err := agentsetup.UpdateXrayInstall(agentsetup.UpdateXrayInstallOptions{
+			ConfigPath:  *cfgPath,
+			BinDir:      adopted.BinDir,
+			XrayConfig:  adopted.ConfigPath,
+			ShareDir:    adopted.ShareDir,
+			ServicePath: adopted.ServicePath,
+			Logger:      log,
+		}); err != nil {
+			return fmt.Errorf("xray-core adopt: %w", err)
+		}
+		log.Info("xray-core adopted", "binary", found.Binary, "config", found.Config, "service", found.Service)
+	case "migrate":
+		found := xraycore.DetectLayout(opts)
+		if found.Binary == "" {
+			return xraycore.ErrNoInstall
+		}
+		res, err := xraycore.Migrate(ctx, opts, found)
+		for _, backup := range res.Backups {
+			log.Info("xray-core migrate backup", "path", backup)
+		}
+		if err != nil {
+			return fmt.Errorf("xray-core migrate: %w", err)
+		}
+		log.Info("xray-core migrated", "copied", len(res.Copied))
 	default:
 		return fmt.Errorf("unknown core action: %s", *action)
 	}
@@ -131,11 +289,14 @@ func setupCommand(args []string) {
 	cfgPath := fs.String("config", "", "config path (default /etc/xray-agent/config.yaml)")
 	servicePath := fs.String("service", "", "systemd service path (default /usr/lib/systemd/system/xray-agent.service)")
 	binPath := fs.String("bin", "", "binary install path (default /usr/local/bin/xray-agent)")
+	initSystem := fs.String("init", "", "init system: auto|systemd|openrc|sysvinit|none (default service.init from config)")
+	noService := fs.Bool("no-service", false, "install no services; `run` supervises xray itself (same as --init none)")
 	ghToken := fs.String("github-token", "", "GitHub token to save into config (optional)")
-	ctlBase := fs.String("control-base-url", "", "control base URL (optional)")
+	ctlBase := fs.String("control-base-url", "", "control base URL, or a comma-separated list for failover (optional)")
 	ctlToken := fs.String("control-token", "", "control bearer token (optional)")
 	ctlSlug := fs.String("control-server-slug", "", "control server slug (optional)")
 	ctlTLS := fs.String("control-tls-insecure", "", "control TLS insecure (true/false, optional)")
+	user := fs.String("user", "", "run the agent service as this account, created if missing (e.g. xray-agent; root switches back)")
 	fs.Parse(args)
 
 	tlsPtr, err := parseBool(*ctlTLS, "control-tls-insecure")
@@ -143,6 +304,13 @@ func setupCommand(args []string) {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
+	if *noService {
+		if *initSystem != "" && *initSystem != config.ServiceInitNone {
+			fmt.Fprintf(os.Stderr, "--no-service conflicts with --init %s\n", *initSystem)
+			os.Exit(1)
+		}
+		*initSystem = config.ServiceInitNone
+	}
 
 	log := logger.New("info")
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
@@ -157,6 +325,8 @@ func setupCommand(args []string) {
 		Token:       *ctlToken,
 		ServerSlug:  *ctlSlug,
 		TLSInsecure: tlsPtr,
+		Init:        *initSystem,
+		User:        *user,
 		Logger:      log,
 	}
 	if err := agentsetup.Install(ctx, opts); err != nil {
@@ -168,14 +338,19 @@ func setupCommand(args []string) {
 func updateConfigCommand(args []string) {
 	fs := flag.NewFlagSet("update-config", flag.ExitOnError)
 	cfgPath := fs.String("config", defaultConfigPath, "config path")
-	ctlBase := fs.String("control-base-url", "", "control base URL")
+	ctlBase := fs.String("control-base-url", "", "control base URL, or a comma-separated list for failover")
 	ctlToken := fs.String("control-token", "", "control bearer token")
 	ctlSlug := fs.String("control-server-slug", "", "control server slug")
 	ctlTLS := fs.String("control-tls-insecure", "", "control TLS insecure (true/false)")
 	ghToken := fs.String("github-token", "", "GitHub token to persist (optional)")
-	restart := fs.Bool("restart", true, "restart xray-agent service after update")
+	restart := fs.Bool("restart", true, "restart xray-agent service after update (false is the same as --apply none)")
+	apply := fs.String("apply", "", "how the running agent picks up the change: restart|reload|none (default restart)")
 	fs.Parse(args)
 
+	if *apply == "" && !*restart {
+		*apply = agentsetup.ApplyNone
+	}
+
 	tlsPtr, err := parseBool(*ctlTLS, "control-tls-insecure")
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
@@ -186,7 +361,7 @@ func updateConfigCommand(args []string) {
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
 
-	err = agentsetup.UpdateControl(ctx, agentsetup.UpdateControlOptions{
+	applied, err := agentsetup.UpdateControl(ctx, agentsetup.UpdateControlOptions{
 		ConfigPath:  *cfgPath,
 		BaseURL:     *ctlBase,
 		Token:       *ctlToken,
@@ -194,12 +369,102 @@ func updateConfigCommand(args []string) {
 		TLSInsecure: tlsPtr,
 		GitHubToken: *ghToken,
 		Logger:      log,
-		Restart:     *restart,
+		Apply:       *apply,
 	})
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "update config failed: %v\n", err)
 		os.Exit(1)
 	}
+	log.Info("agent config update applied", "strategy", applied)
+}
+
+func registerCommand(args []string) {
+	if err := runRegisterCommand(args); err != nil {
+		fmt.Fprintf(os.Stderr, "register failed: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// runRegisterCommand enrolls the node with a bootstrap token, saves the
+// server slug and token the panel assigns and restarts the agent with them.
+func runRegisterCommand(args []string) error {
+	fs := flag.NewFlagSet("register", flag.ContinueOnError)
+	cfgPath := fs.String("config", defaultConfigPath, "config path")
+	bootstrapToken := fs.String("bootstrap-token", "", "one-time bootstrap token from the panel (required)")
+	ctlBase := fs.String("control-base-url", "", "control base URL (default control.base_url from the config)")
+	ctlTLS := fs.String("control-tls-insecure", "", "control TLS insecure (true/false, optional)")
+	hostname := fs.String("hostname", "", "name reported to the panel (default the system hostname)")
+	start := fs.Bool("start", true, "restart the xray-agent service with the new identity")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *bootstrapToken == "" {
+		return errors.New("--bootstrap-token is required")
+	}
+	tlsPtr, err := parseBool(*ctlTLS, "control-tls-insecure")
+	if err != nil {
+		return err
+	}
+
+	existing, err := loadConfigIfExists(*cfgPath)
+	if err != nil {
+		return fmt.Errorf("load config: %w", err)
+	}
+	if existing != nil && existing.SOPS {
+		// Refused before enrolling, since the bootstrap token is single-use.
+		return fmt.Errorf("%s is sops-encrypted and cannot be rewritten; edit it with sops", *cfgPath)
+	}
+	baseURL := *ctlBase
+	tlsInsecure := false
+	if existing != nil {
+		if baseURL == "" {
+			baseURL = existing.Control.BaseURL.Primary()
+		}
+		tlsInsecure = existing.Control.TLSInsecure
+	}
+	if baseURL == "" {
+		return errors.New("--control-base-url is required without a config")
+	}
+	if tlsPtr != nil {
+		tlsInsecure = *tlsPtr
+	}
+	if *hostname == "" {
+		if *hostname, err = os.Hostname(); err != nil {
+			return err
+		}
+	}
+
+	log := logger.New("info")
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	// Only the first URL of a list is asked; the others serve the same panel.
+	registration, err := control.Register(ctx, strings.Split(baseURL, ",")[0], *bootstrapToken, tlsInsecure, &model.RegisterRequest{
+		Hostname:        *hostname,
+		AgentVersion:    strings.TrimSpace(embeddedVersion),
+		XrayCoreVersion: strings.TrimSpace(xrayCoreInstalledVersion(ctx)),
+		OS:              runtime.GOOS,
+		Arch:            runtime.GOARCH,
+	})
+	if err != nil {
+		return err
+	}
+	log.Info("registered node", "server_slug", registration.ServerSlug)
+
+	apply := agentsetup.ApplyRestart
+	if !*start {
+		apply = agentsetup.ApplyNone
+	}
+	_, err = agentsetup.UpdateControl(ctx, agentsetup.UpdateControlOptions{
+		ConfigPath:  *cfgPath,
+		BaseURL:     *ctlBase,
+		Token:       registration.Token,
+		ServerSlug:  registration.ServerSlug,
+		TLSInsecure: tlsPtr,
+		Logger:      log,
+		Apply:       apply,
+	})
+	return err
 }
 
 func runAgent(args []string) {
@@ -209,20 +474,71 @@ func runAgent(args []string) {
 func runAgentArgs(args []string) {
 	fs := flag.NewFlagSet("run", flag.ExitOnError)
 	cfgPath := fs.String("config", defaultConfigPath, "path to config.yaml")
+	profile := fs.String("profile", "", "named profile from the config's profiles to apply")
 	coreVersionFlag := fs.String("core-version", "", "xray-core target version (default config/default)")
 	ghTokenFlag := fs.String("github-token", "", "GitHub token for core downloads (optional)")
 	fs.Parse(args)
 
-	cfg, err := config.Load(*cfgPath)
+	cfg, err := config.LoadProfile(*cfgPath, *profile)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "load config: %v\n", err)
 		os.Exit(1)
 	}
 
-	log := logger.New(cfg.Logging.Level)
+	log, logCloser, err := logger.Open(logger.Options{
+		Level:      cfg.Logging.Level,
+		Format:     cfg.Logging.Format,
+		Output:     cfg.Logging.Output,
+		File:       cfg.Logging.File,
+		MaxSizeMB:  cfg.Logging.MaxSizeMB,
+		MaxAgeDays: cfg.Logging.MaxAgeDays,
+		MaxBackups: cfg.Logging.MaxBackups,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "open logger: %v\n", err)
+		os.Exit(1)
+	}
+	defer logCloser.Close()
+
+	// One agent per storage.dir: two would fight over the xray API and
+	// report the same traffic twice.
+	lock, err := state.AcquireLock(filepath.Join(cfg.Storage.Dir, state.LockFile))
+	var locked *state.LockedError
+	switch {
+	case errors.As(err, &locked):
+		fmt.Fprintf(os.Stderr, "%v: stop the running agent, or give this one its own storage.dir\n", err)
+		os.Exit(1)
+	case err != nil:
+		log.Warn("instance lock not taken; a second agent would not be detected", "err", err)
+	}
+	defer lock.Release()
+
+	for _, p := range privsep.Check(cfg, privsep.Paths(cfg)) {
+		log.Warn("running without root: "+p.Feature+" will fail", "setting", p.Setting, "path", p.Path, "uid", os.Geteuid(), "fix", p.Fix)
+	}
+
+	var shipper *logger.Shipper
+	if cfg.Logging.Remote.Enabled {
+		shipper = logger.NewShipper(log.Handler(), logger.ShipOptions{
+			Level:      cfg.Logging.Remote.Level,
+			BufferSize: cfg.Logging.Remote.BufferSize,
+			BatchSize:  cfg.Logging.Remote.BatchSize,
+			Interval:   time.Duration(cfg.Logging.Remote.IntervalSec) * time.Second,
+		})
+		log = slog.New(shipper)
+	}
+	recent := logger.NewRecent(log.Handler(), logger.DefaultRecentSize)
+	log = slog.New(recent)
+
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
 
+	if cfg.Debug.Listen != "" {
+		if err := debugserver.Start(ctx, cfg.Debug.Listen, log); err != nil {
+			log.Warn("debug server not started", "err", err)
+		}
+	}
+
 	targetCoreVersion := *coreVersionFlag
 	if targetCoreVersion == "" {
 		targetCoreVersion = cfg.Xray.Version
@@ -232,9 +548,50 @@ func runAgentArgs(args []string) {
 	}
 	targetGitHubToken := resolveGitHubToken(*ghTokenFlag, cfg.GitHub.Token)
 
-	if err := ensureCore(ctx, log, targetCoreVersion, targetGitHubToken); err != nil {
-		fmt.Fprintf(os.Stderr, "ensure xray-core: %v\n", err)
-		os.Exit(1)
+	// sing-box is installed and run outside the agent; only xray-core is
+	// installed, limited and supervised here.
+	var coreSupervisor *supervisor.Supervisor
+	if cfg.Backend != config.BackendSingBox {
+		coreOpts := xraycore.Options{
+			Repo:                cfg.GitHub.Repo,
+			Arch:                cfg.Xray.Arch,
+			AssetName:           cfg.GitHub.AssetName,
+			DigestOptional:      cfg.GitHub.DgstOptional,
+			Version:             targetCoreVersion,
+			AssetCacheDir:       cfg.Storage.AssetCacheDir,
+			AssetCacheKeep:      cfg.Storage.AssetCacheKeep,
+			Token:               targetGitHubToken,
+			Mirrors:             cfg.GitHub.Mirrors,
+			MinisignKey:         cfg.GitHub.MinisignKey,
+			Proxy:               cfg.GitHub.DownloadProxy,
+			DownloadIdleTimeout: time.Duration(cfg.GitHub.DownloadTimeoutSec) * time.Second,
+			Init:                cfg.Service.Init,
+			Limits:              coreLimits(cfg),
+			Hooks:               coreHooks(cfg),
+		}
+		applyInstallPaths(&coreOpts, cfg)
+		warnLegacyLayout(log, coreOpts)
+		if err := ensureCore(ctx, log, coreOpts); err != nil {
+			fmt.Fprintf(os.Stderr, "ensure xray-core: %v\n", err)
+			os.Exit(1)
+		}
+		limitsOpts := xraycore.Options{Init: cfg.Service.Init, Limits: coreLimits(cfg), Logger: log}
+		applyInstallPaths(&limitsOpts, cfg)
+		if err := xraycore.ApplyLimits(ctx, limitsOpts); err != nil {
+			log.Warn("xray service limits not in effect", "err", err)
+		}
+
+		if cfg.Service.Init == config.ServiceInitNone {
+			coreSupervisor = supervisor.New(supervisor.Options{
+				Binary: cfg.Service.XrayBinary,
+				Args:   []string{"-config", cfg.Service.XrayConfig},
+				Logger: log,
+			})
+			if err := coreSupervisor.Start(ctx); err != nil {
+				fmt.Fprintf(os.Stderr, "start xray: %v\n", err)
+				os.Exit(1)
+			}
+		}
 	}
 
 	ctrl := control.NewClient(
@@ -243,18 +600,741 @@ func runAgentArgs(args []string) {
 		strings.TrimSpace(embeddedVersion),
 		strings.TrimSpace(xraycore.InstalledVersion(ctx)),
 	)
-	xm := xray.NewManager(cfg, log)
-	stats := internalStats.New(cfg, log)
-	metricCollector := metrics.New(log)
+	if cfg.Profile != "" {
+		log.Info("using config profile", "profile", cfg.Profile, "base_url", cfg.Control.BaseURL)
+	}
+	go reloadOnHangup(ctx, *cfgPath, cfg.Profile, ctrl, log)
+	var (
+		core  agent.CoreManager
+		stats agent.StatsSource
+	)
+	if cfg.Backend == config.BackendSingBox {
+		core, stats = singbox.NewManager(cfg, log), singbox.NewCollector(cfg, log)
+	} else {
+		mgr := xray.NewManager(cfg, log)
+		if err := discoverInboundTags(ctx, cfg, mgr, log); err != nil {
+			fmt.Fprintf(os.Stderr, "inbound tags: %v\n", err)
+			os.Exit(1)
+		}
+		core, stats = mgr, internalStats.New(cfg, log)
+	}
+	metricOpts := metrics.Options{
+		Include: cfg.Metrics.Interfaces.Include,
+		Exclude: cfg.Metrics.Interfaces.Exclude,
+	}
+	if cfg.Metrics.IPv6Probe != config.IPv6ProbeNone {
+		metricOpts.IPv6Probe = cfg.Metrics.IPv6Probe
+	}
+	metricCollector := metrics.New(log, metricOpts)
 
-	agt := agent.New(cfg, log, ctrl, xm, stats, metricCollector)
+	shipDone := make(chan struct{})
+	if shipper != nil {
+		go func() {
+			defer close(shipDone)
+			shipper.Run(ctx, ctrl.PostLogs)
+		}()
+	} else {
+		close(shipDone)
+	}
+
+	agt := agent.New(cfg, log, ctrl, core, stats, metricCollector)
+	if cfg.Audit.Enabled {
+		auditLog := audit.New(cfg.Audit.File, cfg.Audit.Remote, log)
+		if mgr, ok := core.(*xray.Manager); ok {
+			mgr.SetAudit(auditLog)
+		}
+		agt.SetAudit(auditLog)
+	}
+	if coreSupervisor != nil {
+		agt.SetCoreSupervisor(coreSupervisor)
+	}
+	if r, ok := logCloser.(logger.Rotator); ok {
+		agt.SetLogRotator(r)
+	}
+	if rs, ok := logCloser.(logger.RetentionSetter); ok {
+		agt.OnRetention(func(p model.RetentionPolicy) {
+			rs.SetRetention(model.IntOr(p.LogMaxAgeDays, cfg.Logging.MaxAgeDays), model.IntOr(p.BackupCount, cfg.Logging.MaxBackups))
+		})
+	}
+	if shipper != nil {
+		agt.OnRetention(func(p model.RetentionPolicy) {
+			shipper.SetRetention(
+				model.IntOr(p.HistoryCacheSize, cfg.Logging.Remote.BufferSize),
+				time.Duration(model.IntOr(p.SpoolMaxAgeSec, 0))*time.Second,
+			)
+		})
+	}
 	agt.Start(ctx)
+	adminAPI := admin.Handler(admin.API{
+		Status: func(ctx context.Context) (*model.AdminStatus, error) {
+			st, err := agt.AdminStatus(ctx)
+			if err != nil {
+				return nil, err
+			}
+			st.Events = recent.Entries(topEvents)
+			return st, nil
+		},
+		Clients:     agt.AdminClients,
+		Routes:      agt.AdminRoutes,
+		RouteReport: agt.AdminRouteReport,
+		Sync:        agt.SyncNow,
+		Logs:        recent.Entries,
+		Usage:       agt.AdminUsage,
+	})
+	if cfg.Admin.Socket != config.AdminSocketNone {
+		if err := admin.Start(ctx, cfg.Admin.Socket, adminAPI, log); err != nil {
+			log.Warn("admin api not started", "err", err)
+		}
+	}
+	if cfg.Admin.Listen != "" {
+		if err := admin.StartTCP(ctx, cfg.Admin.Listen, cfg.Admin.Token, adminAPI, log); err != nil {
+			log.Warn("admin api not started", "err", err)
+		}
+	}
 
 	<-ctx.Done()
+	if coreSupervisor != nil {
+		<-coreSupervisor.Done()
+	}
 	log.Info("agent stopped")
+	<-shipDone
+}
+
+// discoverInboundTags checks xray.inbound_tags against the inbounds of the
+// core and fills in the empty ones, so a wrong tag stops the agent here
+// instead of failing every AlterInbound. A rendered config is only written
+// from the state later, so its tags are taken as configured.
+func discoverInboundTags(ctx context.Context, cfg *config.Config, mgr *xray.Manager, log *slog.Logger) error {
+	tags := cfg.Xray.InboundTags
+	configured := tags.VLESS != "" || tags.VMESS != "" || tags.TROJAN != ""
+	if cfg.Xray.Render.Template != "" && configured {
+		return nil
+	}
+	inbounds, source, err := mgr.DiscoverInbounds(ctx, cmp.Or(cfg.Xray.Install.ConfigPath, cfg.Service.XrayConfig))
+	if err != nil {
+		if !configured {
+			return fmt.Errorf("xray.inbound_tags not set and the inbounds could not be discovered: %w", err)
+		}
+		log.Warn("could not discover xray inbounds; inbound tags not checked", "err", err)
+		return nil
+	}
+	filled, err := xray.ResolveInboundTags(cfg, inbounds)
+	if err != nil {
+		return err
+	}
+	for proto, tag := range filled {
+		log.Info("discovered inbound tag", "proto", proto, "tag", tag, "source", source)
+	}
+	return nil
+}
+
+func routesCommand(args []string) {
+	inSync, err := runRoutesCommand(args, os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if !inSync {
+		os.Exit(2)
+	}
+}
+
+// runRoutesCommand prints the routes the agent manages (the normalized routes
+// of the current panel state) next to the rules the core reports, and whether
+// any managed rule is missing or points elsewhere.
+func runRoutesCommand(args []string, out io.Writer) (bool, error) {
+	fs := flag.NewFlagSet("routes", flag.ContinueOnError)
+	cfgPath := fs.String("config", defaultConfigPath, "path to config.yaml")
+	profile := fs.String("profile", "", "named profile from the config's profiles to apply")
+	asJSON := fs.Bool("json", false, "print the comparison as JSON")
+	if err := fs.Parse(args); err != nil {
+		return false, err
+	}
+
+	cfg, err := config.LoadProfile(*cfgPath, *profile)
+	if err != nil {
+		return false, fmt.Errorf("load config: %w", err)
+	}
+	log := logger.New("warn")
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	ctrl := control.NewClient(cfg, log, strings.TrimSpace(embeddedVersion), "")
+	ctrl.SetOneShot()
+	ds, err := ctrl.GetState(ctx)
+	if err != nil {
+		return false, fmt.Errorf("get state: %w", err)
+	}
+	managed, _ := model.NormalizeRouteRules(ds.Routes)
+
+	coreRules, err := xray.NewManager(cfg, log).ListRules(ctx)
+	if errors.Is(err, xray.ErrListRulesUnsupported) {
+		fmt.Fprintln(os.Stderr, "warning: core cannot list routing rules; showing managed rules only")
+	} else if err != nil {
+		return false, fmt.Errorf("list core rules: %w", err)
+	}
+
+	reports := xray.CompareRules(managed, coreRules)
+	if *asJSON {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return xray.RulesInSync(reports), enc.Encode(reports)
+	}
+
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TAG\tSTATUS\tMANAGED OUTBOUND\tCORE OUTBOUND")
+	for _, r := range reports {
+		managedOut, coreOut := "-", "-"
+		if r.Managed != nil {
+			managedOut = cmp.Or(r.Managed.OutboundTag, "balancer:"+r.Managed.BalancerTag)
+		}
+		if r.Core != nil {
+			coreOut = cmp.Or(r.Core.OutboundTag, "-")
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", cmp.Or(r.Tag, "(untagged)"), r.Status, managedOut, coreOut)
+	}
+	return xray.RulesInSync(reports), tw.Flush()
+}
+
+func clientsCommand(args []string) {
+	if err := runClientsCommand(args, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// runClientsCommand lists the users on the node by inbound tag: the clients
+// the running agent applied, from its admin API, or with --direct the users
+// the xray core itself reports.
+func runClientsCommand(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("clients", flag.ContinueOnError)
+	cfgPath := fs.String("config", defaultConfigPath, "path to config.yaml")
+	profile := fs.String("profile", "", "named profile from the config's profiles to apply")
+	socket := fs.String("socket", "", "admin API socket (default admin.socket from the config)")
+	direct := fs.Bool("direct", false, "ask the xray API instead of the running agent")
+	inbound := fs.String("inbound", "", "only list users of this inbound tag")
+	asJSON := fs.Bool("json", false, "print the users as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	var users []xray.CoreUser
+	if *direct {
+		cfg, err := config.LoadProfile(*cfgPath, *profile)
+		if err != nil {
+			return fmt.Errorf("load config: %w", err)
+		}
+		if users, err = xray.NewManager(cfg, logger.New("warn")).ListUsers(ctx); err != nil {
+			return fmt.Errorf("list core users: %w", err)
+		}
+	} else {
+		path, err := adminSocket(*cfgPath, *profile, *socket)
+		if err != nil {
+			return err
+		}
+		clients, err := admin.NewClient(path).Clients(ctx)
+		if err != nil {
+			return err
+		}
+		for _, c := range clients {
+			users = append(users, xray.CoreUser{InboundTag: c.InboundTag, Proto: c.Proto, Email: c.Email})
+		}
+		slices.SortFunc(users, func(x, y xray.CoreUser) int {
+			return cmp.Or(strings.Compare(x.InboundTag, y.InboundTag), strings.Compare(x.Email, y.Email))
+		})
+	}
+	if *inbound != "" {
+		users = slices.DeleteFunc(users, func(u xray.CoreUser) bool { return u.InboundTag != *inbound })
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		if users == nil {
+			users = []xray.CoreUser{}
+		}
+		return enc.Encode(users)
+	}
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "INBOUND\tPROTO\tEMAIL")
+	perInbound := map[string]int{}
+	for _, u := range users {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", cmp.Or(u.InboundTag, "-"), u.Proto, u.Email)
+		perInbound[u.InboundTag]++
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "\n%d users on %d inbounds\n", len(users), len(perInbound))
+	return nil
+}
+
+func statsCommand(args []string) {
+	if err := runStatsCommand(args, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// trafficRow is one counter pair printed by the stats command.
+type trafficRow struct {
+	Name     string `json:"name"`
+	Uplink   int64  `json:"uplink"`
+	Downlink int64  `json:"downlink"`
+}
+
+// runStatsCommand reads the core's traffic counters once, without resetting
+// them, and prints them per user (busiest first) and per inbound.
+func runStatsCommand(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("stats", flag.ContinueOnError)
+	cfgPath := fs.String("config", defaultConfigPath, "path to config.yaml")
+	profile := fs.String("profile", "", "named profile from the config's profiles to apply")
+	asJSON := fs.Bool("json", false, "print the counters as JSON, in bytes")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	cfg, err := config.LoadProfile(*cfgPath, *profile)
+	if err != nil {
+		return fmt.Errorf("load config: %w", err)
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	traffic, err := internalStats.New(cfg, logger.New("warn")).QueryTraffic(ctx)
+	if err != nil {
+		return err
+	}
+
+	rows := func(counters map[string][2]int64) []trafficRow {
+		list := make([]trafficRow, 0, len(counters))
+		for name, v := range counters {
+			list = append(list, trafficRow{Name: name, Uplink: v[0], Downlink: v[1]})
+		}
+		slices.SortFunc(list, func(x, y trafficRow) int {
+			return cmp.Or(cmp.Compare(y.Uplink+y.Downlink, x.Uplink+x.Downlink), strings.Compare(x.Name, y.Name))
+		})
+		return list
+	}
+	users, inbounds := rows(traffic.Users), rows(traffic.Inbounds)
+	if *asJSON {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(map[string][]trafficRow{"users": users, "inbounds": inbounds})
+	}
+
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	table := func(header string, list []trafficRow) {
+		fmt.Fprintf(tw, "%s\tUPLINK\tDOWNLINK\tTOTAL\n", header)
+		var up, down int64
+		for _, r := range list {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", r.Name, formatBytes(r.Uplink), formatBytes(r.Downlink), formatBytes(r.Uplink+r.Downlink))
+			up += r.Uplink
+			down += r.Downlink
+		}
+		fmt.Fprintf(tw, "(%d total)\t%s\t%s\t%s\n", len(list), formatBytes(up), formatBytes(down), formatBytes(up+down))
+	}
+	table("USER", users)
+	fmt.Fprintln(tw)
+	table("INBOUND", inbounds)
+	return tw.Flush()
+}
+
+func usageCommand(args []string) {
+	if err := runUsageCommand(args, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// usageRow is one user's usage in the usage export; Day is set with --daily.
+type usageRow struct {
+	Day      string `json:"day,omitempty"`
+	Email    string `json:"email"`
+	Uplink   int64  `json:"uplink"`
+	Downlink int64  `json:"downlink"`
+}
+
+// runUsageCommand handles `usage export`, which sums the usage history
+// between --from and --to per user, or per user and UTC day with --daily.
+// It reads the files only, so it works while the agent is stopped.
+func runUsageCommand(args []string, out io.Writer) error {
+	const usageText = "usage: xray-agent usage export --from time [--to time] [--format csv|json] [--daily] [--config path] [--profile name]"
+	if len(args) == 0 || args[0] != "export" {
+		return errors.New(usageText)
+	}
+	fs := flag.NewFlagSet("usage export", flag.ContinueOnError)
+	cfgPath := fs.String("config", defaultConfigPath, "path to config.yaml")
+	profile := fs.String("profile", "", "named profile from the config's profiles to apply")
+	fromFlag := fs.String("from", "", "start of the range, inclusive: YYYY-MM-DD (UTC) or RFC 3339")
+	toFlag := fs.String("to", "", "end of the range, exclusive: YYYY-MM-DD (UTC) or RFC 3339 (default now)")
+	format := fs.String("format", "csv", "output format: csv or json")
+	daily := fs.Bool("daily", false, "one row per user and UTC day instead of per user")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if *fromFlag == "" {
+		return errors.New(usageText)
+	}
+	from, err := parseUsageTime(*fromFlag)
+	if err != nil {
+		return fmt.Errorf("--from: %w", err)
+	}
+	to := time.Now().UTC()
+	if *toFlag != "" {
+		if to, err = parseUsageTime(*toFlag); err != nil {
+			return fmt.Errorf("--to: %w", err)
+		}
+	}
+	if !from.Before(to) {
+		return errors.New("--from must be before --to")
+	}
+	if *format != "csv" && *format != "json" {
+		return fmt.Errorf("--format must be csv or json, got %q", *format)
+	}
+
+	cfg, err := config.LoadProfile(*cfgPath, *profile)
+	if err != nil {
+		return fmt.Errorf("load config: %w", err)
+	}
+	if !cfg.UsageHistory.Enabled {
+		fmt.Fprintln(os.Stderr, "warning: usage_history is not enabled; exporting what", cfg.UsageHistory.Dir, "holds")
+	}
+	sums := map[[2]string]*usageRow{}
+	err = usage.NewHistory(cfg.UsageHistory.Dir, 0).Read(from, to, func(s usage.Sample) error {
+		var day string
+		if *daily {
+			day = s.Time.UTC().Format(time.DateOnly)
+		}
+		row := sums[[2]string{day, s.Email}]
+		if row == nil {
+			row = &usageRow{Day: day, Email: s.Email}
+			sums[[2]string{day, s.Email}] = row
+		}
+		row.Uplink += s.Uplink
+		row.Downlink += s.Downlink
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("read usage history: %w", err)
+	}
+	rows := make([]usageRow, 0, len(sums))
+	for _, r := range sums {
+		rows = append(rows, *r)
+	}
+	slices.SortFunc(rows, func(x, y usageRow) int {
+		return cmp.Or(strings.Compare(x.Day, y.Day), strings.Compare(x.Email, y.Email))
+	})
+
+	if *format == "json" {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(struct {
+			From  time.Time  `json:"from"`
+			To    time.Time  `json:"to"`
+			Users []usageRow `json:"users"`
+		}{from, to, rows})
+	}
+	w := csv.NewWriter(out)
+	header := []string{"email", "uplink", "downlink", "total"}
+	if *daily {
+		header = append([]string{"day"}, header...)
+	}
+	w.Write(header)
+	for _, r := range rows {
+		record := []string{r.Email, fmt.Sprint(r.Uplink), fmt.Sprint(r.Downlink), fmt.Sprint(r.Uplink + r.Downlink)}
+		if *daily {
+			record = append([]string{r.Day}, record...)
+		}
+		w.Write(record)
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// parseUsageTime reads a date, meaning its start in UTC, or an RFC 3339
+// time.
+func parseUsageTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.DateOnly, s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither YYYY-MM-DD nor RFC 3339", s)
+	}
+	return t.UTC(), nil
+}
+
+func logsCommand(args []string) {
+	if err := runLogsCommand(args, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// logSource is one log the logs command reads.
+type logSource struct {
+	name string
+	read func(ctx context.Context, out chan<- logtail.Line) error
+}
+
+// runLogsCommand prints the last lines of the agent's log and, with --xray,
+// of xray's access and error logs, and follows them with --follow. Each log
+// is read from where the config sends it: a file, or the journal.
+func runLogsCommand(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("logs", flag.ContinueOnError)
+	cfgPath := fs.String("config", defaultConfigPath, "path to config.yaml")
+	profile := fs.String("profile", "", "named profile from the config's profiles to apply")
+	lines := fs.Int("lines", 50, "lines to show from each log")
+	follow := fs.Bool("follow", false, "keep printing new lines until interrupted")
+	level := fs.String("level", "", "only show lines at or above this level: debug, info, warn or error")
+	email := fs.String("email", "", "only show lines mentioning this user")
+	agentLog := fs.Bool("agent", true, "show the agent's own log")
+	xrayLogs := fs.String("xray", "", "also show xray logs: access, error or access,error")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	cfg, err := config.LoadProfile(*cfgPath, *profile)
+	if err != nil {
+		return fmt.Errorf("load config: %w", err)
+	}
+	filter := logtail.Filter{MinLevel: slog.LevelDebug, Email: *email}
+	if *level != "" {
+		if err := filter.MinLevel.UnmarshalText([]byte(*level)); err != nil {
+			return fmt.Errorf("--level: %w", err)
+		}
+	}
+
+	var sources []logSource
+	if *agentLog {
+		sources = append(sources, agentLogSource(cfg, filter, *lines, *follow))
+	}
+	if *xrayLogs != "" {
+		xs, err := xrayLogSources(cfg, strings.Split(*xrayLogs, ","), filter, *lines, *follow)
+		if err != nil {
+			return err
+		}
+		sources = append(sources, xs...)
+	}
+	if len(sources) == 0 {
+		return errors.New("no logs selected")
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	ch := make(chan logtail.Line)
+	printed := make(chan struct{})
+	go func() {
+		defer close(printed)
+		for l := range ch {
+			if len(sources) > 1 {
+				fmt.Fprintf(out, "%s | %s\n", l.Source, l.Text)
+			} else {
+				fmt.Fprintln(out, l.Text)
+			}
+		}
+	}()
+
+	errs := make([]error, len(sources))
+	if *follow {
+		var wg sync.WaitGroup
+		for i, src := range sources {
+			wg.Go(func() { errs[i] = src.read(ctx, ch) })
+		}
+		wg.Wait()
+	} else {
+		// One log after the other, so each is printed in one piece.
+		for i, src := range sources {
+			errs[i] = src.read(ctx, ch)
+		}
+	}
+	close(ch)
+	<-printed
+	for i, err := range errs {
+		if err != nil {
+			errs[i] = fmt.Errorf("%s log: %w", sources[i].name, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// agentLogSource reads the agent's log file, or the journal when the agent
+// logs to journald, syslog or stdout under systemd.
+func agentLogSource(cfg *config.Config, filter logtail.Filter, lines int, follow bool) logSource {
+	src := logSource{name: "agent"}
+	output := cfg.Logging.Output
+	if output == "" && cfg.Logging.File != "" {
+		output = logger.OutputFile
+	}
+	switch output {
+	case logger.OutputFile:
+		src.read = func(ctx context.Context, out chan<- logtail.Line) error {
+			return logtail.File(ctx, src.name, cfg.Logging.File, lines, follow, filter.Match, out)
+		}
+	case logger.OutputJournal:
+		// Attributes are journal fields rather than part of the message, so
+		// the level and email are matched by journalctl.
+		args := []string{"-t", "xray-agent"}
+		if filter.Email != "" {
+			args = append(args, "EMAIL="+filter.Email)
+		}
+		src.read = func(ctx context.Context, out chan<- logtail.Line) error {
+			return logtail.Journal(ctx, src.name, args, logtail.JournalPriority(filter.MinLevel), lines, follow, func(string) bool { return true }, out)
+		}
+	case logger.OutputSyslog:
+		src.read = func(ctx context.Context, out chan<- logtail.Line) error {
+			return logtail.Journal(ctx, src.name, []string{"-t", "xray-agent"}, logtail.JournalPriority(filter.MinLevel), lines, follow, filter.Match, out)
+		}
+	default:
+		// stdout of the systemd unit; the level is in the text.
+		src.read = func(ctx context.Context, out chan<- logtail.Line) error {
+			return logtail.Journal(ctx, src.name, []string{"-u", "xray-agent"}, "", lines, follow, filter.Match, out)
+		}
+	}
+	return src
+}
+
+// xrayLogSources reads the access and error logs named in the xray config,
+// or the xray unit's journal for a log written to stdout.
+func xrayLogSources(cfg *config.Config, kinds []string, filter logtail.Filter, lines int, follow bool) ([]logSource, error) {
+	xrayConfig := cmp.Or(cfg.Xray.Install.ConfigPath, cfg.Service.XrayConfig)
+	xc, err := xrayconf.Load(xrayConfig)
+	if err != nil {
+		return nil, fmt.Errorf("read xray log paths: %w", err)
+	}
+	accessPath, errorPath := xc.LogPaths()
+
+	var sources []logSource
+	journal := false
+	for _, kind := range kinds {
+		var path string
+		switch strings.TrimSpace(kind) {
+		case "access":
+			path = accessPath
+		case "error":
+			path = errorPath
+		default:
+			return nil, fmt.Errorf("--xray: unknown log %q (access or error)", kind)
+		}
+		switch path {
+		case "none":
+			return nil, fmt.Errorf("xray %s log is disabled in %s", kind, xrayConfig)
+		case "":
+			// Both logs go to the same journal; read it once.
+			if journal {
+				continue
+			}
+			journal = true
+			src := logSource{name: "xray"}
+			src.read = func(ctx context.Context, out chan<- logtail.Line) error {
+				return logtail.Journal(ctx, src.name, []string{"-u", "xray"}, "", lines, follow, filter.Match, out)
+			}
+			sources = append(sources, src)
+		default:
+			src := logSource{name: kind}
+			src.read = func(ctx context.Context, out chan<- logtail.Line) error {
+				return logtail.File(ctx, src.name, path, lines, follow, filter.Match, out)
+			}
+			sources = append(sources, src)
+		}
+	}
+	return sources, nil
+}
+
+// adminSocket returns the admin API socket: the --socket flag, or
+// admin.socket from the config.
+func adminSocket(cfgPath, profile, socket string) (string, error) {
+	if socket != "" {
+		return socket, nil
+	}
+	cfg, err := config.LoadProfile(cfgPath, profile)
+	if err != nil {
+		return "", fmt.Errorf("load config: %w", err)
+	}
+	if cfg.Admin.Socket == config.AdminSocketNone {
+		return "", errors.New("admin API is disabled (admin.socket: none)")
+	}
+	return cfg.Admin.Socket, nil
+}
+
+func configCommand(args []string) {
+	if err := runConfigCommand(args, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// runConfigCommand handles `config show`, which prints the config the agent
+// would run with: the profile merged in, defaults applied, token files read
+// and secrets decrypted, then redacted.
+func runConfigCommand(args []string, out io.Writer) error {
+	if len(args) == 0 || args[0] != "show" {
+		return errors.New("usage: xray-agent config show [--config path] [--profile name]")
+	}
+	fs := flag.NewFlagSet("config show", flag.ContinueOnError)
+	cfgPath := fs.String("config", defaultConfigPath, "path to config.yaml")
+	profile := fs.String("profile", "", "named profile from the config's profiles to apply")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	cfg, err := config.LoadProfile(*cfgPath, *profile)
+	if err != nil {
+		return fmt.Errorf("load config: %w", err)
+	}
+	// GITHUB_TOKEN stands in for github.token, as it does for core installs.
+	cfg.GitHub.Token = resolveGitHubToken("", cfg.GitHub.Token)
+	data, err := yaml.Marshal(cfg.Redacted())
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "# effective config from %s", *cfgPath)
+	if cfg.Profile != "" {
+		fmt.Fprintf(out, " (profile %s)", cfg.Profile)
+	}
+	fmt.Fprintln(out)
+	_, err = out.Write(data)
+	return err
+}
+
+// e2eCommand is intentionally absent from printHelp; it is a smoke test for
+// maintainers and packagers that needs a real xray binary.
+func e2eCommand(args []string) {
+	if err := runE2ECommand(args); err != nil {
+		fmt.Fprintf(os.Stderr, "e2e failed: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println("e2e ok")
 }
 
-func ensureCore(ctx context.Context, log *slog.Logger, version string, ghToken string) error {
+func runE2ECommand(args []string) error {
+	fs := flag.NewFlagSet("e2e", flag.ContinueOnError)
+	xrayBin := fs.String("xray", "xray", "xray-core binary to launch")
+	timeout := fs.Duration("timeout", 60*time.Second, "overall deadline")
+	keep := fs.Bool("keep", false, "keep the generated work directory")
+	logLevel := fs.String("log-level", "info", "agent log level")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	log := logger.New(*logLevel)
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	res, err := e2e.Run(ctx, e2e.Options{
+		XrayBin: *xrayBin,
+		Timeout: *timeout,
+		KeepDir: *keep,
+		Logger:  log,
+	})
+	if res != nil && *keep {
+		log.Info("e2e work dir kept", "path", res.WorkDir)
+	}
+	return err
+}
+
+func ensureCore(ctx context.Context, log *slog.Logger, opts xraycore.Options) error {
+	version := opts.Version
 	if version == "" {
 		version = config.DefaultXrayVersion
 	}
@@ -270,16 +1350,77 @@ func ensureCore(ctx context.Context, log *slog.Logger, version string, ghToken s
 	}
 
 	log.Info("installing xray-core", "target", version)
-	if _, err := xrayCoreInstaller(ctx, xraycore.Options{
-		Version: version,
-		Logger:  log,
-		Token:   ghToken,
-	}); err != nil {
+	opts.Version = version
+	opts.Logger = log
+	if _, err := xrayCoreInstaller(ctx, opts); err != nil {
 		return err
 	}
 	return nil
 }
 
+func coreLimits(cfg *config.Config) xraycore.Limits {
+	return xraycore.Limits{
+		NoFile:      cfg.Xray.Limits.NoFile,
+		NProc:       cfg.Xray.Limits.NProc,
+		Environment: cfg.Xray.Limits.Environment,
+		Directives:  cfg.Xray.Hardening.Directives(),
+	}
+}
+
+func coreHooks(cfg *config.Config) xraycore.Hooks {
+	return xraycore.Hooks{
+		PreUpdate:  cfg.Xray.Hooks.PreUpdate,
+		PostUpdate: cfg.Xray.Hooks.PostUpdate,
+		OnFailure:  cfg.Xray.Hooks.OnFailure,
+	}
+}
+
+// reloadOnHangup re-reads the config on SIGHUP (sent by `update-config
+// --apply reload`) and switches the control client to its endpoint and token.
+func reloadOnHangup(ctx context.Context, path, profile string, ctrl *control.Client, log *slog.Logger) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		}
+		cfg, err := config.LoadProfile(path, profile)
+		if err != nil {
+			log.Warn("reload config failed; keeping the current control settings", "err", err)
+			continue
+		}
+		ctrl.Reload(cfg)
+		log.Info("reloaded control settings", "base_url", cfg.Control.BaseURL, "server_slug", cfg.Control.ServerSlug)
+	}
+}
+
+// applyInstallPaths copies xray.install overrides into opts.
+func applyInstallPaths(opts *xraycore.Options, cfg *config.Config) {
+	opts.BinDir = cfg.Xray.Install.BinDir
+	opts.ConfigPath = cfg.Xray.Install.ConfigPath
+	opts.ShareDir = cfg.Xray.Install.ShareDir
+	opts.ServicePath = cfg.Xray.Install.ServicePath
+	opts.VersionsDir = cfg.Xray.Install.VersionsDir
+	opts.KeepVersions = cfg.Xray.Install.KeepVersions
+}
+
+// warnLegacyLayout points out an xray install made by another script that
+// the agent would otherwise install alongside rather than replace.
+func warnLegacyLayout(log *slog.Logger, opts xraycore.Options) {
+	found := xraycore.DetectLayout(opts)
+	if found.Binary == "" {
+		return
+	}
+	diffs := found.Differences(xraycore.AgentLayout(opts))
+	if len(diffs) == 0 {
+		return
+	}
+	log.Warn("existing xray install does not match the agent's layout; run `xray-agent core --action adopt` or `--action migrate`", "differences", strings.Join(diffs, "; "))
+}
+
 func resolveGitHubToken(flagVal string, cfgVal string) string {
 	if flagVal != "" {
 		return flagVal
@@ -303,20 +1444,164 @@ func loadConfigIfExists(path string) (*config.Config, error) {
 	return config.Load(path)
 }
 
+// topEvents is how many recent events the admin API returns for top.
+const topEvents = 10
+
+func topCommand(args []string) {
+	if err := runTopCommand(args, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// runTopCommand redraws the running agent's status every interval until
+// interrupted, or prints one frame with --once.
+func runTopCommand(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("top", flag.ContinueOnError)
+	cfgPath := fs.String("config", defaultConfigPath, "path to config.yaml (for admin.socket)")
+	profile := fs.String("profile", "", "named profile from the config's profiles to apply")
+	socket := fs.String("socket", "", "admin API socket (default admin.socket from the config)")
+	interval := fs.Duration("interval", 2*time.Second, "refresh interval")
+	limit := fs.Int("limit", 15, "users to show, busiest first")
+	once := fs.Bool("once", false, "print one frame and exit")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	path, err := adminSocket(*cfgPath, *profile, *socket)
+	if err != nil {
+		return err
+	}
+	client := admin.NewClient(path)
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	if *once {
+		// Throughput needs two samples.
+		if _, err := client.Status(ctx); err != nil {
+			return err
+		}
+		time.Sleep(time.Second)
+	}
+	for {
+		st, err := client.Status(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if !*once {
+			fmt.Fprint(out, "\033[H\033[2J")
+		}
+		if err := renderTop(out, st, *limit, time.Now()); err != nil {
+			return err
+		}
+		if *once {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(*interval):
+		}
+	}
+}
+
+func renderTop(out io.Writer, st *model.AdminStatus, limit int, now time.Time) error {
+	var up, down int64
+	for _, u := range st.Throughput {
+		up += u.UplinkBytesSec
+		down += u.DownlinkBytesSec
+	}
+	node := cmp.Or(st.NodeStatus, &model.NodeStatus{})
+	fmt.Fprintf(out, "xray-agent  status %s  uptime %s  config v%d  users %d (active %d)  %s\n",
+		cmp.Or(node.Status, "-"), time.Duration(node.UptimeSec)*time.Second, node.ConfigVersion,
+		st.Users, st.ActiveUsers, now.Format(time.TimeOnly))
+	if st.SampleSec > 0 {
+		fmt.Fprintf(out, "total  up %s/s  down %s/s  over %.1fs\n\n", formatBytes(up), formatBytes(down), st.SampleSec)
+	} else {
+		fmt.Fprint(out, "total  sampling...\n\n")
+	}
+
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "LOOP\tSTATUS\tLAST OK\tFAILURES\tLAST ERROR")
+	names := slices.Sorted(maps.Keys(node.Subsystems))
+	for _, name := range names {
+		sub := node.Subsystems[name]
+		lastOK := "-"
+		if sub.LastSuccessAt != nil {
+			lastOK = now.Sub(*sub.LastSuccessAt).Round(time.Second).String() + " ago"
+		}
+		lastErr := ""
+		if sub.Status != model.NodeStatusOK {
+			lastErr = sub.LastError
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\n", name, sub.Status, lastOK, sub.ConsecutiveFailures, lastErr)
+	}
+	fmt.Fprintln(tw)
+
+	fmt.Fprintln(tw, "USER\tUP/S\tDOWN/S")
+	for i, u := range st.Throughput {
+		if i == limit {
+			fmt.Fprintf(tw, "... %d more\t\t\n", len(st.Throughput)-limit)
+			break
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", u.Email, formatBytes(u.UplinkBytesSec), formatBytes(u.DownlinkBytesSec))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(out, "\nRECENT EVENTS")
+	for _, e := range st.Events {
+		fmt.Fprintf(out, "%s %-5s %s", e.Time.Local().Format(time.TimeOnly), e.Level, e.Message)
+		for _, k := range slices.Sorted(maps.Keys(e.Attrs)) {
+			fmt.Fprintf(out, " %s=%s", k, e.Attrs[k])
+		}
+		fmt.Fprintln(out)
+	}
+	return nil
+}
+
+// formatBytes renders n with a binary unit, e.g. 1.5 MiB.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
 func printHelp() {
 	fmt.Println("Usage: xray-agent <subcommand> [options]")
 	fmt.Println()
 	fmt.Println("Subcommands:")
 	fmt.Println("  run            Start the agent (default config path /etc/xray-agent/config.yaml)")
-	fmt.Println("  setup          Install config/binary/systemd unit")
+	fmt.Println("  setup          Install config/binary/service")
 	fmt.Println("  update-config  Update control/github config and restart agent")
-	fmt.Println("  core           Manage xray-core (check/install)")
+	fmt.Println("  register       Enroll this node with a bootstrap token and start the agent")
+	fmt.Println("  core           Manage xray-core (check/install/rollback/uninstall)")
+	fmt.Println("  routes         Compare managed routing rules with the running core")
+	fmt.Println("  top            Live view of throughput, loop health and events of the running agent")
+	fmt.Println("  clients        List the users provisioned on the node per inbound")
+	fmt.Println("  stats          Print the core's per-user and per-inbound traffic counters")
+	fmt.Println("  logs           Show or follow the agent's and xray's logs")
+	fmt.Println("  usage export   Print per-user usage from the local usage history as CSV or JSON")
+	fmt.Println("  config show    Print the effective config with secrets redacted")
 	fmt.Println("  version        Show agent version and commit")
 	fmt.Println()
 	fmt.Println("Examples:")
 	fmt.Println("  xray-agent run --config /etc/xray-agent/config.yaml")
+	fmt.Println("  xray-agent run --profile staging")
 	fmt.Println("  xray-agent setup --control-base-url https://panel --control-token TOKEN --control-server-slug slug --github-token ghp_xxx")
 	fmt.Println("  xray-agent update-config --control-base-url https://panel --control-token TOKEN --control-server-slug slug")
+	fmt.Println("  xray-agent register --control-base-url https://panel --bootstrap-token TOKEN")
 	fmt.Println("  xray-agent core --action install --version v25.10.15")
 	fmt.Println()
 	printVersion()
@@ -329,6 +1614,72 @@ func printVersion() {
 	fmt.Println("License GPLv3+: GNU GPL version 3 or later <http://gnu.org/licenses/gpl.html>")
 }
 
+func versionCommand(args []string) {
+	if err := runVersionCommand(args, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// versionInfo is what `version --json` prints for inventory tooling.
+type versionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date,omitempty"`
+	GoVersion string `json:"go_version"`
+	// XrayCoreLibrary is the xray-core module the agent's API client is
+	// built against, not the version of the installed core.
+	XrayCoreLibrary string `json:"xray_core_library"`
+	model.Capabilities
+}
+
+// runVersionCommand prints the version, or with --json the build details and
+// the capabilities the agent reports to the panel. Capabilities depend on
+// the config, which is read when it exists.
+func runVersionCommand(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("version", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print build details and supported features as JSON")
+	cfgPath := fs.String("config", defaultConfigPath, "config path (optional, for config-dependent features)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if !*asJSON {
+		printVersion()
+		return nil
+	}
+
+	cfg, err := loadConfigIfExists(*cfgPath)
+	if err != nil {
+		return fmt.Errorf("load config: %w", err)
+	}
+	if cfg == nil {
+		cfg = &config.Config{Backend: config.BackendXray}
+	}
+	info := versionInfo{
+		Version:         strings.TrimSpace(embeddedVersion),
+		Commit:          buildCommit(),
+		BuildDate:       buildDate,
+		GoVersion:       runtime.Version(),
+		XrayCoreLibrary: "unknown",
+		Capabilities:    agent.Capabilities(cfg),
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, dep := range bi.Deps {
+			if dep.Path == "github.com/xtls/xray-core" {
+				info.XrayCoreLibrary = cmp.Or(dep.Replace, dep).Version
+			}
+		}
+		for _, s := range bi.Settings {
+			if s.Key == "vcs.time" && info.BuildDate == "" {
+				info.BuildDate = s.Value
+			}
+		}
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(info)
+}
+
 func buildCommit() string {
 	if info, ok := debug.ReadBuildInfo(); ok {
 		for _, s := range info.Settings {
@@ -0,0 +1,350 @@
+package testsupport
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// BrokerMessage is one PUBLISH a client sent to the fake broker.
+type BrokerMessage struct {
+	Topic    string
+	Payload  []byte
+	Retained bool
+}
+
+// Broker is an in-process fake MQTT 3.1.1 broker. It matches topics exactly
+// (no wildcards), keeps retained messages, delivers to subscribers at the
+// QoS they asked for (at most 1) and records what clients publish. All methods are safe for concurrent use.
+type Broker struct {
+	// Addr is the host:port the broker listens on.
+	Addr string
+	lis  net.Listener
+
+	mu        sync.Mutex
+	username  string
+	password  string
+	retained  map[string][]byte
+	published []BrokerMessage
+	clients   map[*brokerClient]bool
+	connects  int
+	acks      int
+}
+
+type brokerClient struct {
+	conn net.Conn
+	mu   sync.Mutex
+	// subs maps each subscribed topic to its granted QoS.
+	subs   map[string]byte
+	nextID uint16
+}
+
+// NewBroker starts a fake broker on a random localhost port and stops it
+// when the test finishes.
+func NewBroker(tb testing.TB) *Broker {
+	tb.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatalf("start fake mqtt broker: %v", err)
+	}
+	b := &Broker{
+		Addr:     lis.Addr().String(),
+		lis:      lis,
+		retained: map[string][]byte{},
+		clients:  map[*brokerClient]bool{},
+	}
+	go b.serve()
+	tb.Cleanup(b.Close)
+	return b
+}
+
+// Close stops the broker and drops every client.
+func (b *Broker) Close() {
+	_ = b.lis.Close()
+	b.DropClients()
+}
+
+// RequireLogin makes CONNECT fail with "bad user name or password" unless
+// the client sends these credentials.
+func (b *Broker) RequireLogin(username, password string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.username, b.password = username, password
+}
+
+// Publish sends payload to the subscribers of topic, as the panel would,
+// and keeps it for later subscribers when retain is set.
+func (b *Broker) Publish(topic string, payload []byte, retain bool) {
+	b.mu.Lock()
+	if retain {
+		b.retained[topic] = slices.Clone(payload)
+	}
+	clients := make([]*brokerClient, 0, len(b.clients))
+	for c := range b.clients {
+		clients = append(clients, c)
+	}
+	b.mu.Unlock()
+	for _, c := range clients {
+		c.mu.Lock()
+		qos, subscribed := c.subs[topic]
+		c.mu.Unlock()
+		if subscribed {
+			c.deliver(topic, payload, qos, false)
+		}
+	}
+}
+
+// Published returns what clients published to topic, oldest first.
+func (b *Broker) Published(topic string) []BrokerMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var out []BrokerMessage
+	for _, m := range b.published {
+		if m.Topic == topic {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// Connects returns how many connections the broker accepted.
+func (b *Broker) Connects() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.connects
+}
+
+// Acks returns how many deliveries clients have acknowledged.
+func (b *Broker) Acks() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.acks
+}
+
+// DropClients closes every client connection, like a broker restart.
+func (b *Broker) DropClients() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for c := range b.clients {
+		_ = c.conn.Close()
+		delete(b.clients, c)
+	}
+}
+
+func (b *Broker) serve() {
+	for {
+		conn, err := b.lis.Accept()
+		if err != nil {
+			return
+		}
+		go b.handle(conn)
+	}
+}
+
+func (b *Broker) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	c := &brokerClient{conn: conn, subs: map[string]byte{}}
+	defer func() {
+		b.mu.Lock()
+		delete(b.clients, c)
+		b.mu.Unlock()
+	}()
+
+	header, body, err := readBrokerPacket(r)
+	if err != nil || header>>4 != 1 {
+		return
+	}
+	code := byte(0)
+	if username, password, err := connectLogin(body); err != nil {
+		code = 2
+	} else {
+		b.mu.Lock()
+		if b.username != "" && (username != b.username || password != b.password) {
+			code = 4
+		}
+		b.mu.Unlock()
+	}
+	if c.write(0x20, []byte{0, code}) != nil || code != 0 {
+		return
+	}
+	b.mu.Lock()
+	b.clients[c] = true
+	b.connects++
+	b.mu.Unlock()
+
+	for {
+		header, body, err := readBrokerPacket(r)
+		if err != nil {
+			return
+		}
+		switch header >> 4 {
+		case 3: // PUBLISH
+			topic, rest, err := brokerString(body)
+			if err != nil {
+				return
+			}
+			if qos := header >> 1 & 0x03; qos > 0 {
+				if len(rest) < 2 {
+					return
+				}
+				if c.write(0x40, rest[:2]) != nil {
+					return
+				}
+				rest = rest[2:]
+			}
+			msg := BrokerMessage{Topic: topic, Payload: slices.Clone(rest), Retained: header&1 != 0}
+			b.mu.Lock()
+			b.published = append(b.published, msg)
+			if msg.Retained {
+				b.retained[topic] = msg.Payload
+			}
+			b.mu.Unlock()
+		case 4: // PUBACK from a client
+			b.mu.Lock()
+			b.acks++
+			b.mu.Unlock()
+		case 8: // SUBSCRIBE
+			if len(body) < 2 {
+				return
+			}
+			id, rest := body[:2], body[2:]
+			var topics []string
+			var codes []byte
+			for len(rest) > 0 {
+				topic, next, err := brokerString(rest)
+				if err != nil || len(next) < 1 {
+					return
+				}
+				topics = append(topics, topic)
+				codes = append(codes, min(next[0], 1))
+				rest = next[1:]
+			}
+			c.mu.Lock()
+			for i, topic := range topics {
+				c.subs[topic] = codes[i]
+			}
+			c.mu.Unlock()
+			if c.write(0x90, append(slices.Clone(id), codes...)) != nil {
+				return
+			}
+			for i, topic := range topics {
+				b.mu.Lock()
+				payload, ok := b.retained[topic]
+				b.mu.Unlock()
+				if ok {
+					c.deliver(topic, payload, codes[i], true)
+				}
+			}
+		case 12: // PINGREQ
+			if c.write(0xd0, nil) != nil {
+				return
+			}
+		case 14: // DISCONNECT
+			return
+		default:
+			return
+		}
+	}
+}
+
+func (c *brokerClient) deliver(topic string, payload []byte, qos byte, retained bool) {
+	header := 0x30 | qos<<1
+	if retained {
+		header |= 1
+	}
+	body := binary.BigEndian.AppendUint16(nil, uint16(len(topic)))
+	body = append(body, topic...)
+	if qos > 0 {
+		c.mu.Lock()
+		c.nextID++
+		if c.nextID == 0 {
+			c.nextID = 1
+		}
+		body = binary.BigEndian.AppendUint16(body, c.nextID)
+		c.mu.Unlock()
+	}
+	_ = c.write(header, append(body, payload...))
+}
+
+func (c *brokerClient) write(header byte, body []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := []byte{header}
+	for n := len(body); ; {
+		digit := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			digit |= 0x80
+		}
+		out = append(out, digit)
+		if n == 0 {
+			break
+		}
+	}
+	_, err := c.conn.Write(append(out, body...))
+	return err
+}
+
+// connectLogin returns the user name and password of a CONNECT body.
+func connectLogin(body []byte) (string, string, error) {
+	proto, rest, err := brokerString(body)
+	if err != nil || proto != "MQTT" || len(rest) < 4 {
+		return "", "", errors.New("bad connect")
+	}
+	flags := rest[1]
+	rest = rest[4:]
+	if _, rest, err = brokerString(rest); err != nil {
+		return "", "", err
+	}
+	var username, password string
+	if flags&0x80 != 0 {
+		if username, rest, err = brokerString(rest); err != nil {
+			return "", "", err
+		}
+	}
+	if flags&0x40 != 0 {
+		if password, _, err = brokerString(rest); err != nil {
+			return "", "", err
+		}
+	}
+	return username, password, nil
+}
+
+func readBrokerPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, mult := 0, 1
+	for range 4 {
+		d, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(d&0x7f) * mult
+		if d&0x80 == 0 {
+			body := make([]byte, length)
+			_, err := io.ReadFull(r, body)
+			return header, body, err
+		}
+		mult *= 128
+	}
+	return 0, nil, errors.New("malformed length")
+}
+
+func brokerString(b []byte) (string, []byte, error) {
+	if len(b) < 2 {
+		return "", nil, errors.New("short string")
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return "", nil, errors.New("short string")
+	}
+	return string(b[2 : 2+n]), b[2+n:], nil
+}
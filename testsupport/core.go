@@ -0,0 +1,384 @@
+// Package testsupport provides an in-process fake of the Xray-core gRPC API
+// (HandlerService, RoutingService and StatsService) for integration tests.
+//
+// The fake keeps per-inbound user registries, routing rules and traffic
+// counters in memory, records every mutating call, and can inject latency or
+// errors per RPC method. It does not need a real xray binary. Broker is a
+// fake MQTT broker for the control transport.
+package testsupport
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xtls/xray-core/common/protocol"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	handlerService "github.com/xtls/xray-core/app/proxyman/command"
+	routerService "github.com/xtls/xray-core/app/router/command"
+	statscommand "github.com/xtls/xray-core/app/stats/command"
+)
+
+// RPC method names accepted by FailMethod and SetMethodLatency.
+const (
+	MethodAlterInbound         = "AlterInbound"
+	MethodListInbounds         = "ListInbounds"
+	MethodGetInboundUsers      = "GetInboundUsers"
+	MethodGetInboundUsersCount = "GetInboundUsersCount"
+	MethodAddOutbound          = "AddOutbound"
+	MethodRemoveOutbound       = "RemoveOutbound"
+	MethodAddRule              = "AddRule"
+	MethodRemoveRule           = "RemoveRule"
+	MethodListRule             = "ListRule"
+	MethodQueryStats           = "QueryStats"
+	MethodGetSysStats          = "GetSysStats"
+	MethodGetAllOnlineUsers    = "GetAllOnlineUsers"
+	MethodGetStatsOnlineIpList = "GetStatsOnlineIpList"
+)
+
+// Operation kinds recorded in HandlerOp and RouteOp.
+const (
+	OpAdd    = "add"
+	OpRemove = "remove"
+)
+
+// HandlerOp is one AlterInbound user operation as received by the fake.
+type HandlerOp struct {
+	Tag   string
+	Kind  string
+	Email string
+}
+
+// RouteOp is one AddRule/RemoveRule call as received by the fake.
+type RouteOp struct {
+	Tag  string
+	Kind string
+}
+
+// Core is a running fake xray API listener. All methods are safe for
+// concurrent use.
+type Core struct {
+	// Addr is the host:port the gRPC server listens on.
+	Addr string
+
+	server *grpc.Server
+	lis    net.Listener
+
+	mu       sync.Mutex
+	strict   bool
+	latency  map[string]time.Duration
+	failures map[string]error
+
+	inbounds map[string]map[string]*protocol.User
+	// inboundProtocols are the proxy protocols ListInbounds reports by tag.
+	inboundProtocols map[string]string
+	handlerOps       []HandlerOp
+	// outbounds are the tags of outbounds added through the API.
+	outbounds []string
+
+	rules []string
+	// ruleOutbounds maps rule tags to the outbound tag ListRule reports.
+	ruleOutbounds map[string]string
+	routeOps      []RouteOp
+
+	counters  map[string]int64
+	onlineIPs map[string]map[string]int64
+	sysStats  *statscommand.SysStatsResponse
+}
+
+// StartCore starts a fake core on a random localhost port.
+func StartCore() (*Core, error) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Core{
+		Addr:             lis.Addr().String(),
+		lis:              lis,
+		latency:          map[string]time.Duration{},
+		failures:         map[string]error{},
+		inbounds:         map[string]map[string]*protocol.User{},
+		inboundProtocols: map[string]string{},
+		ruleOutbounds:    map[string]string{},
+		counters:         map[string]int64{},
+		onlineIPs:        map[string]map[string]int64{},
+		sysStats:         &statscommand.SysStatsResponse{},
+	}
+	c.server = grpc.NewServer()
+	handlerService.RegisterHandlerServiceServer(c.server, &handlerServer{core: c})
+	routerService.RegisterRoutingServiceServer(c.server, &routingServer{core: c})
+	statscommand.RegisterStatsServiceServer(c.server, &statsServer{core: c})
+	go c.server.Serve(lis)
+	return c, nil
+}
+
+// NewCore starts a fake core and stops it when the test finishes.
+func NewCore(tb testing.TB) *Core {
+	tb.Helper()
+	c, err := StartCore()
+	if err != nil {
+		tb.Fatalf("start fake xray core: %v", err)
+	}
+	tb.Cleanup(c.Close)
+	return c
+}
+
+// Close stops the gRPC server and releases the listener.
+func (c *Core) Close() {
+	c.server.Stop()
+	_ = c.lis.Close()
+}
+
+// SetStrict makes the fake behave like a real core: adding an existing user,
+// removing a missing user or rule, and touching an undeclared inbound all fail.
+// The default is lenient and accepts every mutation.
+func (c *Core) SetStrict(strict bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.strict = strict
+}
+
+// SetLatency delays every RPC by d.
+func (c *Core) SetLatency(d time.Duration) {
+	c.SetMethodLatency("", d)
+}
+
+// SetMethodLatency delays one RPC method by d; an empty method applies to all.
+func (c *Core) SetMethodLatency(method string, d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if d <= 0 {
+		delete(c.latency, method)
+		return
+	}
+	c.latency[method] = d
+}
+
+// FailMethod makes the given RPC method return err after recording the call.
+// A nil err clears the failure.
+func (c *Core) FailMethod(method string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err == nil {
+		delete(c.failures, method)
+		return
+	}
+	c.failures[method] = err
+}
+
+// AddInbound declares an inbound tag so strict mode accepts users for it.
+func (c *Core) AddInbound(tags ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, tag := range tags {
+		if _, ok := c.inbounds[tag]; !ok {
+			c.inbounds[tag] = map[string]*protocol.User{}
+		}
+	}
+}
+
+// AddProtocolInbound declares inbound tags that ListInbounds reports with
+// the given proxy protocol, e.g. "vless".
+func (c *Core) AddProtocolInbound(proto string, tags ...string) {
+	c.AddInbound(tags...)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, tag := range tags {
+		c.inboundProtocols[tag] = proto
+	}
+}
+
+// Users returns the sorted emails currently registered on an inbound.
+func (c *Core) Users(tag string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	emails := make([]string, 0, len(c.inbounds[tag]))
+	for email := range c.inbounds[tag] {
+		emails = append(emails, email)
+	}
+	slices.Sort(emails)
+	return emails
+}
+
+// User returns the registered user on an inbound, or nil.
+func (c *Core) User(tag string, email string) *protocol.User {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.inbounds[tag][email]
+}
+
+// OutboundTags returns the tags of outbounds added through the API, in
+// insertion order.
+func (c *Core) OutboundTags() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.outbounds)
+}
+
+// HandlerOps returns a copy of every AlterInbound user operation received.
+func (c *Core) HandlerOps() []HandlerOp {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.handlerOps)
+}
+
+// RouteOps returns a copy of every AddRule/RemoveRule call received.
+func (c *Core) RouteOps() []RouteOp {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.routeOps)
+}
+
+// RuleTags returns the installed routing rule tags in insertion order.
+func (c *Core) RuleTags() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.rules)
+}
+
+// SeedRule installs a routing rule without recording an operation, like a
+// rule from the static xray config.
+func (c *Core) SeedRule(ruleTag string, outboundTag string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !slices.Contains(c.rules, ruleTag) {
+		c.rules = append(c.rules, ruleTag)
+	}
+	c.ruleOutbounds[ruleTag] = outboundTag
+}
+
+// ResetOps clears the recorded handler and route operations.
+func (c *Core) ResetOps() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.handlerOps = nil
+	c.routeOps = nil
+}
+
+// DropUser removes a user from an inbound behind the agent's back, as a
+// manual API call would.
+func (c *Core) DropUser(tag string, email string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.inbounds[tag], email)
+}
+
+// ResetRuntime drops every registered user, rule and API-added outbound, as
+// an xray restart would.
+func (c *Core) ResetRuntime() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for tag := range c.inbounds {
+		c.inbounds[tag] = map[string]*protocol.User{}
+	}
+	c.rules = nil
+	c.outbounds = nil
+	clear(c.ruleOutbounds)
+	clear(c.counters)
+	clear(c.onlineIPs)
+}
+
+// SetCounter sets a raw StatsService counter by full name.
+func (c *Core) SetCounter(name string, value int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counters[name] = value
+}
+
+// Counter returns a raw StatsService counter value.
+func (c *Core) Counter(name string) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.counters[name]
+}
+
+// SetUserTraffic sets the uplink/downlink counters for a user email.
+func (c *Core) SetUserTraffic(email string, uplink int64, downlink int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counters[userTrafficStat(email, "uplink")] = uplink
+	c.counters[userTrafficStat(email, "downlink")] = downlink
+}
+
+// AddUserTraffic increments the uplink/downlink counters for a user email.
+func (c *Core) AddUserTraffic(email string, uplink int64, downlink int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counters[userTrafficStat(email, "uplink")] += uplink
+	c.counters[userTrafficStat(email, "downlink")] += downlink
+}
+
+// SetInboundTraffic sets the uplink/downlink counters for an inbound tag.
+func (c *Core) SetInboundTraffic(tag string, uplink int64, downlink int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counters["inbound>>>"+tag+">>>traffic>>>uplink"] = uplink
+	c.counters["inbound>>>"+tag+">>>traffic>>>downlink"] = downlink
+}
+
+// SetOnlineIPs marks a user online with the given address -> unix last-seen
+// map. An empty map marks the user offline.
+func (c *Core) SetOnlineIPs(email string, ips map[string]int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(ips) == 0 {
+		delete(c.onlineIPs, email)
+		return
+	}
+	c.onlineIPs[email] = ips
+}
+
+// SetSysStats sets the response returned by GetSysStats.
+func (c *Core) SetSysStats(resp *statscommand.SysStatsResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sysStats = resp
+}
+
+// intercept applies configured latency and failures for method. It must be
+// called without c.mu held.
+func (c *Core) intercept(ctx context.Context, method string) error {
+	c.mu.Lock()
+	delay := c.latency[""] + c.latency[method]
+	err := c.failures[method]
+	c.mu.Unlock()
+
+	if delay > 0 {
+		select {
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case <-time.After(delay):
+		}
+	}
+	return err
+}
+
+func userTrafficStat(email string, direction string) string {
+	return "user>>>" + email + ">>>traffic>>>" + direction
+}
+
+func onlineStat(email string) string {
+	return "user>>>" + email + ">>>online"
+}
+
+func emailFromOnlineStat(name string) (string, bool) {
+	const prefix = "user>>>"
+	const suffix = ">>>online"
+	if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+		return "", false
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(name, prefix), suffix), true
+}
+
+func notFound(format string, args ...any) error {
+	return status.Error(codes.Unknown, fmt.Sprintf(format, args...)+" not found")
+}
@@ -0,0 +1,103 @@
+package testsupport
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/xtls/xray-core/common/protocol"
+	"github.com/xtls/xray-core/common/serial"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+
+	handlerService "github.com/xtls/xray-core/app/proxyman/command"
+	statscommand "github.com/xtls/xray-core/app/stats/command"
+)
+
+func dial(t *testing.T, core *Core) *grpc.ClientConn {
+	t.Helper()
+	conn, err := grpc.NewClient(core.Addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("dial fake core: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func alterUser(ctx context.Context, client handlerService.HandlerServiceClient, tag string, add bool, email string) error {
+	var op *serial.TypedMessage
+	if add {
+		op = serial.ToTypedMessage(&handlerService.AddUserOperation{User: &protocol.User{Email: email}})
+	} else {
+		op = serial.ToTypedMessage(&handlerService.RemoveUserOperation{Email: email})
+	}
+	_, err := client.AlterInbound(ctx, &handlerService.AlterInboundRequest{Tag: tag, Operation: op})
+	return err
+}
+
+func TestCoreUserRegistryStrictMode(t *testing.T) {
+	core := NewCore(t)
+	core.SetStrict(true)
+	core.AddInbound("vless-in")
+	client := handlerService.NewHandlerServiceClient(dial(t, core))
+	ctx := context.Background()
+
+	if err := alterUser(ctx, client, "vless-in", true, "a@example.com"); err != nil {
+		t.Fatalf("add user: %v", err)
+	}
+	if err := alterUser(ctx, client, "vless-in", true, "a@example.com"); err == nil {
+		t.Fatal("expected duplicate add to fail in strict mode")
+	}
+	if err := alterUser(ctx, client, "missing-in", true, "b@example.com"); err == nil {
+		t.Fatal("expected unknown inbound to fail in strict mode")
+	}
+	if got := core.Users("vless-in"); len(got) != 1 || got[0] != "a@example.com" {
+		t.Fatalf("unexpected registry: %+v", got)
+	}
+
+	if err := alterUser(ctx, client, "vless-in", false, "a@example.com"); err != nil {
+		t.Fatalf("remove user: %v", err)
+	}
+	if err := alterUser(ctx, client, "vless-in", false, "a@example.com"); err == nil {
+		t.Fatal("expected removing a missing user to fail in strict mode")
+	}
+	if ops := core.HandlerOps(); len(ops) != 5 {
+		t.Fatalf("expected every call to be recorded, got %+v", ops)
+	}
+}
+
+func TestCoreFailureAndLatencyInjection(t *testing.T) {
+	core := NewCore(t)
+	client := statscommand.NewStatsServiceClient(dial(t, core))
+	core.SetUserTraffic("a@example.com", 10, 20)
+
+	core.FailMethod(MethodQueryStats, status.Error(codes.Unavailable, "core down"))
+	_, err := client.QueryStats(context.Background(), &statscommand.QueryStatsRequest{Pattern: "a@example.com"})
+	if status.Code(err) != codes.Unavailable {
+		t.Fatalf("expected injected failure, got %v", err)
+	}
+	core.FailMethod(MethodQueryStats, nil)
+
+	core.SetMethodLatency(MethodQueryStats, 200*time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = client.QueryStats(ctx, &statscommand.QueryStatsRequest{Pattern: "a@example.com"})
+	if status.Code(err) != codes.DeadlineExceeded && !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline from injected latency, got %v", err)
+	}
+	core.SetMethodLatency(MethodQueryStats, 0)
+
+	resp, err := client.QueryStats(context.Background(), &statscommand.QueryStatsRequest{Pattern: "a@example.com", Reset_: true})
+	if err != nil {
+		t.Fatalf("QueryStats: %v", err)
+	}
+	if len(resp.GetStat()) != 2 {
+		t.Fatalf("unexpected stats: %+v", resp.GetStat())
+	}
+	if got := core.Counter(userTrafficStat("a@example.com", "uplink")); got != 0 {
+		t.Fatalf("expected reset counter, got %d", got)
+	}
+}
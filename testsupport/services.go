@@ -0,0 +1,364 @@
+package testsupport
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/xtls/xray-core/app/router"
+	"github.com/xtls/xray-core/common/protocol"
+	"github.com/xtls/xray-core/common/serial"
+	"github.com/xtls/xray-core/core"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	handlerService "github.com/xtls/xray-core/app/proxyman/command"
+	routerService "github.com/xtls/xray-core/app/router/command"
+	statscommand "github.com/xtls/xray-core/app/stats/command"
+)
+
+type handlerServer struct {
+	handlerService.UnimplementedHandlerServiceServer
+	core *Core
+}
+
+func (h *handlerServer) AlterInbound(ctx context.Context, req *handlerService.AlterInboundRequest) (*handlerService.AlterInboundResponse, error) {
+	msg, err := req.GetOperation().GetInstance()
+	if err != nil {
+		return nil, err
+	}
+
+	c := h.core
+	c.mu.Lock()
+	switch op := msg.(type) {
+	case *handlerService.AddUserOperation:
+		c.handlerOps = append(c.handlerOps, HandlerOp{Tag: req.GetTag(), Kind: OpAdd, Email: op.GetUser().GetEmail()})
+	case *handlerService.RemoveUserOperation:
+		c.handlerOps = append(c.handlerOps, HandlerOp{Tag: req.GetTag(), Kind: OpRemove, Email: op.GetEmail()})
+	default:
+		c.mu.Unlock()
+		return nil, fmt.Errorf("unexpected op %T", op)
+	}
+	c.mu.Unlock()
+
+	if err := c.intercept(ctx, MethodAlterInbound); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	users, ok := c.inbounds[req.GetTag()]
+	if !ok {
+		if c.strict {
+			return nil, notFound("handler %s", req.GetTag())
+		}
+		users = map[string]*protocol.User{}
+		c.inbounds[req.GetTag()] = users
+	}
+
+	switch op := msg.(type) {
+	case *handlerService.AddUserOperation:
+		email := op.GetUser().GetEmail()
+		if _, exists := users[email]; exists && c.strict {
+			return nil, status.Errorf(codes.Unknown, "User %s already exists.", email)
+		}
+		users[email] = op.GetUser()
+	case *handlerService.RemoveUserOperation:
+		if _, exists := users[op.GetEmail()]; !exists && c.strict {
+			return nil, notFound("User %s", op.GetEmail())
+		}
+		delete(users, op.GetEmail())
+	}
+	return &handlerService.AlterInboundResponse{}, nil
+}
+
+func (h *handlerServer) ListInbounds(ctx context.Context, req *handlerService.ListInboundsRequest) (*handlerService.ListInboundsResponse, error) {
+	c := h.core
+	if err := c.intercept(ctx, MethodListInbounds); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tags := make([]string, 0, len(c.inbounds))
+	for tag := range c.inbounds {
+		tags = append(tags, tag)
+	}
+	slices.Sort(tags)
+
+	resp := &handlerService.ListInboundsResponse{}
+	for _, tag := range tags {
+		in := &core.InboundHandlerConfig{Tag: tag}
+		if proto := c.inboundProtocols[tag]; proto != "" && !req.GetIsOnlyTags() {
+			in.ProxySettings = &serial.TypedMessage{Type: "xray.proxy." + proto + ".inbound.Config"}
+		}
+		resp.Inbounds = append(resp.Inbounds, in)
+	}
+	return resp, nil
+}
+
+func (h *handlerServer) GetInboundUsers(ctx context.Context, req *handlerService.GetInboundUserRequest) (*handlerService.GetInboundUserResponse, error) {
+	c := h.core
+	if err := c.intercept(ctx, MethodGetInboundUsers); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	users, ok := c.inbounds[req.GetTag()]
+	if !ok {
+		return nil, notFound("handler %s", req.GetTag())
+	}
+
+	resp := &handlerService.GetInboundUserResponse{}
+	if req.GetEmail() != "" {
+		if user, ok := users[req.GetEmail()]; ok {
+			resp.Users = append(resp.Users, user)
+		}
+		return resp, nil
+	}
+
+	emails := make([]string, 0, len(users))
+	for email := range users {
+		emails = append(emails, email)
+	}
+	slices.Sort(emails)
+	for _, email := range emails {
+		resp.Users = append(resp.Users, users[email])
+	}
+	return resp, nil
+}
+
+func (h *handlerServer) GetInboundUsersCount(ctx context.Context, req *handlerService.GetInboundUserRequest) (*handlerService.GetInboundUsersCountResponse, error) {
+	c := h.core
+	if err := c.intercept(ctx, MethodGetInboundUsersCount); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	users, ok := c.inbounds[req.GetTag()]
+	if !ok {
+		return nil, notFound("handler %s", req.GetTag())
+	}
+	return &handlerService.GetInboundUsersCountResponse{Count: int64(len(users))}, nil
+}
+
+func (h *handlerServer) AddOutbound(ctx context.Context, req *handlerService.AddOutboundRequest) (*handlerService.AddOutboundResponse, error) {
+	c := h.core
+	if err := c.intercept(ctx, MethodAddOutbound); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tag := req.GetOutbound().GetTag()
+	if slices.Contains(c.outbounds, tag) {
+		return nil, status.Errorf(codes.Unknown, "existing tag found: %s", tag)
+	}
+	c.outbounds = append(c.outbounds, tag)
+	return &handlerService.AddOutboundResponse{}, nil
+}
+
+func (h *handlerServer) RemoveOutbound(ctx context.Context, req *handlerService.RemoveOutboundRequest) (*handlerService.RemoveOutboundResponse, error) {
+	c := h.core
+	if err := c.intercept(ctx, MethodRemoveOutbound); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Like xray, removing an unknown tag succeeds.
+	c.outbounds = slices.DeleteFunc(c.outbounds, func(t string) bool { return t == req.GetTag() })
+	return &handlerService.RemoveOutboundResponse{}, nil
+}
+
+type routingServer struct {
+	routerService.UnimplementedRoutingServiceServer
+	core *Core
+}
+
+func (r *routingServer) AddRule(ctx context.Context, req *routerService.AddRuleRequest) (*routerService.AddRuleResponse, error) {
+	msg, err := req.GetConfig().GetInstance()
+	if err != nil {
+		return nil, err
+	}
+	tags := ruleTags(msg)
+
+	c := r.core
+	c.mu.Lock()
+	for _, tag := range tags {
+		c.routeOps = append(c.routeOps, RouteOp{Tag: tag, Kind: OpAdd})
+	}
+	if len(tags) == 0 {
+		c.routeOps = append(c.routeOps, RouteOp{Kind: OpAdd})
+	}
+	c.mu.Unlock()
+
+	if err := c.intercept(ctx, MethodAddRule); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, tag := range tags {
+		if slices.Contains(c.rules, tag) {
+			if c.strict {
+				return nil, status.Errorf(codes.Unknown, "duplicate ruleTag %s", tag)
+			}
+			continue
+		}
+		if req.GetShouldAppend() {
+			c.rules = append(c.rules, tag)
+		} else {
+			c.rules = append([]string{tag}, c.rules...)
+		}
+	}
+	maps.Copy(c.ruleOutbounds, ruleOutbounds(msg))
+	return &routerService.AddRuleResponse{}, nil
+}
+
+func (r *routingServer) RemoveRule(ctx context.Context, req *routerService.RemoveRuleRequest) (*routerService.RemoveRuleResponse, error) {
+	c := r.core
+	c.mu.Lock()
+	c.routeOps = append(c.routeOps, RouteOp{Tag: req.GetRuleTag(), Kind: OpRemove})
+	c.mu.Unlock()
+
+	if err := c.intercept(ctx, MethodRemoveRule); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	idx := slices.Index(c.rules, req.GetRuleTag())
+	if idx < 0 {
+		if c.strict {
+			return nil, notFound("rule %s", req.GetRuleTag())
+		}
+		return &routerService.RemoveRuleResponse{}, nil
+	}
+	c.rules = slices.Delete(c.rules, idx, idx+1)
+	delete(c.ruleOutbounds, req.GetRuleTag())
+	return &routerService.RemoveRuleResponse{}, nil
+}
+
+func (r *routingServer) ListRule(ctx context.Context, req *routerService.ListRuleRequest) (*routerService.ListRuleResponse, error) {
+	c := r.core
+	if err := c.intercept(ctx, MethodListRule); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	resp := &routerService.ListRuleResponse{}
+	for _, tag := range c.rules {
+		resp.Rules = append(resp.Rules, &routerService.ListRuleItem{Tag: c.ruleOutbounds[tag], RuleTag: tag})
+	}
+	return resp, nil
+}
+
+// ruleTags extracts rule tags from a router.Config as built by the agent.
+func ruleTags(msg any) []string {
+	cfg, ok := msg.(*router.Config)
+	if !ok {
+		return nil
+	}
+	var tags []string
+	for _, rule := range cfg.GetRule() {
+		if tag := rule.GetRuleTag(); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// ruleOutbounds maps each tagged rule in a router.Config to its outbound tag.
+func ruleOutbounds(msg any) map[string]string {
+	cfg, ok := msg.(*router.Config)
+	if !ok {
+		return nil
+	}
+	out := map[string]string{}
+	for _, rule := range cfg.GetRule() {
+		if tag := rule.GetRuleTag(); tag != "" {
+			out[tag] = rule.GetTag()
+		}
+	}
+	return out
+}
+
+type statsServer struct {
+	statscommand.UnimplementedStatsServiceServer
+	core *Core
+}
+
+func (s *statsServer) QueryStats(ctx context.Context, req *statscommand.QueryStatsRequest) (*statscommand.QueryStatsResponse, error) {
+	c := s.core
+	if err := c.intercept(ctx, MethodQueryStats); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	names := make([]string, 0, len(c.counters))
+	for name := range c.counters {
+		if strings.Contains(name, req.GetPattern()) {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+
+	resp := &statscommand.QueryStatsResponse{}
+	for _, name := range names {
+		resp.Stat = append(resp.Stat, &statscommand.Stat{Name: name, Value: c.counters[name]})
+		if req.GetReset_() {
+			c.counters[name] = 0
+		}
+	}
+	return resp, nil
+}
+
+func (s *statsServer) GetSysStats(ctx context.Context, req *statscommand.SysStatsRequest) (*statscommand.SysStatsResponse, error) {
+	c := s.core
+	if err := c.intercept(ctx, MethodGetSysStats); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sysStats, nil
+}
+
+func (s *statsServer) GetAllOnlineUsers(ctx context.Context, req *statscommand.GetAllOnlineUsersRequest) (*statscommand.GetAllOnlineUsersResponse, error) {
+	c := s.core
+	if err := c.intercept(ctx, MethodGetAllOnlineUsers); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	users := make([]string, 0, len(c.onlineIPs))
+	for email := range c.onlineIPs {
+		users = append(users, onlineStat(email))
+	}
+	slices.Sort(users)
+	return &statscommand.GetAllOnlineUsersResponse{Users: users}, nil
+}
+
+func (s *statsServer) GetStatsOnlineIpList(ctx context.Context, req *statscommand.GetStatsRequest) (*statscommand.GetStatsOnlineIpListResponse, error) {
+	c := s.core
+	if err := c.intercept(ctx, MethodGetStatsOnlineIpList); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	resp := &statscommand.GetStatsOnlineIpListResponse{Name: req.GetName()}
+	if email, ok := emailFromOnlineStat(req.GetName()); ok {
+		resp.Ips = c.onlineIPs[email]
+	}
+	return resp, nil
+}